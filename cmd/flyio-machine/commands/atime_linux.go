@@ -0,0 +1,19 @@
+//go:build linux
+
+package commands
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// accessTime returns a file's last access time, or the zero time if the
+// platform doesn't report one
+func accessTime(fi os.FileInfo) time.Time {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}
+	}
+	return time.Unix(st.Atim.Sec, st.Atim.Nsec)
+}
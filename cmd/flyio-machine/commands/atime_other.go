@@ -0,0 +1,14 @@
+//go:build !linux
+
+package commands
+
+import (
+	"os"
+	"time"
+)
+
+// accessTime returns the zero time where access times aren't read, so
+// modification time alone decides
+func accessTime(fi os.FileInfo) time.Time {
+	return time.Time{}
+}
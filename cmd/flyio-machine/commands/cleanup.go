@@ -5,11 +5,15 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/fly-io/162719/internal/config"
 	"github.com/fly-io/162719/pkg/db"
 	"github.com/fly-io/162719/pkg/devicemapper"
 	"github.com/fly-io/162719/pkg/errors"
+	appfsm "github.com/fly-io/162719/pkg/fsm"
+	"github.com/fly-io/162719/pkg/storage"
 	"github.com/spf13/cobra"
 )
 
@@ -17,6 +21,7 @@ var (
 	cleanupAll      bool
 	cleanupImage    string
 	cleanupOrphaned bool
+	cleanupHost     string
 )
 
 var cleanupCmd = &cobra.Command{
@@ -25,7 +30,14 @@ var cleanupCmd = &cobra.Command{
 	Long: `Clean up resources associated with images:
   --all              Clean all resources for all images
   --image <s3-key>   Clean resources for specific image
-  --orphaned         Clean orphaned resources not tracked in database`,
+  --orphaned         Clean orphaned resources not tracked in database:
+                     extracted trees, downloads, leftover mounts under
+                     mounts/ and mapped devices with no image row on
+                     this host; orphaned snapshots are deleted from the
+                     pool
+
+With --host, --all and --image only touch images last written by that
+host, so hosts sharing a database leave each other's devices alone.`,
 	RunE: runCleanup,
 }
 
@@ -34,22 +46,24 @@ func init() {
 	cleanupCmd.Flags().BoolVar(&cleanupAll, "all", false, "Clean all resources")
 	cleanupCmd.Flags().StringVar(&cleanupImage, "image", "", "Clean specific image by S3 key")
 	cleanupCmd.Flags().BoolVar(&cleanupOrphaned, "orphaned", false, "Clean orphaned resources")
+	cleanupCmd.Flags().StringVar(&cleanupHost, "host", "", "Only clean images recorded on this host (see --hostname)")
 }
 
 func runCleanup(cmd *cobra.Command, args []string) error {
 	cfg, err := config.Load()
 	if err != nil {
-		return errors.Wrap(err, "config load failed")
+		return configError(errors.Wrap(err, "config load failed"))
 	}
 
-	repo, err := db.NewRepository(cfg.SQLitePath)
+	repo, err := openRepository(cfg)
 	if err != nil {
 		return errors.Wrap(err, "db init failed")
 	}
 	defer repo.Close()
 
 	// Initialize devicemapper manager (may be stub on non-Linux)
-	dmManager, err := devicemapper.NewManager("pool", devicemapper.DefaultDataSize, devicemapper.DefaultMetadataSize)
+	dmManager, err := devicemapper.NewManager("pool", devicemapper.DefaultDataSize, devicemapper.DefaultMetadataSize,
+		devicemapper.WithDevicePrefix(cfg.DevicePrefix))
 	if err != nil {
 		fmt.Printf("⚠️  Devicemapper unavailable: %v\n", err)
 		dmManager = nil
@@ -58,18 +72,26 @@ func runCleanup(cmd *cobra.Command, args []string) error {
 	ctx := context.Background()
 
 	if cleanupAll {
-		return cleanupAllImages(ctx, repo, dmManager, cfg)
+		return cleanupAllImages(ctx, repo, dmManager, cfg, cleanupHost)
 	} else if cleanupImage != "" {
-		return cleanupSpecificImage(ctx, repo, dmManager, cfg, cleanupImage)
+		return cleanupSpecificImage(ctx, repo, dmManager, cfg, cleanupImage, cleanupHost)
 	} else if cleanupOrphaned {
 		return cleanupOrphanedResources(ctx, repo, dmManager, cfg)
 	} else {
-		return fmt.Errorf("must specify --all, --image, or --orphaned")
+		return usageError(fmt.Errorf("must specify --all, --image, or --orphaned"))
 	}
 }
 
-func cleanupAllImages(ctx context.Context, repo *db.Repository, dmManager devicemapper.Manager, cfg *config.Config) error {
-	images, err := repo.List()
+// cleanupAllImages cleans every image, or with host only those recorded
+// on that host
+func cleanupAllImages(ctx context.Context, repo *db.Repository, dmManager devicemapper.Manager, cfg *config.Config, host string) error {
+	var images []*db.Image
+	var err error
+	if host != "" {
+		images, err = repo.ListByHostContext(ctx, host)
+	} else {
+		images, err = repo.ListContext(ctx)
+	}
 	if err != nil {
 		return errors.Wrap(err, "list failed")
 	}
@@ -87,11 +109,14 @@ func cleanupAllImages(ctx context.Context, repo *db.Repository, dmManager device
 	return nil
 }
 
-func cleanupSpecificImage(ctx context.Context, repo *db.Repository, dmManager devicemapper.Manager, cfg *config.Config, s3Key string) error {
+func cleanupSpecificImage(ctx context.Context, repo *db.Repository, dmManager devicemapper.Manager, cfg *config.Config, s3Key, host string) error {
 	img, err := repo.GetByS3Key(s3Key)
 	if err != nil {
 		return errors.Wrap(err, "image not found")
 	}
+	if host != "" && img != nil && img.Host != host {
+		return fmt.Errorf("image %s is recorded on host %q, not %q", s3Key, img.Host, host)
+	}
 
 	fmt.Printf("🧹 Cleaning up %s...\n", s3Key)
 
@@ -104,9 +129,28 @@ func cleanupSpecificImage(ctx context.Context, repo *db.Repository, dmManager de
 }
 
 func cleanupImageResources(ctx context.Context, repo *db.Repository, dmManager devicemapper.Manager, cfg *config.Config, img *db.Image) error {
+	if err := releaseImageResources(ctx, dmManager, cfg, img); err != nil {
+		return err
+	}
+
+	// 5. Update database status
+	img.Status = "cleaned"
+	if err := repo.Update(img); err != nil {
+		return errors.Wrap(err, "failed to update database")
+	}
+
+	return nil
+}
+
+// releaseImageResources deletes an image's snapshot and base device and
+// removes its extracted files and download, clearing the device fields on
+// img. The database record is left for the caller to update.
+func releaseImageResources(ctx context.Context, dmManager devicemapper.Manager, cfg *config.Config, img *db.Image) error {
+	layout := appfsm.NewLayout(cfg.WorkDir, cfg.ScratchDir)
+
 	// 1. Unmount and delete snapshot if exists
 	if dmManager != nil && img.SnapshotID != 0 {
-		snapshotName := fmt.Sprintf("flyio-snapshot-%d", img.SnapshotID)
+		snapshotName := devicemapper.SnapshotName(cfg.DevicePrefix, fmt.Sprintf("%d", img.SnapshotID))
 		snapshotPath := filepath.Join("/dev/mapper", snapshotName)
 
 		// Try to unmount if mounted
@@ -122,9 +166,14 @@ func cleanupImageResources(ctx context.Context, repo *db.Repository, dmManager d
 	// 2. Unmount and delete base device if exists
 	if dmManager != nil && img.BaseDeviceID > 0 {
 		deviceID := fmt.Sprintf("%d", img.BaseDeviceID)
-		devicePath := filepath.Join("/dev/mapper", fmt.Sprintf("flyio-%s", deviceID))
+		devicePath := filepath.Join("/dev/mapper", devicemapper.DeviceName(cfg.DevicePrefix, deviceID))
+
+		// A crashed run can leave the device mounted, and a mounted device
+		// can't be removed. UnmountDevice falls back to a lazy unmount.
+		if err := dmManager.UnmountDevice(ctx, layout.MountPath(deviceID)); err != nil {
+			fmt.Printf("⚠️  Unmount warning: %v\n", err)
+		}
 
-		// Try to unmount if mounted
 		if _, err := os.Stat(devicePath); err == nil {
 			if err := dmManager.DeleteDevice(ctx, deviceID); err != nil {
 				fmt.Printf("⚠️  Device cleanup warning: %v\n", err)
@@ -134,28 +183,27 @@ func cleanupImageResources(ctx context.Context, repo *db.Repository, dmManager d
 		img.DevicePath = ""
 	}
 
-	// 3. Remove extracted filesystem
-	extractedPath := filepath.Join(cfg.WorkDir, "extracted", img.S3Key)
-	if _, err := os.Stat(extractedPath); err == nil {
-		if err := os.RemoveAll(extractedPath); err != nil {
-			return errors.Wrap(err, "failed to remove extracted files")
+	// 3. Remove extracted filesystem, of the whole archive or the image's
+	// subpath. Digest-addressed trees may be shared with other images and
+	// are left for orphan cleanup.
+	for _, extractedPath := range []string{layout.ExtractPath(img.S3Key), layout.TreePath(img.S3Key, "", img.ExtractSubpath)} {
+		if _, err := os.Stat(extractedPath); err == nil {
+			if err := os.RemoveAll(extractedPath); err != nil {
+				return errors.Wrap(err, "failed to remove extracted files")
+			}
 		}
 	}
 
-	// 4. Remove downloaded tarball
-	downloadPath := filepath.Join(cfg.WorkDir, "downloads", img.S3Key)
-	if _, err := os.Stat(downloadPath); err == nil {
-		if err := os.Remove(downloadPath); err != nil {
-			return errors.Wrap(err, "failed to remove download")
+	// 4. Remove downloaded tarball, plain or compressed
+	downloadPath := layout.DownloadPath(img.S3Key)
+	for _, path := range []string{downloadPath, storage.CompressedPath(downloadPath)} {
+		if _, err := os.Stat(path); err == nil {
+			if err := os.Remove(path); err != nil {
+				return errors.Wrap(err, "failed to remove download")
+			}
 		}
 	}
 
-	// 5. Update database status
-	img.Status = "cleaned"
-	if err := repo.Update(img); err != nil {
-		return errors.Wrap(err, "failed to update database")
-	}
-
 	return nil
 }
 
@@ -164,17 +212,33 @@ func cleanupOrphanedResources(ctx context.Context, repo *db.Repository, dmManage
 
 	orphanCount := 0
 
+	// Local files are named by storage.LocalName, so map tracked keys to those names
+	images, err := repo.List()
+	if err != nil {
+		return errors.Wrap(err, "list failed")
+	}
+	layout := appfsm.NewLayout(cfg.WorkDir, cfg.ScratchDir)
+	tracked := make(map[string]bool, len(images))
+	trackedTrees := make(map[string]bool, len(images))
+	for _, img := range images {
+		tracked[storage.LocalName(img.S3Key)] = true
+		tracked[storage.CompressedPath(storage.LocalName(img.S3Key))] = true
+		tracked[filepath.Base(layout.TreePath(img.S3Key, "", img.ExtractSubpath))] = true
+		if path := layout.CachedTreePath(img.SHA256); path != "" {
+			trackedTrees[path] = true
+		}
+	}
+
 	// 1. Check for orphaned extracted directories
-	extractedDir := filepath.Join(cfg.WorkDir, "extracted")
+	extractedDir := layout.ExtractedDir()
 	if entries, err := os.ReadDir(extractedDir); err == nil {
 		for _, entry := range entries {
-			if !entry.IsDir() {
+			if !entry.IsDir() || entry.Name() == appfsm.TreeCacheDir {
 				continue
 			}
 
 			// Check if this image exists in database
-			_, err := repo.GetByS3Key(entry.Name())
-			if err != nil {
+			if !tracked[entry.Name()] {
 				// Orphaned - remove it
 				orphanPath := filepath.Join(extractedDir, entry.Name())
 				if err := os.RemoveAll(orphanPath); err != nil {
@@ -187,8 +251,31 @@ func cleanupOrphanedResources(ctx context.Context, repo *db.Repository, dmManage
 		}
 	}
 
+	// Digest-addressed trees are orphaned once no image has that digest
+	treeDir := filepath.Join(extractedDir, appfsm.TreeCacheDir)
+	if entries, err := os.ReadDir(treeDir); err == nil {
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+
+			// Trees extracted from a subpath belong to the archive's digest
+			name, _, _ := strings.Cut(entry.Name(), appfsm.SubpathTreeSeparator)
+			orphanPath := filepath.Join(treeDir, entry.Name())
+			if trackedTrees[filepath.Join(treeDir, name)] {
+				continue
+			}
+			if err := appfsm.RemoveCachedTree(orphanPath); err != nil {
+				fmt.Printf("⚠️  Failed to remove orphaned tree %s: %v\n", entry.Name(), err)
+			} else {
+				fmt.Printf("🗑️  Removed orphaned tree: %s\n", entry.Name())
+				orphanCount++
+			}
+		}
+	}
+
 	// 2. Check for orphaned downloads
-	downloadDir := filepath.Join(cfg.WorkDir, "downloads")
+	downloadDir := layout.DownloadsDir()
 	if entries, err := os.ReadDir(downloadDir); err == nil {
 		for _, entry := range entries {
 			if entry.IsDir() {
@@ -196,8 +283,7 @@ func cleanupOrphanedResources(ctx context.Context, repo *db.Repository, dmManage
 			}
 
 			// Check if this image exists in database
-			_, err := repo.GetByS3Key(entry.Name())
-			if err != nil {
+			if !tracked[entry.Name()] {
 				// Orphaned - remove it
 				orphanPath := filepath.Join(downloadDir, entry.Name())
 				if err := os.Remove(orphanPath); err != nil {
@@ -210,6 +296,150 @@ func cleanupOrphanedResources(ctx context.Context, repo *db.Repository, dmManage
 		}
 	}
 
+	// Devices are listed before the records are read. Device and snapshot
+	// IDs are recorded before the pool is touched, so one created meanwhile
+	// is already referenced by the time the records are read.
+	var devices []*devicemapper.DeviceInfo
+	var listErr error
+	if dmManager != nil {
+		devices, listErr = dmManager.ListDevices(ctx)
+	}
+
+	// Devices and mounts are host-local, so only this host's records (and
+	// those written before hosts were tracked) hold them
+	local, err := localImages(ctx, repo)
+	if err != nil {
+		return err
+	}
+	referenced, err := referencedDeviceIDs(ctx, repo, local)
+	if err != nil {
+		return err
+	}
+
+	// 3. Check for orphaned mounts. A crashed run can leave a device
+	// mounted; UnmountDevice is a no-op for a dir that isn't mounted.
+	if dmManager != nil {
+		mounts, err := findOrphanedMounts(layout.MountsDir(), referenced)
+		if err != nil {
+			return err
+		}
+		for _, mountPath := range mounts {
+			if err := dmManager.UnmountDevice(ctx, mountPath); err != nil {
+				fmt.Printf("⚠️  Failed to unmount orphaned mount %s: %v\n", mountPath, err)
+				continue
+			}
+			if err := os.Remove(mountPath); err != nil && !os.IsNotExist(err) {
+				fmt.Printf("⚠️  Failed to remove orphaned mount point %s: %v\n", mountPath, err)
+				continue
+			}
+			fmt.Printf("🗑️  Removed orphaned mount: %s\n", mountPath)
+			orphanCount++
+		}
+	}
+
+	// 4. Check for orphaned devices, mapped under our prefix with an ID
+	// no image or clone holds. Snapshots are deleted from the pool too,
+	// releasing their blocks.
+	if dmManager != nil {
+		if listErr != nil {
+			fmt.Printf("⚠️  Skipping orphaned devices: %v\n", errors.Wrap(listErr, "failed to list devices"))
+		}
+		for _, dev := range findOrphanedDevices(devices, cfg.DevicePrefix, referenced) {
+			if dev.Snapshot {
+				id, _ := strconv.Atoi(dev.ID)
+				err = dmManager.DeleteSnapshot(ctx, id)
+			} else {
+				err = dmManager.DeleteDevice(ctx, dev.ID)
+			}
+			if err != nil {
+				fmt.Printf("⚠️  Failed to remove orphaned device %s: %v\n", dev.Path, err)
+				continue
+			}
+			fmt.Printf("🗑️  Removed orphaned device: %s\n", dev.Path)
+			orphanCount++
+		}
+	}
+
 	fmt.Printf("✅ Removed %d orphaned resources\n", orphanCount)
 	return nil
 }
+
+// orphanedDevice is a mapped device no image or clone references
+type orphanedDevice struct {
+	ID       string
+	Snapshot bool
+	Path     string
+}
+
+// localImages returns the images recorded on this host, including those
+// written before hosts were tracked
+func localImages(ctx context.Context, repo *db.Repository) ([]*db.Image, error) {
+	images, err := repo.ListContext(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "list failed")
+	}
+	var local []*db.Image
+	for _, img := range images {
+		if img.Host == "" || img.Host == repo.Host() {
+			local = append(local, img)
+		}
+	}
+	return local, nil
+}
+
+// referencedDeviceIDs returns the thin device IDs held by images (base
+// devices and snapshots) and their clones. The pool numbers all of them
+// from one space, so a single set covers every kind.
+func referencedDeviceIDs(ctx context.Context, repo *db.Repository, images []*db.Image) (map[string]bool, error) {
+	referenced := make(map[string]bool)
+	for _, img := range images {
+		for _, id := range []int{img.BaseDeviceID, img.SnapshotID} {
+			if id > 0 {
+				referenced[strconv.Itoa(id)] = true
+			}
+		}
+		clones, err := repo.ListClonesContext(ctx, img.ID)
+		if err != nil {
+			return nil, errors.Wrap(err, "clone lookup failed")
+		}
+		for _, clone := range clones {
+			referenced[strconv.Itoa(clone.DeviceID)] = true
+		}
+	}
+	return referenced, nil
+}
+
+// findOrphanedMounts returns the mount points under mountsDir, which are
+// named by device ID, whose device isn't referenced. A missing dir has
+// none.
+func findOrphanedMounts(mountsDir string, referenced map[string]bool) ([]string, error) {
+	entries, err := os.ReadDir(mountsDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read mounts dir")
+	}
+
+	var orphans []string
+	for _, entry := range entries {
+		if entry.IsDir() && !referenced[entry.Name()] {
+			orphans = append(orphans, filepath.Join(mountsDir, entry.Name()))
+		}
+	}
+	return orphans, nil
+}
+
+// findOrphanedDevices returns the devices mapped under prefix whose IDs
+// aren't referenced
+func findOrphanedDevices(devices []*devicemapper.DeviceInfo, prefix string, referenced map[string]bool) []orphanedDevice {
+	var orphans []orphanedDevice
+	for _, dev := range devices {
+		id, snapshot, ok := devicemapper.ParseDeviceName(prefix, filepath.Base(dev.DevicePath))
+		if !ok || referenced[id] {
+			continue
+		}
+		orphans = append(orphans, orphanedDevice{ID: id, Snapshot: snapshot, Path: dev.DevicePath})
+	}
+	return orphans
+}
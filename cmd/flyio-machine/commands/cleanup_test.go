@@ -0,0 +1,164 @@
+package commands
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/fly-io/162719/internal/config"
+	"github.com/fly-io/162719/pkg/db"
+	"github.com/fly-io/162719/pkg/devicemapper"
+)
+
+// fakeDeviceLister reports a fixed set of mapped devices and records the
+// devices removed
+type fakeDeviceLister struct {
+	devicemapper.Manager
+	devices []*devicemapper.DeviceInfo
+	removed []string
+}
+
+func (f *fakeDeviceLister) ListDevices(ctx context.Context) ([]*devicemapper.DeviceInfo, error) {
+	return f.devices, nil
+}
+
+func (f *fakeDeviceLister) DeleteDevice(ctx context.Context, deviceID string) error {
+	f.removed = append(f.removed, "device "+deviceID)
+	return nil
+}
+
+func (f *fakeDeviceLister) DeleteSnapshot(ctx context.Context, snapshotID int) error {
+	f.removed = append(f.removed, "snapshot "+strconv.Itoa(snapshotID))
+	return nil
+}
+
+func (f *fakeDeviceLister) UnmountDevice(ctx context.Context, mountPath string) error {
+	return nil
+}
+
+func TestFindOrphans(t *testing.T) {
+	dbPath := "/tmp/test_images_cleanup.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	repo, err := db.NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	ctx := context.Background()
+	img := &db.Image{S3Key: "app.tar", Status: db.StatusReady, BaseDeviceID: 1, SnapshotID: 2}
+	if err := repo.CreateContext(ctx, img); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.CreateCloneContext(ctx, &db.Clone{ImageID: img.ID, DeviceID: 3, SourceSnapshotID: 2}); err != nil {
+		t.Fatal(err)
+	}
+	images, err := repo.ListContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	referenced, err := referencedDeviceIDs(ctx, repo, images)
+	if err != nil {
+		t.Fatalf("referencedDeviceIDs: %v", err)
+	}
+	if want := map[string]bool{"1": true, "2": true, "3": true}; !reflect.DeepEqual(referenced, want) {
+		t.Errorf("referenced = %v, want %v", referenced, want)
+	}
+
+	t.Run("mounts", func(t *testing.T) {
+		mountsDir := t.TempDir()
+		for _, name := range []string{"1", "4"} {
+			if err := os.Mkdir(filepath.Join(mountsDir, name), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.WriteFile(filepath.Join(mountsDir, "5"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := findOrphanedMounts(mountsDir, referenced)
+		if err != nil {
+			t.Fatalf("findOrphanedMounts: %v", err)
+		}
+		if want := []string{filepath.Join(mountsDir, "4")}; !reflect.DeepEqual(got, want) {
+			t.Errorf("orphaned mounts = %v, want %v", got, want)
+		}
+
+		if got, err := findOrphanedMounts(filepath.Join(mountsDir, "missing"), referenced); err != nil || got != nil {
+			t.Errorf("missing mounts dir = %v, %v; want none", got, err)
+		}
+	})
+
+	t.Run("devices", func(t *testing.T) {
+		devices := []*devicemapper.DeviceInfo{
+			{DevicePath: "/dev/mapper/flyio-1"},
+			{DevicePath: "/dev/mapper/flyio-snapshot-2", SnapshotID: 2},
+			{DevicePath: "/dev/mapper/flyio-snapshot-3", SnapshotID: 3},
+			{DevicePath: "/dev/mapper/flyio-6"},
+			{DevicePath: "/dev/mapper/flyio-snapshot-7", SnapshotID: 7},
+			{DevicePath: "/dev/mapper/other-8"},
+		}
+
+		got := findOrphanedDevices(devices, "flyio", referenced)
+		want := []orphanedDevice{
+			{ID: "6", Path: "/dev/mapper/flyio-6"},
+			{ID: "7", Snapshot: true, Path: "/dev/mapper/flyio-snapshot-7"},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("orphaned devices = %+v, want %+v", got, want)
+		}
+	})
+}
+
+func TestCleanupOrphanedResources_Devices(t *testing.T) {
+	dbPath := "/tmp/test_images_cleanup_devices.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	ctx := context.Background()
+	seed := []struct {
+		host string
+		img  *db.Image
+	}{
+		{"host-a", &db.Image{S3Key: "a.tar", Status: db.StatusReady, BaseDeviceID: 1, SnapshotID: 2}},
+		// Another host's IDs don't hold devices mapped here
+		{"host-b", &db.Image{S3Key: "b.tar", Status: db.StatusReady, BaseDeviceID: 3, SnapshotID: 4}},
+	}
+	for _, s := range seed {
+		repo, err := db.NewRepository(dbPath, db.WithHost(s.host))
+		if err != nil {
+			t.Fatalf("failed to create repository: %v", err)
+		}
+		if err := repo.CreateContext(ctx, s.img); err != nil {
+			t.Fatal(err)
+		}
+		repo.Close()
+	}
+
+	repo, err := db.NewRepository(dbPath, db.WithHost("host-a"))
+	if err != nil {
+		t.Fatalf("failed to open repository: %v", err)
+	}
+	defer repo.Close()
+
+	dm := &fakeDeviceLister{devices: []*devicemapper.DeviceInfo{
+		{DevicePath: "/dev/mapper/flyio-1"},
+		{DevicePath: "/dev/mapper/flyio-snapshot-2", SnapshotID: 2},
+		{DevicePath: "/dev/mapper/flyio-3"},
+		{DevicePath: "/dev/mapper/flyio-snapshot-4", SnapshotID: 4},
+	}}
+	cfg := &config.Config{WorkDir: t.TempDir(), DevicePrefix: "flyio"}
+	if err := cleanupOrphanedResources(ctx, repo, dm, cfg); err != nil {
+		t.Fatalf("cleanupOrphanedResources: %v", err)
+	}
+
+	if want := []string{"device 3", "snapshot 4"}; !reflect.DeepEqual(dm.removed, want) {
+		t.Errorf("removed = %v, want %v", dm.removed, want)
+	}
+}
@@ -0,0 +1,87 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/fly-io/162719/internal/config"
+	"github.com/fly-io/162719/pkg/db"
+	"github.com/fly-io/162719/pkg/devicemapper"
+	"github.com/fly-io/162719/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var cloneCmd = &cobra.Command{
+	Use:   "clone <image-key>",
+	Short: "Create a writable clone from an image's snapshot",
+	Long: `Create a writable clone of an activated image by snapshotting its
+existing snapshot. Each clone gets its own device ID and can be used
+as an independent ephemeral instance of the image.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runClone,
+}
+
+func init() {
+	rootCmd.AddCommand(cloneCmd)
+}
+
+func runClone(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+	imageKey := args[0]
+
+	cfg, err := config.Load()
+	if err != nil {
+		return configError(errors.Wrap(err, "config load failed"))
+	}
+
+	repo, err := openRepository(cfg)
+	if err != nil {
+		return errors.Wrap(err, "db init failed")
+	}
+	defer repo.Close()
+
+	img, err := repo.GetByS3KeyContext(ctx, imageKey)
+	if err != nil {
+		return errors.Wrap(err, "image lookup failed")
+	}
+	if img == nil {
+		return fmt.Errorf("image not found: %s", imageKey)
+	}
+	if img.Status != db.StatusReady || img.SnapshotID == 0 {
+		return fmt.Errorf("image %s has no active snapshot (status: %s)", imageKey, img.Status)
+	}
+
+	dmManager, err := devicemapper.NewManager("pool", devicemapper.DefaultDataSize, devicemapper.DefaultMetadataSize,
+		devicemapper.WithMetadataCriticalPercent(cfg.PoolMetadataCriticalPercent),
+		devicemapper.WithPoolTiers(poolTiers(cfg)...),
+		devicemapper.WithDevicePrefix(cfg.DevicePrefix))
+	if err != nil {
+		return deviceError(errors.Wrap(err, "devicemapper unavailable"))
+	}
+	defer dmManager.Close()
+
+	cloneID, err := repo.AllocateNextDeviceID(ctx)
+	if err != nil {
+		return errors.Wrap(err, "clone ID allocation failed")
+	}
+
+	fmt.Printf("🧬 Cloning %s (snapshot %d -> %d)...\n", imageKey, img.SnapshotID, cloneID)
+
+	info, err := dmManager.CreateSnapshot(ctx, fmt.Sprintf("%d", img.SnapshotID), cloneID)
+	if err != nil {
+		return deviceError(errors.Wrap(err, "clone creation failed"))
+	}
+
+	clone := &db.Clone{
+		ImageID:          img.ID,
+		DeviceID:         cloneID,
+		SourceSnapshotID: img.SnapshotID,
+		DevicePath:       info.DevicePath,
+	}
+	if err := repo.CreateCloneContext(ctx, clone); err != nil {
+		return errors.Wrap(err, "failed to record clone")
+	}
+
+	fmt.Printf("✅ Clone created: %s\n", info.DevicePath)
+	return nil
+}
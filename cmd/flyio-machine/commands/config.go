@@ -0,0 +1,71 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/fly-io/162719/internal/config"
+	"github.com/fly-io/162719/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var configShowJSON bool
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect configuration",
+}
+
+var configShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Show the effective configuration and where each value came from",
+	Long: `Loads the configuration the way every command does (flags, then FLYIO_*
+environment variables, then the config file, then defaults) and prints each
+setting with its resolved value and source.`,
+	Args: cobra.NoArgs,
+	RunE: runConfigShow,
+}
+
+func init() {
+	configShowCmd.Flags().BoolVar(&configShowJSON, "json", false, "Print settings as JSON")
+	configCmd.AddCommand(configShowCmd)
+	rootCmd.AddCommand(configCmd)
+}
+
+func runConfigShow(cmd *cobra.Command, args []string) error {
+	cfg, err := config.Load()
+	if err != nil {
+		return configError(errors.Wrap(err, "config load failed"))
+	}
+
+	flags := cmd.Flags()
+	settings := cfg.Settings(func(key string) bool {
+		f := flags.Lookup(key)
+		return f != nil && f.Changed
+	})
+
+	if configShowJSON {
+		return writeSettingsJSON(os.Stdout, settings)
+	}
+	return writeSettingsTable(os.Stdout, settings)
+}
+
+// writeSettingsTable prints settings as aligned KEY VALUE SOURCE columns
+func writeSettingsTable(w io.Writer, settings []config.Setting) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tVALUE\tSOURCE")
+	for _, s := range settings {
+		fmt.Fprintf(tw, "%s\t%v\t%s\n", s.Key, s.Value, s.Source)
+	}
+	return tw.Flush()
+}
+
+// writeSettingsJSON prints settings as a JSON array
+func writeSettingsJSON(w io.Writer, settings []config.Setting) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(settings)
+}
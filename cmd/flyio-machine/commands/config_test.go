@@ -0,0 +1,95 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fly-io/162719/internal/config"
+)
+
+func TestConfigSettings_ReflectsEnvOverride(t *testing.T) {
+	t.Setenv("FLYIO_S3_REGION", "eu-west-1")
+	t.Setenv("FLYIO_NOTIFY_SECRET", "hunter2")
+
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("config load: %v", err)
+	}
+	settings := cfg.Settings(func(key string) bool { return key == "source" })
+
+	byKey := map[string]config.Setting{}
+	for _, s := range settings {
+		byKey[s.Key] = s
+	}
+
+	tests := []struct {
+		key        string
+		wantValue  any
+		wantSource string
+	}{
+		{key: "s3-region", wantValue: "eu-west-1", wantSource: config.SourceEnv},
+		{key: "notify-secret", wantValue: "<redacted>", wantSource: config.SourceEnv},
+		{key: "source", wantSource: config.SourceFlag},
+		{key: "fsm-max-retries", wantValue: 5, wantSource: config.SourceDefault},
+		{key: "download-breaker-cooldown", wantValue: "30s", wantSource: config.SourceDefault},
+	}
+	for _, tt := range tests {
+		got, ok := byKey[tt.key]
+		if !ok {
+			t.Errorf("setting %s missing", tt.key)
+			continue
+		}
+		if tt.wantValue != nil && got.Value != tt.wantValue {
+			t.Errorf("%s = %v, want %v", tt.key, got.Value, tt.wantValue)
+		}
+		if got.Source != tt.wantSource {
+			t.Errorf("%s source = %s, want %s", tt.key, got.Source, tt.wantSource)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := writeSettingsJSON(&buf, settings); err != nil {
+		t.Fatalf("write JSON: %v", err)
+	}
+	var decoded []config.Setting
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("decode JSON: %v", err)
+	}
+	if len(decoded) != len(settings) {
+		t.Errorf("JSON has %d settings, want %d", len(decoded), len(settings))
+	}
+	if bytes.Contains(buf.Bytes(), []byte("hunter2")) {
+		t.Error("secret leaked into output")
+	}
+}
+
+func TestConfigLoad_ExplicitFile(t *testing.T) {
+	dir := t.TempDir()
+
+	// Unlike the discovered config.yaml, a named file must exist
+	t.Setenv("FLYIO_CONFIG", filepath.Join(dir, "missing.yaml"))
+	if _, err := config.Load(); err == nil {
+		t.Error("config load with a missing --config file succeeded")
+	}
+
+	path := filepath.Join(dir, "flyio.yaml")
+	if err := os.WriteFile(path, []byte("s3-region: ap-southeast-2\nmax-attempts: 7\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("FLYIO_CONFIG", path)
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("config load: %v", err)
+	}
+	if cfg.S3Region != "ap-southeast-2" || cfg.MaxAttempts != 7 {
+		t.Errorf("s3-region = %q, max-attempts = %d; want the file's ap-southeast-2 and 7", cfg.S3Region, cfg.MaxAttempts)
+	}
+	for _, s := range cfg.Settings(func(string) bool { return false }) {
+		if s.Key == "s3-region" && s.Source != config.SourceFile {
+			t.Errorf("s3-region source = %s, want %s", s.Source, config.SourceFile)
+		}
+	}
+}
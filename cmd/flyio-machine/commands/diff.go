@@ -0,0 +1,124 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/fly-io/162719/internal/config"
+	"github.com/fly-io/162719/pkg/db"
+	"github.com/fly-io/162719/pkg/errors"
+	appfsm "github.com/fly-io/162719/pkg/fsm"
+	"github.com/spf13/cobra"
+)
+
+var diffCmd = &cobra.Command{
+	Use:   "diff <key-a> <key-b>",
+	Short: "Compare two images' extracted trees",
+	Long: `Walk the extracted trees of two images and report the files added,
+removed and changed going from the first to the second, with the change in
+file bytes. Only the first --limit changes are listed.
+
+Images that both recorded a tree hash (fetch --tree-hash) and match are
+reported identical without walking. Both trees must still be on disk, so
+images fetched with --keep-extracted=false can't be compared.`,
+	Args: cobra.ExactArgs(2),
+	RunE: runDiff,
+}
+
+var diffLimit int
+
+func init() {
+	rootCmd.AddCommand(diffCmd)
+	diffCmd.Flags().IntVar(&diffLimit, "limit", 20, "Changes to list (0 = counts only)")
+}
+
+func runDiff(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+
+	if diffLimit < 0 {
+		return usageError(fmt.Errorf("--limit must be non-negative"))
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		return configError(errors.Wrap(err, "config load failed"))
+	}
+
+	if err := ensureDirectories(cfg.SQLitePath, "", ""); err != nil {
+		return err
+	}
+	repo, err := openRepository(cfg)
+	if err != nil {
+		return errors.Wrap(err, "db init failed")
+	}
+	defer repo.Close()
+
+	layout := appfsm.NewLayout(cfg.WorkDir, cfg.ScratchDir)
+	var images [2]*db.Image
+	var trees [2]string
+	for i, key := range args {
+		img, err := repo.GetByS3KeyContext(ctx, key)
+		if err != nil {
+			return errors.Wrap(err, "image lookup failed")
+		}
+		if img == nil {
+			return fmt.Errorf("image not found: %s", key)
+		}
+		images[i] = img
+		trees[i] = layout.TreePath(img.S3Key, img.SHA256, img.ExtractSubpath)
+	}
+
+	if a, b := images[0].TreeHash, images[1].TreeHash; a != "" && a == b {
+		fmt.Printf("✅ %s and %s are identical (tree hash %s)\n", args[0], args[1], a)
+		return nil
+	}
+	for i, tree := range trees {
+		if _, err := os.Stat(tree); err != nil {
+			return fmt.Errorf("extracted tree of %s not found at %s", args[i], tree)
+		}
+	}
+
+	diff, err := appfsm.DiffTrees(trees[0], trees[1])
+	if err != nil {
+		return err
+	}
+	writeTreeDiff(os.Stdout, args[0], args[1], diff, diffLimit)
+	return nil
+}
+
+// writeTreeDiff prints the change counts and the first limit changes
+func writeTreeDiff(w io.Writer, keyA, keyB string, diff *appfsm.TreeDiff, limit int) {
+	if len(diff.Changes) == 0 {
+		fmt.Fprintf(w, "✅ %s and %s are identical\n", keyA, keyB)
+		return
+	}
+
+	fmt.Fprintf(w, "📊 %s → %s: %d added, %d removed, %d changed (%s)\n",
+		keyA, keyB, diff.Added, diff.Removed, diff.Changed, formatSizeDelta(diff.SizeDelta))
+	marks := map[string]string{appfsm.ChangeAdded: "+", appfsm.ChangeRemoved: "-", appfsm.ChangeChanged: "~"}
+	for i, c := range diff.Changes {
+		if i == limit {
+			fmt.Fprintf(w, "   ... and %d more\n", len(diff.Changes)-limit)
+			break
+		}
+		fmt.Fprintf(w, "   %s %s (%s)\n", marks[c.Kind], c.Path, formatSizeDelta(c.SizeDelta))
+	}
+}
+
+// formatSizeDelta renders a signed byte count, e.g. "+1.5 KB" or "-20 B"
+func formatSizeDelta(n int64) string {
+	sign := "+"
+	if n < 0 {
+		sign, n = "-", -n
+	}
+	switch {
+	case n >= 1024*1024:
+		return fmt.Sprintf("%s%.1f MB", sign, float64(n)/1024/1024)
+	case n >= 1024:
+		return fmt.Sprintf("%s%.1f KB", sign, float64(n)/1024)
+	default:
+		return fmt.Sprintf("%s%d B", sign, n)
+	}
+}
@@ -0,0 +1,37 @@
+package commands
+
+import (
+	"bytes"
+	"testing"
+
+	appfsm "github.com/fly-io/162719/pkg/fsm"
+)
+
+func TestWriteTreeDiff(t *testing.T) {
+	diff := &appfsm.TreeDiff{
+		Changes: []appfsm.TreeChange{
+			{Path: "etc/hostname", Kind: appfsm.ChangeChanged, SizeDelta: 5},
+			{Path: "etc/motd", Kind: appfsm.ChangeRemoved, SizeDelta: -7},
+			{Path: "usr/lib/libssl.so", Kind: appfsm.ChangeAdded, SizeDelta: 3 * 1024 * 1024},
+		},
+		Added: 1, Removed: 1, Changed: 1,
+		SizeDelta: 3*1024*1024 - 2,
+	}
+
+	var out bytes.Buffer
+	writeTreeDiff(&out, "a.tar", "b.tar", diff, 2)
+	want := `📊 a.tar → b.tar: 1 added, 1 removed, 1 changed (+3.0 MB)
+   ~ etc/hostname (+5 B)
+   - etc/motd (-7 B)
+   ... and 1 more
+`
+	if out.String() != want {
+		t.Errorf("output:\n%s\nwant:\n%s", out.String(), want)
+	}
+
+	out.Reset()
+	writeTreeDiff(&out, "a.tar", "b.tar", &appfsm.TreeDiff{}, 2)
+	if want := "✅ a.tar and b.tar are identical\n"; out.String() != want {
+		t.Errorf("output = %q, want %q", out.String(), want)
+	}
+}
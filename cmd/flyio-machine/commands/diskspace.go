@@ -0,0 +1,78 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/fly-io/162719/pkg/errors"
+	appfsm "github.com/fly-io/162719/pkg/fsm"
+	"github.com/fly-io/162719/pkg/storage"
+)
+
+// ErrInsufficientSpace is returned when a filesystem can't hold an image
+var ErrInsufficientSpace = errors.New("insufficient disk space")
+
+// availableBytes reports the space available to unprivileged writers on
+// the filesystem holding path; replaced in tests
+var availableBytes = freeBytes
+
+// checkDiskSpace refuses with ErrInsufficientSpace if the filesystem
+// holding path has less than needed bytes available. path need not exist
+// yet: its nearest existing ancestor decides the filesystem.
+func checkDiskSpace(path string, needed int64) error {
+	dir := path
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+
+	available, err := availableBytes(dir)
+	if err != nil {
+		return errors.Wrap(err, "failed to check free space")
+	}
+	if available < needed {
+		return errors.Fatal(fmt.Errorf("%w on %s: need %.1f MB, %.1f MB available",
+			ErrInsufficientSpace, dir, float64(needed)/1024/1024, float64(available)/1024/1024))
+	}
+	return nil
+}
+
+// checkDownloadSpace makes sure the downloads dir can hold the object
+// before a fetch starts, so a full disk fails up front instead of partway
+// through the download. An existing download of the key is replaced, so
+// its size counts as free. If the object size can't be read the check is
+// skipped and the download reports the real problem.
+func checkDownloadSpace(ctx context.Context, source storage.Source, layout appfsm.Layout, key string) error {
+	info, err := source.Head(ctx, key)
+	if err != nil {
+		slog.Warn("disk_space_check_skipped", "s3_key", key, "error", err)
+		return nil
+	}
+
+	needed := info.Size
+	if fi, err := os.Stat(layout.DownloadPath(key)); err == nil && fi.Mode().IsRegular() {
+		needed -= fi.Size()
+	}
+	if needed <= 0 {
+		return nil
+	}
+
+	err = checkDiskSpace(layout.DownloadsDir(), needed)
+	if errors.Is(err, ErrInsufficientSpace) {
+		slog.Error("disk_space_insufficient", "s3_key", key, "needed", needed, "error", err)
+		return err
+	}
+	if err != nil {
+		slog.Warn("disk_space_check_skipped", "s3_key", key, "error", err)
+	}
+	return nil
+}
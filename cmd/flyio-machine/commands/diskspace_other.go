@@ -0,0 +1,13 @@
+//go:build !(linux || darwin || freebsd)
+
+package commands
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// freeBytes is unsupported here, so disk space checks are skipped
+func freeBytes(path string) (int64, error) {
+	return 0, fmt.Errorf("free space check not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,80 @@
+package commands
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fly-io/162719/pkg/errors"
+	appfsm "github.com/fly-io/162719/pkg/fsm"
+	"github.com/fly-io/162719/pkg/storage"
+)
+
+// fakeAvailable makes availableBytes report avail bytes for the test
+func fakeAvailable(t *testing.T, avail int64) *[]string {
+	t.Helper()
+	var asked []string
+	orig := availableBytes
+	availableBytes = func(path string) (int64, error) {
+		asked = append(asked, path)
+		return avail, nil
+	}
+	t.Cleanup(func() { availableBytes = orig })
+	return &asked
+}
+
+func TestCheckDiskSpace(t *testing.T) {
+	dir := t.TempDir()
+	asked := fakeAvailable(t, 1000)
+
+	if err := checkDiskSpace(filepath.Join(dir, "work", "downloads"), 1000); err != nil {
+		t.Errorf("checkDiskSpace with exactly enough room: %v", err)
+	}
+	// The missing path resolves to its nearest existing ancestor
+	if len(*asked) != 1 || (*asked)[0] != dir {
+		t.Errorf("statfs asked about %v, want [%s]", *asked, dir)
+	}
+
+	err := checkDiskSpace(dir, 1001)
+	if !errors.Is(err, ErrInsufficientSpace) {
+		t.Fatalf("checkDiskSpace over the available space: err = %v, want ErrInsufficientSpace", err)
+	}
+	if !errors.IsFatal(err) {
+		t.Errorf("insufficient space should not be retried: %v", err)
+	}
+}
+
+func TestCheckDownloadSpace(t *testing.T) {
+	sourceDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(sourceDir, "app.tar"), make([]byte, 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+	source, err := storage.NewLocalSource(sourceDir, storage.ClientOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	layout := appfsm.NewLayout(t.TempDir(), "")
+	ctx := context.Background()
+
+	fakeAvailable(t, 1024)
+	if err := checkDownloadSpace(ctx, source, layout, "app.tar"); !errors.Is(err, ErrInsufficientSpace) {
+		t.Fatalf("4KB object with 1KB free: err = %v, want ErrInsufficientSpace", err)
+	}
+
+	// A stale download of the key is replaced, so its space counts as free
+	if err := os.MkdirAll(layout.DownloadsDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(layout.DownloadPath("app.tar"), make([]byte, 3072), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkDownloadSpace(ctx, source, layout, "app.tar"); err != nil {
+		t.Errorf("4KB object replacing a 3KB download with 1KB free: %v", err)
+	}
+
+	// An object that can't be sized is left for the download to report
+	if err := checkDownloadSpace(ctx, source, layout, "missing.tar"); err != nil {
+		t.Errorf("missing object: %v, want the check skipped", err)
+	}
+}
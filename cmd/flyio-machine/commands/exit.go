@@ -0,0 +1,159 @@
+package commands
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/fly-io/162719/pkg/devicemapper"
+	"github.com/fly-io/162719/pkg/errors"
+	appfsm "github.com/fly-io/162719/pkg/fsm"
+	"github.com/fly-io/162719/pkg/security"
+	"github.com/fly-io/162719/pkg/storage"
+	"github.com/spf13/cobra"
+)
+
+// Process exit codes. Automation keys off these, so existing codes never
+// change meaning; new failure classes get new codes.
+const (
+	exitOK       = 0
+	exitFailure  = 1 // anything not covered below
+	exitUsage    = 2 // bad command line: unknown command, flag or argument
+	exitConfig   = 3 // configuration failed to load or validate
+	exitNetwork  = 4 // image source unreachable, object missing, access denied or corrupt in transit
+	exitRejected = 5 // image rejected by validation or security checks
+	exitDevice   = 6 // devicemapper unavailable or a device operation failed
+)
+
+const exitCodesHelp = `Exit codes:
+  0  success
+  1  other error
+  2  usage error (unknown command, bad flag or argument)
+  3  configuration error
+  4  S3 or network error (unreachable, object missing, access denied)
+  5  image rejected by validation or security checks
+  6  devicemapper error`
+
+// exitKinds names each failure exit code in --json error envelopes
+var exitKinds = map[int]string{
+	exitFailure:  "failure",
+	exitUsage:    "usage",
+	exitConfig:   "config",
+	exitNetwork:  "network",
+	exitRejected: "rejected",
+	exitDevice:   "device",
+}
+
+// exitError tags an error with the exit code it should produce
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Unwrap() error { return e.err }
+
+func withExitCode(err error, code int) error {
+	if err == nil {
+		return nil
+	}
+	return &exitError{code: code, err: err}
+}
+
+// usageError marks err as caused by the command line
+func usageError(err error) error { return withExitCode(err, exitUsage) }
+
+// configError marks err as caused by the configuration
+func configError(err error) error { return withExitCode(err, exitConfig) }
+
+// deviceError marks err as a devicemapper failure
+func deviceError(err error) error { return withExitCode(err, exitDevice) }
+
+// exitCode maps an error returned by a command to the process exit code.
+// An explicit tag wins; otherwise the typed errors in the chain decide.
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+
+	var tagged *exitError
+	if errors.As(err, &tagged) {
+		return tagged.code
+	}
+
+	switch {
+	case errors.Is(err, security.ErrRejected),
+		errors.Is(err, appfsm.ErrNotRootfs),
+		errors.Is(err, appfsm.ErrHostCapacityExceeded),
+		errors.Is(err, appfsm.ErrContentTypeNotAllowed),
+		errors.Is(err, devicemapper.ErrTarbomb):
+		return exitRejected
+	case errors.Is(err, storage.ErrNotFound),
+		errors.Is(err, storage.ErrAccessDenied),
+		errors.Is(err, storage.ErrNetwork),
+		errors.Is(err, storage.ErrChecksumMismatch):
+		return exitNetwork
+	case errors.Is(err, devicemapper.ErrMetadataSpaceCritical),
+		errors.Is(err, devicemapper.ErrFilesystemUncorrectable),
+		errors.Is(err, appfsm.ErrInsufficientPoolSpace):
+		return exitDevice
+	}
+	return exitFailure
+}
+
+// commandRan is set once a command's RunE starts. Errors cobra returns
+// before that come from parsing the command line.
+var commandRan bool
+
+// trackCommandRuns wraps the RunE of cmd and all its subcommands to set
+// commandRan
+func trackCommandRuns(cmd *cobra.Command) {
+	if runE := cmd.RunE; runE != nil {
+		cmd.RunE = func(c *cobra.Command, args []string) error {
+			commandRan = true
+			return runE(c, args)
+		}
+	}
+	for _, sub := range cmd.Commands() {
+		trackCommandRuns(sub)
+	}
+}
+
+// errorEnvelope is the JSON form of a command failure written to stderr
+// with --json
+type errorEnvelope struct {
+	Error    string `json:"error"`
+	Kind     string `json:"kind"`
+	ExitCode int    `json:"exit_code"`
+	ImageKey string `json:"image_key"`
+}
+
+// jsonErrorsRequested reports whether args ask for --json. It is decided
+// before parsing so that errors from parsing itself are rendered as JSON
+// too.
+func jsonErrorsRequested(args []string) bool {
+	for _, arg := range args {
+		switch arg {
+		case "--":
+			return false
+		case "--json", "--json=true":
+			return true
+		}
+	}
+	return false
+}
+
+// writeJSONError writes err as an errorEnvelope line to w. cmd is the
+// command that failed, used to find the image key among its arguments.
+func writeJSONError(w io.Writer, cmd *cobra.Command, err error) {
+	code := exitCode(err)
+	env := errorEnvelope{
+		Error:    err.Error(),
+		Kind:     exitKinds[code],
+		ExitCode: code,
+	}
+	if cmd != nil && strings.Contains(cmd.Use, "<image-key>") && cmd.Flags().NArg() > 0 {
+		env.ImageKey = cmd.Flags().Arg(0)
+	}
+	json.NewEncoder(w).Encode(env)
+}
@@ -0,0 +1,160 @@
+package commands
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fly-io/162719/pkg/devicemapper"
+	appfsm "github.com/fly-io/162719/pkg/fsm"
+)
+
+// writeExitTestTar writes a tarball holding one file of size bytes
+func writeExitTestTar(t *testing.T, path string, size int) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("create tar: %v", err)
+	}
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+	if err := tw.WriteHeader(&tar.Header{Name: "etc/hostname", Mode: 0644, Size: int64(size), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatalf("write header: %v", err)
+	}
+	if _, err := tw.Write([]byte(strings.Repeat("x", size))); err != nil {
+		t.Fatalf("write body: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close tar: %v", err)
+	}
+}
+
+func TestExecute_ExitCodes(t *testing.T) {
+	dir := t.TempDir()
+	sourceDir := filepath.Join(dir, "source")
+	if err := os.MkdirAll(sourceDir, 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	writeExitTestTar(t, filepath.Join(sourceDir, "big.tar"), 4096)
+	t.Setenv("FLYIO_WORK_DIR", filepath.Join(dir, "work"))
+
+	// Flag values stick to the shared command tree between runs, so every
+	// fetch spells out the ones it depends on
+	fetchArgs := func(source, key string, extra ...string) []string {
+		args := []string{
+			"--sqlite-path", filepath.Join(dir, "images.db"),
+			"--fsm-db-path", filepath.Join(dir, key+".fsm.db"),
+			"--source", source,
+			"--source-dir", sourceDir,
+			"--max-file-size", "1024",
+		}
+		return append(append(args, extra...), "fetch-and-create", key)
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		want int
+	}{
+		{name: "unknown command", args: []string{"frobnicate"}, want: exitUsage},
+		{name: "unknown flag", args: []string{"list", "--no-such-flag"}, want: exitUsage},
+		{name: "missing argument", args: []string{"fetch-and-create"}, want: exitUsage},
+		{name: "missing required flag", args: []string{"export"}, want: exitUsage},
+		{name: "invalid config", args: fetchArgs("ftp", "any.tar"), want: exitConfig},
+		{name: "object missing from source", args: fetchArgs("local", "missing.tar"), want: exitNetwork},
+		{name: "image rejected by validator", args: fetchArgs("local", "big.tar"), want: exitRejected},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := execute(tt.args); got != tt.want {
+				t.Errorf("execute(%q) = %d, want %d", tt.args, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "success", err: nil, want: exitOK},
+		{name: "untyped", err: fmt.Errorf("boom"), want: exitFailure},
+		{name: "tagged usage", err: usageError(fmt.Errorf("bad flag")), want: exitUsage},
+		{name: "tagged config", err: configError(fmt.Errorf("bad config")), want: exitConfig},
+		{name: "tagged device", err: deviceError(fmt.Errorf("dmsetup failed")), want: exitDevice},
+		{name: "not a rootfs", err: fmt.Errorf("validate: %w", appfsm.ErrNotRootfs), want: exitRejected},
+		{name: "pool metadata full", err: fmt.Errorf("create: %w", devicemapper.ErrMetadataSpaceCritical), want: exitDevice},
+		{name: "pool too small", err: fmt.Errorf("create: %w", appfsm.ErrInsufficientPoolSpace), want: exitDevice},
+		{name: "outer tag wins", err: configError(fmt.Errorf("x: %w", appfsm.ErrNotRootfs)), want: exitConfig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exitCode(tt.err); got != tt.want {
+				t.Errorf("exitCode(%v) = %d, want %d", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExecute_JSONErrorEnvelope(t *testing.T) {
+	dir := t.TempDir()
+	var stderr bytes.Buffer
+	rootCmd.SetErr(&stderr)
+	defer rootCmd.SetErr(nil)
+
+	tests := []struct {
+		name string
+		args []string
+		want errorEnvelope
+	}{
+		{
+			name: "config failure names the image",
+			args: []string{"--json", "--sqlite-path", filepath.Join(dir, "images.db"), "--source", "ftp", "fetch-and-create", "images/alpine.tar"},
+			want: errorEnvelope{Kind: "config", ExitCode: exitConfig, ImageKey: "images/alpine.tar"},
+		},
+		{
+			name: "parse failure",
+			args: []string{"frobnicate", "--json"},
+			want: errorEnvelope{Kind: "usage", ExitCode: exitUsage},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stderr.Reset()
+			if got := execute(tt.args); got != tt.want.ExitCode {
+				t.Errorf("exit code = %d, want %d", got, tt.want.ExitCode)
+			}
+
+			var got errorEnvelope
+			dec := json.NewDecoder(&stderr)
+			if err := dec.Decode(&got); err != nil {
+				t.Fatalf("stderr is not a JSON envelope: %v", err)
+			}
+			if dec.More() {
+				t.Errorf("stderr has output after the envelope")
+			}
+			if got.Error == "" {
+				t.Error("envelope has no error message")
+			}
+			got.Error = ""
+			if got != tt.want {
+				t.Errorf("envelope = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	// Without --json the human line is unchanged
+	stderr.Reset()
+	execute([]string{"frobnicate"})
+	if !strings.HasPrefix(stderr.String(), "Error: ") {
+		t.Errorf("human stderr = %q, want an Error: line", stderr.String())
+	}
+}
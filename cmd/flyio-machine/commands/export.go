@@ -0,0 +1,58 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/fly-io/162719/internal/config"
+	"github.com/fly-io/162719/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var exportOut string
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Dump the images database to JSON",
+	Long: `Write every image with its labels, clones and scanned packages to a
+JSON file, for moving images to another host with import.`,
+	Args: cobra.NoArgs,
+	RunE: runExport,
+}
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+	exportCmd.Flags().StringVar(&exportOut, "out", "", "File to write the dump to")
+	exportCmd.MarkFlagRequired("out")
+}
+
+func runExport(cmd *cobra.Command, args []string) error {
+	cfg, err := config.Load()
+	if err != nil {
+		return configError(errors.Wrap(err, "config load failed"))
+	}
+
+	repo, err := openRepository(cfg)
+	if err != nil {
+		return errors.Wrap(err, "db init failed")
+	}
+	defer repo.Close()
+
+	dump, err := repo.ExportContext(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "export failed")
+	}
+
+	data, err := json.MarshalIndent(dump, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to encode dump")
+	}
+	if err := os.WriteFile(exportOut, append(data, '\n'), 0644); err != nil {
+		return errors.Wrap(err, "failed to write dump")
+	}
+
+	fmt.Printf("📤 Exported %d images to %s\n", len(dump.Images), exportOut)
+	return nil
+}
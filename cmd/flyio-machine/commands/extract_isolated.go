@@ -0,0 +1,38 @@
+package commands
+
+import (
+	"os"
+
+	"github.com/fly-io/162719/pkg/devicemapper"
+	"github.com/fly-io/162719/pkg/errors"
+	"github.com/fly-io/162719/pkg/security"
+	"github.com/spf13/cobra"
+)
+
+// extractIsolatedCmd is the child half of --isolate-extraction: the
+// binary re-executes itself as this command, in a new mount namespace,
+// to extract the tar stream on stdin
+var extractIsolatedCmd = &cobra.Command{
+	Use:    devicemapper.IsolatedExtractCommand + " <dest-dir> <spec-json>",
+	Short:  "Extract a tar stream from stdin in isolation (internal)",
+	Hidden: true,
+	// The parent reads the last line of output as the error
+	SilenceUsage: true,
+	Args:         cobra.ExactArgs(2),
+	RunE:         runExtractIsolated,
+}
+
+func init() {
+	rootCmd.AddCommand(extractIsolatedCmd)
+}
+
+func runExtractIsolated(cmd *cobra.Command, args []string) error {
+	err := devicemapper.RunIsolatedExtract(args[0], args[1], os.Stdin)
+	if errors.Is(err, security.ErrRejected) || errors.Is(err, devicemapper.ErrTarbomb) {
+		return withExitCode(err, devicemapper.IsolatedExitRejected)
+	}
+	if errors.Is(err, devicemapper.ErrDiskFull) {
+		return withExitCode(err, devicemapper.IsolatedExitDiskFull)
+	}
+	return err
+}
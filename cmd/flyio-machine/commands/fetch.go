@@ -2,14 +2,18 @@ package commands
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
+	"os"
 	"time"
 
 	"github.com/fly-io/162719/internal/config"
 	"github.com/fly-io/162719/pkg/db"
 	"github.com/fly-io/162719/pkg/devicemapper"
 	"github.com/fly-io/162719/pkg/errors"
+	"github.com/fly-io/162719/pkg/events"
 	appfsm "github.com/fly-io/162719/pkg/fsm"
+	"github.com/fly-io/162719/pkg/notify"
 	"github.com/fly-io/162719/pkg/security"
 	"github.com/fly-io/162719/pkg/storage"
 	"github.com/spf13/cobra"
@@ -23,8 +27,43 @@ var fetchCmd = &cobra.Command{
 	RunE:  runFetch,
 }
 
+var (
+	fetchKeepDownload     bool
+	fetchKeepExtracted    bool
+	fetchPostHook         string
+	fetchPostHookFailure  string
+	fetchTmpfsWorkDir     bool
+	fetchTmpfsSize        string
+	fetchRequireRootfs    bool
+	fetchTreeHash         bool
+	fetchTimeoutSeconds   int
+	fetchForce            bool
+	fetchImageRef         bool
+	fetchCheckDiskSpace   bool
+	fetchTrace            bool
+	fetchKeepFailed       bool
+	fetchCompressDownload bool
+	fetchStripPrefix      string
+)
+
 func init() {
 	rootCmd.AddCommand(fetchCmd)
+	fetchCmd.Flags().BoolVar(&fetchKeepDownload, "keep-download", true, "Keep the downloaded tarball after a successful build")
+	fetchCmd.Flags().BoolVar(&fetchCompressDownload, "compress-download", false, "Re-compress the kept download with zstd once the image is ready (decompressed again on reuse)")
+	fetchCmd.Flags().BoolVar(&fetchKeepExtracted, "keep-extracted", true, "Keep the extracted tree after a successful build")
+	fetchCmd.Flags().StringVar(&fetchPostHook, "post-hook", "", "Executable to run once the image is ready (FLYIO_* variables describe it)")
+	fetchCmd.Flags().StringVar(&fetchPostHookFailure, "post-hook-failure", hookFailureFail, "On post-hook failure: fail (mark image failed) or warn")
+	fetchCmd.Flags().BoolVar(&fetchTmpfsWorkDir, "tmpfs-work-dir", false, "Mount a tmpfs over the scratch dir for this run (Linux only)")
+	fetchCmd.Flags().StringVar(&fetchTmpfsSize, "tmpfs-size", "8G", "Size of the --tmpfs-work-dir mount (e.g. 512M, 8G)")
+	fetchCmd.Flags().BoolVar(&fetchRequireRootfs, "require-rootfs", false, "Fail images without /etc and /bin or /usr at the top level (default: warn)")
+	fetchCmd.Flags().BoolVar(&fetchTreeHash, "tree-hash", false, "Record a digest of the extracted tree for later tamper checks")
+	fetchCmd.Flags().BoolVar(&fetchImageRef, "image-ref", false, "Treat the argument as a container registry reference (e.g. ghcr.io/org/app:1.2) and pull it from the registry")
+	fetchCmd.Flags().BoolVar(&fetchCheckDiskSpace, "check-disk-space", true, "Refuse to start if the work dir's filesystem can't hold the object")
+	fetchCmd.Flags().BoolVar(&fetchKeepFailed, "keep-failed", false, "On a validation or device creation failure, move the extracted tree to the failed dir instead of deleting it")
+	fetchCmd.Flags().BoolVar(&fetchTrace, "trace", false, "Print the time spent in each FSM state once the run ends")
+	fetchCmd.Flags().BoolVar(&fetchForce, "force", false, "Process the image even if it is already ready")
+	fetchCmd.Flags().StringVar(&fetchStripPrefix, "strip-prefix", "", "Extract only the tarball's entries under this directory (e.g. rootfs), at the root of the device")
+	fetchCmd.Flags().IntVar(&fetchTimeoutSeconds, "timeout-seconds", 0, "Deadline for this image's run in seconds, overriding --fetch-timeout (0 = use it)")
 }
 
 func runFetch(cmd *cobra.Command, args []string) error {
@@ -33,10 +72,33 @@ func runFetch(cmd *cobra.Command, args []string) error {
 
 	cfg, err := config.Load()
 	if err != nil {
-		return errors.Wrap(err, "config load failed")
+		return configError(errors.Wrap(err, "config load failed"))
 	}
 	if err := cfg.Validate(); err != nil {
-		return errors.Wrap(err, "config invalid")
+		return configError(errors.Wrap(err, "config invalid"))
+	}
+	if err := validateHookFailureMode(fetchPostHookFailure); err != nil {
+		return usageError(err)
+	}
+	if fetchTimeoutSeconds < 0 {
+		return usageError(fmt.Errorf("--timeout-seconds must be non-negative"))
+	}
+	if fetchImageRef {
+		if _, err := storage.ParseReference(imageKey); err != nil {
+			return usageError(err)
+		}
+	}
+	var subpath string
+	if fetchStripPrefix != "" {
+		if subpath, err = devicemapper.CleanSubpath(fetchStripPrefix); err != nil {
+			return usageError(fmt.Errorf("--strip-prefix: %w", err))
+		}
+	}
+	var tmpfsSize int64
+	if fetchTmpfsWorkDir {
+		if tmpfsSize, err = parseByteSize(fetchTmpfsSize); err != nil {
+			return usageError(errors.Wrap(err, "invalid --tmpfs-size"))
+		}
 	}
 
 	// Ensure all necessary directories exist
@@ -44,21 +106,49 @@ func runFetch(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	repo, err := db.NewRepository(cfg.SQLitePath)
+	repo, err := openRepository(cfg)
 	if err != nil {
 		return errors.Wrap(err, "db init failed")
 	}
 	defer repo.Close()
 
-	s3Client, err := storage.NewClient(ctx, cfg.S3Bucket, cfg.S3Region)
+	// Only one fetch per key may run at a time; a concurrent invocation
+	// would race on the image row and work directories
+	lock, err := repo.AcquireLock(ctx, imageKey, db.DefaultLockStaleAfter)
+	if err != nil {
+		return errors.Wrap(err, "fetch lock failed")
+	}
+	defer lock.Release(ctx)
+
+	// A ready image needs no clients, devices or FSM run
+	if _, skipped, err := skipReady(ctx, repo, []string{imageKey}, fetchForce); err != nil {
+		return err
+	} else if skipped > 0 {
+		fmt.Printf("⏭️  %s already ready, skipped (--force to process it again)\n", imageKey)
+		if fetchPostHook != "" {
+			return runFetchPostHook(ctx, repo, imageKey)
+		}
+		return nil
+	}
+
+	source, err := newSource(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	registry, err := storage.NewRegistrySource(nil, storage.ClientOptions{HashAlgorithm: cfg.HashAlgorithm})
 	if err != nil {
-		return errors.Wrap(err, "S3 client failed")
+		return errors.Wrap(err, "registry source failed")
 	}
 
-	validator := security.NewValidator(cfg.MaxFileSize, cfg.MaxTotalSize, cfg.MaxCompressionRatio)
+	validator := security.NewValidator(cfg.MaxFileSize, cfg.MaxTotalSize, cfg.MaxCompressionRatio,
+		security.WithMaxSymlinkTarget(cfg.MaxSymlinkTarget),
+		security.WithAbsoluteSymlinkAllowlist(cfg.SymlinkAllowlist...))
 
 	// Initialize devicemapper (stub on non-Linux)
-	dmManager, err := devicemapper.NewManager("pool", devicemapper.DefaultDataSize, devicemapper.DefaultMetadataSize)
+	dmManager, err := devicemapper.NewManager("pool", devicemapper.DefaultDataSize, devicemapper.DefaultMetadataSize,
+		devicemapper.WithMetadataCriticalPercent(cfg.PoolMetadataCriticalPercent),
+		devicemapper.WithPoolTiers(poolTiers(cfg)...),
+		devicemapper.WithDevicePrefix(cfg.DevicePrefix))
 	if err != nil {
 		slog.Warn("devicemapper unavailable", "error", err)
 	}
@@ -66,6 +156,26 @@ func runFetch(cmd *cobra.Command, args []string) error {
 		defer dmManager.Close()
 	}
 
+	// Downloads and extracted trees live under the scratch dir, so that is
+	// what moves into memory
+	if fetchTmpfsWorkDir {
+		scratchDir := appfsm.NewLayout(cfg.WorkDir, cfg.ScratchDir).ScratchDir
+		unmount, err := mountTmpfsWorkDir(ctx, dmManager, scratchDir, tmpfsSize)
+		if err != nil {
+			return err
+		}
+		defer unmount()
+	}
+
+	// Registry images are sized by their layers, which aren't known until
+	// the manifest is fetched
+	if fetchCheckDiskSpace && !fetchImageRef {
+		layout := appfsm.NewLayout(cfg.WorkDir, cfg.ScratchDir)
+		if err := checkDownloadSpace(ctx, source, layout, imageKey); err != nil {
+			return err
+		}
+	}
+
 	fsmDBPath := cfg.FSMDBPath
 
 	manager, err := fsm.New(fsm.Config{DBPath: fsmDBPath})
@@ -74,30 +184,265 @@ func runFetch(cmd *cobra.Command, args []string) error {
 	}
 	defer manager.Shutdown(10 * time.Second)
 
-	machine := appfsm.NewMachine(repo, s3Client, validator, dmManager, cfg.WorkDir, cfg.FSMMaxRetries)
+	opts := []appfsm.Option{appfsm.WithClock(commandClock), appfsm.WithRegistrySource(registry), appfsm.WithRunIDKey(cfg.RunIDLogKey)}
+	if cfg.DeviceIDBlockSize > 1 {
+		allocator, err := repo.NewIDAllocator(cfg.DeviceIDBlockSize)
+		if err != nil {
+			return errors.Wrap(err, "device ID allocator failed")
+		}
+		opts = append(opts, appfsm.WithDeviceIDAllocator(allocator))
+	}
+	if cfg.ScratchDir != "" {
+		opts = append(opts, appfsm.WithScratchDir(cfg.ScratchDir))
+	}
+	extractOpts := extractOptions(cfg)
+	opts = append(opts, appfsm.WithExtractOptions(extractOpts))
+	if cfg.DownloadBreakerThreshold > 0 {
+		opts = append(opts, appfsm.WithDownloadBreaker(storage.NewBreaker(cfg.DownloadBreakerThreshold, cfg.DownloadBreakerCooldown, commandClock)))
+	}
+	if len(cfg.TrustedPrefixes) > 0 {
+		opts = append(opts, appfsm.WithTrustedPrefixes(cfg.TrustedPrefixes...))
+	}
+	if len(cfg.RequireContentTypes) > 0 {
+		opts = append(opts, appfsm.WithRequiredContentTypes(cfg.RequireContentTypes...))
+	}
+	if cfg.StorageDriver != "" {
+		opts = append(opts, appfsm.WithStorageDriver(cfg.StorageDriver))
+	}
+	if cfg.DeviceHeadroom > 0 {
+		opts = append(opts, appfsm.WithDeviceHeadroom(cfg.DeviceHeadroom))
+	}
+	if fetchRequireRootfs {
+		opts = append(opts, appfsm.WithRequireRootfs())
+	}
+	if fetchTreeHash {
+		opts = append(opts, appfsm.WithTreeHash())
+	}
+	if fetchKeepFailed {
+		opts = append(opts, appfsm.WithKeepFailed())
+	}
+	if cfg.StreamExtract {
+		opts = append(opts, appfsm.WithStreamingExtract())
+	}
+	if cfg.TrustMultipartETags {
+		opts = append(opts, appfsm.WithTrustMultipartETags())
+	}
+	if cfg.MaxAttempts > 0 {
+		opts = append(opts, appfsm.WithMaxAttempts(cfg.MaxAttempts))
+	}
+	if cfg.MaxHostExtractedSize > 0 {
+		opts = append(opts, appfsm.WithMaxHostExtractedSize(cfg.MaxHostExtractedSize))
+	}
+	if !fetchKeepDownload || !fetchKeepExtracted {
+		opts = append(opts, appfsm.WithWorkFileRetention(fetchKeepDownload, fetchKeepExtracted))
+	}
+	if fetchCompressDownload {
+		opts = append(opts, appfsm.WithCompressDownloads())
+	}
+	if cfg.NotifyURL != "" {
+		opts = append(opts, appfsm.WithNotifier(notify.NewWebhook(cfg.NotifyURL, cfg.NotifySecret)))
+	}
+	if cfg.EventLog != "" {
+		eventLog, err := os.OpenFile(cfg.EventLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return errors.Wrap(err, "failed to open event log")
+		}
+		defer eventLog.Close()
+		opts = append(opts, appfsm.WithEventEmitter(events.NewJSONLines(eventLog)))
+	}
+
+	if fetchTrace {
+		// Printed on every exit from here, so a failed or timed-out run
+		// still shows where its time went
+		trace := appfsm.NewTrace()
+		opts = append(opts, appfsm.WithTrace(trace))
+		defer trace.Write(os.Stdout)
+	}
+
+	machine := appfsm.NewMachine(repo, source, validator, dmManager, cfg.WorkDir, cfg.FSMMaxRetries, opts...)
 	start, _, err := machine.Register(ctx, manager)
 	if err != nil {
 		return errors.Wrap(err, "FSM register failed")
 	}
 
 	req := &appfsm.ImageRequest{
-		S3Key:    imageKey,
-		S3Bucket: cfg.S3Bucket,
+		S3Key:          imageKey,
+		S3Bucket:       cfg.S3Bucket,
+		TimeoutSeconds: fetchTimeoutSeconds,
+		ExtractSubpath: subpath,
+	}
+	if fetchImageRef {
+		req = &appfsm.ImageRequest{ImageRef: imageKey, TimeoutSeconds: fetchTimeoutSeconds, ExtractSubpath: subpath}
 	}
 	resp := &appfsm.ImageResponse{}
 
+	timeout := req.Timeout(cfg.FetchTimeout)
+	slog.Info("fetch_timeout", "s3_key", imageKey, "timeout", timeout, "per_image", req.TimeoutSeconds > 0)
+	waitCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
 	version, err := start(ctx, imageKey, fsm.NewRequest(req, resp))
 	if err != nil {
 		return errors.Wrap(err, "FSM start failed")
 	}
 
-	slog.Info("fsm started", "version", version)
+	slog.Info("fsm started", "version", version, cfg.RunIDLogKey, version)
 
-	if err := manager.Wait(ctx, version); err != nil {
+	if err := manager.Wait(waitCtx, version); err != nil {
+		if waitCtx.Err() != nil {
+			cancelRun := func(cause string) error { return manager.Cancel(ctx, version, cause) }
+			return fetchTimedOut(ctx, cancelRun, repo, imageKey, timeout)
+		}
 		return errors.Wrap(err, "FSM execution failed")
 	}
 
-	slog.Info("fetch completed", "status", resp.Status, "device", resp.DevicePath, "snapshot", resp.SnapshotID)
+	slog.Info("fetch completed", "status", resp.Status, "device", resp.DevicePath, "snapshot", resp.SnapshotID, "attempts", resp.Attempts, "degradations", resp.Degradations)
+	printDegradations(imageKey, resp)
+
+	if fetchPostHook != "" {
+		return runFetchPostHook(ctx, repo, imageKey)
+	}
 
 	return nil
 }
+
+// skipReady splits keys into those still to process and a count of those
+// already ready, which are skipped unless force is set. A ready record
+// without a digest never finished a download, so its key is processed.
+func skipReady(ctx context.Context, repo *db.Repository, keys []string, force bool) (todo []string, skipped int, err error) {
+	if force {
+		return keys, 0, nil
+	}
+
+	for _, key := range keys {
+		img, err := repo.GetByS3KeyContext(ctx, key)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "image lookup failed")
+		}
+		if img != nil && img.Status == db.StatusReady && img.SHA256 != "" {
+			slog.Info("image_skipped", "s3_key", key, "reason", "already_ready")
+			skipped++
+			continue
+		}
+		todo = append(todo, key)
+	}
+	return todo, skipped, nil
+}
+
+// fetchTimedOut stops a run that outlived its deadline and marks the
+// image failed so the next fetch starts it afresh
+func fetchTimedOut(ctx context.Context, cancelRun func(cause string) error, repo *db.Repository, imageKey string, timeout time.Duration) error {
+	err := fmt.Errorf("fetch timed out after %s", timeout)
+	slog.Error("fetch_timed_out", "s3_key", imageKey, "timeout", timeout)
+
+	if cancelErr := cancelRun(err.Error()); cancelErr != nil {
+		slog.Warn("fsm_cancel_failed", "s3_key", imageKey, "error", cancelErr)
+	}
+	img, lookupErr := repo.GetByS3KeyContext(ctx, imageKey)
+	if lookupErr == nil && img != nil {
+		if updateErr := repo.UpdateStatusContext(ctx, img.ID, db.StatusFailed, err.Error()); updateErr != nil {
+			slog.Warn("timeout_status_update_failed", "s3_key", imageKey, "error", updateErr)
+		}
+	}
+	return err
+}
+
+// printDegradations tells the operator whether the image was fully
+// provisioned or only partially, listing each skipped step
+func printDegradations(imageKey string, resp *appfsm.ImageResponse) {
+	if resp.Status != db.StatusReady {
+		return
+	}
+	if len(resp.Degradations) == 0 {
+		fmt.Printf("✅ %s ready\n", imageKey)
+		return
+	}
+	fmt.Printf("⚠️  %s ready with %d degradation(s):\n", imageKey, len(resp.Degradations))
+	for _, d := range resp.Degradations {
+		fmt.Printf("   - %s\n", d)
+	}
+}
+
+// runFetchPostHook runs --post-hook for a ready image, applying
+// --post-hook-failure when it fails
+func runFetchPostHook(ctx context.Context, repo *db.Repository, imageKey string) error {
+	img, err := repo.GetByS3KeyContext(ctx, imageKey)
+	if err != nil {
+		return errors.Wrap(err, "image lookup failed")
+	}
+	if img == nil || img.Status != db.StatusReady {
+		slog.Info("post_hook_skipped", "s3_key", imageKey, "reason", "image_not_ready")
+		return nil
+	}
+
+	slog.Info("post_hook_started", "s3_key", imageKey, "command", fetchPostHook)
+	hookErr := runPostHook(ctx, fetchPostHook, img)
+	if hookErr == nil {
+		slog.Info("post_hook_complete", "s3_key", imageKey)
+		return nil
+	}
+
+	if fetchPostHookFailure == hookFailureWarn {
+		slog.Warn("post_hook_failed", "s3_key", imageKey, "error", hookErr)
+		return nil
+	}
+
+	slog.Error("post_hook_failed", "s3_key", imageKey, "error", hookErr)
+	if err := repo.UpdateStatusContext(ctx, img.ID, db.StatusFailed, hookErr.Error()); err != nil {
+		return errors.Wrap(err, "failed to mark image failed")
+	}
+	return hookErr
+}
+
+// poolTiers returns the pool tiers configured with --device-pools
+func poolTiers(cfg *config.Config) []devicemapper.PoolTier {
+	var tiers []devicemapper.PoolTier
+	for _, pool := range cfg.DevicePools {
+		// Validated with the config
+		tier, _ := devicemapper.ParsePoolTier(pool)
+		tiers = append(tiers, tier)
+	}
+	return tiers
+}
+
+// extractOptions builds the tarball extraction options from cfg
+func extractOptions(cfg *config.Config) devicemapper.ExtractOptions {
+	opts := devicemapper.ExtractOptions{
+		CopyBufferSize:      cfg.ExtractBufferSize,
+		MaxTopLevelEntries:  cfg.MaxTopLevelEntries,
+		WarnTopLevelEntries: cfg.TopLevelEntriesMode == "warn",
+		Isolate:             cfg.IsolateExtraction,
+	}
+	if cfg.ExtractWorkers > 1 {
+		opts.Parallel = true
+		opts.Workers = cfg.ExtractWorkers
+	}
+	return opts
+}
+
+// newSource builds the image source selected by --source
+func newSource(ctx context.Context, cfg *config.Config) (storage.Source, error) {
+	opts := storage.ClientOptions{
+		HashAlgorithm: cfg.HashAlgorithm,
+		PartSize:      cfg.DownloadPartSize,
+		Concurrency:   cfg.DownloadConcurrency,
+	}
+
+	if cfg.Source == "local" {
+		source, err := storage.NewLocalSource(cfg.SourceDir, opts)
+		if err != nil {
+			return nil, errors.Wrap(err, "local source failed")
+		}
+		return source, nil
+	}
+
+	s3Client, err := storage.NewClient(ctx, cfg.S3Bucket, cfg.S3Region, opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "S3 client failed")
+	}
+	return s3Client, nil
+}
@@ -0,0 +1,56 @@
+package commands
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/fly-io/162719/pkg/db"
+)
+
+func TestSkipReady(t *testing.T) {
+	dbPath := "/tmp/test_images_skip_ready.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	repo, err := db.NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	for _, img := range []*db.Image{
+		{S3Key: "images/alpine.tar", SHA256: "sha256:aaa", Status: db.StatusReady},
+		{S3Key: "images/debian.tar", SHA256: "sha256:bbb", Status: db.StatusReady},
+		{S3Key: "images/failed.tar", SHA256: "sha256:ccc", Status: db.StatusFailed},
+		{S3Key: "images/nodigest.tar", Status: db.StatusReady},
+	} {
+		if err := repo.Create(img); err != nil {
+			t.Fatalf("create image: %v", err)
+		}
+	}
+
+	ctx := context.Background()
+	keys := []string{"images/alpine.tar", "images/new.tar", "images/failed.tar", "images/debian.tar", "images/nodigest.tar", "images/other.tar"}
+
+	todo, skipped, err := skipReady(ctx, repo, keys, false)
+	if err != nil {
+		t.Fatalf("skipReady: %v", err)
+	}
+	if skipped != 2 {
+		t.Errorf("skipped = %d, want 2", skipped)
+	}
+	want := []string{"images/new.tar", "images/failed.tar", "images/nodigest.tar", "images/other.tar"}
+	if !reflect.DeepEqual(todo, want) {
+		t.Errorf("todo = %v, want %v", todo, want)
+	}
+
+	todo, skipped, err = skipReady(ctx, repo, keys, true)
+	if err != nil {
+		t.Fatalf("skipReady with force: %v", err)
+	}
+	if skipped != 0 || !reflect.DeepEqual(todo, keys) {
+		t.Errorf("with force: todo = %v, skipped = %d; want every key, none skipped", todo, skipped)
+	}
+}
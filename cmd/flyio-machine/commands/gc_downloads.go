@@ -0,0 +1,208 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/fly-io/162719/internal/config"
+	"github.com/fly-io/162719/pkg/db"
+	"github.com/fly-io/162719/pkg/errors"
+	appfsm "github.com/fly-io/162719/pkg/fsm"
+	"github.com/fly-io/162719/pkg/storage"
+	"github.com/spf13/cobra"
+)
+
+var gcDownloadsCmd = &cobra.Command{
+	Use:   "gc-downloads",
+	Short: "Delete least recently used downloads until the downloads dir fits a size cap",
+	Long: `Enumerate the tarballs under the downloads dir and, if together they
+exceed --max-size, delete the least recently used ones (by the later of
+access and modification time) until the total is under the cap.
+
+Downloads of images that aren't ready are never deleted, since a fetch may
+still be using them; if they alone exceed the cap, the dir stays over it.`,
+	Args: cobra.NoArgs,
+	RunE: runGCDownloads,
+}
+
+var (
+	gcDownloadsMaxSize string
+	gcDownloadsDryRun  bool
+)
+
+func init() {
+	rootCmd.AddCommand(gcDownloadsCmd)
+	gcDownloadsCmd.Flags().StringVar(&gcDownloadsMaxSize, "max-size", "", "Size cap for the downloads dir (e.g. 512M, 50G)")
+	gcDownloadsCmd.Flags().BoolVar(&gcDownloadsDryRun, "dry-run", false, "Print what would be deleted without deleting")
+	gcDownloadsCmd.MarkFlagRequired("max-size")
+}
+
+// downloadFile is a tarball in the downloads dir
+type downloadFile struct {
+	Path string
+	Size int64
+	// Used is the later of the file's access and modification times
+	Used time.Time
+}
+
+func runGCDownloads(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+
+	maxSize, err := parseByteSize(gcDownloadsMaxSize)
+	if err != nil {
+		return usageError(errors.Wrap(err, "invalid --max-size"))
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		return configError(errors.Wrap(err, "config load failed"))
+	}
+
+	if err := ensureDirectories(cfg.SQLitePath, "", ""); err != nil {
+		return err
+	}
+	repo, err := openRepository(cfg)
+	if err != nil {
+		return errors.Wrap(err, "db init failed")
+	}
+	defer repo.Close()
+
+	layout := appfsm.NewLayout(cfg.WorkDir, cfg.ScratchDir)
+	files, err := listDownloads(layout.DownloadsDir())
+	if err != nil {
+		return err
+	}
+	protected, err := protectedDownloads(ctx, repo, layout)
+	if err != nil {
+		return err
+	}
+
+	victims := selectLRU(files, maxSize, protected)
+	total, freed := totalSize(files), totalSize(victims)
+
+	for _, f := range victims {
+		if gcDownloadsDryRun {
+			fmt.Printf("🗑️  Would delete %s (%.1f MB, last used %s)\n", f.Path, float64(f.Size)/1024/1024, f.Used.Format(time.RFC3339))
+			continue
+		}
+		if err := os.Remove(f.Path); err != nil && !os.IsNotExist(err) {
+			slog.Warn("download_gc_failed", "path", f.Path, "error", err)
+			freed -= f.Size
+			continue
+		}
+		slog.Info("download_gc_deleted", "path", f.Path, "size", f.Size, "used", f.Used)
+	}
+
+	verb := "Freed"
+	if gcDownloadsDryRun {
+		verb = "Would free"
+	}
+	fmt.Printf("🧹 %s %.1f MB from %d download(s); %.1f MB of %.1f MB cap remain\n",
+		verb, float64(freed)/1024/1024, len(victims), float64(total-freed)/1024/1024, float64(maxSize)/1024/1024)
+	if total-freed > maxSize {
+		fmt.Printf("⚠️  Still over the cap: the rest belongs to images that aren't ready\n")
+	}
+	return nil
+}
+
+// listDownloads returns the regular files directly under dir. A missing
+// dir has no downloads.
+func listDownloads(dir string) ([]downloadFile, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read downloads dir")
+	}
+
+	var files []downloadFile
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		fi, err := entry.Info()
+		if err != nil {
+			// Removed since the listing
+			continue
+		}
+		used := fi.ModTime()
+		if atime := accessTime(fi); atime.After(used) {
+			used = atime
+		}
+		files = append(files, downloadFile{
+			Path: filepath.Join(dir, entry.Name()),
+			Size: fi.Size(),
+			Used: used,
+		})
+	}
+	return files, nil
+}
+
+// protectedDownloads returns the download paths, plain and compressed, of
+// every image that isn't ready, which a running or resumable fetch may
+// still need
+func protectedDownloads(ctx context.Context, repo *db.Repository, layout appfsm.Layout) (map[string]bool, error) {
+	protected := make(map[string]bool)
+	for _, status := range db.Statuses {
+		if status == db.StatusReady {
+			continue
+		}
+		images, err := repo.GetByStatusContext(ctx, status)
+		if err != nil {
+			return nil, errors.Wrap(err, "image lookup failed")
+		}
+		for _, img := range images {
+			path := layout.DownloadPath(img.S3Key)
+			protected[path] = true
+			protected[storage.CompressedPath(path)] = true
+		}
+	}
+	return protected, nil
+}
+
+// selectLRU picks the files to delete to bring the total size of files
+// down to maxSize, least recently used first. Protected paths count
+// toward the total but are never picked.
+func selectLRU(files []downloadFile, maxSize int64, protected map[string]bool) []downloadFile {
+	total := totalSize(files)
+	if total <= maxSize {
+		return nil
+	}
+
+	candidates := make([]downloadFile, 0, len(files))
+	for _, f := range files {
+		if !protected[f.Path] {
+			candidates = append(candidates, f)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if !candidates[i].Used.Equal(candidates[j].Used) {
+			return candidates[i].Used.Before(candidates[j].Used)
+		}
+		return candidates[i].Path < candidates[j].Path
+	})
+
+	var victims []downloadFile
+	for _, f := range candidates {
+		if total <= maxSize {
+			break
+		}
+		victims = append(victims, f)
+		total -= f.Size
+	}
+	return victims
+}
+
+func totalSize(files []downloadFile) int64 {
+	var total int64
+	for _, f := range files {
+		total += f.Size
+	}
+	return total
+}
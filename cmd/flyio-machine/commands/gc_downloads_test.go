@@ -0,0 +1,77 @@
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSelectLRU(t *testing.T) {
+	dir := t.TempDir()
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// name -> size and hours after base of last use
+	files := map[string]struct {
+		size int
+		hour int
+	}{
+		"oldest.tar": {100, 0},
+		"old.tar":    {200, 1},
+		"middle.tar": {300, 2},
+		"newer.tar":  {400, 3},
+		"newest.tar": {500, 4},
+	}
+	for name, f := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, make([]byte, f.size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		used := base.Add(time.Duration(f.hour) * time.Hour)
+		if err := os.Chtimes(path, used, used); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "not-a-download"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	downloads, err := listDownloads(dir)
+	if err != nil {
+		t.Fatalf("listDownloads: %v", err)
+	}
+	if len(downloads) != len(files) {
+		t.Fatalf("listDownloads found %d files, want %d", len(downloads), len(files))
+	}
+
+	tests := []struct {
+		name      string
+		maxSize   int64
+		protected []string
+		want      []string
+	}{
+		{"under cap", 1500, nil, nil},
+		{"evicts oldest first", 1200, nil, []string{"oldest.tar", "old.tar"}},
+		{"evicts until under cap", 1000, nil, []string{"oldest.tar", "old.tar", "middle.tar"}},
+		{"skips protected", 1200, []string{"oldest.tar"}, []string{"old.tar", "middle.tar"}},
+		{"protected alone over cap", 0, []string{"newest.tar"}, []string{"oldest.tar", "old.tar", "middle.tar", "newer.tar"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			protected := make(map[string]bool)
+			for _, name := range tt.protected {
+				protected[filepath.Join(dir, name)] = true
+			}
+
+			var got []string
+			for _, f := range selectLRU(downloads, tt.maxSize, protected) {
+				got = append(got, filepath.Base(f.Path))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("selectLRU(max %d) = %v, want %v", tt.maxSize, got, tt.want)
+			}
+		})
+	}
+}
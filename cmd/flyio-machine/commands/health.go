@@ -0,0 +1,66 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/fly-io/162719/internal/config"
+	"github.com/fly-io/162719/pkg/errors"
+	appfsm "github.com/fly-io/162719/pkg/fsm"
+	"github.com/spf13/cobra"
+)
+
+var healthCmd = &cobra.Command{
+	Use:   "health",
+	Short: "Check that the database and devicemapper are usable",
+	Long: `Check that the image database answers queries and report whether
+devicemapper is available. The command fails if the database is
+unusable, or if devicemapper is unavailable while dm-enabled is set.`,
+	Args: cobra.NoArgs,
+	RunE: runHealth,
+}
+
+func init() {
+	rootCmd.AddCommand(healthCmd)
+}
+
+func runHealth(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+
+	cfg, err := config.Load()
+	if err != nil {
+		return configError(errors.Wrap(err, "config load failed"))
+	}
+
+	if err := checkDatabaseHealth(ctx, cfg); err != nil {
+		fmt.Printf("❌ database: %v\n", err)
+		return err
+	}
+	fmt.Println("✅ database: ok")
+
+	dmStatus := appfsm.CheckDeviceMapperHealth(ctx)
+	if dmStatus == "ok" {
+		fmt.Println("✅ devicemapper: ok")
+		return nil
+	}
+	if cfg.DMEnabled {
+		fmt.Printf("❌ devicemapper: %s\n", dmStatus)
+		return deviceError(fmt.Errorf("devicemapper unavailable: %s", dmStatus))
+	}
+	fmt.Printf("⚠️  devicemapper: %s\n", dmStatus)
+	return nil
+}
+
+// checkDatabaseHealth opens the configured database and pings it
+func checkDatabaseHealth(ctx context.Context, cfg *config.Config) error {
+	if err := ensureDirectories(cfg.SQLitePath, "", ""); err != nil {
+		return err
+	}
+	repo, err := openRepository(cfg)
+	if err != nil {
+		return errors.Wrap(err, "db init failed")
+	}
+	defer repo.Close()
+
+	return repo.Ping(ctx)
+}
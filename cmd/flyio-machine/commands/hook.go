@@ -0,0 +1,52 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"github.com/fly-io/162719/pkg/db"
+	"github.com/fly-io/162719/pkg/errors"
+)
+
+// Post-hook failure modes
+const (
+	hookFailureFail = "fail" // mark the image failed
+	hookFailureWarn = "warn" // log and keep the image ready
+)
+
+// validateHookFailureMode checks a --post-hook-failure value
+func validateHookFailureMode(mode string) error {
+	switch mode {
+	case hookFailureFail, hookFailureWarn:
+		return nil
+	}
+	return fmt.Errorf("invalid post-hook-failure %q: expected fail or warn", mode)
+}
+
+// postHookEnv describes a ready image to a post-hook, on top of the
+// caller's environment
+func postHookEnv(img *db.Image) []string {
+	return append(os.Environ(),
+		"FLYIO_IMAGE_KEY="+img.S3Key,
+		"FLYIO_DEVICE_PATH="+img.DevicePath,
+		"FLYIO_SNAPSHOT_ID="+strconv.Itoa(img.SnapshotID),
+		"FLYIO_SHA256="+img.SHA256,
+	)
+}
+
+// runPostHook runs the executable at command for a ready image. The hook's
+// output is passed through; a non-zero exit is returned as an error.
+func runPostHook(ctx context.Context, command string, img *db.Image) error {
+	cmd := exec.CommandContext(ctx, command)
+	cmd.Env = postHookEnv(img)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("post-hook %s failed", command))
+	}
+	return nil
+}
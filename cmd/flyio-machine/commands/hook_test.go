@@ -0,0 +1,100 @@
+//go:build unix
+
+package commands
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fly-io/162719/pkg/db"
+)
+
+// writeHookScript writes an executable shell script into a temp dir
+func writeHookScript(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "hook.sh")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body), 0755); err != nil {
+		t.Fatalf("write hook: %v", err)
+	}
+	return path
+}
+
+func TestRunPostHook_PassesImageEnvironment(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "env.txt")
+	t.Setenv("HOOK_OUT", out)
+	hook := writeHookScript(t, `env | grep '^FLYIO_' | sort > "$HOOK_OUT"`+"\n")
+
+	img := &db.Image{
+		S3Key:      "images/alpine.tar",
+		SHA256:     "sha256:abc",
+		DevicePath: "/dev/mapper/flyio-7",
+		SnapshotID: 8,
+	}
+	if err := runPostHook(context.Background(), hook, img); err != nil {
+		t.Fatalf("runPostHook failed: %v", err)
+	}
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("hook did not record its environment: %v", err)
+	}
+	for _, want := range []string{
+		"FLYIO_DEVICE_PATH=/dev/mapper/flyio-7",
+		"FLYIO_IMAGE_KEY=images/alpine.tar",
+		"FLYIO_SHA256=sha256:abc",
+		"FLYIO_SNAPSHOT_ID=8",
+	} {
+		if !strings.Contains(string(data), want+"\n") {
+			t.Errorf("hook environment missing %q:\n%s", want, data)
+		}
+	}
+}
+
+func TestRunFetchPostHook_FailureModes(t *testing.T) {
+	dbPath := "/tmp/test_images_hook.db"
+	failing := writeHookScript(t, "exit 3\n")
+
+	tests := []struct {
+		mode       string
+		wantErr    bool
+		wantStatus string
+	}{
+		{mode: hookFailureFail, wantErr: true, wantStatus: db.StatusFailed},
+		{mode: hookFailureWarn, wantErr: false, wantStatus: db.StatusReady},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			os.Remove(dbPath)
+			defer os.Remove(dbPath)
+
+			repo, err := db.NewRepository(dbPath)
+			if err != nil {
+				t.Fatalf("failed to create repository: %v", err)
+			}
+			defer repo.Close()
+
+			img := &db.Image{S3Key: "images/alpine.tar", SHA256: "", Status: db.StatusReady}
+			if err := repo.Create(img); err != nil {
+				t.Fatalf("failed to create image: %v", err)
+			}
+
+			oldHook, oldMode := fetchPostHook, fetchPostHookFailure
+			fetchPostHook, fetchPostHookFailure = failing, tt.mode
+			defer func() { fetchPostHook, fetchPostHookFailure = oldHook, oldMode }()
+
+			err = runFetchPostHook(context.Background(), repo, img.S3Key)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("runFetchPostHook error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			got, _ := repo.GetByS3Key(img.S3Key)
+			if got.Status != tt.wantStatus {
+				t.Errorf("status = %q, want %q", got.Status, tt.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/fly-io/162719/internal/config"
+	"github.com/fly-io/162719/pkg/db"
+	"github.com/fly-io/162719/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var (
+	importIn         string
+	importOnConflict string
+)
+
+var importCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Load images from a JSON dump created by export",
+	Long: `Insert the images of an export dump. Images whose S3 key already exists
+are skipped or replaced according to --on-conflict. Device and snapshot IDs
+are kept, and the device sequence is advanced past them.`,
+	Args: cobra.NoArgs,
+	RunE: runImport,
+}
+
+func init() {
+	rootCmd.AddCommand(importCmd)
+	importCmd.Flags().StringVar(&importIn, "in", "", "Dump file to read")
+	importCmd.MarkFlagRequired("in")
+	importCmd.Flags().StringVar(&importOnConflict, "on-conflict", string(db.ConflictSkip), "What to do with existing keys (skip, replace)")
+}
+
+func runImport(cmd *cobra.Command, args []string) error {
+	policy, err := db.ParseConflictPolicy(importOnConflict)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(importIn)
+	if err != nil {
+		return errors.Wrap(err, "failed to read dump")
+	}
+	var dump db.Dump
+	if err := json.Unmarshal(data, &dump); err != nil {
+		return errors.Wrap(err, "failed to decode dump")
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		return configError(errors.Wrap(err, "config load failed"))
+	}
+
+	if err := ensureDirectories(cfg.SQLitePath, "", ""); err != nil {
+		return err
+	}
+
+	repo, err := openRepository(cfg)
+	if err != nil {
+		return errors.Wrap(err, "db init failed")
+	}
+	defer repo.Close()
+
+	result, err := repo.ImportContext(context.Background(), &dump, policy)
+	if err != nil {
+		return errors.Wrap(err, "import failed")
+	}
+
+	fmt.Printf("📥 Imported %d images (%d replaced, %d skipped)\n", result.Imported+result.Replaced, result.Replaced, result.Skipped)
+	return nil
+}
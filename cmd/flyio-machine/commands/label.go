@@ -0,0 +1,89 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/fly-io/162719/internal/config"
+	"github.com/fly-io/162719/pkg/db"
+	"github.com/fly-io/162719/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var labelCmd = &cobra.Command{
+	Use:   "label <image-key> [key=value...]",
+	Short: "Set or show labels on an image",
+	Long: `Attach key=value labels to an image for filtering with list --label.
+Setting an existing key overwrites its value. With no labels given, the
+image's current labels are printed.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: runLabel,
+}
+
+func init() {
+	rootCmd.AddCommand(labelCmd)
+}
+
+func runLabel(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+	imageKey := args[0]
+
+	// Parse everything up front so a typo doesn't leave labels half-applied
+	type label struct{ key, value string }
+	var labels []label
+	for _, arg := range args[1:] {
+		key, value, err := db.ParseLabel(arg)
+		if err != nil {
+			return err
+		}
+		labels = append(labels, label{key, value})
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		return configError(errors.Wrap(err, "config load failed"))
+	}
+
+	repo, err := openRepository(cfg)
+	if err != nil {
+		return errors.Wrap(err, "db init failed")
+	}
+	defer repo.Close()
+
+	img, err := repo.GetByS3KeyContext(ctx, imageKey)
+	if err != nil {
+		return errors.Wrap(err, "image lookup failed")
+	}
+	if img == nil {
+		return fmt.Errorf("image not found: %s", imageKey)
+	}
+
+	for _, l := range labels {
+		if err := repo.SetLabelContext(ctx, img.ID, l.key, l.value); err != nil {
+			return errors.Wrap(err, "failed to set label")
+		}
+		fmt.Printf("🏷️  %s: %s=%s\n", imageKey, l.key, l.value)
+	}
+
+	if len(labels) == 0 {
+		current, err := repo.GetLabelsContext(ctx, img.ID)
+		if err != nil {
+			return errors.Wrap(err, "failed to get labels")
+		}
+		if len(current) == 0 {
+			fmt.Printf("No labels on %s\n", imageKey)
+			return nil
+		}
+		keys := make([]string, 0, len(current))
+		for key := range current {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Printf("%s=%s\n", key, current[key])
+		}
+	}
+
+	return nil
+}
@@ -1,7 +1,17 @@
 package commands
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/fly-io/162719/internal/config"
 	"github.com/fly-io/162719/pkg/db"
@@ -9,6 +19,20 @@ import (
 	"github.com/spf13/cobra"
 )
 
+var (
+	listWatch      bool
+	listInterval   time.Duration
+	listLabel      string
+	listShowError  bool
+	listFailedOnly bool
+	listJSON       bool
+	listSince      string
+	listHost       string
+)
+
+// errorColumnWidth caps the ERROR column; --json carries the full text
+const errorColumnWidth = 60
+
 var listCmd = &cobra.Command{
 	Use:   "list",
 	Short: "List all images and their status",
@@ -17,12 +41,20 @@ var listCmd = &cobra.Command{
 
 func init() {
 	rootCmd.AddCommand(listCmd)
+	listCmd.Flags().BoolVar(&listWatch, "watch", false, "Re-query and reprint the table when images change")
+	listCmd.Flags().DurationVar(&listInterval, "interval", 2*time.Second, "Polling interval for --watch")
+	listCmd.Flags().StringVar(&listLabel, "label", "", "Only list images with this key=value label")
+	listCmd.Flags().BoolVar(&listShowError, "show-error", false, "Add a column with each image's (truncated) error message")
+	listCmd.Flags().BoolVar(&listFailedOnly, "failed-only", false, "Only list failed images")
+	listCmd.Flags().BoolVar(&listJSON, "json", false, "Print images as JSON, including full error messages")
+	listCmd.Flags().StringVar(&listHost, "host", "", "Only list images recorded on this host (see --hostname)")
+	listCmd.Flags().StringVar(&listSince, "since", "", "Only list images created or updated within this long, e.g. 1h, 24h or 7d")
 }
 
 func runList(cmd *cobra.Command, args []string) error {
 	cfg, err := config.Load()
 	if err != nil {
-		return errors.Wrap(err, "config load failed")
+		return configError(errors.Wrap(err, "config load failed"))
 	}
 
 	// Ensure database directory exists
@@ -30,24 +62,245 @@ func runList(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	repo, err := db.NewRepository(cfg.SQLitePath)
+	var list imageLister = func(ctx context.Context, repo *db.Repository) ([]*db.Image, error) {
+		return repo.ListContext(ctx)
+	}
+	if listLabel != "" {
+		key, value, err := db.ParseLabel(listLabel)
+		if err != nil {
+			return err
+		}
+		list = func(ctx context.Context, repo *db.Repository) ([]*db.Image, error) {
+			return repo.ListByLabelContext(ctx, key, value)
+		}
+	}
+
+	if listFailedOnly {
+		list = failedOnly(list)
+	}
+	if listHost != "" {
+		list = onHost(list, listHost, listLabel == "")
+	}
+	if listSince != "" {
+		since, err := parseSince(listSince)
+		if err != nil {
+			return usageError(err)
+		}
+		list = updatedSince(list, since)
+	}
+
+	repo, err := openRepository(cfg)
 	if err != nil {
 		return errors.Wrap(err, "db init failed")
 	}
 	defer repo.Close()
 
-	images, err := repo.List()
+	if listWatch {
+		return watchImages(repo, listInterval, list)
+	}
+
+	images, err := list(context.Background(), repo)
 	if err != nil {
 		return errors.Wrap(err, "list failed")
 	}
 
+	if listJSON {
+		return writeImageJSON(os.Stdout, images)
+	}
+
+	printImageTable(images)
+	return nil
+}
+
+// imageLister fetches the images shown by list
+type imageLister func(ctx context.Context, repo *db.Repository) ([]*db.Image, error)
+
+// failedOnly narrows list to failed images
+func failedOnly(list imageLister) imageLister {
+	return func(ctx context.Context, repo *db.Repository) ([]*db.Image, error) {
+		images, err := list(ctx, repo)
+		if err != nil {
+			return nil, err
+		}
+		failed := images[:0]
+		for _, img := range images {
+			if img.Status == db.StatusFailed {
+				failed = append(failed, img)
+			}
+		}
+		return failed, nil
+	}
+}
+
+// onHost narrows list to images recorded on host. If list is every image
+// (all), the host query replaces it.
+func onHost(list imageLister, host string, all bool) imageLister {
+	return func(ctx context.Context, repo *db.Repository) ([]*db.Image, error) {
+		onHost, err := repo.ListByHostContext(ctx, host)
+		if err != nil || all {
+			return onHost, err
+		}
+		images, err := list(ctx, repo)
+		if err != nil {
+			return nil, err
+		}
+		hostIDs := make(map[int64]bool, len(onHost))
+		for _, img := range onHost {
+			hostIDs[img.ID] = true
+		}
+		kept := images[:0]
+		for _, img := range images {
+			if hostIDs[img.ID] {
+				kept = append(kept, img)
+			}
+		}
+		return kept, nil
+	}
+}
+
+// updatedSince narrows list to images created or updated within since
+func updatedSince(list imageLister, since time.Duration) imageLister {
+	return func(ctx context.Context, repo *db.Repository) ([]*db.Image, error) {
+		images, err := list(ctx, repo)
+		if err != nil {
+			return nil, err
+		}
+		recent, err := repo.ListSinceContext(ctx, since)
+		if err != nil {
+			return nil, err
+		}
+		recentIDs := make(map[int64]bool, len(recent))
+		for _, img := range recent {
+			recentIDs[img.ID] = true
+		}
+		kept := images[:0]
+		for _, img := range images {
+			if recentIDs[img.ID] {
+				kept = append(kept, img)
+			}
+		}
+		return kept, nil
+	}
+}
+
+// parseSince parses a --since window: a Go duration such as "90m" or
+// "24h", or a whole number of days such as "7d"
+func parseSince(s string) (time.Duration, error) {
+	var d time.Duration
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n > int(math.MaxInt64/(24*time.Hour)) {
+			return 0, fmt.Errorf("invalid --since %q: expected a duration like 1h or a day count like 7d", s)
+		}
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if d, err = time.ParseDuration(s); err != nil {
+			return 0, fmt.Errorf("invalid --since %q: expected a duration like 1h or a day count like 7d", s)
+		}
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid --since %q: must be positive", s)
+	}
+	return d, nil
+}
+
+// watchImages polls the repository and redraws the table whenever the
+// image set changes or the terminal is resized, until interrupted
+func watchImages(repo *db.Repository, interval time.Duration, list imageLister) error {
+	if interval <= 0 {
+		return usageError(fmt.Errorf("interval must be positive"))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	resized := make(chan os.Signal, 1)
+	if sigs := resizeSignals(); len(sigs) > 0 {
+		signal.Notify(resized, sigs...)
+		defer signal.Stop(resized)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var prev []*db.Image
+	first := true
+	for {
+		images, err := list(ctx, repo)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return errors.Wrap(err, "list failed")
+		}
+
+		if changed := changedImages(prev, images); first || len(changed) > 0 {
+			redrawImageTable(images, interval)
+			prev = images
+			first = false
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-resized:
+			redrawImageTable(prev, interval)
+		case <-ticker.C:
+		}
+	}
+}
+
+// changedImages returns the sorted S3 keys that were added, removed, or
+// changed between two listings
+func changedImages(prev, curr []*db.Image) []string {
+	before := make(map[string]*db.Image, len(prev))
+	for _, img := range prev {
+		before[img.S3Key] = img
+	}
+
+	var changed []string
+	for _, img := range curr {
+		old, ok := before[img.S3Key]
+		delete(before, img.S3Key)
+		if !ok || old.Status != img.Status || old.DevicePath != img.DevicePath ||
+			old.SnapshotID != img.SnapshotID || old.UpdatedAt != img.UpdatedAt {
+			changed = append(changed, img.S3Key)
+		}
+	}
+	for key := range before {
+		changed = append(changed, key)
+	}
+
+	sort.Strings(changed)
+	return changed
+}
+
+func redrawImageTable(images []*db.Image, interval time.Duration) {
+	// Clear the screen so a resized terminal never shows stale wrapped rows
+	fmt.Print("\033[H\033[2J")
+	fmt.Printf("Every %s - %s (Ctrl-C to exit)\n\n", interval, commandClock.Now().Format(time.RFC3339))
+	printImageTable(images)
+}
+
+func printImageTable(images []*db.Image) {
+	writeImageTable(os.Stdout, images, listShowError)
+}
+
+func writeImageTable(w io.Writer, images []*db.Image, showError bool) {
 	if len(images) == 0 {
-		fmt.Println("No images found")
-		return nil
+		fmt.Fprintln(w, "No images found")
+		return
 	}
 
-	fmt.Printf("%-40s %-12s %-30s %-20s\n", "S3 KEY", "STATUS", "DEVICE", "SNAPSHOT")
-	fmt.Println("------------------------------------------------------------------------------------------------")
+	header := fmt.Sprintf("%-40s %-12s %-30s %-10s %-8s", "S3 KEY", "STATUS", "DEVICE", "SNAPSHOT", "ATTEMPTS")
+	rule := "------------------------------------------------------------------------------------------------------------"
+	if showError {
+		header += " ERROR"
+		rule += strings.Repeat("-", errorColumnWidth+1)
+	}
+	fmt.Fprintln(w, header)
+	fmt.Fprintln(w, rule)
 
 	for _, img := range images {
 		devicePath := img.DevicePath
@@ -60,9 +313,54 @@ func runList(cmd *cobra.Command, args []string) error {
 			snapshotStr = fmt.Sprintf("%d", snapshotID)
 		}
 
-		fmt.Printf("%-40s %-12s %-30s %-20s\n",
-			img.S3Key, img.Status, devicePath, snapshotStr)
+		row := fmt.Sprintf("%-40s %-12s %-30s %-10s %-8d",
+			img.S3Key, img.Status, devicePath, snapshotStr, img.Attempts)
+		if showError {
+			row += " " + errorSummary(img.ErrorMessage, errorColumnWidth)
+		}
+		fmt.Fprintln(w, row)
 	}
+}
 
-	return nil
+// errorSummary flattens msg onto one line and truncates it to width runes
+func errorSummary(msg string, width int) string {
+	msg = strings.Join(strings.Fields(msg), " ")
+	if msg == "" {
+		return "-"
+	}
+	if runes := []rune(msg); len(runes) > width {
+		return string(runes[:width-3]) + "..."
+	}
+	return msg
+}
+
+// imageJSON is the --json form of a listed image
+type imageJSON struct {
+	S3Key        string `json:"s3_key"`
+	Status       string `json:"status"`
+	DevicePath   string `json:"device_path,omitempty"`
+	SnapshotID   int    `json:"snapshot_id,omitempty"`
+	Attempts     int    `json:"attempts"`
+	ErrorMessage string `json:"error_message,omitempty"`
+	Host         string `json:"host,omitempty"`
+	UpdatedAt    string `json:"updated_at"`
+}
+
+func writeImageJSON(w io.Writer, images []*db.Image) error {
+	out := make([]imageJSON, len(images))
+	for i, img := range images {
+		out[i] = imageJSON{
+			S3Key:        img.S3Key,
+			Status:       img.Status,
+			DevicePath:   img.DevicePath,
+			SnapshotID:   img.SnapshotID,
+			Attempts:     img.Attempts,
+			ErrorMessage: img.ErrorMessage,
+			Host:         img.Host,
+			UpdatedAt:    img.UpdatedAt,
+		}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
 }
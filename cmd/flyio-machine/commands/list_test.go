@@ -0,0 +1,235 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fly-io/162719/internal/config"
+	"github.com/fly-io/162719/pkg/db"
+)
+
+func TestChangedImages(t *testing.T) {
+	prev := []*db.Image{
+		{S3Key: "a.tar", Status: db.StatusPending, UpdatedAt: "t1"},
+		{S3Key: "b.tar", Status: db.StatusReady, SnapshotID: 2, UpdatedAt: "t1"},
+		{S3Key: "c.tar", Status: db.StatusFailed, UpdatedAt: "t1"},
+	}
+
+	tests := []struct {
+		name string
+		curr []*db.Image
+		want []string
+	}{
+		{
+			name: "no changes",
+			curr: prev,
+			want: nil,
+		},
+		{
+			name: "status change",
+			curr: []*db.Image{
+				{S3Key: "a.tar", Status: db.StatusDownloading, UpdatedAt: "t2"},
+				prev[1], prev[2],
+			},
+			want: []string{"a.tar"},
+		},
+		{
+			name: "added and removed",
+			curr: []*db.Image{prev[0], prev[1], {S3Key: "d.tar", Status: db.StatusPending}},
+			want: []string{"c.tar", "d.tar"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := changedImages(prev, tt.curr)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("changedImages() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteImageTable_ShowError(t *testing.T) {
+	images := []*db.Image{
+		{S3Key: "a.tar", Status: db.StatusReady},
+		{
+			S3Key:        "b.tar",
+			Status:       db.StatusFailed,
+			ErrorMessage: "extraction failed:\n\tpath traversal in ../etc/passwd\r\nsee logs for the full entry list and the offending archive member",
+		},
+	}
+
+	var buf bytes.Buffer
+	writeImageTable(&buf, images, true)
+	lines := strings.Split(strings.TrimRight(buf.String(), "\n"), "\n")
+
+	if len(lines) != 4 {
+		t.Fatalf("table has %d lines, want header, rule and 2 rows:\n%s", len(lines), buf.String())
+	}
+	if !strings.HasSuffix(lines[0], " ERROR") {
+		t.Errorf("header missing ERROR column: %q", lines[0])
+	}
+	if !strings.HasSuffix(lines[2], " -") {
+		t.Errorf("image without error should show -: %q", lines[2])
+	}
+	want := "extraction failed: path traversal in ../etc/passwd see lo..."
+	if !strings.HasSuffix(lines[3], " "+want) {
+		t.Errorf("error column = %q, want suffix %q", lines[3], want)
+	}
+
+	buf.Reset()
+	writeImageTable(&buf, images, false)
+	if strings.Contains(buf.String(), "ERROR") || strings.Contains(buf.String(), "extraction failed") {
+		t.Errorf("error column shown without --show-error:\n%s", buf.String())
+	}
+}
+
+func TestWriteImageJSON_FullErrorMessage(t *testing.T) {
+	msg := "line one\nline two"
+	var buf bytes.Buffer
+	if err := writeImageJSON(&buf, []*db.Image{{S3Key: "b.tar", Status: db.StatusFailed, ErrorMessage: msg}}); err != nil {
+		t.Fatalf("writeImageJSON: %v", err)
+	}
+
+	var got []imageJSON
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, buf.String())
+	}
+	if len(got) != 1 || got[0].ErrorMessage != msg {
+		t.Errorf("JSON images = %+v, want full error %q", got, msg)
+	}
+}
+
+func TestFailedOnly(t *testing.T) {
+	all := func(ctx context.Context, repo *db.Repository) ([]*db.Image, error) {
+		return []*db.Image{
+			{S3Key: "a.tar", Status: db.StatusReady},
+			{S3Key: "b.tar", Status: db.StatusFailed},
+			{S3Key: "c.tar", Status: db.StatusPending},
+		}, nil
+	}
+
+	images, err := failedOnly(all)(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("failedOnly: %v", err)
+	}
+	if len(images) != 1 || images[0].S3Key != "b.tar" {
+		t.Errorf("failedOnly = %v, want only b.tar", images)
+	}
+}
+
+func TestOnHost(t *testing.T) {
+	dbPath := "/tmp/test_images_list_host.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	for _, host := range []string{"host-a", "host-b"} {
+		repo, err := db.NewRepository(dbPath, db.WithHost(host))
+		if err != nil {
+			t.Fatalf("NewRepository: %v", err)
+		}
+		for _, key := range []string{host + "/app.tar", host + "/db.tar"} {
+			img := &db.Image{S3Key: key, Status: db.StatusReady}
+			if err := repo.Create(img); err != nil {
+				t.Fatalf("Create: %v", err)
+			}
+			if strings.HasSuffix(key, "app.tar") {
+				repo.SetLabel(img.ID, "role", "app")
+			}
+		}
+		repo.Close()
+	}
+	repo, err := db.NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("NewRepository: %v", err)
+	}
+	defer repo.Close()
+
+	all := func(ctx context.Context, repo *db.Repository) ([]*db.Image, error) {
+		return repo.ListContext(ctx)
+	}
+	byLabel := func(ctx context.Context, repo *db.Repository) ([]*db.Image, error) {
+		return repo.ListByLabelContext(ctx, "role", "app")
+	}
+	tests := []struct {
+		name string
+		list imageLister
+		all  bool
+		want []string
+	}{
+		{name: "every image", list: all, all: true, want: []string{"host-b/app.tar", "host-b/db.tar"}},
+		{name: "labelled images", list: byLabel, want: []string{"host-b/app.tar"}},
+	}
+	for _, tt := range tests {
+		images, err := onHost(tt.list, "host-b", tt.all)(context.Background(), repo)
+		if err != nil {
+			t.Fatalf("%s: onHost: %v", tt.name, err)
+		}
+		var got []string
+		for _, img := range images {
+			got = append(got, img.S3Key)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: onHost = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{in: "1h", want: time.Hour},
+		{in: "90m", want: 90 * time.Minute},
+		{in: "24h", want: 24 * time.Hour},
+		{in: "7d", want: 7 * 24 * time.Hour},
+		{in: "1d", want: 24 * time.Hour},
+		{in: "", wantErr: true},
+		{in: "0h", wantErr: true},
+		{in: "-1h", wantErr: true},
+		{in: "1.5d", wantErr: true},
+		{in: "d", wantErr: true},
+		{in: "yesterday", wantErr: true},
+		{in: "999999999d", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseSince(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseSince(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseSince(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestOpenRepository_RecordsConfiguredHost(t *testing.T) {
+	dbPath := "/tmp/test_images_open_host.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	repo, err := openRepository(&config.Config{SQLitePath: dbPath, Hostname: "builder-7"})
+	if err != nil {
+		t.Fatalf("openRepository: %v", err)
+	}
+	defer repo.Close()
+	img := &db.Image{S3Key: "app.tar", Status: db.StatusPending}
+	if err := repo.Create(img); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if images, err := repo.ListByHost("builder-7"); err != nil || len(images) != 1 {
+		t.Errorf("ListByHost(builder-7) = %v, %v; want app.tar", images, err)
+	}
+}
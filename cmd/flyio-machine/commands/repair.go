@@ -0,0 +1,46 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/fly-io/162719/internal/config"
+	"github.com/fly-io/162719/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var repairSequenceCmd = &cobra.Command{
+	Use:   "repair-sequence",
+	Short: "Move the device ID sequence past every recorded device",
+	Long: `Recompute the device ID sequence from the device and snapshot IDs
+recorded on images and clones, so new devices can't collide with existing
+ones after the sequence was damaged or the database was rebuilt. The
+sequence is only ever moved forward.`,
+	Args: cobra.NoArgs,
+	RunE: runRepairSequence,
+}
+
+func init() {
+	rootCmd.AddCommand(repairSequenceCmd)
+}
+
+func runRepairSequence(cmd *cobra.Command, args []string) error {
+	cfg, err := config.Load()
+	if err != nil {
+		return configError(errors.Wrap(err, "config load failed"))
+	}
+
+	repo, err := openRepository(cfg)
+	if err != nil {
+		return errors.Wrap(err, "db init failed")
+	}
+	defer repo.Close()
+
+	next, err := repo.RepairDeviceSequence(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "repair failed")
+	}
+
+	fmt.Printf("✅ Device sequence repaired: next device ID is %d\n", next)
+	return nil
+}
@@ -0,0 +1,80 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/fly-io/162719/internal/config"
+	"github.com/fly-io/162719/pkg/db"
+	"github.com/fly-io/162719/pkg/devicemapper"
+	"github.com/fly-io/162719/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var resetCmd = &cobra.Command{
+	Use:   "reset <image-key>",
+	Short: "Reset an image to pending for a full re-process",
+	Long: `Delete an image's devices and local files and reset its record to
+pending, clearing its digest and all other derived state. The next
+fetch-and-create downloads and processes the image from scratch.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runReset,
+}
+
+func init() {
+	rootCmd.AddCommand(resetCmd)
+}
+
+func runReset(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+	imageKey := args[0]
+
+	cfg, err := config.Load()
+	if err != nil {
+		return configError(errors.Wrap(err, "config load failed"))
+	}
+
+	repo, err := openRepository(cfg)
+	if err != nil {
+		return errors.Wrap(err, "db init failed")
+	}
+	defer repo.Close()
+
+	img, err := repo.GetByS3KeyContext(ctx, imageKey)
+	if err != nil {
+		return errors.Wrap(err, "image lookup failed")
+	}
+	if img == nil {
+		return fmt.Errorf("image not found: %s", imageKey)
+	}
+
+	// Don't pull the rug out from under an in-flight fetch
+	lock, err := repo.AcquireLock(ctx, imageKey, db.DefaultLockStaleAfter)
+	if err != nil {
+		return errors.Wrap(err, "reset lock failed")
+	}
+	defer lock.Release(ctx)
+
+	dmManager, err := devicemapper.NewManager("pool", devicemapper.DefaultDataSize, devicemapper.DefaultMetadataSize,
+		devicemapper.WithDevicePrefix(cfg.DevicePrefix))
+	if err != nil {
+		fmt.Printf("⚠️  Devicemapper unavailable: %v\n", err)
+		dmManager = nil
+	}
+	if dmManager != nil {
+		defer dmManager.Close()
+	}
+
+	fmt.Printf("🔄 Resetting %s...\n", imageKey)
+
+	if err := releaseImageResources(ctx, dmManager, cfg, img); err != nil {
+		return errors.Wrap(err, "cleanup failed")
+	}
+
+	if err := repo.ResetContext(ctx, img.ID); err != nil {
+		return errors.Wrap(err, "reset failed")
+	}
+
+	fmt.Printf("✅ Reset: %s is pending\n", imageKey)
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package commands
+
+import "os"
+
+// resizeSignals returns nil where terminal resize is not signalled
+func resizeSignals() []os.Signal {
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build unix
+
+package commands
+
+import (
+	"os"
+	"syscall"
+)
+
+// resizeSignals returns the signals delivered on terminal resize
+func resizeSignals() []os.Signal {
+	return []os.Signal{syscall.SIGWINCH}
+}
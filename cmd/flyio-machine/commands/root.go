@@ -3,7 +3,12 @@ package commands
 import (
 	"fmt"
 	"os"
+	"sync"
+	"time"
 
+	"github.com/fly-io/162719/pkg/clock"
+	"github.com/fly-io/162719/pkg/security"
+	"github.com/fly-io/162719/pkg/storage"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -11,30 +16,131 @@ import (
 var rootCmd = &cobra.Command{
 	Use:   "flyio-machine",
 	Short: "Fly.io Platform Machines - Container image management",
-	Long:  `Manages container images with FSM orchestration, S3 storage, and vulnerability scanning.`,
+	Long:  "Manages container images with FSM orchestration, S3 storage, and vulnerability scanning.\n\n" + exitCodesHelp,
 }
 
+// commandClock supplies the current time to every command; tests swap in
+// a fake to run time-based behavior at fixed instants
+var commandClock clock.Clock = clock.Real{}
+
+// Execute runs the command line and exits with the code for its outcome
+// (see exitCodesHelp)
 func Execute() {
-	if err := rootCmd.Execute(); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+	if code := execute(os.Args[1:]); code != exitOK {
+		os.Exit(code)
+	}
+}
+
+var trackRunsOnce sync.Once
+
+// execute runs rootCmd with args and returns the process exit code
+func execute(args []string) int {
+	trackRunsOnce.Do(func() { trackCommandRuns(rootCmd) })
+	commandRan = false
+
+	// With --json the envelope replaces cobra's error and usage output
+	jsonErrors := jsonErrorsRequested(args)
+	rootCmd.SilenceErrors = jsonErrors
+	rootCmd.SilenceUsage = jsonErrors
+
+	rootCmd.SetArgs(args)
+	cmd, err := rootCmd.ExecuteC()
+	if err == nil {
+		return exitOK
+	}
+	if !commandRan {
+		err = usageError(err)
 	}
+	if jsonErrors {
+		writeJSONError(rootCmd.ErrOrStderr(), cmd, err)
+	} else {
+		fmt.Fprintf(rootCmd.ErrOrStderr(), "Error: %v\n", err)
+	}
+	return exitCode(err)
 }
 
 func init() {
+	rootCmd.PersistentFlags().String("config", "", "Config file (default: config.yaml in . or $HOME/.flyio, if present)")
 	rootCmd.PersistentFlags().String("sqlite-path", ".artifacts/images.db", "SQLite database path")
 	rootCmd.PersistentFlags().String("fsm-db-path", ".artifacts/fsm.db", "FSM BoltDB path")
 	rootCmd.PersistentFlags().String("s3-bucket", "flyio-platform-hiring-challenge", "S3 bucket name")
 	rootCmd.PersistentFlags().String("s3-region", "us-east-1", "S3 region")
+	rootCmd.PersistentFlags().String("source", "s3", "Image source (s3, local)")
+	rootCmd.PersistentFlags().String("source-dir", "", "Directory of image tarballs for --source local")
+	rootCmd.PersistentFlags().String("scratch-dir", "", "Directory for downloads and extracted trees (default: work dir)")
+	rootCmd.PersistentFlags().String("hash-algorithm", "sha256", "Download digest algorithm (sha256, sha512)")
+	rootCmd.PersistentFlags().Int64("download-part-size", storage.DefaultPartSize, "Part size in bytes for parallel ranged S3 downloads")
+	rootCmd.PersistentFlags().Int("download-concurrency", 1, "Ranged S3 download parts fetched at once (1 = single stream)")
+	rootCmd.PersistentFlags().Int("download-breaker-threshold", 0, "Consecutive transient download failures that pause all downloads (0 = off)")
+	rootCmd.PersistentFlags().Duration("download-breaker-cooldown", 30*time.Second, "How long downloads pause once the breaker opens, before a probe")
 	rootCmd.PersistentFlags().Int64("max-file-size", 2*1024*1024*1024, "Max file size in bytes")
 	rootCmd.PersistentFlags().Int64("max-total-size", 20*1024*1024*1024, "Max total extraction size")
 	rootCmd.PersistentFlags().Float64("max-compression-ratio", 100.0, "Max compression ratio")
+	rootCmd.PersistentFlags().Int("max-symlink-target", security.DefaultMaxSymlinkTarget, "Longest symlink target in bytes accepted in an archive")
+	rootCmd.PersistentFlags().StringSlice("symlink-allowlist", nil, "Reject absolute symlink targets outside these prefixes, e.g. /usr,/bin,/lib (default: allow any)")
+	rootCmd.PersistentFlags().StringSlice("trusted-prefixes", nil, "Key prefixes of trusted images exempt from the compression-ratio check")
+	rootCmd.PersistentFlags().StringSlice("require-content-type", nil, "Content-Types an S3 object may have, e.g. application/x-tar,application/gzip (default: any)")
+	rootCmd.PersistentFlags().Int("max-toplevel-entries", 0, "Top-level entries allowed in an archive without a single root directory (0 = unchecked)")
+	rootCmd.PersistentFlags().String("toplevel-entries-mode", "fail", "On too many top-level entries: fail (reject the image) or warn")
+	rootCmd.PersistentFlags().Bool("isolate-extraction", false, "Extract in a child process confined to a new mount namespace (Linux only)")
+	rootCmd.PersistentFlags().Int("extract-workers", 1, "Concurrent file writers during extraction (1 = sequential)")
+	rootCmd.PersistentFlags().Int("extract-buffer-size", 1024*1024, "Copy buffer size in bytes for extracting file contents")
+	rootCmd.PersistentFlags().Bool("stream-extract", false, "Extract images while downloading, without keeping the tarball on disk")
+	rootCmd.PersistentFlags().Bool("trust-multipart-etags", false, "Treat a matching multipart S3 ETag as proof a download is current, skipping its SHA256 check")
+	rootCmd.PersistentFlags().Int64("max-host-extracted-size", 0, "Max combined size of all images on the host in bytes (0 = unlimited)")
+	rootCmd.PersistentFlags().Float64("pool-metadata-critical-percent", 95.0, "Pool metadata usage (percent) at which new devices are refused")
+	rootCmd.PersistentFlags().Float64("device-headroom", 0, "Size devices to the extracted image plus this fraction of it, e.g. 0.25 (0 = fixed 1GiB)")
+	rootCmd.PersistentFlags().StringSlice("device-pools", nil, "Extra thin pools for devices by size, e.g. ssd:2147483648,hdd (name:maxbytes, or name for no limit)")
+	rootCmd.PersistentFlags().String("device-prefix", "flyio", "Prefix of device and snapshot names under /dev/mapper")
+	rootCmd.PersistentFlags().String("hostname", "", "Host recorded on the images this host creates or updates (default: the OS hostname)")
+	rootCmd.PersistentFlags().String("storage-driver", "devicemapper", "How image trees are mounted (devicemapper, overlay)")
+	rootCmd.PersistentFlags().Int("max-attempts", 0, "Max fetch runs per image, persisted across restarts (0 = unlimited)")
+	rootCmd.PersistentFlags().Duration("fetch-timeout", 0, "Deadline for each fetch run (0 = none); --timeout-seconds overrides it per image")
+
+	rootCmd.PersistentFlags().String("event-log", "", "Append a JSON Lines record per FSM transition to this file")
+	rootCmd.PersistentFlags().String("run-id-log-key", "run_id", "Log attribute carrying the FSM run ID on every line a run logs")
+	rootCmd.PersistentFlags().String("notify-url", "", "POST a JSON notification here when an image is ready or fails")
+	rootCmd.PersistentFlags().String("notify-secret", "", "HMAC-SHA256 key for the notification signature header (prefer FLYIO_NOTIFY_SECRET)")
+	rootCmd.PersistentFlags().Bool("json", false, "Report a failure as a JSON object on stderr (error, kind, exit_code, image_key)")
 
+	viper.BindPFlag("config", rootCmd.PersistentFlags().Lookup("config"))
 	viper.BindPFlag("sqlite-path", rootCmd.PersistentFlags().Lookup("sqlite-path"))
 	viper.BindPFlag("fsm-db-path", rootCmd.PersistentFlags().Lookup("fsm-db-path"))
 	viper.BindPFlag("s3-bucket", rootCmd.PersistentFlags().Lookup("s3-bucket"))
 	viper.BindPFlag("s3-region", rootCmd.PersistentFlags().Lookup("s3-region"))
+	viper.BindPFlag("source", rootCmd.PersistentFlags().Lookup("source"))
+	viper.BindPFlag("source-dir", rootCmd.PersistentFlags().Lookup("source-dir"))
+	viper.BindPFlag("scratch-dir", rootCmd.PersistentFlags().Lookup("scratch-dir"))
+	viper.BindPFlag("hash-algorithm", rootCmd.PersistentFlags().Lookup("hash-algorithm"))
+	viper.BindPFlag("download-part-size", rootCmd.PersistentFlags().Lookup("download-part-size"))
+	viper.BindPFlag("download-concurrency", rootCmd.PersistentFlags().Lookup("download-concurrency"))
+	viper.BindPFlag("download-breaker-threshold", rootCmd.PersistentFlags().Lookup("download-breaker-threshold"))
+	viper.BindPFlag("download-breaker-cooldown", rootCmd.PersistentFlags().Lookup("download-breaker-cooldown"))
 	viper.BindPFlag("max-file-size", rootCmd.PersistentFlags().Lookup("max-file-size"))
 	viper.BindPFlag("max-total-size", rootCmd.PersistentFlags().Lookup("max-total-size"))
 	viper.BindPFlag("max-compression-ratio", rootCmd.PersistentFlags().Lookup("max-compression-ratio"))
+	viper.BindPFlag("max-symlink-target", rootCmd.PersistentFlags().Lookup("max-symlink-target"))
+	viper.BindPFlag("symlink-allowlist", rootCmd.PersistentFlags().Lookup("symlink-allowlist"))
+	viper.BindPFlag("trusted-prefixes", rootCmd.PersistentFlags().Lookup("trusted-prefixes"))
+	viper.BindPFlag("require-content-type", rootCmd.PersistentFlags().Lookup("require-content-type"))
+	viper.BindPFlag("max-toplevel-entries", rootCmd.PersistentFlags().Lookup("max-toplevel-entries"))
+	viper.BindPFlag("toplevel-entries-mode", rootCmd.PersistentFlags().Lookup("toplevel-entries-mode"))
+	viper.BindPFlag("isolate-extraction", rootCmd.PersistentFlags().Lookup("isolate-extraction"))
+	viper.BindPFlag("extract-workers", rootCmd.PersistentFlags().Lookup("extract-workers"))
+	viper.BindPFlag("extract-buffer-size", rootCmd.PersistentFlags().Lookup("extract-buffer-size"))
+	viper.BindPFlag("stream-extract", rootCmd.PersistentFlags().Lookup("stream-extract"))
+	viper.BindPFlag("trust-multipart-etags", rootCmd.PersistentFlags().Lookup("trust-multipart-etags"))
+	viper.BindPFlag("max-host-extracted-size", rootCmd.PersistentFlags().Lookup("max-host-extracted-size"))
+	viper.BindPFlag("pool-metadata-critical-percent", rootCmd.PersistentFlags().Lookup("pool-metadata-critical-percent"))
+	viper.BindPFlag("device-headroom", rootCmd.PersistentFlags().Lookup("device-headroom"))
+	viper.BindPFlag("device-pools", rootCmd.PersistentFlags().Lookup("device-pools"))
+	viper.BindPFlag("device-prefix", rootCmd.PersistentFlags().Lookup("device-prefix"))
+	viper.BindPFlag("hostname", rootCmd.PersistentFlags().Lookup("hostname"))
+	viper.BindPFlag("storage-driver", rootCmd.PersistentFlags().Lookup("storage-driver"))
+	viper.BindPFlag("max-attempts", rootCmd.PersistentFlags().Lookup("max-attempts"))
+	viper.BindPFlag("fetch-timeout", rootCmd.PersistentFlags().Lookup("fetch-timeout"))
+	viper.BindPFlag("event-log", rootCmd.PersistentFlags().Lookup("event-log"))
+	viper.BindPFlag("run-id-log-key", rootCmd.PersistentFlags().Lookup("run-id-log-key"))
+	viper.BindPFlag("notify-url", rootCmd.PersistentFlags().Lookup("notify-url"))
+	viper.BindPFlag("notify-secret", rootCmd.PersistentFlags().Lookup("notify-secret"))
 }
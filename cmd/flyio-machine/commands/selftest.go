@@ -0,0 +1,282 @@
+package commands
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fly-io/162719/internal/config"
+	"github.com/fly-io/162719/pkg/db"
+	"github.com/fly-io/162719/pkg/devicemapper"
+	"github.com/fly-io/162719/pkg/errors"
+	appfsm "github.com/fly-io/162719/pkg/fsm"
+	"github.com/fly-io/162719/pkg/security"
+	"github.com/fly-io/162719/pkg/storage"
+	"github.com/spf13/cobra"
+	"github.com/superfly/fsm"
+)
+
+var selftestCmd = &cobra.Command{
+	Use:   "selftest",
+	Short: "Run the full pipeline on a synthetic image",
+	Long: `Build a small synthetic image and run it through the same pipeline
+as fetch-and-create - download from a local source, validation, device
+creation, scan and snapshot - reporting each stage.
+
+The run uses its own database, FSM store and work directory in a
+temporary directory that is removed afterwards, so no configured state is
+touched. When devicemapper is available, device IDs are allocated from
+the configured database so they can't collide with real devices, and the
+device and snapshot are removed again. Without devicemapper (or with
+--stub) the run stops short of device creation and reports the expected
+degradations.`,
+	Args: cobra.NoArgs,
+	RunE: runSelftest,
+}
+
+var selftestStub bool
+
+func init() {
+	rootCmd.AddCommand(selftestCmd)
+	selftestCmd.Flags().BoolVar(&selftestStub, "stub", false, "Don't use devicemapper, as on hosts without it")
+}
+
+// selftestImageKey is the key of the synthetic image in the local source
+const selftestImageKey = "selftest.tar"
+
+// selftestStages are the pipeline stages reported, in order
+var selftestStages = []string{
+	appfsm.StateCheckDB,
+	appfsm.StateDownload,
+	appfsm.StateValidate,
+	appfsm.StateCreateDevice,
+	appfsm.StateScan,
+	appfsm.StateComplete,
+}
+
+// selftestReport is the outcome of a selftest run
+type selftestReport struct {
+	// Reached is how many of selftestStages were entered; with a failed
+	// run the last one reached is the one that failed
+	Reached      int
+	Failed       bool
+	Degradations []string
+}
+
+// Degraded reports whether the run succeeded with steps skipped
+func (r *selftestReport) Degraded() bool {
+	return !r.Failed && len(r.Degradations) > 0
+}
+
+func runSelftest(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+
+	cfg, err := config.Load()
+	if err != nil {
+		return configError(errors.Wrap(err, "config load failed"))
+	}
+	if err := cfg.Validate(); err != nil {
+		return configError(errors.Wrap(err, "config invalid"))
+	}
+
+	var dmManager devicemapper.Manager
+	if !selftestStub {
+		dmManager, err = devicemapper.NewManager("pool", devicemapper.DefaultDataSize, devicemapper.DefaultMetadataSize,
+			devicemapper.WithMetadataCriticalPercent(cfg.PoolMetadataCriticalPercent),
+			devicemapper.WithPoolTiers(poolTiers(cfg)...),
+			devicemapper.WithDevicePrefix(cfg.DevicePrefix))
+		if err != nil {
+			slog.Warn("devicemapper unavailable", "error", err)
+			dmManager = nil
+		}
+	}
+	if dmManager != nil {
+		defer dmManager.Close()
+	}
+
+	report, runErr := selftest(ctx, cfg, dmManager)
+	writeSelftestReport(os.Stdout, report, runErr)
+	return runErr
+}
+
+// selftest runs a synthetic image through the pipeline in a temporary
+// directory. dmManager may be nil. The report is valid even when an
+// error is returned.
+func selftest(ctx context.Context, cfg *config.Config, dmManager devicemapper.Manager) (*selftestReport, error) {
+	report := &selftestReport{}
+
+	tmpDir, err := os.MkdirTemp("", "flyio-selftest-")
+	if err != nil {
+		return report, errors.Wrap(err, "failed to create temp dir")
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// The run gets its own copy of the config pointing at the temp dir, so
+	// cleanup works on its layout and not the configured one
+	runCfg := *cfg
+	runCfg.SQLitePath = filepath.Join(tmpDir, "images.db")
+	runCfg.FSMDBPath = filepath.Join(tmpDir, "fsm.db")
+	runCfg.WorkDir = filepath.Join(tmpDir, "work")
+	runCfg.ScratchDir = ""
+	runCfg.SourceDir = filepath.Join(tmpDir, "source")
+
+	if err := ensureDirectories(runCfg.SQLitePath, runCfg.FSMDBPath, runCfg.WorkDir); err != nil {
+		return report, err
+	}
+	if err := writeSelftestImage(filepath.Join(runCfg.SourceDir, selftestImageKey)); err != nil {
+		return report, err
+	}
+
+	repo, err := openRepository(&runCfg)
+	if err != nil {
+		return report, errors.Wrap(err, "db init failed")
+	}
+	defer repo.Close()
+
+	source, err := storage.NewLocalSource(runCfg.SourceDir, storage.ClientOptions{HashAlgorithm: cfg.HashAlgorithm})
+	if err != nil {
+		return report, errors.Wrap(err, "local source failed")
+	}
+
+	manager, err := fsm.New(fsm.Config{DBPath: runCfg.FSMDBPath})
+	if err != nil {
+		return report, errors.Wrap(err, "FSM manager failed")
+	}
+	defer manager.Shutdown(10 * time.Second)
+
+	hooks := make(map[string]appfsm.StateHook)
+	for i, state := range selftestStages {
+		hooks[state] = func(ctx context.Context, req *appfsm.ImageRequest, resp *appfsm.ImageResponse) {
+			report.Reached = max(report.Reached, i+1)
+		}
+	}
+	opts := []appfsm.Option{
+		appfsm.WithClock(commandClock),
+		appfsm.WithExtractOptions(extractOptions(cfg)),
+		appfsm.WithStateHooks(hooks),
+		appfsm.WithRunIDKey(cfg.RunIDLogKey),
+	}
+	if cfg.StorageDriver != "" {
+		opts = append(opts, appfsm.WithStorageDriver(cfg.StorageDriver))
+	}
+	if cfg.DeviceHeadroom > 0 {
+		opts = append(opts, appfsm.WithDeviceHeadroom(cfg.DeviceHeadroom))
+	}
+	if dmManager != nil {
+		// Thin device IDs are shared by the whole pool; take them from the
+		// configured database so they can't collide with real devices
+		if err := ensureDirectories(cfg.SQLitePath, "", ""); err != nil {
+			return report, err
+		}
+		idRepo, err := openRepository(cfg)
+		if err != nil {
+			return report, errors.Wrap(err, "db init failed")
+		}
+		defer idRepo.Close()
+		opts = append(opts, appfsm.WithDeviceIDAllocator(idRepo))
+	}
+
+	validator := security.NewValidator(cfg.MaxFileSize, cfg.MaxTotalSize, cfg.MaxCompressionRatio,
+		security.WithMaxSymlinkTarget(cfg.MaxSymlinkTarget),
+		security.WithAbsoluteSymlinkAllowlist(cfg.SymlinkAllowlist...))
+	machine := appfsm.NewMachine(repo, source, validator, dmManager, runCfg.WorkDir, cfg.FSMMaxRetries, opts...)
+	start, _, err := machine.Register(ctx, manager)
+	if err != nil {
+		return report, errors.Wrap(err, "FSM register failed")
+	}
+
+	resp := &appfsm.ImageResponse{}
+	version, err := start(ctx, selftestImageKey, fsm.NewRequest(&appfsm.ImageRequest{S3Key: selftestImageKey}, resp))
+	if err != nil {
+		return report, errors.Wrap(err, "FSM start failed")
+	}
+	runErr := manager.Wait(ctx, version)
+	report.Degradations = resp.Degradations
+
+	// Remove the device and snapshot whether or not the run finished
+	if dmManager != nil {
+		if img, err := repo.GetByS3KeyContext(ctx, selftestImageKey); err == nil && img != nil {
+			if err := releaseImageResources(ctx, dmManager, &runCfg, img); err != nil {
+				slog.Warn("selftest_cleanup_failed", "error", err)
+			}
+		}
+	}
+
+	if runErr != nil {
+		report.Failed = true
+		return report, errors.Wrap(runErr, "selftest failed")
+	}
+	if resp.Status != db.StatusReady {
+		report.Failed = true
+		return report, fmt.Errorf("selftest image finished %q, not %q", resp.Status, db.StatusReady)
+	}
+	return report, nil
+}
+
+// writeSelftestImage writes a minimal rootfs tarball to path
+func writeSelftestImage(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.Wrap(err, "failed to create source dir")
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.Wrap(err, "failed to create selftest image")
+	}
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+	for _, dir := range []string{"bin/", "etc/"} {
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: dir, Mode: 0755}); err != nil {
+			return errors.Wrap(err, "failed to write selftest image")
+		}
+	}
+	files := []struct{ name, body string }{
+		{"bin/sh", "#!/bin/sh\n"},
+		{"etc/hostname", "selftest\n"},
+		{"etc/os-release", "ID=selftest\n"},
+	}
+	for _, file := range files {
+		hdr := &tar.Header{Typeflag: tar.TypeReg, Name: file.name, Mode: 0644, Size: int64(len(file.body))}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return errors.Wrap(err, "failed to write selftest image")
+		}
+		if _, err := io.WriteString(tw, file.body); err != nil {
+			return errors.Wrap(err, "failed to write selftest image")
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return errors.Wrap(err, "failed to write selftest image")
+	}
+	return f.Close()
+}
+
+// writeSelftestReport prints each stage's outcome and the overall result
+func writeSelftestReport(w io.Writer, report *selftestReport, runErr error) {
+	for i, state := range selftestStages {
+		switch {
+		case i >= report.Reached:
+			fmt.Fprintf(w, "   %-14s not run\n", state)
+		case report.Failed && i == report.Reached-1:
+			fmt.Fprintf(w, "❌ %-14s failed\n", state)
+		default:
+			fmt.Fprintf(w, "✅ %-14s passed\n", state)
+		}
+	}
+
+	switch {
+	case runErr != nil:
+		fmt.Fprintf(w, "❌ selftest failed: %v\n", runErr)
+	case report.Degraded():
+		fmt.Fprintf(w, "⚠️  selftest passed with %d degradation(s):\n", len(report.Degradations))
+		for _, d := range report.Degradations {
+			fmt.Fprintf(w, "   - %s\n", d)
+		}
+	default:
+		fmt.Fprintln(w, "✅ selftest passed")
+	}
+}
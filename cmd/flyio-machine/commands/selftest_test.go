@@ -0,0 +1,41 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/fly-io/162719/internal/config"
+)
+
+func TestSelftest_StubReportsSuccessWithDegradation(t *testing.T) {
+	if got := execute([]string{"--source", "s3", "--max-file-size", "1048576", "selftest", "--stub"}); got != exitOK {
+		t.Fatalf("selftest --stub exit code = %d, want %d", got, exitOK)
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("config load: %v", err)
+	}
+	report, err := selftest(context.Background(), cfg, nil)
+	if err != nil {
+		t.Fatalf("selftest: %v", err)
+	}
+	if report.Reached != len(selftestStages) {
+		t.Errorf("reached %d stages, want %d", report.Reached, len(selftestStages))
+	}
+	if !report.Degraded() {
+		t.Errorf("stub selftest not reported degraded: %+v", report)
+	}
+
+	var out bytes.Buffer
+	writeSelftestReport(&out, report, nil)
+	if strings.Contains(out.String(), "failed") || strings.Contains(out.String(), "not run") {
+		t.Errorf("report shows a failed or skipped stage:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "selftest passed with 2 degradation(s)") ||
+		!strings.Contains(out.String(), "device creation skipped") {
+		t.Errorf("report doesn't show success with degradation:\n%s", out.String())
+	}
+}
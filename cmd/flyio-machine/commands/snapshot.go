@@ -0,0 +1,105 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/fly-io/162719/internal/config"
+	"github.com/fly-io/162719/pkg/db"
+	"github.com/fly-io/162719/pkg/devicemapper"
+	"github.com/fly-io/162719/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var snapshotCmd = &cobra.Command{
+	Use:   "snapshot",
+	Short: "Manage image snapshot devices",
+}
+
+var snapshotActivateCmd = &cobra.Command{
+	Use:   "activate <image-key>",
+	Short: "Map an image's snapshot as a device",
+	Long: `Map an existing snapshot under /dev/mapper. Only the device mapping is
+created; the snapshot's data in the thin pool is left untouched.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runSnapshotToggle(args[0], true)
+	},
+}
+
+var snapshotDeactivateCmd = &cobra.Command{
+	Use:   "deactivate <image-key>",
+	Short: "Unmap an image's snapshot device",
+	Long: `Remove an image's snapshot mapping from /dev/mapper. The snapshot stays
+in the thin pool and can be activated again later.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runSnapshotToggle(args[0], false)
+	},
+}
+
+func init() {
+	snapshotCmd.AddCommand(snapshotActivateCmd, snapshotDeactivateCmd)
+	rootCmd.AddCommand(snapshotCmd)
+}
+
+func runSnapshotToggle(imageKey string, active bool) error {
+	ctx := context.Background()
+
+	cfg, err := config.Load()
+	if err != nil {
+		return configError(errors.Wrap(err, "config load failed"))
+	}
+
+	repo, err := openRepository(cfg)
+	if err != nil {
+		return errors.Wrap(err, "db init failed")
+	}
+	defer repo.Close()
+
+	dmManager, err := devicemapper.NewManager("pool", devicemapper.DefaultDataSize, devicemapper.DefaultMetadataSize,
+		devicemapper.WithPoolTiers(poolTiers(cfg)...),
+		devicemapper.WithDevicePrefix(cfg.DevicePrefix))
+	if err != nil {
+		return deviceError(errors.Wrap(err, "devicemapper unavailable"))
+	}
+	defer dmManager.Close()
+
+	return setSnapshotActive(ctx, repo, dmManager, imageKey, active)
+}
+
+// setSnapshotActive maps or unmaps an image's snapshot and records the
+// result. It only touches device mappings, never pool metadata.
+func setSnapshotActive(ctx context.Context, repo *db.Repository, dmManager devicemapper.Manager, imageKey string, active bool) error {
+	img, err := repo.GetByS3KeyContext(ctx, imageKey)
+	if err != nil {
+		return errors.Wrap(err, "image lookup failed")
+	}
+	if img == nil {
+		return fmt.Errorf("image not found: %s", imageKey)
+	}
+	if img.Status != db.StatusReady || img.SnapshotID == 0 {
+		return fmt.Errorf("image %s has no snapshot (status: %s)", imageKey, img.Status)
+	}
+
+	if active {
+		info, err := dmManager.ActivateSnapshot(ctx, img.SnapshotID)
+		if err != nil {
+			return deviceError(errors.Wrap(err, "snapshot activation failed"))
+		}
+		if err := repo.SetSnapshotActiveContext(ctx, img.ID, true); err != nil {
+			return errors.Wrap(err, "failed to record snapshot state")
+		}
+		fmt.Printf("✅ Activated snapshot %d for %s at %s\n", img.SnapshotID, imageKey, info.DevicePath)
+		return nil
+	}
+
+	if err := dmManager.DeactivateSnapshot(ctx, img.SnapshotID); err != nil {
+		return deviceError(errors.Wrap(err, "snapshot deactivation failed"))
+	}
+	if err := repo.SetSnapshotActiveContext(ctx, img.ID, false); err != nil {
+		return errors.Wrap(err, "failed to record snapshot state")
+	}
+	fmt.Printf("💤 Deactivated snapshot %d for %s\n", img.SnapshotID, imageKey)
+	return nil
+}
@@ -0,0 +1,154 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/fly-io/162719/internal/config"
+	"github.com/fly-io/162719/pkg/db"
+	"github.com/fly-io/162719/pkg/devicemapper"
+	"github.com/fly-io/162719/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var snapshotBatchCmd = &cobra.Command{
+	Use:   "snapshot-batch <image-key>...",
+	Short: "Create writable clones of several images in one batch",
+	Long: `Create --count writable clones of each image, like clone, but as one
+batch: every clone of the same image is snapshotted under a single suspend
+of the image's snapshot instead of one suspend per clone.
+
+A clone that fails doesn't stop the others. Each result is printed, and
+the command fails if any clone did.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: runSnapshotBatch,
+}
+
+var snapshotBatchCount int
+
+func init() {
+	rootCmd.AddCommand(snapshotBatchCmd)
+	snapshotBatchCmd.Flags().IntVar(&snapshotBatchCount, "count", 1, "Clones to create of each image")
+}
+
+// batchClone is the outcome of one clone of a batch
+type batchClone struct {
+	ImageKey string
+	// CloneID is 0 if the clone never got an ID
+	CloneID    int
+	DevicePath string
+	Err        error
+}
+
+func runSnapshotBatch(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+
+	if snapshotBatchCount < 1 {
+		return usageError(fmt.Errorf("--count must be at least 1"))
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		return configError(errors.Wrap(err, "config load failed"))
+	}
+
+	repo, err := openRepository(cfg)
+	if err != nil {
+		return errors.Wrap(err, "db init failed")
+	}
+	defer repo.Close()
+
+	dmManager, err := devicemapper.NewManager("pool", devicemapper.DefaultDataSize, devicemapper.DefaultMetadataSize,
+		devicemapper.WithMetadataCriticalPercent(cfg.PoolMetadataCriticalPercent),
+		devicemapper.WithPoolTiers(poolTiers(cfg)...),
+		devicemapper.WithDevicePrefix(cfg.DevicePrefix))
+	if err != nil {
+		return deviceError(errors.Wrap(err, "devicemapper unavailable"))
+	}
+	defer dmManager.Close()
+
+	results := cloneBatch(ctx, repo, dmManager, args, snapshotBatchCount)
+	failed := 0
+	for _, r := range results {
+		if r.Err != nil {
+			failed++
+			fmt.Printf("❌ %s: %v\n", r.ImageKey, r.Err)
+			continue
+		}
+		fmt.Printf("✅ %s: clone %d at %s\n", r.ImageKey, r.CloneID, r.DevicePath)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d clones failed", failed, len(results))
+	}
+	return nil
+}
+
+// cloneBatch creates count clones of each image's snapshot in a single
+// CreateSnapshots call and records the ones that succeed. There is one
+// result per requested clone, in keys order; an image that can't be
+// cloned fails all of its clones.
+func cloneBatch(ctx context.Context, repo *db.Repository, dmManager devicemapper.Manager, keys []string, count int) []batchClone {
+	var results []batchClone
+	var specs []devicemapper.SnapshotSpec
+	// specResult maps each spec to its entry in results
+	var specResult []int
+	images := make(map[string]*db.Image)
+
+	for _, key := range keys {
+		img, err := repo.GetByS3KeyContext(ctx, key)
+		switch {
+		case err != nil:
+			err = errors.Wrap(err, "image lookup failed")
+		case img == nil:
+			err = fmt.Errorf("image not found")
+		case img.Status != db.StatusReady || img.SnapshotID == 0:
+			err = fmt.Errorf("image has no active snapshot (status: %s)", img.Status)
+		}
+		images[key] = img
+
+		for i := 0; i < count; i++ {
+			result := batchClone{ImageKey: key, Err: err}
+			if err == nil {
+				if result.CloneID, result.Err = repo.AllocateNextDeviceID(ctx); result.Err != nil {
+					result.Err = errors.Wrap(result.Err, "clone ID allocation failed")
+				}
+			}
+			results = append(results, result)
+			if result.Err == nil {
+				specs = append(specs, devicemapper.SnapshotSpec{SourceID: fmt.Sprintf("%d", img.SnapshotID), SnapshotID: result.CloneID})
+				specResult = append(specResult, len(results)-1)
+			}
+		}
+	}
+	if len(specs) == 0 {
+		return results
+	}
+
+	fmt.Printf("🧬 Creating %d clone(s) of %d image(s)...\n", len(specs), len(keys))
+	infos, errs := dmManager.CreateSnapshots(ctx, specs)
+
+	for s, r := range specResult {
+		result := &results[r]
+		if s >= len(errs) || s >= len(infos) || (errs[s] == nil && infos[s] == nil) {
+			result.Err = fmt.Errorf("no result for clone %d", result.CloneID)
+			continue
+		}
+		if errs[s] != nil {
+			result.Err = errors.Wrap(errs[s], "clone creation failed")
+			continue
+		}
+		img := images[result.ImageKey]
+		clone := &db.Clone{
+			ImageID:          img.ID,
+			DeviceID:         result.CloneID,
+			SourceSnapshotID: img.SnapshotID,
+			DevicePath:       infos[s].DevicePath,
+		}
+		if err := repo.CreateCloneContext(ctx, clone); err != nil {
+			result.Err = errors.Wrap(err, "failed to record clone")
+			continue
+		}
+		result.DevicePath = infos[s].DevicePath
+	}
+	return results
+}
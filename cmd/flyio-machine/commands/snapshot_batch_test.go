@@ -0,0 +1,97 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/fly-io/162719/pkg/db"
+	"github.com/fly-io/162719/pkg/devicemapper"
+)
+
+// fakeBatchManager fails every snapshot of failSource and records the
+// specs it was given
+type fakeBatchManager struct {
+	devicemapper.Manager
+	failSource string
+	specs      []devicemapper.SnapshotSpec
+}
+
+func (f *fakeBatchManager) CreateSnapshots(ctx context.Context, specs []devicemapper.SnapshotSpec) ([]*devicemapper.DeviceInfo, []error) {
+	f.specs = append(f.specs, specs...)
+	infos := make([]*devicemapper.DeviceInfo, len(specs))
+	errs := make([]error, len(specs))
+	for i, spec := range specs {
+		if spec.SourceID == f.failSource {
+			errs[i] = fmt.Errorf("create_snap failed")
+			continue
+		}
+		infos[i] = &devicemapper.DeviceInfo{DevicePath: fmt.Sprintf("/dev/mapper/flyio-snapshot-%d", spec.SnapshotID), SnapshotID: spec.SnapshotID}
+	}
+	return infos, errs
+}
+
+func TestCloneBatch_PartialFailure(t *testing.T) {
+	dbPath := "/tmp/test_images_snapshot_batch.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	repo, err := db.NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	ctx := context.Background()
+	good := &db.Image{S3Key: "images/good.tar", Status: db.StatusReady, SnapshotID: 5}
+	bad := &db.Image{S3Key: "images/bad.tar", Status: db.StatusReady, SnapshotID: 7}
+	pending := &db.Image{S3Key: "images/pending.tar", Status: db.StatusPending}
+	for _, img := range []*db.Image{good, bad, pending} {
+		if err := repo.CreateContext(ctx, img); err != nil {
+			t.Fatalf("create image: %v", err)
+		}
+	}
+
+	dm := &fakeBatchManager{failSource: "7"}
+	keys := []string{good.S3Key, bad.S3Key, pending.S3Key, "images/missing.tar"}
+	results := cloneBatch(ctx, repo, dm, keys, 2)
+
+	if len(results) != 2*len(keys) {
+		t.Fatalf("got %d results, want %d", len(results), 2*len(keys))
+	}
+	// Only images with a snapshot reach the manager, in one batch
+	if len(dm.specs) != 4 {
+		t.Errorf("manager got %d specs, want 4: %+v", len(dm.specs), dm.specs)
+	}
+	for i, r := range results {
+		if r.ImageKey != keys[i/2] {
+			t.Errorf("results[%d] is for %s, want %s", i, r.ImageKey, keys[i/2])
+		}
+		wantOK := r.ImageKey == good.S3Key
+		if (r.Err == nil) != wantOK {
+			t.Errorf("results[%d] (%s) err = %v, want success: %v", i, r.ImageKey, r.Err, wantOK)
+		}
+		if wantOK && (r.CloneID == 0 || r.DevicePath == "") {
+			t.Errorf("results[%d] = %+v, want a clone ID and device path", i, r)
+		}
+	}
+	if results[0].CloneID == results[1].CloneID {
+		t.Errorf("both clones of %s got ID %d", good.S3Key, results[0].CloneID)
+	}
+
+	// Only successful clones are recorded
+	for _, img := range []*db.Image{good, bad} {
+		clones, err := repo.ListClonesContext(ctx, img.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := 0
+		if img == good {
+			want = 2
+		}
+		if len(clones) != want {
+			t.Errorf("%s has %d recorded clones, want %d", img.S3Key, len(clones), want)
+		}
+	}
+}
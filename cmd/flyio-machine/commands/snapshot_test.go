@@ -0,0 +1,107 @@
+package commands
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/fly-io/162719/pkg/db"
+	"github.com/fly-io/162719/pkg/devicemapper"
+	"github.com/spf13/cobra"
+)
+
+// fakeSnapshotManager records snapshot activation calls
+type fakeSnapshotManager struct {
+	devicemapper.Manager
+	activated   []int
+	deactivated []int
+}
+
+func (f *fakeSnapshotManager) ActivateSnapshot(ctx context.Context, snapshotID int) (*devicemapper.DeviceInfo, error) {
+	f.activated = append(f.activated, snapshotID)
+	return &devicemapper.DeviceInfo{DevicePath: "/dev/mapper/flyio-snapshot-x", SnapshotID: snapshotID}, nil
+}
+
+func (f *fakeSnapshotManager) DeactivateSnapshot(ctx context.Context, snapshotID int) error {
+	f.deactivated = append(f.deactivated, snapshotID)
+	return nil
+}
+
+func TestSnapshotCommands_RequireImageKey(t *testing.T) {
+	for _, cmd := range []*cobra.Command{snapshotActivateCmd, snapshotDeactivateCmd} {
+		if err := cmd.Args(cmd, nil); err == nil {
+			t.Errorf("%s accepted no arguments", cmd.Name())
+		}
+		if err := cmd.Args(cmd, []string{"a.tar", "b.tar"}); err == nil {
+			t.Errorf("%s accepted two arguments", cmd.Name())
+		}
+		if err := cmd.Args(cmd, []string{"a.tar"}); err != nil {
+			t.Errorf("%s rejected one argument: %v", cmd.Name(), err)
+		}
+	}
+
+	names := map[string]bool{}
+	for _, sub := range snapshotCmd.Commands() {
+		names[sub.Name()] = true
+	}
+	if !names["activate"] || !names["deactivate"] {
+		t.Errorf("snapshot subcommands = %v, want activate and deactivate", names)
+	}
+}
+
+func TestSetSnapshotActive(t *testing.T) {
+	dbPath := "/tmp/test_images_snapshot.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	repo, err := db.NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	ctx := context.Background()
+	img := &db.Image{S3Key: "images/alpine.tar", Status: db.StatusReady, SnapshotID: 5, SnapshotActive: true}
+	if err := repo.Create(img); err != nil {
+		t.Fatalf("create image: %v", err)
+	}
+	pending := &db.Image{S3Key: "images/pending.tar", Status: db.StatusPending}
+	if err := repo.Create(pending); err != nil {
+		t.Fatalf("create image: %v", err)
+	}
+
+	dm := &fakeSnapshotManager{}
+
+	if err := setSnapshotActive(ctx, repo, dm, img.S3Key, false); err != nil {
+		t.Fatalf("deactivate: %v", err)
+	}
+	got, _ := repo.GetByS3Key(img.S3Key)
+	if got.SnapshotActive {
+		t.Error("snapshot still recorded active after deactivate")
+	}
+
+	if err := setSnapshotActive(ctx, repo, dm, img.S3Key, true); err != nil {
+		t.Fatalf("activate: %v", err)
+	}
+	got, _ = repo.GetByS3Key(img.S3Key)
+	if !got.SnapshotActive {
+		t.Error("snapshot not recorded active after activate")
+	}
+
+	if len(dm.deactivated) != 1 || dm.deactivated[0] != 5 {
+		t.Errorf("deactivated = %v, want [5]", dm.deactivated)
+	}
+	if len(dm.activated) != 1 || dm.activated[0] != 5 {
+		t.Errorf("activated = %v, want [5]", dm.activated)
+	}
+
+	if err := setSnapshotActive(ctx, repo, dm, pending.S3Key, true); err == nil {
+		t.Error("expected error for image without a snapshot")
+	}
+	if err := setSnapshotActive(ctx, repo, dm, "images/missing.tar", true); err == nil {
+		t.Error("expected error for unknown image")
+	}
+	if len(dm.activated) != 1 {
+		t.Errorf("manager called for invalid images: %v", dm.activated)
+	}
+}
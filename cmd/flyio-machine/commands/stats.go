@@ -0,0 +1,79 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/fly-io/162719/internal/config"
+	"github.com/fly-io/162719/pkg/db"
+	"github.com/fly-io/162719/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var statsJSON bool
+
+var statsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Summarize images, downloads, and devices",
+	RunE:  runStats,
+}
+
+func init() {
+	rootCmd.AddCommand(statsCmd)
+	statsCmd.Flags().BoolVar(&statsJSON, "json", false, "Print stats as JSON")
+}
+
+func runStats(cmd *cobra.Command, args []string) error {
+	cfg, err := config.Load()
+	if err != nil {
+		return configError(errors.Wrap(err, "config load failed"))
+	}
+
+	if err := ensureDirectories(cfg.SQLitePath, "", ""); err != nil {
+		return err
+	}
+
+	repo, err := openRepository(cfg)
+	if err != nil {
+		return errors.Wrap(err, "db init failed")
+	}
+	defer repo.Close()
+
+	stats, err := repo.StatsContext(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "stats failed")
+	}
+
+	if statsJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(stats)
+	}
+
+	printStats(stats)
+	return nil
+}
+
+func printStats(stats *db.Stats) {
+	fmt.Printf("📊 Images: %d\n", stats.TotalImages)
+
+	statuses := make([]string, 0, len(stats.ByStatus))
+	for status := range stats.ByStatus {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+	for _, status := range statuses {
+		fmt.Printf("   %-12s %d\n", status, stats.ByStatus[status])
+	}
+
+	fmt.Printf("📦 Downloaded: %.1f MB\n", float64(stats.TotalDownloadBytes)/1024/1024)
+	fmt.Printf("💾 Devices: %d base, %d snapshots, %d clones\n", stats.ActiveDevices, stats.ActiveSnapshots, stats.Clones)
+	if stats.AvgReadySeconds > 0 {
+		avg := time.Duration(stats.AvgReadySeconds * float64(time.Second)).Round(time.Second)
+		fmt.Printf("⏱️  Average time to ready: %s\n", avg)
+	}
+}
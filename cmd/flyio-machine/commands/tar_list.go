@@ -0,0 +1,151 @@
+package commands
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/fly-io/162719/internal/config"
+	"github.com/fly-io/162719/pkg/devicemapper"
+	"github.com/fly-io/162719/pkg/errors"
+	"github.com/fly-io/162719/pkg/security"
+	"github.com/fly-io/162719/pkg/storage"
+	"github.com/spf13/cobra"
+)
+
+var tarListCmd = &cobra.Command{
+	Use:   "tar-list <image-key>",
+	Short: "List an image tarball's entries without extracting it",
+	Long: `Read an image's tarball from the configured source and list its
+entries - mode, type, size and name - without writing any files. Sources
+that can stream are read once; others are downloaded to a temporary file
+that is removed afterwards.
+
+The path, symlink and size checks extraction applies run in report mode:
+entries that would be rejected are flagged and listing carries on. The
+command exits with the rejected code if any entry was flagged.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runTarList,
+}
+
+func init() {
+	rootCmd.AddCommand(tarListCmd)
+}
+
+func runTarList(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+	key := args[0]
+
+	cfg, err := config.Load()
+	if err != nil {
+		return configError(errors.Wrap(err, "config load failed"))
+	}
+	if err := cfg.Validate(); err != nil {
+		return configError(errors.Wrap(err, "config invalid"))
+	}
+
+	source, err := newSource(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	r, err := openTarball(ctx, source, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	validator := security.NewValidator(cfg.MaxFileSize, cfg.MaxTotalSize, cfg.MaxCompressionRatio,
+		security.WithMaxSymlinkTarget(cfg.MaxSymlinkTarget),
+		security.WithAbsoluteSymlinkAllowlist(cfg.SymlinkAllowlist...))
+	flagged, err := writeTarList(os.Stdout, r, validator)
+	if err != nil {
+		return errors.Wrap(err, "failed to read tarball")
+	}
+	if flagged > 0 {
+		return fmt.Errorf("%w: %d suspicious entries in %s", security.ErrRejected, flagged, key)
+	}
+	return nil
+}
+
+// openTarball streams key from source when it can, or downloads it to a
+// temporary file removed on Close
+func openTarball(ctx context.Context, source storage.Source, key string) (io.ReadCloser, error) {
+	if streamer, ok := source.(storage.Streamer); ok {
+		obj, err := streamer.Open(ctx, key)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to open object")
+		}
+		return obj, nil
+	}
+
+	tmpDir, err := os.MkdirTemp("", "flyio-tar-list-")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create temp dir")
+	}
+	tarPath := filepath.Join(tmpDir, "image.tar")
+	if _, err := source.Download(ctx, key, tarPath); err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, errors.Wrap(err, "download failed")
+	}
+	f, err := os.Open(tarPath)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, errors.Wrap(err, "failed to open tarball")
+	}
+	return &tempTarball{File: f, dir: tmpDir}, nil
+}
+
+// tempTarball is a downloaded tarball whose directory goes on Close
+type tempTarball struct {
+	*os.File
+	dir string
+}
+
+func (t *tempTarball) Close() error {
+	err := t.File.Close()
+	os.RemoveAll(t.dir)
+	return err
+}
+
+// writeTarList prints one line per entry of r, flagging the entries that
+// fail validation, and returns how many were flagged
+func writeTarList(w io.Writer, r io.Reader, validator *security.Validator) (int, error) {
+	flagged := 0
+	err := devicemapper.ListTarball(r, validator, func(e devicemapper.TarEntry) error {
+		name := e.Name
+		if e.Linkname != "" {
+			name += " -> " + e.Linkname
+		}
+		fmt.Fprintf(w, "%s %-8s %10d %s\n", e.Mode, tarTypeName(e.Type), e.Size, name)
+		if e.Problem != nil {
+			flagged++
+			fmt.Fprintf(w, "   ⚠️  %v\n", e.Problem)
+		}
+		return nil
+	})
+	return flagged, err
+}
+
+// tarTypeName names a tar entry type for listing
+func tarTypeName(typeflag byte) string {
+	switch typeflag {
+	case tar.TypeReg:
+		return "file"
+	case tar.TypeDir:
+		return "dir"
+	case tar.TypeSymlink:
+		return "symlink"
+	case tar.TypeLink:
+		return "hardlink"
+	case tar.TypeChar:
+		return "char"
+	case tar.TypeBlock:
+		return "block"
+	case tar.TypeFifo:
+		return "fifo"
+	}
+	return fmt.Sprintf("type-%c", typeflag)
+}
@@ -0,0 +1,64 @@
+package commands
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fly-io/162719/pkg/security"
+)
+
+func TestWriteTarList_FlagsSuspiciousEntries(t *testing.T) {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for _, hdr := range []*tar.Header{
+		{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "bin/sh", Typeflag: tar.TypeSymlink, Linkname: "/usr/bin/dash", Mode: 0777},
+		{Name: "../evil", Typeflag: tar.TypeReg, Mode: 0644},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+
+	var out bytes.Buffer
+	flagged, err := writeTarList(&out, &archive, security.NewValidator(1024, 1024*1024, 100))
+	if err != nil {
+		t.Fatalf("writeTarList: %v", err)
+	}
+	if flagged != 1 {
+		t.Errorf("flagged = %d, want 1", flagged)
+	}
+	for _, want := range []string{"dir", "bin/sh -> /usr/bin/dash", "../evil", "⚠️"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("listing missing %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestTarList_ExitCodes(t *testing.T) {
+	dir := t.TempDir()
+	sourceDir := filepath.Join(dir, "source")
+	if err := os.MkdirAll(sourceDir, 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	writeExitTestTar(t, filepath.Join(sourceDir, "small.tar"), 16)
+	writeExitTestTar(t, filepath.Join(sourceDir, "big.tar"), 4096)
+
+	args := func(key string) []string {
+		return []string{"--source", "local", "--source-dir", sourceDir, "--max-file-size", "1024", "tar-list", key}
+	}
+	if got := execute(args("small.tar")); got != exitOK {
+		t.Errorf("tar-list small.tar exit code = %d, want %d", got, exitOK)
+	}
+	if got := execute(args("big.tar")); got != exitRejected {
+		t.Errorf("tar-list big.tar exit code = %d, want %d", got, exitRejected)
+	}
+	if entries, _ := os.ReadDir(sourceDir); len(entries) != 2 {
+		t.Errorf("tar-list wrote into the source dir: %v", entries)
+	}
+}
@@ -0,0 +1,66 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/fly-io/162719/pkg/devicemapper"
+	"github.com/fly-io/162719/pkg/errors"
+)
+
+// byteSizeUnits maps size suffixes to their binary multipliers
+var byteSizeUnits = map[string]int64{
+	"":  1,
+	"K": 1 << 10,
+	"M": 1 << 20,
+	"G": 1 << 30,
+	"T": 1 << 40,
+}
+
+// parseByteSize parses sizes like "8G", "512Mi", "1TiB" or a plain byte
+// count. Suffixes are binary multiples and case-insensitive.
+func parseByteSize(s string) (int64, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	str = strings.TrimSuffix(str, "B")
+	str = strings.TrimSuffix(str, "I")
+
+	unit := ""
+	if n := len(str); n > 0 && (str[n-1] < '0' || str[n-1] > '9') {
+		unit, str = str[n-1:], str[:n-1]
+	}
+	multiplier, ok := byteSizeUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q: unknown unit %q", s, unit)
+	}
+
+	n, err := strconv.ParseInt(str, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q: expected a positive number with an optional K, M, G or T suffix", s)
+	}
+	if n > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("invalid size %q: too large", s)
+	}
+	return n * multiplier, nil
+}
+
+// mountTmpfsWorkDir mounts a tmpfs of sizeBytes at path so work files stay
+// in memory, returning a function that unmounts it again
+func mountTmpfsWorkDir(ctx context.Context, dmManager devicemapper.Manager, path string, sizeBytes int64) (func(), error) {
+	if dmManager == nil {
+		return nil, deviceError(fmt.Errorf("tmpfs work dir requires devicemapper (root on Linux)"))
+	}
+	if err := dmManager.MountTmpfs(ctx, path, sizeBytes); err != nil {
+		return nil, deviceError(errors.Wrap(err, "tmpfs work dir mount failed"))
+	}
+
+	return func() {
+		// The run's context may already be done; unmounting must still happen
+		if err := dmManager.UnmountDevice(context.Background(), path); err != nil {
+			slog.Error("tmpfs_unmount_failed", "path", path, "error", err)
+		}
+	}, nil
+}
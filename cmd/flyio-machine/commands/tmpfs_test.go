@@ -0,0 +1,35 @@
+package commands
+
+import "testing"
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{in: "4096", want: 4096},
+		{in: "8G", want: 8 << 30},
+		{in: "8g", want: 8 << 30},
+		{in: "512Mi", want: 512 << 20},
+		{in: "1TiB", want: 1 << 40},
+		{in: "64KB", want: 64 << 10},
+		{in: "", wantErr: true},
+		{in: "0", wantErr: true},
+		{in: "-1G", wantErr: true},
+		{in: "8X", wantErr: true},
+		{in: "G", wantErr: true},
+		{in: "9999999999T", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseByteSize(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseByteSize(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseByteSize(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
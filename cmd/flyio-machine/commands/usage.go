@@ -0,0 +1,112 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/fly-io/162719/internal/config"
+	"github.com/fly-io/162719/pkg/db"
+	"github.com/fly-io/162719/pkg/devicemapper"
+	"github.com/fly-io/162719/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var usageCmd = &cobra.Command{
+	Use:   "usage",
+	Short: "Show how much of each image's thin devices is in use",
+	Long: `Print, for each image's base device and snapshot, how many bytes are
+backed by thin pool blocks against the device's virtual size. Thin devices
+are sparse, so this is the space an image actually costs the pool.
+
+A snapshot shares unmodified blocks with its base device, so its usage
+counts those shared blocks too.`,
+	Args: cobra.NoArgs,
+	RunE: runUsage,
+}
+
+var usageImage string
+
+func init() {
+	rootCmd.AddCommand(usageCmd)
+	usageCmd.Flags().StringVar(&usageImage, "image", "", "Only show the image with this key")
+}
+
+func runUsage(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+
+	cfg, err := config.Load()
+	if err != nil {
+		return configError(errors.Wrap(err, "config load failed"))
+	}
+
+	if err := ensureDirectories(cfg.SQLitePath, "", ""); err != nil {
+		return err
+	}
+	repo, err := openRepository(cfg)
+	if err != nil {
+		return errors.Wrap(err, "db init failed")
+	}
+	defer repo.Close()
+
+	var images []*db.Image
+	if usageImage != "" {
+		img, err := repo.GetByS3KeyContext(ctx, usageImage)
+		if err != nil {
+			return errors.Wrap(err, "image lookup failed")
+		}
+		if img == nil {
+			return fmt.Errorf("image not found: %s", usageImage)
+		}
+		images = []*db.Image{img}
+	} else if images, err = repo.ListContext(ctx); err != nil {
+		return errors.Wrap(err, "list failed")
+	}
+
+	dmManager, err := devicemapper.NewManager("pool", devicemapper.DefaultDataSize, devicemapper.DefaultMetadataSize,
+		devicemapper.WithDevicePrefix(cfg.DevicePrefix))
+	if err != nil {
+		return deviceError(errors.Wrap(err, "devicemapper unavailable"))
+	}
+	defer dmManager.Close()
+
+	writeUsage(ctx, os.Stdout, dmManager, images)
+	return nil
+}
+
+// writeUsage prints the device usage of every image that has devices.
+// Devices that can't be read (e.g. an inactive snapshot) are reported and
+// skipped.
+func writeUsage(ctx context.Context, w io.Writer, dmManager devicemapper.Manager, images []*db.Image) {
+	shown := 0
+	for _, img := range images {
+		if img.BaseDeviceID == 0 && img.SnapshotID == 0 {
+			continue
+		}
+		shown++
+		fmt.Fprintf(w, "%s\n", img.S3Key)
+
+		devices := []struct {
+			kind string
+			id   int
+		}{{"base", img.BaseDeviceID}, {"snapshot", img.SnapshotID}}
+		for _, dev := range devices {
+			if dev.id == 0 {
+				continue
+			}
+			label := fmt.Sprintf("%s %d", dev.kind, dev.id)
+			stats, err := dmManager.DeviceStats(ctx, strconv.Itoa(dev.id))
+			if err != nil {
+				fmt.Fprintf(w, "   %-16s ⚠️  %v\n", label, err)
+				continue
+			}
+			fmt.Fprintf(w, "   %-16s %.1f MB used of %.1f MB (%.1f%%)\n", label,
+				float64(stats.UsedBytes)/1024/1024, float64(stats.AllocatedBytes)/1024/1024, stats.UsedPercent())
+		}
+	}
+	if shown == 0 {
+		fmt.Fprintln(w, "No images with devices")
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/fly-io/162719/internal/config"
+	"github.com/fly-io/162719/pkg/db"
 	"github.com/fly-io/162719/pkg/errors"
 )
 
@@ -29,4 +31,11 @@ func ensureDirectories(sqlitePath, fsmDBPath, workDir string) error {
 	}
 
 	return nil
-}
\ No newline at end of file
+}
+
+// openRepository opens the configured database. Every command opens it
+// here so the rows it writes record the same host (--hostname, else the
+// system hostname) that list and cleanup filter on.
+func openRepository(cfg *config.Config) (*db.Repository, error) {
+	return db.NewRepository(cfg.SQLitePath, db.WithClock(commandClock), db.WithHost(cfg.Hostname))
+}
@@ -0,0 +1,112 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/fly-io/162719/internal/config"
+	"github.com/fly-io/162719/pkg/errors"
+	appfsm "github.com/fly-io/162719/pkg/fsm"
+	"github.com/fly-io/162719/pkg/security"
+	"github.com/fly-io/162719/pkg/storage"
+	"github.com/spf13/cobra"
+)
+
+var validateCmd = &cobra.Command{
+	Use:   "validate <tarball>",
+	Short: "Validate a local image tarball without building it",
+	Long: `Run the checks fetch-and-create applies to a download - security
+limits, OCI unpacking and the rootfs layout check - on a local tarball,
+extracting it into a temporary directory that is removed afterwards.
+
+By default images already recorded with the same digest are listed. With
+--no-db no database is opened or created, so the result is reported
+only on stdout and through the exit code.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runValidate,
+}
+
+var (
+	validateNoDB          bool
+	validateRequireRootfs bool
+)
+
+func init() {
+	rootCmd.AddCommand(validateCmd)
+	validateCmd.Flags().BoolVar(&validateNoDB, "no-db", false, "Don't open the image database; report only on stdout and exit code")
+	validateCmd.Flags().BoolVar(&validateRequireRootfs, "require-rootfs", false, "Fail images without /etc and /bin or /usr at the top level (default: warn)")
+}
+
+func runValidate(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+	tarPath := args[0]
+
+	cfg, err := config.Load()
+	if err != nil {
+		return configError(errors.Wrap(err, "config load failed"))
+	}
+	if err := cfg.Validate(); err != nil {
+		return configError(errors.Wrap(err, "config invalid"))
+	}
+
+	digest, err := storage.FileDigest(tarPath, cfg.HashAlgorithm)
+	if err != nil {
+		return usageError(errors.Wrap(err, "failed to read tarball"))
+	}
+
+	tmpDir, err := os.MkdirTemp("", "flyio-validate-")
+	if err != nil {
+		return errors.Wrap(err, "failed to create temp dir")
+	}
+	defer os.RemoveAll(tmpDir)
+
+	validator := security.NewValidator(cfg.MaxFileSize, cfg.MaxTotalSize, cfg.MaxCompressionRatio,
+		security.WithMaxSymlinkTarget(cfg.MaxSymlinkTarget),
+		security.WithAbsoluteSymlinkAllowlist(cfg.SymlinkAllowlist...))
+	extractOpts := extractOptions(cfg)
+
+	result, err := appfsm.ValidateImage(tarPath, filepath.Join(tmpDir, "tree"), validator, extractOpts)
+	if err != nil {
+		fmt.Printf("❌ %s is invalid: %v\n", tarPath, err)
+		return err
+	}
+	if result.RootfsErr != nil {
+		if validateRequireRootfs {
+			fmt.Printf("❌ %s is invalid: %v\n", tarPath, result.RootfsErr)
+			return result.RootfsErr
+		}
+		fmt.Printf("⚠️  %v\n", result.RootfsErr)
+	}
+
+	fmt.Printf("✅ %s is valid (%s)\n", tarPath, digest)
+	if result.OCI {
+		fmt.Println("   OCI image layout unpacked")
+	}
+
+	if validateNoDB {
+		return nil
+	}
+	return printKnownImages(ctx, cfg, digest)
+}
+
+// printKnownImages lists the images recorded with digest
+func printKnownImages(ctx context.Context, cfg *config.Config, digest string) error {
+	repo, err := openRepository(cfg)
+	if err != nil {
+		return errors.Wrap(err, "db init failed")
+	}
+	defer repo.Close()
+
+	images, err := repo.ListContext(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to list images")
+	}
+	for _, img := range images {
+		if storage.FormatDigest(storage.ParseDigest(img.SHA256)) == digest {
+			fmt.Printf("   Known as %s (%s)\n", img.S3Key, img.Status)
+		}
+	}
+	return nil
+}
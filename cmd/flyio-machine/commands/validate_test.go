@@ -0,0 +1,27 @@
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidate_NoDBLeavesNoDatabase(t *testing.T) {
+	dir := t.TempDir()
+	tarPath := filepath.Join(dir, "image.tar")
+	writeExitTestTar(t, tarPath, 16)
+	dbPath := filepath.Join(dir, "images.db")
+
+	args := []string{"--sqlite-path", dbPath, "--source", "s3", "--max-file-size", "1024", "validate", "--no-db", tarPath}
+	if got := execute(args); got != exitOK {
+		t.Fatalf("validate --no-db exit code = %d, want %d", got, exitOK)
+	}
+	if _, err := os.Stat(dbPath); !os.IsNotExist(err) {
+		t.Errorf("validate --no-db created %s", dbPath)
+	}
+
+	writeExitTestTar(t, tarPath, 4096)
+	if got := execute(args); got != exitRejected {
+		t.Errorf("validate --no-db on an oversized file exit code = %d, want %d", got, exitRejected)
+	}
+}
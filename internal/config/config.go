@@ -2,8 +2,16 @@ package config
 
 import (
 	"fmt"
+	"mime"
+	"net/url"
+	"path/filepath"
+	"runtime"
 	"strings"
+	"time"
 
+	"github.com/fly-io/162719/pkg/devicemapper"
+	"github.com/fly-io/162719/pkg/security"
+	"github.com/fly-io/162719/pkg/storage"
 	"github.com/spf13/viper"
 )
 
@@ -17,19 +25,106 @@ type Config struct {
 	S3Bucket string `mapstructure:"s3-bucket"`
 	S3Region string `mapstructure:"s3-region"`
 
+	// Image source: "s3" (default) or "local" to read tarballs from SourceDir
+	Source    string `mapstructure:"source"`
+	SourceDir string `mapstructure:"source-dir"`
+
+	// Download digest algorithm (sha256, sha512)
+	HashAlgorithm string `mapstructure:"hash-algorithm"`
+
+	// Parallel ranged S3 downloads: parts of DownloadPartSize bytes,
+	// DownloadConcurrency at a time (1 = single stream)
+	DownloadPartSize    int64 `mapstructure:"download-part-size"`
+	DownloadConcurrency int   `mapstructure:"download-concurrency"`
+
+	// Consecutive transient download failures that open the download
+	// circuit (0 disables it), and how long it stays open before a probe
+	DownloadBreakerThreshold int           `mapstructure:"download-breaker-threshold"`
+	DownloadBreakerCooldown  time.Duration `mapstructure:"download-breaker-cooldown"`
+
 	// Working directory
 	WorkDir string `mapstructure:"work-dir"`
+	// Downloads and extracted trees; defaults to WorkDir
+	ScratchDir string `mapstructure:"scratch-dir"`
 
 	// Security limits
 	MaxFileSize         int64   `mapstructure:"max-file-size"`
 	MaxTotalSize        int64   `mapstructure:"max-total-size"`
 	MaxCompressionRatio float64 `mapstructure:"max-compression-ratio"`
+	// Longest symlink target accepted in an archive, in bytes
+	MaxSymlinkTarget int `mapstructure:"max-symlink-target"`
+	// Absolute prefixes absolute symlink targets must fall under, e.g.
+	// /usr, /bin and /lib (empty = any absolute target)
+	SymlinkAllowlist []string `mapstructure:"symlink-allowlist"`
+	// Key prefixes of trusted images exempt from the compression-ratio check
+	TrustedPrefixes []string `mapstructure:"trusted-prefixes"`
+	// Content-Types an S3 object must have to be downloaded (empty = any)
+	RequireContentTypes []string `mapstructure:"require-content-type"`
+	// Distinct top-level entries allowed in an archive before it is
+	// treated as a tarbomb (0 = unchecked), and whether to fail or warn
+	MaxTopLevelEntries  int    `mapstructure:"max-toplevel-entries"`
+	TopLevelEntriesMode string `mapstructure:"toplevel-entries-mode"`
+	// Extract in a child process confined to a new mount namespace
+	// chrooted at the destination (Linux only)
+	IsolateExtraction bool `mapstructure:"isolate-extraction"`
+	// Concurrent file writers during extraction (1 = sequential)
+	ExtractWorkers int `mapstructure:"extract-workers"`
+	// Buffer size in bytes for copying file contents out of the tarball
+	ExtractBufferSize int `mapstructure:"extract-buffer-size"`
+	// Extract while downloading instead of writing the tarball to disk
+	StreamExtract bool `mapstructure:"stream-extract"`
+	// Trust a matching multipart ETag without checking the download's
+	// digest
+	TrustMultipartETags bool `mapstructure:"trust-multipart-etags"`
+	// Combined size cap across all images on the host (0 = unlimited)
+	MaxHostExtractedSize int64 `mapstructure:"max-host-extracted-size"`
+	// Pool metadata usage (percent) at which new devices are refused
+	PoolMetadataCriticalPercent float64 `mapstructure:"pool-metadata-critical-percent"`
+	// Size base devices to the extracted image plus this fraction of it
+	// (0 = fixed default size)
+	DeviceHeadroom float64 `mapstructure:"device-headroom"`
+	// Extra thin pools devices are spread over by size, as "name:maxbytes"
+	// or "name" for no limit; devices too large for all of them go to the
+	// default pool. Needs DeviceHeadroom, so devices are sized to images.
+	DevicePools []string `mapstructure:"device-pools"`
+
+	// Prefix of device and snapshot names under /dev/mapper; give each
+	// instance sharing a host its own
+	DevicePrefix string `mapstructure:"device-prefix"`
+
+	// Host recorded on the images this host creates or updates, so hosts
+	// sharing a database can tell their devices apart ("" = os.Hostname())
+	Hostname string `mapstructure:"hostname"`
+
+	// How image trees become mountable roots: "devicemapper" (default)
+	// copies them onto thin devices, "overlay" mounts them as overlayfs
+	// lower layers
+	StorageDriver string `mapstructure:"storage-driver"`
 
 	// Feature flags
 	DMEnabled bool `mapstructure:"dm-enabled"`
 
 	// FSM configuration
 	FSMMaxRetries int `mapstructure:"fsm-max-retries"`
+	// Fetch runs allowed per image across restarts (0 = unlimited)
+	MaxAttempts int `mapstructure:"max-attempts"`
+	// Deadline for one fetch run (0 = none); a per-image timeout on the
+	// request overrides it
+	FetchTimeout time.Duration `mapstructure:"fetch-timeout"`
+
+	// Device IDs reserved per database write (1 disables pre-allocation)
+	DeviceIDBlockSize int `mapstructure:"device-id-block-size"`
+
+	// Optional JSON Lines file receiving one record per FSM transition
+	EventLog string `mapstructure:"event-log"`
+
+	// Log attribute tagging every line of an FSM run with the run's ID
+	RunIDLogKey string `mapstructure:"run-id-log-key"`
+
+	// Optional webhook notified when an image is ready or fails, signed
+	// with NotifySecret
+	NotifyURL    string `mapstructure:"notify-url"`
+	NotifySecret string `mapstructure:"notify-secret"`
 }
 
 // Load reads configuration from environment, config file, and defaults
@@ -39,26 +134,57 @@ func Load() (*Config, error) {
 	viper.SetDefault("fsm-db-path", ".artifacts/fsm.db")
 	viper.SetDefault("s3-bucket", "flyio-platform-hiring-challenge")
 	viper.SetDefault("s3-region", "us-east-1")
+	viper.SetDefault("source", "s3")
+	viper.SetDefault("run-id-log-key", "run_id")
+	viper.SetDefault("hash-algorithm", "sha256")
+	viper.SetDefault("download-part-size", storage.DefaultPartSize)
+	viper.SetDefault("download-concurrency", 1)
+	viper.SetDefault("download-breaker-threshold", 0)
+	viper.SetDefault("download-breaker-cooldown", 30*time.Second)
 	viper.SetDefault("work-dir", "/tmp/flyio-machine")
 	viper.SetDefault("max-file-size", 2*1024*1024*1024)
 	viper.SetDefault("max-total-size", 20*1024*1024*1024)
 	viper.SetDefault("max-compression-ratio", 100.0)
+	viper.SetDefault("max-symlink-target", security.DefaultMaxSymlinkTarget)
+	viper.SetDefault("max-host-extracted-size", 0)
+	viper.SetDefault("pool-metadata-critical-percent", 95.0)
+	viper.SetDefault("max-toplevel-entries", 0)
+	viper.SetDefault("toplevel-entries-mode", "fail")
+	viper.SetDefault("isolate-extraction", false)
+	viper.SetDefault("extract-workers", 1)
+	viper.SetDefault("extract-buffer-size", 1024*1024)
+	viper.SetDefault("stream-extract", false)
+	viper.SetDefault("trust-multipart-etags", false)
+	viper.SetDefault("device-prefix", devicemapper.DefaultDevicePrefix)
+	viper.SetDefault("storage-driver", "devicemapper")
+	viper.SetDefault("device-headroom", 0.0)
 	viper.SetDefault("dm-enabled", false)
 	viper.SetDefault("fsm-max-retries", 5)
+	viper.SetDefault("max-attempts", 0)
+	viper.SetDefault("fetch-timeout", 0)
+	viper.SetDefault("device-id-block-size", 1)
 
 	// Environment variables (will be FLYIO_SQLITE_PATH, etc.)
 	viper.SetEnvPrefix("FLYIO")
 	viper.AutomaticEnv()
 	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
 
-	// Config file (optional)
-	viper.SetConfigName("config")
+	// Config file: one named with --config must exist; otherwise
+	// config.yaml is optional and looked for in . and $HOME/.flyio
 	viper.SetConfigType("yaml")
-	viper.AddConfigPath(".")
-	viper.AddConfigPath("$HOME/.flyio")
+	if path := viper.GetString("config"); path != "" {
+		viper.SetConfigFile(path)
+		if err := viper.ReadInConfig(); err != nil {
+			return nil, fmt.Errorf("failed to read config file %s: %w", path, err)
+		}
+	} else {
+		viper.SetConfigName("config")
+		viper.AddConfigPath(".")
+		viper.AddConfigPath("$HOME/.flyio")
 
-	// Read config file (ignore if not found)
-	_ = viper.ReadInConfig()
+		// Read config file (ignore if not found)
+		_ = viper.ReadInConfig()
+	}
 
 	// Unmarshal into config struct
 	var cfg Config
@@ -77,8 +203,35 @@ func (c *Config) Validate() error {
 	if c.FSMDBPath == "" {
 		return fmt.Errorf("fsm-db-path cannot be empty")
 	}
-	if c.S3Bucket == "" {
-		return fmt.Errorf("s3-bucket cannot be empty")
+	if c.RunIDLogKey == "" {
+		return fmt.Errorf("run-id-log-key cannot be empty")
+	}
+	switch c.Source {
+	case "s3":
+		if c.S3Bucket == "" {
+			return fmt.Errorf("s3-bucket cannot be empty")
+		}
+	case "local":
+		if c.SourceDir == "" {
+			return fmt.Errorf("source-dir is required with source local")
+		}
+	default:
+		return fmt.Errorf("source must be s3 or local, got %q", c.Source)
+	}
+	if _, err := storage.HashFunc(c.HashAlgorithm); err != nil {
+		return fmt.Errorf("hash-algorithm: %w", err)
+	}
+	if c.DownloadPartSize <= 0 {
+		return fmt.Errorf("download-part-size must be positive")
+	}
+	if c.DownloadConcurrency <= 0 {
+		return fmt.Errorf("download-concurrency must be positive")
+	}
+	if c.DownloadBreakerThreshold < 0 {
+		return fmt.Errorf("download-breaker-threshold must be non-negative")
+	}
+	if c.DownloadBreakerThreshold > 0 && c.DownloadBreakerCooldown <= 0 {
+		return fmt.Errorf("download-breaker-cooldown must be positive")
 	}
 	if c.MaxFileSize <= 0 {
 		return fmt.Errorf("max-file-size must be positive")
@@ -89,8 +242,86 @@ func (c *Config) Validate() error {
 	if c.MaxCompressionRatio <= 0 {
 		return fmt.Errorf("max-compression-ratio must be positive")
 	}
+	if c.MaxSymlinkTarget <= 0 {
+		return fmt.Errorf("max-symlink-target must be positive")
+	}
+	for _, prefix := range c.SymlinkAllowlist {
+		if !filepath.IsAbs(prefix) {
+			return fmt.Errorf("symlink-allowlist entry %q must be an absolute path", prefix)
+		}
+	}
+	for _, prefix := range c.TrustedPrefixes {
+		if prefix == "" {
+			return fmt.Errorf("trusted-prefixes cannot contain an empty prefix")
+		}
+	}
+	for _, contentType := range c.RequireContentTypes {
+		if _, _, err := mime.ParseMediaType(contentType); err != nil {
+			return fmt.Errorf("require-content-type: invalid content type %q", contentType)
+		}
+	}
+	if c.MaxTopLevelEntries < 0 {
+		return fmt.Errorf("max-toplevel-entries must be non-negative")
+	}
+	switch c.TopLevelEntriesMode {
+	case "fail", "warn":
+	default:
+		return fmt.Errorf("toplevel-entries-mode must be fail or warn, got %q", c.TopLevelEntriesMode)
+	}
+	if c.IsolateExtraction && runtime.GOOS != "linux" {
+		return fmt.Errorf("isolate-extraction is only supported on Linux")
+	}
+	if c.IsolateExtraction && c.StreamExtract {
+		return fmt.Errorf("isolate-extraction cannot be combined with stream-extract")
+	}
+	if c.ExtractWorkers <= 0 {
+		return fmt.Errorf("extract-workers must be positive")
+	}
+	if c.ExtractBufferSize <= 0 {
+		return fmt.Errorf("extract-buffer-size must be positive")
+	}
+	if c.PoolMetadataCriticalPercent <= 0 || c.PoolMetadataCriticalPercent > 100 {
+		return fmt.Errorf("pool-metadata-critical-percent must be in (0, 100]")
+	}
+	if c.DeviceHeadroom < 0 {
+		return fmt.Errorf("device-headroom must be non-negative")
+	}
+	for _, pool := range c.DevicePools {
+		if _, err := devicemapper.ParsePoolTier(pool); err != nil {
+			return fmt.Errorf("device-pools: %w", err)
+		}
+	}
+	if len(c.DevicePools) > 0 && c.DeviceHeadroom == 0 {
+		return fmt.Errorf("device-pools requires device-headroom: without it every device has the same size")
+	}
+	switch c.StorageDriver {
+	case "devicemapper", "overlay":
+	default:
+		return fmt.Errorf("storage-driver must be devicemapper or overlay, got %q", c.StorageDriver)
+	}
+	if err := devicemapper.ValidateDevicePrefix(c.DevicePrefix); err != nil {
+		return fmt.Errorf("device-prefix: %w", err)
+	}
+	if c.MaxHostExtractedSize < 0 {
+		return fmt.Errorf("max-host-extracted-size must be non-negative")
+	}
 	if c.FSMMaxRetries < 0 {
 		return fmt.Errorf("fsm-max-retries must be non-negative")
 	}
+	if c.NotifyURL != "" {
+		u, err := url.Parse(c.NotifyURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("notify-url must be an http(s) URL, got %q", c.NotifyURL)
+		}
+	}
+	if c.MaxAttempts < 0 {
+		return fmt.Errorf("max-attempts must be non-negative")
+	}
+	if c.FetchTimeout < 0 {
+		return fmt.Errorf("fetch-timeout must be non-negative")
+	}
+	if c.DeviceIDBlockSize <= 0 {
+		return fmt.Errorf("device-id-block-size must be positive")
+	}
 	return nil
 }
@@ -0,0 +1,75 @@
+package config
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Where a resolved setting came from, in viper's order of precedence
+const (
+	SourceFlag    = "flag"
+	SourceEnv     = "env"
+	SourceFile    = "file"
+	SourceDefault = "default"
+)
+
+// redacted replaces secret values when settings are printed
+const redacted = "<redacted>"
+
+// Setting is one resolved configuration value
+type Setting struct {
+	Key    string `json:"key"`
+	Value  any    `json:"value"`
+	Source string `json:"source"`
+}
+
+// Settings lists every Config field in declaration order with its value
+// and where it came from. flagChanged reports whether a key's flag was
+// set on the command line; viper doesn't track that itself. Secrets are
+// redacted.
+func (c *Config) Settings(flagChanged func(key string) bool) []Setting {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+
+	settings := make([]Setting, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("mapstructure")
+		if key == "" {
+			continue
+		}
+
+		value := v.Field(i).Interface()
+		if d, ok := value.(time.Duration); ok {
+			value = d.String()
+		}
+		if strings.HasSuffix(key, "-secret") && !v.Field(i).IsZero() {
+			value = redacted
+		}
+		settings = append(settings, Setting{Key: key, Value: value, Source: settingSource(key, flagChanged)})
+	}
+	return settings
+}
+
+// settingSource works out which layer supplied key, mirroring the lookup
+// order viper uses
+func settingSource(key string, flagChanged func(key string) bool) string {
+	switch {
+	case flagChanged != nil && flagChanged(key):
+		return SourceFlag
+	case envSet(key):
+		return SourceEnv
+	case viper.InConfig(key):
+		return SourceFile
+	}
+	return SourceDefault
+}
+
+// envSet reports whether the FLYIO_ variable for key is set
+func envSet(key string) bool {
+	_, ok := os.LookupEnv("FLYIO_" + strings.ToUpper(strings.ReplaceAll(key, "-", "_")))
+	return ok
+}
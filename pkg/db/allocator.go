@@ -0,0 +1,56 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+)
+
+// DeviceIDAllocator hands out unique thin device IDs
+type DeviceIDAllocator interface {
+	AllocateNextDeviceID(ctx context.Context) (int, error)
+}
+
+// IDAllocator is a hi-lo device ID allocator. It reserves blocks of IDs
+// from device_sequence in one write and hands them out from memory,
+// refilling when a block is exhausted. IDs reserved but never handed out
+// (e.g. after a crash) are simply skipped; they are never reused.
+type IDAllocator struct {
+	repo      *Repository
+	blockSize int
+
+	mu   sync.Mutex
+	next int
+	end  int // exclusive
+}
+
+var _ DeviceIDAllocator = (*IDAllocator)(nil)
+
+// NewIDAllocator creates an allocator reserving blockSize IDs at a time
+func (r *Repository) NewIDAllocator(blockSize int) (*IDAllocator, error) {
+	if blockSize <= 0 {
+		return nil, fmt.Errorf("block size must be positive, got %d", blockSize)
+	}
+	return &IDAllocator{repo: r, blockSize: blockSize}, nil
+}
+
+// AllocateNextDeviceID returns the next ID from the current block,
+// reserving a new block when the current one is exhausted
+func (a *IDAllocator) AllocateNextDeviceID(ctx context.Context) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.next >= a.end {
+		first, err := a.repo.reserveDeviceIDs(ctx, a.blockSize)
+		if err != nil {
+			return 0, err
+		}
+		a.next, a.end = first, first+a.blockSize
+		slog.Info("reserved_device_id_block", "first", first, "block_size", a.blockSize)
+	}
+
+	id := a.next
+	a.next++
+	return id, nil
+}
@@ -0,0 +1,101 @@
+package db
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestIDAllocator_ConcurrentUniqueness(t *testing.T) {
+	dbPath := "/tmp/test_images_alloc.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	repo, err := NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	const workers = 8
+	const perWorker = 50
+	ctx := context.Background()
+
+	var (
+		mu   sync.Mutex
+		seen = make(map[int]bool)
+		wg   sync.WaitGroup
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			// Mix block allocators with direct single-ID allocation
+			var alloc DeviceIDAllocator = repo
+			if w%2 == 0 {
+				a, err := repo.NewIDAllocator(7)
+				if err != nil {
+					t.Errorf("failed to create allocator: %v", err)
+					return
+				}
+				alloc = a
+			}
+
+			for i := 0; i < perWorker; i++ {
+				id, err := alloc.AllocateNextDeviceID(ctx)
+				if err != nil {
+					t.Errorf("worker %d: allocation failed: %v", w, err)
+					return
+				}
+				mu.Lock()
+				if seen[id] {
+					t.Errorf("worker %d: duplicate device ID %d", w, id)
+				}
+				seen[id] = true
+				mu.Unlock()
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if len(seen) != workers*perWorker {
+		t.Errorf("allocated %d unique IDs, want %d", len(seen), workers*perWorker)
+	}
+}
+
+func TestIDAllocator_SkipsUnusedReservations(t *testing.T) {
+	dbPath := "/tmp/test_images_alloc2.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	repo, err := NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	ctx := context.Background()
+
+	// A "crashed" allocator reserves a block and only uses one ID
+	crashed, _ := repo.NewIDAllocator(10)
+	first, err := crashed.AllocateNextDeviceID(ctx)
+	if err != nil {
+		t.Fatalf("allocation failed: %v", err)
+	}
+
+	// A fresh allocator must start after the whole reserved block
+	fresh, _ := repo.NewIDAllocator(10)
+	next, err := fresh.AllocateNextDeviceID(ctx)
+	if err != nil {
+		t.Fatalf("allocation failed: %v", err)
+	}
+	if next != first+10 {
+		t.Errorf("fresh allocator got %d, want %d (after reserved block)", next, first+10)
+	}
+
+	if _, err := repo.NewIDAllocator(0); err == nil {
+		t.Error("expected error for zero block size")
+	}
+}
@@ -0,0 +1,286 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"sort"
+
+	"github.com/fly-io/162719/pkg/errors"
+)
+
+// DumpVersion identifies the layout of Dump; bump it on incompatible changes
+const DumpVersion = 1
+
+// Dump is a portable copy of the images database, for moving images
+// between hosts
+type Dump struct {
+	Version int           `json:"version"`
+	Images  []DumpedImage `json:"images"`
+}
+
+// DumpedImage is an image row with its labels, clones and packages. Row
+// IDs are not carried over; rows are matched by S3 key on import.
+type DumpedImage struct {
+	S3Key        string `json:"s3_key"`
+	SHA256       string `json:"sha256"`
+	Status       string `json:"status"`
+	DevicePath   string `json:"device_path,omitempty"`
+	BaseDeviceID int    `json:"base_device_id,omitempty"`
+	SnapshotID   int    `json:"snapshot_id,omitempty"`
+	ErrorMessage string `json:"error_message,omitempty"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	DownloadSize int64  `json:"download_size,omitempty"`
+	Attempts     int    `json:"attempts,omitempty"`
+	TreeHash     string `json:"tree_hash,omitempty"`
+	// SnapshotActive is whether the snapshot is mapped under /dev/mapper
+	SnapshotActive bool `json:"snapshot_active,omitempty"`
+	// DownloadCompression is how the kept download is compressed on disk
+	DownloadCompression string `json:"download_compression,omitempty"`
+	// ExtractSubpath is the tarball directory the image was extracted from
+	ExtractSubpath string `json:"extract_subpath,omitempty"`
+	// Host is the host the image's device paths belong to
+	Host      string            `json:"host,omitempty"`
+	CreatedAt string            `json:"created_at"`
+	UpdatedAt string            `json:"updated_at"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Clones    []DumpedClone     `json:"clones,omitempty"`
+	Packages  []DumpedPackage   `json:"packages,omitempty"`
+}
+
+// DumpedClone is a clone row belonging to a DumpedImage
+type DumpedClone struct {
+	DeviceID         int    `json:"device_id"`
+	SourceSnapshotID int    `json:"source_snapshot_id"`
+	DevicePath       string `json:"device_path,omitempty"`
+	CreatedAt        string `json:"created_at"`
+}
+
+// DumpedPackage is a scanned package belonging to a DumpedImage
+type DumpedPackage struct {
+	Manager      string `json:"manager"`
+	Name         string `json:"name"`
+	Version      string `json:"version"`
+	Architecture string `json:"architecture,omitempty"`
+}
+
+// ConflictPolicy decides what Import does with an image whose S3 key
+// already exists
+type ConflictPolicy string
+
+// Conflict policies
+const (
+	ConflictSkip    ConflictPolicy = "skip"
+	ConflictReplace ConflictPolicy = "replace"
+)
+
+// ParseConflictPolicy validates an --on-conflict value
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	switch p := ConflictPolicy(s); p {
+	case ConflictSkip, ConflictReplace:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid conflict policy %q: expected skip or replace", s)
+}
+
+// ImportResult counts what Import did with each dumped image
+type ImportResult struct {
+	Imported int
+	Replaced int
+	Skipped  int
+}
+
+// Export dumps every image with its labels, clones and packages, ordered
+// by S3 key
+func (r *Repository) Export() (*Dump, error) {
+	return r.ExportContext(context.Background())
+}
+
+// ExportContext is like Export but honors ctx cancellation
+func (r *Repository) ExportContext(ctx context.Context) (*Dump, error) {
+	images, err := r.ListContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Order by key so dumps of the same data are byte-identical
+	sort.Slice(images, func(i, j int) bool { return images[i].S3Key < images[j].S3Key })
+
+	dump := &Dump{Version: DumpVersion, Images: make([]DumpedImage, 0, len(images))}
+	for _, img := range images {
+		labels, err := r.GetLabelsContext(ctx, img.ID)
+		if err != nil {
+			return nil, err
+		}
+		if len(labels) == 0 {
+			labels = nil
+		}
+		clones, err := r.ListClonesContext(ctx, img.ID)
+		if err != nil {
+			return nil, err
+		}
+		pkgs, err := r.ListPackagesContext(ctx, img.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		dumped := DumpedImage{
+			S3Key:               img.S3Key,
+			SHA256:              img.SHA256,
+			Status:              img.Status,
+			DevicePath:          img.DevicePath,
+			BaseDeviceID:        img.BaseDeviceID,
+			SnapshotID:          img.SnapshotID,
+			SnapshotActive:      img.SnapshotActive,
+			ErrorMessage:        img.ErrorMessage,
+			ETag:                img.ETag,
+			LastModified:        img.LastModified,
+			DownloadSize:        img.DownloadSize,
+			Attempts:            img.Attempts,
+			TreeHash:            img.TreeHash,
+			DownloadCompression: img.DownloadCompression,
+			ExtractSubpath:      img.ExtractSubpath,
+			Host:                img.Host,
+			CreatedAt:           img.CreatedAt,
+			UpdatedAt:           img.UpdatedAt,
+			Labels:              labels,
+		}
+		for _, c := range clones {
+			dumped.Clones = append(dumped.Clones, DumpedClone{
+				DeviceID:         c.DeviceID,
+				SourceSnapshotID: c.SourceSnapshotID,
+				DevicePath:       c.DevicePath,
+				CreatedAt:        c.CreatedAt,
+			})
+		}
+		for _, p := range pkgs {
+			dumped.Packages = append(dumped.Packages, DumpedPackage{
+				Manager:      p.Manager,
+				Name:         p.Name,
+				Version:      p.Version,
+				Architecture: p.Architecture,
+			})
+		}
+		dump.Images = append(dump.Images, dumped)
+	}
+
+	slog.Info("database_export_complete", "image_count", len(dump.Images))
+	return dump, nil
+}
+
+// Import inserts the images of a dump in a single transaction, resolving
+// S3 key collisions with policy. Device and snapshot IDs are kept as is,
+// and the device sequence is advanced past the highest imported ID so
+// later allocations cannot collide with them.
+func (r *Repository) Import(dump *Dump, policy ConflictPolicy) (*ImportResult, error) {
+	return r.ImportContext(context.Background(), dump, policy)
+}
+
+// ImportContext is like Import but honors ctx cancellation
+func (r *Repository) ImportContext(ctx context.Context, dump *Dump, policy ConflictPolicy) (*ImportResult, error) {
+	if dump.Version != DumpVersion {
+		return nil, fmt.Errorf("unsupported dump version %d (expected %d)", dump.Version, DumpVersion)
+	}
+	if _, err := ParseConflictPolicy(string(policy)); err != nil {
+		return nil, err
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	result := &ImportResult{}
+	maxDeviceID := 0
+	for _, img := range dump.Images {
+		var existingID int64
+		err := tx.QueryRowContext(ctx, `SELECT id FROM images WHERE s3_key = ?`, img.S3Key).Scan(&existingID)
+		switch {
+		case err == sql.ErrNoRows:
+			result.Imported++
+		case err != nil:
+			return nil, errors.Wrap(err, "failed to look up image")
+		case policy == ConflictSkip:
+			slog.Info("database_import_skipped", "s3_key", img.S3Key)
+			result.Skipped++
+			continue
+		default:
+			// Labels, clones and packages cascade with the row
+			if _, err := tx.ExecContext(ctx, `DELETE FROM images WHERE id = ?`, existingID); err != nil {
+				return nil, errors.Wrap(err, "failed to replace image")
+			}
+			result.Replaced++
+		}
+
+		imageID, err := importImage(ctx, tx, img, r.now())
+		if err != nil {
+			return nil, err
+		}
+
+		maxDeviceID = max(maxDeviceID, img.BaseDeviceID, img.SnapshotID)
+		for _, c := range img.Clones {
+			maxDeviceID = max(maxDeviceID, c.DeviceID)
+		}
+		slog.Info("database_image_imported", "s3_key", img.S3Key, "image_id", imageID)
+	}
+
+	if maxDeviceID > 0 {
+		query := `UPDATE device_sequence SET next_device_id = MAX(next_device_id, ?) WHERE id = 1`
+		if _, err := tx.ExecContext(ctx, query, maxDeviceID+1); err != nil {
+			return nil, errors.Wrap(err, "failed to advance device sequence")
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrap(err, "failed to commit import")
+	}
+
+	slog.Info("database_import_complete", "imported", result.Imported, "replaced", result.Replaced, "skipped", result.Skipped)
+	return result, nil
+}
+
+// importImage inserts one dumped image with its labels, clones and
+// packages. Missing timestamps default to now.
+func importImage(ctx context.Context, tx *sql.Tx, img DumpedImage, now string) (int64, error) {
+	query := `
+		INSERT INTO images (s3_key, sha256, status, device_path, base_device_id, snapshot_id, snapshot_active, error_message,
+		                    etag, last_modified, download_size, attempts, tree_hash, download_compression, extract_subpath, host, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?,
+		        COALESCE(NULLIF(?, ''), ?), COALESCE(NULLIF(?, ''), ?))
+	`
+	res, err := tx.ExecContext(ctx, query,
+		img.S3Key, img.SHA256, img.Status, img.DevicePath, img.BaseDeviceID, img.SnapshotID, img.SnapshotActive, img.ErrorMessage,
+		img.ETag, img.LastModified, img.DownloadSize, img.Attempts, img.TreeHash, img.DownloadCompression, img.ExtractSubpath, img.Host, img.CreatedAt, now, img.UpdatedAt, now)
+	if err != nil {
+		slog.Error("database_import_insert_failed", "s3_key", img.S3Key, "error", err)
+		return 0, errors.Wrap(err, fmt.Sprintf("failed to import image %s", img.S3Key))
+	}
+	imageID, err := res.LastInsertId()
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to get last insert id")
+	}
+
+	for key, value := range img.Labels {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO image_labels (image_id, key, value) VALUES (?, ?, ?)`, imageID, key, value); err != nil {
+			return 0, errors.Wrap(err, "failed to import label")
+		}
+	}
+
+	for _, c := range img.Clones {
+		query := `INSERT INTO clones (image_id, device_id, source_snapshot_id, device_path, created_at) VALUES (?, ?, ?, ?, COALESCE(NULLIF(?, ''), ?))`
+		if _, err := tx.ExecContext(ctx, query, imageID, c.DeviceID, c.SourceSnapshotID, c.DevicePath, c.CreatedAt, now); err != nil {
+			return 0, errors.Wrap(err, fmt.Sprintf("failed to import clone %d", c.DeviceID))
+		}
+	}
+
+	for _, p := range img.Packages {
+		query := `INSERT INTO packages (image_id, manager, name, version, architecture) VALUES (?, ?, ?, ?, ?)`
+		if _, err := tx.ExecContext(ctx, query, imageID, p.Manager, p.Name, p.Version, p.Architecture); err != nil {
+			return 0, errors.Wrap(err, fmt.Sprintf("failed to import package %s", p.Name))
+		}
+	}
+
+	return imageID, nil
+}
@@ -0,0 +1,137 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func newExportTestRepo(t *testing.T, dbPath string) *Repository {
+	t.Helper()
+	os.Remove(dbPath)
+	t.Cleanup(func() { os.Remove(dbPath) })
+
+	repo, err := NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	t.Cleanup(func() { repo.Close() })
+	return repo
+}
+
+func TestExportImport_RoundTrip(t *testing.T) {
+	src := newExportTestRepo(t, "/tmp/test_images_export.db")
+
+	ready := &Image{S3Key: "images/ready.tar", SHA256: "sha256:abc", Status: StatusReady,
+		DevicePath: "/dev/mapper/flyio-7", BaseDeviceID: 7, SnapshotID: 8, SnapshotActive: true, ETag: "etag", DownloadSize: 1024, ExtractSubpath: "rootfs"}
+	failed := &Image{S3Key: "images/failed.tar", SHA256: "", Status: StatusFailed, ErrorMessage: "boom"}
+	for _, img := range []*Image{ready, failed} {
+		if err := src.Create(img); err != nil {
+			t.Fatalf("failed to create image: %v", err)
+		}
+	}
+	if err := src.SetLabel(ready.ID, "env", "prod"); err != nil {
+		t.Fatalf("SetLabel failed: %v", err)
+	}
+	if err := src.CreateClone(&Clone{ImageID: ready.ID, DeviceID: 42, SourceSnapshotID: 8, DevicePath: "/dev/mapper/flyio-42"}); err != nil {
+		t.Fatalf("CreateClone failed: %v", err)
+	}
+	if err := src.ReplacePackages(ready.ID, []Package{{Manager: "apk", Name: "musl", Version: "1.2.4", Architecture: "x86_64"}}); err != nil {
+		t.Fatalf("ReplacePackages failed: %v", err)
+	}
+
+	dump, err := src.Export()
+	if err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+
+	// Go through JSON as the commands do
+	data, err := json.Marshal(dump)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	var decoded Dump
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+
+	dst := newExportTestRepo(t, "/tmp/test_images_import.db")
+	result, err := dst.Import(&decoded, ConflictSkip)
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if result.Imported != 2 {
+		t.Errorf("Imported = %d, want 2", result.Imported)
+	}
+
+	again, err := dst.Export()
+	if err != nil {
+		t.Fatalf("Export of imported database failed: %v", err)
+	}
+	if !again.Images[1].SnapshotActive || again.Images[0].SnapshotActive {
+		t.Errorf("snapshot_active not carried over: %+v", again.Images)
+	}
+	if len(again.Images[1].Packages) != 1 {
+		t.Errorf("packages not carried over: %+v", again.Images[1].Packages)
+	}
+	if !reflect.DeepEqual(dump, again) {
+		t.Errorf("round trip mismatch:\n got %+v\nwant %+v", again, dump)
+	}
+
+	// The sequence must not hand out any imported device ID again
+	next, err := dst.AllocateNextDeviceID(context.Background())
+	if err != nil {
+		t.Fatalf("AllocateNextDeviceID failed: %v", err)
+	}
+	if next <= 42 {
+		t.Errorf("next device ID = %d, want > 42", next)
+	}
+}
+
+func TestImport_ConflictPolicy(t *testing.T) {
+	repo := newExportTestRepo(t, "/tmp/test_images_import2.db")
+
+	existing := &Image{S3Key: "images/app.tar", SHA256: "sha256:old", Status: StatusPending}
+	if err := repo.Create(existing); err != nil {
+		t.Fatalf("failed to create image: %v", err)
+	}
+
+	dump := &Dump{Version: DumpVersion, Images: []DumpedImage{
+		{S3Key: "images/app.tar", SHA256: "sha256:new", Status: StatusReady},
+	}}
+
+	result, err := repo.Import(dump, ConflictSkip)
+	if err != nil {
+		t.Fatalf("Import skip failed: %v", err)
+	}
+	if result.Skipped != 1 {
+		t.Errorf("Skipped = %d, want 1", result.Skipped)
+	}
+	img, _ := repo.GetByS3Key("images/app.tar")
+	if img.SHA256 != "sha256:old" {
+		t.Errorf("skip overwrote existing image: sha256 = %q", img.SHA256)
+	}
+
+	// Replacing keeps the scan results the dump carries
+	dump.Images[0].Packages = []DumpedPackage{{Manager: "dpkg", Name: "libc6", Version: "2.36"}}
+	result, err = repo.Import(dump, ConflictReplace)
+	if err != nil {
+		t.Fatalf("Import replace failed: %v", err)
+	}
+	if result.Replaced != 1 {
+		t.Errorf("Replaced = %d, want 1", result.Replaced)
+	}
+	img, _ = repo.GetByS3Key("images/app.tar")
+	if img.SHA256 != "sha256:new" || img.Status != StatusReady {
+		t.Errorf("replace did not overwrite image: %+v", img)
+	}
+	if pkgs, err := repo.ListPackages(img.ID); err != nil || len(pkgs) != 1 || pkgs[0].Name != "libc6" {
+		t.Errorf("packages after replace = %+v (%v), want libc6", pkgs, err)
+	}
+
+	if _, err := repo.Import(dump, ConflictPolicy("merge")); err == nil {
+		t.Error("expected error for unknown conflict policy")
+	}
+}
@@ -0,0 +1,110 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/fly-io/162719/pkg/errors"
+)
+
+// ParseLabel splits a "key=value" argument into its parts
+func ParseLabel(s string) (key, value string, err error) {
+	key, value, ok := strings.Cut(s, "=")
+	key = strings.TrimSpace(key)
+	if !ok || key == "" {
+		return "", "", fmt.Errorf("invalid label %q: expected key=value", s)
+	}
+	return key, value, nil
+}
+
+// SetLabel attaches a label to an image, overwriting any previous value
+// for the same key
+func (r *Repository) SetLabel(imageID int64, key, value string) error {
+	return r.SetLabelContext(context.Background(), imageID, key, value)
+}
+
+// SetLabelContext is like SetLabel but honors ctx cancellation
+func (r *Repository) SetLabelContext(ctx context.Context, imageID int64, key, value string) error {
+	slog.Info("database_set_label", "image_id", imageID, "key", key, "value", value)
+
+	query := `
+		INSERT INTO image_labels (image_id, key, value) VALUES (?, ?, ?)
+		ON CONFLICT(image_id, key) DO UPDATE SET value = excluded.value
+	`
+	if _, err := r.db.ExecContext(ctx, query, imageID, key, value); err != nil {
+		slog.Error("database_set_label_failed", "image_id", imageID, "key", key, "error", err)
+		return errors.Wrap(err, "failed to set label")
+	}
+	return nil
+}
+
+// GetLabels returns all labels of an image
+func (r *Repository) GetLabels(imageID int64) (map[string]string, error) {
+	return r.GetLabelsContext(context.Background(), imageID)
+}
+
+// GetLabelsContext is like GetLabels but honors ctx cancellation
+func (r *Repository) GetLabelsContext(ctx context.Context, imageID int64) (map[string]string, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT key, value FROM image_labels WHERE image_id = ?`, imageID)
+	if err != nil {
+		slog.Error("database_get_labels_failed", "image_id", imageID, "error", err)
+		return nil, errors.Wrap(err, "failed to get labels")
+	}
+	defer rows.Close()
+
+	labels := make(map[string]string)
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			slog.Error("database_scan_row_failed", "error", err)
+			return nil, errors.Wrap(err, "failed to scan row")
+		}
+		labels[key] = value
+	}
+
+	if err := rows.Err(); err != nil {
+		slog.Error("database_rows_error", "error", err)
+		return nil, errors.Wrap(err, "rows error")
+	}
+	return labels, nil
+}
+
+// ListByLabel retrieves all images carrying the label key=value
+func (r *Repository) ListByLabel(key, value string) ([]*Image, error) {
+	return r.ListByLabelContext(context.Background(), key, value)
+}
+
+// ListByLabelContext is like ListByLabel but honors ctx cancellation
+func (r *Repository) ListByLabelContext(ctx context.Context, key, value string) ([]*Image, error) {
+	slog.Info("database_list_images_by_label", "key", key, "value", value)
+
+	query := `SELECT ` + imageColumns + ` FROM images
+		WHERE id IN (SELECT image_id FROM image_labels WHERE key = ? AND value = ?)
+		ORDER BY created_at DESC`
+	rows, err := r.db.QueryContext(ctx, query, key, value)
+	if err != nil {
+		slog.Error("database_list_query_failed", "error", err)
+		return nil, errors.Wrap(err, "failed to list images by label")
+	}
+	defer rows.Close()
+
+	var images []*Image
+	for rows.Next() {
+		img, err := scanImage(rows)
+		if err != nil {
+			slog.Error("database_scan_row_failed", "error", err)
+			return nil, errors.Wrap(err, "failed to scan row")
+		}
+		images = append(images, img)
+	}
+
+	if err := rows.Err(); err != nil {
+		slog.Error("database_rows_error", "error", err)
+		return nil, errors.Wrap(err, "rows error")
+	}
+
+	slog.Info("database_list_by_label_complete", "key", key, "value", value, "image_count", len(images))
+	return images, nil
+}
@@ -0,0 +1,104 @@
+package db
+
+import (
+	"os"
+	"testing"
+)
+
+func TestLabels(t *testing.T) {
+	dbPath := "/tmp/test_images_labels.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	repo, err := NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	prod := &Image{S3Key: "images/prod.tar", SHA256: "", Status: StatusReady}
+	staging := &Image{S3Key: "images/staging.tar", SHA256: "", Status: StatusReady}
+	for _, img := range []*Image{prod, staging} {
+		if err := repo.Create(img); err != nil {
+			t.Fatalf("failed to create image: %v", err)
+		}
+	}
+
+	if err := repo.SetLabel(prod.ID, "env", "staging"); err != nil {
+		t.Fatalf("SetLabel failed: %v", err)
+	}
+	// Overwrite: labels are unique per (image, key)
+	if err := repo.SetLabel(prod.ID, "env", "prod"); err != nil {
+		t.Fatalf("SetLabel overwrite failed: %v", err)
+	}
+	if err := repo.SetLabel(prod.ID, "team", "search"); err != nil {
+		t.Fatalf("SetLabel failed: %v", err)
+	}
+	if err := repo.SetLabel(staging.ID, "env", "staging"); err != nil {
+		t.Fatalf("SetLabel failed: %v", err)
+	}
+
+	labels, err := repo.GetLabels(prod.ID)
+	if err != nil {
+		t.Fatalf("GetLabels failed: %v", err)
+	}
+	if len(labels) != 2 || labels["env"] != "prod" || labels["team"] != "search" {
+		t.Errorf("GetLabels = %v, want env=prod team=search", labels)
+	}
+
+	tests := []struct {
+		key, value string
+		want       []string
+	}{
+		{"env", "prod", []string{"images/prod.tar"}},
+		{"env", "staging", []string{"images/staging.tar"}},
+		{"team", "search", []string{"images/prod.tar"}},
+		{"team", "ads", nil},
+	}
+	for _, tt := range tests {
+		images, err := repo.ListByLabel(tt.key, tt.value)
+		if err != nil {
+			t.Fatalf("ListByLabel(%s=%s) failed: %v", tt.key, tt.value, err)
+		}
+		var got []string
+		for _, img := range images {
+			got = append(got, img.S3Key)
+		}
+		if len(got) != len(tt.want) || (len(got) > 0 && got[0] != tt.want[0]) {
+			t.Errorf("ListByLabel(%s=%s) = %v, want %v", tt.key, tt.value, got, tt.want)
+		}
+	}
+
+	// Labels go away with their image
+	if err := repo.Delete(prod.ID); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if labels, _ := repo.GetLabels(prod.ID); len(labels) != 0 {
+		t.Errorf("expected labels to be deleted with image, got %v", labels)
+	}
+}
+
+func TestParseLabel(t *testing.T) {
+	tests := []struct {
+		in         string
+		key, value string
+		wantErr    bool
+	}{
+		{"env=prod", "env", "prod", false},
+		{"note=a=b", "note", "a=b", false},
+		{"empty=", "empty", "", false},
+		{"noequals", "", "", true},
+		{"=value", "", "", true},
+	}
+
+	for _, tt := range tests {
+		key, value, err := ParseLabel(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseLabel(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if key != tt.key || value != tt.value {
+			t.Errorf("ParseLabel(%q) = %q, %q; want %q, %q", tt.in, key, value, tt.key, tt.value)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fly-io/162719/pkg/errors"
+)
+
+// DefaultLockStaleAfter is how long a lock may go unrefreshed before
+// another process may reclaim it even if its holder still appears alive
+const DefaultLockStaleAfter = time.Hour
+
+// ErrLockHeld is returned when another live process holds the lock
+var ErrLockHeld = errors.New("already processing")
+
+// Lock is a held per-key advisory lock. Until it is released, its
+// acquired_at is refreshed every quarter of its stale timeout so a long
+// run keeps it.
+type Lock struct {
+	repo *Repository
+	Key  string
+	PID  int
+	Host string
+
+	stop    chan struct{}
+	stopped chan struct{}
+	release sync.Once
+}
+
+// AcquireLock takes the advisory lock for key on behalf of this process.
+// A lock that is older than staleAfter (when positive), or whose holder
+// process is gone, is reclaimed. Holders are only probed on their own
+// host; a lock held from another host is only reclaimed once stale. If
+// another live process holds the lock, an error wrapping ErrLockHeld is
+// returned.
+func (r *Repository) AcquireLock(ctx context.Context, key string, staleAfter time.Duration) (*Lock, error) {
+	return r.acquireLock(ctx, key, os.Getpid(), staleAfter)
+}
+
+func (r *Repository) acquireLock(ctx context.Context, key string, pid int, staleAfter time.Duration) (*Lock, error) {
+	now := r.clock.Now().Unix()
+
+	// Each step is a single statement so concurrent acquirers can never
+	// both succeed: the insert only wins if no row exists, and a reclaim
+	// only wins if the row still belongs to the stale holder we inspected
+	res, err := r.db.ExecContext(ctx, `
+		INSERT INTO locks (key, pid, host, acquired_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(key) DO NOTHING
+	`, key, pid, r.host, now)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to write lock")
+	}
+	if n, _ := res.RowsAffected(); n == 1 {
+		slog.Info("lock_acquired", "key", key, "pid", pid, "host", r.host)
+		return r.heldLock(key, pid, staleAfter), nil
+	}
+
+	var (
+		holderPID  int
+		holderHost string
+		acquiredAt int64
+	)
+	err = r.db.QueryRowContext(ctx, `SELECT pid, host, acquired_at FROM locks WHERE key = ?`, key).Scan(&holderPID, &holderHost, &acquiredAt)
+	if err == sql.ErrNoRows {
+		// Released between our insert and read; try again from the top
+		return r.acquireLock(ctx, key, pid, staleAfter)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read lock")
+	}
+
+	held := fmt.Errorf("%s is held by pid %d on %s, last refreshed %s: %w",
+		key, holderPID, holderHost, time.Unix(acquiredAt, 0).UTC().Format(time.RFC3339), ErrLockHeld)
+
+	age := time.Duration(now-acquiredAt) * time.Second
+	expired := staleAfter > 0 && age > staleAfter
+	// A PID only means something on the host it came from; locks written
+	// before hosts were recorded can't be placed and are never probed
+	local := holderHost != "" && holderHost == r.host
+	if !expired && (!local || processAlive(holderPID)) {
+		return nil, held
+	}
+
+	slog.Warn("reclaiming_stale_lock", "key", key, "holder_pid", holderPID, "holder_host", holderHost, "age", age)
+	res, err = r.db.ExecContext(ctx, `
+		UPDATE locks SET pid = ?, host = ?, acquired_at = ?
+		WHERE key = ? AND pid = ? AND host = ? AND acquired_at = ?
+	`, pid, r.host, now, key, holderPID, holderHost, acquiredAt)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to reclaim lock")
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		// Someone else reclaimed or refreshed it first
+		return nil, held
+	}
+
+	slog.Info("lock_acquired", "key", key, "pid", pid, "host", r.host, "reclaimed_from", holderPID)
+	return r.heldLock(key, pid, staleAfter), nil
+}
+
+// heldLock returns the Lock for a row this process just wrote, refreshing
+// it in the background when it can go stale
+func (r *Repository) heldLock(key string, pid int, staleAfter time.Duration) *Lock {
+	l := &Lock{repo: r, Key: key, PID: pid, Host: r.host, stop: make(chan struct{}), stopped: make(chan struct{})}
+	go l.heartbeat(staleAfter / 4)
+	return l
+}
+
+// heartbeat refreshes the lock every interval until it is released or
+// found lost. A non-positive interval never refreshes.
+func (l *Lock) heartbeat(interval time.Duration) {
+	defer close(l.stopped)
+	if interval <= 0 {
+		<-l.stop
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			held, err := l.refresh(context.Background())
+			if err != nil {
+				slog.Warn("lock_refresh_failed", "key", l.Key, "pid", l.PID, "error", err)
+				continue
+			}
+			if !held {
+				slog.Error("lock_lost", "key", l.Key, "pid", l.PID, "host", l.Host)
+				return
+			}
+		}
+	}
+}
+
+// refresh moves the lock's acquired_at to now, reporting false if the
+// lock no longer belongs to this holder
+func (l *Lock) refresh(ctx context.Context) (bool, error) {
+	res, err := l.repo.db.ExecContext(ctx, `UPDATE locks SET acquired_at = ? WHERE key = ? AND pid = ? AND host = ?`,
+		l.repo.clock.Now().Unix(), l.Key, l.PID, l.Host)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to refresh lock")
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+// Release stops refreshing the lock and drops it if it is still held by
+// this holder. Releasing a lock that was reclaimed by another process is
+// a no-op.
+func (l *Lock) Release(ctx context.Context) error {
+	l.release.Do(func() { close(l.stop) })
+	<-l.stopped
+
+	_, err := l.repo.db.ExecContext(ctx, `DELETE FROM locks WHERE key = ? AND pid = ? AND host = ?`, l.Key, l.PID, l.Host)
+	if err != nil {
+		return errors.Wrap(err, "failed to release lock")
+	}
+	slog.Info("lock_released", "key", l.Key, "pid", l.PID)
+	return nil
+}
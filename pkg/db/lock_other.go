@@ -0,0 +1,9 @@
+//go:build !unix
+
+package db
+
+// processAlive cannot probe processes here, so locks are only reclaimed
+// once they exceed their stale timeout
+func processAlive(pid int) bool {
+	return pid > 0
+}
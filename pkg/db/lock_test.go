@@ -0,0 +1,177 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fly-io/162719/pkg/clock"
+)
+
+func newLockTestRepo(t *testing.T, dbPath string) *Repository {
+	t.Helper()
+	os.Remove(dbPath)
+	t.Cleanup(func() { os.Remove(dbPath) })
+
+	repo, err := NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	t.Cleanup(func() { repo.Close() })
+	return repo
+}
+
+func TestAcquireLock_ConcurrentSecondAcquisitionFails(t *testing.T) {
+	dbPath := "/tmp/test_images_lock.db"
+	repo := newLockTestRepo(t, dbPath)
+	ctx := context.Background()
+
+	// A second process opening the same database
+	other, err := NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to open second repository: %v", err)
+	}
+	defer other.Close()
+
+	const workers = 8
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		acquired int
+		held     int
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			r := repo
+			if w%2 == 1 {
+				r = other
+			}
+			_, err := r.AcquireLock(ctx, "images/alpine.tar", DefaultLockStaleAfter)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				acquired++
+			case errors.Is(err, ErrLockHeld):
+				held++
+			default:
+				t.Errorf("unexpected error: %v", err)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if acquired != 1 || held != workers-1 {
+		t.Errorf("acquired=%d held=%d, want exactly one winner", acquired, held)
+	}
+}
+
+func TestAcquireLock_ReleaseAllowsReacquire(t *testing.T) {
+	repo := newLockTestRepo(t, "/tmp/test_images_lock2.db")
+	ctx := context.Background()
+
+	lock, err := repo.AcquireLock(ctx, "images/alpine.tar", DefaultLockStaleAfter)
+	if err != nil {
+		t.Fatalf("AcquireLock failed: %v", err)
+	}
+	if _, err := repo.AcquireLock(ctx, "images/other.tar", DefaultLockStaleAfter); err != nil {
+		t.Errorf("locks on different keys should not conflict: %v", err)
+	}
+	if err := lock.Release(ctx); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+	if _, err := repo.AcquireLock(ctx, "images/alpine.tar", DefaultLockStaleAfter); err != nil {
+		t.Errorf("expected reacquire after release, got %v", err)
+	}
+}
+
+func TestAcquireLock_ReclaimsStaleLocks(t *testing.T) {
+	repo := newLockTestRepo(t, "/tmp/test_images_lock3.db")
+	ctx := context.Background()
+
+	// Held by a live process (ourselves), but for longer than the timeout
+	if _, err := repo.AcquireLock(ctx, "old", time.Minute); err != nil {
+		t.Fatalf("AcquireLock failed: %v", err)
+	}
+	if _, err := repo.db.Exec(`UPDATE locks SET acquired_at = acquired_at - 3600 WHERE key = 'old'`); err != nil {
+		t.Fatalf("failed to age lock: %v", err)
+	}
+	if _, err := repo.acquireLock(ctx, "old", os.Getpid()+1, time.Minute); err != nil {
+		t.Errorf("expected expired lock to be reclaimed, got %v", err)
+	}
+
+	// Held by a process on this host that no longer exists
+	if _, err := repo.db.Exec(`INSERT INTO locks (key, pid, host, acquired_at) VALUES ('dead', -1, ?, ?)`, repo.host, time.Now().Unix()); err != nil {
+		t.Fatalf("failed to seed lock: %v", err)
+	}
+	lock, err := repo.AcquireLock(ctx, "dead", DefaultLockStaleAfter)
+	if err != nil {
+		t.Fatalf("expected lock of dead holder to be reclaimed, got %v", err)
+	}
+	if lock.PID != os.Getpid() {
+		t.Errorf("lock PID = %d, want %d", lock.PID, os.Getpid())
+	}
+}
+
+func TestAcquireLock_DoesNotProbeOtherHosts(t *testing.T) {
+	repo := newLockTestRepo(t, "/tmp/test_images_lock4.db")
+	ctx := context.Background()
+
+	// pid -1 is dead here, but says nothing about another host
+	if _, err := repo.db.Exec(`INSERT INTO locks (key, pid, host, acquired_at) VALUES ('remote', -1, 'other-host', ?)`, time.Now().Unix()); err != nil {
+		t.Fatalf("failed to seed lock: %v", err)
+	}
+	if _, err := repo.AcquireLock(ctx, "remote", DefaultLockStaleAfter); !errors.Is(err, ErrLockHeld) {
+		t.Errorf("lock held from another host: err = %v, want ErrLockHeld", err)
+	}
+
+	if _, err := repo.db.Exec(`UPDATE locks SET acquired_at = acquired_at - 7200 WHERE key = 'remote'`); err != nil {
+		t.Fatalf("failed to age lock: %v", err)
+	}
+	lock, err := repo.AcquireLock(ctx, "remote", DefaultLockStaleAfter)
+	if err != nil {
+		t.Fatalf("expected stale lock from another host to be reclaimed, got %v", err)
+	}
+	if lock.Host != repo.host {
+		t.Errorf("lock host = %q, want %q", lock.Host, repo.host)
+	}
+}
+
+func TestLock_RefreshKeepsLongRunsHeld(t *testing.T) {
+	dbPath := "/tmp/test_images_lock5.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+	fake := clock.NewFake(time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC))
+	repo, err := NewRepository(dbPath, WithClock(fake))
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+	ctx := context.Background()
+
+	lock, err := repo.AcquireLock(ctx, "long", time.Hour)
+	if err != nil {
+		t.Fatalf("AcquireLock failed: %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		fake.Advance(30 * time.Minute)
+		if held, err := lock.refresh(ctx); err != nil || !held {
+			t.Fatalf("refresh = %v, %v; want held", held, err)
+		}
+	}
+	if _, err := repo.acquireLock(ctx, "long", os.Getpid()+1, time.Hour); !errors.Is(err, ErrLockHeld) {
+		t.Errorf("refreshed lock after 2h: err = %v, want ErrLockHeld", err)
+	}
+
+	if err := lock.Release(ctx); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+	if held, err := lock.refresh(ctx); err != nil || held {
+		t.Errorf("refresh after release = %v, %v; want not held", held, err)
+	}
+}
@@ -0,0 +1,160 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+
+	"github.com/fly-io/162719/pkg/errors"
+)
+
+// Migration is a single versioned schema change
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *sql.Tx) error
+}
+
+// Column describes a column added to an existing table
+type Column struct {
+	Name       string
+	Definition string
+}
+
+const migrationsTable = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+    version INTEGER PRIMARY KEY,
+    name TEXT NOT NULL,
+    applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+`
+
+// migrate applies all pending migrations, each in its own transaction.
+// Several processes may open an older database at once, so a migration
+// found pending is checked again under the write lock before it runs.
+func migrate(db *sql.DB, migrations []Migration) error {
+	if _, err := db.Exec(migrationsTable); err != nil {
+		return errors.Wrap(err, "failed to create schema_migrations table")
+	}
+
+	applied, err := appliedVersions(db)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if applied[m.Version] {
+			continue
+		}
+
+		slog.Info("database_apply_migration", "version", m.Version, "name", m.Name)
+		if err := applyMigration(db, m); err != nil {
+			slog.Error("database_migration_failed", "version", m.Version, "name", m.Name, "error", err)
+			return errors.Wrap(err, fmt.Sprintf("migration %d (%s) failed", m.Version, m.Name))
+		}
+	}
+
+	return nil
+}
+
+// applyMigration runs m in a transaction begun IMMEDIATE (see
+// NewRepository), skipping it if another process recorded it first
+func applyMigration(db *sql.DB, m Migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	var applied int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM schema_migrations WHERE version = ?", m.Version).Scan(&applied); err != nil {
+		return errors.Wrap(err, "failed to check schema_migrations")
+	}
+	if applied > 0 {
+		slog.Info("database_migration_already_applied", "version", m.Version, "name", m.Name)
+		return nil
+	}
+
+	if err := m.Up(tx); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("INSERT INTO schema_migrations (version, name) VALUES (?, ?)", m.Version, m.Name); err != nil {
+		return errors.Wrap(err, "failed to record migration")
+	}
+
+	return tx.Commit()
+}
+
+func appliedVersions(db *sql.DB) (map[int]bool, error) {
+	rows, err := db.Query("SELECT version FROM schema_migrations")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query schema_migrations")
+	}
+	defer rows.Close()
+
+	applied := make(map[int]bool)
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, errors.Wrap(err, "failed to scan migration version")
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
+
+// execSQL returns a migration step that executes a block of statements
+func execSQL(statements string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(statements)
+		return err
+	}
+}
+
+// addColumns returns a migration step that adds columns to a table,
+// skipping any that already exist so databases patched before migrations
+// were tracked upgrade cleanly
+func addColumns(table string, columns ...Column) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		existing, err := tableColumns(tx, table)
+		if err != nil {
+			return err
+		}
+
+		for _, col := range columns {
+			if existing[col.Name] {
+				continue
+			}
+			if _, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, col.Name, col.Definition)); err != nil {
+				return errors.Wrap(err, fmt.Sprintf("failed to add column %s.%s", table, col.Name))
+			}
+		}
+		return nil
+	}
+}
+
+func tableColumns(tx *sql.Tx, table string) (map[string]bool, error) {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read table info")
+	}
+	defer rows.Close()
+
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return nil, errors.Wrap(err, "failed to scan table info")
+		}
+		existing[name] = true
+	}
+	return existing, rows.Err()
+}
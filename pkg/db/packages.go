@@ -0,0 +1,84 @@
+package db
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/fly-io/162719/pkg/errors"
+)
+
+// ReplacePackages stores the package inventory of an image, discarding any
+// previously recorded one
+func (r *Repository) ReplacePackages(imageID int64, pkgs []Package) error {
+	return r.ReplacePackagesContext(context.Background(), imageID, pkgs)
+}
+
+// ReplacePackagesContext is like ReplacePackages but honors ctx cancellation
+func (r *Repository) ReplacePackagesContext(ctx context.Context, imageID int64, pkgs []Package) error {
+	slog.Info("database_replace_packages", "image_id", imageID, "package_count", len(pkgs))
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM packages WHERE image_id = ?`, imageID); err != nil {
+		slog.Error("database_delete_packages_failed", "image_id", imageID, "error", err)
+		return errors.Wrap(err, "failed to delete packages")
+	}
+
+	stmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO packages (image_id, manager, name, version, architecture) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(image_id, manager, name, architecture) DO UPDATE SET version = excluded.version
+	`)
+	if err != nil {
+		return errors.Wrap(err, "failed to prepare insert")
+	}
+	defer stmt.Close()
+
+	for _, p := range pkgs {
+		if _, err := stmt.ExecContext(ctx, imageID, p.Manager, p.Name, p.Version, p.Architecture); err != nil {
+			slog.Error("database_insert_package_failed", "image_id", imageID, "name", p.Name, "error", err)
+			return errors.Wrap(err, "failed to insert package")
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "failed to commit packages")
+	}
+	return nil
+}
+
+// ListPackages returns the recorded packages of an image, ordered by name
+func (r *Repository) ListPackages(imageID int64) ([]*Package, error) {
+	return r.ListPackagesContext(context.Background(), imageID)
+}
+
+// ListPackagesContext is like ListPackages but honors ctx cancellation
+func (r *Repository) ListPackagesContext(ctx context.Context, imageID int64) ([]*Package, error) {
+	query := `SELECT image_id, manager, name, version, architecture FROM packages
+		WHERE image_id = ? ORDER BY name, manager, architecture`
+	rows, err := r.db.QueryContext(ctx, query, imageID)
+	if err != nil {
+		slog.Error("database_list_packages_failed", "image_id", imageID, "error", err)
+		return nil, errors.Wrap(err, "failed to list packages")
+	}
+	defer rows.Close()
+
+	var pkgs []*Package
+	for rows.Next() {
+		p := &Package{}
+		if err := rows.Scan(&p.ImageID, &p.Manager, &p.Name, &p.Version, &p.Architecture); err != nil {
+			slog.Error("database_scan_row_failed", "error", err)
+			return nil, errors.Wrap(err, "failed to scan row")
+		}
+		pkgs = append(pkgs, p)
+	}
+
+	if err := rows.Err(); err != nil {
+		slog.Error("database_rows_error", "error", err)
+		return nil, errors.Wrap(err, "rows error")
+	}
+	return pkgs, nil
+}
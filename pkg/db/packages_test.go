@@ -0,0 +1,59 @@
+package db
+
+import (
+	"os"
+	"testing"
+)
+
+func TestReplacePackages(t *testing.T) {
+	dbPath := "/tmp/test_images_packages.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	repo, err := NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	img := &Image{S3Key: "images/debian.tar", SHA256: "", Status: StatusPending}
+	if err := repo.Create(img); err != nil {
+		t.Fatalf("failed to create image: %v", err)
+	}
+
+	first := []Package{
+		{Manager: "dpkg", Name: "libc6", Version: "2.36", Architecture: "amd64"},
+		{Manager: "dpkg", Name: "bash", Version: "5.2", Architecture: "amd64"},
+	}
+	if err := repo.ReplacePackages(img.ID, first); err != nil {
+		t.Fatalf("ReplacePackages failed: %v", err)
+	}
+
+	// A rescan replaces the previous inventory rather than merging
+	second := []Package{
+		{Manager: "dpkg", Name: "bash", Version: "5.3", Architecture: "amd64"},
+	}
+	if err := repo.ReplacePackages(img.ID, second); err != nil {
+		t.Fatalf("ReplacePackages failed: %v", err)
+	}
+
+	pkgs, err := repo.ListPackages(img.ID)
+	if err != nil {
+		t.Fatalf("ListPackages failed: %v", err)
+	}
+	if len(pkgs) != 1 || pkgs[0].Name != "bash" || pkgs[0].Version != "5.3" {
+		t.Fatalf("unexpected packages after rescan: %+v", pkgs)
+	}
+
+	// Packages go away with their image
+	if err := repo.Delete(img.ID); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	pkgs, err = repo.ListPackages(img.ID)
+	if err != nil {
+		t.Fatalf("ListPackages failed: %v", err)
+	}
+	if len(pkgs) != 0 {
+		t.Errorf("expected packages to cascade on delete, got %d", len(pkgs))
+	}
+}
@@ -0,0 +1,55 @@
+package db
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/fly-io/162719/pkg/errors"
+)
+
+// PruneCandidates returns images last updated more than olderThan ago, as
+// measured by the repository clock, oldest first. When statuses are given
+// only images in one of them are returned.
+func (r *Repository) PruneCandidates(olderThan time.Duration, statuses ...string) ([]*Image, error) {
+	return r.PruneCandidatesContext(context.Background(), olderThan, statuses...)
+}
+
+// PruneCandidatesContext is like PruneCandidates but honors ctx cancellation
+func (r *Repository) PruneCandidatesContext(ctx context.Context, olderThan time.Duration, statuses ...string) ([]*Image, error) {
+	cutoff := r.clock.Now().Add(-olderThan).UTC().Format(timestampLayout)
+	slog.Info("database_prune_candidates", "cutoff", cutoff, "statuses", statuses)
+
+	query := `SELECT ` + imageColumns + ` FROM images WHERE updated_at < ?`
+	args := []any{cutoff}
+	if len(statuses) > 0 {
+		query += ` AND status IN (?` + strings.Repeat(", ?", len(statuses)-1) + `)`
+		for _, status := range statuses {
+			args = append(args, status)
+		}
+	}
+	query += ` ORDER BY updated_at, id`
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		slog.Error("database_prune_query_failed", "error", err)
+		return nil, errors.Wrap(err, "failed to query prune candidates")
+	}
+	defer rows.Close()
+
+	var images []*Image
+	for rows.Next() {
+		img, err := scanImage(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan row")
+		}
+		images = append(images, img)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "rows error")
+	}
+
+	slog.Info("database_prune_candidates_found", "count", len(images))
+	return images, nil
+}
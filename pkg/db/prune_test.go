@@ -0,0 +1,151 @@
+package db
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/fly-io/162719/pkg/clock"
+)
+
+func TestPruneCandidates(t *testing.T) {
+	dbPath := "/tmp/test_images_prune.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	clk := clock.NewFake(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	repo, err := NewRepository(dbPath, WithClock(clk))
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	create := func(key, status string) *Image {
+		t.Helper()
+		img := &Image{S3Key: key, Status: status}
+		if err := repo.Create(img); err != nil {
+			t.Fatalf("create %s: %v", key, err)
+		}
+		return img
+	}
+
+	// Ten days ago: one failed, one ready
+	oldFailed := create("old-failed.tar", StatusFailed)
+	create("old-ready.tar", StatusReady)
+
+	// Five days ago: a failed image that was touched again yesterday
+	clk.Advance(5 * 24 * time.Hour)
+	retried := create("retried.tar", StatusFailed)
+
+	clk.Advance(4 * 24 * time.Hour)
+	if err := repo.UpdateStatus(retried.ID, StatusFailed, "still broken"); err != nil {
+		t.Fatalf("update status: %v", err)
+	}
+
+	clk.Advance(24 * time.Hour)
+	create("new-failed.tar", StatusFailed)
+
+	got, err := repo.PruneCandidates(7*24*time.Hour, StatusFailed)
+	if err != nil {
+		t.Fatalf("PruneCandidates failed: %v", err)
+	}
+	if len(got) != 1 || got[0].ID != oldFailed.ID {
+		t.Fatalf("failed candidates = %v, want only %s", keys(got), oldFailed.S3Key)
+	}
+
+	got, err = repo.PruneCandidates(7 * 24 * time.Hour)
+	if err != nil {
+		t.Fatalf("PruneCandidates failed: %v", err)
+	}
+	if want := []string{"old-failed.tar", "old-ready.tar"}; !equalKeys(got, want) {
+		t.Errorf("any-status candidates = %v, want %v", keys(got), want)
+	}
+
+	got, err = repo.PruneCandidates(12*time.Hour, StatusFailed, StatusReady)
+	if err != nil {
+		t.Fatalf("PruneCandidates failed: %v", err)
+	}
+	if want := []string{"old-failed.tar", "old-ready.tar", "retried.tar"}; !equalKeys(got, want) {
+		t.Errorf("12h candidates = %v, want %v", keys(got), want)
+	}
+}
+
+func keys(images []*Image) []string {
+	var out []string
+	for _, img := range images {
+		out = append(out, img.S3Key)
+	}
+	return out
+}
+
+func equalKeys(images []*Image, want []string) bool {
+	got := keys(images)
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestListSince_IncludesBoundary(t *testing.T) {
+	dbPath := "/tmp/test_images_since.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	clk := clock.NewFake(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	repo, err := NewRepository(dbPath, WithClock(clk))
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	create := func(key string) *Image {
+		t.Helper()
+		img := &Image{S3Key: key, Status: StatusPending}
+		if err := repo.Create(img); err != nil {
+			t.Fatalf("create %s: %v", key, err)
+		}
+		return img
+	}
+
+	create("old.tar")
+	clk.Advance(time.Second)
+	create("boundary.tar")
+	stale := create("stale-but-updated.tar")
+	clk.Advance(30 * time.Minute)
+	create("recent.tar")
+	clk.Advance(30 * time.Minute)
+	if err := repo.UpdateStatus(stale.ID, StatusFailed, "retried"); err != nil {
+		t.Fatalf("update status: %v", err)
+	}
+
+	// Now is 12:00:01 + 1h; the cutoff lands exactly on boundary.tar
+	got, err := repo.ListSince(time.Hour)
+	if err != nil {
+		t.Fatalf("ListSince failed: %v", err)
+	}
+	want := map[string]bool{"boundary.tar": true, "stale-but-updated.tar": true, "recent.tar": true}
+	if len(got) != len(want) {
+		t.Fatalf("ListSince(1h) = %v, want %d images", keys(got), len(want))
+	}
+	for _, img := range got {
+		if !want[img.S3Key] {
+			t.Errorf("ListSince(1h) returned %s", img.S3Key)
+		}
+	}
+
+	clk.Advance(time.Second)
+	got, err = repo.ListSince(time.Hour)
+	if err != nil {
+		t.Fatalf("ListSince failed: %v", err)
+	}
+	for _, img := range got {
+		if img.S3Key == "boundary.tar" {
+			t.Error("boundary.tar still listed a second past the cutoff")
+		}
+	}
+}
@@ -5,36 +5,150 @@ import (
 	"database/sql"
 	"fmt"
 	"log/slog"
+	"os"
+	"time"
 
+	"github.com/fly-io/162719/pkg/clock"
 	"github.com/fly-io/162719/pkg/errors"
 	_ "modernc.org/sqlite"
 )
 
 // Repository provides database operations for images
 type Repository struct {
-	db *sql.DB
+	db    *sql.DB
+	clock clock.Clock
+	host  string
 }
 
+// RepositoryOption configures a Repository
+type RepositoryOption func(*Repository)
+
+// WithClock sets the clock used for timestamps and time-based queries
+// (default: the system clock)
+func WithClock(c clock.Clock) RepositoryOption {
+	return func(r *Repository) {
+		r.clock = c
+	}
+}
+
+// WithHost sets the host recorded on the images the repository creates
+// or updates (default: os.Hostname()). An empty host keeps the default.
+func WithHost(host string) RepositoryOption {
+	return func(r *Repository) {
+		if host != "" {
+			r.host = host
+		}
+	}
+}
+
+// Host returns the host recorded on the images the repository creates or
+// updates
+func (r *Repository) Host() string {
+	return r.host
+}
+
+// timestampLayout matches SQLite's CURRENT_TIMESTAMP so rows written by
+// the repository compare correctly with rows defaulted by the schema
+const timestampLayout = "2006-01-02 15:04:05"
+
+// MemoryPath opens a private in-memory database instead of a file. Each
+// repository opened with it is empty and gone once closed.
+const MemoryPath = ":memory:"
+
 // NewRepository creates a new repository
-func NewRepository(dbPath string) (*Repository, error) {
+func NewRepository(dbPath string, opts ...RepositoryOption) (*Repository, error) {
 	slog.Info("database_init", "db_path", dbPath)
 
-	db, err := sql.Open("sqlite", dbPath)
+	// Wait on lock contention instead of failing immediately with
+	// SQLITE_BUSY when several processes or goroutines write at once, and
+	// enforce REFERENCES clauses so deleting an image cascades to its rows.
+	// Transactions begin IMMEDIATE: every one of them writes, and taking
+	// the write lock up front lets busy_timeout wait for it, where a
+	// deferred transaction upgrading from a read fails at once.
+	db, err := sql.Open("sqlite", dbPath+"?_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)&_txlock=immediate")
 	if err != nil {
 		slog.Error("database_open_failed", "db_path", dbPath, "error", err)
 		return nil, errors.Wrap(err, "failed to open database")
 	}
+	if dbPath == MemoryPath {
+		// Every connection to :memory: gets its own empty database
+		db.SetMaxOpenConns(1)
+	}
 
-	// Create schema
-	slog.Info("database_create_schema", "db_path", dbPath)
-	if _, err := db.Exec(Schema); err != nil {
+	// Apply pending schema migrations
+	slog.Info("database_migrate", "db_path", dbPath)
+	if err := migrate(db, Migrations); err != nil {
 		db.Close()
-		slog.Error("database_schema_failed", "db_path", dbPath, "error", err)
-		return nil, errors.Wrap(err, "failed to create schema")
+		slog.Error("database_migration_failed", "db_path", dbPath, "error", err)
+		return nil, errors.Wrap(err, "failed to migrate schema")
+	}
+
+	// Device paths are host-local, so records note the host that wrote
+	// them for deployments sharing one database
+	host, err := os.Hostname()
+	if err != nil {
+		slog.Warn("database_hostname_unavailable", "error", err)
+	}
+
+	r := &Repository{db: db, clock: clock.Real{}, host: host}
+	for _, opt := range opts {
+		opt(r)
 	}
 
 	slog.Info("database_ready", "db_path", dbPath)
-	return &Repository{db: db}, nil
+	return r, nil
+}
+
+// NewInMemoryRepository creates a repository backed by a private
+// in-memory database, e.g. for tests
+func NewInMemoryRepository(opts ...RepositoryOption) (*Repository, error) {
+	return NewRepository(MemoryPath, opts...)
+}
+
+// now returns the repository clock's current time as a SQLite timestamp
+func (r *Repository) now() string {
+	return r.clock.Now().UTC().Format(timestampLayout)
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// imageColumns lists the columns read by scanImage, in scan order
+const imageColumns = `id, s3_key, sha256, status,
+		       device_path, base_device_id, snapshot_id, error_message,
+		       etag, last_modified, download_size, attempts, snapshot_active, tree_hash, download_compression, extract_subpath, host, created_at, updated_at`
+
+// scanImage scans a row selected with imageColumns into an Image
+func scanImage(row rowScanner) (*Image, error) {
+	var img Image
+	var devicePath, errorMessage, etag, lastModified, treeHash, downloadCompression, extractSubpath, host sql.NullString
+	var baseDeviceID sql.NullInt64
+	var snapshotID sql.NullInt64
+
+	err := row.Scan(
+		&img.ID, &img.S3Key, &img.SHA256, &img.Status,
+		&devicePath, &baseDeviceID, &snapshotID, &errorMessage,
+		&etag, &lastModified, &img.DownloadSize, &img.Attempts, &img.SnapshotActive, &treeHash,
+		&downloadCompression, &extractSubpath, &host, &img.CreatedAt, &img.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	// Handle nullable fields
+	img.DevicePath = devicePath.String
+	img.BaseDeviceID = int(baseDeviceID.Int64)
+	img.SnapshotID = int(snapshotID.Int64)
+	img.ErrorMessage = errorMessage.String
+	img.ETag = etag.String
+	img.LastModified = lastModified.String
+	img.TreeHash = treeHash.String
+	img.DownloadCompression = downloadCompression.String
+	img.ExtractSubpath = extractSubpath.String
+	img.Host = host.String
+
+	return &img, nil
 }
 
 // Close closes the database connection
@@ -42,17 +156,40 @@ func (r *Repository) Close() error {
 	return r.db.Close()
 }
 
+// Ping verifies the database answers queries, not just that its file
+// opened: a locked or corrupt database fails here
+func (r *Repository) Ping(ctx context.Context) error {
+	if err := r.db.PingContext(ctx); err != nil {
+		return errors.Wrap(err, "database ping failed")
+	}
+	var one int
+	if err := r.db.QueryRowContext(ctx, "SELECT 1").Scan(&one); err != nil {
+		return errors.Wrap(err, "database query failed")
+	}
+	if one != 1 {
+		return fmt.Errorf("database query returned %d, want 1", one)
+	}
+	return nil
+}
+
 // Create inserts a new image record
 func (r *Repository) Create(img *Image) error {
+	return r.CreateContext(context.Background(), img)
+}
+
+// CreateContext is like Create but honors ctx cancellation
+func (r *Repository) CreateContext(ctx context.Context, img *Image) error {
 	slog.Info("database_create_image", "s3_key", img.S3Key, "status", img.Status)
 
 	query := `
-		INSERT INTO images (s3_key, sha256, status, device_path, base_device_id, snapshot_id, error_message)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO images (s3_key, sha256, status, device_path, base_device_id, snapshot_id, error_message, etag, last_modified, download_size, attempts, snapshot_active, tree_hash, download_compression, extract_subpath, host, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
-	result, err := r.db.Exec(query,
+	now := r.now()
+	result, err := r.db.ExecContext(ctx, query,
 		img.S3Key, img.SHA256, img.Status,
-		img.DevicePath, img.BaseDeviceID, img.SnapshotID, img.ErrorMessage)
+		img.DevicePath, img.BaseDeviceID, img.SnapshotID, img.ErrorMessage,
+		img.ETag, img.LastModified, img.DownloadSize, img.Attempts, img.SnapshotActive, img.TreeHash, img.DownloadCompression, img.ExtractSubpath, r.host, now, now)
 	if err != nil {
 		slog.Error("database_insert_failed", "s3_key", img.S3Key, "error", err)
 		return errors.Wrap(err, "failed to insert image")
@@ -64,6 +201,7 @@ func (r *Repository) Create(img *Image) error {
 		return errors.Wrap(err, "failed to get last insert id")
 	}
 	img.ID = id
+	img.Host = r.host
 
 	slog.Info("database_image_created", "s3_key", img.S3Key, "image_id", img.ID, "status", img.Status)
 	return nil
@@ -71,23 +209,15 @@ func (r *Repository) Create(img *Image) error {
 
 // GetByS3Key retrieves an image by S3 key
 func (r *Repository) GetByS3Key(s3Key string) (*Image, error) {
-	slog.Info("database_query_image", "s3_key", s3Key)
-
-	query := `
-		SELECT id, s3_key, sha256, status,
-		       device_path, base_device_id, snapshot_id, error_message, created_at, updated_at
-		FROM images WHERE s3_key = ?
-	`
-	var img Image
-	var devicePath, errorMessage sql.NullString
-	var baseDeviceID sql.NullInt64
-	var snapshotID sql.NullInt64
+	return r.GetByS3KeyContext(context.Background(), s3Key)
+}
 
-	err := r.db.QueryRow(query, s3Key).Scan(
-		&img.ID, &img.S3Key, &img.SHA256, &img.Status,
-		&devicePath, &baseDeviceID, &snapshotID, &errorMessage,
-		&img.CreatedAt, &img.UpdatedAt)
+// GetByS3KeyContext is like GetByS3Key but honors ctx cancellation
+func (r *Repository) GetByS3KeyContext(ctx context.Context, s3Key string) (*Image, error) {
+	slog.Info("database_query_image", "s3_key", s3Key)
 
+	query := `SELECT ` + imageColumns + ` FROM images WHERE s3_key = ?`
+	img, err := scanImage(r.db.QueryRowContext(ctx, query, s3Key))
 	if err == sql.ErrNoRows {
 		slog.Info("database_image_not_found", "s3_key", s3Key)
 		return nil, nil // Not found
@@ -97,29 +227,31 @@ func (r *Repository) GetByS3Key(s3Key string) (*Image, error) {
 		return nil, errors.Wrap(err, "failed to query image")
 	}
 
-	// Handle nullable fields
-	img.DevicePath = devicePath.String
-	img.BaseDeviceID = int(baseDeviceID.Int64)
-	img.SnapshotID = int(snapshotID.Int64)
-	img.ErrorMessage = errorMessage.String
-
 	slog.Info("database_image_found", "s3_key", s3Key, "image_id", img.ID, "status", img.Status)
-	return &img, nil
+	return img, nil
 }
 
 // Update updates an existing image record
 func (r *Repository) Update(img *Image) error {
+	return r.UpdateContext(context.Background(), img)
+}
+
+// UpdateContext is like Update but honors ctx cancellation
+func (r *Repository) UpdateContext(ctx context.Context, img *Image) error {
 	slog.Info("database_update_image", "image_id", img.ID, "s3_key", img.S3Key, "status", img.Status)
 
 	query := `
 		UPDATE images
 		SET sha256 = ?, status = ?,
-		    device_path = ?, base_device_id = ?, snapshot_id = ?, error_message = ?, updated_at = CURRENT_TIMESTAMP
+		    device_path = ?, base_device_id = ?, snapshot_id = ?, error_message = ?,
+		    etag = ?, last_modified = ?, download_size = ?, snapshot_active = ?, tree_hash = ?,
+		    download_compression = ?, extract_subpath = ?, host = ?, updated_at = ?
 		WHERE id = ?
 	`
-	result, err := r.db.Exec(query,
+	result, err := r.db.ExecContext(ctx, query,
 		img.SHA256, img.Status,
-		img.DevicePath, img.BaseDeviceID, img.SnapshotID, img.ErrorMessage, img.ID)
+		img.DevicePath, img.BaseDeviceID, img.SnapshotID, img.ErrorMessage,
+		img.ETag, img.LastModified, img.DownloadSize, img.SnapshotActive, img.TreeHash, img.DownloadCompression, img.ExtractSubpath, r.host, r.now(), img.ID)
 	if err != nil {
 		slog.Error("database_update_failed", "image_id", img.ID, "s3_key", img.S3Key, "error", err)
 		return errors.Wrap(err, "failed to update image")
@@ -134,6 +266,7 @@ func (r *Repository) Update(img *Image) error {
 		slog.Error("database_image_not_found_for_update", "image_id", img.ID)
 		return fmt.Errorf("image not found: id=%d", img.ID)
 	}
+	img.Host = r.host
 
 	slog.Info("database_image_updated", "image_id", img.ID, "s3_key", img.S3Key, "status", img.Status)
 	return nil
@@ -141,10 +274,15 @@ func (r *Repository) Update(img *Image) error {
 
 // UpdateStatus updates only the status field
 func (r *Repository) UpdateStatus(id int64, status, errorMessage string) error {
+	return r.UpdateStatusContext(context.Background(), id, status, errorMessage)
+}
+
+// UpdateStatusContext is like UpdateStatus but honors ctx cancellation
+func (r *Repository) UpdateStatusContext(ctx context.Context, id int64, status, errorMessage string) error {
 	slog.Info("database_update_status", "image_id", id, "status", status)
 
-	query := `UPDATE images SET status = ?, error_message = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`
-	_, err := r.db.Exec(query, status, errorMessage, id)
+	query := `UPDATE images SET status = ?, error_message = ?, updated_at = ? WHERE id = ?`
+	_, err := r.db.ExecContext(ctx, query, status, errorMessage, r.now(), id)
 	if err != nil {
 		slog.Error("database_status_update_failed", "image_id", id, "status", status, "error", err)
 		return errors.Wrap(err, "failed to update status")
@@ -154,61 +292,271 @@ func (r *Repository) UpdateStatus(id int64, status, errorMessage string) error {
 	return nil
 }
 
+// IncrementAttempts records another processing attempt on an image and
+// returns the new count. It is a single statement, so concurrent or
+// restarted processes never lose an increment.
+func (r *Repository) IncrementAttempts(id int64) (int, error) {
+	return r.IncrementAttemptsContext(context.Background(), id)
+}
+
+// IncrementAttemptsContext is like IncrementAttempts but honors ctx cancellation
+func (r *Repository) IncrementAttemptsContext(ctx context.Context, id int64) (int, error) {
+	var attempts int
+	query := `UPDATE images SET attempts = attempts + 1, updated_at = ? WHERE id = ? RETURNING attempts`
+	err := r.db.QueryRowContext(ctx, query, r.now(), id).Scan(&attempts)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("image not found: id=%d", id)
+	}
+	if err != nil {
+		slog.Error("database_increment_attempts_failed", "image_id", id, "error", err)
+		return 0, errors.Wrap(err, "failed to increment attempts")
+	}
+
+	slog.Info("database_attempts_incremented", "image_id", id, "attempts", attempts)
+	return attempts, nil
+}
+
+// SetSnapshotActive records whether an image's snapshot is currently
+// mapped as a device
+func (r *Repository) SetSnapshotActive(id int64, active bool) error {
+	return r.SetSnapshotActiveContext(context.Background(), id, active)
+}
+
+// SetSnapshotActiveContext is like SetSnapshotActive but honors ctx cancellation
+func (r *Repository) SetSnapshotActiveContext(ctx context.Context, id int64, active bool) error {
+	query := `UPDATE images SET snapshot_active = ?, updated_at = ? WHERE id = ?`
+	result, err := r.db.ExecContext(ctx, query, active, r.now(), id)
+	if err != nil {
+		slog.Error("database_set_snapshot_active_failed", "image_id", id, "error", err)
+		return errors.Wrap(err, "failed to set snapshot active")
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		slog.Error("database_rows_affected_failed", "image_id", id, "error", err)
+		return errors.Wrap(err, "failed to get rows affected")
+	}
+	if rows == 0 {
+		return fmt.Errorf("image not found: id=%d", id)
+	}
+
+	slog.Info("database_snapshot_active_updated", "image_id", id, "active", active)
+	return nil
+}
+
+// SetTreeHash records the digest of an image's extracted tree
+func (r *Repository) SetTreeHash(id int64, hash string) error {
+	return r.SetTreeHashContext(context.Background(), id, hash)
+}
+
+// SetTreeHashContext is like SetTreeHash but honors ctx cancellation
+func (r *Repository) SetTreeHashContext(ctx context.Context, id int64, hash string) error {
+	query := `UPDATE images SET tree_hash = ?, updated_at = ? WHERE id = ?`
+	result, err := r.db.ExecContext(ctx, query, hash, r.now(), id)
+	if err != nil {
+		slog.Error("database_set_tree_hash_failed", "image_id", id, "error", err)
+		return errors.Wrap(err, "failed to set tree hash")
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		slog.Error("database_rows_affected_failed", "image_id", id, "error", err)
+		return errors.Wrap(err, "failed to get rows affected")
+	}
+	if rows == 0 {
+		return fmt.Errorf("image not found: id=%d", id)
+	}
+
+	slog.Info("database_tree_hash_updated", "image_id", id, "tree_hash", hash)
+	return nil
+}
+
+// SetDownloadCompression records how an image's kept download is
+// compressed on disk; "" marks it stored as downloaded
+func (r *Repository) SetDownloadCompression(id int64, compression string) error {
+	return r.SetDownloadCompressionContext(context.Background(), id, compression)
+}
+
+// SetDownloadCompressionContext is like SetDownloadCompression but honors
+// ctx cancellation
+func (r *Repository) SetDownloadCompressionContext(ctx context.Context, id int64, compression string) error {
+	query := `UPDATE images SET download_compression = ?, updated_at = ? WHERE id = ?`
+	result, err := r.db.ExecContext(ctx, query, compression, r.now(), id)
+	if err != nil {
+		slog.Error("database_set_download_compression_failed", "image_id", id, "error", err)
+		return errors.Wrap(err, "failed to set download compression")
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		slog.Error("database_rows_affected_failed", "image_id", id, "error", err)
+		return errors.Wrap(err, "failed to get rows affected")
+	}
+	if rows == 0 {
+		return fmt.Errorf("image not found: id=%d", id)
+	}
+
+	slog.Info("database_download_compression_updated", "image_id", id, "compression", compression)
+	return nil
+}
+
+// Reset returns an image to pending and clears everything derived from
+// processing it (digest, device, snapshot, error, object metadata, attempt
+// count, tree hash, download compression), so the next fetch starts from scratch
+func (r *Repository) Reset(id int64) error {
+	return r.ResetContext(context.Background(), id)
+}
+
+// ResetContext is like Reset but honors ctx cancellation
+func (r *Repository) ResetContext(ctx context.Context, id int64) error {
+	slog.Info("database_reset_image", "image_id", id)
+
+	query := `
+		UPDATE images
+		SET status = ?, sha256 = '',
+		    device_path = NULL, base_device_id = NULL, snapshot_id = NULL, error_message = NULL,
+		    etag = NULL, last_modified = NULL, download_size = 0, attempts = 0, snapshot_active = 0,
+		    tree_hash = NULL, download_compression = NULL, updated_at = ?
+		WHERE id = ?
+	`
+	result, err := r.db.ExecContext(ctx, query, StatusPending, r.now(), id)
+	if err != nil {
+		slog.Error("database_reset_failed", "image_id", id, "error", err)
+		return errors.Wrap(err, "failed to reset image")
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		slog.Error("database_rows_affected_failed", "image_id", id, "error", err)
+		return errors.Wrap(err, "failed to get rows affected")
+	}
+	if rows == 0 {
+		slog.Error("database_image_not_found_for_reset", "image_id", id)
+		return fmt.Errorf("image not found: id=%d", id)
+	}
+
+	slog.Info("database_image_reset", "image_id", id)
+	return nil
+}
+
 // List retrieves all images
 func (r *Repository) List() ([]*Image, error) {
+	return r.ListContext(context.Background())
+}
+
+// ListContext is like List but honors ctx cancellation
+func (r *Repository) ListContext(ctx context.Context) ([]*Image, error) {
 	slog.Info("database_list_images")
 
-	query := `
-		SELECT id, s3_key, sha256, status,
-		       device_path, base_device_id, snapshot_id, error_message, created_at, updated_at
-		FROM images ORDER BY created_at DESC
-	`
-	rows, err := r.db.Query(query)
+	query := `SELECT ` + imageColumns + ` FROM images ORDER BY created_at DESC`
+	images, err := r.queryImages(ctx, query)
 	if err != nil {
-		slog.Error("database_list_query_failed", "error", err)
 		return nil, errors.Wrap(err, "failed to list images")
 	}
+
+	slog.Info("database_list_complete", "image_count", len(images))
+	return images, nil
+}
+
+// ListSince retrieves images created or updated within since of now, as
+// measured by the repository clock. An image updated exactly since ago is
+// included.
+func (r *Repository) ListSince(since time.Duration) ([]*Image, error) {
+	return r.ListSinceContext(context.Background(), since)
+}
+
+// ListSinceContext is like ListSince but honors ctx cancellation
+func (r *Repository) ListSinceContext(ctx context.Context, since time.Duration) ([]*Image, error) {
+	cutoff := r.clock.Now().Add(-since).UTC().Format(timestampLayout)
+	slog.Info("database_list_since", "cutoff", cutoff)
+
+	// updated_at is never before created_at, so it covers both
+	query := `SELECT ` + imageColumns + ` FROM images WHERE updated_at >= ? ORDER BY created_at DESC`
+	images, err := r.queryImages(ctx, query, cutoff)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list images")
+	}
+
+	slog.Info("database_list_since_complete", "cutoff", cutoff, "image_count", len(images))
+	return images, nil
+}
+
+// ListByHost retrieves the images last created or updated by host
+func (r *Repository) ListByHost(host string) ([]*Image, error) {
+	return r.ListByHostContext(context.Background(), host)
+}
+
+// ListByHostContext is like ListByHost but honors ctx cancellation
+func (r *Repository) ListByHostContext(ctx context.Context, host string) ([]*Image, error) {
+	slog.Info("database_query_host", "host", host)
+
+	query := `SELECT ` + imageColumns + ` FROM images WHERE host = ? ORDER BY created_at DESC`
+	images, err := r.queryImages(ctx, query, host)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query images by host")
+	}
+
+	slog.Info("database_query_host_complete", "host", host, "image_count", len(images))
+	return images, nil
+}
+
+// GetByStatus retrieves all images with the given status
+func (r *Repository) GetByStatus(status string) ([]*Image, error) {
+	return r.GetByStatusContext(context.Background(), status)
+}
+
+// GetByStatusContext is like GetByStatus but honors ctx cancellation
+func (r *Repository) GetByStatusContext(ctx context.Context, status string) ([]*Image, error) {
+	slog.Info("database_query_status", "status", status)
+
+	query := `SELECT ` + imageColumns + ` FROM images WHERE status = ? ORDER BY created_at DESC`
+	images, err := r.queryImages(ctx, query, status)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query images by status")
+	}
+
+	slog.Info("database_query_status_complete", "status", status, "image_count", len(images))
+	return images, nil
+}
+
+// queryImages runs a query selecting imageColumns and scans every row
+func (r *Repository) queryImages(ctx context.Context, query string, args ...any) ([]*Image, error) {
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		slog.Error("database_list_query_failed", "error", err)
+		return nil, err
+	}
 	defer rows.Close()
 
 	var images []*Image
 	for rows.Next() {
-		var img Image
-		var devicePath, errorMessage sql.NullString
-		var baseDeviceID sql.NullInt64
-		var snapshotID sql.NullInt64
-
-		err := rows.Scan(
-			&img.ID, &img.S3Key, &img.SHA256, &img.Status,
-			&devicePath, &baseDeviceID, &snapshotID, &errorMessage,
-			&img.CreatedAt, &img.UpdatedAt)
+		img, err := scanImage(rows)
 		if err != nil {
 			slog.Error("database_scan_row_failed", "error", err)
 			return nil, errors.Wrap(err, "failed to scan row")
 		}
 
-		img.DevicePath = devicePath.String
-		img.BaseDeviceID = int(baseDeviceID.Int64)
-		img.SnapshotID = int(snapshotID.Int64)
-		img.ErrorMessage = errorMessage.String
-
-		images = append(images, &img)
+		images = append(images, img)
 	}
 
 	if err := rows.Err(); err != nil {
 		slog.Error("database_rows_error", "error", err)
 		return nil, errors.Wrap(err, "rows error")
 	}
-
-	slog.Info("database_list_complete", "image_count", len(images))
 	return images, nil
 }
 
 // Delete deletes an image by ID
 func (r *Repository) Delete(id int64) error {
+	return r.DeleteContext(context.Background(), id)
+}
+
+// DeleteContext is like Delete but honors ctx cancellation
+func (r *Repository) DeleteContext(ctx context.Context, id int64) error {
 	slog.Info("database_delete_image", "image_id", id)
 
 	query := `DELETE FROM images WHERE id = ?`
-	_, err := r.db.Exec(query, id)
+	_, err := r.db.ExecContext(ctx, query, id)
 	if err != nil {
 		slog.Error("database_delete_failed", "image_id", id, "error", err)
 		return errors.Wrap(err, "failed to delete image")
@@ -220,33 +568,143 @@ func (r *Repository) Delete(id int64) error {
 
 // AllocateNextDeviceID returns the next available device ID for both base devices and snapshots
 func (r *Repository) AllocateNextDeviceID(ctx context.Context) (int, error) {
+	nextID, err := r.reserveDeviceIDs(ctx, 1)
+	if err != nil {
+		return 0, err
+	}
+
+	slog.Info("allocated_device_id", "device_id", nextID, "next_available", nextID+1)
+	return nextID, nil
+}
+
+// reserveDeviceIDs atomically reserves count consecutive device IDs and
+// returns the first. The increment and read happen in a single statement,
+// so concurrent writers never observe the same range.
+func (r *Repository) reserveDeviceIDs(ctx context.Context, count int) (int, error) {
+	var first int
+	query := `
+		UPDATE device_sequence SET next_device_id = next_device_id + ?
+		WHERE id = 1
+		RETURNING next_device_id - ?
+	`
+	if err := r.db.QueryRowContext(ctx, query, count, count).Scan(&first); err != nil {
+		slog.Error("failed_to_update_device_sequence", "count", count, "error", err)
+		return 0, errors.Wrap(err, "failed to update device sequence")
+	}
+	return first, nil
+}
+
+// RepairDeviceSequence moves the device sequence past every device and
+// snapshot ID recorded on images and clones, recreating its row if it is
+// missing, and returns the next ID it will hand out. The sequence never
+// moves backwards: IDs above the highest recorded one may be reserved by
+// a running allocator.
+func (r *Repository) RepairDeviceSequence(ctx context.Context) (int, error) {
 	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
-		slog.Error("failed_to_begin_transaction", "error", err)
 		return 0, errors.Wrap(err, "failed to begin transaction")
 	}
 	defer tx.Rollback()
 
-	var nextID int
-	query := "SELECT next_device_id FROM device_sequence WHERE id = 1"
-	err = tx.QueryRowContext(ctx, query).Scan(&nextID)
-	if err != nil {
-		slog.Error("failed_to_query_device_sequence", "error", err)
-		return 0, errors.Wrap(err, "failed to query device sequence")
+	var maxID int
+	query := `
+		SELECT MAX(
+			(SELECT COALESCE(MAX(base_device_id), 0) FROM images),
+			(SELECT COALESCE(MAX(snapshot_id), 0) FROM images),
+			(SELECT COALESCE(MAX(device_id), 0) FROM clones)
+		)
+	`
+	if err := tx.QueryRowContext(ctx, query).Scan(&maxID); err != nil {
+		return 0, errors.Wrap(err, "failed to find highest device ID")
 	}
 
-	updateQuery := "UPDATE device_sequence SET next_device_id = ? WHERE id = 1"
-	_, err = tx.ExecContext(ctx, updateQuery, nextID+1)
-	if err != nil {
-		slog.Error("failed_to_update_device_sequence", "error", err)
+	var next int
+	query = `
+		INSERT INTO device_sequence (id, next_device_id) VALUES (1, ?)
+		ON CONFLICT(id) DO UPDATE SET next_device_id = MAX(next_device_id, excluded.next_device_id)
+		RETURNING next_device_id
+	`
+	if err := tx.QueryRowContext(ctx, query, maxID+1).Scan(&next); err != nil {
 		return 0, errors.Wrap(err, "failed to update device sequence")
 	}
 
 	if err := tx.Commit(); err != nil {
-		slog.Error("failed_to_commit_transaction", "error", err)
-		return 0, errors.Wrap(err, "failed to commit transaction")
+		return 0, errors.Wrap(err, "failed to commit device sequence repair")
 	}
 
-	slog.Info("allocated_device_id", "device_id", nextID, "next_available", nextID+1)
-	return nextID, nil
+	slog.Info("device_sequence_repaired", "max_device_id", maxID, "next_device_id", next)
+	return next, nil
+}
+
+// CreateClone inserts a new clone record
+func (r *Repository) CreateClone(clone *Clone) error {
+	return r.CreateCloneContext(context.Background(), clone)
+}
+
+// CreateCloneContext is like CreateClone but honors ctx cancellation
+func (r *Repository) CreateCloneContext(ctx context.Context, clone *Clone) error {
+	slog.Info("database_create_clone", "image_id", clone.ImageID, "device_id", clone.DeviceID, "source_snapshot_id", clone.SourceSnapshotID)
+
+	query := `
+		INSERT INTO clones (image_id, device_id, source_snapshot_id, device_path, created_at)
+		VALUES (?, ?, ?, ?, ?)
+	`
+	result, err := r.db.ExecContext(ctx, query, clone.ImageID, clone.DeviceID, clone.SourceSnapshotID, clone.DevicePath, r.now())
+	if err != nil {
+		slog.Error("database_clone_insert_failed", "image_id", clone.ImageID, "device_id", clone.DeviceID, "error", err)
+		return errors.Wrap(err, "failed to insert clone")
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		slog.Error("database_last_insert_id_failed", "image_id", clone.ImageID, "error", err)
+		return errors.Wrap(err, "failed to get last insert id")
+	}
+	clone.ID = id
+
+	slog.Info("database_clone_created", "clone_id", clone.ID, "image_id", clone.ImageID, "device_id", clone.DeviceID)
+	return nil
+}
+
+// ListClones retrieves all clones of an image
+func (r *Repository) ListClones(imageID int64) ([]*Clone, error) {
+	return r.ListClonesContext(context.Background(), imageID)
+}
+
+// ListClonesContext is like ListClones but honors ctx cancellation
+func (r *Repository) ListClonesContext(ctx context.Context, imageID int64) ([]*Clone, error) {
+	slog.Info("database_list_clones", "image_id", imageID)
+
+	query := `
+		SELECT id, image_id, device_id, source_snapshot_id, device_path, created_at
+		FROM clones WHERE image_id = ? ORDER BY device_id
+	`
+	rows, err := r.db.QueryContext(ctx, query, imageID)
+	if err != nil {
+		slog.Error("database_list_clones_failed", "image_id", imageID, "error", err)
+		return nil, errors.Wrap(err, "failed to list clones")
+	}
+	defer rows.Close()
+
+	var clones []*Clone
+	for rows.Next() {
+		var clone Clone
+		var devicePath sql.NullString
+
+		if err := rows.Scan(&clone.ID, &clone.ImageID, &clone.DeviceID, &clone.SourceSnapshotID, &devicePath, &clone.CreatedAt); err != nil {
+			slog.Error("database_scan_row_failed", "error", err)
+			return nil, errors.Wrap(err, "failed to scan row")
+		}
+		clone.DevicePath = devicePath.String
+
+		clones = append(clones, &clone)
+	}
+
+	if err := rows.Err(); err != nil {
+		slog.Error("database_rows_error", "error", err)
+		return nil, errors.Wrap(err, "rows error")
+	}
+
+	slog.Info("database_list_clones_complete", "image_id", imageID, "clone_count", len(clones))
+	return clones, nil
 }
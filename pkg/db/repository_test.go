@@ -1,10 +1,46 @@
 package db
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"os"
+	"strconv"
+	"sync"
 	"testing"
 )
 
+func TestNewInMemoryRepository_Isolated(t *testing.T) {
+	ctx := context.Background()
+
+	a, err := NewInMemoryRepository()
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer a.Close()
+	b, err := NewInMemoryRepository()
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer b.Close()
+
+	img := &Image{S3Key: "images/alpine.tar", Status: StatusPending}
+	if err := a.CreateContext(ctx, img); err != nil {
+		t.Fatalf("failed to create image: %v", err)
+	}
+	// Later statements must see the same database, not a fresh one
+	if _, err := a.IncrementAttemptsContext(ctx, img.ID); err != nil {
+		t.Fatalf("failed to increment attempts: %v", err)
+	}
+	if got, err := a.GetByS3KeyContext(ctx, img.S3Key); err != nil || got == nil || got.Attempts != 1 {
+		t.Errorf("GetByS3Key = %+v, %v; want the image with 1 attempt", got, err)
+	}
+
+	if got, err := b.GetByS3KeyContext(ctx, img.S3Key); err != nil || got != nil {
+		t.Errorf("second in-memory repository sees %+v, %v; want empty", got, err)
+	}
+}
+
 func TestRepository_CreateAndGet(t *testing.T) {
 	dbPath := "/tmp/test_images.db"
 	os.Remove(dbPath)
@@ -87,3 +123,511 @@ func TestRepository_List(t *testing.T) {
 		t.Errorf("expected 2 images, got %d", len(images))
 	}
 }
+
+func TestRepository_AllocateNextDeviceID(t *testing.T) {
+	dbPath := "/tmp/test_images4.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	repo, err := NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	ctx := context.Background()
+	for want := 1; want <= 3; want++ {
+		got, err := repo.AllocateNextDeviceID(ctx)
+		if err != nil {
+			t.Fatalf("failed to allocate device ID: %v", err)
+		}
+		if got != want {
+			t.Errorf("allocated device ID %d, want %d", got, want)
+		}
+	}
+}
+
+func TestRepository_RepairDeviceSequence(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup string // SQL run on the seeded database before repairing
+		want  int
+	}{
+		{name: "sequence behind recorded IDs", want: 58},
+		{name: "sequence row missing", setup: "DELETE FROM device_sequence", want: 58},
+		{name: "sequence already ahead", setup: "UPDATE device_sequence SET next_device_id = 100", want: 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dbPath := "/tmp/test_images_sequence.db"
+			os.Remove(dbPath)
+			defer os.Remove(dbPath)
+
+			repo, err := NewRepository(dbPath)
+			if err != nil {
+				t.Fatalf("failed to create repository: %v", err)
+			}
+			defer repo.Close()
+
+			// IDs recorded without going through the sequence, as after
+			// an import into a fresh database
+			img := &Image{S3Key: "image1.tar", Status: StatusReady, BaseDeviceID: 40, SnapshotID: 41}
+			if err := repo.Create(img); err != nil {
+				t.Fatalf("failed to create image: %v", err)
+			}
+			if err := repo.CreateClone(&Clone{ImageID: img.ID, DeviceID: 57, SourceSnapshotID: 41}); err != nil {
+				t.Fatalf("failed to create clone: %v", err)
+			}
+			if tt.setup != "" {
+				if _, err := repo.db.Exec(tt.setup); err != nil {
+					t.Fatalf("setup failed: %v", err)
+				}
+			}
+
+			ctx := context.Background()
+			next, err := repo.RepairDeviceSequence(ctx)
+			if err != nil {
+				t.Fatalf("RepairDeviceSequence failed: %v", err)
+			}
+			if next != tt.want {
+				t.Errorf("RepairDeviceSequence = %d, want %d", next, tt.want)
+			}
+			if got, err := repo.AllocateNextDeviceID(ctx); err != nil || got != tt.want {
+				t.Errorf("next allocation = %d, %v; want %d", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRepository_Clones(t *testing.T) {
+	dbPath := "/tmp/test_images5.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	repo, err := NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	img := &Image{S3Key: "image1.tar", SHA256: "hash1", Status: StatusReady, SnapshotID: 2}
+	if err := repo.Create(img); err != nil {
+		t.Fatalf("failed to create image: %v", err)
+	}
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		deviceID, err := repo.AllocateNextDeviceID(ctx)
+		if err != nil {
+			t.Fatalf("failed to allocate device ID: %v", err)
+		}
+		clone := &Clone{
+			ImageID:          img.ID,
+			DeviceID:         deviceID,
+			SourceSnapshotID: img.SnapshotID,
+			DevicePath:       "/dev/mapper/flyio-snapshot-" + strconv.Itoa(deviceID),
+		}
+		if err := repo.CreateClone(clone); err != nil {
+			t.Fatalf("failed to create clone: %v", err)
+		}
+		if clone.ID == 0 {
+			t.Error("clone ID should be set after create")
+		}
+	}
+
+	clones, err := repo.ListClones(img.ID)
+	if err != nil {
+		t.Fatalf("failed to list clones: %v", err)
+	}
+	if len(clones) != 2 {
+		t.Fatalf("expected 2 clones, got %d", len(clones))
+	}
+	if clones[0].DeviceID == clones[1].DeviceID {
+		t.Errorf("clones share device ID %d", clones[0].DeviceID)
+	}
+	for _, c := range clones {
+		if c.SourceSnapshotID != img.SnapshotID {
+			t.Errorf("clone source snapshot %d, want %d", c.SourceSnapshotID, img.SnapshotID)
+		}
+	}
+
+	// Device IDs are unique across clones
+	dup := &Clone{ImageID: img.ID, DeviceID: clones[0].DeviceID, SourceSnapshotID: img.SnapshotID}
+	if err := repo.CreateClone(dup); err == nil {
+		t.Error("expected error for duplicate clone device ID")
+	}
+}
+
+func TestRepository_ETagRoundTrip(t *testing.T) {
+	dbPath := "/tmp/test_images6.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	repo, err := NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	img := &Image{
+		S3Key:        "image1.tar",
+		SHA256:       "hash1",
+		Status:       StatusPending,
+		ETag:         "d41d8cd98f00b204e9800998ecf8427e",
+		LastModified: "2025-01-02T03:04:05Z",
+	}
+	if err := repo.Create(img); err != nil {
+		t.Fatalf("failed to create image: %v", err)
+	}
+
+	got, err := repo.GetByS3Key("image1.tar")
+	if err != nil {
+		t.Fatalf("failed to get image: %v", err)
+	}
+	if got.ETag != img.ETag || got.LastModified != img.LastModified {
+		t.Errorf("metadata mismatch after create: got etag=%q last_modified=%q", got.ETag, got.LastModified)
+	}
+
+	got.ETag = "9e107d9d372bb6826bd81d3542a419d6-2"
+	if err := repo.Update(got); err != nil {
+		t.Fatalf("failed to update image: %v", err)
+	}
+
+	updated, err := repo.GetByS3Key("image1.tar")
+	if err != nil {
+		t.Fatalf("failed to get image: %v", err)
+	}
+	if updated.ETag != got.ETag {
+		t.Errorf("etag not updated: got %q, want %q", updated.ETag, got.ETag)
+	}
+}
+
+func TestNewRepository_AddsMissingColumns(t *testing.T) {
+	dbPath := "/tmp/test_images7.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	// Create a database with the original images table (no etag columns)
+	old, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	_, err = old.Exec(`
+		CREATE TABLE images (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			s3_key TEXT NOT NULL UNIQUE,
+			sha256 TEXT NOT NULL,
+			status TEXT NOT NULL,
+			device_path TEXT,
+			base_device_id INTEGER,
+			snapshot_id INTEGER,
+			error_message TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+		INSERT INTO images (s3_key, sha256, status) VALUES ('old.tar', 'hash', 'ready');
+	`)
+	old.Close()
+	if err != nil {
+		t.Fatalf("failed to create old schema: %v", err)
+	}
+
+	repo, err := NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to open old database: %v", err)
+	}
+	defer repo.Close()
+
+	img, err := repo.GetByS3Key("old.tar")
+	if err != nil {
+		t.Fatalf("failed to get existing image: %v", err)
+	}
+	if img == nil || img.ETag != "" {
+		t.Fatalf("expected existing image with empty etag, got %+v", img)
+	}
+
+	img.ETag = "abc"
+	if err := repo.Update(img); err != nil {
+		t.Fatalf("failed to update image on migrated database: %v", err)
+	}
+}
+
+func TestNewRepository_MigratesOldDatabaseIdempotently(t *testing.T) {
+	dbPath := "/tmp/test_images8.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	// Create a database the way versions before migrations did
+	old, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	if _, err := old.Exec(initialSchema); err != nil {
+		old.Close()
+		t.Fatalf("failed to create old schema: %v", err)
+	}
+	if _, err := old.Exec(`INSERT INTO images (s3_key, sha256, status) VALUES ('old.tar', 'hash', 'ready')`); err != nil {
+		old.Close()
+		t.Fatalf("failed to seed old database: %v", err)
+	}
+	old.Close()
+
+	// Opening twice must apply every migration exactly once
+	for i := 0; i < 2; i++ {
+		repo, err := NewRepository(dbPath)
+		if err != nil {
+			t.Fatalf("open %d: failed to migrate old database: %v", i, err)
+		}
+
+		var count, maxVersion int
+		err = repo.db.QueryRow("SELECT COUNT(*), MAX(version) FROM schema_migrations").Scan(&count, &maxVersion)
+		if err != nil {
+			repo.Close()
+			t.Fatalf("open %d: failed to query schema_migrations: %v", i, err)
+		}
+		if count != len(Migrations) || maxVersion != Migrations[len(Migrations)-1].Version {
+			t.Errorf("open %d: got %d migrations up to version %d, want %d", i, count, maxVersion, len(Migrations))
+		}
+
+		img, err := repo.GetByS3Key("old.tar")
+		if err != nil || img == nil {
+			t.Errorf("open %d: existing image lost after migration: %v", i, err)
+		}
+		repo.Close()
+	}
+}
+
+func TestNewRepository_ConcurrentMigrations(t *testing.T) {
+	dbPath := "/tmp/test_images_concurrent_migrate.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	// Each repository has its own connections, as separate processes do
+	const opens = 8
+	errs := make(chan error, opens)
+	var wg sync.WaitGroup
+	for i := 0; i < opens; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			repo, err := NewRepository(dbPath)
+			if err == nil {
+				repo.Close()
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("concurrent open failed: %v", err)
+		}
+	}
+}
+
+func TestApplyMigration_SkipsRecordedVersion(t *testing.T) {
+	repo, err := NewInMemoryRepository()
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	// Recorded by another process after this one listed what was pending
+	last := Migrations[len(Migrations)-1]
+	rerun := Migration{Version: last.Version, Name: last.Name, Up: func(tx *sql.Tx) error {
+		return errors.New("migration ran twice")
+	}}
+	if err := applyMigration(repo.db, rerun); err != nil {
+		t.Errorf("applyMigration of a recorded version: %v", err)
+	}
+}
+
+func TestRepository_ContextCancelled(t *testing.T) {
+	dbPath := "/tmp/test_images9.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	repo, err := NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := repo.GetByS3KeyContext(ctx, "image1.tar"); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetByS3KeyContext: expected context.Canceled, got %v", err)
+	}
+	if err := repo.CreateContext(ctx, &Image{S3Key: "image1.tar", Status: StatusPending}); !errors.Is(err, context.Canceled) {
+		t.Errorf("CreateContext: expected context.Canceled, got %v", err)
+	}
+	if _, err := repo.ListContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("ListContext: expected context.Canceled, got %v", err)
+	}
+}
+
+func TestRepository_Reset(t *testing.T) {
+	dbPath := "/tmp/test_images10.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	repo, err := NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	img := &Image{
+		S3Key:        "image1.tar",
+		SHA256:       "sha256:abc123",
+		Status:       StatusFailed,
+		DevicePath:   "/dev/mapper/flyio-snapshot-2",
+		BaseDeviceID: 1,
+		SnapshotID:   2,
+		ErrorMessage: "device creation failed",
+		ETag:         "etag-1",
+		LastModified: "2024-01-01T00:00:00Z",
+		DownloadSize: 1024,
+	}
+	if err := repo.Create(img); err != nil {
+		t.Fatalf("failed to create image: %v", err)
+	}
+
+	if err := repo.Reset(img.ID); err != nil {
+		t.Fatalf("Reset failed: %v", err)
+	}
+
+	got, err := repo.GetByS3Key("image1.tar")
+	if err != nil || got == nil {
+		t.Fatalf("failed to get image: %v", err)
+	}
+	if got.Status != StatusPending {
+		t.Errorf("Status = %q, want %q", got.Status, StatusPending)
+	}
+	if got.SHA256 != "" || got.DevicePath != "" || got.BaseDeviceID != 0 || got.SnapshotID != 0 ||
+		got.ErrorMessage != "" || got.ETag != "" || got.LastModified != "" || got.DownloadSize != 0 {
+		t.Errorf("expected all derived fields cleared, got %+v", got)
+	}
+
+	if err := repo.Reset(img.ID + 100); err == nil {
+		t.Error("expected error resetting a missing image")
+	}
+}
+
+func TestRepository_Ping(t *testing.T) {
+	dbPath := "/tmp/test_images_ping.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	repo, err := NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	ctx := context.Background()
+	if err := repo.Ping(ctx); err != nil {
+		t.Errorf("Ping on an open database failed: %v", err)
+	}
+
+	repo.Close()
+	if err := repo.Ping(ctx); err == nil {
+		t.Error("Ping on a closed database succeeded")
+	}
+
+	// sql.Open is lazy, so an unopenable path only fails once used
+	unopenable, err := sql.Open("sqlite", "/nonexistent/dir/images.db")
+	if err != nil {
+		t.Fatalf("sql.Open failed: %v", err)
+	}
+	defer unopenable.Close()
+	if err := (&Repository{db: unopenable}).Ping(ctx); err == nil {
+		t.Error("Ping on an unopenable database succeeded")
+	}
+}
+
+func TestRepository_HostScopedQueries(t *testing.T) {
+	ctx := context.Background()
+	dbPath := "/tmp/test_images_hosts.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	hostA, err := NewRepository(dbPath, WithHost("host-a"))
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer hostA.Close()
+	hostB, err := NewRepository(dbPath, WithHost("host-b"))
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer hostB.Close()
+
+	alpine := &Image{S3Key: "images/alpine.tar", Status: StatusReady}
+	if err := hostA.CreateContext(ctx, alpine); err != nil {
+		t.Fatalf("failed to create image: %v", err)
+	}
+	debian := &Image{S3Key: "images/debian.tar", Status: StatusPending}
+	if err := hostA.CreateContext(ctx, debian); err != nil {
+		t.Fatalf("failed to create image: %v", err)
+	}
+	if alpine.Host != "host-a" {
+		t.Errorf("created image host = %q, want host-a", alpine.Host)
+	}
+
+	// Host B takes over the pending image and builds its device
+	debian.Status, debian.DevicePath = StatusReady, "/dev/mapper/flyio-7"
+	if err := hostB.UpdateContext(ctx, debian); err != nil {
+		t.Fatalf("failed to update image: %v", err)
+	}
+
+	for host, want := range map[string]string{"host-a": "images/alpine.tar", "host-b": "images/debian.tar"} {
+		images, err := hostA.ListByHostContext(ctx, host)
+		if err != nil {
+			t.Fatalf("ListByHost(%s): %v", host, err)
+		}
+		if len(images) != 1 || images[0].S3Key != want || images[0].Host != host {
+			t.Errorf("ListByHost(%s) = %+v, want only %s", host, images, want)
+		}
+	}
+	if images, err := hostA.ListByHostContext(ctx, "host-c"); err != nil || len(images) != 0 {
+		t.Errorf("ListByHost(host-c) = %v, %v; want none", images, err)
+	}
+
+	dump, err := hostA.ExportContext(ctx)
+	if err != nil {
+		t.Fatalf("export failed: %v", err)
+	}
+	imported, err := NewInMemoryRepository(WithHost("host-c"))
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer imported.Close()
+	if _, err := imported.ImportContext(ctx, dump, ConflictSkip); err != nil {
+		t.Fatalf("import failed: %v", err)
+	}
+	if images, err := imported.ListByHostContext(ctx, "host-b"); err != nil || len(images) != 1 {
+		t.Errorf("imported ListByHost(host-b) = %v, %v; want the dumped host kept", images, err)
+	}
+}
+
+func TestNewRepository_DefaultsHostToHostname(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Skipf("no hostname: %v", err)
+	}
+	repo, err := NewInMemoryRepository(WithHost(""))
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	img := &Image{S3Key: "images/alpine.tar", Status: StatusPending}
+	if err := repo.Create(img); err != nil {
+		t.Fatalf("failed to create image: %v", err)
+	}
+	got, err := repo.GetByS3Key(img.S3Key)
+	if err != nil || got == nil || got.Host != hostname {
+		t.Errorf("GetByS3Key = %+v, %v; want host %q", got, err, hostname)
+	}
+}
@@ -1,9 +1,11 @@
 package db
 
-// Schema defines the SQLite database schema for container images.
+import "database/sql"
+
+// initialSchema defines the original SQLite database schema for container images.
 // It creates the images table with indexes for efficient querying,
 // and device_sequence for unified device ID allocation.
-const Schema = `
+const initialSchema = `
 CREATE TABLE IF NOT EXISTS images (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     s3_key TEXT NOT NULL UNIQUE,
@@ -29,6 +31,103 @@ CREATE TABLE IF NOT EXISTS device_sequence (
 INSERT OR IGNORE INTO device_sequence (id, next_device_id) VALUES (1, 1);
 `
 
+// clonesSchema tracks writable snapshots taken from an image's activated snapshot
+const clonesSchema = `
+CREATE TABLE IF NOT EXISTS clones (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    image_id INTEGER NOT NULL REFERENCES images(id) ON DELETE CASCADE,
+    device_id INTEGER NOT NULL UNIQUE,
+    source_snapshot_id INTEGER NOT NULL,
+    device_path TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_clones_image_id ON clones(image_id);
+`
+
+// locksSchema holds per-key advisory locks so only one process works on
+// an image at a time. acquired_at is unix seconds, for staleness checks,
+// and is refreshed while the lock is held. Migration 13 adds the holder's
+// host.
+const locksSchema = `
+CREATE TABLE IF NOT EXISTS locks (
+    key TEXT PRIMARY KEY,
+    pid INTEGER NOT NULL,
+    acquired_at INTEGER NOT NULL
+);
+`
+
+// labelsSchema stores free-form key=value labels, one value per key per image
+const labelsSchema = `
+CREATE TABLE IF NOT EXISTS image_labels (
+    image_id INTEGER NOT NULL REFERENCES images(id) ON DELETE CASCADE,
+    key TEXT NOT NULL,
+    value TEXT NOT NULL,
+    PRIMARY KEY (image_id, key)
+);
+
+CREATE INDEX IF NOT EXISTS idx_image_labels_key_value ON image_labels(key, value);
+`
+
+// packagesSchema records the OS packages found in each image by the scan state
+const packagesSchema = `
+CREATE TABLE IF NOT EXISTS packages (
+    image_id INTEGER NOT NULL REFERENCES images(id) ON DELETE CASCADE,
+    manager TEXT NOT NULL,
+    name TEXT NOT NULL,
+    version TEXT NOT NULL,
+    architecture TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY (image_id, manager, name, architecture)
+);
+
+CREATE INDEX IF NOT EXISTS idx_packages_name ON packages(name, version);
+`
+
+// Migrations is the ordered list of schema changes. Versions must be unique
+// and increasing; applied versions are recorded in schema_migrations.
+// Never edit a released migration - append a new one instead.
+var Migrations = []Migration{
+	{Version: 1, Name: "initial_schema", Up: execSQL(initialSchema)},
+	{Version: 2, Name: "clones", Up: execSQL(clonesSchema)},
+	{Version: 3, Name: "image_object_metadata", Up: addColumns("images",
+		Column{Name: "etag", Definition: "TEXT"},
+		Column{Name: "last_modified", Definition: "TEXT"},
+	)},
+	{Version: 4, Name: "locks", Up: execSQL(locksSchema)},
+	{Version: 5, Name: "image_labels", Up: execSQL(labelsSchema)},
+	{Version: 6, Name: "image_download_size", Up: addColumns("images",
+		Column{Name: "download_size", Definition: "INTEGER NOT NULL DEFAULT 0"},
+	)},
+	{Version: 7, Name: "packages", Up: execSQL(packagesSchema)},
+	{Version: 8, Name: "image_attempts", Up: addColumns("images",
+		Column{Name: "attempts", Definition: "INTEGER NOT NULL DEFAULT 0"},
+	)},
+	{Version: 9, Name: "snapshot_active", Up: func(tx *sql.Tx) error {
+		if err := addColumns("images",
+			Column{Name: "snapshot_active", Definition: "INTEGER NOT NULL DEFAULT 0"},
+		)(tx); err != nil {
+			return err
+		}
+		// Snapshots were always left active when they were created
+		return execSQL(`UPDATE images SET snapshot_active = 1 WHERE status = 'ready' AND snapshot_id > 0`)(tx)
+	}},
+	{Version: 10, Name: "image_tree_hash", Up: addColumns("images",
+		Column{Name: "tree_hash", Definition: "TEXT"},
+	)},
+	{Version: 11, Name: "image_download_compression", Up: addColumns("images",
+		Column{Name: "download_compression", Definition: "TEXT"},
+	)},
+	{Version: 12, Name: "image_host", Up: addColumns("images",
+		Column{Name: "host", Definition: "TEXT"},
+	)},
+	{Version: 13, Name: "lock_host", Up: addColumns("locks",
+		Column{Name: "host", Definition: "TEXT NOT NULL DEFAULT ''"},
+	)},
+	{Version: 14, Name: "image_extract_subpath", Up: addColumns("images",
+		Column{Name: "extract_subpath", Definition: "TEXT"},
+	)},
+}
+
 // Status constants
 const (
 	StatusPending     = "pending"
@@ -37,16 +136,56 @@ const (
 	StatusFailed      = "failed"
 )
 
+// Statuses lists every image status, in pipeline order
+var Statuses = []string{StatusPending, StatusDownloading, StatusReady, StatusFailed}
+
 // Image represents a container image record
 type Image struct {
 	ID           int64
 	S3Key        string
-	SHA256       string
+	SHA256       string // algorithm-prefixed digest; unprefixed values are SHA256
 	Status       string
 	DevicePath   string
 	BaseDeviceID int
 	SnapshotID   int
 	ErrorMessage string
-	CreatedAt    string
-	UpdatedAt    string
+	ETag         string
+	LastModified string
+	DownloadSize int64 // bytes of the downloaded tarball
+	Attempts     int   // fetch runs that have processed this image
+	// SnapshotActive reports whether the snapshot is mapped under /dev/mapper
+	SnapshotActive bool
+	// TreeHash is the digest of the extracted tree, for tamper detection
+	TreeHash string
+	// DownloadCompression is how the kept download is compressed on disk:
+	// "" when stored as downloaded, or storage.CompressionZstd
+	DownloadCompression string
+	// ExtractSubpath is the directory of the tarball the image was
+	// extracted from (fetch --strip-prefix), "" for the whole tarball
+	ExtractSubpath string
+	// Host is the host that last created or updated the record, where
+	// its device paths are valid; "" for records written before hosts
+	// were tracked
+	Host      string
+	CreatedAt string
+	UpdatedAt string
+}
+
+// Package is an OS package found installed in an image
+type Package struct {
+	ImageID      int64
+	Manager      string // dpkg, apk
+	Name         string
+	Version      string
+	Architecture string
+}
+
+// Clone represents a writable snapshot taken from an image's snapshot
+type Clone struct {
+	ID               int64
+	ImageID          int64
+	DeviceID         int
+	SourceSnapshotID int
+	DevicePath       string
+	CreatedAt        string
 }
@@ -0,0 +1,134 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+
+	"github.com/fly-io/162719/pkg/errors"
+)
+
+// Stats summarizes the image population
+type Stats struct {
+	TotalImages        int            `json:"total_images"`
+	ByStatus           map[string]int `json:"by_status"`
+	TotalDownloadBytes int64          `json:"total_download_bytes"`
+	ActiveDevices      int            `json:"active_devices"`
+	ActiveSnapshots    int            `json:"active_snapshots"`
+	Clones             int            `json:"clones"`
+	// AvgReadySeconds is the mean time from record creation to the last
+	// update of ready images; zero when no image is ready
+	AvgReadySeconds float64 `json:"avg_ready_seconds"`
+}
+
+// Stats aggregates image counts and sizes in the database
+func (r *Repository) Stats() (*Stats, error) {
+	return r.StatsContext(context.Background())
+}
+
+// StatsContext is like Stats but honors ctx cancellation
+func (r *Repository) StatsContext(ctx context.Context) (*Stats, error) {
+	slog.Info("database_stats")
+
+	byStatus, err := r.CountByStatusContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stats := &Stats{ByStatus: byStatus}
+	for _, count := range byStatus {
+		stats.TotalImages += count
+	}
+
+	var avgReady sql.NullFloat64
+	query := `
+		SELECT COALESCE(SUM(download_size), 0),
+		       COUNT(CASE WHEN base_device_id > 0 THEN 1 END),
+		       COUNT(CASE WHEN snapshot_id > 0 THEN 1 END),
+		       AVG(CASE WHEN status = ? THEN
+		           (julianday(updated_at) - julianday(created_at)) * 86400 END),
+		       (SELECT COUNT(*) FROM clones)
+		FROM images
+	`
+	err = r.db.QueryRowContext(ctx, query, StatusReady).Scan(
+		&stats.TotalDownloadBytes, &stats.ActiveDevices, &stats.ActiveSnapshots,
+		&avgReady, &stats.Clones)
+	if err != nil {
+		slog.Error("database_stats_failed", "error", err)
+		return nil, errors.Wrap(err, "failed to aggregate images")
+	}
+	stats.AvgReadySeconds = avgReady.Float64
+
+	slog.Info("database_stats_complete", "total_images", stats.TotalImages)
+	return stats, nil
+}
+
+// CountByStatus returns the number of images in each status with a single
+// aggregate query. Every known status has an entry, zero if no image is in it.
+func (r *Repository) CountByStatus() (map[string]int, error) {
+	return r.CountByStatusContext(context.Background())
+}
+
+// CountByStatusContext is like CountByStatus but honors ctx cancellation
+func (r *Repository) CountByStatusContext(ctx context.Context) (map[string]int, error) {
+	counts := make(map[string]int, len(Statuses))
+	for _, status := range Statuses {
+		counts[status] = 0
+	}
+
+	rows, err := r.db.QueryContext(ctx, `SELECT status, COUNT(*) FROM images GROUP BY status`)
+	if err != nil {
+		slog.Error("database_count_by_status_failed", "error", err)
+		return nil, errors.Wrap(err, "failed to count images by status")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var status string
+		var count int
+		if err := rows.Scan(&status, &count); err != nil {
+			slog.Error("database_scan_row_failed", "error", err)
+			return nil, errors.Wrap(err, "failed to scan row")
+		}
+		counts[status] = count
+	}
+	if err := rows.Err(); err != nil {
+		slog.Error("database_rows_error", "error", err)
+		return nil, errors.Wrap(err, "rows error")
+	}
+
+	return counts, nil
+}
+
+// TotalDownloadedBytes sums the download size of all ready images, an
+// estimate of the disk their extracted trees occupy on this host
+func (r *Repository) TotalDownloadedBytes() (int64, error) {
+	return r.TotalDownloadedBytesContext(context.Background())
+}
+
+// TotalDownloadedBytesContext is like TotalDownloadedBytes but honors ctx cancellation
+func (r *Repository) TotalDownloadedBytesContext(ctx context.Context) (int64, error) {
+	var total int64
+	query := `SELECT COALESCE(SUM(download_size), 0) FROM images WHERE status = ?`
+	if err := r.db.QueryRowContext(ctx, query, StatusReady).Scan(&total); err != nil {
+		slog.Error("database_sum_download_size_failed", "error", err)
+		return 0, errors.Wrap(err, "failed to sum download sizes")
+	}
+	return total, nil
+}
+
+// CountByTree counts the images other than excludeID that were extracted
+// from digest at subpath, and so share its extracted tree
+func (r *Repository) CountByTree(digest, subpath string, excludeID int64) (int, error) {
+	return r.CountByTreeContext(context.Background(), digest, subpath, excludeID)
+}
+
+// CountByTreeContext is like CountByTree but honors ctx cancellation
+func (r *Repository) CountByTreeContext(ctx context.Context, digest, subpath string, excludeID int64) (int, error) {
+	var count int
+	query := `SELECT COUNT(*) FROM images WHERE sha256 = ? AND COALESCE(extract_subpath, '') = ? AND id != ?`
+	if err := r.db.QueryRowContext(ctx, query, digest, subpath, excludeID).Scan(&count); err != nil {
+		slog.Error("database_count_by_tree_failed", "digest", digest, "error", err)
+		return 0, errors.Wrap(err, "failed to count images sharing the tree")
+	}
+	return count, nil
+}
@@ -0,0 +1,158 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	dbPath := "/tmp/test_images_stats.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	repo, err := NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	// Empty database
+	stats, err := repo.Stats()
+	if err != nil {
+		t.Fatalf("Stats failed: %v", err)
+	}
+	if stats.TotalImages != 0 || stats.TotalDownloadBytes != 0 || stats.AvgReadySeconds != 0 {
+		t.Errorf("expected zero stats for empty database, got %+v", stats)
+	}
+
+	seed := []*Image{
+		{S3Key: "a.tar", Status: StatusReady, DownloadSize: 100, BaseDeviceID: 1, SnapshotID: 2},
+		{S3Key: "b.tar", Status: StatusReady, DownloadSize: 250, BaseDeviceID: 3, SnapshotID: 4},
+		{S3Key: "c.tar", Status: StatusFailed, DownloadSize: 50},
+		{S3Key: "d.tar", Status: StatusPending},
+	}
+	for _, img := range seed {
+		if err := repo.Create(img); err != nil {
+			t.Fatalf("failed to create image: %v", err)
+		}
+	}
+	if err := repo.CreateClone(&Clone{ImageID: seed[0].ID, DeviceID: 5, SourceSnapshotID: 2}); err != nil {
+		t.Fatalf("failed to create clone: %v", err)
+	}
+	// a.tar took 30s to become ready
+	if _, err := repo.db.Exec(`UPDATE images SET created_at = '2024-01-01 00:00:00', updated_at = '2024-01-01 00:00:30' WHERE s3_key = 'a.tar'`); err != nil {
+		t.Fatalf("failed to set timestamps: %v", err)
+	}
+	if _, err := repo.db.Exec(`UPDATE images SET created_at = '2024-01-01 00:00:00', updated_at = '2024-01-01 00:01:30' WHERE s3_key = 'b.tar'`); err != nil {
+		t.Fatalf("failed to set timestamps: %v", err)
+	}
+
+	stats, err = repo.Stats()
+	if err != nil {
+		t.Fatalf("Stats failed: %v", err)
+	}
+
+	if stats.TotalImages != 4 {
+		t.Errorf("TotalImages = %d, want 4", stats.TotalImages)
+	}
+	wantStatus := map[string]int{StatusReady: 2, StatusFailed: 1, StatusPending: 1}
+	for status, want := range wantStatus {
+		if got := stats.ByStatus[status]; got != want {
+			t.Errorf("ByStatus[%s] = %d, want %d", status, got, want)
+		}
+	}
+	if stats.TotalDownloadBytes != 400 {
+		t.Errorf("TotalDownloadBytes = %d, want 400", stats.TotalDownloadBytes)
+	}
+	if stats.ActiveDevices != 2 || stats.ActiveSnapshots != 2 {
+		t.Errorf("devices/snapshots = %d/%d, want 2/2", stats.ActiveDevices, stats.ActiveSnapshots)
+	}
+	if stats.Clones != 1 {
+		t.Errorf("Clones = %d, want 1", stats.Clones)
+	}
+	if stats.AvgReadySeconds < 59.9 || stats.AvgReadySeconds > 60.1 {
+		t.Errorf("AvgReadySeconds = %f, want 60", stats.AvgReadySeconds)
+	}
+}
+
+func TestCountByStatus(t *testing.T) {
+	dbPath := "/tmp/test_images_count.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	repo, err := NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	counts, err := repo.CountByStatus()
+	if err != nil {
+		t.Fatalf("CountByStatus failed: %v", err)
+	}
+	want := map[string]int{StatusPending: 0, StatusDownloading: 0, StatusReady: 0, StatusFailed: 0}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("empty database counts = %v, want %v", counts, want)
+	}
+
+	for i, status := range []string{StatusReady, StatusReady, StatusReady, StatusFailed, StatusPending, StatusPending} {
+		if err := repo.Create(&Image{S3Key: fmt.Sprintf("img-%d.tar", i), Status: status}); err != nil {
+			t.Fatalf("failed to create image: %v", err)
+		}
+	}
+
+	counts, err = repo.CountByStatus()
+	if err != nil {
+		t.Fatalf("CountByStatus failed: %v", err)
+	}
+	want = map[string]int{StatusPending: 2, StatusDownloading: 0, StatusReady: 3, StatusFailed: 1}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("counts = %v, want %v", counts, want)
+	}
+}
+
+func TestCountByTree(t *testing.T) {
+	dbPath := "/tmp/test_images_count_by_tree.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	repo, err := NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	seed := []*Image{
+		{S3Key: "a.tar", SHA256: "sha256:aaa", Status: StatusReady},
+		{S3Key: "b.tar", SHA256: "sha256:aaa", Status: StatusFailed},
+		{S3Key: "c.tar", SHA256: "sha256:aaa", Status: StatusReady, ExtractSubpath: "rootfs"},
+		{S3Key: "d.tar", SHA256: "sha256:bbb", Status: StatusReady},
+	}
+	for _, img := range seed {
+		if err := repo.Create(img); err != nil {
+			t.Fatalf("failed to create image: %v", err)
+		}
+	}
+
+	tests := []struct {
+		digest, subpath string
+		exclude         int64
+		want            int
+	}{
+		{digest: "sha256:aaa", exclude: seed[0].ID, want: 1},
+		{digest: "sha256:aaa", subpath: "rootfs", exclude: seed[2].ID, want: 0},
+		{digest: "sha256:aaa", subpath: "rootfs", exclude: seed[0].ID, want: 1},
+		{digest: "sha256:bbb", exclude: seed[3].ID, want: 0},
+	}
+	for _, tt := range tests {
+		got, err := repo.CountByTree(tt.digest, tt.subpath, tt.exclude)
+		if err != nil {
+			t.Fatalf("CountByTree failed: %v", err)
+		}
+		if got != tt.want {
+			t.Errorf("CountByTree(%s, %q, %d) = %d, want %d", tt.digest, tt.subpath, tt.exclude, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package devicemapper
+
+import "fmt"
+
+// SnapshotSpec names one snapshot of a CreateSnapshots batch
+type SnapshotSpec struct {
+	// SourceID is the base device or snapshot to snapshot
+	SourceID   string
+	SnapshotID int
+}
+
+// snapshotGroup is the specs of a batch that share a source, by index
+type snapshotGroup struct {
+	sourceID string
+	indices  []int
+}
+
+// groupSnapshotSpecs groups specs by source in first-seen order, so each
+// origin is suspended once per batch rather than once per snapshot. A
+// spec without a source or snapshot ID, or repeating an earlier spec's
+// snapshot ID, is left out and gets an error at its index instead.
+func groupSnapshotSpecs(specs []SnapshotSpec) ([]snapshotGroup, []error) {
+	errs := make([]error, len(specs))
+	var groups []snapshotGroup
+	bySource := make(map[string]int)
+	seen := make(map[int]bool)
+
+	for i, spec := range specs {
+		switch {
+		case spec.SourceID == "":
+			errs[i] = fmt.Errorf("snapshot %d has no source", spec.SnapshotID)
+			continue
+		case spec.SnapshotID <= 0:
+			errs[i] = fmt.Errorf("invalid snapshot ID %d", spec.SnapshotID)
+			continue
+		case seen[spec.SnapshotID]:
+			errs[i] = fmt.Errorf("snapshot %d appears more than once in the batch", spec.SnapshotID)
+			continue
+		}
+		seen[spec.SnapshotID] = true
+
+		g, ok := bySource[spec.SourceID]
+		if !ok {
+			g = len(groups)
+			bySource[spec.SourceID] = g
+			groups = append(groups, snapshotGroup{sourceID: spec.SourceID})
+		}
+		groups[g].indices = append(groups[g].indices, i)
+	}
+	return groups, errs
+}
@@ -0,0 +1,37 @@
+package devicemapper
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGroupSnapshotSpecs(t *testing.T) {
+	specs := []SnapshotSpec{
+		{SourceID: "2", SnapshotID: 10},
+		{SourceID: "4", SnapshotID: 11},
+		{SourceID: "2", SnapshotID: 12},
+		{SourceID: "4", SnapshotID: 10}, // repeats snapshot 10
+		{SourceID: "", SnapshotID: 13},
+		{SourceID: "2", SnapshotID: 0},
+		{SourceID: "6", SnapshotID: 14},
+	}
+
+	groups, errs := groupSnapshotSpecs(specs)
+
+	want := []snapshotGroup{
+		{sourceID: "2", indices: []int{0, 2}},
+		{sourceID: "4", indices: []int{1}},
+		{sourceID: "6", indices: []int{6}},
+	}
+	if !reflect.DeepEqual(groups, want) {
+		t.Errorf("groups = %+v, want %+v", groups, want)
+	}
+	if len(errs) != len(specs) {
+		t.Fatalf("got %d errors, want one slot per spec (%d)", len(errs), len(specs))
+	}
+	for i, err := range errs {
+		if wantErr := i == 3 || i == 4 || i == 5; (err != nil) != wantErr {
+			t.Errorf("errs[%d] = %v, want error: %v", i, err, wantErr)
+		}
+	}
+}
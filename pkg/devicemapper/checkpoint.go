@@ -0,0 +1,152 @@
+package devicemapper
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// checkpointSuffix names the file beside destDir recording how far a
+// resumable extraction into destDir got
+const checkpointSuffix = ".checkpoint"
+
+// checkpointEvery is how many bytes of file content are written between
+// checkpoint saves; replaced in tests
+var checkpointEvery int64 = 64 * 1024 * 1024
+
+// checkpointState is the saved progress of an extraction. The archive's
+// size and modification time tie it to one archive; a checkpoint for any
+// other archive is ignored.
+type checkpointState struct {
+	ArchiveSize    int64 `json:"archive_size"`
+	ArchiveModTime int64 `json:"archive_mod_time"`
+	// Entry is the index of the last entry known to be on disk, and
+	// Offset the archive offset of its content
+	Entry  int   `json:"entry"`
+	Offset int64 `json:"offset"`
+}
+
+// checkpoint tracks a resumable extraction of the archive f. Entries up
+// to resumeAfter were extracted by an earlier run.
+type checkpoint struct {
+	path        string
+	f           *os.File
+	state       checkpointState
+	resumeAfter int
+	resumeAt    int64
+	offset      int64
+	unsaved     int64
+}
+
+// loadCheckpoint reads the checkpoint left beside destDir by an earlier
+// extraction of f, if any
+func loadCheckpoint(destDir string, f *os.File) (*checkpoint, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat tar: %w", err)
+	}
+	c := &checkpoint{
+		path:        filepath.Clean(destDir) + checkpointSuffix,
+		f:           f,
+		state:       checkpointState{ArchiveSize: fi.Size(), ArchiveModTime: fi.ModTime().UnixNano()},
+		resumeAfter: -1,
+	}
+
+	data, err := os.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read extraction checkpoint: %w", err)
+	}
+	var saved checkpointState
+	if err := json.Unmarshal(data, &saved); err != nil {
+		slog.Warn("extraction_checkpoint_ignored", "path", c.path, "reason", "unreadable", "error", err)
+		return c, nil
+	}
+	if saved.ArchiveSize != c.state.ArchiveSize || saved.ArchiveModTime != c.state.ArchiveModTime {
+		slog.Warn("extraction_checkpoint_ignored", "path", c.path, "reason", "archive_changed")
+		return c, nil
+	}
+
+	c.resumeAfter, c.resumeAt = saved.Entry, saved.Offset
+	slog.Info("extraction_resuming", "path", c.path, "entry", saved.Entry, "offset", saved.Offset)
+	return c, nil
+}
+
+// next is called as the header of entry index is read. It reports whether
+// an earlier run already extracted the entry. A nil checkpoint resumes
+// nothing.
+func (c *checkpoint) next(index int) (bool, error) {
+	if c == nil {
+		return false, nil
+	}
+	// tar.Reader reads headers without reading ahead, so this is where
+	// the entry's content starts
+	offset, err := c.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return false, fmt.Errorf("failed to read archive offset: %w", err)
+	}
+	c.offset = offset
+
+	if index == c.resumeAfter && offset != c.resumeAt {
+		c.remove()
+		return false, fmt.Errorf("extraction checkpoint expects entry %d at offset %d, found it at %d; checkpoint removed", index, c.resumeAt, offset)
+	}
+	return index <= c.resumeAfter, nil
+}
+
+// done records that entry index is on disk after writing written bytes of
+// its content, saving the checkpoint once enough content has been written
+// since the last save
+func (c *checkpoint) done(index int, written int64) error {
+	if c == nil {
+		return nil
+	}
+	c.state.Entry, c.state.Offset = index, c.offset
+	c.unsaved += written
+	if c.unsaved < checkpointEvery {
+		return nil
+	}
+	c.unsaved = 0
+	return c.save()
+}
+
+// save writes the checkpoint under a temporary name and renames it into
+// place, so a crash mid-save leaves the previous checkpoint intact
+func (c *checkpoint) save() error {
+	data, err := json.Marshal(c.state)
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to save extraction checkpoint: %w", err)
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		return fmt.Errorf("failed to save extraction checkpoint: %w", err)
+	}
+	return nil
+}
+
+// remove deletes the checkpoint once it is no longer needed
+func (c *checkpoint) remove() error {
+	if c == nil {
+		return nil
+	}
+	if err := os.Remove(c.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove extraction checkpoint: %w", err)
+	}
+	return nil
+}
+
+// extractedIntact reports whether target is a regular file of size bytes,
+// as an earlier run would have left it. Only the size is checked: a file
+// cut short by an interruption is rewritten.
+func extractedIntact(target string, size int64) bool {
+	fi, err := os.Lstat(target)
+	return err == nil && fi.Mode().IsRegular() && fi.Size() == size
+}
@@ -0,0 +1,141 @@
+package devicemapper
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countCreates replaces createFile with one that counts files created
+// per base name and fails to create failOn
+func countCreates(t *testing.T, failOn string) map[string]int {
+	t.Helper()
+	orig := createFile
+	t.Cleanup(func() { createFile = orig })
+
+	created := make(map[string]int)
+	createFile = func(name string, mode os.FileMode) (io.WriteCloser, error) {
+		base := filepath.Base(name)
+		if base == failOn {
+			return nil, errors.New("interrupted")
+		}
+		created[base]++
+		return os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	}
+	return created
+}
+
+func checkpointTar(t *testing.T, path string) {
+	t.Helper()
+	writeTar(t, path, []tarEntry{
+		{name: "app/", typeflag: tar.TypeDir},
+		{name: "app/a", typeflag: tar.TypeReg, body: strings.Repeat("a", 3000)},
+		{name: "app/b", typeflag: tar.TypeReg, body: strings.Repeat("b", 3000)},
+		{name: "app/c", typeflag: tar.TypeReg, body: strings.Repeat("c", 3000)},
+		{name: "app/d", typeflag: tar.TypeReg, body: strings.Repeat("d", 3000)},
+	})
+}
+
+func TestExtractTarball_ResumeSkipsCompletedFiles(t *testing.T) {
+	orig := checkpointEvery
+	defer func() { checkpointEvery = orig }()
+	checkpointEvery = 1
+
+	dir := t.TempDir()
+	tarPath := filepath.Join(dir, "image.tar")
+	checkpointTar(t, tarPath)
+	destDir := filepath.Join(dir, "extracted")
+	opts := ExtractOptions{Resumable: true, Parallel: true}
+
+	countCreates(t, "c")
+	if err := ExtractTarball(tarPath, destDir, newTestValidator(), opts); err == nil {
+		t.Fatal("interrupted extraction succeeded")
+	}
+	if _, err := os.Stat(destDir + checkpointSuffix); err != nil {
+		t.Fatalf("no checkpoint after interruption: %v", err)
+	}
+
+	created := countCreates(t, "")
+	if err := ExtractTarball(tarPath, destDir, newTestValidator(), opts); err != nil {
+		t.Fatalf("resumed extraction failed: %v", err)
+	}
+	if created["a"] != 0 || created["b"] != 0 {
+		t.Errorf("resumed run rewrote completed files: %v", created)
+	}
+	if created["c"] != 1 || created["d"] != 1 {
+		t.Errorf("resumed run didn't write remaining files: %v", created)
+	}
+
+	for _, name := range []string{"a", "b", "c", "d"} {
+		data, err := os.ReadFile(filepath.Join(destDir, "app", name))
+		if err != nil || string(data) != strings.Repeat(name, 3000) {
+			t.Errorf("app/%s wrong after resume (err %v)", name, err)
+		}
+	}
+	if _, err := os.Stat(destDir + checkpointSuffix); !os.IsNotExist(err) {
+		t.Errorf("checkpoint left after success, stat err: %v", err)
+	}
+}
+
+func TestExtractTarball_ResumeRewritesDamagedFile(t *testing.T) {
+	orig := checkpointEvery
+	defer func() { checkpointEvery = orig }()
+	checkpointEvery = 1
+
+	dir := t.TempDir()
+	tarPath := filepath.Join(dir, "image.tar")
+	checkpointTar(t, tarPath)
+	destDir := filepath.Join(dir, "extracted")
+	opts := ExtractOptions{Resumable: true}
+
+	countCreates(t, "c")
+	if err := ExtractTarball(tarPath, destDir, newTestValidator(), opts); err == nil {
+		t.Fatal("interrupted extraction succeeded")
+	}
+	if err := os.Truncate(filepath.Join(destDir, "app/a"), 10); err != nil {
+		t.Fatal(err)
+	}
+
+	created := countCreates(t, "")
+	if err := ExtractTarball(tarPath, destDir, newTestValidator(), opts); err != nil {
+		t.Fatalf("resumed extraction failed: %v", err)
+	}
+	if created["a"] != 1 || created["b"] != 0 {
+		t.Errorf("created = %v, want only the damaged completed file rewritten", created)
+	}
+}
+
+func TestExtractTarball_CheckpointForOtherArchiveIgnored(t *testing.T) {
+	orig := checkpointEvery
+	defer func() { checkpointEvery = orig }()
+	checkpointEvery = 1
+
+	dir := t.TempDir()
+	tarPath := filepath.Join(dir, "image.tar")
+	checkpointTar(t, tarPath)
+	destDir := filepath.Join(dir, "extracted")
+	opts := ExtractOptions{Resumable: true}
+
+	countCreates(t, "c")
+	if err := ExtractTarball(tarPath, destDir, newTestValidator(), opts); err == nil {
+		t.Fatal("interrupted extraction succeeded")
+	}
+	// A new upload under the same path
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(tarPath, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	created := countCreates(t, "")
+	if err := ExtractTarball(tarPath, destDir, newTestValidator(), opts); err != nil {
+		t.Fatalf("extraction failed: %v", err)
+	}
+	if created["a"] != 1 || created["b"] != 1 {
+		t.Errorf("stale checkpoint skipped files: %v", created)
+	}
+}
@@ -0,0 +1,61 @@
+package devicemapper
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/fly-io/162719/pkg/security"
+)
+
+// CheckTree re-runs the checks extraction applies under opts against a
+// tree already extracted to dir, e.g. one cached by an earlier run with
+// other options: the top-level entry limit, the validator's symlink
+// policy and, unless opts skips it, the compression ratio of the tree
+// against compressedSize bytes of archive.
+func CheckTree(dir string, validator *security.Validator, opts ExtractOptions, compressedSize int64) error {
+	topLevel := newTopLevelTracker(opts)
+	var total int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir {
+			return nil
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if err := topLevel.add(name); err != nil {
+			return err
+		}
+
+		switch {
+		case d.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return fmt.Errorf("failed to read symlink %s: %w", name, err)
+			}
+			if err := validator.ValidateSymlink(name, target); err != nil {
+				return fmt.Errorf("invalid symlink in tree: %w", err)
+			}
+		case d.Type().IsRegular():
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			total += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if opts.SkipCompressionRatio {
+		return nil
+	}
+	return validator.ValidateCompressionRatio(compressedSize, total)
+}
@@ -0,0 +1,113 @@
+package devicemapper
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fly-io/162719/pkg/security"
+)
+
+// writeTree builds a tree of files, each holding body, plus symlinks
+func writeTree(t *testing.T, dir string, files []string, body string, symlinks map[string]string) {
+	t.Helper()
+
+	for _, name := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, target := range symlinks {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(target, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCheckTree(t *testing.T) {
+	strict := security.NewValidator(1024*1024, 10*1024*1024, 10.0, security.WithAbsoluteSymlinkAllowlist("/usr/"))
+
+	tests := []struct {
+		name           string
+		files          []string
+		body           string
+		symlinks       map[string]string
+		opts           ExtractOptions
+		compressedSize int64
+		wantErr        error
+	}{
+		{
+			name:           "passes",
+			files:          []string{"etc/hostname", "usr/bin/dash"},
+			body:           "x",
+			symlinks:       map[string]string{"bin/sh": "/usr/bin/dash", "etc/alias": "hostname"},
+			opts:           ExtractOptions{MaxTopLevelEntries: 3},
+			compressedSize: 1024,
+		},
+		{
+			name:           "too many top-level entries",
+			files:          []string{"a", "b", "c"},
+			body:           "x",
+			opts:           ExtractOptions{MaxTopLevelEntries: 2},
+			compressedSize: 1024,
+			wantErr:        ErrTarbomb,
+		},
+		{
+			name:           "top-level entries only warned about",
+			files:          []string{"a", "b", "c"},
+			body:           "x",
+			opts:           ExtractOptions{MaxTopLevelEntries: 2, WarnTopLevelEntries: true},
+			compressedSize: 1024,
+		},
+		{
+			name:           "symlink outside the allowlist",
+			files:          []string{"etc/hostname"},
+			body:           "x",
+			symlinks:       map[string]string{"etc/passwd": "/host/etc/passwd"},
+			compressedSize: 1024,
+			wantErr:        security.ErrRejected,
+		},
+		{
+			name:           "compression ratio exceeded",
+			files:          []string{"data"},
+			body:           strings.Repeat("x", 4096),
+			compressedSize: 100,
+			wantErr:        security.ErrRejected,
+		},
+		{
+			name:           "compression ratio skipped",
+			files:          []string{"data"},
+			body:           strings.Repeat("x", 4096),
+			opts:           ExtractOptions{SkipCompressionRatio: true},
+			compressedSize: 100,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeTree(t, dir, tt.files, tt.body, tt.symlinks)
+
+			err := CheckTree(dir, strict, tt.opts, tt.compressedSize)
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("CheckTree failed: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("CheckTree error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
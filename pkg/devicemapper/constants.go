@@ -10,4 +10,7 @@ const (
 	DefaultSectorSize = 512
 	// DefaultDeviceSectors is the default device size in sectors (1GB = 2097152 sectors)
 	DefaultDeviceSectors = 2097152
+	// DefaultMetadataCriticalPercent is the pool metadata usage at which
+	// new devices and snapshots are refused
+	DefaultMetadataCriticalPercent = 95.0
 )
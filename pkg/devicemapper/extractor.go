@@ -6,12 +6,88 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"syscall"
 
+	"github.com/fly-io/162719/pkg/errors"
 	"github.com/fly-io/162719/pkg/security"
 )
 
-// ExtractTarball extracts a tarball to a directory with security validation
-func ExtractTarball(tarPath, destDir string, validator *security.Validator) error {
+// Whiteout markers used by layered (OCI/Docker) tarballs
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// ErrDiskFull is returned when the filesystem being extracted to runs out
+// of space. The archive itself may be fine: space has to be freed before
+// the image can be extracted.
+var ErrDiskFull = errors.New("disk full")
+
+// createFile opens an extraction target for writing; replaced in tests
+var createFile = func(name string, mode os.FileMode) (io.WriteCloser, error) {
+	return os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+}
+
+// ExtractTarballAtomic extracts a tarball into a sibling temp directory and
+// renames it into place only on success, so destDir is either absent or
+// complete. Any previous destDir is replaced; on failure the temp
+// directory is removed and destDir is left untouched.
+func ExtractTarballAtomic(tarPath, destDir string, validator *security.Validator, opts ExtractOptions) error {
+	// Every attempt starts from a fresh temp directory, so there is never
+	// anything to resume
+	opts.Resumable = false
+	return BuildDirAtomic(destDir, func(tmpDir string) error {
+		return ExtractTarball(tarPath, tmpDir, validator, opts)
+	})
+}
+
+// BuildDirAtomic populates a sibling temp directory with build and renames
+// it over destDir only if build succeeds
+func BuildDirAtomic(destDir string, build func(tmpDir string) error) error {
+	parent := filepath.Dir(destDir)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return fmt.Errorf("failed to create parent dir: %w", err)
+	}
+
+	tmpDir, err := os.MkdirTemp(parent, "."+filepath.Base(destDir)+".tmp-")
+	if err != nil {
+		return fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			os.RemoveAll(tmpDir)
+		}
+	}()
+
+	if err := os.Chmod(tmpDir, 0755); err != nil {
+		return fmt.Errorf("failed to chmod temp dir: %w", err)
+	}
+
+	if err := build(tmpDir); err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(destDir); err != nil {
+		return fmt.Errorf("failed to remove previous extraction: %w", err)
+	}
+	if err := os.Rename(tmpDir, destDir); err != nil {
+		return fmt.Errorf("failed to move extraction into place: %w", err)
+	}
+	committed = true
+
+	return nil
+}
+
+// ExtractTarball extracts a tarball to a directory with security
+// validation. With opts.Resumable, progress is checkpointed beside destDir
+// and a later call for the same archive skips the files already written.
+func ExtractTarball(tarPath, destDir string, validator *security.Validator, opts ExtractOptions) error {
+	if opts.Isolate {
+		return extractIsolated(tarPath, destDir, validator, opts)
+	}
+
 	validator.Reset()
 
 	f, err := os.Open(tarPath)
@@ -20,23 +96,213 @@ func ExtractTarball(tarPath, destDir string, validator *security.Validator) erro
 	}
 	defer f.Close()
 
-	tarReader := tar.NewReader(f)
+	var ckpt *checkpoint
+	if opts.Resumable {
+		if ckpt, err = loadCheckpoint(destDir, f); err != nil {
+			return err
+		}
+	}
+
+	if err := extractStream(f, destDir, validator, opts, ckpt); err != nil {
+		return err
+	}
+	if err := ckpt.remove(); err != nil {
+		return err
+	}
+
+	if opts.SkipCompressionRatio {
+		return nil
+	}
+
+	fi, err := os.Stat(tarPath)
+	if err != nil {
+		return fmt.Errorf("failed to stat tar: %w", err)
+	}
+
+	if err := validator.ValidateCompressionRatio(fi.Size(), validator.GetCurrentTotalSize()); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ExtractStream extracts a tar stream to a directory with security
+// validation, reading r exactly once. Any bytes after the end-of-archive
+// marker are drained, so a caller hashing r (e.g. through io.TeeReader)
+// sees the whole object.
+func ExtractStream(r io.Reader, destDir string, validator *security.Validator, opts ExtractOptions) error {
+	validator.Reset()
+
+	counted := &countingReader{r: r}
+	if err := extractStream(counted, destDir, validator, opts, nil); err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.Discard, counted); err != nil {
+		return fmt.Errorf("failed to read end of tar stream: %w", err)
+	}
+
+	if opts.SkipCompressionRatio {
+		return nil
+	}
+	return validator.ValidateCompressionRatio(counted.n, validator.GetCurrentTotalSize())
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
 
-	for {
+// ApplyLayer applies an uncompressed layer tar stream on top of destDir.
+// Whiteout markers delete entries from lower layers instead of being
+// written out. The validator is not reset, so size limits accumulate
+// across all layers of an image.
+func ApplyLayer(r io.Reader, destDir string, validator *security.Validator) error {
+	return extractStream(r, destDir, validator, ExtractOptions{Layered: true}, nil)
+}
+
+// walkTar calls fn with each entry of the tar stream r in order, along
+// with its index and its content, which fn may leave unread. archive/tar
+// folds PAX extended headers and GNU long name/link records into the
+// header that follows them, so fn sees the full decoded paths and must
+// validate them as such.
+func walkTar(r io.Reader, fn func(index int, header *tar.Header, content io.Reader) error) error {
+	tarReader := tar.NewReader(r)
+	for index := 0; ; index++ {
 		header, err := tarReader.Next()
 		if err == io.EOF {
-			break
+			return nil
 		}
 		if err != nil {
 			return fmt.Errorf("tar read error: %w", err)
 		}
 
+		switch header.Typeflag {
+		case tar.TypeXGlobalHeader:
+			// Archive-wide PAX defaults, not a file; its name is arbitrary
+			// and must never reach the filesystem
+			continue
+		case tar.TypeXHeader, tar.TypeGNULongName, tar.TypeGNULongLink:
+			return fmt.Errorf("unexpected tar extension header %q for %s", header.Typeflag, header.Name)
+		}
+
+		if err := fn(index, header, tarReader); err != nil {
+			return err
+		}
+	}
+}
+
+// extractStream extracts tar entries from r into destDir. In layered mode
+// entries replace existing ones and whiteout markers are applied. A
+// non-nil ckpt records progress and skips regular files extracted by an
+// earlier run; every entry is still read and validated.
+func extractStream(r io.Reader, destDir string, validator *security.Validator, opts ExtractOptions, ckpt *checkpoint) (err error) {
+	// Layers must apply strictly in order, so they never write in parallel.
+	// A checkpoint may only cover files already on disk, so resumable
+	// extraction writes inline too.
+	var pool *writePool
+	if opts.Parallel && !opts.Layered && ckpt == nil {
+		pool = newWritePool(opts.workers(), opts.maxBufferedBytes())
+		defer func() {
+			if closeErr := pool.close(); err == nil {
+				err = closeErr
+			}
+		}()
+	}
+
+	// Only this goroutine writes inline, so one copy buffer serves every file
+	copyBuf := make([]byte, opts.copyBufferSize())
+
+	// Entries written by this layer, so an opaque marker only hides lower layers
+	written := make(map[string]bool)
+
+	topLevel := newTopLevelTracker(opts)
+
+	subpath := opts.Subpath
+	if subpath != "" {
+		if subpath, err = CleanSubpath(subpath); err != nil {
+			return err
+		}
+	}
+
+	return walkTar(r, func(index int, header *tar.Header, content io.Reader) error {
+		if pool != nil {
+			if err := pool.firstErr(); err != nil {
+				return err
+			}
+		}
+		resumed, err := ckpt.next(index)
+		if err != nil {
+			return err
+		}
+
+		if subpath != "" {
+			name, ok, err := subpathEntry(header.Name, header.Typeflag, subpath)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return ckpt.done(index, 0)
+			}
+			header.Name = name
+			if header.Typeflag == tar.TypeLink {
+				// Hardlink targets are archive paths too
+				if header.Linkname, _, err = subpathEntry(header.Linkname, tar.TypeReg, subpath); err != nil {
+					return fmt.Errorf("invalid hardlink target: %w", err)
+				}
+			}
+		}
+
 		if err := validator.ValidatePath(header.Name); err != nil {
 			return fmt.Errorf("invalid path in tar: %w", err)
 		}
+		if err := topLevel.add(header.Name); err != nil {
+			return err
+		}
 
 		target := filepath.Join(destDir, header.Name)
 
+		// A path appearing twice must be written in archive order
+		if pool != nil && pool.dispatched(target) {
+			if err := pool.drain(); err != nil {
+				return err
+			}
+		}
+
+		if opts.Layered {
+			// Lower layers may have planted symlinks; never follow them when
+			// deleting or replacing entries in an upper layer
+			if err := checkNoSymlinkParents(destDir, header.Name); err != nil {
+				return err
+			}
+
+			handled, err := applyWhiteout(destDir, header.Name, written)
+			if err != nil {
+				return err
+			}
+			if handled {
+				return nil
+			}
+			for p := filepath.Clean(header.Name); p != "." && !written[p]; p = filepath.Dir(p) {
+				written[p] = true
+			}
+
+			// A later layer replaces whatever a lower layer left at this path.
+			// Removing it first also stops writes following a lower-layer symlink.
+			if fi, err := os.Lstat(target); err == nil && !(fi.IsDir() && header.Typeflag == tar.TypeDir) {
+				if err := os.RemoveAll(target); err != nil {
+					return fmt.Errorf("failed to replace %s: %w", header.Name, err)
+				}
+			}
+		}
+
+		var wrote int64
 		switch header.Typeflag {
 		case tar.TypeDir:
 			if err := os.MkdirAll(target, 0755); err != nil {
@@ -56,16 +322,29 @@ func ExtractTarball(tarPath, destDir string, validator *security.Validator) erro
 				return fmt.Errorf("failed to create parent dir: %w", err)
 			}
 
-			outFile, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode))
-			if err != nil {
-				return fmt.Errorf("failed to create file: %w", err)
+			// tar.Reader seeks past the content of an entry left unread
+			if resumed && extractedIntact(target, header.Size) {
+				break
+			}
+
+			mode := os.FileMode(header.Mode)
+			if pool != nil && header.Size <= pool.budget {
+				// Content must be read before the next header, so buffer it
+				// and let a worker do the open/write/close
+				pool.acquire(header.Size)
+				data := make([]byte, header.Size)
+				if _, err := io.ReadFull(content, data); err != nil {
+					pool.release(header.Size)
+					return fmt.Errorf("failed to write file: %w", err)
+				}
+				pool.submit(writeJob{target: target, mode: mode, data: data})
+				return nil
 			}
 
-			if _, err := io.Copy(outFile, tarReader); err != nil {
-				outFile.Close()
-				return fmt.Errorf("failed to write file: %w", err)
+			if err := writeFile(target, content, header.Size, mode, copyBuf); err != nil {
+				return err
 			}
-			outFile.Close()
+			wrote = header.Size
 
 		case tar.TypeSymlink:
 			// Validate symlink target in context of its location
@@ -77,20 +356,183 @@ func ExtractTarball(tarPath, destDir string, validator *security.Validator) erro
 				return fmt.Errorf("invalid symlink target: %w", err)
 			}
 
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return fmt.Errorf("failed to create parent dir: %w", err)
+			}
 			if err := os.Symlink(header.Linkname, target); err != nil && !os.IsExist(err) {
 				return fmt.Errorf("failed to create symlink: %w", err)
 			}
+
+		case tar.TypeLink:
+			// The link source must already be on disk, not queued
+			source := filepath.Join(destDir, header.Linkname)
+			if pool != nil && pool.dispatched(source) {
+				if err := pool.drain(); err != nil {
+					return err
+				}
+			}
+			if err := linkFile(destDir, header.Name, header.Linkname, validator); err != nil {
+				return err
+			}
 		}
+
+		return ckpt.done(index, wrote)
+	})
+}
+
+// writeFile creates target with mode and copies r into it through buf,
+// or io.Copy's default buffer when buf is nil. r must hold exactly size
+// bytes, the size declared in the entry's header: size and ratio limits
+// were checked against that figure, so content that runs past it or stops
+// short of it fails the entry. Running out of space fails with ErrDiskFull
+// and removes the partial file.
+func writeFile(target string, r io.Reader, size int64, mode os.FileMode, buf []byte) error {
+	outFile, err := createFile(target, mode)
+	if err != nil {
+		if errors.Is(err, syscall.ENOSPC) {
+			return diskFull(target, err)
+		}
+		return fmt.Errorf("failed to create file: %w", err)
 	}
 
-	fi, err := os.Stat(tarPath)
+	// Hide *os.File's ReadFrom, which would otherwise take over the copy
+	// and fall back to its own 32KB buffer, ignoring buf. One byte past
+	// size is enough to tell that the content is too long.
+	n, err := io.CopyBuffer(struct{ io.Writer }{outFile}, io.LimitReader(r, size+1), buf)
 	if err != nil {
-		return fmt.Errorf("failed to stat tar: %w", err)
+		outFile.Close()
+		if errors.Is(err, syscall.ENOSPC) {
+			os.Remove(target)
+			return diskFull(target, err)
+		}
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	if n != size {
+		outFile.Close()
+		os.Remove(target)
+		if n > size {
+			return errors.Fatal(fmt.Errorf("%w: %s has more content than its declared size of %d bytes", security.ErrRejected, target, size))
+		}
+		return errors.Fatal(fmt.Errorf("%w: %s has %d bytes, declared %d", security.ErrRejected, target, n, size))
 	}
+	// Some filesystems only report a full disk once buffered data is flushed
+	if err := outFile.Close(); err != nil {
+		if errors.Is(err, syscall.ENOSPC) {
+			os.Remove(target)
+			return diskFull(target, err)
+		}
+		return err
+	}
+	return nil
+}
 
-	if err := validator.ValidateCompressionRatio(fi.Size(), validator.GetCurrentTotalSize()); err != nil {
+// diskFull reports that target couldn't be written for lack of space
+func diskFull(target string, err error) error {
+	return fmt.Errorf("%w: failed to write %s: %w", ErrDiskFull, target, err)
+}
+
+// linkFile creates the hard link name -> linkname, both archive paths.
+// The source must be a regular file already extracted under destDir and
+// reached without symlinks: linking through one could pull a host file
+// into the tree.
+func linkFile(destDir, name, linkname string, validator *security.Validator) error {
+	if linkname == "" {
+		return fmt.Errorf("invalid hardlink %s: empty target", name)
+	}
+	if err := validator.ValidatePath(linkname); err != nil {
+		return fmt.Errorf("invalid hardlink target: %w", err)
+	}
+	if err := checkNoSymlinkParents(destDir, linkname); err != nil {
 		return err
 	}
 
+	source := filepath.Join(destDir, linkname)
+	fi, err := os.Lstat(source)
+	if err != nil {
+		return fmt.Errorf("hardlink %s: target %s not extracted: %w", name, linkname, err)
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("security: hardlink %s targets non-regular file %s", name, linkname)
+	}
+
+	target := filepath.Join(destDir, name)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("failed to create parent dir: %w", err)
+	}
+	// Like a regular file entry, a later link replaces an earlier entry
+	if fi, err := os.Lstat(target); err == nil && !fi.IsDir() {
+		if err := os.Remove(target); err != nil {
+			return fmt.Errorf("failed to replace %s: %w", name, err)
+		}
+	}
+	if err := os.Link(source, target); err != nil {
+		return fmt.Errorf("failed to create hardlink: %w", err)
+	}
+	return nil
+}
+
+// applyWhiteout handles a whiteout marker entry, reporting whether the
+// entry was a marker. ".wh.<name>" deletes <name> from lower layers;
+// ".wh..wh..opq" empties its directory of everything not written by the
+// current layer.
+func applyWhiteout(destDir, name string, written map[string]bool) (bool, error) {
+	base := filepath.Base(name)
+	if !strings.HasPrefix(base, whiteoutPrefix) {
+		return false, nil
+	}
+	dir := filepath.Dir(filepath.Clean(name))
+
+	if base == whiteoutOpaque {
+		entries, err := os.ReadDir(filepath.Join(destDir, dir))
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		if err != nil {
+			return true, fmt.Errorf("failed to read opaque dir %s: %w", dir, err)
+		}
+		for _, e := range entries {
+			rel := filepath.Join(dir, e.Name())
+			if written[rel] {
+				continue
+			}
+			if err := os.RemoveAll(filepath.Join(destDir, rel)); err != nil {
+				return true, fmt.Errorf("failed to apply opaque whiteout %s: %w", rel, err)
+			}
+		}
+		return true, nil
+	}
+
+	victim := strings.TrimPrefix(base, whiteoutPrefix)
+	if victim == "" || victim == "." || victim == ".." {
+		return true, fmt.Errorf("invalid whiteout entry: %s", name)
+	}
+	if err := os.RemoveAll(filepath.Join(destDir, dir, victim)); err != nil {
+		return true, fmt.Errorf("failed to apply whiteout %s: %w", name, err)
+	}
+	return true, nil
+}
+
+// checkNoSymlinkParents rejects entries whose parent directories inside
+// destDir are symlinks, which would redirect writes outside the tree
+func checkNoSymlinkParents(destDir, name string) error {
+	dir := filepath.Dir(filepath.Clean(name))
+	if dir == "." {
+		return nil
+	}
+
+	current := destDir
+	for _, part := range strings.Split(dir, string(filepath.Separator)) {
+		current = filepath.Join(current, part)
+		fi, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to inspect %s: %w", current, err)
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("security: entry %s traverses symlink %s", name, strings.TrimPrefix(current, destDir+string(filepath.Separator)))
+		}
+	}
 	return nil
 }
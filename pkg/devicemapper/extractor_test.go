@@ -0,0 +1,574 @@
+package devicemapper
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/fly-io/162719/pkg/security"
+)
+
+// tarEntry describes a single entry written by writeTar
+type tarEntry struct {
+	name     string
+	typeflag byte
+	body     string
+	linkname string
+}
+
+// writeTar builds an uncompressed tarball at path from entries
+func writeTar(t testing.TB, path string, entries []tarEntry) {
+	t.Helper()
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("failed to create tar: %v", err)
+	}
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name:     e.name,
+			Typeflag: e.typeflag,
+			Linkname: e.linkname,
+			Mode:     0644,
+			Size:     int64(len(e.body)),
+		}
+		if e.typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("failed to write header %s: %v", e.name, err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatalf("failed to write body %s: %v", e.name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("failed to close tar: %v", err)
+	}
+}
+
+func newTestValidator() *security.Validator {
+	return security.NewValidator(1024*1024, 10*1024*1024, 1000.0)
+}
+
+func TestExtractTarballAtomic_Success(t *testing.T) {
+	dir := t.TempDir()
+	tarPath := filepath.Join(dir, "image.tar")
+	writeTar(t, tarPath, []tarEntry{
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/hostname", typeflag: tar.TypeReg, body: "machine\n"},
+	})
+
+	destDir := filepath.Join(dir, "extracted", "image")
+	if err := ExtractTarballAtomic(tarPath, destDir, newTestValidator(), ExtractOptions{}); err != nil {
+		t.Fatalf("extraction failed: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(destDir, "etc", "hostname"))
+	if err != nil || string(data) != "machine\n" {
+		t.Errorf("extracted file mismatch: %q, %v", data, err)
+	}
+	assertNoTempDirs(t, filepath.Dir(destDir))
+}
+
+func TestExtractTarball_SmallCopyBufferReusedAcrossFiles(t *testing.T) {
+	dir := t.TempDir()
+	tarPath := filepath.Join(dir, "image.tar")
+	long := strings.Repeat("0123456789", 100)
+	writeTar(t, tarPath, []tarEntry{
+		{name: "a.txt", typeflag: tar.TypeReg, body: long},
+		{name: "b.txt", typeflag: tar.TypeReg, body: "short"},
+	})
+
+	destDir := filepath.Join(dir, "out")
+	if err := ExtractTarball(tarPath, destDir, newTestValidator(), ExtractOptions{CopyBufferSize: 7}); err != nil {
+		t.Fatalf("extraction failed: %v", err)
+	}
+
+	for name, want := range map[string]string{"a.txt": long, "b.txt": "short"} {
+		data, err := os.ReadFile(filepath.Join(destDir, name))
+		if err != nil || string(data) != want {
+			t.Errorf("%s mismatch: %d bytes, %v", name, len(data), err)
+		}
+	}
+}
+
+func TestExtractStream_FromMemoryHashesWholeStream(t *testing.T) {
+	dir := t.TempDir()
+	tarPath := filepath.Join(dir, "image.tar")
+	writeTar(t, tarPath, []tarEntry{
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/hostname", typeflag: tar.TypeReg, body: "machine\n"},
+		{name: "bin/sh", typeflag: tar.TypeReg, body: "#!/bin/true\n"},
+	})
+	data, err := os.ReadFile(tarPath)
+	if err != nil {
+		t.Fatalf("read tar: %v", err)
+	}
+	// tar(1) pads archives to a 10 KiB record; the padding is part of the
+	// object and must be hashed too
+	data = append(data, make([]byte, 10240-len(data)%10240)...)
+
+	hash := sha256.New()
+	destDir := filepath.Join(dir, "out")
+	if err := ExtractStream(io.TeeReader(bytes.NewReader(data), hash), destDir, newTestValidator(), ExtractOptions{}); err != nil {
+		t.Fatalf("extraction failed: %v", err)
+	}
+
+	want := sha256.Sum256(data)
+	if got := hex.EncodeToString(hash.Sum(nil)); got != hex.EncodeToString(want[:]) {
+		t.Errorf("streamed checksum = %s, want %s", got, hex.EncodeToString(want[:]))
+	}
+
+	tree := treeContents(t, destDir)
+	if tree[filepath.Join("etc", "hostname")] != "machine\n" || tree[filepath.Join("bin", "sh")] != "#!/bin/true\n" {
+		t.Errorf("extracted tree = %v", tree)
+	}
+}
+
+func TestExtractTarballAtomic_FailureLeavesNoDirectory(t *testing.T) {
+	dir := t.TempDir()
+	tarPath := filepath.Join(dir, "image.tar")
+	writeTar(t, tarPath, []tarEntry{
+		{name: "etc/hostname", typeflag: tar.TypeReg, body: "machine\n"},
+		{name: "../escape", typeflag: tar.TypeReg, body: "evil"},
+	})
+
+	destDir := filepath.Join(dir, "extracted", "image")
+	if err := ExtractTarballAtomic(tarPath, destDir, newTestValidator(), ExtractOptions{}); err == nil {
+		t.Fatal("expected extraction to fail on path traversal entry")
+	}
+
+	if _, err := os.Stat(destDir); !os.IsNotExist(err) {
+		t.Errorf("final directory should not exist after failed extraction, stat err: %v", err)
+	}
+	assertNoTempDirs(t, filepath.Dir(destDir))
+}
+
+func assertNoTempDirs(t *testing.T, parent string) {
+	t.Helper()
+
+	entries, err := os.ReadDir(parent)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", parent, err)
+	}
+	for _, e := range entries {
+		if matched, _ := filepath.Match(".*.tmp-*", e.Name()); matched {
+			t.Errorf("temp directory left behind: %s", e.Name())
+		}
+	}
+}
+
+func TestExtractTarball_LayeredWhiteout(t *testing.T) {
+	dir := t.TempDir()
+	destDir := filepath.Join(dir, "rootfs")
+
+	lower := filepath.Join(dir, "lower.tar")
+	writeTar(t, lower, []tarEntry{
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/keep.conf", typeflag: tar.TypeReg, body: "keep"},
+		{name: "etc/remove.conf", typeflag: tar.TypeReg, body: "remove"},
+	})
+	upper := filepath.Join(dir, "upper.tar")
+	writeTar(t, upper, []tarEntry{
+		{name: "etc/.wh.remove.conf", typeflag: tar.TypeReg},
+	})
+
+	for _, tarPath := range []string{lower, upper} {
+		if err := ExtractTarball(tarPath, destDir, newTestValidator(), ExtractOptions{Layered: true}); err != nil {
+			t.Fatalf("ExtractTarball(%s) failed: %v", filepath.Base(tarPath), err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(destDir, "etc/keep.conf")); err != nil {
+		t.Errorf("expected etc/keep.conf to survive: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(destDir, "etc/remove.conf")); !os.IsNotExist(err) {
+		t.Errorf("expected etc/remove.conf to be deleted, stat err = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(destDir, "etc/.wh.remove.conf")); !os.IsNotExist(err) {
+		t.Errorf("whiteout marker should not be written, stat err = %v", err)
+	}
+}
+
+func TestExtractTarball_LayeredOpaqueWhiteout(t *testing.T) {
+	dir := t.TempDir()
+	destDir := filepath.Join(dir, "rootfs")
+
+	lower := filepath.Join(dir, "lower.tar")
+	writeTar(t, lower, []tarEntry{
+		{name: "opt/app/", typeflag: tar.TypeDir},
+		{name: "opt/app/old.bin", typeflag: tar.TypeReg, body: "old"},
+		{name: "opt/app/lib/", typeflag: tar.TypeDir},
+		{name: "opt/app/lib/old.so", typeflag: tar.TypeReg, body: "old"},
+		{name: "opt/other", typeflag: tar.TypeReg, body: "other"},
+	})
+	upper := filepath.Join(dir, "upper.tar")
+	writeTar(t, upper, []tarEntry{
+		{name: "opt/app/", typeflag: tar.TypeDir},
+		{name: "opt/app/new.bin", typeflag: tar.TypeReg, body: "new"},
+		{name: "opt/app/.wh..wh..opq", typeflag: tar.TypeReg},
+	})
+
+	for _, tarPath := range []string{lower, upper} {
+		if err := ExtractTarball(tarPath, destDir, newTestValidator(), ExtractOptions{Layered: true}); err != nil {
+			t.Fatalf("ExtractTarball(%s) failed: %v", filepath.Base(tarPath), err)
+		}
+	}
+
+	entries, err := os.ReadDir(filepath.Join(destDir, "opt/app"))
+	if err != nil {
+		t.Fatalf("failed to read opt/app: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "new.bin" {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Errorf("opt/app contents = %v, want [new.bin]", names)
+	}
+	if _, err := os.Stat(filepath.Join(destDir, "opt/other")); err != nil {
+		t.Errorf("opaque whiteout must not touch siblings: %v", err)
+	}
+}
+
+func TestExtractTarball_NonLayeredKeepsWhiteoutFiles(t *testing.T) {
+	dir := t.TempDir()
+	tarPath := filepath.Join(dir, "image.tar")
+	destDir := filepath.Join(dir, "rootfs")
+	writeTar(t, tarPath, []tarEntry{
+		{name: "etc/.wh.foo", typeflag: tar.TypeReg, body: "literal"},
+	})
+
+	if err := ExtractTarball(tarPath, destDir, newTestValidator(), ExtractOptions{}); err != nil {
+		t.Fatalf("ExtractTarball failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(destDir, "etc/.wh.foo")); err != nil {
+		t.Errorf("single-layer extraction should write .wh. files verbatim: %v", err)
+	}
+}
+
+// treeContents maps each path under root to its file content, symlink
+// target, or "<dir>"
+func treeContents(t testing.TB, root string) map[string]string {
+	t.Helper()
+
+	tree := make(map[string]string)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			tree[rel] = "-> " + link
+		case info.IsDir():
+			tree[rel] = "<dir>"
+		default:
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			tree[rel] = string(data)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to walk %s: %v", root, err)
+	}
+	return tree
+}
+
+// manyFilesTar returns entries for a tree of n small files plus a few
+// edge cases: a duplicate path, a symlink, and a file larger than the
+// parallel buffer budget
+func manyFilesTar(n int) []tarEntry {
+	entries := []tarEntry{{name: "data/", typeflag: tar.TypeDir}}
+	for i := 0; i < n; i++ {
+		entries = append(entries, tarEntry{
+			name:     fmt.Sprintf("data/%02d/file-%d.txt", i%16, i),
+			typeflag: tar.TypeReg,
+			body:     strings.Repeat(fmt.Sprintf("%d", i), 64),
+		})
+	}
+	return append(entries,
+		tarEntry{name: "data/00/file-0.txt", typeflag: tar.TypeReg, body: "overwritten"},
+		tarEntry{name: "data/link", typeflag: tar.TypeSymlink, linkname: "00/file-0.txt"},
+		tarEntry{name: "data/big.bin", typeflag: tar.TypeReg, body: strings.Repeat("x", 8192)},
+	)
+}
+
+func TestExtractTarball_ParallelMatchesSequential(t *testing.T) {
+	dir := t.TempDir()
+	tarPath := filepath.Join(dir, "image.tar")
+	writeTar(t, tarPath, manyFilesTar(500))
+
+	seqDir := filepath.Join(dir, "sequential")
+	if err := ExtractTarball(tarPath, seqDir, newTestValidator(), ExtractOptions{}); err != nil {
+		t.Fatalf("sequential extraction failed: %v", err)
+	}
+
+	parDir := filepath.Join(dir, "parallel")
+	opts := ExtractOptions{Parallel: true, Workers: 4, MaxBufferedBytes: 4096}
+	if err := ExtractTarball(tarPath, parDir, newTestValidator(), opts); err != nil {
+		t.Fatalf("parallel extraction failed: %v", err)
+	}
+
+	seq, par := treeContents(t, seqDir), treeContents(t, parDir)
+	if len(seq) != len(par) {
+		t.Fatalf("tree sizes differ: sequential %d, parallel %d", len(seq), len(par))
+	}
+	for path, want := range seq {
+		if got, ok := par[path]; !ok || got != want {
+			t.Errorf("%s: parallel = %.20q, sequential = %.20q", path, got, want)
+		}
+	}
+	if par["data/00/file-0.txt"] != "overwritten" {
+		t.Errorf("later duplicate entry should win, got %q", par["data/00/file-0.txt"])
+	}
+}
+
+func TestExtractTarball_ParallelEnforcesLimits(t *testing.T) {
+	dir := t.TempDir()
+	tarPath := filepath.Join(dir, "image.tar")
+	writeTar(t, tarPath, []tarEntry{
+		{name: "ok.txt", typeflag: tar.TypeReg, body: "fine"},
+		{name: "../escape.txt", typeflag: tar.TypeReg, body: "nope"},
+	})
+
+	err := ExtractTarball(tarPath, filepath.Join(dir, "out"), newTestValidator(), ExtractOptions{Parallel: true, Workers: 2})
+	if err == nil {
+		t.Fatal("expected path traversal to be rejected in parallel mode")
+	}
+}
+
+func benchmarkExtract(b *testing.B, opts ExtractOptions) {
+	dir := b.TempDir()
+	tarPath := filepath.Join(dir, "image.tar")
+	writeTar(b, tarPath, manyFilesTar(2000))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		destDir := filepath.Join(dir, fmt.Sprintf("out-%d", i))
+		if err := ExtractTarball(tarPath, destDir, newTestValidator(), opts); err != nil {
+			b.Fatalf("extraction failed: %v", err)
+		}
+		b.StopTimer()
+		os.RemoveAll(destDir)
+		b.StartTimer()
+	}
+}
+
+func BenchmarkExtractTarball_Sequential(b *testing.B) {
+	benchmarkExtract(b, ExtractOptions{})
+}
+
+func BenchmarkExtractTarball_Parallel(b *testing.B) {
+	benchmarkExtract(b, ExtractOptions{Parallel: true})
+}
+
+func benchmarkExtractBuffer(b *testing.B, bufferSize int) {
+	dir := b.TempDir()
+	tarPath := filepath.Join(dir, "image.tar")
+
+	const fileSize = 16 * 1024 * 1024
+	body := strings.Repeat("x", fileSize)
+	var entries []tarEntry
+	for i := 0; i < 4; i++ {
+		entries = append(entries, tarEntry{name: fmt.Sprintf("blob-%d.bin", i), typeflag: tar.TypeReg, body: body})
+	}
+	writeTar(b, tarPath, entries)
+	validator := security.NewValidator(fileSize, 1024*1024*1024, 1000.0)
+
+	b.SetBytes(int64(len(entries)) * fileSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		destDir := filepath.Join(dir, fmt.Sprintf("out-%d", i))
+		if err := ExtractTarball(tarPath, destDir, validator, ExtractOptions{CopyBufferSize: bufferSize}); err != nil {
+			b.Fatalf("extraction failed: %v", err)
+		}
+		b.StopTimer()
+		os.RemoveAll(destDir)
+		b.StartTimer()
+	}
+}
+
+func BenchmarkExtractTarball_Buffer32K(b *testing.B) {
+	benchmarkExtractBuffer(b, 32*1024)
+}
+
+func BenchmarkExtractTarball_Buffer1M(b *testing.B) {
+	benchmarkExtractBuffer(b, 1024*1024)
+}
+
+func TestExtractTarball_MaxTopLevelEntries(t *testing.T) {
+	singleRoot := []tarEntry{
+		{name: "rootfs/", typeflag: tar.TypeDir},
+		{name: "rootfs/etc/hostname", typeflag: tar.TypeReg, body: "alpine"},
+		{name: "rootfs/bin/sh", typeflag: tar.TypeReg, body: "#!shell"},
+		{name: "rootfs/usr/lib/libc", typeflag: tar.TypeReg, body: "libc"},
+	}
+	scattered := []tarEntry{
+		{name: "./", typeflag: tar.TypeDir},
+		{name: "./README", typeflag: tar.TypeReg, body: "readme"},
+		{name: "./Makefile", typeflag: tar.TypeReg, body: "all:"},
+		{name: "./main.c", typeflag: tar.TypeReg, body: "int main;"},
+		{name: "./util.c", typeflag: tar.TypeReg, body: "int util;"},
+	}
+
+	tests := []struct {
+		name    string
+		entries []tarEntry
+		opts    ExtractOptions
+		wantErr bool
+	}{
+		{name: "single root", entries: singleRoot, opts: ExtractOptions{MaxTopLevelEntries: 1}},
+		{name: "scattered", entries: scattered, opts: ExtractOptions{MaxTopLevelEntries: 3}, wantErr: true},
+		{name: "scattered within limit", entries: scattered, opts: ExtractOptions{MaxTopLevelEntries: 4}},
+		{name: "scattered in warn mode", entries: scattered, opts: ExtractOptions{MaxTopLevelEntries: 3, WarnTopLevelEntries: true}},
+		{name: "check disabled", entries: scattered},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tarPath := filepath.Join(t.TempDir(), "image.tar")
+			writeTar(t, tarPath, tt.entries)
+
+			err := ExtractTarball(tarPath, t.TempDir(), newTestValidator(), tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ExtractTarball error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && !errors.Is(err, ErrTarbomb) {
+				t.Errorf("error = %v, want ErrTarbomb", err)
+			}
+		})
+	}
+}
+
+func TestExtractTarball_ContentLongerThanDeclaredSize(t *testing.T) {
+	dir := t.TempDir()
+
+	// The header declares 4 bytes but 1KB of content follows it
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "etc/hostname", Typeflag: tar.TypeReg, Mode: 0644, Size: 4}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write([]byte("AAAA"))
+	tw.Flush()
+	buf.Write(bytes.Repeat([]byte("A"), 1024))
+	buf.Write(make([]byte, 1024))
+
+	tarPath := filepath.Join(dir, "image.tar")
+	if err := os.WriteFile(tarPath, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	destDir := filepath.Join(dir, "extracted")
+	if err := ExtractTarball(tarPath, destDir, newTestValidator(), ExtractOptions{}); err == nil {
+		t.Fatal("expected extraction to fail on content past the declared size")
+	}
+	if fi, err := os.Stat(filepath.Join(destDir, "etc/hostname")); err == nil && fi.Size() > 4 {
+		t.Errorf("etc/hostname is %d bytes, more than its declared 4", fi.Size())
+	}
+}
+
+func TestWriteFile_RejectsSizeMismatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		size    int64
+		wantErr bool
+	}{
+		{"exact", "hello", 5, false},
+		{"longer than declared", "hello world", 5, true},
+		{"shorter than declared", "hi", 5, true},
+		{"empty", "", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := filepath.Join(t.TempDir(), "file")
+			err := writeFile(target, strings.NewReader(tt.content), tt.size, 0644, nil)
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("writeFile: %v", err)
+				}
+				if got, _ := os.ReadFile(target); string(got) != tt.content {
+					t.Errorf("file content = %q, want %q", got, tt.content)
+				}
+				return
+			}
+			if !errors.Is(err, security.ErrRejected) {
+				t.Fatalf("writeFile err = %v, want security rejection", err)
+			}
+			if _, err := os.Stat(target); !os.IsNotExist(err) {
+				t.Errorf("file with mismatched size left behind, stat err: %v", err)
+			}
+		})
+	}
+}
+
+// fullDisk is a file that accepts limit bytes and then fails with ENOSPC
+type fullDisk struct {
+	f     *os.File
+	limit int
+}
+
+func (d *fullDisk) Write(p []byte) (int, error) {
+	if len(p) > d.limit {
+		n, _ := d.f.Write(p[:d.limit])
+		d.limit = 0
+		return n, &os.PathError{Op: "write", Path: d.f.Name(), Err: syscall.ENOSPC}
+	}
+	d.limit -= len(p)
+	return d.f.Write(p)
+}
+
+func (d *fullDisk) Close() error { return d.f.Close() }
+
+func TestExtractTarball_DiskFull(t *testing.T) {
+	dir := t.TempDir()
+	tarPath := filepath.Join(dir, "image.tar")
+	writeTar(t, tarPath, []tarEntry{
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/hostname", typeflag: tar.TypeReg, body: strings.Repeat("x", 4096)},
+	})
+
+	orig := createFile
+	defer func() { createFile = orig }()
+	createFile = func(name string, mode os.FileMode) (io.WriteCloser, error) {
+		f, err := orig(name, mode)
+		if err != nil {
+			return nil, err
+		}
+		return &fullDisk{f: f.(*os.File), limit: 1024}, nil
+	}
+
+	destDir := filepath.Join(dir, "extracted")
+	err := ExtractTarball(tarPath, destDir, newTestValidator(), ExtractOptions{})
+	if !errors.Is(err, ErrDiskFull) || !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("ExtractTarball err = %v, want ErrDiskFull wrapping ENOSPC", err)
+	}
+	if errors.Is(err, security.ErrRejected) {
+		t.Errorf("a full disk must not look like a bad archive: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(destDir, "etc/hostname")); !os.IsNotExist(err) {
+		t.Errorf("partial file left behind, stat err: %v", err)
+	}
+}
@@ -0,0 +1,39 @@
+package devicemapper
+
+import (
+	"fmt"
+
+	"github.com/fly-io/162719/pkg/errors"
+)
+
+// ErrFilesystemUncorrectable means e2fsck found errors it could not repair
+// automatically; the device must be reformatted before reuse
+var ErrFilesystemUncorrectable = errors.New("filesystem errors left uncorrected")
+
+// e2fsck exit status bits (see e2fsck(8))
+const (
+	fsckErrorsCorrected   = 1
+	fsckRebootRequired    = 2
+	fsckErrorsUncorrected = 4
+	fsckOperationalError  = 8
+)
+
+// fsckArgs builds the e2fsck arguments for devicePath. -p ("preen")
+// repairs anything safe to fix without asking.
+func fsckArgs(devicePath string) []string {
+	return []string{"-p", devicePath}
+}
+
+// fsckResult interprets an e2fsck exit status. Repaired filesystems are
+// usable; the reboot bit only concerns mounted root filesystems, which a
+// device checked before mounting never is.
+func fsckResult(exitCode int) error {
+	switch {
+	case exitCode&^(fsckErrorsCorrected|fsckRebootRequired) == 0:
+		return nil
+	case exitCode >= fsckOperationalError:
+		return fmt.Errorf("e2fsck failed with exit status %d", exitCode)
+	default:
+		return errors.Wrap(ErrFilesystemUncorrectable, fmt.Sprintf("e2fsck exit status %d", exitCode))
+	}
+}
@@ -0,0 +1,44 @@
+package devicemapper
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestFsckArgs(t *testing.T) {
+	got := strings.Join(fsckArgs("/dev/mapper/flyio-7"), " ")
+	want := "-p /dev/mapper/flyio-7"
+	if got != want {
+		t.Errorf("fsckArgs = %q, want %q", got, want)
+	}
+}
+
+func TestFsckResult(t *testing.T) {
+	tests := []struct {
+		exitCode     int
+		wantErr      bool
+		wantReformat bool
+	}{
+		{exitCode: 0},
+		{exitCode: 1},
+		{exitCode: 2},
+		{exitCode: 3},
+		{exitCode: 4, wantErr: true, wantReformat: true},
+		{exitCode: 5, wantErr: true, wantReformat: true},
+		{exitCode: 8, wantErr: true},
+		{exitCode: 12, wantErr: true},
+		{exitCode: 16, wantErr: true},
+		{exitCode: 32, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		err := fsckResult(tt.exitCode)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("fsckResult(%d) = %v, wantErr %v", tt.exitCode, err, tt.wantErr)
+		}
+		if got := errors.Is(err, ErrFilesystemUncorrectable); got != tt.wantReformat {
+			t.Errorf("fsckResult(%d) uncorrectable = %v, want %v", tt.exitCode, got, tt.wantReformat)
+		}
+	}
+}
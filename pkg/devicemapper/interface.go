@@ -11,22 +11,76 @@ type DeviceInfo struct {
 
 // Manager manages devicemapper thin volumes
 type Manager interface {
-	// CreateDevice creates a thin volume from extracted image
-	CreateDevice(ctx context.Context, extractedPath string, imageID string) (*DeviceInfo, error)
+	// CreateDevice creates a thin volume from extracted image, sizeBytes
+	// large (rounded up to whole MiB), or DefaultDeviceSectors if 0, in
+	// the pool its size selects (see WithPoolTiers). A device already
+	// mapped under the name is kept if it has that size and a clean
+	// filesystem, and recreated otherwise.
+	CreateDevice(ctx context.Context, extractedPath string, imageID string, sizeBytes int64) (*DeviceInfo, error)
 
-	// CreateSnapshot creates a snapshot of a device
-	CreateSnapshot(ctx context.Context, baseDeviceID string, snapshotID int) (*DeviceInfo, error)
+	// CreateSnapshot creates a snapshot of a device. The source may be a
+	// base device or an existing snapshot (producing a clone).
+	CreateSnapshot(ctx context.Context, sourceID string, snapshotID int) (*DeviceInfo, error)
+
+	// CreateSnapshots creates several snapshots, suspending each distinct
+	// source once for all of its snapshots. The results are indexed like
+	// specs: a failed spec has a nil DeviceInfo and a non-nil error, and
+	// doesn't stop the others.
+	CreateSnapshots(ctx context.Context, specs []SnapshotSpec) ([]*DeviceInfo, []error)
+
+	// ActivateSnapshot maps an existing snapshot's thin device without
+	// touching pool metadata. Activating an active snapshot is a no-op.
+	ActivateSnapshot(ctx context.Context, snapshotID int) (*DeviceInfo, error)
+
+	// DeactivateSnapshot unmaps a snapshot's thin device, leaving its
+	// data in the pool. Deactivating an inactive snapshot is a no-op.
+	DeactivateSnapshot(ctx context.Context, snapshotID int) error
+
+	// DeleteSnapshot deactivates a snapshot and deletes its thin device
+	// from the pool, releasing its blocks
+	DeleteSnapshot(ctx context.Context, snapshotID int) error
+
+	// CheckFilesystem runs e2fsck -p on an unmounted device, repairing
+	// what it safely can. It returns ErrFilesystemUncorrectable when the
+	// device needs reformatting.
+	CheckFilesystem(ctx context.Context, devicePath string) error
 
 	// MountDevice mounts a device to the specified path
 	MountDevice(ctx context.Context, devicePath, mountPath string) error
 
-	// UnmountDevice unmounts a device from the specified path
+	// UnmountDevice unmounts a device from the specified path, retrying
+	// with a lazy unmount if the mount is busy
 	UnmountDevice(ctx context.Context, mountPath string) error
 
+	// ForceUnmount lazily unmounts the specified path, detaching it even
+	// while busy
+	ForceUnmount(ctx context.Context, mountPath string) error
+
+	// MountTmpfs mounts a tmpfs of sizeBytes at path, creating path if
+	// needed. Unmount it with UnmountDevice.
+	MountTmpfs(ctx context.Context, path string, sizeBytes int64) error
+
+	// MountOverlay mounts an overlayfs at target with lower as its
+	// read-only layer and upper taking writes, creating upper, work and
+	// target if needed. Unmount it with UnmountDevice.
+	MountOverlay(ctx context.Context, lower, upper, work, target string) error
+
 	// DeleteDevice removes a device
 	DeleteDevice(ctx context.Context, deviceID string) error
 
-	// ListDevices lists all managed devices
+	// PoolStatus reports thin pool data and metadata usage
+	PoolStatus(ctx context.Context) (*PoolStatus, error)
+
+	// PoolStatusFor reports the usage of the pool CreateDevice would
+	// place a device of sizeBytes in
+	PoolStatusFor(ctx context.Context, sizeBytes int64) (*PoolStatus, error)
+
+	// DeviceStats reports how much of an active thin device (base device
+	// or snapshot) is backed by pool blocks
+	DeviceStats(ctx context.Context, deviceID string) (*DeviceStats, error)
+
+	// ListDevices lists the active base devices and snapshots under the
+	// manager's device prefix, including those mapped by earlier runs
 	ListDevices(ctx context.Context) ([]*DeviceInfo, error)
 
 	// Close cleans up resources
@@ -0,0 +1,127 @@
+package devicemapper
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/fly-io/162719/pkg/errors"
+	"github.com/fly-io/162719/pkg/security"
+)
+
+// IsolatedExtractCommand is the hidden subcommand the binary re-executes
+// itself as to extract a tarball in isolation; see RunIsolatedExtract
+const IsolatedExtractCommand = "extract-isolated"
+
+// IsolatedExitRejected is the exit code of an isolated extraction that
+// rejected its archive, as opposed to failing to extract it
+const IsolatedExitRejected = 5
+
+// IsolatedExitDiskFull is the exit code of an isolated extraction that
+// ran out of space
+const IsolatedExitDiskFull = 7
+
+// IsolatedSpec carries the validator limits and options of an isolated
+// extraction to the child process
+type IsolatedSpec struct {
+	MaxFileSize         int64          `json:"max_file_size"`
+	MaxTotalSize        int64          `json:"max_total_size"`
+	MaxCompressionRatio float64        `json:"max_compression_ratio"`
+	MaxSymlinkTarget    int            `json:"max_symlink_target"`
+	SymlinkAllowlist    []string       `json:"symlink_allowlist,omitempty"`
+	Options             ExtractOptions `json:"options"`
+}
+
+// isolatedExtractCmd builds the command re-executing exe to extract the
+// tar stream on its stdin into destDir
+func isolatedExtractCmd(exe, destDir string, spec IsolatedSpec) (*exec.Cmd, error) {
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode isolated extraction spec: %w", err)
+	}
+	cmd := exec.Command(exe, IsolatedExtractCommand, destDir, string(data))
+	cmd.SysProcAttr = isolationAttr()
+	return cmd, nil
+}
+
+// extractIsolated extracts tarPath into destDir in a child process
+// confined to a new mount namespace chrooted at destDir, so a bug in path
+// validation can't reach the real root. The child applies validator's
+// limits to its own copy; validator itself is left untouched.
+func extractIsolated(tarPath, destDir string, validator *security.Validator, opts ExtractOptions) error {
+	if !isolationSupported {
+		return fmt.Errorf("isolated extraction is only supported on Linux")
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find executable: %w", err)
+	}
+	f, err := os.Open(tarPath)
+	if err != nil {
+		return fmt.Errorf("failed to open tar: %w", err)
+	}
+	defer f.Close()
+
+	spec := IsolatedSpec{Options: opts}
+	spec.Options.Isolate = false
+	spec.MaxFileSize, spec.MaxTotalSize, spec.MaxCompressionRatio = validator.Limits()
+	spec.MaxSymlinkTarget = validator.MaxSymlinkTarget()
+	spec.SymlinkAllowlist = validator.AbsoluteSymlinkAllowlist()
+
+	cmd, err := isolatedExtractCmd(exe, destDir, spec)
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	cmd.Stdin = f
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
+
+	return isolatedResult(cmd.Run(), stderr.String())
+}
+
+// isolatedResult turns the outcome of an isolated extraction into an
+// error, using the child's last line of output as its message
+func isolatedResult(runErr error, output string) error {
+	if runErr == nil {
+		return nil
+	}
+	msg := runErr.Error()
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if last := strings.TrimSpace(lines[len(lines)-1]); last != "" {
+		msg = strings.TrimPrefix(last, "Error: ")
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(runErr, &exitErr) {
+		switch exitErr.ExitCode() {
+		case IsolatedExitRejected:
+			return errors.Fatal(fmt.Errorf("%w: isolated extraction: %s", security.ErrRejected, msg))
+		case IsolatedExitDiskFull:
+			return fmt.Errorf("%w: isolated extraction: %s", ErrDiskFull, msg)
+		}
+	}
+	return fmt.Errorf("isolated extraction failed: %s", msg)
+}
+
+// RunIsolatedExtract is the child side of an isolated extraction. It
+// decodes specJSON, confines the process to destDir and extracts the tar
+// stream r there. The process must already be in its own mount namespace.
+func RunIsolatedExtract(destDir, specJSON string, r io.Reader) error {
+	var spec IsolatedSpec
+	if err := json.Unmarshal([]byte(specJSON), &spec); err != nil {
+		return fmt.Errorf("invalid isolated extraction spec: %w", err)
+	}
+	if err := confine(destDir); err != nil {
+		return err
+	}
+	validator := security.NewValidator(spec.MaxFileSize, spec.MaxTotalSize, spec.MaxCompressionRatio,
+		security.WithMaxSymlinkTarget(spec.MaxSymlinkTarget),
+		security.WithAbsoluteSymlinkAllowlist(spec.SymlinkAllowlist...))
+	return ExtractStream(r, "/", validator, spec.Options)
+}
@@ -0,0 +1,30 @@
+//go:build linux
+
+package devicemapper
+
+import (
+	"fmt"
+	"syscall"
+)
+
+const isolationSupported = true
+
+// isolationAttr starts the child in a new mount namespace
+func isolationAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNS}
+}
+
+// confine stops mount events propagating back to the host and chroots
+// into dir
+func confine(dir string) error {
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("failed to make mounts private: %w", err)
+	}
+	if err := syscall.Chroot(dir); err != nil {
+		return fmt.Errorf("failed to chroot to %s: %w", dir, err)
+	}
+	if err := syscall.Chdir("/"); err != nil {
+		return fmt.Errorf("failed to chdir into chroot: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package devicemapper
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+)
+
+const isolationSupported = false
+
+func isolationAttr() *syscall.SysProcAttr {
+	return nil
+}
+
+func confine(dir string) error {
+	return fmt.Errorf("isolated extraction not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,78 @@
+package devicemapper
+
+import (
+	"encoding/json"
+	"errors"
+	"os/exec"
+	"reflect"
+	"runtime"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/fly-io/162719/pkg/security"
+)
+
+func TestIsolatedExtractCmd(t *testing.T) {
+	spec := IsolatedSpec{
+		MaxFileSize:         1024,
+		MaxTotalSize:        4096,
+		MaxCompressionRatio: 50,
+		Options:             ExtractOptions{MaxTopLevelEntries: 3, SkipCompressionRatio: true},
+	}
+	cmd, err := isolatedExtractCmd("/usr/bin/flyio-machine", "/work/extracted/.abc.tmp-1", spec)
+	if err != nil {
+		t.Fatalf("isolatedExtractCmd failed: %v", err)
+	}
+
+	if len(cmd.Args) != 4 || cmd.Args[0] != "/usr/bin/flyio-machine" || cmd.Args[1] != IsolatedExtractCommand || cmd.Args[2] != "/work/extracted/.abc.tmp-1" {
+		t.Fatalf("args = %q, want [exe %s dest spec]", cmd.Args, IsolatedExtractCommand)
+	}
+	var got IsolatedSpec
+	if err := json.Unmarshal([]byte(cmd.Args[3]), &got); err != nil {
+		t.Fatalf("spec argument is not JSON: %v", err)
+	}
+	if !reflect.DeepEqual(got, spec) {
+		t.Errorf("spec = %+v, want %+v", got, spec)
+	}
+
+	if runtime.GOOS == "linux" {
+		if cmd.SysProcAttr == nil || cmd.SysProcAttr.Cloneflags&syscall.CLONE_NEWNS == 0 {
+			t.Errorf("child is not started in a new mount namespace: %+v", cmd.SysProcAttr)
+		}
+	}
+}
+
+func TestIsolatedResult(t *testing.T) {
+	exitWith := func(code int) error {
+		return exec.Command("sh", "-c", "exit "+strconv.Itoa(code)).Run()
+	}
+
+	if err := isolatedResult(nil, "logs\n"); err != nil {
+		t.Errorf("success returned %v", err)
+	}
+
+	rejected := isolatedResult(exitWith(IsolatedExitRejected), "level=INFO msg=extracting\nError: security: path traversal detected: ../etc\n")
+	if !errors.Is(rejected, security.ErrRejected) {
+		t.Errorf("rejection = %v, want ErrRejected", rejected)
+	}
+	if want := "security: isolated extraction: security: path traversal detected: ../etc"; rejected == nil || rejected.Error() != want {
+		t.Errorf("rejection message = %v, want %q", rejected, want)
+	}
+
+	full := isolatedResult(exitWith(IsolatedExitDiskFull), "Error: disk full: failed to write /usr/lib/libc.so: no space left on device\n")
+	if !errors.Is(full, ErrDiskFull) || errors.Is(full, security.ErrRejected) {
+		t.Errorf("disk full = %v, want ErrDiskFull", full)
+	}
+
+	failed := isolatedResult(exitWith(1), "Error: failed to chroot to /x: operation not permitted\n")
+	if failed == nil || errors.Is(failed, security.ErrRejected) {
+		t.Errorf("failure = %v, want a plain error", failed)
+	}
+}
+
+func TestRunIsolatedExtract_RejectsBadSpec(t *testing.T) {
+	if err := RunIsolatedExtract(t.TempDir(), "{not json", nil); err == nil {
+		t.Error("RunIsolatedExtract accepted an invalid spec")
+	}
+}
@@ -0,0 +1,45 @@
+package devicemapper
+
+import "log/slog"
+
+// leftoverAction is what CreateDevice does about a device already mapped
+// under the name it is about to create, e.g. one left by a crashed run
+type leftoverAction int
+
+const (
+	leftoverNone     leftoverAction = iota // nothing mapped: create the device
+	leftoverReuse                          // keep the device and its filesystem
+	leftoverRecreate                       // remove the device and create it afresh
+)
+
+// decideLeftover picks what to do about the device at the target name. A
+// leftover is reused only if its live table has wantSectors and its
+// filesystem checks clean; anything else, including a device that was
+// never formatted, is recreated. table and fsck are only called when the
+// device exists.
+func decideLeftover(exists bool, wantSectors int64, table func() (string, error), fsck func() error) leftoverAction {
+	if !exists {
+		return leftoverNone
+	}
+
+	live, err := table()
+	if err != nil {
+		slog.Warn("leftover_device_table_unreadable", "error", err)
+		return leftoverRecreate
+	}
+	sectors, err := parseThinSectors(live)
+	if err != nil {
+		slog.Warn("leftover_device_table_unreadable", "error", err)
+		return leftoverRecreate
+	}
+	if sectors != wantSectors {
+		slog.Warn("leftover_device_size_mismatch", "sectors", sectors, "want_sectors", wantSectors)
+		return leftoverRecreate
+	}
+
+	if err := fsck(); err != nil {
+		slog.Warn("leftover_device_filesystem_unusable", "error", err)
+		return leftoverRecreate
+	}
+	return leftoverReuse
+}
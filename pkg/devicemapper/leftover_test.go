@@ -0,0 +1,46 @@
+package devicemapper
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDecideLeftover(t *testing.T) {
+	const want = 2097152
+	table := func(sectors string) func() (string, error) {
+		return func() (string, error) {
+			return "0 " + sectors + " thin /dev/mapper/pool 7\n", nil
+		}
+	}
+	clean := func() error { return nil }
+
+	tests := []struct {
+		name   string
+		exists bool
+		table  func() (string, error)
+		fsck   func() error
+		want   leftoverAction
+	}{
+		{"nothing mapped", false, nil, nil, leftoverNone},
+		{"clean and same size", true, table("2097152"), clean, leftoverReuse},
+		{"other size", true, table("4194304"), clean, leftoverRecreate},
+		{"unreadable table", true, func() (string, error) { return "", errors.New("no such device") }, clean, leftoverRecreate},
+		{"not a thin device", true, func() (string, error) { return "0 2097152 linear /dev/sda 0", nil }, clean, leftoverRecreate},
+		{"uncorrectable filesystem", true, table("2097152"), func() error { return ErrFilesystemUncorrectable }, leftoverRecreate},
+		// Crashed before mkfs: e2fsck finds no filesystem at all
+		{"never formatted", true, table("2097152"), func() error { return errors.New("e2fsck failed with exit status 8") }, leftoverRecreate},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A missing device must not be probed
+			if tt.table == nil {
+				tt.table = func() (string, error) { t.Fatal("table read for a missing device"); return "", nil }
+				tt.fsck = func() error { t.Fatal("fsck run on a missing device"); return nil }
+			}
+			if got := decideLeftover(tt.exists, want, tt.table, tt.fsck); got != tt.want {
+				t.Errorf("decideLeftover = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
@@ -19,10 +20,18 @@ type LinuxManager struct {
 	dataSize     int64
 	metadataSize int64
 	devices      map[string]*DeviceInfo
+	options      managerOptions
+
+	// pools maps the thin devices this process created or activated to
+	// the pool holding them
+	pools map[string]string
+
+	// poolStatus reads pool usage for the metadata guard; replaced in tests
+	poolStatus func(ctx context.Context, pool string) (*PoolStatus, error)
 }
 
 // NewManager creates a Linux devicemapper manager
-func NewManager(poolName string, dataSize, metadataSize int64) (Manager, error) {
+func NewManager(poolName string, dataSize, metadataSize int64, opts ...ManagerOption) (Manager, error) {
 	slog.Info("devicemapper_init", "pool", poolName, "platform", "linux")
 
 	if !isRoot() {
@@ -35,6 +44,12 @@ func NewManager(poolName string, dataSize, metadataSize int64) (Manager, error)
 		dataSize:     dataSize,
 		metadataSize: metadataSize,
 		devices:      make(map[string]*DeviceInfo),
+		options:      defaultManagerOptions(),
+		pools:        make(map[string]string),
+	}
+	m.poolStatus = m.readPoolStatus
+	for _, opt := range opts {
+		opt(&m.options)
 	}
 
 	if err := m.initThinpool(); err != nil {
@@ -46,12 +61,43 @@ func NewManager(poolName string, dataSize, metadataSize int64) (Manager, error)
 	return m, nil
 }
 
-func (m *LinuxManager) CreateDevice(ctx context.Context, extractedPath string, deviceID string) (*DeviceInfo, error) {
-	slog.Info("create_device_start", "device_id", deviceID, "pool", m.poolName)
+func (m *LinuxManager) CreateDevice(ctx context.Context, extractedPath string, deviceID string, sizeBytes int64) (*DeviceInfo, error) {
+	sectors := DeviceSectors(sizeBytes)
+	pool := m.devicePool(sizeBytes)
+	slog.Info("create_device_start", "device_id", deviceID, "pool", pool)
+
+	if err := m.guardMetadataSpace(ctx, pool); err != nil {
+		return nil, err
+	}
 
 	// deviceID is numeric (from database AUTOINCREMENT id)
-	deviceName := fmt.Sprintf("flyio-%s", deviceID)
-	poolDevicePath := filepath.Join("/dev/mapper", m.poolName)
+	deviceName := m.deviceName(deviceID)
+	poolDevicePath := m.poolPath(pool)
+	devicePath := filepath.Join("/dev/mapper", deviceName)
+
+	// A crashed run can leave the device mapped, and dmsetup create
+	// refuses a name that already exists
+	_, statErr := os.Stat(devicePath)
+	action := decideLeftover(statErr == nil, sectors,
+		func() (string, error) {
+			out, err := exec.CommandContext(ctx, "dmsetup", "table", deviceName).Output()
+			return string(out), err
+		},
+		func() error { return m.CheckFilesystem(ctx, devicePath) })
+	switch action {
+	case leftoverReuse:
+		slog.Warn("existing_device_reused", "device_id", deviceID, "device_path", devicePath)
+		info := &DeviceInfo{DevicePath: devicePath, Size: sectors * DefaultSectorSize}
+		m.devices[deviceID] = info
+		m.pools[deviceID] = pool
+		return info, nil
+	case leftoverRecreate:
+		slog.Warn("existing_device_removed", "device_id", deviceID, "device_path", devicePath)
+		if err := exec.CommandContext(ctx, "dmsetup", "remove", deviceName).Run(); err != nil {
+			slog.Error("existing_device_removal_failed", "device_name", deviceName, "error", err)
+			return nil, errors.Wrap(err, "failed to remove existing device")
+		}
+	}
 
 	// Step 1: Create thin device metadata in pool
 	// Try to delete existing device first (idempotency)
@@ -69,8 +115,6 @@ func (m *LinuxManager) CreateDevice(ctx context.Context, extractedPath string, d
 	}
 
 	// Step 2: Activate device with dmsetup create
-	// Size: 1GB = 2097152 sectors (512 bytes each)
-	sectors := int64(2097152)
 	tableSpec := fmt.Sprintf("0 %d thin %s %s", sectors, poolDevicePath, deviceID)
 	slog.Info("activate_device", "device_name", deviceName, "sectors", sectors)
 
@@ -80,8 +124,6 @@ func (m *LinuxManager) CreateDevice(ctx context.Context, extractedPath string, d
 		return nil, errors.Wrap(err, "failed to activate device")
 	}
 
-	devicePath := filepath.Join("/dev/mapper", deviceName)
-
 	// Step 3: Format with ext4 filesystem
 	slog.Info("format_device", "device_path", devicePath, "filesystem", "ext4")
 	cmd = exec.CommandContext(ctx, "mkfs.ext4", "-F", devicePath)
@@ -93,39 +135,73 @@ func (m *LinuxManager) CreateDevice(ctx context.Context, extractedPath string, d
 	info := &DeviceInfo{
 		DevicePath: devicePath,
 		SnapshotID: 0,
-		Size:       sectors * 512, // Convert sectors to bytes
+		Size:       sectors * DefaultSectorSize, // Convert sectors to bytes
 	}
 
 	m.devices[deviceID] = info
+	m.pools[deviceID] = pool
 
-	slog.Info("create_device_complete", "device_id", deviceID, "device_path", devicePath, "size_mb", info.Size/1024/1024)
+	slog.Info("create_device_complete", "device_id", deviceID, "device_path", devicePath, "size_mb", info.Size/1024/1024, "pool", pool)
 	return info, nil
 }
 
-func (m *LinuxManager) CreateSnapshot(ctx context.Context, baseDeviceID string, snapshotID int) (*DeviceInfo, error) {
+func (m *LinuxManager) CreateSnapshot(ctx context.Context, sourceID string, snapshotID int) (*DeviceInfo, error) {
 	snapshotIDStr := fmt.Sprintf("%d", snapshotID)
-	snapshotName := fmt.Sprintf("flyio-snapshot-%d", snapshotID)
-	poolDevicePath := filepath.Join("/dev/mapper", m.poolName)
+	snapshotName := m.snapshotName(snapshotIDStr)
+	pool, err := m.sourcePool(ctx, sourceID)
+	if err != nil {
+		slog.Error("snapshot_source_pool_unknown", "source_id", sourceID, "error", err)
+		return nil, err
+	}
+	poolDevicePath := m.poolPath(pool)
 
-	slog.Info("create_snapshot_start", "base_device_id", baseDeviceID, "snapshot_id", snapshotID)
+	slog.Info("create_snapshot_start", "source_id", sourceID, "snapshot_id", snapshotID, "pool", pool)
 
-	// Step 1: Create snapshot from base device
+	if err := m.guardMetadataSpace(ctx, pool); err != nil {
+		return nil, err
+	}
+
+	// Step 1: Create snapshot from source device (base device or snapshot)
 	// Try to delete existing snapshot first (idempotency)
 	slog.Info("delete_existing_snapshot", "snapshot_id", snapshotID)
 	deleteCmd := exec.CommandContext(ctx, "dmsetup", "message", poolDevicePath, "0",
 		fmt.Sprintf("delete %s", snapshotIDStr))
 	deleteCmd.Run() // Ignore errors - snapshot may not exist
 
-	slog.Info("create_snapshot_metadata", "snapshot_id", snapshotID, "base_device_id", baseDeviceID)
+	// The snapshot's logical size must match its source
+	sectors := sourceSectors(m.devices, sourceID, func() (string, error) {
+		name := m.activeDeviceName(sourceID)
+		if name == "" {
+			return "", fmt.Errorf("device %s is not active", sourceID)
+		}
+		out, err := exec.CommandContext(ctx, "dmsetup", "table", name).Output()
+		return string(out), err
+	})
+
+	// An active origin must be suspended while the snapshot is taken,
+	// otherwise in-flight writes can leave the snapshot inconsistent
+	if originName := m.activeDeviceName(sourceID); originName != "" {
+		slog.Info("suspend_origin", "origin_name", originName)
+		if err := exec.CommandContext(ctx, "dmsetup", "suspend", originName).Run(); err != nil {
+			slog.Error("origin_suspend_failed", "origin_name", originName, "error", err)
+			return nil, errors.Wrap(err, "failed to suspend origin device")
+		}
+		defer func() {
+			if err := exec.Command("dmsetup", "resume", originName).Run(); err != nil {
+				slog.Error("origin_resume_failed", "origin_name", originName, "error", err)
+			}
+		}()
+	}
+
+	slog.Info("create_snapshot_metadata", "snapshot_id", snapshotID, "source_id", sourceID)
 	cmd := exec.CommandContext(ctx, "dmsetup", "message", poolDevicePath, "0",
-		fmt.Sprintf("create_snap %s %s", snapshotIDStr, baseDeviceID))
+		fmt.Sprintf("create_snap %s %s", snapshotIDStr, sourceID))
 	if err := cmd.Run(); err != nil {
 		slog.Error("snapshot_metadata_failed", "snapshot_id", snapshotID, "error", err)
 		return nil, errors.Wrap(err, "failed to create snapshot metadata")
 	}
 
 	// Step 2: Activate snapshot device
-	sectors := int64(2097152) // 1GB
 	tableSpec := fmt.Sprintf("0 %d thin %s %s", sectors, poolDevicePath, snapshotIDStr)
 	slog.Info("activate_snapshot", "snapshot_name", snapshotName, "sectors", sectors)
 
@@ -140,16 +216,271 @@ func (m *LinuxManager) CreateSnapshot(ctx context.Context, baseDeviceID string,
 	info := &DeviceInfo{
 		DevicePath: snapshotPath,
 		SnapshotID: snapshotID,
-		Size:       sectors * 512,
+		Size:       sectors * DefaultSectorSize,
 	}
 
+	// Track the snapshot so clones of it inherit its size and pool too
+	m.devices[snapshotIDStr] = info
+	m.pools[snapshotIDStr] = pool
+
 	slog.Info("create_snapshot_complete", "snapshot_id", snapshotID, "snapshot_path", snapshotPath, "size_mb", info.Size/1024/1024)
 	return info, nil
 }
 
+func (m *LinuxManager) CreateSnapshots(ctx context.Context, specs []SnapshotSpec) ([]*DeviceInfo, []error) {
+	infos := make([]*DeviceInfo, len(specs))
+	groups, errs := groupSnapshotSpecs(specs)
+	slog.Info("create_snapshots_start", "snapshots", len(specs), "sources", len(groups))
+
+	// One metadata check per pool covers the batch
+	guarded := make(map[string]error)
+	for _, group := range groups {
+		pool, err := m.sourcePool(ctx, group.sourceID)
+		if err != nil {
+			slog.Error("snapshot_source_pool_unknown", "source_id", group.sourceID, "error", err)
+			for _, i := range group.indices {
+				errs[i] = err
+			}
+			continue
+		}
+		guardErr, checked := guarded[pool]
+		if !checked {
+			guardErr = m.guardMetadataSpace(ctx, pool)
+			guarded[pool] = guardErr
+		}
+		if guardErr != nil {
+			for _, i := range group.indices {
+				errs[i] = guardErr
+			}
+			continue
+		}
+		m.createSnapshotGroup(ctx, pool, group, specs, infos, errs)
+	}
+
+	failed := 0
+	for _, err := range errs {
+		if err != nil {
+			failed++
+		}
+	}
+	slog.Info("create_snapshots_complete", "snapshots", len(specs), "failed", failed)
+	return infos, errs
+}
+
+// createSnapshotGroup creates the snapshots of one source in its pool,
+// sending every create_snap message under a single suspend of the origin
+// before activating them, and fills in infos and errs at the group's
+// indices
+func (m *LinuxManager) createSnapshotGroup(ctx context.Context, pool string, group snapshotGroup, specs []SnapshotSpec, infos []*DeviceInfo, errs []error) {
+	poolDevicePath := m.poolPath(pool)
+	sourceID := group.sourceID
+
+	sectors := sourceSectors(m.devices, sourceID, func() (string, error) {
+		name := m.activeDeviceName(sourceID)
+		if name == "" {
+			return "", fmt.Errorf("device %s is not active", sourceID)
+		}
+		out, err := exec.CommandContext(ctx, "dmsetup", "table", name).Output()
+		return string(out), err
+	})
+
+	func() {
+		if originName := m.activeDeviceName(sourceID); originName != "" {
+			slog.Info("suspend_origin", "origin_name", originName, "snapshots", len(group.indices))
+			if err := exec.CommandContext(ctx, "dmsetup", "suspend", originName).Run(); err != nil {
+				slog.Error("origin_suspend_failed", "origin_name", originName, "error", err)
+				for _, i := range group.indices {
+					errs[i] = errors.Wrap(err, "failed to suspend origin device")
+				}
+				return
+			}
+			defer func() {
+				if err := exec.Command("dmsetup", "resume", originName).Run(); err != nil {
+					slog.Error("origin_resume_failed", "origin_name", originName, "error", err)
+				}
+			}()
+		}
+
+		for _, i := range group.indices {
+			snapshotIDStr := fmt.Sprintf("%d", specs[i].SnapshotID)
+			// Drop any earlier snapshot with this ID (idempotency)
+			exec.CommandContext(ctx, "dmsetup", "message", poolDevicePath, "0",
+				fmt.Sprintf("delete %s", snapshotIDStr)).Run()
+			cmd := exec.CommandContext(ctx, "dmsetup", "message", poolDevicePath, "0",
+				fmt.Sprintf("create_snap %s %s", snapshotIDStr, sourceID))
+			if err := cmd.Run(); err != nil {
+				slog.Error("snapshot_metadata_failed", "snapshot_id", specs[i].SnapshotID, "error", err)
+				errs[i] = errors.Wrap(err, "failed to create snapshot metadata")
+			}
+		}
+	}()
+
+	for _, i := range group.indices {
+		if errs[i] != nil {
+			continue
+		}
+		snapshotIDStr := fmt.Sprintf("%d", specs[i].SnapshotID)
+		snapshotName := m.snapshotName(snapshotIDStr)
+		tableSpec := fmt.Sprintf("0 %d thin %s %s", sectors, poolDevicePath, snapshotIDStr)
+		if err := exec.CommandContext(ctx, "dmsetup", "create", snapshotName, "--table", tableSpec).Run(); err != nil {
+			slog.Error("snapshot_activation_failed", "snapshot_name", snapshotName, "error", err)
+			errs[i] = errors.Wrap(err, "failed to activate snapshot")
+			continue
+		}
+
+		info := &DeviceInfo{
+			DevicePath: filepath.Join("/dev/mapper", snapshotName),
+			SnapshotID: specs[i].SnapshotID,
+			Size:       sectors * DefaultSectorSize,
+		}
+		m.devices[snapshotIDStr] = info
+		m.pools[snapshotIDStr] = pool
+		infos[i] = info
+	}
+}
+
+func (m *LinuxManager) ActivateSnapshot(ctx context.Context, snapshotID int) (*DeviceInfo, error) {
+	snapshotIDStr := fmt.Sprintf("%d", snapshotID)
+	snapshotName := m.snapshotName(snapshotIDStr)
+	snapshotPath := filepath.Join("/dev/mapper", snapshotName)
+
+	slog.Info("activate_snapshot_start", "snapshot_id", snapshotID)
+
+	if _, err := os.Stat(snapshotPath); err == nil {
+		slog.Info("snapshot_already_active", "snapshot_name", snapshotName)
+		info, ok := m.devices[snapshotIDStr]
+		if !ok {
+			info = &DeviceInfo{DevicePath: snapshotPath, SnapshotID: snapshotID}
+		}
+		return info, nil
+	}
+
+	// The thin device already exists in the pool, so only the mapping is
+	// created; no create_snap message is sent
+	sectors := sourceSectors(m.devices, snapshotIDStr, func() (string, error) {
+		return "", fmt.Errorf("snapshot %d is not active", snapshotID)
+	})
+
+	// A snapshot this process didn't create may be in any pool; the
+	// mapping only loads against the pool that holds it
+	pools := poolNames(m.poolName, m.options.poolTiers)
+	if pool, ok := m.pools[snapshotIDStr]; ok {
+		pools = []string{pool}
+	}
+	var err error
+	for _, pool := range pools {
+		tableSpec := fmt.Sprintf("0 %d thin %s %s", sectors, m.poolPath(pool), snapshotIDStr)
+		if err = exec.CommandContext(ctx, "dmsetup", "create", snapshotName, "--table", tableSpec).Run(); err == nil {
+			m.pools[snapshotIDStr] = pool
+			break
+		}
+	}
+	if err != nil {
+		slog.Error("snapshot_activation_failed", "snapshot_name", snapshotName, "error", err)
+		return nil, errors.Wrap(err, "failed to activate snapshot")
+	}
+
+	info := &DeviceInfo{
+		DevicePath: snapshotPath,
+		SnapshotID: snapshotID,
+		Size:       sectors * DefaultSectorSize,
+	}
+	m.devices[snapshotIDStr] = info
+
+	slog.Info("activate_snapshot_complete", "snapshot_id", snapshotID, "snapshot_path", snapshotPath)
+	return info, nil
+}
+
+func (m *LinuxManager) DeactivateSnapshot(ctx context.Context, snapshotID int) error {
+	snapshotName := m.snapshotName(fmt.Sprintf("%d", snapshotID))
+	slog.Info("deactivate_snapshot", "snapshot_id", snapshotID, "snapshot_name", snapshotName)
+
+	if _, err := os.Stat(filepath.Join("/dev/mapper", snapshotName)); os.IsNotExist(err) {
+		slog.Info("snapshot_not_active", "snapshot_name", snapshotName)
+		return nil
+	}
+
+	// Only the mapping is removed; the thin device stays in the pool so
+	// the snapshot can be activated again
+	cmd := exec.CommandContext(ctx, "dmsetup", "remove", snapshotName)
+	if err := cmd.Run(); err != nil {
+		slog.Error("snapshot_deactivation_failed", "snapshot_name", snapshotName, "error", err)
+		return errors.Wrap(err, "failed to deactivate snapshot")
+	}
+
+	slog.Info("deactivate_snapshot_complete", "snapshot_id", snapshotID)
+	return nil
+}
+
+func (m *LinuxManager) DeleteSnapshot(ctx context.Context, snapshotID int) error {
+	if err := m.DeactivateSnapshot(ctx, snapshotID); err != nil {
+		return err
+	}
+
+	// A snapshot this process didn't create may be in any pool; device
+	// IDs are unique across pools, so only the one holding it accepts
+	snapshotIDStr := fmt.Sprintf("%d", snapshotID)
+	pools := poolNames(m.poolName, m.options.poolTiers)
+	if pool, ok := m.pools[snapshotIDStr]; ok {
+		pools = []string{pool}
+	}
+	var err error
+	for _, pool := range pools {
+		cmd := exec.CommandContext(ctx, "dmsetup", "message", m.poolPath(pool), "0",
+			fmt.Sprintf("delete %s", snapshotIDStr))
+		if err = cmd.Run(); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		slog.Error("snapshot_deletion_failed", "snapshot_id", snapshotID, "error", err)
+		return errors.Wrap(err, "failed to delete snapshot")
+	}
+
+	delete(m.devices, snapshotIDStr)
+	delete(m.pools, snapshotIDStr)
+	slog.Info("snapshot_deleted", "snapshot_id", snapshotID)
+	return nil
+}
+
+func (m *LinuxManager) CheckFilesystem(ctx context.Context, devicePath string) error {
+	slog.Info("check_filesystem", "device_path", devicePath)
+
+	err := exec.CommandContext(ctx, "e2fsck", fsckArgs(devicePath)...).Run()
+	exitCode := 0
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return errors.Wrap(err, "failed to run e2fsck")
+		}
+		exitCode = exitErr.ExitCode()
+	}
+
+	if err := fsckResult(exitCode); err != nil {
+		slog.Error("check_filesystem_failed", "device_path", devicePath, "exit_code", exitCode, "error", err)
+		return err
+	}
+
+	slog.Info("check_filesystem_complete", "device_path", devicePath, "exit_code", exitCode)
+	return nil
+}
+
 func (m *LinuxManager) MountDevice(ctx context.Context, devicePath, mountPath string) error {
 	slog.Info("mount_device", "device_path", devicePath, "mount_path", mountPath)
 
+	// A retry may find the device still mounted from a previous attempt
+	entry, mounted, err := mountAt(procMountsPath, mountPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to check existing mounts")
+	}
+	if mounted {
+		if sameDevice(entry.Source, devicePath) {
+			slog.Info("mount_already_present", "device_path", devicePath, "mount_path", mountPath)
+			return nil
+		}
+		return fmt.Errorf("mount path %s is already in use by %s", mountPath, entry.Source)
+	}
+
 	// Mount the device to the specified path
 	cmd := exec.CommandContext(ctx, "mount", devicePath, mountPath)
 	if err := cmd.Run(); err != nil {
@@ -164,9 +495,18 @@ func (m *LinuxManager) MountDevice(ctx context.Context, devicePath, mountPath st
 func (m *LinuxManager) UnmountDevice(ctx context.Context, mountPath string) error {
 	slog.Info("unmount_device", "mount_path", mountPath)
 
-	// Unmount the device from the specified path
-	cmd := exec.CommandContext(ctx, "umount", mountPath)
-	if err := cmd.Run(); err != nil {
+	_, mounted, err := mountAt(procMountsPath, mountPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to check existing mounts")
+	}
+	if !mounted {
+		slog.Info("unmount_not_mounted", "mount_path", mountPath)
+		return nil
+	}
+
+	// Unmount the device from the specified path, falling back to a lazy
+	// unmount if it is busy
+	if err := unmountWithFallback(ctx, mountPath, runCommand); err != nil {
 		slog.Error("unmount_failed", "mount_path", mountPath, "error", err)
 		return errors.Wrap(err, "failed to unmount device")
 	}
@@ -175,8 +515,90 @@ func (m *LinuxManager) UnmountDevice(ctx context.Context, mountPath string) erro
 	return nil
 }
 
+func (m *LinuxManager) ForceUnmount(ctx context.Context, mountPath string) error {
+	slog.Info("force_unmount", "mount_path", mountPath)
+
+	_, mounted, err := mountAt(procMountsPath, mountPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to check existing mounts")
+	}
+	if !mounted {
+		slog.Info("unmount_not_mounted", "mount_path", mountPath)
+		return nil
+	}
+
+	if err := runCommand(ctx, "umount", umountArgs(mountPath, true)...); err != nil {
+		slog.Error("force_unmount_failed", "mount_path", mountPath, "error", err)
+		return errors.Wrap(err, "failed to force unmount device")
+	}
+
+	slog.Info("force_unmount_complete", "mount_path", mountPath)
+	return nil
+}
+
+func (m *LinuxManager) MountTmpfs(ctx context.Context, path string, sizeBytes int64) error {
+	slog.Info("mount_tmpfs", "path", path, "size_mb", sizeBytes/1024/1024)
+
+	if sizeBytes <= 0 {
+		return fmt.Errorf("tmpfs size must be positive, got %d", sizeBytes)
+	}
+
+	// Stacking a tmpfs over an existing mount would hide its contents and
+	// leave the caller's unmount to tear down someone else's mount
+	entry, mounted, err := mountAt(procMountsPath, path)
+	if err != nil {
+		return errors.Wrap(err, "failed to check existing mounts")
+	}
+	if mounted {
+		return fmt.Errorf("%s is already a mount point (%s %s)", path, entry.FSType, entry.Source)
+	}
+
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return errors.Wrap(err, "failed to create tmpfs mount point")
+	}
+
+	if err := runCommand(ctx, "mount", tmpfsMountArgs(path, sizeBytes)...); err != nil {
+		slog.Error("mount_tmpfs_failed", "path", path, "error", err)
+		return errors.Wrap(err, "failed to mount tmpfs")
+	}
+
+	slog.Info("mount_tmpfs_complete", "path", path)
+	return nil
+}
+
+func (m *LinuxManager) MountOverlay(ctx context.Context, lower, upper, work, target string) error {
+	slog.Info("mount_overlay", "lower", lower, "upper", upper, "target", target)
+
+	args, err := overlayMountArgs(lower, upper, work, target)
+	if err != nil {
+		return err
+	}
+
+	entry, mounted, err := mountAt(procMountsPath, target)
+	if err != nil {
+		return errors.Wrap(err, "failed to check existing mounts")
+	}
+	if mounted {
+		return fmt.Errorf("%s is already a mount point (%s %s)", target, entry.FSType, entry.Source)
+	}
+
+	for _, dir := range []string{upper, work, target} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return errors.Wrap(err, "failed to create overlay dir")
+		}
+	}
+
+	if err := runCommand(ctx, "mount", args...); err != nil {
+		slog.Error("mount_overlay_failed", "target", target, "error", err)
+		return errors.Wrap(err, "failed to mount overlay")
+	}
+
+	slog.Info("mount_overlay_complete", "target", target)
+	return nil
+}
+
 func (m *LinuxManager) DeleteDevice(ctx context.Context, deviceID string) error {
-	deviceName := fmt.Sprintf("flyio-%s", deviceID)
+	deviceName := m.deviceName(deviceID)
 	slog.Info("delete_device", "device_id", deviceID, "device_name", deviceName)
 
 	cmd := exec.Command("dmsetup", "remove", deviceName)
@@ -186,14 +608,98 @@ func (m *LinuxManager) DeleteDevice(ctx context.Context, deviceID string) error
 	}
 
 	delete(m.devices, deviceID)
+	delete(m.pools, deviceID)
 	slog.Info("device_deleted", "device_id", deviceID)
 	return nil
 }
 
+func (m *LinuxManager) PoolStatus(ctx context.Context) (*PoolStatus, error) {
+	return m.readPoolStatus(ctx, m.poolName)
+}
+
+func (m *LinuxManager) PoolStatusFor(ctx context.Context, sizeBytes int64) (*PoolStatus, error) {
+	return m.poolStatus(ctx, m.devicePool(sizeBytes))
+}
+
+// devicePool returns the pool a new device of sizeBytes goes to
+func (m *LinuxManager) devicePool(sizeBytes int64) string {
+	return selectPool(m.options.poolTiers, m.poolName, DeviceSectors(sizeBytes)*DefaultSectorSize)
+}
+
+// readPoolStatus reads the data and metadata usage of pool
+func (m *LinuxManager) readPoolStatus(ctx context.Context, pool string) (*PoolStatus, error) {
+	table, err := exec.CommandContext(ctx, "dmsetup", "table", pool).Output()
+	if err != nil {
+		slog.Error("pool_table_failed", "pool", pool, "error", err)
+		return nil, errors.Wrap(err, "failed to read pool table")
+	}
+
+	status, err := exec.CommandContext(ctx, "dmsetup", "status", pool).Output()
+	if err != nil {
+		slog.Error("pool_status_failed", "pool", pool, "error", err)
+		return nil, errors.Wrap(err, "failed to read pool status")
+	}
+
+	ps, err := parsePoolStatus(string(table), string(status))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse pool status")
+	}
+
+	slog.Info("pool_status", "pool", pool,
+		"used_data_blocks", ps.UsedDataBlocks, "total_data_blocks", ps.TotalDataBlocks,
+		"free_data_mb", ps.FreeDataBytes()/1024/1024)
+	return ps, nil
+}
+
+func (m *LinuxManager) DeviceStats(ctx context.Context, deviceID string) (*DeviceStats, error) {
+	name := m.activeDeviceName(deviceID)
+	if name == "" {
+		return nil, fmt.Errorf("device %s is not active", deviceID)
+	}
+
+	status, err := exec.CommandContext(ctx, "dmsetup", "status", name).Output()
+	if err != nil {
+		slog.Error("device_status_failed", "device_name", name, "error", err)
+		return nil, errors.Wrap(err, "failed to read device status")
+	}
+
+	stats, err := parseThinStatus(string(status))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse device status")
+	}
+	return stats, nil
+}
+
+// guardMetadataSpace refuses to allocate thin devices in pool once its
+// metadata usage is critical. If usage can't be read the guard fails closed.
+func (m *LinuxManager) guardMetadataSpace(ctx context.Context, pool string) error {
+	status, err := m.poolStatus(ctx, pool)
+	if err != nil {
+		return errors.Wrap(err, "failed to check pool metadata space")
+	}
+	if err := checkMetadataSpace(status, m.options.metadataCriticalPercent); err != nil {
+		slog.Error("pool_metadata_critical", "pool", pool,
+			"used_metadata_blocks", status.UsedMetadataBlocks, "total_metadata_blocks", status.TotalMetadataBlocks,
+			"critical_percent", m.options.metadataCriticalPercent)
+		return err
+	}
+	return nil
+}
+
 func (m *LinuxManager) ListDevices(ctx context.Context) ([]*DeviceInfo, error) {
-	devices := make([]*DeviceInfo, 0, len(m.devices))
-	for _, dev := range m.devices {
-		devices = append(devices, dev)
+	out, err := exec.CommandContext(ctx, "dmsetup", "ls", "--target", "thin").Output()
+	if err != nil {
+		slog.Error("list_devices_failed", "error", err)
+		return nil, errors.Wrap(err, "failed to list devices")
+	}
+
+	devices := parseDeviceList(string(out), m.options.devicePrefix)
+	// Sizes are only known for devices this process created
+	for _, dev := range devices {
+		id, _, _ := ParseDeviceName(m.options.devicePrefix, filepath.Base(dev.DevicePath))
+		if known, ok := m.devices[id]; ok {
+			dev.Size = known.Size
+		}
 	}
 	return devices, nil
 }
@@ -203,17 +709,80 @@ func (m *LinuxManager) Close() error {
 }
 
 func (m *LinuxManager) initThinpool() error {
-	slog.Info("checking_thinpool", "pool", m.poolName)
+	for _, pool := range poolNames(m.poolName, m.options.poolTiers) {
+		slog.Info("checking_thinpool", "pool", pool)
+
+		// Check if thinpool already exists
+		cmd := exec.Command("dmsetup", "info", pool)
+		if err := cmd.Run(); err != nil {
+			slog.Error("thinpool_not_found", "pool", pool)
+			return fmt.Errorf("thinpool %s not found: thinpool setup requires manual configuration - see docs", pool)
+		}
+		slog.Info("thinpool_exists", "pool", pool)
+	}
+	return nil
+}
 
-	// Check if thinpool already exists
-	cmd := exec.Command("dmsetup", "info", m.poolName)
-	if err := cmd.Run(); err == nil {
-		slog.Info("thinpool_exists", "pool", m.poolName)
-		return nil
+// poolPath returns the device path of thin pool name
+func (m *LinuxManager) poolPath(name string) string {
+	return filepath.Join("/dev/mapper", name)
+}
+
+// sourcePool returns the pool holding thin device id. For a device this
+// process didn't create, the pool is matched against the pool device in
+// the device's live table. With several pools, a device whose pool can't
+// be resolved is an error: a snapshot issued against the wrong pool would
+// copy whatever device holds that ID there.
+func (m *LinuxManager) sourcePool(ctx context.Context, id string) (string, error) {
+	if pool, ok := m.pools[id]; ok {
+		return pool, nil
+	}
+	pools := poolNames(m.poolName, m.options.poolTiers)
+	if len(pools) == 1 {
+		return m.poolName, nil
+	}
+
+	name := m.activeDeviceName(id)
+	if name == "" {
+		return "", fmt.Errorf("can't tell which pool holds device %s: it is not active", id)
 	}
+	table, err := exec.CommandContext(ctx, "dmsetup", "table", name).Output()
+	if err != nil {
+		return "", errors.Wrap(err, fmt.Sprintf("failed to read table of device %s", id))
+	}
+	dev, err := parseThinPoolDevice(string(table))
+	if err != nil {
+		return "", errors.Wrap(err, fmt.Sprintf("failed to find pool of device %s", id))
+	}
+	for _, pool := range pools {
+		out, err := exec.CommandContext(ctx, "dmsetup", "info", "-c", "--noheadings", "-o", "major,minor", pool).Output()
+		if err == nil && strings.TrimSpace(string(out)) == dev {
+			m.pools[id] = pool
+			return pool, nil
+		}
+	}
+	return "", fmt.Errorf("device %s is in pool %s, which is not one of %s", id, dev, strings.Join(pools, ", "))
+}
 
-	slog.Error("thinpool_not_found", "pool", m.poolName)
-	return fmt.Errorf("thinpool setup requires manual configuration - see docs")
+// deviceName returns the mapped name of base device id
+func (m *LinuxManager) deviceName(id string) string {
+	return DeviceName(m.options.devicePrefix, id)
+}
+
+// snapshotName returns the mapped name of snapshot id
+func (m *LinuxManager) snapshotName(id string) string {
+	return SnapshotName(m.options.devicePrefix, id)
+}
+
+// activeDeviceName returns the mapped device name for a thin device ID
+// if it is currently active, checking snapshot names before base names
+func (m *LinuxManager) activeDeviceName(deviceID string) string {
+	for _, name := range []string{m.snapshotName(deviceID), m.deviceName(deviceID)} {
+		if _, err := os.Stat(filepath.Join("/dev/mapper", name)); err == nil {
+			return name
+		}
+	}
+	return ""
 }
 
 func isRoot() bool {
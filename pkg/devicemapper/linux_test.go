@@ -4,6 +4,7 @@ package devicemapper
 
 import (
 	"context"
+	"errors"
 	"testing"
 )
 
@@ -90,3 +91,71 @@ func TestManagerInterface(t *testing.T) {
 
 // Note: Actual dmsetup integration tests require privileged mode and thinpool setup
 // These should be run in Docker E2E tests, not in CI unit tests
+
+func TestCreate_RefusedWhenMetadataCritical(t *testing.T) {
+	m := &LinuxManager{
+		poolName: "pool",
+		devices:  make(map[string]*DeviceInfo),
+		options:  defaultManagerOptions(),
+		poolStatus: func(ctx context.Context, pool string) (*PoolStatus, error) {
+			return &PoolStatus{UsedMetadataBlocks: 96, TotalMetadataBlocks: 100}, nil
+		},
+	}
+
+	if _, err := m.CreateDevice(context.Background(), "/nonexistent", "7", 0); !errors.Is(err, ErrMetadataSpaceCritical) {
+		t.Errorf("CreateDevice error = %v, want ErrMetadataSpaceCritical", err)
+	}
+	if _, err := m.CreateSnapshot(context.Background(), "7", 8); !errors.Is(err, ErrMetadataSpaceCritical) {
+		t.Errorf("CreateSnapshot error = %v, want ErrMetadataSpaceCritical", err)
+	}
+	if len(m.devices) != 0 {
+		t.Errorf("refused creation recorded devices: %v", m.devices)
+	}
+}
+
+func TestLinuxManager_NamesUseDevicePrefix(t *testing.T) {
+	options := defaultManagerOptions()
+	WithDevicePrefix("staging")(&options)
+	m := &LinuxManager{poolName: "pool", devices: make(map[string]*DeviceInfo), options: options}
+
+	if got := m.deviceName("7"); got != "staging-7" {
+		t.Errorf("deviceName = %q, want staging-7", got)
+	}
+	if got := m.snapshotName("8"); got != "staging-snapshot-8" {
+		t.Errorf("snapshotName = %q, want staging-snapshot-8", got)
+	}
+
+	m.options = defaultManagerOptions()
+	if got := m.deviceName("7"); got != "flyio-7" {
+		t.Errorf("default deviceName = %q, want flyio-7", got)
+	}
+}
+
+func TestLinuxManager_TieredPools(t *testing.T) {
+	options := defaultManagerOptions()
+	WithPoolTiers(PoolTier{Name: "ssd", MaxDeviceSize: 1 << 30})(&options)
+	var read []string
+	m := &LinuxManager{
+		poolName: "pool",
+		devices:  make(map[string]*DeviceInfo),
+		pools:    map[string]string{"7": "ssd"},
+		options:  options,
+		poolStatus: func(ctx context.Context, pool string) (*PoolStatus, error) {
+			read = append(read, pool)
+			return &PoolStatus{}, nil
+		},
+	}
+
+	m.PoolStatusFor(context.Background(), 512<<20)
+	m.PoolStatusFor(context.Background(), 2<<30)
+	if len(read) != 2 || read[0] != "ssd" || read[1] != "pool" {
+		t.Errorf("PoolStatusFor read pools %v, want [ssd pool]", read)
+	}
+
+	if pool, err := m.sourcePool(context.Background(), "7"); err != nil || pool != "ssd" {
+		t.Errorf("sourcePool(7) = %q, %v; want ssd", pool, err)
+	}
+	if pool, err := m.sourcePool(context.Background(), "999999"); err == nil {
+		t.Errorf("sourcePool of an unknown inactive device = %q, want an error", pool)
+	}
+}
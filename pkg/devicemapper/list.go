@@ -0,0 +1,80 @@
+package devicemapper
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/fly-io/162719/pkg/security"
+)
+
+// TarEntry is one entry of a listed tarball. Problem is the check that
+// extraction would have failed on, or nil.
+type TarEntry struct {
+	Name     string
+	Type     byte
+	Size     int64
+	Mode     os.FileMode
+	Linkname string
+	Problem  error
+}
+
+// ListTarball calls fn with each entry of the tar stream r without writing
+// anything. The checks extraction applies run in report mode: a failed
+// check is recorded in the entry's Problem and listing carries on. Errors
+// reading the archive, or returned by fn, stop the listing.
+func ListTarball(r io.Reader, validator *security.Validator, fn func(TarEntry) error) error {
+	validator.Reset()
+
+	// Regular files seen so far, which hardlinks may target
+	regular := make(map[string]bool)
+
+	return walkTar(r, func(index int, header *tar.Header, content io.Reader) error {
+		entry := TarEntry{
+			Name:     header.Name,
+			Type:     header.Typeflag,
+			Size:     header.Size,
+			Mode:     header.FileInfo().Mode(),
+			Linkname: header.Linkname,
+			Problem:  checkEntry(header, validator, regular),
+		}
+		if header.Typeflag == tar.TypeReg && entry.Problem == nil {
+			regular[filepath.Clean(header.Name)] = true
+		}
+		return fn(entry)
+	})
+}
+
+// checkEntry runs the validation extractStream applies to header
+func checkEntry(header *tar.Header, validator *security.Validator, regular map[string]bool) error {
+	if err := validator.ValidatePath(header.Name); err != nil {
+		return fmt.Errorf("invalid path in tar: %w", err)
+	}
+
+	switch header.Typeflag {
+	case tar.TypeReg:
+		if err := validator.ValidateFileSize(header.Size); err != nil {
+			return err
+		}
+		return validator.AddExtractedSize(header.Size)
+
+	case tar.TypeSymlink:
+		if err := validator.ValidateSymlink(header.Name, header.Linkname); err != nil {
+			return fmt.Errorf("invalid symlink target: %w", err)
+		}
+
+	case tar.TypeLink:
+		if header.Linkname == "" {
+			return fmt.Errorf("invalid hardlink %s: empty target", header.Name)
+		}
+		if err := validator.ValidatePath(header.Linkname); err != nil {
+			return fmt.Errorf("invalid hardlink target: %w", err)
+		}
+		if !regular[filepath.Clean(header.Linkname)] {
+			return fmt.Errorf("hardlink %s: target %s is not an earlier regular file", header.Name, header.Linkname)
+		}
+	}
+	return nil
+}
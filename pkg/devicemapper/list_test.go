@@ -0,0 +1,63 @@
+package devicemapper
+
+import (
+	"archive/tar"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fly-io/162719/pkg/security"
+)
+
+func TestListTarball_ReportsEntriesWithoutWriting(t *testing.T) {
+	dir := t.TempDir()
+	tarPath := filepath.Join(dir, "image.tar")
+	writeTar(t, tarPath, []tarEntry{
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/hosts", typeflag: tar.TypeReg, body: "127.0.0.1 localhost\n"},
+		{name: "etc/localtime", typeflag: tar.TypeSymlink, linkname: "../usr/share/zoneinfo/UTC"},
+		{name: "etc/escape", typeflag: tar.TypeSymlink, linkname: "../../../../root"},
+		{name: "../outside", typeflag: tar.TypeReg, body: "x"},
+		{name: "etc/hosts.bak", typeflag: tar.TypeLink, linkname: "etc/hosts"},
+	})
+
+	f, err := os.Open(tarPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var entries []TarEntry
+	err = ListTarball(f, newTestValidator(), func(e TarEntry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ListTarball failed: %v", err)
+	}
+
+	if len(entries) != 6 {
+		t.Fatalf("listed %d entries, want 6", len(entries))
+	}
+	hosts := entries[1]
+	if hosts.Type != tar.TypeReg || hosts.Size != 20 || hosts.Mode != 0644 || hosts.Problem != nil {
+		t.Errorf("etc/hosts = %+v", hosts)
+	}
+	link := entries[2]
+	if link.Type != tar.TypeSymlink || link.Linkname != "../usr/share/zoneinfo/UTC" || link.Mode&os.ModeSymlink == 0 || link.Problem != nil {
+		t.Errorf("etc/localtime = %+v", link)
+	}
+	for _, i := range []int{3, 4} {
+		if !errors.Is(entries[i].Problem, security.ErrRejected) {
+			t.Errorf("%s problem = %v, want a rejection", entries[i].Name, entries[i].Problem)
+		}
+	}
+	if entries[5].Problem != nil {
+		t.Errorf("hardlink to an earlier file flagged: %v", entries[5].Problem)
+	}
+
+	if names, _ := os.ReadDir(dir); len(names) != 1 {
+		t.Errorf("listing wrote files: %v", names)
+	}
+}
@@ -0,0 +1,172 @@
+package devicemapper
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// longTar builds an archive in the given format, so tests control whether
+// long names are carried by PAX records or GNU longname entries
+func longTar(t *testing.T, format tar.Format, hdrs []*tar.Header, bodies map[string]string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range hdrs {
+		hdr.Format = format
+		body := bodies[hdr.Name]
+		hdr.Size = int64(len(body))
+		if hdr.Mode == 0 && hdr.Typeflag != tar.TypeXGlobalHeader {
+			hdr.Mode = 0644
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("write header %s: %v", hdr.Name, err)
+		}
+		if _, err := tw.Write([]byte(body)); err != nil {
+			t.Fatalf("write body %s: %v", hdr.Name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close tar: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func extractBytes(t *testing.T, data []byte) (string, error) {
+	t.Helper()
+	tarPath := filepath.Join(t.TempDir(), "image.tar")
+	if err := os.WriteFile(tarPath, data, 0644); err != nil {
+		t.Fatalf("write tar: %v", err)
+	}
+	destDir := t.TempDir()
+	return destDir, ExtractTarball(tarPath, destDir, newTestValidator(), ExtractOptions{})
+}
+
+// longPath returns a relative path of more than 100 bytes, past the
+// ustar name field
+func longPath(leaf string) string {
+	return strings.Repeat("deeply-nested-directory/", 6) + leaf
+}
+
+func TestExtractTarball_LongNames(t *testing.T) {
+	name := longPath("config.yaml")
+	linkTarget := "../" + longPath("config.yaml")
+	link := "links/current"
+
+	tests := []struct {
+		name   string
+		format tar.Format
+		marker string // proof the archive really used the extension
+	}{
+		{name: "PAX", format: tar.FormatPAX, marker: "path=" + name},
+		{name: "GNU", format: tar.FormatGNU, marker: "././@LongLink"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := longTar(t, tt.format, []*tar.Header{
+				{Name: name, Typeflag: tar.TypeReg},
+				{Name: link, Typeflag: tar.TypeSymlink, Linkname: linkTarget},
+				{Name: "links/hard", Typeflag: tar.TypeLink, Linkname: name},
+			}, map[string]string{name: "key: value"})
+			if !bytes.Contains(data, []byte(tt.marker)) {
+				t.Fatalf("archive does not contain %q; long names were not encoded as expected", tt.marker)
+			}
+
+			destDir, err := extractBytes(t, data)
+			if err != nil {
+				t.Fatalf("ExtractTarball failed: %v", err)
+			}
+
+			if got, err := os.ReadFile(filepath.Join(destDir, name)); err != nil || string(got) != "key: value" {
+				t.Errorf("long file = %q, %v", got, err)
+			}
+			if got, err := os.Readlink(filepath.Join(destDir, link)); err != nil || got != linkTarget {
+				t.Errorf("long symlink target = %q, %v; want %q", got, err, linkTarget)
+			}
+			if got, err := os.ReadFile(filepath.Join(destDir, "links/hard")); err != nil || string(got) != "key: value" {
+				t.Errorf("hardlink to long name = %q, %v", got, err)
+			}
+		})
+	}
+}
+
+func TestExtractTarball_LongNamesStillValidated(t *testing.T) {
+	escape := strings.Repeat("../", 40) + "etc/passwd"
+
+	tests := []struct {
+		name string
+		hdrs []*tar.Header
+	}{
+		{
+			name: "long traversal path",
+			hdrs: []*tar.Header{{Name: "../" + longPath("evil"), Typeflag: tar.TypeReg}},
+		},
+		{
+			name: "long escaping symlink target",
+			hdrs: []*tar.Header{{Name: "etc/link", Typeflag: tar.TypeSymlink, Linkname: escape}},
+		},
+		{
+			name: "long escaping hardlink target",
+			hdrs: []*tar.Header{{Name: "etc/link", Typeflag: tar.TypeLink, Linkname: escape}},
+		},
+	}
+
+	for _, tt := range tests {
+		for _, format := range []tar.Format{tar.FormatPAX, tar.FormatGNU} {
+			t.Run(tt.name+"/"+format.String(), func(t *testing.T) {
+				if _, err := extractBytes(t, longTar(t, format, tt.hdrs, nil)); err == nil {
+					t.Error("expected validation error")
+				}
+			})
+		}
+	}
+}
+
+func TestExtractTarball_HardlinkThroughSymlinkRejected(t *testing.T) {
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("host data"), 0644); err != nil {
+		t.Fatalf("write secret: %v", err)
+	}
+
+	data := longTar(t, tar.FormatPAX, []*tar.Header{
+		{Name: "escape", Typeflag: tar.TypeSymlink, Linkname: outside},
+		{Name: "stolen", Typeflag: tar.TypeLink, Linkname: "escape/secret"},
+	}, nil)
+
+	destDir, err := extractBytes(t, data)
+	if err == nil {
+		t.Fatal("expected hardlink through a symlink to be rejected")
+	}
+	if _, err := os.Lstat(filepath.Join(destDir, "stolen")); !os.IsNotExist(err) {
+		t.Errorf("host file must not be linked into the tree, stat err = %v", err)
+	}
+}
+
+func TestApplyLayer_SkipsPAXGlobalHeader(t *testing.T) {
+	destDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(destDir, "victim"), []byte("lower"), 0644); err != nil {
+		t.Fatalf("write lower file: %v", err)
+	}
+
+	// A global header is not a file; in a layer it must not replace the
+	// entry sharing its name
+	data := longTar(t, tar.FormatPAX, []*tar.Header{
+		{Name: "victim", Typeflag: tar.TypeXGlobalHeader, PAXRecords: map[string]string{"comment": "hi"}},
+		{Name: "added", Typeflag: tar.TypeReg},
+	}, map[string]string{"added": "upper"})
+
+	if err := ApplyLayer(bytes.NewReader(data), destDir, newTestValidator()); err != nil {
+		t.Fatalf("ApplyLayer failed: %v", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(destDir, "victim")); err != nil || string(got) != "lower" {
+		t.Errorf("victim = %q, %v; global header must be ignored", got, err)
+	}
+	if _, err := os.Stat(filepath.Join(destDir, "added")); err != nil {
+		t.Errorf("entry after global header missing: %v", err)
+	}
+}
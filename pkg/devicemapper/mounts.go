@@ -0,0 +1,165 @@
+package devicemapper
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// procMountsPath is the kernel's mount table
+const procMountsPath = "/proc/mounts"
+
+// mountEntry is one line of /proc/mounts
+type mountEntry struct {
+	Source string
+	Target string
+	FSType string
+}
+
+// parseMounts parses /proc/mounts-formatted lines:
+//
+//	/dev/mapper/flyio-7 /tmp/flyio-machine/mounts/7 ext4 rw,relatime 0 0
+func parseMounts(r io.Reader) ([]mountEntry, error) {
+	var entries []mountEntry
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("malformed mount entry: %q", scanner.Text())
+		}
+		entries = append(entries, mountEntry{
+			Source: unescapeMountField(fields[0]),
+			Target: unescapeMountField(fields[1]),
+			FSType: fields[2],
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read mounts: %w", err)
+	}
+	return entries, nil
+}
+
+// unescapeMountField decodes the octal escapes (\040 for space, etc.)
+// the kernel uses for whitespace and backslashes in mount fields
+func unescapeMountField(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// findMount returns the topmost mount at target, if any
+func findMount(entries []mountEntry, target string) (mountEntry, bool) {
+	target = filepath.Clean(target)
+	for i := len(entries) - 1; i >= 0; i-- {
+		if filepath.Clean(entries[i].Target) == target {
+			return entries[i], true
+		}
+	}
+	return mountEntry{}, false
+}
+
+// mountAt looks up the current mount at target in the mount table at mountsPath
+func mountAt(mountsPath, target string) (mountEntry, bool, error) {
+	f, err := os.Open(mountsPath)
+	if err != nil {
+		return mountEntry{}, false, fmt.Errorf("failed to open %s: %w", mountsPath, err)
+	}
+	defer f.Close()
+
+	entries, err := parseMounts(f)
+	if err != nil {
+		return mountEntry{}, false, err
+	}
+	entry, ok := findMount(entries, target)
+	return entry, ok, nil
+}
+
+// sameDevice reports whether two device paths name the same device.
+// /proc/mounts may list a mapper device as /dev/dm-N rather than the
+// /dev/mapper symlink we mounted, so both are resolved first.
+func sameDevice(a, b string) bool {
+	if filepath.Clean(a) == filepath.Clean(b) {
+		return true
+	}
+	ra, errA := filepath.EvalSymlinks(a)
+	rb, errB := filepath.EvalSymlinks(b)
+	return errA == nil && errB == nil && ra == rb
+}
+
+// commandRunner runs an external command to completion
+type commandRunner func(ctx context.Context, name string, args ...string) error
+
+// runCommand is the commandRunner that executes commands for real
+func runCommand(ctx context.Context, name string, args ...string) error {
+	return exec.CommandContext(ctx, name, args...).Run()
+}
+
+// umountArgs builds the umount arguments for mountPath. A lazy unmount
+// detaches the mount immediately and finishes once it is no longer busy.
+func umountArgs(mountPath string, lazy bool) []string {
+	if lazy {
+		return []string{"-l", mountPath}
+	}
+	return []string{mountPath}
+}
+
+// unmountWithFallback unmounts mountPath, retrying lazily if a plain
+// unmount fails, typically because a crashed run left the mount busy
+func unmountWithFallback(ctx context.Context, mountPath string, run commandRunner) error {
+	err := run(ctx, "umount", umountArgs(mountPath, false)...)
+	if err == nil {
+		return nil
+	}
+
+	slog.Warn("unmount_failed_retrying_lazy", "mount_path", mountPath, "error", err)
+	if lazyErr := run(ctx, "umount", umountArgs(mountPath, true)...); lazyErr != nil {
+		return fmt.Errorf("lazy unmount failed after %v: %w", err, lazyErr)
+	}
+	return nil
+}
+
+// tmpfsMountArgs builds the mount arguments for a tmpfs of sizeBytes at path
+func tmpfsMountArgs(path string, sizeBytes int64) []string {
+	return []string{"-t", "tmpfs", "-o", fmt.Sprintf("size=%d,mode=0755", sizeBytes), "tmpfs", path}
+}
+
+// overlayMountArgs builds the mount arguments for an overlay of upper on
+// lower at target, using work as overlayfs's scratch directory. Paths
+// containing the option separators ',' or ':' are refused, since the
+// kernel would split them into other options or extra lower layers.
+func overlayMountArgs(lower, upper, work, target string) ([]string, error) {
+	for _, dir := range []struct{ name, path string }{
+		{"lower", lower}, {"upper", upper}, {"work", work}, {"target", target},
+	} {
+		if dir.path == "" {
+			return nil, fmt.Errorf("overlay %s dir is empty", dir.name)
+		}
+		if strings.ContainsAny(dir.path, ",:") {
+			return nil, fmt.Errorf("overlay %s dir %q contains ',' or ':'", dir.name, dir.path)
+		}
+	}
+	opts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lower, upper, work)
+	return []string{"-t", "overlay", "-o", opts, "overlay", target}, nil
+}
@@ -0,0 +1,175 @@
+package devicemapper
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const fakeProcMounts = `proc /proc proc rw,nosuid,nodev,noexec,relatime 0 0
+/dev/sda1 / ext4 rw,relatime 0 0
+/dev/mapper/flyio-7 /tmp/flyio-machine/mounts/7 ext4 rw,relatime 0 0
+/dev/mapper/flyio-9 /tmp/work\040dir/mounts/9 ext4 rw,relatime 0 0
+tmpfs /mnt/stacked tmpfs rw 0 0
+/dev/mapper/flyio-11 /mnt/stacked ext4 rw 0 0
+`
+
+func TestParseMounts(t *testing.T) {
+	entries, err := parseMounts(strings.NewReader(fakeProcMounts))
+	if err != nil {
+		t.Fatalf("parseMounts failed: %v", err)
+	}
+	if len(entries) != 6 {
+		t.Fatalf("expected 6 entries, got %d", len(entries))
+	}
+
+	tests := []struct {
+		target   string
+		source   string
+		expected bool
+	}{
+		{"/tmp/flyio-machine/mounts/7", "/dev/mapper/flyio-7", true},
+		{"/tmp/flyio-machine/mounts/7/", "/dev/mapper/flyio-7", true},
+		{"/tmp/work dir/mounts/9", "/dev/mapper/flyio-9", true},
+		{"/mnt/stacked", "/dev/mapper/flyio-11", true}, // topmost mount wins
+		{"/tmp/flyio-machine/mounts/8", "", false},
+	}
+
+	for _, tt := range tests {
+		entry, ok := findMount(entries, tt.target)
+		if ok != tt.expected {
+			t.Errorf("findMount(%s) found = %v, want %v", tt.target, ok, tt.expected)
+			continue
+		}
+		if ok && entry.Source != tt.source {
+			t.Errorf("findMount(%s) source = %s, want %s", tt.target, entry.Source, tt.source)
+		}
+	}
+}
+
+func TestParseMounts_Malformed(t *testing.T) {
+	if _, err := parseMounts(strings.NewReader("/dev/sda1 /\n")); err == nil {
+		t.Error("expected error for truncated mount entry")
+	}
+}
+
+func TestMountAt(t *testing.T) {
+	mountsPath := filepath.Join(t.TempDir(), "mounts")
+	if err := os.WriteFile(mountsPath, []byte(fakeProcMounts), 0644); err != nil {
+		t.Fatalf("failed to write fake mounts: %v", err)
+	}
+
+	entry, mounted, err := mountAt(mountsPath, "/tmp/flyio-machine/mounts/7")
+	if err != nil || !mounted || !sameDevice(entry.Source, "/dev/mapper/flyio-7") {
+		t.Errorf("expected flyio-7 mounted, got %+v mounted=%v err=%v", entry, mounted, err)
+	}
+
+	if _, mounted, err := mountAt(mountsPath, "/tmp/flyio-machine/mounts/8"); err != nil || mounted {
+		t.Errorf("expected mounts/8 not mounted, got mounted=%v err=%v", mounted, err)
+	}
+}
+
+func TestSameDevice(t *testing.T) {
+	dir := t.TempDir()
+	dev := filepath.Join(dir, "dm-3")
+	link := filepath.Join(dir, "flyio-7")
+	if err := os.WriteFile(dev, nil, 0644); err != nil {
+		t.Fatalf("failed to create fake device: %v", err)
+	}
+	if err := os.Symlink(dev, link); err != nil {
+		t.Fatalf("failed to create symlink: %v", err)
+	}
+
+	if !sameDevice(link, dev) {
+		t.Error("expected mapper symlink and target to be the same device")
+	}
+	if sameDevice(link, filepath.Join(dir, "dm-4")) {
+		t.Error("expected different devices to differ")
+	}
+}
+
+func TestUnmountWithFallback(t *testing.T) {
+	busy := errors.New("target is busy")
+
+	tests := []struct {
+		name     string
+		failures map[string]error
+		wantCmds []string
+		wantErr  bool
+	}{
+		{
+			name:     "plain unmount succeeds",
+			wantCmds: []string{"umount /mnt/7"},
+		},
+		{
+			name:     "busy retries lazily",
+			failures: map[string]error{"umount /mnt/7": busy},
+			wantCmds: []string{"umount /mnt/7", "umount -l /mnt/7"},
+		},
+		{
+			name:     "lazy failure is reported",
+			failures: map[string]error{"umount /mnt/7": busy, "umount -l /mnt/7": busy},
+			wantCmds: []string{"umount /mnt/7", "umount -l /mnt/7"},
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cmds []string
+			run := func(ctx context.Context, name string, args ...string) error {
+				cmd := strings.Join(append([]string{name}, args...), " ")
+				cmds = append(cmds, cmd)
+				return tt.failures[cmd]
+			}
+
+			err := unmountWithFallback(context.Background(), "/mnt/7", run)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unmountWithFallback error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if strings.Join(cmds, "; ") != strings.Join(tt.wantCmds, "; ") {
+				t.Errorf("commands = %q, want %q", cmds, tt.wantCmds)
+			}
+		})
+	}
+}
+
+func TestTmpfsMountArgs(t *testing.T) {
+	got := strings.Join(tmpfsMountArgs("/tmp/flyio-machine", 8*1024*1024*1024), " ")
+	want := "-t tmpfs -o size=8589934592,mode=0755 tmpfs /tmp/flyio-machine"
+	if got != want {
+		t.Errorf("tmpfsMountArgs = %q, want %q", got, want)
+	}
+}
+
+func TestOverlayMountArgs(t *testing.T) {
+	tests := []struct {
+		name                       string
+		lower, upper, work, target string
+		want                       string
+		wantErr                    bool
+	}{
+		{
+			name:  "layout",
+			lower: "/work/extracted/trees/abc", upper: "/work/overlay/img/upper", work: "/work/overlay/img/work", target: "/work/overlay/img/merged",
+			want: "-t overlay -o lowerdir=/work/extracted/trees/abc,upperdir=/work/overlay/img/upper,workdir=/work/overlay/img/work overlay /work/overlay/img/merged",
+		},
+		{name: "comma in lower", lower: "/a,b", upper: "/u", work: "/w", target: "/t", wantErr: true},
+		{name: "colon in upper", lower: "/l", upper: "/u:v", work: "/w", target: "/t", wantErr: true},
+		{name: "empty work", lower: "/l", upper: "/u", work: "", target: "/t", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args, err := overlayMountArgs(tt.lower, tt.upper, tt.work, tt.target)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("overlayMountArgs error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := strings.Join(args, " "); got != tt.want {
+				t.Errorf("overlayMountArgs = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package devicemapper
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DefaultDevicePrefix prefixes the /dev/mapper names of devices and
+// snapshots unless WithDevicePrefix overrides it
+const DefaultDevicePrefix = "flyio"
+
+// DeviceName returns the mapped name of base device id, e.g. flyio-7.
+// An empty prefix means DefaultDevicePrefix.
+func DeviceName(prefix, id string) string {
+	if prefix == "" {
+		prefix = DefaultDevicePrefix
+	}
+	return fmt.Sprintf("%s-%s", prefix, id)
+}
+
+// SnapshotName returns the mapped name of snapshot id, e.g.
+// flyio-snapshot-8. An empty prefix means DefaultDevicePrefix.
+func SnapshotName(prefix, id string) string {
+	if prefix == "" {
+		prefix = DefaultDevicePrefix
+	}
+	return fmt.Sprintf("%s-snapshot-%s", prefix, id)
+}
+
+// ValidateDevicePrefix rejects prefixes that aren't safe as part of a
+// device-mapper name
+func ValidateDevicePrefix(prefix string) error {
+	if prefix == "" {
+		return fmt.Errorf("device prefix cannot be empty")
+	}
+	for _, r := range prefix {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+		default:
+			return fmt.Errorf("device prefix %q may only contain letters, digits, '-', '_' and '.'", prefix)
+		}
+	}
+	return nil
+}
+
+// ParseDeviceName is the inverse of DeviceName and SnapshotName: it
+// returns the device ID in a mapped name and whether the name is a
+// snapshot's. ok is false for names outside prefix or without a numeric
+// ID. An empty prefix means DefaultDevicePrefix.
+func ParseDeviceName(prefix, name string) (id string, snapshot bool, ok bool) {
+	if prefix == "" {
+		prefix = DefaultDevicePrefix
+	}
+	rest, found := strings.CutPrefix(name, prefix+"-")
+	if !found {
+		return "", false, false
+	}
+	if sid, found := strings.CutPrefix(rest, "snapshot-"); found {
+		rest, snapshot = sid, true
+	}
+	if _, err := strconv.ParseUint(rest, 10, 32); err != nil {
+		return "", false, false
+	}
+	return rest, snapshot, true
+}
+
+// parseDeviceList parses `dmsetup ls --target thin` output, one
+// "<name>\t(<major>:<minor>)" line per device, keeping the devices and
+// snapshots under prefix
+func parseDeviceList(out, prefix string) []*DeviceInfo {
+	var devices []*DeviceInfo
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		id, snapshot, ok := ParseDeviceName(prefix, fields[0])
+		if !ok {
+			continue
+		}
+		info := &DeviceInfo{DevicePath: filepath.Join("/dev/mapper", fields[0])}
+		if snapshot {
+			info.SnapshotID, _ = strconv.Atoi(id)
+		}
+		devices = append(devices, info)
+	}
+	return devices
+}
@@ -0,0 +1,80 @@
+package devicemapper
+
+import "testing"
+
+func TestDeviceNames(t *testing.T) {
+	tests := []struct {
+		prefix       string
+		wantDevice   string
+		wantSnapshot string
+	}{
+		{prefix: "", wantDevice: "flyio-7", wantSnapshot: "flyio-snapshot-7"},
+		{prefix: "flyio", wantDevice: "flyio-7", wantSnapshot: "flyio-snapshot-7"},
+		{prefix: "staging", wantDevice: "staging-7", wantSnapshot: "staging-snapshot-7"},
+	}
+
+	for _, tt := range tests {
+		if got := DeviceName(tt.prefix, "7"); got != tt.wantDevice {
+			t.Errorf("DeviceName(%q) = %q, want %q", tt.prefix, got, tt.wantDevice)
+		}
+		if got := SnapshotName(tt.prefix, "7"); got != tt.wantSnapshot {
+			t.Errorf("SnapshotName(%q) = %q, want %q", tt.prefix, got, tt.wantSnapshot)
+		}
+	}
+}
+
+func TestValidateDevicePrefix(t *testing.T) {
+	for _, prefix := range []string{"flyio", "staging-2", "team_a.dev"} {
+		if err := ValidateDevicePrefix(prefix); err != nil {
+			t.Errorf("ValidateDevicePrefix(%q) = %v, want nil", prefix, err)
+		}
+	}
+	for _, prefix := range []string{"", "a/b", "has space", "../pool"} {
+		if err := ValidateDevicePrefix(prefix); err == nil {
+			t.Errorf("ValidateDevicePrefix(%q) accepted an unsafe prefix", prefix)
+		}
+	}
+}
+
+func TestParseDeviceName(t *testing.T) {
+	tests := []struct {
+		prefix, name string
+		wantID       string
+		wantSnapshot bool
+		wantOK       bool
+	}{
+		{"", "flyio-7", "7", false, true},
+		{"flyio", "flyio-snapshot-8", "8", true, true},
+		{"staging", "staging-12", "12", false, true},
+		{"flyio", "staging-12", "", false, false},
+		{"flyio", "flyio-pool", "", false, false},
+		{"flyio", "flyio-snapshot-", "", false, false},
+		{"flyio", "flyio-7-extra", "", false, false},
+	}
+
+	for _, tt := range tests {
+		id, snapshot, ok := ParseDeviceName(tt.prefix, tt.name)
+		if id != tt.wantID || snapshot != tt.wantSnapshot || ok != tt.wantOK {
+			t.Errorf("ParseDeviceName(%q, %q) = %q, %v, %v; want %q, %v, %v",
+				tt.prefix, tt.name, id, snapshot, ok, tt.wantID, tt.wantSnapshot, tt.wantOK)
+		}
+	}
+}
+
+func TestParseDeviceList(t *testing.T) {
+	out := "flyio-7\t(253:3)\nflyio-snapshot-8\t(253:4)\nother-9\t(253:5)\npool\t(253:2)\n"
+	devices := parseDeviceList(out, "flyio")
+	if len(devices) != 2 {
+		t.Fatalf("parseDeviceList found %d devices, want 2: %+v", len(devices), devices)
+	}
+	if devices[0].DevicePath != "/dev/mapper/flyio-7" || devices[0].SnapshotID != 0 {
+		t.Errorf("devices[0] = %+v, want base device flyio-7", devices[0])
+	}
+	if devices[1].DevicePath != "/dev/mapper/flyio-snapshot-8" || devices[1].SnapshotID != 8 {
+		t.Errorf("devices[1] = %+v, want snapshot 8", devices[1])
+	}
+
+	if devices := parseDeviceList("No devices found\n", "flyio"); len(devices) != 0 {
+		t.Errorf("parseDeviceList(no devices) = %+v, want none", devices)
+	}
+}
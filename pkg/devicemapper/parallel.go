@@ -0,0 +1,198 @@
+package devicemapper
+
+import (
+	"bytes"
+	"os"
+	"runtime"
+	"sync"
+)
+
+// Defaults for extraction
+const (
+	defaultMaxBufferedBytes = 64 * 1024 * 1024
+	defaultCopyBufferSize   = 1024 * 1024
+)
+
+// ExtractOptions tunes tarball extraction
+type ExtractOptions struct {
+	// Layered applies the tarball on top of whatever destDir already
+	// holds: whiteout markers delete entries instead of being written out,
+	// and existing entries are replaced
+	Layered bool
+
+	// Parallel hands regular file writes to a worker pool while headers
+	// are still read in order. Ignored for layered extraction, whose
+	// entries must be applied strictly in sequence.
+	Parallel bool
+	// Workers bounds concurrent file writes (default: number of CPUs)
+	Workers int
+	// MaxBufferedBytes bounds file content held in memory waiting for a
+	// worker (default 64MiB). Larger files are written inline.
+	MaxBufferedBytes int64
+
+	// CopyBufferSize is the buffer used to stream file contents from the
+	// archive to disk (default 1MiB). One buffer is reused for every file
+	// written inline; files handed to workers are already in memory.
+	CopyBufferSize int
+
+	// SkipCompressionRatio disables the compression-ratio check for
+	// archives from a trusted source. File and total size limits still
+	// apply.
+	SkipCompressionRatio bool
+
+	// MaxTopLevelEntries fails extraction once an archive has more than
+	// this many distinct top-level entries, the mark of a tarbomb rather
+	// than an archive with one root (0 disables the check). With
+	// WarnTopLevelEntries it only logs a warning.
+	MaxTopLevelEntries  int
+	WarnTopLevelEntries bool
+
+	// Isolate extracts in a child process confined to a new mount
+	// namespace chrooted at the destination (Linux only)
+	Isolate bool
+	// Subpath extracts only the entries under this directory of the
+	// archive, e.g. "rootfs" for a tarball nesting its rootfs there, and
+	// maps them to the root of the destination. Other entries are
+	// rejected; the directories leading to it are skipped. Names are
+	// validated after the subpath is stripped.
+	Subpath string
+
+	// Resumable checkpoints ExtractTarball's progress in a file beside the
+	// destination, so a run interrupted partway can be repeated without
+	// rewriting the files it finished. Files are written inline rather
+	// than in parallel. Ignored by ExtractTarballAtomic and isolated or
+	// streamed extraction.
+	Resumable bool
+}
+
+func (o ExtractOptions) copyBufferSize() int {
+	if o.CopyBufferSize > 0 {
+		return o.CopyBufferSize
+	}
+	return defaultCopyBufferSize
+}
+
+func (o ExtractOptions) workers() int {
+	if o.Workers > 0 {
+		return o.Workers
+	}
+	return runtime.NumCPU()
+}
+
+func (o ExtractOptions) maxBufferedBytes() int64 {
+	if o.MaxBufferedBytes > 0 {
+		return o.MaxBufferedBytes
+	}
+	return defaultMaxBufferedBytes
+}
+
+// writeJob is a buffered regular file waiting to be written
+type writeJob struct {
+	target string
+	mode   os.FileMode
+	data   []byte
+}
+
+// writePool writes buffered files on a fixed set of workers, bounding the
+// bytes buffered but not yet written
+type writePool struct {
+	jobs    chan writeJob
+	workers sync.WaitGroup
+	pending sync.WaitGroup
+	budget  int64
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	inFlight int64
+	targets  map[string]bool
+	err      error
+}
+
+func newWritePool(workers int, budget int64) *writePool {
+	p := &writePool{
+		jobs:    make(chan writeJob),
+		budget:  budget,
+		targets: make(map[string]bool),
+	}
+	p.cond = sync.NewCond(&p.mu)
+
+	for i := 0; i < workers; i++ {
+		p.workers.Add(1)
+		go p.work()
+	}
+	return p
+}
+
+func (p *writePool) work() {
+	defer p.workers.Done()
+	for job := range p.jobs {
+		err := writeFile(job.target, bytes.NewReader(job.data), int64(len(job.data)), job.mode, nil)
+
+		p.mu.Lock()
+		if err != nil && p.err == nil {
+			p.err = err
+		}
+		p.mu.Unlock()
+
+		p.release(int64(len(job.data)))
+		p.pending.Done()
+	}
+}
+
+// acquire blocks until n more bytes fit in the buffer budget. A single
+// entry is always admitted when nothing else is in flight.
+func (p *writePool) acquire(n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.inFlight > 0 && p.inFlight+n > p.budget {
+		p.cond.Wait()
+	}
+	p.inFlight += n
+}
+
+func (p *writePool) release(n int64) {
+	p.mu.Lock()
+	p.inFlight -= n
+	p.mu.Unlock()
+	p.cond.Broadcast()
+}
+
+func (p *writePool) submit(job writeJob) {
+	p.mu.Lock()
+	p.targets[job.target] = true
+	p.mu.Unlock()
+
+	p.pending.Add(1)
+	p.jobs <- job
+}
+
+// dispatched reports whether target was handed to the pool since the last drain
+func (p *writePool) dispatched(target string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.targets[target]
+}
+
+// drain waits for all submitted writes to finish
+func (p *writePool) drain() error {
+	p.pending.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.targets = make(map[string]bool)
+	return p.err
+}
+
+func (p *writePool) firstErr() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// close drains the pool and stops its workers
+func (p *writePool) close() error {
+	err := p.drain()
+	close(p.jobs)
+	p.workers.Wait()
+	return err
+}
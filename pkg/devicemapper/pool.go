@@ -0,0 +1,185 @@
+package devicemapper
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/fly-io/162719/pkg/errors"
+)
+
+// ErrMetadataSpaceCritical is returned when thin pool metadata usage is at
+// or above the critical threshold. Running the metadata device out of space
+// corrupts the whole pool, so no new devices are created past this point.
+var ErrMetadataSpaceCritical = errors.New("thin pool metadata space critical")
+
+// ManagerOption configures a Manager
+type ManagerOption func(*managerOptions)
+
+type managerOptions struct {
+	metadataCriticalPercent float64
+	devicePrefix            string
+	poolTiers               []PoolTier
+}
+
+func defaultManagerOptions() managerOptions {
+	return managerOptions{
+		metadataCriticalPercent: DefaultMetadataCriticalPercent,
+		devicePrefix:            DefaultDevicePrefix,
+	}
+}
+
+// WithMetadataCriticalPercent sets the pool metadata usage, in percent, at
+// which device and snapshot creation are refused (default 95)
+func WithMetadataCriticalPercent(percent float64) ManagerOption {
+	return func(o *managerOptions) {
+		o.metadataCriticalPercent = percent
+	}
+}
+
+// WithDevicePrefix sets the prefix of device and snapshot names under
+// /dev/mapper (default flyio), so independent instances sharing a host
+// don't collide
+func WithDevicePrefix(prefix string) ManagerOption {
+	return func(o *managerOptions) {
+		o.devicePrefix = prefix
+	}
+}
+
+// PoolStatus reports thin pool block usage
+type PoolStatus struct {
+	DataBlockSize       int64 // bytes per data block
+	UsedDataBlocks      int64
+	TotalDataBlocks     int64
+	UsedMetadataBlocks  int64
+	TotalMetadataBlocks int64
+}
+
+// FreeDataBytes returns the unallocated data space in bytes
+func (p *PoolStatus) FreeDataBytes() int64 {
+	return (p.TotalDataBlocks - p.UsedDataBlocks) * p.DataBlockSize
+}
+
+// MetadataUsedPercent returns the share of metadata blocks in use
+func (p *PoolStatus) MetadataUsedPercent() float64 {
+	if p.TotalMetadataBlocks == 0 {
+		return 0
+	}
+	return float64(p.UsedMetadataBlocks) * 100 / float64(p.TotalMetadataBlocks)
+}
+
+// checkMetadataSpace refuses new devices once metadata usage reaches
+// criticalPercent. The error is fatal: retrying cannot free metadata.
+func checkMetadataSpace(status *PoolStatus, criticalPercent float64) error {
+	used := status.MetadataUsedPercent()
+	if used >= criticalPercent {
+		return errors.Fatal(fmt.Errorf("%w: %.1f%% used (%d/%d blocks), limit %.1f%%",
+			ErrMetadataSpaceCritical, used, status.UsedMetadataBlocks, status.TotalMetadataBlocks, criticalPercent))
+	}
+	return nil
+}
+
+// parsePoolStatus builds a PoolStatus from `dmsetup table` and `dmsetup status`
+// output for a thin-pool target:
+//
+//	table:  0 4194304 thin-pool 7:0 7:1 2048 32768
+//	status: 0 4194304 thin-pool 0 280/4096 0/2048 - rw discard_passdown ...
+func parsePoolStatus(table, status string) (*PoolStatus, error) {
+	tableFields := strings.Fields(table)
+	if len(tableFields) < 6 || tableFields[2] != "thin-pool" {
+		return nil, fmt.Errorf("unexpected thin-pool table: %q", table)
+	}
+	blockSectors, err := strconv.ParseInt(tableFields[5], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid data block size %q: %w", tableFields[5], err)
+	}
+
+	statusFields := strings.Fields(status)
+	if len(statusFields) < 6 || statusFields[2] != "thin-pool" {
+		return nil, fmt.Errorf("unexpected thin-pool status: %q", status)
+	}
+	usedMeta, totalMeta, err := parseUsage(statusFields[4])
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata usage: %w", err)
+	}
+	usedData, totalData, err := parseUsage(statusFields[5])
+	if err != nil {
+		return nil, fmt.Errorf("invalid data usage: %w", err)
+	}
+
+	return &PoolStatus{
+		DataBlockSize:       blockSectors * DefaultSectorSize,
+		UsedDataBlocks:      usedData,
+		TotalDataBlocks:     totalData,
+		UsedMetadataBlocks:  usedMeta,
+		TotalMetadataBlocks: totalMeta,
+	}, nil
+}
+
+// DeviceStats reports how much of a thin device is backed by pool blocks.
+// Thin devices are sparse: only blocks that have been written take space.
+type DeviceStats struct {
+	AllocatedBytes int64 // virtual size of the device
+	UsedBytes      int64 // bytes mapped to pool blocks
+	// HighestMappedSector is the last sector written, or -1 if none has been
+	HighestMappedSector int64
+}
+
+// UsedPercent returns the share of the device's virtual size in use
+func (d *DeviceStats) UsedPercent() float64 {
+	if d.AllocatedBytes == 0 {
+		return 0
+	}
+	return float64(d.UsedBytes) * 100 / float64(d.AllocatedBytes)
+}
+
+// parseThinStatus builds DeviceStats from `dmsetup status` output for a
+// thin target. The highest mapped sector is "-" before anything is written:
+//
+//	0 20971520 thin 3407872 20971519
+//	0 20971520 thin 0 -
+func parseThinStatus(status string) (*DeviceStats, error) {
+	fields := strings.Fields(status)
+	if len(fields) >= 4 && fields[2] == "thin" && fields[3] == "Fail" {
+		return nil, fmt.Errorf("thin device has failed: %q", status)
+	}
+	if len(fields) < 5 || fields[2] != "thin" {
+		return nil, fmt.Errorf("unexpected thin status: %q", status)
+	}
+
+	lengthSectors, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid device length %q: %w", fields[1], err)
+	}
+	mappedSectors, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mapped sectors %q: %w", fields[3], err)
+	}
+	highest := int64(-1)
+	if fields[4] != "-" {
+		if highest, err = strconv.ParseInt(fields[4], 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid highest mapped sector %q: %w", fields[4], err)
+		}
+	}
+
+	return &DeviceStats{
+		AllocatedBytes:      lengthSectors * DefaultSectorSize,
+		UsedBytes:           mappedSectors * DefaultSectorSize,
+		HighestMappedSector: highest,
+	}, nil
+}
+
+// parseUsage parses a "<used>/<total>" block count pair
+func parseUsage(field string) (used, total int64, err error) {
+	usedStr, totalStr, ok := strings.Cut(field, "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("expected used/total, got %q", field)
+	}
+	if used, err = strconv.ParseInt(usedStr, 10, 64); err != nil {
+		return 0, 0, err
+	}
+	if total, err = strconv.ParseInt(totalStr, 10, 64); err != nil {
+		return 0, 0, err
+	}
+	return used, total, nil
+}
@@ -0,0 +1,120 @@
+package devicemapper
+
+import (
+	"testing"
+
+	"github.com/fly-io/162719/pkg/errors"
+)
+
+func TestParsePoolStatus(t *testing.T) {
+	table := "0 4194304 thin-pool 7:0 7:1 2048 32768"
+	status := "0 4194304 thin-pool 1 280/4096 100/2048 - rw discard_passdown queue_if_no_space - 1024"
+
+	ps, err := parsePoolStatus(table, status)
+	if err != nil {
+		t.Fatalf("parsePoolStatus failed: %v", err)
+	}
+
+	if ps.DataBlockSize != 2048*512 {
+		t.Errorf("DataBlockSize = %d, want %d", ps.DataBlockSize, 2048*512)
+	}
+	if ps.UsedDataBlocks != 100 || ps.TotalDataBlocks != 2048 {
+		t.Errorf("data blocks = %d/%d, want 100/2048", ps.UsedDataBlocks, ps.TotalDataBlocks)
+	}
+	if ps.UsedMetadataBlocks != 280 || ps.TotalMetadataBlocks != 4096 {
+		t.Errorf("metadata blocks = %d/%d, want 280/4096", ps.UsedMetadataBlocks, ps.TotalMetadataBlocks)
+	}
+	if want := int64(1948 * 2048 * 512); ps.FreeDataBytes() != want {
+		t.Errorf("FreeDataBytes = %d, want %d", ps.FreeDataBytes(), want)
+	}
+}
+
+func TestParsePoolStatus_Invalid(t *testing.T) {
+	table := "0 4194304 thin-pool 7:0 7:1 2048 32768"
+	for _, status := range []string{
+		"",
+		"0 4194304 linear 7:0 0",
+		"0 4194304 thin-pool 1 280-4096 100/2048",
+		"0 4194304 thin-pool Fail",
+	} {
+		if _, err := parsePoolStatus(table, status); err == nil {
+			t.Errorf("expected error for status %q", status)
+		}
+	}
+}
+
+func TestParseThinStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  string
+		want    DeviceStats
+		percent float64
+	}{
+		{
+			name:    "partly written",
+			status:  "0 20971520 thin 3407872 20971519\n",
+			want:    DeviceStats{AllocatedBytes: 20971520 * 512, UsedBytes: 3407872 * 512, HighestMappedSector: 20971519},
+			percent: 3407872 * 100.0 / 20971520,
+		},
+		{
+			name:    "never written",
+			status:  "0 2097152 thin 0 -",
+			want:    DeviceStats{AllocatedBytes: 2097152 * 512, UsedBytes: 0, HighestMappedSector: -1},
+			percent: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseThinStatus(tt.status)
+			if err != nil {
+				t.Fatalf("parseThinStatus failed: %v", err)
+			}
+			if *got != tt.want {
+				t.Errorf("parseThinStatus = %+v, want %+v", *got, tt.want)
+			}
+			if got.UsedPercent() != tt.percent {
+				t.Errorf("UsedPercent = %f, want %f", got.UsedPercent(), tt.percent)
+			}
+		})
+	}
+}
+
+func TestParseThinStatus_Invalid(t *testing.T) {
+	for _, status := range []string{
+		"",
+		"0 20971520 thin Fail",
+		"0 4194304 thin-pool 1 280/4096 100/2048",
+		"0 20971520 thin many 20971519",
+		"0 20971520 thin 3407872",
+	} {
+		if _, err := parseThinStatus(status); err == nil {
+			t.Errorf("parseThinStatus(%q) succeeded, want error", status)
+		}
+	}
+}
+
+func TestCheckMetadataSpace(t *testing.T) {
+	tests := []struct {
+		used     int64
+		critical float64
+		wantErr  bool
+	}{
+		{used: 50, critical: 95},
+		{used: 94, critical: 95},
+		{used: 95, critical: 95, wantErr: true},
+		{used: 96, critical: 95, wantErr: true},
+		{used: 96, critical: 99},
+	}
+
+	for _, tt := range tests {
+		status := &PoolStatus{UsedMetadataBlocks: tt.used, TotalMetadataBlocks: 100}
+		err := checkMetadataSpace(status, tt.critical)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%d%% used, limit %.0f%%: error = %v, wantErr %v", tt.used, tt.critical, err, tt.wantErr)
+		}
+		if err != nil && (!errors.Is(err, ErrMetadataSpaceCritical) || !errors.IsFatal(err)) {
+			t.Errorf("expected fatal ErrMetadataSpaceCritical, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package devicemapper
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PoolTier is a thin pool taking devices up to MaxDeviceSize bytes
+// (0 for no limit)
+type PoolTier struct {
+	Name          string
+	MaxDeviceSize int64
+}
+
+// WithPoolTiers spreads new devices over several thin pools by size, e.g.
+// small images on an SSD pool and the rest on an HDD pool. Each device
+// goes to the pool with the smallest MaxDeviceSize that fits it; devices
+// too large for every tier go to the pool named in NewManager. Snapshots
+// always live in their source's pool. PoolStatus keeps reporting the
+// NewManager pool; PoolStatusFor reports the pool a device would go to.
+func WithPoolTiers(tiers ...PoolTier) ManagerOption {
+	return func(o *managerOptions) {
+		o.poolTiers = sortPoolTiers(tiers)
+	}
+}
+
+// ParsePoolTier parses a pool tier written as "name:maxbytes", or "name"
+// for a pool taking devices of any size
+func ParsePoolTier(s string) (PoolTier, error) {
+	name, size, hasSize := strings.Cut(s, ":")
+	if name == "" || strings.ContainsAny(name, "/ ") {
+		return PoolTier{}, fmt.Errorf("invalid pool name in %q", s)
+	}
+	tier := PoolTier{Name: name}
+	if hasSize {
+		n, err := strconv.ParseInt(size, 10, 64)
+		if err != nil || n <= 0 {
+			return PoolTier{}, fmt.Errorf("invalid max device size in %q: want a positive byte count", s)
+		}
+		tier.MaxDeviceSize = n
+	}
+	return tier, nil
+}
+
+// sortPoolTiers orders tiers by MaxDeviceSize, with unlimited tiers last
+func sortPoolTiers(tiers []PoolTier) []PoolTier {
+	sorted := append([]PoolTier(nil), tiers...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i].MaxDeviceSize, sorted[j].MaxDeviceSize
+		if a == 0 || b == 0 {
+			return b == 0 && a != 0
+		}
+		return a < b
+	})
+	return sorted
+}
+
+// selectPool returns the pool for a device of sizeBytes: the first of the
+// sorted tiers that fits it, or defaultPool
+func selectPool(tiers []PoolTier, defaultPool string, sizeBytes int64) string {
+	for _, tier := range tiers {
+		if tier.MaxDeviceSize == 0 || sizeBytes <= tier.MaxDeviceSize {
+			return tier.Name
+		}
+	}
+	return defaultPool
+}
+
+// poolNames returns defaultPool followed by the tiers' pools, without
+// duplicates
+func poolNames(defaultPool string, tiers []PoolTier) []string {
+	names := []string{defaultPool}
+	for _, tier := range tiers {
+		dup := false
+		for _, name := range names {
+			dup = dup || name == tier.Name
+		}
+		if !dup {
+			names = append(names, tier.Name)
+		}
+	}
+	return names
+}
+
+// parseThinPoolDevice returns the pool device, as major:minor, of a thin
+// device from its `dmsetup table` output:
+//
+//	0 2097152 thin 253:0 42
+func parseThinPoolDevice(table string) (string, error) {
+	fields := strings.Fields(table)
+	if len(fields) < 5 || fields[2] != "thin" {
+		return "", fmt.Errorf("unexpected thin table: %q", table)
+	}
+	return fields[3], nil
+}
@@ -0,0 +1,80 @@
+package devicemapper
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSelectPool(t *testing.T) {
+	const gib = 1024 * 1024 * 1024
+	// Given out of order: selection must not depend on it
+	tiers := sortPoolTiers([]PoolTier{
+		{Name: "hdd"},
+		{Name: "nvme", MaxDeviceSize: 512 * 1024 * 1024},
+		{Name: "ssd", MaxDeviceSize: 4 * gib},
+	})
+
+	tests := []struct {
+		name  string
+		tiers []PoolTier
+		size  int64
+		want  string
+	}{
+		{name: "no tiers", size: 100 * gib, want: "pool"},
+		{name: "smallest fitting tier", tiers: tiers, size: 256 * 1024 * 1024, want: "nvme"},
+		{name: "exactly at threshold", tiers: tiers, size: 4 * gib, want: "ssd"},
+		{name: "just over threshold", tiers: tiers, size: 4*gib + DefaultSectorSize, want: "hdd"},
+		{name: "unlimited tier takes the rest", tiers: tiers, size: 100 * gib, want: "hdd"},
+		{name: "default pool past every bounded tier", tiers: []PoolTier{{Name: "ssd", MaxDeviceSize: gib}}, size: 2 * gib, want: "pool"},
+		{name: "default device size", tiers: []PoolTier{{Name: "ssd", MaxDeviceSize: gib}}, size: DefaultDeviceSectors * DefaultSectorSize, want: "ssd"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := selectPool(tt.tiers, "pool", tt.size); got != tt.want {
+				t.Errorf("selectPool(%d) = %q, want %q", tt.size, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePoolTier(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    PoolTier
+		wantErr bool
+	}{
+		{in: "ssd:2147483648", want: PoolTier{Name: "ssd", MaxDeviceSize: 2147483648}},
+		{in: "hdd", want: PoolTier{Name: "hdd"}},
+		{in: "ssd:2G", wantErr: true},
+		{in: "ssd:0", wantErr: true},
+		{in: ":100", wantErr: true},
+		{in: "../pool", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParsePoolTier(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParsePoolTier(%q) err = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParsePoolTier(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestPoolNames(t *testing.T) {
+	got := poolNames("pool", []PoolTier{{Name: "ssd", MaxDeviceSize: 1}, {Name: "pool"}, {Name: "hdd"}})
+	if want := []string{"pool", "ssd", "hdd"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("poolNames = %v, want %v", got, want)
+	}
+}
+
+func TestParseThinPoolDevice(t *testing.T) {
+	dev, err := parseThinPoolDevice("0 2097152 thin 253:4 42\n")
+	if err != nil || dev != "253:4" {
+		t.Errorf("parseThinPoolDevice = %q, %v; want 253:4", dev, err)
+	}
+	if _, err := parseThinPoolDevice("0 2097152 linear 8:0 0"); err == nil {
+		t.Error("parseThinPoolDevice accepted a linear table")
+	}
+}
@@ -0,0 +1,55 @@
+package devicemapper
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// parseThinSectors returns the length in sectors of a thin device from its
+// `dmsetup table` output:
+//
+//	0 2097152 thin 253:0 42
+func parseThinSectors(table string) (int64, error) {
+	fields := strings.Fields(table)
+	if len(fields) < 3 || fields[2] != "thin" {
+		return 0, fmt.Errorf("unexpected thin table: %q", table)
+	}
+	sectors, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || sectors <= 0 {
+		return 0, fmt.Errorf("invalid sector count %q", fields[1])
+	}
+	return sectors, nil
+}
+
+// DeviceSectors returns the length in sectors of a device holding
+// sizeBytes, rounded up to a whole MiB. A size of 0 (or less) gives
+// DefaultDeviceSectors.
+func DeviceSectors(sizeBytes int64) int64 {
+	if sizeBytes <= 0 {
+		return DefaultDeviceSectors
+	}
+	const mib = 1024 * 1024
+	return (sizeBytes + mib - 1) / mib * (mib / DefaultSectorSize)
+}
+
+// sourceSectors resolves the size of a snapshot source so the snapshot
+// inherits it. Tracked devices are checked first, then the live table;
+// if neither is available the default size is used.
+func sourceSectors(devices map[string]*DeviceInfo, sourceID string, liveTable func() (string, error)) int64 {
+	if dev, ok := devices[sourceID]; ok && dev.Size > 0 {
+		return dev.Size / DefaultSectorSize
+	}
+
+	table, err := liveTable()
+	if err == nil {
+		var sectors int64
+		if sectors, err = parseThinSectors(table); err == nil {
+			return sectors
+		}
+	}
+
+	slog.Warn("source_size_unknown", "source_id", sourceID, "default_sectors", DefaultDeviceSectors, "error", err)
+	return DefaultDeviceSectors
+}
@@ -0,0 +1,67 @@
+package devicemapper
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSourceSectors(t *testing.T) {
+	noTable := func() (string, error) { return "", fmt.Errorf("not active") }
+
+	tests := []struct {
+		name     string
+		devices  map[string]*DeviceInfo
+		table    func() (string, error)
+		expected int64
+	}{
+		{
+			name:     "tracked base device",
+			devices:  map[string]*DeviceInfo{"7": {Size: 4194304 * DefaultSectorSize}},
+			table:    noTable,
+			expected: 4194304,
+		},
+		{
+			name:     "live table",
+			devices:  map[string]*DeviceInfo{},
+			table:    func() (string, error) { return "0 8388608 thin 253:0 7\n", nil },
+			expected: 8388608,
+		},
+		{
+			name:     "unknown falls back to default",
+			devices:  map[string]*DeviceInfo{},
+			table:    noTable,
+			expected: DefaultDeviceSectors,
+		},
+		{
+			name:     "unparseable table falls back to default",
+			devices:  map[string]*DeviceInfo{},
+			table:    func() (string, error) { return "0 100 linear 8:1 0", nil },
+			expected: DefaultDeviceSectors,
+		},
+	}
+
+	for _, tt := range tests {
+		if got := sourceSectors(tt.devices, "7", tt.table); got != tt.expected {
+			t.Errorf("%s: expected %d sectors, got %d", tt.name, tt.expected, got)
+		}
+	}
+}
+
+func TestDeviceSectors(t *testing.T) {
+	tests := []struct {
+		name      string
+		sizeBytes int64
+		expected  int64
+	}{
+		{name: "unsized uses default", sizeBytes: 0, expected: DefaultDeviceSectors},
+		{name: "whole MiB", sizeBytes: 64 * 1024 * 1024, expected: 131072},
+		{name: "rounds up to next MiB", sizeBytes: 64*1024*1024 + 1, expected: 131072 + 2048},
+		{name: "under one MiB", sizeBytes: 10, expected: 2048},
+	}
+
+	for _, tt := range tests {
+		if got := DeviceSectors(tt.sizeBytes); got != tt.expected {
+			t.Errorf("%s: expected %d sectors, got %d", tt.name, tt.expected, got)
+		}
+	}
+}
@@ -11,19 +11,40 @@ import (
 // StubManager is a no-op devicemapper for non-Linux systems
 type StubManager struct{}
 
-// NewManager creates a stub manager on non-Linux systems
-func NewManager(poolName string, dataSize, metadataSize int64) (Manager, error) {
+// NewManager creates a stub manager on non-Linux systems. Options are
+// accepted for API parity and ignored.
+func NewManager(poolName string, dataSize, metadataSize int64, opts ...ManagerOption) (Manager, error) {
 	return &StubManager{}, nil
 }
 
-func (m *StubManager) CreateDevice(ctx context.Context, extractedPath string, imageID string) (*DeviceInfo, error) {
+func (m *StubManager) CreateDevice(ctx context.Context, extractedPath string, imageID string, sizeBytes int64) (*DeviceInfo, error) {
 	return nil, fmt.Errorf("devicemapper not supported on %s", runtime.GOOS)
 }
 
-func (m *StubManager) CreateSnapshot(ctx context.Context, baseDeviceID string, snapshotID int) (*DeviceInfo, error) {
+func (m *StubManager) CreateSnapshot(ctx context.Context, sourceID string, snapshotID int) (*DeviceInfo, error) {
 	return nil, fmt.Errorf("devicemapper not supported on %s", runtime.GOOS)
 }
 
+func (m *StubManager) CreateSnapshots(ctx context.Context, specs []SnapshotSpec) ([]*DeviceInfo, []error) {
+	errs := make([]error, len(specs))
+	for i := range errs {
+		errs[i] = fmt.Errorf("devicemapper not supported on %s", runtime.GOOS)
+	}
+	return make([]*DeviceInfo, len(specs)), errs
+}
+
+func (m *StubManager) ActivateSnapshot(ctx context.Context, snapshotID int) (*DeviceInfo, error) {
+	return nil, fmt.Errorf("devicemapper not supported on %s", runtime.GOOS)
+}
+
+func (m *StubManager) DeactivateSnapshot(ctx context.Context, snapshotID int) error {
+	return fmt.Errorf("devicemapper not supported on %s", runtime.GOOS)
+}
+
+func (m *StubManager) DeleteSnapshot(ctx context.Context, snapshotID int) error {
+	return fmt.Errorf("devicemapper not supported on %s", runtime.GOOS)
+}
+
 func (m *StubManager) MountDevice(ctx context.Context, devicePath, mountPath string) error {
 	return fmt.Errorf("devicemapper not supported on %s", runtime.GOOS)
 }
@@ -32,10 +53,38 @@ func (m *StubManager) UnmountDevice(ctx context.Context, mountPath string) error
 	return fmt.Errorf("devicemapper not supported on %s", runtime.GOOS)
 }
 
+func (m *StubManager) ForceUnmount(ctx context.Context, mountPath string) error {
+	return fmt.Errorf("devicemapper not supported on %s", runtime.GOOS)
+}
+
+func (m *StubManager) CheckFilesystem(ctx context.Context, devicePath string) error {
+	return fmt.Errorf("devicemapper not supported on %s", runtime.GOOS)
+}
+
+func (m *StubManager) MountTmpfs(ctx context.Context, path string, sizeBytes int64) error {
+	return fmt.Errorf("devicemapper not supported on %s", runtime.GOOS)
+}
+
+func (m *StubManager) MountOverlay(ctx context.Context, lower, upper, work, target string) error {
+	return fmt.Errorf("devicemapper not supported on %s", runtime.GOOS)
+}
+
 func (m *StubManager) DeleteDevice(ctx context.Context, deviceID string) error {
 	return fmt.Errorf("devicemapper not supported on %s", runtime.GOOS)
 }
 
+func (m *StubManager) PoolStatus(ctx context.Context) (*PoolStatus, error) {
+	return nil, fmt.Errorf("devicemapper not supported on %s", runtime.GOOS)
+}
+
+func (m *StubManager) PoolStatusFor(ctx context.Context, sizeBytes int64) (*PoolStatus, error) {
+	return nil, fmt.Errorf("devicemapper not supported on %s", runtime.GOOS)
+}
+
+func (m *StubManager) DeviceStats(ctx context.Context, deviceID string) (*DeviceStats, error) {
+	return nil, fmt.Errorf("devicemapper not supported on %s", runtime.GOOS)
+}
+
 func (m *StubManager) ListDevices(ctx context.Context) ([]*DeviceInfo, error) {
 	return nil, fmt.Errorf("devicemapper not supported on %s", runtime.GOOS)
 }
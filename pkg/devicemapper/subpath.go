@@ -0,0 +1,45 @@
+package devicemapper
+
+import (
+	"archive/tar"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/fly-io/162719/pkg/security"
+)
+
+// CleanSubpath normalizes an extraction subpath such as "./rootfs/" to
+// "rootfs". It fails for subpaths that are empty, absolute or leave the
+// archive root.
+func CleanSubpath(subpath string) (string, error) {
+	if strings.HasPrefix(subpath, "/") {
+		return "", fmt.Errorf("invalid subpath %q: must be relative to the archive root", subpath)
+	}
+	clean := path.Clean(subpath)
+	if clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("invalid subpath %q: must name a directory inside the archive", subpath)
+	}
+	return clean, nil
+}
+
+// subpathEntry maps the entry named name onto the root of subpath, which
+// must already be clean. It reports false for the subpath directory itself
+// and the directories above it, which have nothing to extract, and
+// rejects anything else outside subpath. The mapping is purely textual:
+// "..", if any, is left for path validation to catch.
+func subpathEntry(name string, typeflag byte, subpath string) (string, bool, error) {
+	trimmed := name
+	for strings.HasPrefix(trimmed, "./") {
+		trimmed = trimmed[2:]
+	}
+	if rest, ok := strings.CutPrefix(trimmed, subpath+"/"); ok && strings.Trim(rest, "/") != "" {
+		return rest, true, nil
+	}
+
+	dir := strings.TrimSuffix(trimmed, "/")
+	if typeflag == tar.TypeDir && (dir == "" || dir == "." || dir == subpath || strings.HasPrefix(subpath, dir+"/")) {
+		return "", false, nil
+	}
+	return "", false, fmt.Errorf("%w: entry %s is outside extraction subpath %s", security.ErrRejected, name, subpath)
+}
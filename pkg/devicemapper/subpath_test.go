@@ -0,0 +1,94 @@
+package devicemapper
+
+import (
+	"archive/tar"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fly-io/162719/pkg/security"
+)
+
+func TestExtractTarball_SubpathStripsPrefix(t *testing.T) {
+	dir := t.TempDir()
+	tarPath := filepath.Join(dir, "image.tar")
+	writeTar(t, tarPath, []tarEntry{
+		{name: "./", typeflag: tar.TypeDir},
+		{name: "./rootfs/", typeflag: tar.TypeDir},
+		{name: "./rootfs/etc/", typeflag: tar.TypeDir},
+		{name: "./rootfs/etc/hosts", typeflag: tar.TypeReg, body: "127.0.0.1 localhost\n"},
+		{name: "./rootfs/etc/hosts.bak", typeflag: tar.TypeLink, linkname: "./rootfs/etc/hosts"},
+		{name: "./rootfs/bin/sh", typeflag: tar.TypeSymlink, linkname: "/usr/bin/dash"},
+	})
+	destDir := filepath.Join(dir, "extracted")
+
+	if err := ExtractTarball(tarPath, destDir, newTestValidator(), ExtractOptions{Subpath: "./rootfs/"}); err != nil {
+		t.Fatalf("ExtractTarball failed: %v", err)
+	}
+
+	for _, name := range []string{"etc/hosts", "etc/hosts.bak"} {
+		data, err := os.ReadFile(filepath.Join(destDir, name))
+		if err != nil || string(data) != "127.0.0.1 localhost\n" {
+			t.Errorf("%s not extracted at the root (err %v)", name, err)
+		}
+	}
+	if target, err := os.Readlink(filepath.Join(destDir, "bin/sh")); err != nil || target != "/usr/bin/dash" {
+		t.Errorf("bin/sh -> %q (err %v)", target, err)
+	}
+	if _, err := os.Stat(filepath.Join(destDir, "rootfs")); !os.IsNotExist(err) {
+		t.Errorf("subpath directory itself was extracted, stat err: %v", err)
+	}
+}
+
+func TestExtractTarball_SubpathRejectsOutsideEntries(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []tarEntry
+	}{
+		{
+			name: "file beside the subpath",
+			entries: []tarEntry{
+				{name: "rootfs/etc/hosts", typeflag: tar.TypeReg, body: "x"},
+				{name: "layer/etc/passwd", typeflag: tar.TypeReg, body: "x"},
+			},
+		},
+		{
+			name: "traversal after stripping",
+			entries: []tarEntry{
+				{name: "rootfs/../../etc/passwd", typeflag: tar.TypeReg, body: "x"},
+			},
+		},
+		{
+			name: "hardlink target outside",
+			entries: []tarEntry{
+				{name: "rootfs/etc/hosts", typeflag: tar.TypeLink, linkname: "secret"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			tarPath := filepath.Join(dir, "image.tar")
+			writeTar(t, tarPath, tt.entries)
+
+			err := ExtractTarball(tarPath, filepath.Join(dir, "extracted"), newTestValidator(), ExtractOptions{Subpath: "rootfs"})
+			if !errors.Is(err, security.ErrRejected) {
+				t.Errorf("err = %v, want a rejection", err)
+			}
+		})
+	}
+}
+
+func TestCleanSubpath(t *testing.T) {
+	for in, want := range map[string]string{"rootfs": "rootfs", "./rootfs/": "rootfs", "a/b/../c": "a/c"} {
+		if got, err := CleanSubpath(in); err != nil || got != want {
+			t.Errorf("CleanSubpath(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", ".", "/rootfs", "..", "../rootfs"} {
+		if _, err := CleanSubpath(in); err == nil {
+			t.Errorf("CleanSubpath(%q) succeeded", in)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package devicemapper
+
+import (
+	"fmt"
+	"log/slog"
+	"path"
+	"strings"
+
+	"github.com/fly-io/162719/pkg/errors"
+)
+
+// ErrTarbomb is returned for archives that scatter more top-level entries
+// than allowed instead of holding a single root
+var ErrTarbomb = errors.New("archive has no common root directory")
+
+// topLevelTracker records the distinct top-level entries of an archive
+// and enforces ExtractOptions.MaxTopLevelEntries
+type topLevelTracker struct {
+	max    int
+	warn   bool
+	seen   map[string]bool
+	warned bool
+}
+
+func newTopLevelTracker(opts ExtractOptions) *topLevelTracker {
+	if opts.MaxTopLevelEntries <= 0 {
+		return nil
+	}
+	return &topLevelTracker{
+		max:  opts.MaxTopLevelEntries,
+		warn: opts.WarnTopLevelEntries,
+		seen: make(map[string]bool),
+	}
+}
+
+// add records the top-level entry of an archive path. It fails once more
+// than max distinct entries are seen, or only logs in warn mode. A nil
+// tracker accepts everything.
+func (t *topLevelTracker) add(name string) error {
+	if t == nil {
+		return nil
+	}
+	top, _, _ := strings.Cut(path.Clean(strings.TrimPrefix(name, "./")), "/")
+	if top == "." || t.seen[top] {
+		return nil
+	}
+	t.seen[top] = true
+	if len(t.seen) <= t.max {
+		return nil
+	}
+
+	err := fmt.Errorf("%w: more than %d top-level entries", ErrTarbomb, t.max)
+	if !t.warn {
+		return err
+	}
+	if !t.warned {
+		t.warned = true
+		slog.Warn("tarbomb_detected", "max_toplevel_entries", t.max, "error", err)
+	}
+	return nil
+}
@@ -1,7 +1,10 @@
 // Package errors provides error wrapping utilities for context-aware error messages.
 package errors
 
-import "fmt"
+import (
+	stderrors "errors"
+	"fmt"
+)
 
 // Wrap wraps an error with additional context information.
 // If err is nil, it returns nil without wrapping.
@@ -11,3 +14,58 @@ func Wrap(err error, context string) error {
 	}
 	return fmt.Errorf("%s: %w", context, err)
 }
+
+// New returns an error with the given message, for use as a sentinel.
+func New(message string) error {
+	return stderrors.New(message)
+}
+
+// Is reports whether any error in err's chain matches target.
+func Is(err, target error) bool {
+	return stderrors.Is(err, target)
+}
+
+// As finds the first error in err's chain that matches target.
+func As(err error, target any) bool {
+	return stderrors.As(err, target)
+}
+
+// classified marks an error as transient or fatal without changing its message
+type classified struct {
+	err       error
+	transient bool
+}
+
+func (e *classified) Error() string { return e.err.Error() }
+func (e *classified) Unwrap() error { return e.err }
+
+// Transient marks err as temporary: retrying the operation may succeed
+// (network failures, throttling, busy resources).
+// If err is nil, it returns nil.
+func Transient(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &classified{err: err, transient: true}
+}
+
+// Fatal marks err as permanent: retrying cannot succeed (invalid input,
+// failed validation). If err is nil, it returns nil.
+func Fatal(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &classified{err: err, transient: false}
+}
+
+// IsTransient reports whether the outermost classification in err's chain is transient.
+func IsTransient(err error) bool {
+	var c *classified
+	return stderrors.As(err, &c) && c.transient
+}
+
+// IsFatal reports whether the outermost classification in err's chain is fatal.
+func IsFatal(err error) bool {
+	var c *classified
+	return stderrors.As(err, &c) && !c.transient
+}
@@ -0,0 +1,51 @@
+// Package events provides structured records of FSM state transitions
+// for ingestion by log pipelines, independent of the human-readable log.
+package events
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Outcome values for a transition attempt
+const (
+	OutcomeOK    = "ok"
+	OutcomeError = "error" // retryable failure
+	OutcomeAbort = "abort"
+)
+
+// Event records a single FSM state transition attempt
+type Event struct {
+	Time       time.Time `json:"time"`
+	State      string    `json:"state"`
+	S3Key      string    `json:"s3_key"`
+	DurationMS int64     `json:"duration_ms"`
+	Outcome    string    `json:"outcome"`
+	Retry      uint64    `json:"retry"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Emitter receives transition events
+type Emitter interface {
+	Emit(event Event) error
+}
+
+// JSONLines writes one JSON object per line
+type JSONLines struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewJSONLines creates an emitter writing JSON Lines to w
+func NewJSONLines(w io.Writer) *JSONLines {
+	return &JSONLines{enc: json.NewEncoder(w)}
+}
+
+// Emit writes the event as a single line
+func (j *JSONLines) Emit(event Event) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.enc.Encode(event)
+}
@@ -0,0 +1,90 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/fly-io/162719/pkg/db"
+	"github.com/superfly/fsm"
+)
+
+func TestHandleCheckDB_CountsAttemptsAcrossRestarts(t *testing.T) {
+	dbPath := "/tmp/test_images_attempts.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	repo, err := db.NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	const key = "images/flaky.tar"
+	run := func() (*ImageResponse, error) {
+		// A fresh Machine per run, as after a process restart: only the
+		// database carries state between runs
+		m := NewMachine(repo, nil, nil, nil, t.TempDir(), 5, WithMaxAttempts(3))
+		req := fsm.NewRequest(&ImageRequest{S3Key: key}, &ImageResponse{})
+		resp, err := m.handleCheckDB(context.Background(), req)
+		if err != nil {
+			return nil, err
+		}
+		return resp.Msg, nil
+	}
+
+	for want := 1; want <= 3; want++ {
+		resp, err := run()
+		if err != nil {
+			t.Fatalf("run %d: handleCheckDB failed: %v", want, err)
+		}
+		if resp.Attempts != want {
+			t.Errorf("run %d: Attempts = %d, want %d", want, resp.Attempts, want)
+		}
+		img, _ := repo.GetByS3Key(key)
+		if img.Attempts != want {
+			t.Errorf("run %d: stored attempts = %d, want %d", want, img.Attempts, want)
+		}
+	}
+
+	// The fourth run exceeds the budget even though every run started with
+	// a fresh in-context retry count
+	_, err = run()
+	var abortErr *fsm.AbortError
+	if !errors.As(err, &abortErr) || !errors.Is(err, ErrMaxAttemptsExceeded) {
+		t.Fatalf("expected abort with ErrMaxAttemptsExceeded, got %v", err)
+	}
+	img, _ := repo.GetByS3Key(key)
+	if img.Status != db.StatusFailed {
+		t.Errorf("status = %q, want %q", img.Status, db.StatusFailed)
+	}
+
+	// Reset restores the budget
+	if err := repo.Reset(img.ID); err != nil {
+		t.Fatalf("Reset failed: %v", err)
+	}
+	resp, err := run()
+	if err != nil {
+		t.Fatalf("run after reset failed: %v", err)
+	}
+	if resp.Attempts != 1 {
+		t.Errorf("Attempts after reset = %d, want 1", resp.Attempts)
+	}
+}
+
+func TestHandleCheckDB_RecordsExtractSubpath(t *testing.T) {
+	repo := newFakeRepo()
+	const key = "images/app.tar"
+	for _, subpath := range []string{"rootfs", "layer"} {
+		m := NewMachine(repo, nil, nil, nil, t.TempDir(), 5)
+		req := fsm.NewRequest(&ImageRequest{S3Key: key, ExtractSubpath: subpath}, &ImageResponse{})
+		if _, err := m.handleCheckDB(context.Background(), req); err != nil {
+			t.Fatalf("handleCheckDB: %v", err)
+		}
+		img, _ := repo.GetByS3KeyContext(context.Background(), key)
+		if img.ExtractSubpath != subpath {
+			t.Errorf("stored subpath = %q, want %q", img.ExtractSubpath, subpath)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package fsm
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"strings"
+
+	"github.com/fly-io/162719/pkg/errors"
+	"github.com/fly-io/162719/pkg/storage"
+)
+
+// ErrContentTypeNotAllowed is returned when an object's Content-Type is
+// not one of the required types, e.g. a tarball uploaded as text/plain
+var ErrContentTypeNotAllowed = errors.New("content type not allowed")
+
+// WithRequiredContentTypes rejects objects whose Content-Type isn't one of
+// types (e.g. application/x-tar) before downloading them. Parameters such
+// as charset are ignored. Objects whose source reports no content type,
+// and registry images, are not checked.
+func WithRequiredContentTypes(types ...string) Option {
+	return func(m *Machine) {
+		m.contentTypes = types
+	}
+}
+
+// checkContentType heads key and refuses it unless its content type is
+// allowed. It does nothing when no content types are required.
+func (m *Machine) checkContentType(ctx context.Context, req *ImageRequest, source storage.Source) error {
+	if len(m.contentTypes) == 0 || req.ImageRef != "" {
+		return nil
+	}
+
+	info, err := source.Head(ctx, req.Key())
+	if err != nil {
+		return errors.Wrap(err, "failed to check content type")
+	}
+	if info.ContentType == "" {
+		loggerFrom(ctx).Warn("content_type_check_skipped", "s3_key", req.Key(), "reason", "no_content_type")
+		return nil
+	}
+	if !contentTypeAllowed(info.ContentType, m.contentTypes) {
+		return errors.Fatal(fmt.Errorf("%w: %s has content type %q, want one of %s",
+			ErrContentTypeNotAllowed, req.Key(), info.ContentType, strings.Join(m.contentTypes, ", ")))
+	}
+	return nil
+}
+
+// contentTypeAllowed reports whether the media type of contentType is one
+// of allowed, compared case-insensitively without parameters
+func contentTypeAllowed(contentType string, allowed []string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, a := range allowed {
+		if want, _, err := mime.ParseMediaType(a); err == nil && want == mediaType {
+			return true
+		}
+	}
+	return false
+}
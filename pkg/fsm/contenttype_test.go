@@ -0,0 +1,73 @@
+package fsm
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/fly-io/162719/pkg/db"
+	"github.com/fly-io/162719/pkg/errors"
+	"github.com/fly-io/162719/pkg/storage"
+	"github.com/superfly/fsm"
+)
+
+func TestHandleDownload_RejectsDisallowedContentType(t *testing.T) {
+	dbPath := "/tmp/test_images_content_type.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	repo, err := db.NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	img := &db.Image{S3Key: "images/app.tar", Status: db.StatusPending}
+	if err := repo.Create(img); err != nil {
+		t.Fatalf("failed to create image: %v", err)
+	}
+
+	// headSource has no Download: reaching it would panic
+	source := &headSource{info: storage.ObjectInfo{Size: 1024, ContentType: "application/json"}}
+	m := NewMachine(repo, source, nil, nil, t.TempDir(), 5,
+		WithRequiredContentTypes("application/x-tar", "application/gzip", "application/octet-stream"))
+
+	req := fsm.NewRequest(&ImageRequest{S3Key: img.S3Key}, &ImageResponse{ImageID: img.ID})
+	_, err = m.handleDownload(context.Background(), req)
+	if !errors.Is(err, ErrContentTypeNotAllowed) {
+		t.Fatalf("handleDownload err = %v, want ErrContentTypeNotAllowed", err)
+	}
+	stored, _ := repo.GetByS3Key(img.S3Key)
+	if stored.Status != db.StatusFailed {
+		t.Errorf("status = %q, want failed", stored.Status)
+	}
+}
+
+func TestCheckContentType(t *testing.T) {
+	allowed := []string{"application/x-tar", "application/gzip"}
+
+	tests := []struct {
+		name        string
+		contentType string
+		imageRef    string
+		wantErr     bool
+	}{
+		{name: "allowed", contentType: "application/x-tar"},
+		{name: "parameters and case ignored", contentType: "Application/GZIP; charset=binary"},
+		{name: "disallowed", contentType: "text/plain", wantErr: true},
+		{name: "malformed", contentType: "not a type", wantErr: true},
+		// Local files carry no content type
+		{name: "none reported", contentType: ""},
+		{name: "registry images unchecked", contentType: "text/plain", imageRef: "ghcr.io/org/app:1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := &headSource{info: storage.ObjectInfo{ContentType: tt.contentType}}
+			m := NewMachine(nil, source, nil, nil, t.TempDir(), 5, WithRequiredContentTypes(allowed...))
+			err := m.checkContentType(context.Background(), &ImageRequest{S3Key: "images/app.tar", ImageRef: tt.imageRef}, source)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkContentType(%q) = %v, wantErr %v", tt.contentType, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package fsm
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/fly-io/162719/pkg/db"
+	"github.com/superfly/fsm"
+)
+
+func TestDegradations_ReportedWithoutDevicemapper(t *testing.T) {
+	dbPath := "/tmp/test_images_degraded.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	repo, err := db.NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	img := &db.Image{S3Key: "images/alpine.tar", Status: db.StatusDownloading}
+	if err := repo.Create(img); err != nil {
+		t.Fatalf("failed to create image: %v", err)
+	}
+
+	// A nil manager is what fetch passes on the stub platform
+	m := NewMachine(repo, nil, nil, nil, t.TempDir(), 5)
+
+	resp := &ImageResponse{ImageID: img.ID}
+	req := fsm.NewRequest(&ImageRequest{S3Key: img.S3Key}, resp)
+	ctx := context.Background()
+
+	if _, err := m.handleCreateDevice(ctx, req); err != nil {
+		t.Fatalf("handleCreateDevice failed: %v", err)
+	}
+	// A retried state must not report the same skip twice
+	if _, err := m.handleCreateDevice(ctx, req); err != nil {
+		t.Fatalf("handleCreateDevice retry failed: %v", err)
+	}
+	if _, err := m.handleComplete(ctx, req); err != nil {
+		t.Fatalf("handleComplete failed: %v", err)
+	}
+
+	if resp.Status != db.StatusReady {
+		t.Errorf("status = %q, want %q", resp.Status, db.StatusReady)
+	}
+	want := []string{
+		"device creation skipped: devicemapper unavailable",
+		"snapshot skipped: devicemapper unavailable",
+	}
+	if len(resp.Degradations) != len(want) {
+		t.Fatalf("degradations = %q, want %q", resp.Degradations, want)
+	}
+	for i := range want {
+		if resp.Degradations[i] != want[i] {
+			t.Errorf("degradations[%d] = %q, want %q", i, resp.Degradations[i], want[i])
+		}
+	}
+}
+
+func TestDegradations_NoneWithDevice(t *testing.T) {
+	dbPath := "/tmp/test_images_degraded.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	repo, err := db.NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	img := &db.Image{S3Key: "images/alpine.tar", Status: db.StatusDownloading, DevicePath: "/dev/mapper/flyio-1", BaseDeviceID: 1}
+	if err := repo.Create(img); err != nil {
+		t.Fatalf("failed to create image: %v", err)
+	}
+
+	m := NewMachine(repo, nil, nil, &fakeManager{}, t.TempDir(), 5)
+
+	resp := &ImageResponse{ImageID: img.ID}
+	req := fsm.NewRequest(&ImageRequest{S3Key: img.S3Key}, resp)
+	if _, err := m.handleComplete(context.Background(), req); err != nil {
+		t.Fatalf("handleComplete failed: %v", err)
+	}
+	if len(resp.Degradations) != 0 {
+		t.Errorf("degradations = %q, want none", resp.Degradations)
+	}
+}
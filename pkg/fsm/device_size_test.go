@@ -0,0 +1,107 @@
+package fsm
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fly-io/162719/pkg/db"
+	"github.com/fly-io/162719/pkg/devicemapper"
+	"github.com/fly-io/162719/pkg/security"
+	"github.com/superfly/fsm"
+)
+
+func TestHandleValidate_RecordsExtractedSize(t *testing.T) {
+	dbPath := "/tmp/test_images_device_size.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	repo, err := db.NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	workDir := t.TempDir()
+	validator := security.NewValidator(1024*1024, 10*1024*1024, 1000.0)
+	m := NewMachine(repo, nil, validator, nil, workDir, 5)
+
+	tarPath := filepath.Join(workDir, "image.tar")
+	writeTestTar(t, tarPath, map[string]string{"etc/hostname": "alpine", "bin/sh": strings.Repeat("x", 4000)})
+	digest := "sha256:" + strings.Repeat("cd", 32)
+
+	for _, key := range []string{"images/a.tar", "images/b.tar"} { // the second reuses the cached tree
+		req := fsm.NewRequest(&ImageRequest{S3Key: key}, &ImageResponse{SHA256: digest, DownloadPath: tarPath, DownloadSize: 8192})
+		resp, err := m.handleValidate(context.Background(), req)
+		if err != nil {
+			t.Fatalf("%s: handleValidate failed: %v", key, err)
+		}
+		if resp.Msg.ExtractedSize != 4006 {
+			t.Errorf("%s: ExtractedSize = %d, want 4006", key, resp.Msg.ExtractedSize)
+		}
+	}
+}
+
+func TestHandleCreateDevice_SizesDeviceFromExtractedSize(t *testing.T) {
+	const extractedSize = 200 * 1024 * 1024
+
+	tests := []struct {
+		name        string
+		opts        []Option
+		wantSize    int64
+		wantSectors int64
+	}{
+		{
+			// 200MiB + 25% + 64MiB for ext4 = 314MiB
+			name:        "extracted size plus headroom",
+			opts:        []Option{WithDeviceHeadroom(0.25)},
+			wantSize:    314 * 1024 * 1024,
+			wantSectors: 314 * 2048,
+		},
+		{
+			name:        "fixed size without headroom",
+			wantSize:    0,
+			wantSectors: devicemapper.DefaultDeviceSectors,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dbPath := "/tmp/test_images_device_size.db"
+			os.Remove(dbPath)
+			defer os.Remove(dbPath)
+
+			repo, err := db.NewRepository(dbPath)
+			if err != nil {
+				t.Fatalf("failed to create repository: %v", err)
+			}
+			defer repo.Close()
+
+			img := &db.Image{S3Key: "images/alpine.tar", Status: db.StatusDownloading}
+			if err := repo.Create(img); err != nil {
+				t.Fatalf("failed to create image: %v", err)
+			}
+
+			dm := &fakeManager{poolStatus: &devicemapper.PoolStatus{DataBlockSize: 1 << 20, TotalDataBlocks: 1 << 20}}
+			m := NewMachine(repo, nil, nil, dm, t.TempDir(), 5, tt.opts...)
+
+			resp := &ImageResponse{ImageID: img.ID, ExtractedPath: t.TempDir(), ExtractedSize: extractedSize}
+			req := fsm.NewRequest(&ImageRequest{S3Key: img.S3Key}, resp)
+			if _, err := m.handleCreateDevice(context.Background(), req); err != nil {
+				t.Fatalf("handleCreateDevice failed: %v", err)
+			}
+
+			if len(dm.sizes) != 1 {
+				t.Fatalf("CreateDevice called %d times, want 1", len(dm.sizes))
+			}
+			if dm.sizes[0] != tt.wantSize {
+				t.Errorf("device size = %d, want %d", dm.sizes[0], tt.wantSize)
+			}
+			if got := devicemapper.DeviceSectors(dm.sizes[0]); got != tt.wantSectors {
+				t.Errorf("device sectors = %d, want %d", got, tt.wantSectors)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package fsm
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fly-io/162719/pkg/db"
+	"github.com/fly-io/162719/pkg/storage"
+)
+
+// headSource is a Source whose Head reports a fixed ETag and size
+type headSource struct {
+	storage.Source
+	info storage.ObjectInfo
+}
+
+func (s *headSource) Head(ctx context.Context, key string) (*storage.ObjectInfo, error) {
+	info := s.info
+	return &info, nil
+}
+
+func TestDownloadIsCurrent_MultipartETagChecksDigest(t *testing.T) {
+	const (
+		simple    = "9b2cf535f27731c974343645a3985328"
+		multipart = "d41d8cd98f00b204e9800998ecf8427e-12"
+		content   = "image tarball"
+	)
+
+	tests := []struct {
+		name           string
+		etag           string
+		corruptLocal   bool
+		trustMultipart bool
+		want           bool
+	}{
+		{"simple etag match", simple, false, false, true},
+		// A plain ETag is the content's MD5 and is trusted as is
+		{"simple etag match skips digest", simple, true, false, true},
+		{"multipart etag match with digest match", multipart, false, false, true},
+		{"multipart etag match with digest mismatch", multipart, true, false, false},
+		{"multipart etag trusted when configured", multipart, true, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := &headSource{info: storage.ObjectInfo{ETag: tt.etag, Size: int64(len(content))}}
+			var opts []Option
+			if tt.trustMultipart {
+				opts = append(opts, WithTrustMultipartETags())
+			}
+			m := NewMachine(nil, source, nil, nil, t.TempDir(), 5, opts...)
+
+			img := &db.Image{S3Key: "images/app.tar", ETag: tt.etag}
+			localPath := m.downloadPath(img.S3Key)
+			if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(localPath, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			digest, err := storage.FileDigest(localPath, "sha256")
+			if err != nil {
+				t.Fatal(err)
+			}
+			img.SHA256 = digest
+			if tt.corruptLocal {
+				// Same size, different bytes
+				if err := os.WriteFile(localPath, []byte("IMAGE TARBALL"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			_, got := m.downloadIsCurrent(context.Background(), &ImageRequest{S3Key: img.S3Key}, img)
+			if got != tt.want {
+				t.Errorf("downloadIsCurrent = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDownloadIsCurrent_SimpleETagChecksSize(t *testing.T) {
+	const content = "image tarball"
+	source := &headSource{info: storage.ObjectInfo{ETag: "9b2cf535f27731c974343645a3985328", Size: int64(len(content))}}
+	m := NewMachine(nil, source, nil, nil, t.TempDir(), 5)
+
+	img := &db.Image{S3Key: "images/app.tar", ETag: source.info.ETag}
+	localPath := m.downloadPath(img.S3Key)
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(localPath, []byte(content[:5]), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := m.downloadIsCurrent(context.Background(), &ImageRequest{S3Key: img.S3Key}, img); ok {
+		t.Error("truncated download with a matching ETag was reused")
+	}
+}
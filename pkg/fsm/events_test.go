@@ -0,0 +1,72 @@
+package fsm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/fly-io/162719/pkg/events"
+	"github.com/superfly/fsm"
+)
+
+func TestInstrument_EmitsJSONLinePerTransition(t *testing.T) {
+	var buf bytes.Buffer
+	m := NewMachine(nil, nil, nil, nil, "", 5, WithEventEmitter(events.NewJSONLines(&buf)))
+
+	ok := func(ctx context.Context, req *fsm.Request[ImageRequest, ImageResponse]) (*fsm.Response[ImageResponse], error) {
+		return fsm.NewResponse(req.W.Msg), nil
+	}
+	retryable := func(ctx context.Context, req *fsm.Request[ImageRequest, ImageResponse]) (*fsm.Response[ImageResponse], error) {
+		return nil, fmt.Errorf("connection reset")
+	}
+	aborted := func(ctx context.Context, req *fsm.Request[ImageRequest, ImageResponse]) (*fsm.Response[ImageResponse], error) {
+		return nil, fsm.Abort(fmt.Errorf("compression bomb"))
+	}
+
+	req := fsm.NewRequest(&ImageRequest{S3Key: "images/alpine.tar"}, &ImageResponse{})
+	ctx := context.Background()
+	m.instrument(StateCheckDB, ok)(ctx, req)
+	m.instrument(StateDownload, retryable)(ctx, req)
+	m.instrument(StateValidate, aborted)(ctx, req)
+
+	want := []struct {
+		state   string
+		outcome string
+	}{
+		{StateCheckDB, events.OutcomeOK},
+		{StateDownload, events.OutcomeError},
+		{StateValidate, events.OutcomeAbort},
+	}
+
+	scanner := bufio.NewScanner(&buf)
+	i := 0
+	for ; scanner.Scan(); i++ {
+		var raw map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &raw); err != nil {
+			t.Fatalf("line %d is not valid JSON: %v", i, err)
+		}
+		for _, field := range []string{"time", "state", "s3_key", "duration_ms", "outcome"} {
+			if _, ok := raw[field]; !ok {
+				t.Errorf("line %d missing field %q", i, field)
+			}
+		}
+
+		var event events.Event
+		json.Unmarshal(scanner.Bytes(), &event)
+		if i >= len(want) {
+			continue
+		}
+		if event.State != want[i].state || event.Outcome != want[i].outcome || event.S3Key != "images/alpine.tar" {
+			t.Errorf("line %d = %+v, want state=%s outcome=%s", i, event, want[i].state, want[i].outcome)
+		}
+		if event.Outcome != events.OutcomeOK && event.Error == "" {
+			t.Errorf("line %d: failed transition should carry an error", i)
+		}
+	}
+	if i != len(want) {
+		t.Errorf("got %d event lines, want %d", i, len(want))
+	}
+}
@@ -0,0 +1,119 @@
+package fsm
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/fly-io/162719/pkg/devicemapper"
+)
+
+// fakeManager is an in-memory devicemapper.Manager for handler tests
+type fakeManager struct {
+	poolStatus *devicemapper.PoolStatus
+	poolErr    error
+	fsckErr    error
+	// poolStatusSizes records the sizeBytes of each PoolStatusFor call
+	poolStatusSizes []int64
+
+	checked []string
+	created []string
+	// sizes records the sizeBytes of each CreateDevice call
+	sizes   []int64
+	deleted []string
+	// ops logs device and mount calls in order, e.g. "unmount /path"
+	ops []string
+	// onCreateSnapshot, if set, runs at the start of CreateSnapshot
+	onCreateSnapshot func(snapshotID int)
+}
+
+var _ devicemapper.Manager = (*fakeManager)(nil)
+
+func (f *fakeManager) CreateDevice(ctx context.Context, extractedPath string, imageID string, sizeBytes int64) (*devicemapper.DeviceInfo, error) {
+	f.created = append(f.created, imageID)
+	f.sizes = append(f.sizes, sizeBytes)
+	f.ops = append(f.ops, "create "+imageID)
+	return &devicemapper.DeviceInfo{DevicePath: "/dev/mapper/flyio-" + imageID}, nil
+}
+
+func (f *fakeManager) CreateSnapshot(ctx context.Context, sourceID string, snapshotID int) (*devicemapper.DeviceInfo, error) {
+	if f.onCreateSnapshot != nil {
+		f.onCreateSnapshot(snapshotID)
+	}
+	return &devicemapper.DeviceInfo{SnapshotID: snapshotID}, nil
+}
+
+func (f *fakeManager) CreateSnapshots(ctx context.Context, specs []devicemapper.SnapshotSpec) ([]*devicemapper.DeviceInfo, []error) {
+	infos := make([]*devicemapper.DeviceInfo, len(specs))
+	for i, spec := range specs {
+		infos[i] = &devicemapper.DeviceInfo{SnapshotID: spec.SnapshotID}
+	}
+	return infos, make([]error, len(specs))
+}
+
+func (f *fakeManager) ActivateSnapshot(ctx context.Context, snapshotID int) (*devicemapper.DeviceInfo, error) {
+	return &devicemapper.DeviceInfo{SnapshotID: snapshotID}, nil
+}
+
+func (f *fakeManager) DeactivateSnapshot(ctx context.Context, snapshotID int) error {
+	return nil
+}
+
+func (f *fakeManager) CheckFilesystem(ctx context.Context, devicePath string) error {
+	f.checked = append(f.checked, devicePath)
+	return f.fsckErr
+}
+
+func (f *fakeManager) DeleteSnapshot(ctx context.Context, snapshotID int) error {
+	f.ops = append(f.ops, "delete snapshot "+strconv.Itoa(snapshotID))
+	return nil
+}
+
+func (f *fakeManager) MountDevice(ctx context.Context, devicePath, mountPath string) error {
+	f.ops = append(f.ops, "mount "+mountPath)
+	return nil
+}
+
+func (f *fakeManager) UnmountDevice(ctx context.Context, mountPath string) error {
+	f.ops = append(f.ops, "unmount "+mountPath)
+	return nil
+}
+
+func (f *fakeManager) ForceUnmount(ctx context.Context, mountPath string) error {
+	return nil
+}
+
+func (f *fakeManager) MountTmpfs(ctx context.Context, path string, sizeBytes int64) error {
+	return nil
+}
+
+func (f *fakeManager) MountOverlay(ctx context.Context, lower, upper, work, target string) error {
+	f.ops = append(f.ops, "overlay "+lower+" "+target)
+	return nil
+}
+
+func (f *fakeManager) DeleteDevice(ctx context.Context, deviceID string) error {
+	f.deleted = append(f.deleted, deviceID)
+	f.ops = append(f.ops, "delete "+deviceID)
+	return nil
+}
+
+func (f *fakeManager) PoolStatus(ctx context.Context) (*devicemapper.PoolStatus, error) {
+	return f.poolStatus, f.poolErr
+}
+
+func (f *fakeManager) PoolStatusFor(ctx context.Context, sizeBytes int64) (*devicemapper.PoolStatus, error) {
+	f.poolStatusSizes = append(f.poolStatusSizes, sizeBytes)
+	return f.poolStatus, f.poolErr
+}
+
+func (f *fakeManager) DeviceStats(ctx context.Context, deviceID string) (*devicemapper.DeviceStats, error) {
+	return nil, nil
+}
+
+func (f *fakeManager) ListDevices(ctx context.Context) ([]*devicemapper.DeviceInfo, error) {
+	return nil, nil
+}
+
+func (f *fakeManager) Close() error {
+	return nil
+}
@@ -0,0 +1,146 @@
+package fsm
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/fly-io/162719/pkg/db"
+)
+
+// fakeRepo is an in-memory Repo for handler tests that don't need SQLite.
+// Images are stored and returned by copy, as rows would be.
+type fakeRepo struct {
+	mu       sync.Mutex
+	images   map[int64]*db.Image
+	packages map[int64][]db.Package
+	nextID   int64
+	deviceID int
+}
+
+var _ Repo = (*fakeRepo)(nil)
+
+func newFakeRepo() *fakeRepo {
+	return &fakeRepo{images: make(map[int64]*db.Image), packages: make(map[int64][]db.Package)}
+}
+
+// image returns a copy of the stored image with id, or nil
+func (f *fakeRepo) image(id int64) *db.Image {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	img, ok := f.images[id]
+	if !ok {
+		return nil
+	}
+	c := *img
+	return &c
+}
+
+func (f *fakeRepo) CreateContext(ctx context.Context, img *db.Image) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, existing := range f.images {
+		if existing.S3Key == img.S3Key {
+			return fmt.Errorf("image already exists: %s", img.S3Key)
+		}
+	}
+	f.nextID++
+	img.ID = f.nextID
+	c := *img
+	f.images[img.ID] = &c
+	return nil
+}
+
+func (f *fakeRepo) GetByS3KeyContext(ctx context.Context, s3Key string) (*db.Image, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, img := range f.images {
+		if img.S3Key == s3Key {
+			c := *img
+			return &c, nil
+		}
+	}
+	return nil, nil
+}
+
+func (f *fakeRepo) UpdateContext(ctx context.Context, img *db.Image) error {
+	return f.modify(img.ID, func(stored *db.Image) {
+		*stored = *img
+	})
+}
+
+func (f *fakeRepo) UpdateStatusContext(ctx context.Context, id int64, status, errorMessage string) error {
+	// Like the SQL UPDATE, a missing row is not an error
+	f.modify(id, func(img *db.Image) {
+		img.Status = status
+		img.ErrorMessage = errorMessage
+	})
+	return nil
+}
+
+func (f *fakeRepo) IncrementAttemptsContext(ctx context.Context, id int64) (int, error) {
+	var attempts int
+	err := f.modify(id, func(img *db.Image) {
+		img.Attempts++
+		attempts = img.Attempts
+	})
+	return attempts, err
+}
+
+func (f *fakeRepo) SetTreeHashContext(ctx context.Context, id int64, hash string) error {
+	return f.modify(id, func(img *db.Image) { img.TreeHash = hash })
+}
+
+func (f *fakeRepo) SetDownloadCompressionContext(ctx context.Context, id int64, compression string) error {
+	return f.modify(id, func(img *db.Image) { img.DownloadCompression = compression })
+}
+
+func (f *fakeRepo) ReplacePackagesContext(ctx context.Context, imageID int64, pkgs []db.Package) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.packages[imageID] = append([]db.Package(nil), pkgs...)
+	return nil
+}
+
+func (f *fakeRepo) TotalDownloadedBytesContext(ctx context.Context) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var total int64
+	for _, img := range f.images {
+		if img.Status == db.StatusReady {
+			total += img.DownloadSize
+		}
+	}
+	return total, nil
+}
+
+func (f *fakeRepo) CountByTreeContext(ctx context.Context, digest, subpath string, excludeID int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	count := 0
+	for _, img := range f.images {
+		if img.SHA256 == digest && img.ExtractSubpath == subpath && img.ID != excludeID {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (f *fakeRepo) AllocateNextDeviceID(ctx context.Context) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deviceID++
+	return f.deviceID, nil
+}
+
+// modify applies fn to the stored image with id
+func (f *fakeRepo) modify(id int64, fn func(img *db.Image)) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	img, ok := f.images[id]
+	if !ok {
+		return fmt.Errorf("image not found: id=%d", id)
+	}
+	fn(img)
+	return nil
+}
@@ -0,0 +1,31 @@
+package fsm
+
+import (
+	"context"
+
+	"github.com/superfly/fsm"
+)
+
+// StateHook is called on entry to a state with the request and the
+// response as built so far. Hooks observe; changes they make to resp are
+// seen by the state's handler.
+type StateHook func(ctx context.Context, req *ImageRequest, resp *ImageResponse)
+
+// WithStateHooks registers hooks keyed by state name (StateCheckDB,
+// StateDownload, ...). A hook fires each time its state's handler runs,
+// so a retried state fires again.
+func WithStateHooks(hooks map[string]StateHook) Option {
+	return func(m *Machine) {
+		m.stateHooks = hooks
+	}
+}
+
+// withStateHook wraps a state handler to fire the state's hook first
+func (m *Machine) withStateHook(state string, handler transitionFunc) transitionFunc {
+	return func(ctx context.Context, req *fsm.Request[ImageRequest, ImageResponse]) (*fsm.Response[ImageResponse], error) {
+		if hook := m.stateHooks[state]; hook != nil {
+			hook(ctx, req.Msg, req.W.Msg)
+		}
+		return handler(ctx, req)
+	}
+}
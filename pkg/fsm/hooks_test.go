@@ -0,0 +1,75 @@
+package fsm
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fly-io/162719/pkg/db"
+	"github.com/fly-io/162719/pkg/security"
+	"github.com/fly-io/162719/pkg/storage"
+	"github.com/superfly/fsm"
+)
+
+func TestStateHooks_FireInOrderForFullRun(t *testing.T) {
+	dbPath := "/tmp/test_images_hooks.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	repo, err := db.NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	sourceDir := t.TempDir()
+	writeTestTar(t, filepath.Join(sourceDir, "alpine.tar"), map[string]string{"etc/hostname": "alpine", "bin/sh": "#!shell"})
+	source, err := storage.NewLocalSource(sourceDir, storage.ClientOptions{HashAlgorithm: "sha256"})
+	if err != nil {
+		t.Fatalf("local source: %v", err)
+	}
+
+	var fired []string
+	record := func(state string) StateHook {
+		return func(ctx context.Context, req *ImageRequest, resp *ImageResponse) {
+			if req.S3Key != "alpine.tar" || resp == nil {
+				t.Errorf("hook for %s got key %q, response %v", state, req.S3Key, resp)
+			}
+			fired = append(fired, state)
+		}
+	}
+	states := []string{StateCheckDB, StateDownload, StateValidate, StateCreateDevice, StateScan, StateComplete}
+	hooks := make(map[string]StateHook)
+	for _, state := range states {
+		hooks[state] = record(state)
+	}
+
+	validator := security.NewValidator(1<<20, 1<<30, 1000)
+	m := NewMachine(repo, source, validator, nil, t.TempDir(), 5, WithStateHooks(hooks))
+
+	ctx := context.Background()
+	manager, err := fsm.New(fsm.Config{DBPath: filepath.Join(t.TempDir(), "fsm.db")})
+	if err != nil {
+		t.Fatalf("fsm manager: %v", err)
+	}
+	defer manager.Shutdown(time.Second)
+
+	start, _, err := m.Register(ctx, manager)
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	version, err := start(ctx, "alpine.tar", fsm.NewRequest(&ImageRequest{S3Key: "alpine.tar"}, &ImageResponse{}))
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	if err := manager.Wait(ctx, version); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+
+	if !reflect.DeepEqual(fired, states) {
+		t.Errorf("hooks fired %v, want %v", fired, states)
+	}
+}
@@ -0,0 +1,57 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/fly-io/162719/pkg/db"
+)
+
+func TestCheckHostCapacity(t *testing.T) {
+	dbPath := "/tmp/test_images_host_capacity.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	repo, err := db.NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	// 600 bytes already on the host; failed images don't count
+	for _, img := range []*db.Image{
+		{S3Key: "a.tar", Status: db.StatusReady, DownloadSize: 400},
+		{S3Key: "b.tar", Status: db.StatusReady, DownloadSize: 200},
+		{S3Key: "c.tar", Status: db.StatusFailed, DownloadSize: 5000},
+	} {
+		if err := repo.Create(img); err != nil {
+			t.Fatalf("failed to create image: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		limit   int64
+		size    int64
+		wantErr error
+	}{
+		{name: "unlimited", limit: 0, size: 1 << 40},
+		{name: "fits exactly", limit: 1000, size: 400},
+		{name: "over limit", limit: 1000, size: 401, wantErr: ErrHostCapacityExceeded},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMachine(repo, nil, nil, nil, "", 5, WithMaxHostExtractedSize(tt.limit))
+			err := m.checkHostCapacity(context.Background(), tt.size)
+			if tt.wantErr == nil && err != nil {
+				t.Errorf("expected no error, got %v", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("expected %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
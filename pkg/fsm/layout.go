@@ -0,0 +1,104 @@
+package fsm
+
+import (
+	"encoding/hex"
+	"path/filepath"
+
+	"github.com/fly-io/162719/pkg/devicemapper"
+	"github.com/fly-io/162719/pkg/storage"
+)
+
+// Layout resolves where work files live on disk. Downloads and extracted
+// trees are scratch data and may sit on a different volume than mounts.
+type Layout struct {
+	WorkDir    string // device mount points
+	ScratchDir string // downloads and extracted trees; WorkDir when empty
+}
+
+// NewLayout builds a Layout, defaulting scratchDir to workDir
+func NewLayout(workDir, scratchDir string) Layout {
+	if scratchDir == "" {
+		scratchDir = workDir
+	}
+	return Layout{WorkDir: workDir, ScratchDir: scratchDir}
+}
+
+// DownloadsDir holds downloaded tarballs
+func (l Layout) DownloadsDir() string {
+	return filepath.Join(l.ScratchDir, "downloads")
+}
+
+// ExtractedDir holds extracted trees
+func (l Layout) ExtractedDir() string {
+	return filepath.Join(l.ScratchDir, "extracted")
+}
+
+// FailedDir holds the extracted trees of failed images kept for
+// inspection
+func (l Layout) FailedDir() string {
+	return filepath.Join(l.ScratchDir, "failed")
+}
+
+// DownloadPath returns the local path an S3 key is downloaded to
+func (l Layout) DownloadPath(s3Key string) string {
+	return filepath.Join(l.DownloadsDir(), storage.LocalName(s3Key))
+}
+
+// ExtractPath returns the local directory an S3 key is extracted into
+func (l Layout) ExtractPath(s3Key string) string {
+	return filepath.Join(l.ExtractedDir(), storage.LocalName(s3Key))
+}
+
+// TreePath returns where an image's extracted tree lives: the digest-
+// addressed cache when the digest is known, else the per-key directory.
+// A tree extracted from a subpath of the archive is a different tree, so
+// it gets its own directory beside the whole archive's, named by the
+// cleaned subpath so spellings of one directory share it.
+func (l Layout) TreePath(s3Key, digest, subpath string) string {
+	path := l.CachedTreePath(digest)
+	if path == "" {
+		path = l.ExtractPath(s3Key)
+	}
+	if subpath != "" {
+		if clean, err := devicemapper.CleanSubpath(subpath); err == nil {
+			subpath = clean
+		}
+		path += SubpathTreeSeparator + storage.LocalName(subpath)
+	}
+	return path
+}
+
+// MountsDir holds device mount points
+func (l Layout) MountsDir() string {
+	return filepath.Join(l.WorkDir, "mounts")
+}
+
+// MountPath returns where a device is mounted while being populated
+func (l Layout) MountPath(deviceID string) string {
+	return filepath.Join(l.MountsDir(), deviceID)
+}
+
+// OverlayDir holds the upper, work and merged directories of an S3 key's
+// overlay with the overlay storage driver
+func (l Layout) OverlayDir(s3Key string) string {
+	return filepath.Join(l.WorkDir, "overlay", storage.LocalName(s3Key))
+}
+
+// CachedTreePath returns the directory an image with the given digest is
+// extracted into, or "" if the digest is empty or malformed. sha256 trees
+// are named by their hex digest; other algorithms are prefixed, e.g.
+// "sha512-<hex>".
+func (l Layout) CachedTreePath(digest string) string {
+	if digest == "" {
+		return ""
+	}
+	algorithm, hexDigest := storage.ParseDigest(digest)
+	if _, err := hex.DecodeString(hexDigest); err != nil || hexDigest == "" {
+		return ""
+	}
+	name := hexDigest
+	if algorithm != storage.DefaultHashAlgorithm {
+		name = algorithm + "-" + hexDigest
+	}
+	return filepath.Join(l.ExtractedDir(), TreeCacheDir, name)
+}
@@ -0,0 +1,74 @@
+package fsm
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fly-io/162719/pkg/db"
+	"github.com/fly-io/162719/pkg/storage"
+	"github.com/superfly/fsm"
+)
+
+func TestHandleDownload_UsesScratchDir(t *testing.T) {
+	dbPath := "/tmp/test_images_scratch.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	repo, err := db.NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	sourceDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(sourceDir, "alpine.tar"), []byte("tarball"), 0644); err != nil {
+		t.Fatalf("write source: %v", err)
+	}
+	source, err := storage.NewLocalSource(sourceDir, storage.ClientOptions{})
+	if err != nil {
+		t.Fatalf("NewLocalSource failed: %v", err)
+	}
+
+	img := &db.Image{S3Key: "alpine.tar", Status: db.StatusPending}
+	if err := repo.Create(img); err != nil {
+		t.Fatalf("failed to create image: %v", err)
+	}
+
+	workDir := t.TempDir()
+	scratchDir := t.TempDir()
+	m := NewMachine(repo, source, nil, nil, workDir, 5, WithScratchDir(scratchDir))
+
+	req := fsm.NewRequest(&ImageRequest{S3Key: img.S3Key}, &ImageResponse{ImageID: img.ID})
+	resp, err := m.handleDownload(context.Background(), req)
+	if err != nil {
+		t.Fatalf("handleDownload failed: %v", err)
+	}
+
+	if !strings.HasPrefix(resp.Msg.DownloadPath, scratchDir+string(filepath.Separator)) {
+		t.Errorf("DownloadPath = %q, want it under scratch dir %q", resp.Msg.DownloadPath, scratchDir)
+	}
+	if _, err := os.Stat(resp.Msg.DownloadPath); err != nil {
+		t.Errorf("download missing: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(workDir, "downloads")); !os.IsNotExist(err) {
+		t.Errorf("expected nothing downloaded under work dir, stat err = %v", err)
+	}
+
+	// Mounts stay under the work dir
+	if got := m.layout.MountPath("7"); got != filepath.Join(workDir, "mounts", "7") {
+		t.Errorf("MountPath = %q, want under work dir", got)
+	}
+}
+
+func TestNewLayout_DefaultsScratchToWorkDir(t *testing.T) {
+	l := NewLayout("/work", "")
+	if l.DownloadPath("a.tar") != filepath.Join("/work", "downloads", storage.LocalName("a.tar")) {
+		t.Errorf("DownloadPath = %q, want under work dir", l.DownloadPath("a.tar"))
+	}
+	if l.ExtractPath("a.tar") != filepath.Join("/work", "extracted", storage.LocalName("a.tar")) {
+		t.Errorf("ExtractPath = %q, want under work dir", l.ExtractPath("a.tar"))
+	}
+}
@@ -0,0 +1,43 @@
+package fsm
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/superfly/fsm"
+)
+
+// DefaultRunIDKey is the log attribute carrying a run's ID
+const DefaultRunIDKey = "run_id"
+
+// loggerKey is the context key of a run's logger
+type loggerKey struct{}
+
+// WithRunIDKey names the log attribute that tags every line the machine
+// logs during a run with the run's ID (default DefaultRunIDKey)
+func WithRunIDKey(key string) Option {
+	return func(m *Machine) {
+		if key != "" {
+			m.runIDKey = key
+		}
+	}
+}
+
+// withRunLogger wraps a state handler so everything it logs carries the
+// ID of its run: the version start returned, shared by every state and
+// retry of one image's run
+func (m *Machine) withRunLogger(handler transitionFunc) transitionFunc {
+	return func(ctx context.Context, req *fsm.Request[ImageRequest, ImageResponse]) (*fsm.Response[ImageResponse], error) {
+		logger := slog.Default().With(m.runIDKey, req.Run().StartVersion.String())
+		return handler(context.WithValue(ctx, loggerKey{}, logger), req)
+	}
+}
+
+// loggerFrom returns the run's logger carried by ctx, or the default
+// logger outside a run
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
@@ -0,0 +1,102 @@
+package fsm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/fly-io/162719/pkg/db"
+	"github.com/fly-io/162719/pkg/security"
+	"github.com/fly-io/162719/pkg/storage"
+	"github.com/superfly/fsm"
+)
+
+func TestRunLogger_TagsMachineRecordsWithRunID(t *testing.T) {
+	dbPath := "/tmp/test_images_run_id.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	repo, err := db.NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	sourceDir := t.TempDir()
+	writeTestTar(t, filepath.Join(sourceDir, "alpine.tar"), map[string]string{"etc/hostname": "alpine", "bin/sh": "#!shell"})
+	writeTestTar(t, filepath.Join(sourceDir, "debian.tar"), map[string]string{"etc/hostname": "debian", "bin/sh": "#!shell"})
+	source, err := storage.NewLocalSource(sourceDir, storage.ClientOptions{HashAlgorithm: "sha256"})
+	if err != nil {
+		t.Fatalf("local source: %v", err)
+	}
+
+	var buf bytes.Buffer
+	orig := slog.Default()
+	defer slog.SetDefault(orig)
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{AddSource: true})))
+
+	validator := security.NewValidator(1<<20, 1<<30, 1000)
+	m := NewMachine(repo, source, validator, nil, t.TempDir(), 5, WithRunIDKey("fetch_run"))
+
+	ctx := context.Background()
+	manager, err := fsm.New(fsm.Config{DBPath: filepath.Join(t.TempDir(), "fsm.db")})
+	if err != nil {
+		t.Fatalf("fsm manager: %v", err)
+	}
+	defer manager.Shutdown(time.Second)
+
+	start, _, err := m.Register(ctx, manager)
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	runs := make(map[string]string)
+	for _, key := range []string{"alpine.tar", "debian.tar"} {
+		version, err := start(ctx, key, fsm.NewRequest(&ImageRequest{S3Key: key}, &ImageResponse{}))
+		if err != nil {
+			t.Fatalf("start %s: %v", key, err)
+		}
+		if err := manager.Wait(ctx, version); err != nil {
+			t.Fatalf("run %s failed: %v", key, err)
+		}
+		runs[key] = version.String()
+	}
+	if runs["alpine.tar"] == runs["debian.tar"] {
+		t.Fatalf("both runs got ID %s", runs["alpine.tar"])
+	}
+
+	// Only the machine's own records: the packages it calls log without
+	// a run's context
+	_, thisFile, _, _ := runtime.Caller(0)
+	records := 0
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var record struct {
+			Msg      string `json:"msg"`
+			S3Key    string `json:"s3_key"`
+			FetchRun string `json:"fetch_run"`
+			Source   struct {
+				File string `json:"file"`
+			} `json:"source"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("bad log line %q: %v", scanner.Text(), err)
+		}
+		if filepath.Dir(record.Source.File) != filepath.Dir(thisFile) || record.S3Key == "" {
+			continue
+		}
+		records++
+		if record.FetchRun != runs[record.S3Key] {
+			t.Errorf("%s record %q has fetch_run %q, want %s", record.S3Key, record.Msg, record.FetchRun, runs[record.S3Key])
+		}
+	}
+	if records == 0 {
+		t.Fatal("no records logged during the runs")
+	}
+}
@@ -9,17 +9,19 @@ import (
 
 	"github.com/fly-io/162719/pkg/devicemapper"
 	"github.com/fly-io/162719/pkg/errors"
+	"github.com/fly-io/162719/pkg/events"
 	"github.com/superfly/fsm"
 )
 
 // Register registers the image processing FSM
 func (m *Machine) Register(ctx context.Context, manager *fsm.Manager) (fsm.Start[ImageRequest, ImageResponse], fsm.Resume, error) {
 	start, resume, err := fsm.Register[ImageRequest, ImageResponse](manager, "image-process").
-		Start(StateCheckDB, m.handleCheckDB).
-		To(StateDownload, m.handleDownload).
-		To(StateValidate, m.handleValidate).
-		To(StateCreateDevice, m.handleCreateDevice).
-		To(StateComplete, m.handleComplete).
+		Start(StateCheckDB, m.handler(StateCheckDB, m.handleCheckDB)).
+		To(StateDownload, m.handler(StateDownload, m.handleDownload)).
+		To(StateValidate, m.handler(StateValidate, m.handleValidate)).
+		To(StateCreateDevice, m.handler(StateCreateDevice, m.handleCreateDevice)).
+		To(StateScan, m.handler(StateScan, m.handleScan)).
+		To(StateComplete, m.handler(StateComplete, m.handleComplete)).
 		End(StateFailed).
 		Build(ctx)
 
@@ -30,6 +32,52 @@ func (m *Machine) Register(ctx context.Context, manager *fsm.Manager) (fsm.Start
 	return start, resume, nil
 }
 
+// transitionFunc is the signature of a state handler
+type transitionFunc = func(context.Context, *fsm.Request[ImageRequest, ImageResponse]) (*fsm.Response[ImageResponse], error)
+
+// handler applies the cross-cutting wrappers every state shares: retry
+// policy innermost, then failed-tree quarantine, then the shared tree
+// lock, then terminal-state notification, then instrumentation and
+// tracing, then state hooks, with the run's logger outermost so every
+// wrapper logs through it
+func (m *Machine) handler(state string, h transitionFunc) transitionFunc {
+	return m.withRunLogger(m.withStateHook(state, m.withTrace(state, m.instrument(state, m.withNotify(state, m.withTreeLock(state, m.withQuarantine(state, m.withRetryPolicy(state, h))))))))
+}
+
+// instrument wraps a state handler to emit an event for every attempt
+func (m *Machine) instrument(state string, handler transitionFunc) transitionFunc {
+	return func(ctx context.Context, req *fsm.Request[ImageRequest, ImageResponse]) (*fsm.Response[ImageResponse], error) {
+		start := m.clock.Now()
+		resp, err := handler(ctx, req)
+
+		if m.events == nil {
+			return resp, err
+		}
+
+		event := events.Event{
+			Time:       start.UTC(),
+			State:      state,
+			S3Key:      req.Msg.Key(),
+			DurationMS: m.clock.Now().Sub(start).Milliseconds(),
+			Outcome:    events.OutcomeOK,
+			Retry:      fsm.RetryFromContext(ctx),
+		}
+		if err != nil {
+			event.Outcome = events.OutcomeError
+			var abortErr *fsm.AbortError
+			if errors.As(err, &abortErr) {
+				event.Outcome = events.OutcomeAbort
+			}
+			event.Error = err.Error()
+		}
+		if emitErr := m.events.Emit(event); emitErr != nil {
+			loggerFrom(ctx).Warn("event_emit_failed", "state", state, "s3_key", req.Msg.Key(), "error", emitErr)
+		}
+
+		return resp, err
+	}
+}
+
 // CheckDeviceMapperHealth checks if DeviceMapper is available and functional.
 // Returns "ok" if healthy, "not_available" if not on Linux, or error description otherwise.
 func CheckDeviceMapperHealth(ctx context.Context) string {
@@ -0,0 +1,59 @@
+package fsm
+
+import (
+	"context"
+
+	"github.com/fly-io/162719/pkg/db"
+	"github.com/fly-io/162719/pkg/errors"
+	"github.com/fly-io/162719/pkg/notify"
+	"github.com/superfly/fsm"
+)
+
+// WithNotifier reports every run that ends, in success or failure
+func WithNotifier(notifier notify.Notifier) Option {
+	return func(m *Machine) {
+		m.notifier = notifier
+	}
+}
+
+// withNotify wraps a state handler to send a notification when the run
+// reaches a terminal state: state completes successfully, or any state
+// aborts. Delivery failures are logged and never fail the run.
+func (m *Machine) withNotify(state string, handler transitionFunc) transitionFunc {
+	return func(ctx context.Context, req *fsm.Request[ImageRequest, ImageResponse]) (*fsm.Response[ImageResponse], error) {
+		resp, err := handler(ctx, req)
+
+		if m.notifier == nil {
+			return resp, err
+		}
+
+		var abortErr *fsm.AbortError
+		switch {
+		case err == nil && state == StateComplete:
+			m.notify(ctx, req.Msg.Key(), db.StatusReady, resp.Msg, "")
+		case err != nil && errors.As(err, &abortErr):
+			m.notify(ctx, req.Msg.Key(), db.StatusFailed, req.W.Msg, err.Error())
+		}
+
+		return resp, err
+	}
+}
+
+// notify sends a terminal-state payload built from the accumulated response
+func (m *Machine) notify(ctx context.Context, s3Key, status string, resp *ImageResponse, errMsg string) {
+	payload := notify.Payload{
+		Time:   m.clock.Now().UTC(),
+		S3Key:  s3Key,
+		Status: status,
+		Error:  errMsg,
+	}
+	if resp != nil {
+		payload.SHA256 = resp.SHA256
+		payload.DevicePath = resp.DevicePath
+		payload.SnapshotID = resp.SnapshotID
+	}
+
+	if err := m.notifier.Notify(ctx, payload); err != nil {
+		loggerFrom(ctx).Warn("notify_failed", "s3_key", s3Key, "status", status, "error", err)
+	}
+}
@@ -0,0 +1,65 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fly-io/162719/pkg/clock"
+	"github.com/fly-io/162719/pkg/db"
+	"github.com/fly-io/162719/pkg/notify"
+	"github.com/superfly/fsm"
+)
+
+type recordingNotifier struct {
+	payloads []notify.Payload
+}
+
+func (r *recordingNotifier) Notify(ctx context.Context, payload notify.Payload) error {
+	r.payloads = append(r.payloads, payload)
+	return nil
+}
+
+func TestWithNotify_TerminalStatesOnly(t *testing.T) {
+	ok := func(ctx context.Context, req *fsm.Request[ImageRequest, ImageResponse]) (*fsm.Response[ImageResponse], error) {
+		req.W.Msg.SnapshotID = 8
+		return fsm.NewResponse(req.W.Msg), nil
+	}
+	retryable := func(ctx context.Context, req *fsm.Request[ImageRequest, ImageResponse]) (*fsm.Response[ImageResponse], error) {
+		return nil, errors.New("connection reset")
+	}
+	aborted := func(ctx context.Context, req *fsm.Request[ImageRequest, ImageResponse]) (*fsm.Response[ImageResponse], error) {
+		return nil, fsm.Abort(errors.New("bad tarball"))
+	}
+
+	notifier := &recordingNotifier{}
+	now := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	m := &Machine{notifier: notifier, clock: clock.NewFake(now)}
+	newReq := func() *fsm.Request[ImageRequest, ImageResponse] {
+		return fsm.NewRequest(&ImageRequest{S3Key: "images/alpine.tar"}, &ImageResponse{SHA256: "sha256:abc"})
+	}
+
+	m.withNotify(StateDownload, ok)(context.Background(), newReq())
+	m.withNotify(StateDownload, retryable)(context.Background(), newReq())
+	if len(notifier.payloads) != 0 {
+		t.Fatalf("non-terminal outcomes must not notify, got %+v", notifier.payloads)
+	}
+
+	m.withNotify(StateComplete, ok)(context.Background(), newReq())
+	m.withNotify(StateValidate, aborted)(context.Background(), newReq())
+	if len(notifier.payloads) != 2 {
+		t.Fatalf("expected 2 notifications, got %d", len(notifier.payloads))
+	}
+
+	ready, failed := notifier.payloads[0], notifier.payloads[1]
+	if ready.Status != db.StatusReady || ready.SnapshotID != 8 || ready.SHA256 != "sha256:abc" {
+		t.Errorf("unexpected ready payload: %+v", ready)
+	}
+	if !ready.Time.Equal(now) || !failed.Time.Equal(now) {
+		t.Errorf("payload times = %v, %v, want %v", ready.Time, failed.Time, now)
+	}
+	if failed.Status != db.StatusFailed || failed.Error == "" || failed.S3Key != "images/alpine.tar" {
+		t.Errorf("unexpected failed payload: %+v", failed)
+	}
+}
@@ -0,0 +1,73 @@
+package fsm
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/fly-io/162719/pkg/errors"
+)
+
+// Storage drivers: how an image's tree is turned into a mountable root
+const (
+	// StorageDriverDeviceMapper copies the tree onto a thin device and
+	// snapshots it
+	StorageDriverDeviceMapper = "devicemapper"
+	// StorageDriverOverlay mounts an overlayfs with the extracted tree as
+	// its read-only lower layer, avoiding the copy
+	StorageDriverOverlay = "overlay"
+)
+
+// WithStorageDriver selects the storage driver; the default is
+// StorageDriverDeviceMapper
+func WithStorageDriver(driver string) Option {
+	return func(m *Machine) {
+		m.storageDriver = driver
+	}
+}
+
+// useOverlay reports whether images are mounted as overlays
+func (m *Machine) useOverlay() bool {
+	return m.storageDriver == StorageDriverOverlay
+}
+
+// createOverlay mounts an overlay of the extracted tree for s3Key and
+// records its merged directory as the image's device path. The tree is
+// shared by every image with the same digest and is never written: writes
+// land in the image's own upper directory.
+func (m *Machine) createOverlay(ctx context.Context, s3Key string, resp *ImageResponse) error {
+	dir := m.layout.OverlayDir(s3Key)
+	upper := filepath.Join(dir, "upper")
+	work := filepath.Join(dir, "work")
+	merged := filepath.Join(dir, "merged")
+
+	// A crashed attempt may have left the overlay mounted; UnmountDevice
+	// is a no-op when it didn't
+	if err := m.dmManager.UnmountDevice(ctx, merged); err != nil {
+		return errors.Wrap(err, "failed to unmount stale overlay")
+	}
+
+	loggerFrom(ctx).Info("overlay_mount_started", "s3_key", s3Key, "lower", resp.ExtractedPath, "merged", merged)
+	if err := m.dmManager.MountOverlay(ctx, resp.ExtractedPath, upper, work, merged); err != nil {
+		// Like device creation, an overlay is optional: the extracted
+		// tree remains usable
+		loggerFrom(ctx).Warn("overlay_mount_failed", "s3_key", s3Key, "error", err)
+		resp.ErrorMessage = fmt.Sprintf("overlay warning: %v", err)
+		resp.addDegradation(fmt.Sprintf("overlay mount failed: %v", err))
+		return nil
+	}
+	loggerFrom(ctx).Info("overlay_mounted", "s3_key", s3Key, "merged", merged)
+
+	resp.DevicePath = merged
+	img, err := m.repo.GetByS3KeyContext(ctx, s3Key)
+	if err != nil {
+		return errors.Wrap(err, "failed to look up image")
+	}
+	if img != nil {
+		img.DevicePath = merged
+		if err := m.repo.UpdateContext(ctx, img); err != nil {
+			return errors.Wrap(err, "failed to update image")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package fsm
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/fly-io/162719/pkg/db"
+	"github.com/superfly/fsm"
+)
+
+func TestOverlayDriver_MountsTreeWithoutDevice(t *testing.T) {
+	dbPath := "/tmp/test_images_overlay.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	repo, err := db.NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	img := &db.Image{S3Key: "images/alpine.tar", Status: db.StatusDownloading}
+	if err := repo.Create(img); err != nil {
+		t.Fatalf("failed to create image: %v", err)
+	}
+
+	dm := &fakeManager{}
+	m := NewMachine(repo, nil, nil, dm, t.TempDir(), 5,
+		WithStorageDriver(StorageDriverOverlay), WithWorkFileRetention(false, false))
+
+	digest := "sha256:" + strings.Repeat("ab", 32)
+	lower := m.treePath(&ImageRequest{S3Key: img.S3Key}, digest)
+	if err := os.MkdirAll(lower, 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(lower, "hostname"), []byte("alpine"), 0644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	resp := &ImageResponse{ImageID: img.ID, SHA256: digest, ExtractedPath: lower}
+	req := fsm.NewRequest(&ImageRequest{S3Key: img.S3Key}, resp)
+	if _, err := m.handleCreateDevice(context.Background(), req); err != nil {
+		t.Fatalf("handleCreateDevice failed: %v", err)
+	}
+
+	merged := filepath.Join(m.layout.OverlayDir(img.S3Key), "merged")
+	want := []string{"unmount " + merged, "overlay " + lower + " " + merged}
+	if !reflect.DeepEqual(dm.ops, want) {
+		t.Errorf("ops = %v, want %v", dm.ops, want)
+	}
+	if len(dm.created) != 0 {
+		t.Errorf("created devices %v, want none", dm.created)
+	}
+
+	req = fsm.NewRequest(&ImageRequest{S3Key: img.S3Key}, resp)
+	if _, err := m.handleComplete(context.Background(), req); err != nil {
+		t.Fatalf("handleComplete failed: %v", err)
+	}
+
+	got, _ := repo.GetByS3Key(img.S3Key)
+	if got.Status != db.StatusReady || got.DevicePath != merged || got.SnapshotID != 0 {
+		t.Errorf("image = %s at %q snapshot %d, want ready at %q without snapshot", got.Status, got.DevicePath, got.SnapshotID, merged)
+	}
+	if len(resp.Degradations) != 0 {
+		t.Errorf("degradations = %v, want none", resp.Degradations)
+	}
+	// The overlay reads through to the lower tree, so it must survive
+	if _, err := os.Stat(filepath.Join(lower, "hostname")); err != nil {
+		t.Errorf("lower tree removed: %v", err)
+	}
+}
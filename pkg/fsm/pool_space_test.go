@@ -0,0 +1,62 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/fly-io/162719/pkg/devicemapper"
+)
+
+func TestCheckPoolSpace(t *testing.T) {
+	const (
+		extractedSize = 1024 * 1024
+		blockSize     = 1024 * 1024
+	)
+	tests := []struct {
+		name       string
+		freeBlocks int64
+		poolErr    error
+		wantErr    error
+	}{
+		{name: "enough space", freeBlocks: 1024},
+		{name: "low free space", freeBlocks: 8, wantErr: ErrInsufficientPoolSpace},
+		{name: "unsupported platform", poolErr: fmt.Errorf("devicemapper not supported on darwin")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dm := &fakeManager{poolErr: tt.poolErr}
+			if tt.poolErr == nil {
+				dm.poolStatus = &devicemapper.PoolStatus{
+					DataBlockSize:   blockSize,
+					UsedDataBlocks:  2048 - tt.freeBlocks,
+					TotalDataBlocks: 2048,
+				}
+			}
+			m := &Machine{dmManager: dm}
+
+			err := m.checkPoolSpace(context.Background(), extractedSize)
+			if tt.wantErr == nil && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("expected %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestCheckPoolSpace_ChecksThePoolTheDeviceGoesTo(t *testing.T) {
+	dm := &fakeManager{poolStatus: &devicemapper.PoolStatus{DataBlockSize: 1 << 20, TotalDataBlocks: 1 << 20}}
+	m := &Machine{dmManager: dm, deviceHeadroom: 0.5}
+
+	const extractedSize = 100 * 1024 * 1024
+	if err := m.checkPoolSpace(context.Background(), extractedSize); err != nil {
+		t.Fatalf("checkPoolSpace: %v", err)
+	}
+	if want := m.deviceSize(extractedSize); len(dm.poolStatusSizes) != 1 || dm.poolStatusSizes[0] != want {
+		t.Errorf("pool status read for sizes %v, want [%d]", dm.poolStatusSizes, want)
+	}
+}
@@ -0,0 +1,141 @@
+package fsm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/fly-io/162719/pkg/db"
+	"github.com/fly-io/162719/pkg/devicemapper"
+	"github.com/fly-io/162719/pkg/errors"
+	"github.com/fly-io/162719/pkg/storage"
+	"github.com/superfly/fsm"
+)
+
+// quarantineTimeFormat stamps quarantined trees so repeated failures of
+// one key don't collide
+const quarantineTimeFormat = "20060102T150405Z"
+
+// WithKeepFailed moves the extracted tree of an image that fails
+// validation or device creation into the failed dir instead of deleting
+// it, and appends its new path to the image's error message
+func WithKeepFailed() Option {
+	return func(m *Machine) {
+		m.keepFailed = true
+	}
+}
+
+// quarantineTree moves dir to a fresh path under the failed dir and
+// returns that path. Its completion marker, if any, is dropped so the
+// tree is never mistaken for a reusable extraction.
+func (m *Machine) quarantineTree(ctx context.Context, s3Key, dir string) (string, error) {
+	if err := os.MkdirAll(m.layout.FailedDir(), 0755); err != nil {
+		return "", errors.Wrap(err, "failed to create failed dir")
+	}
+
+	base := filepath.Join(m.layout.FailedDir(), storage.LocalName(s3Key)+"-"+m.clock.Now().UTC().Format(quarantineTimeFormat))
+	target := base
+	for i := 2; ; i++ {
+		if _, err := os.Lstat(target); os.IsNotExist(err) {
+			break
+		}
+		target = fmt.Sprintf("%s-%d", base, i)
+	}
+
+	if err := os.Rename(dir, target); err != nil {
+		return "", errors.Wrap(err, "failed to quarantine extracted tree")
+	}
+	os.Remove(dir + completeSuffix)
+	loggerFrom(ctx).Warn("extracted_tree_quarantined", "s3_key", s3Key, "path", target)
+	return target, nil
+}
+
+// withQuarantine wraps a state handler so that, with WithKeepFailed, an
+// aborted validate or create_device run leaves the tree it extracted in
+// the failed dir. A tree reused from the cache is left in place and only
+// named in the error message. Extraction failures quarantine their
+// partial tree in handleValidate, since it never reaches the tree path.
+func (m *Machine) withQuarantine(state string, handler transitionFunc) transitionFunc {
+	if state != StateValidate && state != StateCreateDevice {
+		return handler
+	}
+	return func(ctx context.Context, req *fsm.Request[ImageRequest, ImageResponse]) (*fsm.Response[ImageResponse], error) {
+		resp, err := handler(ctx, req)
+
+		var abortErr *fsm.AbortError
+		if !m.keepFailed || err == nil || !errors.As(err, &abortErr) {
+			return resp, err
+		}
+		// An overlay's lower layer may be the shared tree of another
+		// ready image, so it stays put
+		if state == StateCreateDevice && m.useOverlay() {
+			return resp, err
+		}
+
+		msg := req.W.Msg
+		if msg == nil {
+			return resp, err
+		}
+		dir := msg.ExtractedPath
+		if dir == "" {
+			dir = m.treePath(req.Msg, msg.SHA256)
+		}
+		if _, statErr := os.Stat(dir); statErr != nil {
+			return resp, err
+		}
+		// A tree reused from the cache may back other images, so it is
+		// only pointed to, never moved
+		if !msg.TreeExtracted {
+			loggerFrom(ctx).Warn("extracted_tree_kept", "s3_key", req.Msg.Key(), "path", dir, "reason", "shared")
+			if msg.ImageID != 0 {
+				m.repo.UpdateStatusContext(ctx, msg.ImageID, db.StatusFailed, sharedTreeMessage(err, dir))
+			}
+			return resp, err
+		}
+
+		path, qErr := m.quarantineTree(ctx, req.Msg.Key(), dir)
+		if qErr != nil {
+			loggerFrom(ctx).Warn("quarantine_failed", "s3_key", req.Msg.Key(), "error", qErr)
+			return resp, err
+		}
+		msg.ExtractedPath = ""
+		if msg.ImageID != 0 {
+			m.repo.UpdateStatusContext(ctx, msg.ImageID, db.StatusFailed, quarantinedMessage(err, path))
+		}
+		return resp, err
+	}
+}
+
+// quarantinedMessage is the error message recorded for a failure whose
+// tree was kept at path
+func quarantinedMessage(err error, path string) string {
+	return fmt.Sprintf("%v (extracted tree kept at %s)", err, path)
+}
+
+// sharedTreeMessage is the error message recorded for a failure whose
+// tree came from the cache and was left at path
+func sharedTreeMessage(err error, path string) string {
+	return fmt.Sprintf("%v (shared extracted tree at %s)", err, path)
+}
+
+// extractTarball extracts tarPath into dir atomically. With WithKeepFailed,
+// a failed extraction's partial tree is quarantined rather than removed,
+// and the returned error names where it went.
+func (m *Machine) extractTarball(ctx context.Context, s3Key, tarPath, dir string, opts devicemapper.ExtractOptions) error {
+	if !m.keepFailed {
+		return devicemapper.ExtractTarballAtomic(tarPath, dir, m.validator, opts)
+	}
+	return devicemapper.BuildDirAtomic(dir, func(tmpDir string) error {
+		err := devicemapper.ExtractTarball(tarPath, tmpDir, m.validator, opts)
+		if err == nil {
+			return nil
+		}
+		path, qErr := m.quarantineTree(ctx, s3Key, tmpDir)
+		if qErr != nil {
+			loggerFrom(ctx).Warn("quarantine_failed", "s3_key", s3Key, "error", qErr)
+			return err
+		}
+		return fmt.Errorf("%w (extracted tree kept at %s)", err, path)
+	})
+}
@@ -0,0 +1,187 @@
+package fsm
+
+import (
+	"archive/tar"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fly-io/162719/pkg/db"
+	"github.com/fly-io/162719/pkg/security"
+	"github.com/superfly/fsm"
+)
+
+func TestKeepFailed_QuarantinesTree(t *testing.T) {
+	dbPath := "/tmp/test_images_quarantine.db"
+
+	tests := []struct {
+		name string
+		// entries are written in order; the last may be the one rejected
+		entries []tar.Header
+		opts    []Option
+	}{
+		{
+			name: "extraction rejected",
+			entries: []tar.Header{
+				{Name: "etc/hostname", Typeflag: tar.TypeReg},
+				{Name: "../escape", Typeflag: tar.TypeReg},
+			},
+		},
+		{
+			name: "not a rootfs",
+			entries: []tar.Header{
+				{Name: "etc/hostname", Typeflag: tar.TypeReg},
+			},
+			opts: []Option{WithRequireRootfs()},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(dbPath)
+			defer os.Remove(dbPath)
+			repo, err := db.NewRepository(dbPath)
+			if err != nil {
+				t.Fatalf("failed to create repository: %v", err)
+			}
+			defer repo.Close()
+
+			ctx := context.Background()
+			img := &db.Image{S3Key: "images/bad.tar", Status: db.StatusDownloading}
+			if err := repo.CreateContext(ctx, img); err != nil {
+				t.Fatal(err)
+			}
+
+			workDir := t.TempDir()
+			tarPath := filepath.Join(workDir, "bad.tar")
+			writeOrderedTar(t, tarPath, tt.entries)
+
+			validator := security.NewValidator(1<<20, 1<<30, 1000)
+			opts := append([]Option{WithKeepFailed()}, tt.opts...)
+			m := NewMachine(repo, nil, validator, nil, workDir, 5, opts...)
+
+			req := fsm.NewRequest(&ImageRequest{S3Key: img.S3Key}, &ImageResponse{ImageID: img.ID, DownloadPath: tarPath, DownloadSize: 1024})
+			if _, err := m.handler(StateValidate, m.handleValidate)(ctx, req); err == nil {
+				t.Fatal("validate accepted a bad image")
+			}
+
+			kept, err := os.ReadDir(m.layout.FailedDir())
+			if err != nil || len(kept) != 1 {
+				t.Fatalf("failed dir holds %v (%v), want one quarantined tree", kept, err)
+			}
+			keptPath := filepath.Join(m.layout.FailedDir(), kept[0].Name())
+			if !strings.Contains(kept[0].Name(), "bad.tar-") {
+				t.Errorf("quarantined tree %s isn't named for its key", kept[0].Name())
+			}
+			if _, err := os.Stat(filepath.Join(keptPath, "etc/hostname")); err != nil {
+				t.Errorf("quarantined tree lacks the extracted file: %v", err)
+			}
+			if _, err := os.Stat(m.extractPath(img.S3Key)); !os.IsNotExist(err) {
+				t.Errorf("tree left at extract path (%v)", err)
+			}
+
+			got, err := repo.GetByS3KeyContext(ctx, img.S3Key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Status != db.StatusFailed || !strings.Contains(got.ErrorMessage, keptPath) {
+				t.Errorf("image is %s with error %q, want failed naming %s", got.Status, got.ErrorMessage, keptPath)
+			}
+		})
+	}
+}
+
+func TestKeepFailed_LeavesCachedTree(t *testing.T) {
+	dbPath := "/tmp/test_images_quarantine_cached.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+	repo, err := db.NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	ctx := context.Background()
+	const digest = "sha256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	img := &db.Image{S3Key: "images/bad.tar", SHA256: digest, Status: db.StatusDownloading}
+	if err := repo.CreateContext(ctx, img); err != nil {
+		t.Fatal(err)
+	}
+
+	validator := security.NewValidator(1<<20, 1<<30, 1000)
+	m := NewMachine(repo, nil, validator, nil, t.TempDir(), 5, WithKeepFailed(), WithRequireRootfs())
+
+	// A complete tree another image extracted, which isn't a rootfs
+	tree := m.layout.CachedTreePath(digest)
+	if err := os.MkdirAll(filepath.Join(tree, "data"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := markTreeComplete(tree); err != nil {
+		t.Fatal(err)
+	}
+
+	req := fsm.NewRequest(&ImageRequest{S3Key: img.S3Key}, &ImageResponse{ImageID: img.ID, SHA256: digest, DownloadSize: 1024})
+	if _, err := m.handler(StateValidate, m.handleValidate)(ctx, req); err == nil {
+		t.Fatal("validate accepted a bad image")
+	}
+
+	if !treeComplete(tree) {
+		t.Error("cached tree was moved out of the cache")
+	}
+	if _, err := os.Stat(m.layout.FailedDir()); !os.IsNotExist(err) {
+		t.Errorf("failed dir created for a cached tree (%v)", err)
+	}
+	got, err := repo.GetByS3KeyContext(ctx, img.S3Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != db.StatusFailed || !strings.Contains(got.ErrorMessage, tree) {
+		t.Errorf("image is %s with error %q, want failed naming %s", got.Status, got.ErrorMessage, tree)
+	}
+}
+
+func TestKeepFailed_OffRemovesTree(t *testing.T) {
+	workDir := t.TempDir()
+	tarPath := filepath.Join(workDir, "bad.tar")
+	writeOrderedTar(t, tarPath, []tar.Header{
+		{Name: "etc/hostname", Typeflag: tar.TypeReg},
+		{Name: "../escape", Typeflag: tar.TypeReg},
+	})
+
+	m := NewMachine(nil, nil, security.NewValidator(1<<20, 1<<30, 1000), nil, workDir, 5)
+	if err := m.extractTarball(context.Background(), "images/bad.tar", tarPath, m.extractPath("images/bad.tar"), m.extractOptionsFor(context.Background(), &ImageRequest{S3Key: "images/bad.tar"})); err == nil {
+		t.Fatal("extraction accepted a bad image")
+	}
+	if _, err := os.Stat(m.layout.FailedDir()); !os.IsNotExist(err) {
+		t.Errorf("failed dir created without WithKeepFailed (%v)", err)
+	}
+}
+
+// writeOrderedTar writes a tarball of entries in order, each regular file
+// holding its own name
+func writeOrderedTar(t *testing.T, path string, entries []tar.Header) {
+	t.Helper()
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("create tar: %v", err)
+	}
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+	for _, hdr := range entries {
+		hdr.Mode = 0644
+		hdr.Size = int64(len(hdr.Name))
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatalf("write header: %v", err)
+		}
+		if _, err := tw.Write([]byte(hdr.Name)); err != nil {
+			t.Fatalf("write body: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close tar: %v", err)
+	}
+}
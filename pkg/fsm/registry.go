@@ -0,0 +1,28 @@
+package fsm
+
+import (
+	"fmt"
+
+	"github.com/fly-io/162719/pkg/errors"
+	"github.com/fly-io/162719/pkg/storage"
+)
+
+// WithRegistrySource sets the source requests carrying an ImageRef are
+// pulled from; without it such requests fail
+func WithRegistrySource(source storage.Source) Option {
+	return func(m *Machine) {
+		m.registry = source
+	}
+}
+
+// sourceFor returns the source an image is fetched from: the registry for
+// image references, the object store otherwise
+func (m *Machine) sourceFor(req *ImageRequest) (storage.Source, error) {
+	if req.ImageRef == "" {
+		return m.source, nil
+	}
+	if m.registry == nil {
+		return nil, errors.Fatal(fmt.Errorf("no registry source configured for image reference %q", req.ImageRef))
+	}
+	return m.registry, nil
+}
@@ -0,0 +1,110 @@
+package fsm
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fly-io/162719/pkg/db"
+	"github.com/fly-io/162719/pkg/security"
+	"github.com/fly-io/162719/pkg/storage"
+	"github.com/superfly/fsm"
+)
+
+func TestRegistryDispatch(t *testing.T) {
+	const ref = "registry.example.com/org/app:1.2"
+
+	// Each source only has the image under its own key, so a request
+	// sent to the wrong one fails with not found
+	s3Dir, registryDir := t.TempDir(), t.TempDir()
+	writeTestTar(t, filepath.Join(s3Dir, "alpine.tar"), map[string]string{"etc/hostname": "s3"})
+	if err := os.MkdirAll(filepath.Join(registryDir, "registry.example.com/org"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestTar(t, filepath.Join(registryDir, ref), map[string]string{"etc/hostname": "registry"})
+
+	s3Source, err := storage.NewLocalSource(s3Dir, storage.ClientOptions{})
+	if err != nil {
+		t.Fatalf("local source: %v", err)
+	}
+	registrySource, err := storage.NewLocalSource(registryDir, storage.ClientOptions{})
+	if err != nil {
+		t.Fatalf("local source: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		req        *ImageRequest
+		registry   storage.Source
+		wantStatus string
+		wantHost   string
+	}{
+		{"s3 key uses object store", &ImageRequest{S3Key: "alpine.tar"}, registrySource, db.StatusReady, "s3"},
+		{"image ref uses registry", &ImageRequest{ImageRef: ref}, registrySource, db.StatusReady, "registry"},
+		{"image ref without registry fails", &ImageRequest{ImageRef: ref}, nil, db.StatusFailed, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dbPath := "/tmp/test_images_registry_dispatch.db"
+			os.Remove(dbPath)
+			defer os.Remove(dbPath)
+
+			repo, err := db.NewRepository(dbPath)
+			if err != nil {
+				t.Fatalf("failed to create repository: %v", err)
+			}
+			defer repo.Close()
+
+			var opts []Option
+			if tt.registry != nil {
+				opts = append(opts, WithRegistrySource(tt.registry))
+			}
+			validator := security.NewValidator(1<<20, 1<<30, 1000)
+			m := NewMachine(repo, s3Source, validator, nil, t.TempDir(), 5, opts...)
+
+			ctx := context.Background()
+			manager, err := fsm.New(fsm.Config{DBPath: filepath.Join(t.TempDir(), "fsm.db")})
+			if err != nil {
+				t.Fatalf("fsm manager: %v", err)
+			}
+			defer manager.Shutdown(time.Second)
+
+			start, _, err := m.Register(ctx, manager)
+			if err != nil {
+				t.Fatalf("register: %v", err)
+			}
+			resp := &ImageResponse{}
+			version, err := start(ctx, tt.req.Key(), fsm.NewRequest(tt.req, resp))
+			if err != nil {
+				t.Fatalf("start: %v", err)
+			}
+			runErr := manager.Wait(ctx, version)
+
+			img, err := repo.GetByS3Key(tt.req.Key())
+			if err != nil || img == nil {
+				t.Fatalf("image %q not recorded: %v", tt.req.Key(), err)
+			}
+			if img.Status != tt.wantStatus {
+				t.Fatalf("status = %q, want %q (run error: %v)", img.Status, tt.wantStatus, runErr)
+			}
+			if tt.wantStatus == db.StatusFailed {
+				if !strings.Contains(img.ErrorMessage, "no registry source") {
+					t.Errorf("error message = %q, want missing registry source", img.ErrorMessage)
+				}
+				return
+			}
+
+			hostname, err := os.ReadFile(filepath.Join(resp.ExtractedPath, "etc/hostname"))
+			if err != nil {
+				t.Fatalf("read extracted tree: %v", err)
+			}
+			if string(hostname) != tt.wantHost {
+				t.Errorf("extracted image from %q, want %q", hostname, tt.wantHost)
+			}
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package fsm
+
+import (
+	"context"
+	"time"
+
+	"github.com/fly-io/162719/pkg/db"
+)
+
+// Repo is the image store the state handlers read and write.
+// *db.Repository implements it; handler tests can use a fake instead.
+type Repo interface {
+	db.DeviceIDAllocator
+
+	CreateContext(ctx context.Context, img *db.Image) error
+	GetByS3KeyContext(ctx context.Context, s3Key string) (*db.Image, error)
+	UpdateContext(ctx context.Context, img *db.Image) error
+	UpdateStatusContext(ctx context.Context, id int64, status, errorMessage string) error
+	IncrementAttemptsContext(ctx context.Context, id int64) (int, error)
+	SetTreeHashContext(ctx context.Context, id int64, hash string) error
+	SetDownloadCompressionContext(ctx context.Context, id int64, compression string) error
+	ReplacePackagesContext(ctx context.Context, imageID int64, pkgs []db.Package) error
+	TotalDownloadedBytesContext(ctx context.Context) (int64, error)
+	CountByTreeContext(ctx context.Context, digest, subpath string, excludeID int64) (int, error)
+}
+
+// treeLocker is implemented by repos that can take advisory locks.
+// *db.Repository does; without it, shared trees are guarded by the
+// reference count alone.
+type treeLocker interface {
+	AcquireLock(ctx context.Context, key string, staleAfter time.Duration) (*db.Lock, error)
+}
+
+var (
+	_ Repo       = (*db.Repository)(nil)
+	_ treeLocker = (*db.Repository)(nil)
+)
@@ -0,0 +1,57 @@
+package fsm
+
+import (
+	"context"
+	"testing"
+
+	"github.com/fly-io/162719/pkg/db"
+	"github.com/superfly/fsm"
+)
+
+func TestHandleCheckDB_FakeRepo(t *testing.T) {
+	repo := newFakeRepo()
+	const key = "images/alpine.tar"
+
+	for want := 1; want <= 2; want++ {
+		m := NewMachine(repo, nil, nil, nil, t.TempDir(), 5)
+		req := fsm.NewRequest(&ImageRequest{S3Key: key}, &ImageResponse{})
+		resp, err := m.handleCheckDB(context.Background(), req)
+		if err != nil {
+			t.Fatalf("run %d: handleCheckDB failed: %v", want, err)
+		}
+		if resp.Msg.ImageID == 0 || resp.Msg.Attempts != want {
+			t.Errorf("run %d: ImageID = %d, Attempts = %d; want an ID and %d", want, resp.Msg.ImageID, resp.Msg.Attempts, want)
+		}
+	}
+
+	img, _ := repo.GetByS3KeyContext(context.Background(), key)
+	if img == nil || img.Status != db.StatusPending || img.Attempts != 2 {
+		t.Errorf("stored image = %+v, want pending after 2 attempts", img)
+	}
+}
+
+func TestHandleComplete_FakeRepo(t *testing.T) {
+	repo := newFakeRepo()
+	ctx := context.Background()
+
+	img := &db.Image{S3Key: "images/alpine.tar", Status: db.StatusDownloading, DevicePath: "/dev/mapper/flyio-1", BaseDeviceID: 1}
+	if err := repo.CreateContext(ctx, img); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewMachine(repo, nil, nil, &fakeManager{}, t.TempDir(), 5)
+	req := fsm.NewRequest(&ImageRequest{S3Key: img.S3Key}, &ImageResponse{ImageID: img.ID})
+	resp, err := m.handleComplete(ctx, req)
+	if err != nil {
+		t.Fatalf("handleComplete failed: %v", err)
+	}
+
+	stored := repo.image(img.ID)
+	if stored.Status != db.StatusReady || resp.Msg.Status != db.StatusReady {
+		t.Errorf("status = %q (response %q), want ready", stored.Status, resp.Msg.Status)
+	}
+	// The snapshot ID comes from the repo's allocator
+	if stored.SnapshotID != 1 || !stored.SnapshotActive || resp.Msg.SnapshotID != 1 {
+		t.Errorf("snapshot = %d active %v (response %d), want 1 active", stored.SnapshotID, stored.SnapshotActive, resp.Msg.SnapshotID)
+	}
+}
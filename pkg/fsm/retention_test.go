@@ -0,0 +1,249 @@
+package fsm
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fly-io/162719/pkg/db"
+	"github.com/fly-io/162719/pkg/storage"
+	"github.com/superfly/fsm"
+)
+
+func TestHandleComplete_WorkFileRetention(t *testing.T) {
+	dbPath := "/tmp/test_images_retention.db"
+
+	tests := []struct {
+		name          string
+		keepDownload  bool
+		keepExtracted bool
+		devicePath    string
+		wantDownload  bool
+		wantExtracted bool
+	}{
+		{name: "keep both", keepDownload: true, keepExtracted: true, devicePath: "/dev/mapper/flyio-1", wantDownload: true, wantExtracted: true},
+		{name: "remove both", devicePath: "/dev/mapper/flyio-1"},
+		{name: "remove download only", keepExtracted: true, devicePath: "/dev/mapper/flyio-1", wantExtracted: true},
+		// Without a device the extracted tree is the only copy of the image
+		{name: "no device keeps extracted", wantExtracted: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(dbPath)
+			defer os.Remove(dbPath)
+
+			repo, err := db.NewRepository(dbPath)
+			if err != nil {
+				t.Fatalf("failed to create repository: %v", err)
+			}
+			defer repo.Close()
+
+			img := &db.Image{S3Key: "images/alpine.tar", Status: db.StatusDownloading, DevicePath: tt.devicePath, BaseDeviceID: 1}
+			if err := repo.Create(img); err != nil {
+				t.Fatalf("failed to create image: %v", err)
+			}
+
+			m := NewMachine(repo, nil, nil, &fakeManager{}, t.TempDir(), 5,
+				WithWorkFileRetention(tt.keepDownload, tt.keepExtracted))
+
+			downloadPath := m.downloadPath(img.S3Key)
+			extractPath := m.extractPath(img.S3Key)
+			if err := os.MkdirAll(filepath.Dir(downloadPath), 0755); err != nil {
+				t.Fatalf("mkdir downloads: %v", err)
+			}
+			if err := os.WriteFile(downloadPath, []byte("tarball"), 0644); err != nil {
+				t.Fatalf("write download: %v", err)
+			}
+			if err := os.MkdirAll(filepath.Join(extractPath, "etc"), 0755); err != nil {
+				t.Fatalf("mkdir extracted: %v", err)
+			}
+
+			req := fsm.NewRequest(&ImageRequest{S3Key: img.S3Key}, &ImageResponse{ImageID: img.ID, DownloadPath: downloadPath})
+			if _, err := m.handleComplete(context.Background(), req); err != nil {
+				t.Fatalf("handleComplete failed: %v", err)
+			}
+
+			if _, err := os.Stat(downloadPath); (err == nil) != tt.wantDownload {
+				t.Errorf("download present = %v, want %v", err == nil, tt.wantDownload)
+			}
+			if _, err := os.Stat(extractPath); (err == nil) != tt.wantExtracted {
+				t.Errorf("extracted tree present = %v, want %v", err == nil, tt.wantExtracted)
+			}
+		})
+	}
+}
+
+func TestHandleComplete_KeepsSharedTree(t *testing.T) {
+	dbPath := "/tmp/test_images_retention_shared.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	repo, err := db.NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	const digest = "sha256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	var images []*db.Image
+	for i, key := range []string{"images/a.tar", "images/b.tar"} {
+		img := &db.Image{S3Key: key, SHA256: digest, Status: db.StatusDownloading, DevicePath: "/dev/mapper/flyio-1", BaseDeviceID: i + 1}
+		if err := repo.Create(img); err != nil {
+			t.Fatalf("failed to create image: %v", err)
+		}
+		images = append(images, img)
+	}
+
+	m := NewMachine(repo, nil, nil, &fakeManager{}, t.TempDir(), 5, WithWorkFileRetention(true, false))
+	tree := m.layout.CachedTreePath(digest)
+	if err := os.MkdirAll(filepath.Join(tree, "etc"), 0755); err != nil {
+		t.Fatalf("mkdir tree: %v", err)
+	}
+	if err := markTreeComplete(tree); err != nil {
+		t.Fatal(err)
+	}
+
+	complete := func(img *db.Image) {
+		t.Helper()
+		req := fsm.NewRequest(&ImageRequest{S3Key: img.S3Key}, &ImageResponse{ImageID: img.ID, SHA256: digest})
+		if _, err := m.handleComplete(context.Background(), req); err != nil {
+			t.Fatalf("handleComplete failed: %v", err)
+		}
+	}
+
+	// b.tar still references the tree
+	complete(images[0])
+	if !treeComplete(tree) {
+		t.Fatal("tree shared with another image was removed")
+	}
+
+	// Once b.tar is gone, a.tar is the last user
+	if err := repo.Delete(images[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.UpdateStatus(images[0].ID, db.StatusDownloading, ""); err != nil {
+		t.Fatal(err)
+	}
+	complete(images[0])
+	if _, err := os.Stat(tree); !os.IsNotExist(err) {
+		t.Errorf("unshared tree still present: %v", err)
+	}
+}
+
+func TestRemoveWorkFiles_NotCalledOnFailure(t *testing.T) {
+	dbPath := "/tmp/test_images_retention2.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	repo, err := db.NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	m := NewMachine(repo, nil, nil, &fakeManager{}, t.TempDir(), 5, WithWorkFileRetention(false, false))
+
+	// No image row: handleComplete aborts before the image is ready
+	key := "images/missing.tar"
+	downloadPath := m.downloadPath(key)
+	if err := os.MkdirAll(filepath.Dir(downloadPath), 0755); err != nil {
+		t.Fatalf("mkdir downloads: %v", err)
+	}
+	if err := os.WriteFile(downloadPath, []byte("tarball"), 0644); err != nil {
+		t.Fatalf("write download: %v", err)
+	}
+
+	req := fsm.NewRequest(&ImageRequest{S3Key: key}, &ImageResponse{})
+	if _, err := m.handleComplete(context.Background(), req); err == nil {
+		t.Fatal("expected handleComplete to fail for a missing image")
+	}
+	if _, err := os.Stat(downloadPath); err != nil {
+		t.Errorf("download must survive a failed build: %v", err)
+	}
+}
+
+func TestCompressDownload_RoundTrip(t *testing.T) {
+	dbPath := "/tmp/test_images_compress.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	repo, err := db.NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	workDir := t.TempDir()
+	m := NewMachine(repo, nil, nil, &fakeManager{}, workDir, 5, WithCompressDownloads())
+
+	const key = "images/alpine.tar"
+	content := bytes.Repeat([]byte("image tarball "), 4096)
+	downloadPath := m.downloadPath(key)
+	if err := os.MkdirAll(filepath.Dir(downloadPath), 0755); err != nil {
+		t.Fatalf("mkdir downloads: %v", err)
+	}
+	if err := os.WriteFile(downloadPath, content, 0644); err != nil {
+		t.Fatalf("write download: %v", err)
+	}
+	digest, err := storage.FileDigest(downloadPath, "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img := &db.Image{S3Key: key, SHA256: digest, Status: db.StatusDownloading, DevicePath: "/dev/mapper/flyio-1", BaseDeviceID: 1}
+	if err := repo.Create(img); err != nil {
+		t.Fatalf("failed to create image: %v", err)
+	}
+
+	// Compress on keep
+	req := fsm.NewRequest(&ImageRequest{S3Key: key}, &ImageResponse{ImageID: img.ID, SHA256: digest, DownloadPath: downloadPath})
+	resp, err := m.handleComplete(context.Background(), req)
+	if err != nil {
+		t.Fatalf("handleComplete failed: %v", err)
+	}
+	compressed := storage.CompressedPath(downloadPath)
+	if _, err := os.Stat(downloadPath); !os.IsNotExist(err) {
+		t.Errorf("uncompressed download still present: %v", err)
+	}
+	fi, err := os.Stat(compressed)
+	if err != nil {
+		t.Fatalf("compressed download missing: %v", err)
+	}
+	if fi.Size() >= int64(len(content)) {
+		t.Errorf("compressed size = %d, want under %d", fi.Size(), len(content))
+	}
+	if resp.Msg.DownloadPath != compressed {
+		t.Errorf("DownloadPath = %q, want %q", resp.Msg.DownloadPath, compressed)
+	}
+	stored, _ := repo.GetByS3Key(key)
+	if stored.DownloadCompression != storage.CompressionZstd {
+		t.Errorf("stored compression = %q, want %q", stored.DownloadCompression, storage.CompressionZstd)
+	}
+
+	// Decompress on reuse: a later run finds the download current again
+	if err := repo.UpdateStatus(img.ID, db.StatusFailed, "device lost"); err != nil {
+		t.Fatal(err)
+	}
+	m = NewMachine(repo, nil, nil, &fakeManager{}, workDir, 5, WithCompressDownloads())
+	req = fsm.NewRequest(&ImageRequest{S3Key: key}, &ImageResponse{})
+	resp, err = m.handleCheckDB(context.Background(), req)
+	if err != nil {
+		t.Fatalf("handleCheckDB failed: %v", err)
+	}
+	if !resp.Msg.DownloadCached {
+		t.Error("restored download not reused")
+	}
+	if got, err := os.ReadFile(downloadPath); err != nil || !bytes.Equal(got, content) {
+		t.Errorf("restored download differs from the original (%v)", err)
+	}
+	if _, err := os.Stat(compressed); !os.IsNotExist(err) {
+		t.Errorf("compressed download still present after restore: %v", err)
+	}
+	stored, _ = repo.GetByS3Key(key)
+	if stored.DownloadCompression != "" {
+		t.Errorf("stored compression = %q after restore, want none", stored.DownloadCompression)
+	}
+}
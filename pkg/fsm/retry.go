@@ -0,0 +1,184 @@
+package fsm
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/fly-io/162719/pkg/db"
+	"github.com/fly-io/162719/pkg/errors"
+	"github.com/superfly/fsm"
+)
+
+// RetryClassifier decides whether a failed state attempt should be retried
+type RetryClassifier func(err error) bool
+
+// WithRetryClassifier overrides the default retry policy
+func WithRetryClassifier(classifier RetryClassifier) Option {
+	return func(m *Machine) {
+		m.retryClassifier = classifier
+	}
+}
+
+// DefaultRetryClassifier retries transient and unclassified errors and
+// gives up on fatal ones, aborts, and cancellation
+func DefaultRetryClassifier(err error) bool {
+	var abortErr *fsm.AbortError
+	switch {
+	case err == nil:
+		return false
+	case errors.As(err, &abortErr):
+		return false
+	case errors.Is(err, context.Canceled):
+		return false
+	case errors.IsFatal(err):
+		return false
+	}
+	return true
+}
+
+// shouldRetry reports whether a failed attempt is worth another try
+func (m *Machine) shouldRetry(err error) bool {
+	if err == nil {
+		return false
+	}
+	if m.retryClassifier != nil {
+		return m.retryClassifier(err)
+	}
+	return DefaultRetryClassifier(err)
+}
+
+// ErrMaxRetriesExceeded is returned when a state has used up its retries
+// within one run
+var ErrMaxRetriesExceeded = errors.New("max retries exceeded")
+
+// checkRetryBudget aborts once state has used up its attempts, marking the
+// image failed with the state that gave up
+func (m *Machine) checkRetryBudget(ctx context.Context, state string, retry uint64, req *fsm.Request[ImageRequest, ImageResponse]) error {
+	if retry < uint64(m.maxRetries) {
+		return nil
+	}
+	err := fmt.Errorf("%w in state %s", ErrMaxRetriesExceeded, state)
+	loggerFrom(ctx).Error("max_retries_exceeded", "s3_key", req.Msg.Key(), "state", state, "max_retries", m.maxRetries)
+	m.markFailed(ctx, req, err)
+	return fsm.Abort(err)
+}
+
+// markFailed records err as the reason the request's image failed. An
+// image check_db hasn't recorded yet has no row to mark.
+func (m *Machine) markFailed(ctx context.Context, req *fsm.Request[ImageRequest, ImageResponse], err error) {
+	msg := req.W.Msg
+	if msg == nil || msg.ImageID == 0 {
+		return
+	}
+	if updateErr := m.repo.UpdateStatusContext(ctx, msg.ImageID, db.StatusFailed, err.Error()); updateErr != nil {
+		loggerFrom(ctx).Warn("status_update_failed", "s3_key", req.Msg.Key(), "error", updateErr)
+	}
+}
+
+// ErrMaxAttemptsExceeded is returned when an image has been processed by
+// more fetch runs than the persisted attempt budget allows
+var ErrMaxAttemptsExceeded = errors.New("max attempts exceeded")
+
+// WithMaxAttempts caps how many fetch runs may process an image, counted
+// in the database so the budget survives process restarts; 0 is unlimited.
+// It complements maxRetries, which only bounds retries within one run.
+func WithMaxAttempts(limit int) Option {
+	return func(m *Machine) {
+		m.maxAttempts = limit
+	}
+}
+
+// recordAttempt counts a new run against an existing image and aborts
+// once the persisted attempt budget is spent
+func (m *Machine) recordAttempt(ctx context.Context, img *db.Image) error {
+	attempts, err := m.repo.IncrementAttemptsContext(ctx, img.ID)
+	if err != nil {
+		return errors.Wrap(err, "failed to record attempt")
+	}
+	img.Attempts = attempts
+
+	if m.maxAttempts > 0 && attempts > m.maxAttempts {
+		err := fmt.Errorf("%w: %d attempts, limit %d", ErrMaxAttemptsExceeded, attempts, m.maxAttempts)
+		loggerFrom(ctx).Error("max_attempts_exceeded", "s3_key", img.S3Key, "attempts", attempts, "max_attempts", m.maxAttempts)
+		m.repo.UpdateStatusContext(ctx, img.ID, db.StatusFailed, err.Error())
+		return fsm.Abort(err)
+	}
+	return nil
+}
+
+// applyRetryPolicy turns errors the policy won't retry into aborts, so
+// they fail the run immediately instead of burning the retry budget
+func (m *Machine) applyRetryPolicy(err error) error {
+	var abortErr *fsm.AbortError
+	if err == nil || errors.As(err, &abortErr) || m.shouldRetry(err) {
+		return err
+	}
+	return fsm.Abort(err)
+}
+
+// retryFromContext reads the FSM's retry count; replaced in tests
+var retryFromContext = fsm.RetryFromContext
+
+// stateRetries measures each state's retries from the FSM retry count it
+// first saw. The FSM seeds a resumed run with the count of its last failed
+// attempt, whichever state that was, so without this a state could start
+// with a budget an earlier state already spent.
+type stateRetries struct {
+	mu    sync.Mutex
+	first map[string]uint64
+}
+
+// since returns how many retries state has had in run, given the FSM's
+// current count
+func (s *stateRetries) since(run, state string, retry uint64) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.first == nil {
+		s.first = make(map[string]uint64)
+	}
+	key := run + "/" + state
+	first, ok := s.first[key]
+	if !ok || retry < first {
+		s.first[key] = retry
+		first = retry
+	}
+	return retry - first
+}
+
+// done forgets state's count once it has succeeded or given up
+func (s *stateRetries) done(run, state string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.first, run+"/"+state)
+}
+
+// withRetryPolicy wraps a state handler with the retry budget check and
+// the retry classifier. Each state gets the full budget, however many
+// retries earlier states used. Errors it converts to aborts mark the
+// image failed.
+func (m *Machine) withRetryPolicy(state string, handler transitionFunc) transitionFunc {
+	return func(ctx context.Context, req *fsm.Request[ImageRequest, ImageResponse]) (*fsm.Response[ImageResponse], error) {
+		run := req.Run().StartVersion.String()
+		retry := m.retries.since(run, state, retryFromContext(ctx))
+		if err := m.checkRetryBudget(ctx, state, retry, req); err != nil {
+			m.retries.done(run, state)
+			return nil, err
+		}
+
+		resp, err := handler(ctx, req)
+		var abortErr *fsm.AbortError
+		if err == nil || errors.As(err, &abortErr) || !m.shouldRetry(err) {
+			m.retries.done(run, state)
+		}
+
+		if policyErr := m.applyRetryPolicy(err); policyErr != err {
+			loggerFrom(ctx).Error("non_retryable_error", "s3_key", req.Msg.Key(), "error", err)
+			m.markFailed(ctx, req, err)
+			return nil, policyErr
+		}
+
+		return resp, err
+	}
+}
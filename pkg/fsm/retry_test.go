@@ -0,0 +1,186 @@
+package fsm
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/fly-io/162719/pkg/db"
+	"github.com/fly-io/162719/pkg/errors"
+	"github.com/fly-io/162719/pkg/security"
+	"github.com/superfly/fsm"
+)
+
+func isAbort(err error) bool {
+	var abortErr *fsm.AbortError
+	return errors.As(err, &abortErr)
+}
+
+func TestShouldRetry_Classification(t *testing.T) {
+	bomb := security.NewValidator(1024, 1024*1024, 10).ValidateCompressionRatio(1, 1000)
+	if bomb == nil {
+		t.Fatal("expected compression ratio validation to fail")
+	}
+
+	m := &Machine{maxRetries: 3}
+	tests := []struct {
+		name  string
+		err   error
+		retry bool
+	}{
+		{"nil", nil, false},
+		{"transient S3 failure", errors.Transient(fmt.Errorf("connection reset")), true},
+		{"wrapped transient", errors.Wrap(errors.Transient(fmt.Errorf("throttled")), "failed to download from S3"), true},
+		{"unclassified", fmt.Errorf("something odd"), true},
+		{"compression bomb", bomb, false},
+		{"wrapped validation failure", errors.Wrap(bomb, "tar extraction failed"), false},
+		{"explicit fatal", errors.Fatal(fmt.Errorf("bad input")), false},
+		{"already aborted", fsm.Abort(fmt.Errorf("done")), false},
+		{"cancelled", errors.Wrap(context.Canceled, "download"), false},
+	}
+
+	for _, tt := range tests {
+		if got := m.shouldRetry(tt.err); got != tt.retry {
+			t.Errorf("%s: shouldRetry = %v, want %v", tt.name, got, tt.retry)
+		}
+	}
+}
+
+func TestApplyRetryPolicy(t *testing.T) {
+	m := &Machine{maxRetries: 3}
+
+	transient := errors.Transient(fmt.Errorf("timeout"))
+	if err := m.applyRetryPolicy(transient); err != transient {
+		t.Errorf("transient errors should pass through for retry, got %v", err)
+	}
+
+	fatal := errors.Fatal(fmt.Errorf("security: path traversal detected: ../x"))
+	err := m.applyRetryPolicy(fatal)
+	if !isAbort(err) {
+		t.Errorf("fatal errors should abort without retrying, got %v", err)
+	}
+	if !errors.Is(err, fatal) {
+		t.Errorf("abort should wrap the original error, got %v", err)
+	}
+
+	if err := m.applyRetryPolicy(nil); err != nil {
+		t.Errorf("nil should stay nil, got %v", err)
+	}
+}
+
+func TestWithRetryClassifier_Overrides(t *testing.T) {
+	m := &Machine{maxRetries: 3}
+	WithRetryClassifier(func(error) bool { return false })(m)
+
+	if err := m.applyRetryPolicy(errors.Transient(fmt.Errorf("timeout"))); !isAbort(err) {
+		t.Errorf("custom classifier refusing retries should abort, got %v", err)
+	}
+}
+
+func TestCheckRetryBudget(t *testing.T) {
+	m := &Machine{maxRetries: 3}
+	req := fsm.NewRequest(&ImageRequest{S3Key: "image.tar"}, &ImageResponse{})
+
+	for retry := uint64(0); retry < 3; retry++ {
+		if err := m.checkRetryBudget(context.Background(), StateDownload, retry, req); err != nil {
+			t.Errorf("retry %d: expected budget remaining, got %v", retry, err)
+		}
+	}
+	err := m.checkRetryBudget(context.Background(), StateDownload, 3, req)
+	if !isAbort(err) || !errors.Is(err, ErrMaxRetriesExceeded) {
+		t.Errorf("expected abort with ErrMaxRetriesExceeded once budget is spent, got %v", err)
+	}
+}
+
+func TestWithRetryPolicy_ExhaustionMarksImageFailed(t *testing.T) {
+	saved := retryFromContext
+	retryFromContext = func(ctx context.Context) uint64 {
+		n, _ := ctx.Value(retryCountKey{}).(uint64)
+		return n
+	}
+	defer func() { retryFromContext = saved }()
+
+	flaky := func(ctx context.Context, req *fsm.Request[ImageRequest, ImageResponse]) (*fsm.Response[ImageResponse], error) {
+		return nil, errors.Transient(fmt.Errorf("flake"))
+	}
+
+	states := []string{StateCheckDB, StateDownload, StateValidate, StateCreateDevice, StateScan, StateComplete}
+	for _, state := range states {
+		t.Run(state, func(t *testing.T) {
+			repo := newFakeRepo()
+			img := &db.Image{S3Key: "image.tar", Status: db.StatusDownloading}
+			if err := repo.CreateContext(context.Background(), img); err != nil {
+				t.Fatal(err)
+			}
+			m := NewMachine(repo, nil, nil, nil, t.TempDir(), 3)
+			req := fsm.NewRequest(&ImageRequest{S3Key: "image.tar"}, &ImageResponse{ImageID: img.ID})
+
+			var err error
+			for retry := uint64(0); retry <= 3; retry++ {
+				ctx := context.WithValue(context.Background(), retryCountKey{}, retry)
+				_, err = m.withRetryPolicy(state, flaky)(ctx, req)
+				if retry < 3 && (err == nil || isAbort(err)) {
+					t.Fatalf("retry %d: err = %v, want a retryable error", retry, err)
+				}
+			}
+			if !isAbort(err) || !errors.Is(err, ErrMaxRetriesExceeded) {
+				t.Fatalf("err = %v, want abort with ErrMaxRetriesExceeded", err)
+			}
+
+			stored := repo.image(img.ID)
+			if stored.Status != db.StatusFailed {
+				t.Errorf("status = %q, want failed", stored.Status)
+			}
+			if want := "max retries exceeded in state " + state; stored.ErrorMessage != want {
+				t.Errorf("error message = %q, want %q", stored.ErrorMessage, want)
+			}
+		})
+	}
+}
+
+// retryCountKey carries a fake FSM retry count in tests
+type retryCountKey struct{}
+
+func TestWithRetryPolicy_EachStateGetsFullBudget(t *testing.T) {
+	saved := retryFromContext
+	retryFromContext = func(ctx context.Context) uint64 {
+		n, _ := ctx.Value(retryCountKey{}).(uint64)
+		return n
+	}
+	defer func() { retryFromContext = saved }()
+
+	m := NewMachine(newFakeRepo(), nil, nil, nil, t.TempDir(), 3)
+	flaky := func(ctx context.Context, req *fsm.Request[ImageRequest, ImageResponse]) (*fsm.Response[ImageResponse], error) {
+		return nil, errors.Transient(fmt.Errorf("flake"))
+	}
+	ok := func(ctx context.Context, req *fsm.Request[ImageRequest, ImageResponse]) (*fsm.Response[ImageResponse], error) {
+		return fsm.NewResponse(req.W.Msg), nil
+	}
+	req := fsm.NewRequest(&ImageRequest{S3Key: "image.tar"}, &ImageResponse{})
+	attempt := func(state string, h transitionFunc, retry uint64) error {
+		ctx := context.WithValue(context.Background(), retryCountKey{}, retry)
+		_, err := m.withRetryPolicy(state, h)(ctx, req)
+		return err
+	}
+
+	// Download burns two of its three attempts, then succeeds
+	for retry := uint64(0); retry < 2; retry++ {
+		if err := attempt(StateDownload, flaky, retry); err == nil || isAbort(err) {
+			t.Fatalf("download retry %d: err = %v, want a retryable error", retry, err)
+		}
+	}
+	if err := attempt(StateDownload, ok, 2); err != nil {
+		t.Fatalf("download retry 2: %v", err)
+	}
+
+	// A resumed run hands create_device download's count of 2, yet it
+	// still gets three attempts of its own
+	for retry := uint64(2); retry < 5; retry++ {
+		if err := attempt(StateCreateDevice, flaky, retry); err == nil || isAbort(err) {
+			t.Fatalf("create_device retry %d: err = %v, want a retryable error", retry, err)
+		}
+	}
+	if err := attempt(StateCreateDevice, flaky, 5); !isAbort(err) {
+		t.Errorf("create_device past its budget: err = %v, want abort", err)
+	}
+}
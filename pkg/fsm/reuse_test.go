@@ -0,0 +1,91 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fly-io/162719/pkg/db"
+	"github.com/fly-io/162719/pkg/devicemapper"
+)
+
+func TestReuseDevice(t *testing.T) {
+	dbPath := "/tmp/test_images_reuse.db"
+
+	tests := []struct {
+		name         string
+		recorded     bool
+		deviceExists bool
+		fsckErr      error
+		wantErr      bool
+		wantReuse    bool
+		wantChecked  bool
+		wantReformat bool
+	}{
+		{name: "no recorded device"},
+		{name: "clean filesystem", recorded: true, deviceExists: true, wantReuse: true, wantChecked: true},
+		{
+			name: "uncorrectable errors reformat", recorded: true, deviceExists: true,
+			fsckErr: devicemapper.ErrFilesystemUncorrectable, wantReuse: true, wantChecked: true, wantReformat: true,
+		},
+		{
+			name: "fsck operational error", recorded: true, deviceExists: true,
+			fsckErr: errors.New("e2fsck failed with exit status 8"), wantErr: true, wantChecked: true,
+		},
+		{name: "missing mapping reformats", recorded: true, wantReuse: true, wantReformat: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(dbPath)
+			defer os.Remove(dbPath)
+
+			repo, err := db.NewRepository(dbPath)
+			if err != nil {
+				t.Fatalf("failed to create repository: %v", err)
+			}
+			defer repo.Close()
+
+			devicePath := filepath.Join(t.TempDir(), "flyio-3")
+			if tt.deviceExists {
+				if err := os.WriteFile(devicePath, nil, 0644); err != nil {
+					t.Fatalf("create device node: %v", err)
+				}
+			}
+
+			img := &db.Image{S3Key: "images/alpine.tar", Status: db.StatusDownloading}
+			if tt.recorded {
+				img.BaseDeviceID = 3
+				img.DevicePath = devicePath
+			}
+			if err := repo.Create(img); err != nil {
+				t.Fatalf("failed to create image: %v", err)
+			}
+
+			dm := &fakeManager{fsckErr: tt.fsckErr}
+			m := NewMachine(repo, nil, nil, dm, t.TempDir(), 5)
+
+			id, info, err := m.reuseDevice(context.Background(), img.S3Key, 0)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("reuseDevice error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if (info != nil) != tt.wantReuse {
+				t.Fatalf("reuseDevice info = %v, want reuse %v", info, tt.wantReuse)
+			}
+			if tt.wantReuse && id != 3 {
+				t.Errorf("device ID = %d, want 3", id)
+			}
+			if got := len(dm.checked) > 0; got != tt.wantChecked {
+				t.Errorf("fsck ran = %v, want %v", got, tt.wantChecked)
+			}
+			if got := len(dm.created) > 0; got != tt.wantReformat {
+				t.Errorf("device recreated = %v, want %v", got, tt.wantReformat)
+			}
+			if tt.wantReformat && (dm.created[0] != "3" || len(dm.deleted) != 1 || dm.deleted[0] != "3") {
+				t.Errorf("reformat deleted %v and created %v, want device 3", dm.deleted, dm.created)
+			}
+		})
+	}
+}
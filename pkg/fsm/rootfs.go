@@ -0,0 +1,44 @@
+package fsm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fly-io/162719/pkg/errors"
+)
+
+// ErrNotRootfs is returned when an extracted tree lacks the top-level
+// directories every root filesystem has
+var ErrNotRootfs = errors.New("image does not look like a root filesystem")
+
+// rootfsMarkers lists the top-level entries a rootfs must have; each inner
+// slice is satisfied by any one of its names. Merged-/usr layouts link
+// /bin to usr/bin, so either one counts.
+var rootfsMarkers = [][]string{
+	{"etc"},
+	{"bin", "usr"},
+}
+
+// checkRootfsLayout reports which rootfs markers are missing from root.
+// Symlinks count as present, since /bin is often one.
+func checkRootfsLayout(root string) error {
+	var missing []string
+	for _, alternatives := range rootfsMarkers {
+		found := false
+		for _, name := range alternatives {
+			if _, err := os.Lstat(filepath.Join(root, name)); err == nil {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, "/"+strings.Join(alternatives, " or /"))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: missing %s", ErrNotRootfs, strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fly-io/162719/pkg/db"
+	"github.com/fly-io/162719/pkg/security"
+	"github.com/superfly/fsm"
+)
+
+func TestCheckRootfsLayout(t *testing.T) {
+	tests := []struct {
+		name    string
+		dirs    []string
+		links   map[string]string
+		wantErr bool
+	}{
+		{name: "classic rootfs", dirs: []string{"bin", "etc", "usr"}},
+		{name: "merged usr", dirs: []string{"etc", "usr/bin"}, links: map[string]string{"bin": "usr/bin"}},
+		{name: "usr without bin", dirs: []string{"etc", "usr"}},
+		{name: "single directory", dirs: []string{"myapp/src"}, wantErr: true},
+		{name: "missing etc", dirs: []string{"bin", "usr"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			for _, dir := range tt.dirs {
+				if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+					t.Fatalf("mkdir: %v", err)
+				}
+			}
+			for name, target := range tt.links {
+				if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+					t.Fatalf("symlink: %v", err)
+				}
+			}
+
+			err := checkRootfsLayout(root)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkRootfsLayout() = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrNotRootfs) {
+				t.Errorf("error %v is not ErrNotRootfs", err)
+			}
+		})
+	}
+}
+
+func TestHandleValidate_RequireRootfs(t *testing.T) {
+	dbPath := "/tmp/test_images_rootfs.db"
+
+	tests := []struct {
+		name       string
+		files      map[string]string
+		require    bool
+		wantErr    bool
+		wantStatus string
+	}{
+		{name: "rootfs", files: map[string]string{"etc/hostname": "box", "bin/sh": "sh"}, require: true, wantStatus: db.StatusDownloading},
+		{name: "bogus single dir fails", files: map[string]string{"myapp/main.go": "package main"}, require: true, wantErr: true, wantStatus: db.StatusFailed},
+		{name: "bogus single dir warns", files: map[string]string{"myapp/main.go": "package main"}, wantStatus: db.StatusDownloading},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(dbPath)
+			defer os.Remove(dbPath)
+
+			repo, err := db.NewRepository(dbPath)
+			if err != nil {
+				t.Fatalf("failed to create repository: %v", err)
+			}
+			defer repo.Close()
+
+			img := &db.Image{S3Key: "images/a.tar", Status: db.StatusDownloading}
+			if err := repo.Create(img); err != nil {
+				t.Fatalf("failed to create image: %v", err)
+			}
+
+			workDir := t.TempDir()
+			var opts []Option
+			if tt.require {
+				opts = append(opts, WithRequireRootfs())
+			}
+			validator := security.NewValidator(1024*1024, 10*1024*1024, 1000.0)
+			m := NewMachine(repo, nil, validator, nil, workDir, 5, opts...)
+
+			tarPath := filepath.Join(workDir, "image.tar")
+			writeTestTar(t, tarPath, tt.files)
+
+			req := fsm.NewRequest(&ImageRequest{S3Key: img.S3Key}, &ImageResponse{ImageID: img.ID, DownloadPath: tarPath, DownloadSize: 1024})
+			_, err = m.handleValidate(context.Background(), req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("handleValidate error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			got, _ := repo.GetByS3Key(img.S3Key)
+			if got.Status != tt.wantStatus {
+				t.Errorf("status = %q, want %q", got.Status, tt.wantStatus)
+			}
+		})
+	}
+}
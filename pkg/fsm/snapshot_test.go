@@ -1,8 +1,12 @@
 package fsm
 
 import (
+	"context"
 	"strings"
 	"testing"
+
+	"github.com/fly-io/162719/pkg/db"
+	"github.com/superfly/fsm"
 )
 
 // TestSnapshotMandatoryLogic tests the logic for mandatory snapshot creation
@@ -142,3 +146,30 @@ func TestCleanupLogic(t *testing.T) {
 		t.Error("Cleanup should be triggered on failure")
 	}
 }
+
+func TestHandleComplete_RecordsSnapshotIDBeforeCreating(t *testing.T) {
+	ctx := context.Background()
+	repo := newFakeRepo()
+	img := &db.Image{S3Key: "images/app.tar", Status: db.StatusDownloading, DevicePath: "/dev/mapper/flyio-1", BaseDeviceID: 1}
+	if err := repo.CreateContext(ctx, img); err != nil {
+		t.Fatal(err)
+	}
+
+	// cleanup --orphaned must see the ID as soon as the pool may hold it
+	recorded := -1
+	dm := &fakeManager{onCreateSnapshot: func(snapshotID int) {
+		recorded = repo.image(img.ID).SnapshotID
+		if recorded != snapshotID {
+			t.Errorf("snapshot %d created while the image records %d", snapshotID, recorded)
+		}
+	}}
+	m := NewMachine(repo, nil, nil, dm, t.TempDir(), 5, WithWorkFileRetention(true, true))
+
+	req := fsm.NewRequest(&ImageRequest{S3Key: img.S3Key}, &ImageResponse{ImageID: img.ID})
+	if _, err := m.handleComplete(ctx, req); err != nil {
+		t.Fatalf("handleComplete failed: %v", err)
+	}
+	if recorded <= 0 {
+		t.Errorf("snapshot ID recorded = %d, want one before CreateSnapshot", recorded)
+	}
+}
@@ -0,0 +1,52 @@
+//go:build linux
+
+package fsm
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+// lseek whence values for walking a file's data regions
+const (
+	seekData = 3 // SEEK_DATA
+	seekHole = 4 // SEEK_HOLE
+)
+
+// copyFileData copies the size bytes of src into dst, skipping holes so
+// sparse files stay sparse: only data regions are written and the tail is
+// extended with Truncate. Filesystems without SEEK_DATA get a plain copy.
+func copyFileData(dst, src *os.File, size int64) error {
+	var off int64
+	for off < size {
+		data, err := src.Seek(off, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			break // only a hole remains
+		}
+		if errors.Is(err, syscall.EINVAL) {
+			return copyAll(dst, src)
+		}
+		if err != nil {
+			return err
+		}
+		hole, err := src.Seek(data, seekHole)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(io.NewOffsetWriter(dst, data), io.NewSectionReader(src, data, hole-data)); err != nil {
+			return err
+		}
+		off = hole
+	}
+	return dst.Truncate(size)
+}
+
+func copyAll(dst, src *os.File) error {
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.Copy(dst, src)
+	return err
+}
@@ -0,0 +1,69 @@
+//go:build linux
+
+package fsm
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// allocatedBytes returns the disk space allocated to path
+func allocatedBytes(t *testing.T, path string) int64 {
+	t.Helper()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat %s: %v", path, err)
+	}
+	return fi.Sys().(*syscall.Stat_t).Blocks * 512
+}
+
+func TestCopyDir_KeepsSparseFilesSparse(t *testing.T) {
+	const size = 64 << 20
+	src, dst := t.TempDir(), t.TempDir()
+
+	// A preallocated log: mostly hole, with data at the start and middle
+	path := filepath.Join(src, "var", "log", "wtmp")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	head, middle := []byte("head"), []byte("middle")
+	if _, err := f.WriteAt(head, 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := f.WriteAt(middle, size/2); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := f.Truncate(size); err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+	f.Close()
+	if allocatedBytes(t, path) >= size/2 {
+		t.Skip("temp filesystem does not support sparse files")
+	}
+
+	if err := copyDir(src, dst); err != nil {
+		t.Fatalf("copyDir failed: %v", err)
+	}
+
+	copied := filepath.Join(dst, "var", "log", "wtmp")
+	data, err := os.ReadFile(copied)
+	if err != nil {
+		t.Fatalf("read copy: %v", err)
+	}
+	if len(data) != size {
+		t.Fatalf("copy is %d bytes, want %d", len(data), size)
+	}
+	if !bytes.Equal(data[:len(head)], head) || !bytes.Equal(data[size/2:size/2+len(middle)], middle) {
+		t.Errorf("copy lost the file's data regions")
+	}
+	if got := allocatedBytes(t, copied); got >= size/2 {
+		t.Errorf("copy allocates %d bytes of a %d byte sparse file; want it to stay sparse", got, size)
+	}
+}
@@ -0,0 +1,101 @@
+package fsm
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/fly-io/162719/pkg/db"
+	"github.com/fly-io/162719/pkg/devicemapper"
+	"github.com/superfly/fsm"
+)
+
+func TestHandleCreateDevice_CleansStaleDeviceBeforeRetry(t *testing.T) {
+	dbPath := "/tmp/test_images_stale_device.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	repo, err := db.NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	// The previous attempt allocated device 7 and died before finishing it
+	img := &db.Image{S3Key: "images/alpine.tar", Status: db.StatusDownloading, BaseDeviceID: 7}
+	if err := repo.Create(img); err != nil {
+		t.Fatalf("failed to create image: %v", err)
+	}
+
+	extracted := t.TempDir()
+	if err := os.WriteFile(filepath.Join(extracted, "hostname"), []byte("alpine"), 0644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	dm := &fakeManager{poolStatus: &devicemapper.PoolStatus{DataBlockSize: 1 << 20, TotalDataBlocks: 1 << 20}}
+	m := NewMachine(repo, nil, nil, dm, t.TempDir(), 5)
+	mountPath := m.layout.MountPath("7")
+
+	req := fsm.NewRequest(&ImageRequest{S3Key: img.S3Key}, &ImageResponse{ImageID: img.ID, ExtractedPath: extracted})
+	if _, err := m.handleCreateDevice(context.Background(), req); err != nil {
+		t.Fatalf("handleCreateDevice failed: %v", err)
+	}
+
+	want := []string{
+		"unmount " + mountPath, "delete 7", // stale attempt cleaned first
+		"create 7", "mount " + mountPath, "unmount " + mountPath,
+	}
+	if !reflect.DeepEqual(dm.ops, want) {
+		t.Errorf("device ops = %v, want %v", dm.ops, want)
+	}
+
+	got, _ := repo.GetByS3Key(img.S3Key)
+	if got.BaseDeviceID != 7 || got.DevicePath != "/dev/mapper/flyio-7" {
+		t.Errorf("recorded device %d at %q, want 7 at /dev/mapper/flyio-7", got.BaseDeviceID, got.DevicePath)
+	}
+	if seq, err := repo.AllocateNextDeviceID(context.Background()); err != nil || seq != 1 {
+		t.Errorf("next device ID = %d, %v; want 1 (no ID allocated for the retry)", seq, err)
+	}
+}
+
+func TestHandleCreateDevice_RecordsAllocatedID(t *testing.T) {
+	dbPath := "/tmp/test_images_stale_device2.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	repo, err := db.NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	img := &db.Image{S3Key: "images/alpine.tar", Status: db.StatusDownloading}
+	if err := repo.Create(img); err != nil {
+		t.Fatalf("failed to create image: %v", err)
+	}
+
+	// A mount that fails leaves the device behind for the retry to clean
+	dm := &failingMountManager{fakeManager: fakeManager{poolStatus: &devicemapper.PoolStatus{DataBlockSize: 1 << 20, TotalDataBlocks: 1 << 20}}}
+	m := NewMachine(repo, nil, nil, dm, t.TempDir(), 5)
+
+	req := fsm.NewRequest(&ImageRequest{S3Key: img.S3Key}, &ImageResponse{ImageID: img.ID, ExtractedPath: t.TempDir()})
+	if _, err := m.handleCreateDevice(context.Background(), req); err == nil {
+		t.Fatal("expected mount failure")
+	}
+
+	got, _ := repo.GetByS3Key(img.S3Key)
+	if got.BaseDeviceID == 0 || got.DevicePath != "" {
+		t.Errorf("recorded device %d at %q, want allocated ID without a path", got.BaseDeviceID, got.DevicePath)
+	}
+}
+
+// failingMountManager fails every mount
+type failingMountManager struct {
+	fakeManager
+}
+
+func (f *failingMountManager) MountDevice(ctx context.Context, devicePath, mountPath string) error {
+	return os.ErrPermission
+}
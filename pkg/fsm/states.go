@@ -3,15 +3,18 @@ package fsm
 import (
 	"context"
 	"fmt"
-	"io"
-	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/fly-io/162719/pkg/clock"
 	"github.com/fly-io/162719/pkg/db"
 	"github.com/fly-io/162719/pkg/devicemapper"
 	"github.com/fly-io/162719/pkg/errors"
+	"github.com/fly-io/162719/pkg/events"
+	"github.com/fly-io/162719/pkg/notify"
+	"github.com/fly-io/162719/pkg/scan"
 	"github.com/fly-io/162719/pkg/security"
 	"github.com/fly-io/162719/pkg/storage"
 	"github.com/superfly/fsm"
@@ -19,47 +22,271 @@ import (
 
 // Machine holds dependencies for FSM transitions
 type Machine struct {
-	repo       *db.Repository
-	s3Client   *storage.Client
+	repo       Repo
+	source     storage.Source
 	validator  *security.Validator
 	dmManager  devicemapper.Manager
-	workDir    string
+	layout     Layout
 	maxRetries int
+	events     events.Emitter
+	deviceIDs  db.DeviceIDAllocator
+
+	retryClassifier RetryClassifier
+
+	extractOptions devicemapper.ExtractOptions
+
+	// maxHostExtractedSize caps the combined size of all images on the
+	// host; 0 means unlimited
+	maxHostExtractedSize int64
+
+	vulnChecker scan.Checker
+
+	// keepDownload and keepExtracted retain work files after a successful
+	// build; both default to true
+	keepDownload  bool
+	keepExtracted bool
+
+	// maxAttempts bounds fetch runs per image across restarts; 0 is unlimited
+	maxAttempts int
+
+	notifier notify.Notifier
+
+	clock clock.Clock
+
+	// streamExtract extracts straight from the source stream when the
+	// source supports it, skipping the tarball on disk
+	streamExtract bool
+
+	// requireRootfs fails images whose tree doesn't look like a rootfs
+	// instead of only warning
+	requireRootfs bool
+
+	// trustedPrefixes lists key prefixes whose archives skip the
+	// compression-ratio check
+	trustedPrefixes []string
+
+	// treeHash records a digest of each extracted tree for later
+	// tamper checks
+	treeHash bool
+
+	// breaker is shared with every machine downloading from the same
+	// source; nil downloads unguarded
+	breaker *storage.Breaker
+
+	// storageDriver is StorageDriverDeviceMapper (the default when empty)
+	// or StorageDriverOverlay
+	storageDriver string
+
+	// stateHooks are called on entry to each state, keyed by state name
+	stateHooks map[string]StateHook
+
+	// deviceHeadroom sizes base devices to the extracted size plus this
+	// fraction of it; 0 keeps the fixed default device size
+	deviceHeadroom float64
+
+	// registry serves requests carrying an ImageRef; nil rejects them
+	registry storage.Source
+
+	// trustMultipartETags skips the digest check behind a matching
+	// multipart ETag
+	trustMultipartETags bool
+
+	// trace records per-state durations; nil disables tracing
+	trace *Trace
+
+	// keepFailed quarantines the extracted trees of failed images
+	keepFailed bool
+
+	// compressDownloads stores kept downloads zstd-compressed
+	compressDownloads bool
+
+	// contentTypes lists the Content-Types an object may have; empty
+	// allows any
+	contentTypes []string
+
+	// runIDKey is the log attribute carrying each run's ID
+	runIDKey string
+
+	// retries gives each state its own retry budget
+	retries stateRetries
+}
+
+// Option configures optional Machine behavior
+type Option func(*Machine)
+
+// WithEventEmitter records a structured event for every state transition
+func WithEventEmitter(emitter events.Emitter) Option {
+	return func(m *Machine) {
+		m.events = emitter
+	}
+}
+
+// WithDeviceIDAllocator overrides how device IDs are allocated
+// (default: one repository write per ID)
+func WithDeviceIDAllocator(allocator db.DeviceIDAllocator) Option {
+	return func(m *Machine) {
+		m.deviceIDs = allocator
+	}
+}
+
+// WithDeviceHeadroom sizes each base device to its image's extracted size
+// plus headroom (a fraction, e.g. 0.25 for 25%) and room for ext4
+// metadata, instead of the fixed default size
+func WithDeviceHeadroom(headroom float64) Option {
+	return func(m *Machine) {
+		m.deviceHeadroom = headroom
+	}
+}
+
+// WithMaxHostExtractedSize refuses images that would push the combined
+// size of all ready images on the host past limit bytes
+func WithMaxHostExtractedSize(limit int64) Option {
+	return func(m *Machine) {
+		m.maxHostExtractedSize = limit
+	}
+}
+
+// WithExtractOptions tunes tarball extraction (e.g. parallel writes)
+func WithExtractOptions(opts devicemapper.ExtractOptions) Option {
+	return func(m *Machine) {
+		m.extractOptions = opts
+	}
+}
+
+// WithVulnerabilityChecker sets the source of known vulnerabilities
+// consulted by the scan state (default: scan.NoopChecker)
+func WithVulnerabilityChecker(checker scan.Checker) Option {
+	return func(m *Machine) {
+		m.vulnChecker = checker
+	}
+}
+
+// WithScratchDir keeps downloads and extracted trees under dir instead of
+// the work dir, e.g. on a larger volume
+func WithScratchDir(dir string) Option {
+	return func(m *Machine) {
+		m.layout = NewLayout(m.layout.WorkDir, dir)
+	}
+}
+
+// WithWorkFileRetention controls whether the downloaded tarball and the
+// extracted tree are kept once an image is ready. Removal only happens
+// after handleComplete succeeds.
+func WithWorkFileRetention(keepDownload, keepExtracted bool) Option {
+	return func(m *Machine) {
+		m.keepDownload = keepDownload
+		m.keepExtracted = keepExtracted
+	}
+}
+
+// WithCompressDownloads re-compresses a kept download with zstd once its
+// image is ready, replacing it with "<download>.zst". A later fetch of the
+// image decompresses it again before checking whether it is current. It
+// has no effect unless downloads are kept.
+func WithCompressDownloads() Option {
+	return func(m *Machine) {
+		m.compressDownloads = true
+	}
+}
+
+// WithClock sets the clock used for event and notification timestamps
+// (default: the system clock)
+func WithClock(c clock.Clock) Option {
+	return func(m *Machine) {
+		m.clock = c
+	}
+}
+
+// WithStreamingExtract extracts images while they download instead of
+// writing the tarball to disk first. Sources that can't stream fall back
+// to download-then-extract.
+func WithStreamingExtract() Option {
+	return func(m *Machine) {
+		m.streamExtract = true
+	}
+}
+
+// WithRequireRootfs fails images whose extracted tree lacks /etc and /bin
+// or /usr. Without it such images only log a warning.
+func WithRequireRootfs() Option {
+	return func(m *Machine) {
+		m.requireRootfs = true
+	}
+}
+
+// WithTrustedPrefixes skips the compression-ratio check for keys under any
+// of prefixes, e.g. internal base images that are mostly zero-filled. Size
+// limits still apply.
+func WithTrustedPrefixes(prefixes ...string) Option {
+	return func(m *Machine) {
+		m.trustedPrefixes = prefixes
+	}
+}
+
+// WithTreeHash hashes every extracted tree at the end of validation and
+// records the digest on the image, so the tree can be verified later
+func WithTreeHash() Option {
+	return func(m *Machine) {
+		m.treeHash = true
+	}
+}
+
+// WithTrustMultipartETags treats a matching multipart ETag as proof the
+// local download is current, skipping the digest check it otherwise gets
+func WithTrustMultipartETags() Option {
+	return func(m *Machine) {
+		m.trustMultipartETags = true
+	}
+}
+
+// WithDownloadBreaker routes downloads through breaker. Share one breaker
+// between all machines fetching from the same source so a throttling
+// endpoint trips it for all of them.
+func WithDownloadBreaker(breaker *storage.Breaker) Option {
+	return func(m *Machine) {
+		m.breaker = breaker
+	}
 }
 
 // NewMachine creates a new FSM machine with dependencies
 func NewMachine(
-	repo *db.Repository,
-	s3Client *storage.Client,
+	repo Repo,
+	source storage.Source,
 	validator *security.Validator,
 	dmManager devicemapper.Manager,
 	workDir string,
 	maxRetries int,
+	opts ...Option,
 ) *Machine {
-	return &Machine{
+	m := &Machine{
 		repo:       repo,
-		s3Client:   s3Client,
+		source:     source,
 		validator:  validator,
 		dmManager:  dmManager,
-		workDir:    workDir,
+		layout:     NewLayout(workDir, ""),
 		maxRetries: maxRetries,
+		deviceIDs:  repo,
+
+		clock:         clock.Real{},
+		vulnChecker:   scan.NoopChecker{},
+		keepDownload:  true,
+		keepExtracted: true,
+		runIDKey:      DefaultRunIDKey,
+	}
+	for _, opt := range opts {
+		opt(m)
 	}
+	return m
 }
 
 // handleCheckDB checks if image already exists in database (idempotency)
 func (m *Machine) handleCheckDB(ctx context.Context, req *fsm.Request[ImageRequest, ImageResponse]) (*fsm.Response[ImageResponse], error) {
-	slog.Info("fsm_state_check_db", "s3_key", req.Msg.S3Key)
-
-	// Check retry limit
-	if retryCount := fsm.RetryFromContext(ctx); retryCount >= uint64(m.maxRetries) {
-		slog.Error("max_retries_exceeded", "s3_key", req.Msg.S3Key, "max_retries", m.maxRetries)
-		return nil, fsm.Abort(fmt.Errorf("max retries (%d) exceeded", m.maxRetries))
-	}
+	loggerFrom(ctx).Info("fsm_state_check_db", "s3_key", req.Msg.Key())
 
 	// Check database
-	img, err := m.repo.GetByS3Key(req.Msg.S3Key)
+	img, err := m.repo.GetByS3KeyContext(ctx, req.Msg.Key())
 	if err != nil {
-		slog.Error("database_check_failed", "s3_key", req.Msg.S3Key, "error", err)
+		loggerFrom(ctx).Error("database_check_failed", "s3_key", req.Msg.Key(), "error", err)
 		return nil, fsm.Abort(errors.Wrap(err, "database error"))
 	}
 
@@ -73,26 +300,51 @@ func (m *Machine) handleCheckDB(ctx context.Context, req *fsm.Request[ImageReque
 		resp.ImageID = img.ID
 		resp.SHA256 = img.SHA256
 		resp.Status = img.Status
+		resp.Attempts = img.Attempts
 
 		if img.Status == db.StatusReady {
-			slog.Info("image_already_ready", "s3_key", req.Msg.S3Key, "image_id", img.ID, "status", img.Status)
+			loggerFrom(ctx).Info("image_already_ready", "s3_key", req.Msg.Key(), "image_id", img.ID, "status", img.Status)
 			// Skip to complete
 			return fsm.NewResponse(resp), nil
 		}
-		slog.Info("image_found_continue_processing", "s3_key", req.Msg.S3Key, "image_id", img.ID, "status", img.Status)
+		loggerFrom(ctx).Info("image_found_continue_processing", "s3_key", req.Msg.Key(), "image_id", img.ID, "status", img.Status)
+
+		if err := m.recordAttempt(ctx, img); err != nil {
+			return nil, err
+		}
+		resp.Attempts = img.Attempts
+
+		// Record the subpath this run extracts, which tree paths are built from
+		if img.ExtractSubpath != req.Msg.ExtractSubpath {
+			img.ExtractSubpath = req.Msg.ExtractSubpath
+			if err := m.repo.UpdateContext(ctx, img); err != nil {
+				return nil, errors.Wrap(err, "failed to record extraction subpath")
+			}
+		}
+
+		m.restoreDownload(ctx, img)
+		if size, ok := m.downloadIsCurrent(ctx, req.Msg, img); ok {
+			loggerFrom(ctx).Info("download_cache_hit", "s3_key", req.Msg.Key(), "image_id", img.ID, "etag", img.ETag)
+			resp.DownloadCached = true
+			resp.DownloadPath = m.downloadPath(req.Msg.Key())
+			resp.DownloadSize = size
+		}
 	} else {
 		// Create new pending record
 		img = &db.Image{
-			S3Key:  req.Msg.S3Key,
-			SHA256: "",
-			Status: db.StatusPending,
+			S3Key:          req.Msg.Key(),
+			SHA256:         "",
+			Status:         db.StatusPending,
+			Attempts:       1,
+			ExtractSubpath: req.Msg.ExtractSubpath,
 		}
-		if err := m.repo.Create(img); err != nil {
-			slog.Error("create_image_failed", "s3_key", req.Msg.S3Key, "error", err)
+		if err := m.repo.CreateContext(ctx, img); err != nil {
+			loggerFrom(ctx).Error("create_image_failed", "s3_key", req.Msg.Key(), "error", err)
 			return nil, errors.Wrap(err, "failed to create image record")
 		}
 		resp.ImageID = img.ID
-		slog.Info("image_created", "s3_key", req.Msg.S3Key, "image_id", img.ID)
+		resp.Attempts = img.Attempts
+		loggerFrom(ctx).Info("image_created", "s3_key", req.Msg.Key(), "image_id", img.ID)
 	}
 
 	return fsm.NewResponse(resp), nil
@@ -100,109 +352,202 @@ func (m *Machine) handleCheckDB(ctx context.Context, req *fsm.Request[ImageReque
 
 // handleDownload downloads image from S3
 func (m *Machine) handleDownload(ctx context.Context, req *fsm.Request[ImageRequest, ImageResponse]) (*fsm.Response[ImageResponse], error) {
-	slog.Info("fsm_state_download", "s3_key", req.Msg.S3Key)
-
-	// Check retry limit
-	if retryCount := fsm.RetryFromContext(ctx); retryCount >= uint64(m.maxRetries) {
-		slog.Error("max_retries_exceeded", "s3_key", req.Msg.S3Key, "max_retries", m.maxRetries)
-		return nil, fsm.Abort(fmt.Errorf("max retries (%d) exceeded", m.maxRetries))
-	}
+	loggerFrom(ctx).Info("fsm_state_download", "s3_key", req.Msg.Key())
 
 	resp := req.W.Msg
 	if resp == nil {
 		return nil, fsm.Abort(fmt.Errorf("response not initialized"))
 	}
 
+	// Skip the fetch when check_db found the local copy is still current
+	if resp.DownloadCached {
+		loggerFrom(ctx).Info("download_skipped", "s3_key", req.Msg.Key(), "local_path", resp.DownloadPath, "reason", "cached")
+		return fsm.NewResponse(resp), nil
+	}
+
 	// Update status
-	if err := m.repo.UpdateStatus(resp.ImageID, db.StatusDownloading, ""); err != nil {
-		slog.Error("status_update_failed", "image_id", resp.ImageID, "status", db.StatusDownloading, "error", err)
+	if err := m.repo.UpdateStatusContext(ctx, resp.ImageID, db.StatusDownloading, ""); err != nil {
+		loggerFrom(ctx).Error("status_update_failed", "image_id", resp.ImageID, "status", db.StatusDownloading, "error", err)
 		return nil, errors.Wrap(err, "failed to update status")
 	}
 
+	source, err := m.sourceFor(req.Msg)
+	if err != nil {
+		m.repo.UpdateStatusContext(ctx, resp.ImageID, db.StatusFailed, err.Error())
+		return nil, fsm.Abort(err)
+	}
+
+	if err := m.checkContentType(ctx, req.Msg, source); err != nil {
+		loggerFrom(ctx).Error("content_type_check_failed", "s3_key", req.Msg.Key(), "error", err)
+		// As with the download itself, only a missing object, denied
+		// access or a disallowed type won't change on retry
+		if errors.IsFatal(err) || errors.Is(err, storage.ErrNotFound) || errors.Is(err, storage.ErrAccessDenied) {
+			m.repo.UpdateStatusContext(ctx, resp.ImageID, db.StatusFailed, err.Error())
+			return nil, fsm.Abort(err)
+		}
+		return nil, err
+	}
+
+	if streamer, ok := m.streamer(source); ok {
+		return m.streamDownload(ctx, req, streamer)
+	}
+
 	// Create work directory
-	downloadDir := filepath.Join(m.workDir, "downloads")
+	downloadDir := m.layout.DownloadsDir()
 	if err := os.MkdirAll(downloadDir, 0755); err != nil {
-		slog.Error("download_dir_creation_failed", "path", downloadDir, "error", err)
+		loggerFrom(ctx).Error("download_dir_creation_failed", "path", downloadDir, "error", err)
 		return nil, errors.Wrap(err, "failed to create download dir")
 	}
 
 	// Download from S3
-	localPath := filepath.Join(downloadDir, filepath.Base(req.Msg.S3Key))
-	slog.Info("download_started", "s3_key", req.Msg.S3Key, "local_path", localPath)
+	localPath := m.downloadPath(req.Msg.Key())
+	loggerFrom(ctx).Info("download_started", "s3_key", req.Msg.Key(), "local_path", localPath)
 
-	result, err := m.s3Client.Download(ctx, req.Msg.S3Key, localPath)
+	var result *storage.DownloadResult
+	err = m.breaker.Do(ctx, func() error {
+		var err error
+		result, err = source.Download(ctx, req.Msg.Key(), localPath)
+		return err
+	})
 	if err != nil {
-		slog.Error("download_failed", "s3_key", req.Msg.S3Key, "error", err)
+		loggerFrom(ctx).Error("download_failed", "s3_key", req.Msg.Key(), "error", err)
+		// A missing object or denied access won't change on retry;
+		// network errors fall through and are retried
+		if errors.Is(err, storage.ErrNotFound) || errors.Is(err, storage.ErrAccessDenied) {
+			m.repo.UpdateStatusContext(ctx, resp.ImageID, db.StatusFailed, err.Error())
+			return nil, fsm.Abort(errors.Wrap(err, "failed to download from S3"))
+		}
 		return nil, errors.Wrap(err, "failed to download from S3")
 	}
 
-	slog.Info("download_complete",
-		"s3_key", req.Msg.S3Key,
+	loggerFrom(ctx).Info("download_complete",
+		"s3_key", req.Msg.Key(),
 		"size_mb", result.Size/1024/1024,
-		"sha256", result.SHA256[:16]+"...",
+		"digest", result.Digest,
 	)
 
 	// Update response
-	resp.SHA256 = result.SHA256
+	resp.SHA256 = result.Digest
 	resp.DownloadPath = result.LocalPath
 	resp.DownloadSize = result.Size
 
 	// Update database
-	img, _ := m.repo.GetByS3Key(req.Msg.S3Key)
-	if img != nil {
-		img.SHA256 = result.SHA256
-		if err := m.repo.Update(img); err != nil {
-			slog.Error("image_update_failed", "image_id", img.ID, "error", err)
-			return nil, errors.Wrap(err, "failed to update image")
-		}
+	info := storage.ObjectInfo{ETag: result.ETag, LastModified: result.LastModified, Size: result.Size}
+	if err := m.recordDownload(ctx, req.Msg.Key(), result.Digest, info); err != nil {
+		return nil, err
 	}
 
 	return fsm.NewResponse(resp), nil
 }
 
+// recordDownload stores the digest and source metadata of a fetched image
+func (m *Machine) recordDownload(ctx context.Context, s3Key, digest string, info storage.ObjectInfo) error {
+	img, _ := m.repo.GetByS3KeyContext(ctx, s3Key)
+	if img == nil {
+		return nil
+	}
+	img.SHA256 = digest
+	img.ETag = info.ETag
+	img.DownloadSize = info.Size
+	img.LastModified = ""
+	if !info.LastModified.IsZero() {
+		img.LastModified = info.LastModified.UTC().Format(time.RFC3339)
+	}
+	if err := m.repo.UpdateContext(ctx, img); err != nil {
+		loggerFrom(ctx).Error("image_update_failed", "image_id", img.ID, "error", err)
+		return errors.Wrap(err, "failed to update image")
+	}
+	return nil
+}
+
 // handleValidate validates and extracts tarball
 func (m *Machine) handleValidate(ctx context.Context, req *fsm.Request[ImageRequest, ImageResponse]) (*fsm.Response[ImageResponse], error) {
-	slog.Info("fsm_state_validate", "s3_key", req.Msg.S3Key)
-
-	// Check retry limit
-	if retryCount := fsm.RetryFromContext(ctx); retryCount >= uint64(m.maxRetries) {
-		slog.Error("max_retries_exceeded", "s3_key", req.Msg.S3Key, "max_retries", m.maxRetries)
-		return nil, fsm.Abort(fmt.Errorf("max retries (%d) exceeded", m.maxRetries))
-	}
+	loggerFrom(ctx).Info("fsm_state_validate", "s3_key", req.Msg.Key())
 
 	resp := req.W.Msg
 	if resp == nil {
 		return nil, fsm.Abort(fmt.Errorf("response not initialized"))
 	}
 
-	// Validate file size
-	if err := m.validator.ValidateFileSize(resp.DownloadSize); err != nil {
-		slog.Error("file_size_validation_failed", "s3_key", req.Msg.S3Key, "size", resp.DownloadSize, "error", err)
-		m.repo.UpdateStatus(resp.ImageID, db.StatusFailed, err.Error())
-		return nil, fsm.Abort(err)
+	if err := m.checkImageSize(ctx, req.Msg.Key(), resp.ImageID, resp.DownloadSize); err != nil {
+		return nil, err
 	}
 
-	// Create extraction directory
-	extractDir := filepath.Join(m.workDir, "extracted", filepath.Base(req.Msg.S3Key))
-	if err := os.RemoveAll(extractDir); err != nil && !os.IsNotExist(err) {
-		slog.Error("extract_dir_cleanup_failed", "path", extractDir, "error", err)
-		return nil, errors.Wrap(err, "failed to clean extract dir")
+	// Trees are cached by digest; a complete one from an earlier run (of
+	// this or any other key with the same content) is reused once it
+	// passes this run's extraction checks, since that run may have
+	// extracted it under other options
+	extractDir := m.treePath(req.Msg, resp.SHA256)
+	extractOpts := m.extractOptionsFor(ctx, req.Msg)
+	if treeComplete(extractDir) {
+		loggerFrom(ctx).Info("extraction_skipped", "s3_key", req.Msg.Key(), "extract_dir", extractDir, "reason", "cached")
+		if err := devicemapper.CheckTree(extractDir, m.validator, extractOpts, resp.DownloadSize); err != nil {
+			loggerFrom(ctx).Error("cached_tree_rejected", "s3_key", req.Msg.Key(), "extract_dir", extractDir, "error", err)
+			m.repo.UpdateStatusContext(ctx, resp.ImageID, db.StatusFailed, err.Error())
+			return nil, fsm.Abort(errors.Wrap(err, "cached tree failed extraction checks"))
+		}
+		if err := m.checkRootfs(ctx, req.Msg.Key(), resp.ImageID, extractDir); err != nil {
+			return nil, err
+		}
+		if err := m.recordTreeHash(ctx, req.Msg.Key(), resp, extractDir); err != nil {
+			return nil, err
+		}
+		if err := m.recordExtractedSize(resp, extractDir, false); err != nil {
+			return nil, err
+		}
+		resp.ExtractedPath = extractDir
+		return fsm.NewResponse(resp), nil
 	}
-	if err := os.MkdirAll(extractDir, 0755); err != nil {
-		slog.Error("extract_dir_creation_failed", "path", extractDir, "error", err)
-		return nil, errors.Wrap(err, "failed to create extract dir")
+	if err := os.Remove(extractDir + completeSuffix); err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "failed to clear stale completion marker")
 	}
 
-	// Extract tarball with security validation
-	slog.Info("extraction_started", "s3_key", req.Msg.S3Key, "extract_dir", extractDir)
+	if resp.Streamed {
+		// The download state extracted the tree as it streamed in
+		loggerFrom(ctx).Info("extraction_skipped", "s3_key", req.Msg.Key(), "extract_dir", extractDir, "reason", "streamed")
+	} else {
+		// Extract tarball with security validation. Extraction goes through a
+		// temp directory so a failed run never leaves a partial tree behind.
+		loggerFrom(ctx).Info("extraction_started", "s3_key", req.Msg.Key(), "extract_dir", extractDir)
+
+		if err := m.extractTarball(ctx, req.Msg.Key(), resp.DownloadPath, extractDir, extractOpts); err != nil {
+			loggerFrom(ctx).Error("extraction_failed", "s3_key", req.Msg.Key(), "error", err, "disk_full", errors.Is(err, devicemapper.ErrDiskFull))
+			m.repo.UpdateStatusContext(ctx, resp.ImageID, db.StatusFailed, err.Error())
+			return nil, fsm.Abort(errors.Wrap(err, "tar extraction failed"))
+		}
+	}
+	resp.TreeExtracted = true
 
-	if err := devicemapper.ExtractTarball(resp.DownloadPath, extractDir, m.validator); err != nil {
-		slog.Error("extraction_failed", "s3_key", req.Msg.S3Key, "error", err)
-		m.repo.UpdateStatus(resp.ImageID, db.StatusFailed, err.Error())
-		return nil, fsm.Abort(errors.Wrap(err, "tar extraction failed"))
+	// OCI image layouts carry the rootfs as layer blobs; replace the layout
+	// with the unpacked filesystem so later states see a plain tree
+	isOCI, err := unpackOCILayout(extractDir, m.validator, !extractOpts.SkipCompressionRatio)
+	if err != nil {
+		loggerFrom(ctx).Error("oci_unpack_failed", "s3_key", req.Msg.Key(), "error", err)
+		m.repo.UpdateStatusContext(ctx, resp.ImageID, db.StatusFailed, err.Error())
+		return nil, fsm.Abort(errors.Wrap(err, "oci unpack failed"))
+	}
+	if isOCI {
+		loggerFrom(ctx).Info("oci_layout_unpacked", "s3_key", req.Msg.Key())
 	}
 
-	slog.Info("extraction_complete", "s3_key", req.Msg.S3Key, "extract_dir", extractDir)
+	// Catch non-rootfs uploads before they get a device and snapshot
+	if err := m.checkRootfs(ctx, req.Msg.Key(), resp.ImageID, extractDir); err != nil {
+		return nil, err
+	}
+
+	if err := markTreeComplete(extractDir); err != nil {
+		loggerFrom(ctx).Error("extraction_mark_complete_failed", "s3_key", req.Msg.Key(), "error", err)
+		return nil, err
+	}
+
+	loggerFrom(ctx).Info("extraction_complete", "s3_key", req.Msg.Key(), "extract_dir", extractDir)
+
+	if err := m.recordTreeHash(ctx, req.Msg.Key(), resp, extractDir); err != nil {
+		return nil, err
+	}
+	if err := m.recordExtractedSize(resp, extractDir, !extractOpts.Isolate); err != nil {
+		return nil, err
+	}
 
 	resp.ExtractedPath = extractDir
 
@@ -211,13 +556,7 @@ func (m *Machine) handleValidate(ctx context.Context, req *fsm.Request[ImageRequ
 
 // handleCreateDevice creates devicemapper device, mounts it, and extracts tarball into it
 func (m *Machine) handleCreateDevice(ctx context.Context, req *fsm.Request[ImageRequest, ImageResponse]) (*fsm.Response[ImageResponse], error) {
-	slog.Info("fsm_state_create_device", "s3_key", req.Msg.S3Key)
-
-	// Check retry limit
-	if retryCount := fsm.RetryFromContext(ctx); retryCount >= uint64(m.maxRetries) {
-		slog.Error("max_retries_exceeded", "s3_key", req.Msg.S3Key, "max_retries", m.maxRetries)
-		return nil, fsm.Abort(fmt.Errorf("max retries (%d) exceeded", m.maxRetries))
-	}
+	loggerFrom(ctx).Info("fsm_state_create_device", "s3_key", req.Msg.Key())
 
 	resp := req.W.Msg
 	if resp == nil {
@@ -226,75 +565,122 @@ func (m *Machine) handleCreateDevice(ctx context.Context, req *fsm.Request[Image
 
 	// Skip devicemapper if not available (stub on non-Linux)
 	if m.dmManager == nil {
-		slog.Warn("devicemapper_unavailable", "s3_key", req.Msg.S3Key, "reason", "stub_platform")
+		loggerFrom(ctx).Warn("devicemapper_unavailable", "s3_key", req.Msg.Key(), "reason", "stub_platform")
+		resp.addDegradation("device creation skipped: devicemapper unavailable")
 		// Keep using extracted path from validate state
 		return fsm.NewResponse(resp), nil
 	}
 
-	// Create base thin device
-	baseDeviceID, err := m.repo.AllocateNextDeviceID(ctx)
-	if err != nil {
-		slog.Error("base_device_id_allocation_failed", "s3_key", req.Msg.S3Key, "error", err)
-		return nil, errors.Wrap(err, "failed to allocate base device ID")
+	if m.useOverlay() {
+		if err := m.createOverlay(ctx, req.Msg.Key(), resp); err != nil {
+			return nil, err
+		}
+		return fsm.NewResponse(resp), nil
 	}
 
-	deviceID := fmt.Sprintf("%d", baseDeviceID)
-	slog.Info("device_creation_started", "s3_key", req.Msg.S3Key, "device_id", deviceID)
+	// Verify the pool can hold the image before mkfs and copy
+	if err := m.checkPoolSpace(ctx, resp.ExtractedSize); err != nil {
+		if !errors.Is(err, ErrInsufficientPoolSpace) {
+			return nil, err
+		}
+		loggerFrom(ctx).Error("pool_space_check_failed", "s3_key", req.Msg.Key(), "error", err)
+		m.repo.UpdateStatusContext(ctx, resp.ImageID, db.StatusFailed, err.Error())
+		return nil, fsm.Abort(err)
+	}
 
-	deviceInfo, err := m.dmManager.CreateDevice(ctx, "", deviceID)
+	// An attempt that failed part way may have left its device mounted;
+	// clear it out so the same ID is built again from scratch
+	staleDeviceID, err := m.cleanStaleDevice(ctx, req.Msg.Key())
 	if err != nil {
-		// Log but don't fail - devicemapper is optional
-		slog.Warn("device_creation_failed", "s3_key", req.Msg.S3Key, "device_id", deviceID, "error", err)
-		resp.ErrorMessage = fmt.Sprintf("devicemapper warning: %v", err)
-		return fsm.NewResponse(resp), nil
+		return nil, err
 	}
 
-	slog.Info("device_created", "s3_key", req.Msg.S3Key, "device_id", deviceID, "device_path", deviceInfo.DevicePath)
+	// A run that crashed after recording its device resumes here; reuse
+	// that device instead of leaking it and allocating another
+	baseDeviceID, deviceInfo, err := m.reuseDevice(ctx, req.Msg.Key(), resp.ExtractedSize)
+	if err != nil {
+		return nil, err
+	}
+	deviceID := fmt.Sprintf("%d", baseDeviceID)
+
+	if deviceInfo == nil {
+		// Create base thin device
+		baseDeviceID = staleDeviceID
+		if baseDeviceID == 0 {
+			baseDeviceID, err = m.deviceIDs.AllocateNextDeviceID(ctx)
+			if err != nil {
+				loggerFrom(ctx).Error("base_device_id_allocation_failed", "s3_key", req.Msg.Key(), "error", err)
+				return nil, errors.Wrap(err, "failed to allocate base device ID")
+			}
+			// Record the ID before touching the pool so a retry can find
+			// whatever this attempt leaves behind
+			if err := m.recordBaseDeviceID(ctx, req.Msg.Key(), baseDeviceID); err != nil {
+				return nil, err
+			}
+		}
+
+		deviceID = fmt.Sprintf("%d", baseDeviceID)
+		loggerFrom(ctx).Info("device_creation_started", "s3_key", req.Msg.Key(), "device_id", deviceID)
+
+		deviceInfo, err = m.dmManager.CreateDevice(ctx, "", deviceID, m.deviceSize(resp.ExtractedSize))
+		if err != nil {
+			// Log but don't fail - devicemapper is optional
+			loggerFrom(ctx).Warn("device_creation_failed", "s3_key", req.Msg.Key(), "device_id", deviceID, "error", err)
+			if err := m.recordBaseDeviceID(ctx, req.Msg.Key(), 0); err != nil {
+				return nil, err
+			}
+			resp.ErrorMessage = fmt.Sprintf("devicemapper warning: %v", err)
+			resp.addDegradation(fmt.Sprintf("device creation failed: %v", err))
+			return fsm.NewResponse(resp), nil
+		}
+
+		loggerFrom(ctx).Info("device_created", "s3_key", req.Msg.Key(), "device_id", deviceID, "device_path", deviceInfo.DevicePath)
+	}
 
 	// Mount device
-	mountPath := filepath.Join(m.workDir, "mounts", deviceID)
+	mountPath := m.layout.MountPath(deviceID)
 	if err := os.MkdirAll(mountPath, 0755); err != nil {
-		slog.Error("mount_dir_creation_failed", "path", mountPath, "error", err)
+		loggerFrom(ctx).Error("mount_dir_creation_failed", "path", mountPath, "error", err)
 		m.dmManager.DeleteDevice(ctx, deviceID)
 		return nil, errors.Wrap(err, "failed to create mount dir")
 	}
 
-	slog.Info("mounting_device", "device_path", deviceInfo.DevicePath, "mount_path", mountPath)
+	loggerFrom(ctx).Info("mounting_device", "device_path", deviceInfo.DevicePath, "mount_path", mountPath)
 
 	if err := m.dmManager.MountDevice(ctx, deviceInfo.DevicePath, mountPath); err != nil {
-		slog.Error("device_mount_failed", "device_path", deviceInfo.DevicePath, "error", err)
+		loggerFrom(ctx).Error("device_mount_failed", "device_path", deviceInfo.DevicePath, "error", err)
 		m.dmManager.DeleteDevice(ctx, deviceID)
 		return nil, errors.Wrap(err, "failed to mount device")
 	}
 
 	// Copy already-extracted files to mounted device
-	slog.Info("copying_files_to_device", "source", resp.ExtractedPath, "dest", mountPath)
+	loggerFrom(ctx).Info("copying_files_to_device", "source", resp.ExtractedPath, "dest", mountPath)
 
 	if err := copyDir(resp.ExtractedPath, mountPath); err != nil {
-		slog.Error("copy_to_device_failed", "error", err)
-		m.repo.UpdateStatus(resp.ImageID, db.StatusFailed, err.Error())
+		loggerFrom(ctx).Error("copy_to_device_failed", "error", err)
+		m.repo.UpdateStatusContext(ctx, resp.ImageID, db.StatusFailed, err.Error())
 		m.dmManager.UnmountDevice(ctx, mountPath)
 		m.dmManager.DeleteDevice(ctx, deviceID)
 		return nil, fsm.Abort(errors.Wrap(err, "copy to device failed"))
 	}
 
-	slog.Info("files_copied_to_device", "mount_path", mountPath)
+	loggerFrom(ctx).Info("files_copied_to_device", "mount_path", mountPath)
 
 	// Unmount device
 	if err := m.dmManager.UnmountDevice(ctx, mountPath); err != nil {
-		slog.Error("device_unmount_failed", "mount_path", mountPath, "error", err)
+		loggerFrom(ctx).Error("device_unmount_failed", "mount_path", mountPath, "error", err)
 		return nil, errors.Wrap(err, "failed to unmount device")
 	}
 
-	slog.Info("device_unmounted", "mount_path", mountPath)
+	loggerFrom(ctx).Info("device_unmounted", "mount_path", mountPath)
 
 	// Update response and database
 	resp.DevicePath = deviceInfo.DevicePath
-	img, _ := m.repo.GetByS3Key(req.Msg.S3Key)
+	img, _ := m.repo.GetByS3KeyContext(ctx, req.Msg.Key())
 	if img != nil {
 		img.BaseDeviceID = baseDeviceID
 		img.DevicePath = deviceInfo.DevicePath
-		if err := m.repo.Update(img); err != nil {
+		if err := m.repo.UpdateContext(ctx, img); err != nil {
 			return nil, errors.Wrap(err, "failed to update image")
 		}
 	}
@@ -306,15 +692,147 @@ func (m *Machine) handleCreateDevice(ctx context.Context, req *fsm.Request[Image
 	return fsm.NewResponse(resp), nil
 }
 
-// handleComplete creates snapshot and marks FSM as complete
-func (m *Machine) handleComplete(ctx context.Context, req *fsm.Request[ImageRequest, ImageResponse]) (*fsm.Response[ImageResponse], error) {
-	slog.Info("fsm_state_complete", "s3_key", req.Msg.S3Key)
+// cleanStaleDevice undoes what an earlier attempt left of a base device it
+// allocated for s3Key but never finished: the device is unmounted and
+// removed, and its ID returned so it can be built again. It returns 0 if
+// there is no such device.
+func (m *Machine) cleanStaleDevice(ctx context.Context, s3Key string) (int, error) {
+	img, err := m.repo.GetByS3KeyContext(ctx, s3Key)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to look up image")
+	}
+	// A recorded device path means the device was completed
+	if img == nil || img.BaseDeviceID == 0 || img.DevicePath != "" {
+		return 0, nil
+	}
+
+	deviceID := fmt.Sprintf("%d", img.BaseDeviceID)
+	loggerFrom(ctx).Warn("stale_device_cleanup", "s3_key", s3Key, "device_id", deviceID)
+
+	// UnmountDevice is a no-op when nothing is mounted there
+	if err := m.dmManager.UnmountDevice(ctx, m.layout.MountPath(deviceID)); err != nil {
+		return 0, errors.Wrap(err, "failed to unmount stale device")
+	}
+	// The attempt may have failed before the device was activated
+	if err := m.dmManager.DeleteDevice(ctx, deviceID); err != nil {
+		loggerFrom(ctx).Info("stale_device_not_removed", "s3_key", s3Key, "device_id", deviceID, "error", err)
+	}
+
+	return img.BaseDeviceID, nil
+}
 
-	// Check retry limit
-	if retryCount := fsm.RetryFromContext(ctx); retryCount >= uint64(m.maxRetries) {
-		slog.Error("max_retries_exceeded", "s3_key", req.Msg.S3Key, "max_retries", m.maxRetries)
-		return nil, fsm.Abort(fmt.Errorf("max retries (%d) exceeded", m.maxRetries))
+// recordBaseDeviceID stores the base device ID allocated for s3Key, or
+// clears it with 0
+func (m *Machine) recordBaseDeviceID(ctx context.Context, s3Key string, id int) error {
+	img, err := m.repo.GetByS3KeyContext(ctx, s3Key)
+	if err != nil {
+		return errors.Wrap(err, "failed to look up image")
+	}
+	if img == nil {
+		return nil
+	}
+	img.BaseDeviceID = id
+	if err := m.repo.UpdateContext(ctx, img); err != nil {
+		return errors.Wrap(err, "failed to record base device ID")
 	}
+	return nil
+}
+
+// reuseDevice returns the base device an earlier attempt recorded for
+// s3Key, or a nil DeviceInfo if there is none. The device is checked with
+// e2fsck before it is mounted again, since a crash can leave its
+// filesystem dirty; one that can't be repaired, or whose mapping is gone,
+// is recreated empty under the same ID, sized for extractedSize bytes.
+func (m *Machine) reuseDevice(ctx context.Context, s3Key string, extractedSize int64) (int, *devicemapper.DeviceInfo, error) {
+	img, err := m.repo.GetByS3KeyContext(ctx, s3Key)
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "failed to look up image")
+	}
+	if img == nil || img.BaseDeviceID == 0 || img.DevicePath == "" {
+		return 0, nil, nil
+	}
+
+	deviceID := fmt.Sprintf("%d", img.BaseDeviceID)
+	loggerFrom(ctx).Info("device_reuse_started", "s3_key", s3Key, "device_id", deviceID, "device_path", img.DevicePath)
+
+	// e2fsck refuses mounted filesystems
+	if err := m.dmManager.UnmountDevice(ctx, m.layout.MountPath(deviceID)); err != nil {
+		return 0, nil, errors.Wrap(err, "failed to unmount reused device")
+	}
+
+	reason := "device_missing"
+	if _, err := os.Stat(img.DevicePath); err == nil {
+		err := m.dmManager.CheckFilesystem(ctx, img.DevicePath)
+		if err == nil {
+			return img.BaseDeviceID, &devicemapper.DeviceInfo{DevicePath: img.DevicePath}, nil
+		}
+		if !errors.Is(err, devicemapper.ErrFilesystemUncorrectable) {
+			return 0, nil, errors.Wrap(err, "filesystem check failed")
+		}
+		reason = "filesystem_uncorrectable"
+	}
+
+	loggerFrom(ctx).Warn("device_reformat", "s3_key", s3Key, "device_id", deviceID, "reason", reason)
+	// The mapping may already be gone; CreateDevice replaces the thin
+	// device either way
+	m.dmManager.DeleteDevice(ctx, deviceID)
+	info, err := m.dmManager.CreateDevice(ctx, "", deviceID, m.deviceSize(extractedSize))
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "failed to reformat reused device")
+	}
+	return img.BaseDeviceID, info, nil
+}
+
+// handleScan inventories the OS packages installed in the image and checks
+// them for known vulnerabilities
+func (m *Machine) handleScan(ctx context.Context, req *fsm.Request[ImageRequest, ImageResponse]) (*fsm.Response[ImageResponse], error) {
+	loggerFrom(ctx).Info("fsm_state_scan", "s3_key", req.Msg.Key())
+
+	resp := req.W.Msg
+	if resp == nil {
+		return nil, fsm.Abort(fmt.Errorf("response not initialized"))
+	}
+
+	// The device is unmounted by now; the extracted tree holds the same files
+	root := m.treePath(req.Msg, resp.SHA256)
+	found, err := scan.Scan(root)
+	if err != nil {
+		loggerFrom(ctx).Error("package_scan_failed", "s3_key", req.Msg.Key(), "error", err)
+		return nil, errors.Wrap(err, "package scan failed")
+	}
+
+	pkgs := make([]db.Package, len(found))
+	for i, p := range found {
+		pkgs[i] = db.Package{
+			ImageID:      resp.ImageID,
+			Manager:      p.Manager,
+			Name:         p.Name,
+			Version:      p.Version,
+			Architecture: p.Architecture,
+		}
+	}
+	if err := m.repo.ReplacePackagesContext(ctx, resp.ImageID, pkgs); err != nil {
+		return nil, errors.Wrap(err, "failed to record packages")
+	}
+	resp.PackageCount = len(pkgs)
+
+	vulns, err := m.vulnChecker.Check(ctx, found)
+	if err != nil {
+		loggerFrom(ctx).Error("vulnerability_check_failed", "s3_key", req.Msg.Key(), "error", err)
+		return nil, errors.Wrap(err, "vulnerability check failed")
+	}
+	for _, v := range vulns {
+		loggerFrom(ctx).Warn("vulnerability_found", "s3_key", req.Msg.Key(), "id", v.ID, "severity", v.Severity, "package", v.Package.Name, "version", v.Package.Version)
+	}
+
+	loggerFrom(ctx).Info("package_scan_complete", "s3_key", req.Msg.Key(), "package_count", len(pkgs), "vulnerability_count", len(vulns))
+
+	return fsm.NewResponse(resp), nil
+}
+
+// handleComplete creates snapshot and marks FSM as complete
+func (m *Machine) handleComplete(ctx context.Context, req *fsm.Request[ImageRequest, ImageResponse]) (*fsm.Response[ImageResponse], error) {
+	loggerFrom(ctx).Info("fsm_state_complete", "s3_key", req.Msg.Key())
 
 	resp := req.W.Msg
 	if resp == nil {
@@ -322,78 +840,454 @@ func (m *Machine) handleComplete(ctx context.Context, req *fsm.Request[ImageRequ
 	}
 
 	// Load image from database to get device_path set by handleCreateDevice
-	img, err := m.repo.GetByS3Key(req.Msg.S3Key)
+	img, err := m.repo.GetByS3KeyContext(ctx, req.Msg.Key())
 	if err != nil {
-		slog.Error("failed_to_load_image", "s3_key", req.Msg.S3Key, "error", err)
+		loggerFrom(ctx).Error("failed_to_load_image", "s3_key", req.Msg.Key(), "error", err)
 		return nil, fsm.Abort(errors.Wrap(err, "failed to load image"))
 	}
 	if img == nil {
-		slog.Error("image_not_found", "s3_key", req.Msg.S3Key)
+		loggerFrom(ctx).Error("image_not_found", "s3_key", req.Msg.Key())
 		return nil, fsm.Abort(fmt.Errorf("image not found in database"))
 	}
 
 	// Create snapshot from base device (MANDATORY - required by challenge)
-	// Only skip on non-Linux platforms (stub manager)
-	if m.dmManager != nil && img.DevicePath != "" {
+	// Only skip on non-Linux platforms (stub manager). An overlay's upper
+	// directory already takes the image's writes, so it has no snapshot.
+	if m.useOverlay() {
+		loggerFrom(ctx).Info("snapshot_skipped", "s3_key", req.Msg.Key(), "reason", "overlay_driver")
+		resp.DevicePath = img.DevicePath
+	} else if m.dmManager != nil && img.DevicePath != "" {
 		baseDeviceID := fmt.Sprintf("%d", img.BaseDeviceID)
 
 		snapshotID := img.SnapshotID
 		if snapshotID == 0 {
 			var err error
-			snapshotID, err = m.repo.AllocateNextDeviceID(ctx)
+			snapshotID, err = m.deviceIDs.AllocateNextDeviceID(ctx)
 			if err != nil {
-				slog.Error("snapshot_id_allocation_failed", "s3_key", req.Msg.S3Key, "error", err)
-				m.repo.UpdateStatus(img.ID, db.StatusFailed, fmt.Sprintf("snapshot ID allocation failed: %v", err))
+				loggerFrom(ctx).Error("snapshot_id_allocation_failed", "s3_key", req.Msg.Key(), "error", err)
+				m.repo.UpdateStatusContext(ctx, img.ID, db.StatusFailed, fmt.Sprintf("snapshot ID allocation failed: %v", err))
 				return nil, fsm.Abort(errors.Wrap(err, "snapshot ID allocation failed"))
 			}
-			slog.Info("allocated_new_snapshot_id", "s3_key", req.Msg.S3Key, "snapshot_id", snapshotID)
+			loggerFrom(ctx).Info("allocated_new_snapshot_id", "s3_key", req.Msg.Key(), "snapshot_id", snapshotID)
+			// Record the ID before touching the pool, so cleanup --orphaned
+			// doesn't take the snapshot for an orphan and a retry reuses it
+			img.SnapshotID = snapshotID
+			if err := m.repo.UpdateContext(ctx, img); err != nil {
+				loggerFrom(ctx).Error("image_update_failed", "image_id", img.ID, "error", err)
+				return nil, errors.Wrap(err, "failed to record snapshot ID")
+			}
 		} else {
-			slog.Info("reusing_existing_snapshot_id", "s3_key", req.Msg.S3Key, "snapshot_id", snapshotID)
+			loggerFrom(ctx).Info("reusing_existing_snapshot_id", "s3_key", req.Msg.Key(), "snapshot_id", snapshotID)
 		}
 
-		slog.Info("snapshot_creation_started", "s3_key", req.Msg.S3Key, "base_device_id", baseDeviceID, "snapshot_id", snapshotID)
+		loggerFrom(ctx).Info("snapshot_creation_started", "s3_key", req.Msg.Key(), "base_device_id", baseDeviceID, "snapshot_id", snapshotID)
 
 		snapshotInfo, err := m.dmManager.CreateSnapshot(ctx, baseDeviceID, snapshotID)
 		if err != nil {
 			// Check if this is a platform limitation (stub manager on non-Linux)
 			if strings.Contains(err.Error(), "not supported") {
 				// Graceful degradation for non-Linux platforms
-				slog.Warn("snapshot_unavailable", "s3_key", req.Msg.S3Key, "reason", "platform_limitation")
+				loggerFrom(ctx).Warn("snapshot_unavailable", "s3_key", req.Msg.Key(), "reason", "platform_limitation")
 				resp.ErrorMessage = fmt.Sprintf("snapshot unavailable: %v", err)
+				resp.addDegradation(fmt.Sprintf("snapshot skipped: %v", err))
+				img.SnapshotID = 0
+				if err := m.repo.UpdateContext(ctx, img); err != nil {
+					return nil, errors.Wrap(err, "failed to clear snapshot ID")
+				}
 			} else {
 				// Snapshot creation is MANDATORY on Linux - abort FSM
-				slog.Error("snapshot_creation_failed", "s3_key", req.Msg.S3Key, "error", err)
-				m.repo.UpdateStatus(img.ID, db.StatusFailed, fmt.Sprintf("snapshot creation failed: %v", err))
+				loggerFrom(ctx).Error("snapshot_creation_failed", "s3_key", req.Msg.Key(), "error", err)
+				m.repo.UpdateStatusContext(ctx, img.ID, db.StatusFailed, fmt.Sprintf("snapshot creation failed: %v", err))
 				return nil, fsm.Abort(errors.Wrap(err, "snapshot creation failed (required by challenge)"))
 			}
 		} else {
-			slog.Info("snapshot_created", "s3_key", req.Msg.S3Key, "snapshot_id", snapshotInfo.SnapshotID)
+			loggerFrom(ctx).Info("snapshot_created", "s3_key", req.Msg.Key(), "snapshot_id", snapshotInfo.SnapshotID)
 
 			// Update database with snapshot info
 			img.SnapshotID = snapshotInfo.SnapshotID
+			img.SnapshotActive = true
 			resp.SnapshotID = snapshotInfo.SnapshotID
 			resp.DevicePath = img.DevicePath
-			if err := m.repo.Update(img); err != nil {
-				slog.Error("image_update_failed", "image_id", img.ID, "error", err)
+			if err := m.repo.UpdateContext(ctx, img); err != nil {
+				loggerFrom(ctx).Error("image_update_failed", "image_id", img.ID, "error", err)
 				return nil, errors.Wrap(err, "failed to update image")
 			}
 		}
 	} else {
-		slog.Info("snapshot_skipped", "s3_key", req.Msg.S3Key, "dm_available", m.dmManager != nil, "device_path", img.DevicePath)
+		loggerFrom(ctx).Info("snapshot_skipped", "s3_key", req.Msg.Key(), "dm_available", m.dmManager != nil, "device_path", img.DevicePath)
+		if m.dmManager == nil {
+			resp.addDegradation("snapshot skipped: devicemapper unavailable")
+		} else {
+			resp.addDegradation("snapshot skipped: image has no device")
+		}
 	}
 
 	// Mark image as ready
-	if err := m.repo.UpdateStatus(resp.ImageID, db.StatusReady, ""); err != nil {
-		slog.Error("status_update_failed", "image_id", resp.ImageID, "error", err)
+	if err := m.repo.UpdateStatusContext(ctx, resp.ImageID, db.StatusReady, ""); err != nil {
+		loggerFrom(ctx).Error("status_update_failed", "image_id", resp.ImageID, "error", err)
 		return nil, errors.Wrap(err, "failed to update status")
 	}
 	resp.Status = db.StatusReady
 
-	slog.Info("fsm_complete", "s3_key", req.Msg.S3Key, "status", db.StatusReady)
+	loggerFrom(ctx).Info("fsm_complete", "s3_key", req.Msg.Key(), "status", db.StatusReady)
+
+	// An overlay reads through to the extracted tree, so it is kept
+	m.removeWorkFiles(ctx, img.ID, req.Msg, resp, img.DevicePath != "" && !m.useOverlay())
 
 	return fsm.NewResponse(resp), nil
 }
 
+// removeWorkFiles deletes the download and extracted tree of a ready image
+// unless configured to keep them, compressing a kept download if
+// configured to. The extracted tree is kept when no device was built,
+// since it is then the only copy of the image. Failures are logged rather
+// than returned: the image is already ready.
+func (m *Machine) removeWorkFiles(ctx context.Context, imageID int64, req *ImageRequest, resp *ImageResponse, onDevice bool) {
+	s3Key := req.Key()
+	if !m.keepDownload {
+		path := m.downloadPath(s3Key)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			loggerFrom(ctx).Warn("download_remove_failed", "s3_key", s3Key, "path", path, "error", err)
+		} else {
+			loggerFrom(ctx).Info("download_removed", "s3_key", s3Key, "path", path)
+			resp.DownloadPath = ""
+		}
+	} else if m.compressDownloads {
+		m.compressDownload(ctx, imageID, s3Key, resp)
+	}
+
+	if !m.keepExtracted {
+		if !onDevice {
+			loggerFrom(ctx).Warn("extracted_tree_kept", "s3_key", s3Key, "reason", "no_device")
+			return
+		}
+		m.removeTree(ctx, imageID, req, resp.SHA256)
+	}
+}
+
+// removeTree deletes the extracted tree of a ready image. A digest-
+// addressed tree is shared by every image extracted from the same tarball
+// and subpath, so it is only removed when no other image references it,
+// counted while holding the tree's lock.
+func (m *Machine) removeTree(ctx context.Context, imageID int64, req *ImageRequest, digest string) {
+	s3Key := req.Key()
+	path := m.treePath(req, digest)
+	if m.layout.CachedTreePath(digest) != "" {
+		release, err := m.lockTree(ctx, req, digest)
+		if err != nil {
+			loggerFrom(ctx).Warn("extracted_tree_kept", "s3_key", s3Key, "path", path, "reason", "locked", "error", err)
+			return
+		}
+		defer release()
+		shared, err := m.repo.CountByTreeContext(ctx, digest, req.ExtractSubpath, imageID)
+		if err != nil {
+			loggerFrom(ctx).Warn("extracted_tree_kept", "s3_key", s3Key, "path", path, "reason", "count_failed", "error", err)
+			return
+		}
+		if shared > 0 {
+			loggerFrom(ctx).Info("extracted_tree_kept", "s3_key", s3Key, "path", path, "reason", "shared", "images", shared)
+			return
+		}
+	}
+	if err := RemoveCachedTree(path); err != nil {
+		loggerFrom(ctx).Warn("extracted_tree_remove_failed", "s3_key", s3Key, "path", path, "error", err)
+	} else {
+		loggerFrom(ctx).Info("extracted_tree_removed", "s3_key", s3Key, "path", path)
+	}
+}
+
+// compressDownload replaces an image's download with a zstd-compressed
+// copy and records the compression. The original is only removed once the
+// copy and the record are in place, so a failure leaves it usable.
+func (m *Machine) compressDownload(ctx context.Context, imageID int64, s3Key string, resp *ImageResponse) {
+	path := m.downloadPath(s3Key)
+	fi, err := os.Stat(path)
+	if err != nil || !fi.Mode().IsRegular() {
+		// Streamed images have no download to compress
+		return
+	}
+
+	compressed := storage.CompressedPath(path)
+	if err := storage.CompressFile(path, compressed); err != nil {
+		loggerFrom(ctx).Warn("download_compress_failed", "s3_key", s3Key, "path", path, "error", err)
+		return
+	}
+	if err := m.repo.SetDownloadCompressionContext(ctx, imageID, storage.CompressionZstd); err != nil {
+		loggerFrom(ctx).Warn("download_compress_failed", "s3_key", s3Key, "path", path, "error", err)
+		os.Remove(compressed)
+		return
+	}
+	if err := os.Remove(path); err != nil {
+		loggerFrom(ctx).Warn("download_remove_failed", "s3_key", s3Key, "path", path, "error", err)
+	}
+
+	var size int64
+	if cfi, err := os.Stat(compressed); err == nil {
+		size = cfi.Size()
+	}
+	loggerFrom(ctx).Info("download_compressed", "s3_key", s3Key, "path", compressed, "size", fi.Size(), "compressed_size", size)
+	resp.DownloadPath = compressed
+}
+
+// restoreDownload decompresses an image's compressed download back to the
+// download path, so it can be checked and reused like any other. The
+// compressed copy is dropped either way: if it can't be restored the image
+// is downloaded again.
+func (m *Machine) restoreDownload(ctx context.Context, img *db.Image) {
+	if img.DownloadCompression == "" {
+		return
+	}
+
+	path := m.downloadPath(img.S3Key)
+	compressed := storage.CompressedPath(path)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err := storage.DecompressFile(compressed, path); err != nil {
+			loggerFrom(ctx).Warn("download_decompress_failed", "s3_key", img.S3Key, "path", compressed, "error", err)
+		} else {
+			loggerFrom(ctx).Info("download_decompressed", "s3_key", img.S3Key, "path", path)
+		}
+	}
+
+	if err := os.Remove(compressed); err != nil && !os.IsNotExist(err) {
+		loggerFrom(ctx).Warn("download_remove_failed", "s3_key", img.S3Key, "path", compressed, "error", err)
+	}
+	if err := m.repo.SetDownloadCompressionContext(ctx, img.ID, ""); err != nil {
+		loggerFrom(ctx).Warn("download_compression_clear_failed", "s3_key", img.S3Key, "error", err)
+		return
+	}
+	img.DownloadCompression = ""
+}
+
+// checkImageSize refuses images over the per-image size limit or that
+// would overfill the host, marking the image failed. It runs before
+// anything is extracted.
+func (m *Machine) checkImageSize(ctx context.Context, s3Key string, imageID, size int64) error {
+	if err := m.validator.ValidateFileSize(size); err != nil {
+		loggerFrom(ctx).Error("file_size_validation_failed", "s3_key", s3Key, "size", size, "error", err)
+		m.repo.UpdateStatusContext(ctx, imageID, db.StatusFailed, err.Error())
+		return fsm.Abort(err)
+	}
+
+	if err := m.checkHostCapacity(ctx, size); err != nil {
+		if !errors.Is(err, ErrHostCapacityExceeded) {
+			return err
+		}
+		loggerFrom(ctx).Error("host_capacity_check_failed", "s3_key", s3Key, "error", err)
+		m.repo.UpdateStatusContext(ctx, imageID, db.StatusFailed, err.Error())
+		return fsm.Abort(err)
+	}
+	return nil
+}
+
+// recordTreeHash hashes the extracted tree and stores the digest on the
+// image when tree hashing is enabled
+func (m *Machine) recordTreeHash(ctx context.Context, s3Key string, resp *ImageResponse, dir string) error {
+	if !m.treeHash {
+		return nil
+	}
+
+	hash, err := TreeHash(dir)
+	if err != nil {
+		loggerFrom(ctx).Error("tree_hash_failed", "s3_key", s3Key, "error", err)
+		return err
+	}
+	if err := m.repo.SetTreeHashContext(ctx, resp.ImageID, hash); err != nil {
+		return err
+	}
+
+	loggerFrom(ctx).Info("tree_hash_recorded", "s3_key", s3Key, "tree_hash", hash)
+	resp.TreeHash = hash
+	return nil
+}
+
+// extractOptionsFor returns the extraction options for req, skipping the
+// compression-ratio check when its key has a trusted prefix
+func (m *Machine) extractOptionsFor(ctx context.Context, req *ImageRequest) devicemapper.ExtractOptions {
+	s3Key := req.Key()
+	opts := m.extractOptions
+	opts.Subpath = req.ExtractSubpath
+	for _, prefix := range m.trustedPrefixes {
+		if prefix != "" && strings.HasPrefix(s3Key, prefix) {
+			loggerFrom(ctx).Info("compression_ratio_check_skipped", "s3_key", s3Key, "trusted_prefix", prefix)
+			opts.SkipCompressionRatio = true
+			break
+		}
+	}
+	return opts
+}
+
+// checkRootfs warns when an extracted tree doesn't look like a rootfs, or
+// with requireRootfs marks the image failed. A cached tree is left in
+// place: other images with the same content may be built without the flag.
+func (m *Machine) checkRootfs(ctx context.Context, s3Key string, imageID int64, dir string) error {
+	err := checkRootfsLayout(dir)
+	if err == nil {
+		return nil
+	}
+	if !m.requireRootfs {
+		loggerFrom(ctx).Warn("rootfs_check_failed", "s3_key", s3Key, "extract_dir", dir, "error", err)
+		return nil
+	}
+	loggerFrom(ctx).Error("rootfs_check_failed", "s3_key", s3Key, "extract_dir", dir, "error", err)
+	m.repo.UpdateStatusContext(ctx, imageID, db.StatusFailed, err.Error())
+	return fsm.Abort(err)
+}
+
+// ErrInsufficientPoolSpace is returned when the thin pool cannot hold an image
+var ErrInsufficientPoolSpace = errors.New("insufficient pool space")
+
+// ErrHostCapacityExceeded is returned when an image would push the host
+// past its configured total extracted size
+var ErrHostCapacityExceeded = errors.New("host extracted size limit exceeded")
+
+// checkHostCapacity verifies that adding an image of size bytes keeps the
+// total of all ready images within maxHostExtractedSize
+func (m *Machine) checkHostCapacity(ctx context.Context, size int64) error {
+	if m.maxHostExtractedSize <= 0 {
+		return nil
+	}
+
+	used, err := m.repo.TotalDownloadedBytesContext(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to measure host usage")
+	}
+
+	loggerFrom(ctx).Info("host_capacity_check", "used_mb", used/1024/1024, "image_mb", size/1024/1024, "limit_mb", m.maxHostExtractedSize/1024/1024)
+
+	if used+size > m.maxHostExtractedSize {
+		return fmt.Errorf("%w: %d bytes in use + %d would exceed %d",
+			ErrHostCapacityExceeded, used, size, m.maxHostExtractedSize)
+	}
+	return nil
+}
+
+// recordExtractedSize sets resp.ExtractedSize for the tree at dir. When
+// fromValidator is set the tree was just extracted in-process and the
+// validator's running total is used; otherwise, or if the total is
+// unset, the tree is measured.
+func (m *Machine) recordExtractedSize(resp *ImageResponse, dir string, fromValidator bool) error {
+	var size int64
+	if fromValidator {
+		size = m.validator.GetCurrentTotalSize()
+	}
+	if size == 0 {
+		var err error
+		if size, err = dirSize(dir); err != nil {
+			return errors.Wrap(err, "failed to measure extracted size")
+		}
+	}
+	resp.ExtractedSize = size
+	return nil
+}
+
+// deviceSize returns the base device size for an image of extractedSize
+// bytes: the size plus deviceHeadroom of it and poolHeadroomBytes for
+// ext4. It returns 0, the default device size, without a headroom or a
+// known size.
+func (m *Machine) deviceSize(extractedSize int64) int64 {
+	if m.deviceHeadroom <= 0 || extractedSize <= 0 {
+		return 0
+	}
+	return extractedSize + int64(float64(extractedSize)*m.deviceHeadroom) + poolHeadroomBytes
+}
+
+// poolHeadroomBytes is reserved on top of the extracted size for ext4
+// metadata and journal written by mkfs
+const poolHeadroomBytes = 64 * 1024 * 1024
+
+// checkPoolSpace verifies the thin pool the image's device will go to has
+// enough free data space for an extracted tree of size bytes plus
+// headroom. Platforms without devicemapper skip the check.
+func (m *Machine) checkPoolSpace(ctx context.Context, size int64) error {
+	status, err := m.dmManager.PoolStatusFor(ctx, m.deviceSize(size))
+	if err != nil {
+		if strings.Contains(err.Error(), "not supported") {
+			return nil
+		}
+		return errors.Wrap(err, "failed to read pool status")
+	}
+
+	needed := size + size/10 + poolHeadroomBytes
+	free := status.FreeDataBytes()
+	loggerFrom(ctx).Info("pool_space_check", "extracted_mb", size/1024/1024, "needed_mb", needed/1024/1024, "free_mb", free/1024/1024)
+
+	if needed > free {
+		return fmt.Errorf("%w: need %d bytes, %d free", ErrInsufficientPoolSpace, needed, free)
+	}
+	return nil
+}
+
+// dirSize returns the total size of regular files under a directory
+func dirSize(root string) (int64, error) {
+	var total int64
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total, err
+}
+
+// downloadPath returns the local path an S3 key is downloaded to
+func (m *Machine) downloadPath(s3Key string) string {
+	return m.layout.DownloadPath(s3Key)
+}
+
+// extractPath returns the local directory an S3 key is extracted into
+func (m *Machine) extractPath(s3Key string) string {
+	return m.layout.ExtractPath(s3Key)
+}
+
+// downloadIsCurrent reports whether the local download of an image still
+// matches the S3 object, returning its size. The stored ETag is compared
+// against a fresh HeadObject; images without an ETag fall back to
+// comparing the stored digest against the local file, as do multipart
+// ETags, which match only if the object was split the same way and so
+// aren't trusted alone.
+func (m *Machine) downloadIsCurrent(ctx context.Context, req *ImageRequest, img *db.Image) (int64, bool) {
+	localPath := m.downloadPath(img.S3Key)
+	fi, err := os.Stat(localPath)
+	if err != nil || !fi.Mode().IsRegular() {
+		return 0, false
+	}
+
+	if img.ETag != "" {
+		source, err := m.sourceFor(req)
+		if err != nil {
+			return 0, false
+		}
+		info, err := source.Head(ctx, img.S3Key)
+		if err != nil {
+			loggerFrom(ctx).Warn("etag_check_failed", "s3_key", img.S3Key, "error", err)
+			return 0, false
+		}
+		// A matching ETag says nothing about a download cut short
+		match, verify := storage.CompareETags(img.ETag, info.ETag, m.trustMultipartETags)
+		if !match || info.Size != fi.Size() {
+			return 0, false
+		}
+		if !verify {
+			return fi.Size(), true
+		}
+		loggerFrom(ctx).Info("etag_multipart_verify", "s3_key", img.S3Key, "etag", img.ETag)
+	}
+
+	if img.SHA256 == "" {
+		return 0, false
+	}
+	algorithm, hexDigest := storage.ParseDigest(img.SHA256)
+	digest, err := storage.FileDigest(localPath, algorithm)
+	if err != nil {
+		loggerFrom(ctx).Warn("digest_check_failed", "path", localPath, "algorithm", algorithm, "error", err)
+		return 0, false
+	}
+	return fi.Size(), digest == storage.FormatDigest(algorithm, hexDigest)
+}
+
 func copyDir(src, dst string) error {
 	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
@@ -432,7 +1326,6 @@ func copyDir(src, dst string) error {
 		}
 		defer dstFile.Close()
 
-		_, err = io.Copy(dstFile, srcFile)
-		return err
+		return copyFileData(dstFile, srcFile, info.Size())
 	})
 }
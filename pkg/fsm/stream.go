@@ -0,0 +1,144 @@
+package fsm
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/fly-io/162719/pkg/db"
+	"github.com/fly-io/162719/pkg/devicemapper"
+	"github.com/fly-io/162719/pkg/errors"
+	"github.com/fly-io/162719/pkg/storage"
+	"github.com/superfly/fsm"
+)
+
+// streamer returns source as a Streamer when streaming extraction is
+// enabled and the source supports it
+func (m *Machine) streamer(source storage.Source) (storage.Streamer, bool) {
+	if !m.streamExtract {
+		return nil, false
+	}
+	streamer, ok := source.(storage.Streamer)
+	return streamer, ok
+}
+
+// streamDownload extracts the object as it arrives, hashing it on the way,
+// so the image is read once and never written to disk as a tarball. The
+// tree is built under the per-key path, since the digest is only known at
+// the end, then moved to its digest-addressed path.
+func (m *Machine) streamDownload(ctx context.Context, req *fsm.Request[ImageRequest, ImageResponse], streamer storage.Streamer) (*fsm.Response[ImageResponse], error) {
+	resp := req.W.Msg
+	s3Key := req.Msg.Key()
+
+	var obj *storage.Object
+	err := m.breaker.Do(ctx, func() error {
+		var err error
+		obj, err = streamer.Open(ctx, s3Key)
+		return err
+	})
+	if err != nil {
+		loggerFrom(ctx).Error("download_failed", "s3_key", s3Key, "error", err)
+		if errors.Is(err, storage.ErrNotFound) || errors.Is(err, storage.ErrAccessDenied) {
+			m.repo.UpdateStatusContext(ctx, resp.ImageID, db.StatusFailed, err.Error())
+			return nil, fsm.Abort(errors.Wrap(err, "failed to open object"))
+		}
+		return nil, errors.Wrap(err, "failed to open object")
+	}
+	defer obj.Close()
+
+	if err := m.checkImageSize(ctx, s3Key, resp.ImageID, obj.Info.Size); err != nil {
+		return nil, err
+	}
+
+	stagingDir := m.extractPath(s3Key)
+	loggerFrom(ctx).Info("stream_extraction_started", "s3_key", s3Key, "extract_dir", stagingDir, "size_mb", obj.Info.Size/1024/1024)
+
+	// Read errors come from the network and are worth retrying; anything
+	// else is a bad archive
+	body := &readErrTracker{r: obj}
+	err = devicemapper.BuildDirAtomic(stagingDir, func(tmpDir string) error {
+		return devicemapper.ExtractStream(body, tmpDir, m.validator, m.extractOptionsFor(ctx, req.Msg))
+	})
+	if err != nil {
+		if body.err != nil {
+			loggerFrom(ctx).Warn("stream_interrupted", "s3_key", s3Key, "error", err)
+			return nil, errors.Wrap(err, "download stream interrupted")
+		}
+		loggerFrom(ctx).Error("extraction_failed", "s3_key", s3Key, "error", err, "disk_full", errors.Is(err, devicemapper.ErrDiskFull))
+		m.repo.UpdateStatusContext(ctx, resp.ImageID, db.StatusFailed, err.Error())
+		return nil, fsm.Abort(errors.Wrap(err, "tar extraction failed"))
+	}
+
+	digest, err := obj.Digest()
+	if err != nil {
+		os.RemoveAll(stagingDir)
+		return nil, errors.Wrap(err, "stream digest failed")
+	}
+
+	extractDir := m.treePath(req.Msg, digest)
+	if extractDir != stagingDir {
+		release, err := m.lockTree(ctx, req.Msg, digest)
+		if err != nil {
+			os.RemoveAll(stagingDir)
+			return nil, err
+		}
+		err = promoteTree(stagingDir, extractDir)
+		release()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	loggerFrom(ctx).Info("stream_extraction_complete", "s3_key", s3Key, "extract_dir", extractDir, "size_mb", obj.Size()/1024/1024, "digest", digest)
+
+	info := obj.Info
+	info.Size = obj.Size()
+	if err := m.recordDownload(ctx, s3Key, digest, info); err != nil {
+		return nil, err
+	}
+
+	resp.SHA256 = digest
+	resp.DownloadPath = ""
+	resp.DownloadSize = info.Size
+	resp.ExtractedPath = extractDir
+	resp.Streamed = true
+
+	return fsm.NewResponse(resp), nil
+}
+
+// promoteTree moves a freshly extracted tree to its digest-addressed path.
+// If a complete tree with the same content is already there it is kept
+// and the new one discarded.
+func promoteTree(stagingDir, extractDir string) error {
+	if treeComplete(extractDir) {
+		return os.RemoveAll(stagingDir)
+	}
+	if err := os.Remove(extractDir + completeSuffix); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to clear stale completion marker")
+	}
+	if err := os.RemoveAll(extractDir); err != nil {
+		return errors.Wrap(err, "failed to remove partial tree")
+	}
+	if err := os.MkdirAll(filepath.Dir(extractDir), 0755); err != nil {
+		return errors.Wrap(err, "failed to create tree cache dir")
+	}
+	if err := os.Rename(stagingDir, extractDir); err != nil {
+		return errors.Wrap(err, "failed to move extracted tree into place")
+	}
+	return nil
+}
+
+// readErrTracker remembers the first read error other than EOF
+type readErrTracker struct {
+	r   io.Reader
+	err error
+}
+
+func (t *readErrTracker) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if err != nil && err != io.EOF && t.err == nil {
+		t.err = err
+	}
+	return n, err
+}
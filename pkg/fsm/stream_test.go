@@ -0,0 +1,90 @@
+package fsm
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fly-io/162719/pkg/db"
+	"github.com/fly-io/162719/pkg/security"
+	"github.com/fly-io/162719/pkg/storage"
+	"github.com/superfly/fsm"
+)
+
+func TestStreamingExtract_NoTarballOnDisk(t *testing.T) {
+	dbPath := "/tmp/test_images_stream.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	repo, err := db.NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	sourceDir := t.TempDir()
+	writeTestTar(t, filepath.Join(sourceDir, "alpine.tar"), map[string]string{"etc/hostname": "streamed"})
+	data, err := os.ReadFile(filepath.Join(sourceDir, "alpine.tar"))
+	if err != nil {
+		t.Fatalf("read tar: %v", err)
+	}
+	sum := sha256.Sum256(data)
+	wantDigest := storage.FormatDigest("sha256", hex.EncodeToString(sum[:]))
+
+	source, err := storage.NewLocalSource(sourceDir, storage.ClientOptions{})
+	if err != nil {
+		t.Fatalf("local source: %v", err)
+	}
+
+	img := &db.Image{S3Key: "alpine.tar", Status: db.StatusPending}
+	if err := repo.Create(img); err != nil {
+		t.Fatalf("failed to create image: %v", err)
+	}
+
+	workDir := t.TempDir()
+	validator := security.NewValidator(1024*1024, 10*1024*1024, 1000.0)
+	m := NewMachine(repo, source, validator, nil, workDir, 5, WithStreamingExtract())
+
+	resp := &ImageResponse{ImageID: img.ID}
+	req := fsm.NewRequest(&ImageRequest{S3Key: img.S3Key}, resp)
+	ctx := context.Background()
+
+	if _, err := m.handleDownload(ctx, req); err != nil {
+		t.Fatalf("handleDownload failed: %v", err)
+	}
+	if _, err := m.handleValidate(ctx, req); err != nil {
+		t.Fatalf("handleValidate failed: %v", err)
+	}
+
+	if resp.SHA256 != wantDigest {
+		t.Errorf("digest = %s, want %s", resp.SHA256, wantDigest)
+	}
+	if resp.DownloadSize != int64(len(data)) {
+		t.Errorf("download size = %d, want %d", resp.DownloadSize, len(data))
+	}
+	if _, err := os.Stat(m.downloadPath(img.S3Key)); !os.IsNotExist(err) {
+		t.Errorf("tarball written to disk while streaming: %v", err)
+	}
+
+	treeDir := NewLayout(workDir, "").CachedTreePath(wantDigest)
+	if resp.ExtractedPath != treeDir {
+		t.Errorf("ExtractedPath = %q, want %q", resp.ExtractedPath, treeDir)
+	}
+	if !treeComplete(treeDir) {
+		t.Error("streamed tree not marked complete")
+	}
+	if got, err := os.ReadFile(filepath.Join(treeDir, "etc/hostname")); err != nil || string(got) != "streamed" {
+		t.Errorf("etc/hostname = %q, %v; want streamed", got, err)
+	}
+	if _, err := os.Stat(m.extractPath(img.S3Key)); !os.IsNotExist(err) {
+		t.Errorf("staging tree left behind: %v", err)
+	}
+
+	got, _ := repo.GetByS3Key(img.S3Key)
+	if got.SHA256 != wantDigest || got.DownloadSize != int64(len(data)) {
+		t.Errorf("recorded digest %s size %d, want %s size %d", got.SHA256, got.DownloadSize, wantDigest, len(data))
+	}
+}
@@ -0,0 +1,105 @@
+package fsm
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/superfly/fsm"
+)
+
+// Trace accumulates the wall-clock time spent in each state of a run.
+// Retried states add up, with each attempt counted.
+type Trace struct {
+	mu     sync.Mutex
+	order  []string
+	states map[string]*stateTiming
+}
+
+type stateTiming struct {
+	total    time.Duration
+	attempts int
+}
+
+// NewTrace creates an empty trace
+func NewTrace() *Trace {
+	return &Trace{states: make(map[string]*stateTiming)}
+}
+
+// WithTrace records the duration of every state handler in trace
+func WithTrace(trace *Trace) Option {
+	return func(m *Machine) {
+		m.trace = trace
+	}
+}
+
+func (t *Trace) record(state string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	timing, ok := t.states[state]
+	if !ok {
+		timing = &stateTiming{}
+		t.states[state] = timing
+		t.order = append(t.order, state)
+	}
+	timing.total += d
+	timing.attempts++
+}
+
+// Duration returns the total time spent in state
+func (t *Trace) Duration(state string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if timing, ok := t.states[state]; ok {
+		return timing.total
+	}
+	return 0
+}
+
+// Write prints one line per state in the order they first ran, then the
+// total. Nothing is printed for an empty trace.
+func (t *Trace) Write(w io.Writer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.order) == 0 {
+		return
+	}
+	var total time.Duration
+	fmt.Fprintln(w, "⏱️  State timings:")
+	for _, state := range t.order {
+		timing := t.states[state]
+		total += timing.total
+		line := fmt.Sprintf("   %-14s %10s", state, roundDuration(timing.total))
+		if timing.attempts > 1 {
+			line += fmt.Sprintf("  (%d attempts)", timing.attempts)
+		}
+		fmt.Fprintln(w, line)
+	}
+	fmt.Fprintf(w, "   %-14s %10s\n", "total", roundDuration(total))
+}
+
+// roundDuration keeps trace lines readable: milliseconds under a minute,
+// seconds beyond
+func roundDuration(d time.Duration) time.Duration {
+	if d < time.Minute {
+		return d.Round(time.Millisecond)
+	}
+	return d.Round(time.Second)
+}
+
+// withTrace wraps a state handler to record its duration
+func (m *Machine) withTrace(state string, handler transitionFunc) transitionFunc {
+	if m.trace == nil {
+		return handler
+	}
+	return func(ctx context.Context, req *fsm.Request[ImageRequest, ImageResponse]) (*fsm.Response[ImageResponse], error) {
+		start := m.clock.Now()
+		resp, err := handler(ctx, req)
+		m.trace.record(state, m.clock.Now().Sub(start))
+		return resp, err
+	}
+}
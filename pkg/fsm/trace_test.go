@@ -0,0 +1,91 @@
+package fsm
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fly-io/162719/pkg/db"
+	"github.com/fly-io/162719/pkg/security"
+	"github.com/fly-io/162719/pkg/storage"
+	"github.com/superfly/fsm"
+)
+
+func TestTrace_RecordsEveryStateOfFullRun(t *testing.T) {
+	dbPath := "/tmp/test_images_trace.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	repo, err := db.NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	sourceDir := t.TempDir()
+	writeTestTar(t, filepath.Join(sourceDir, "alpine.tar"), map[string]string{"etc/hostname": "alpine", "bin/sh": "#!shell"})
+	source, err := storage.NewLocalSource(sourceDir, storage.ClientOptions{HashAlgorithm: "sha256"})
+	if err != nil {
+		t.Fatalf("local source: %v", err)
+	}
+
+	trace := NewTrace()
+	validator := security.NewValidator(1<<20, 1<<30, 1000)
+	m := NewMachine(repo, source, validator, nil, t.TempDir(), 5, WithTrace(trace))
+
+	ctx := context.Background()
+	manager, err := fsm.New(fsm.Config{DBPath: filepath.Join(t.TempDir(), "fsm.db")})
+	if err != nil {
+		t.Fatalf("fsm manager: %v", err)
+	}
+	defer manager.Shutdown(time.Second)
+
+	start, _, err := m.Register(ctx, manager)
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	version, err := start(ctx, "alpine.tar", fsm.NewRequest(&ImageRequest{S3Key: "alpine.tar"}, &ImageResponse{}))
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	if err := manager.Wait(ctx, version); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+
+	var out bytes.Buffer
+	trace.Write(&out)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+
+	states := []string{StateCheckDB, StateDownload, StateValidate, StateCreateDevice, StateScan, StateComplete}
+	// A header, one line per state in run order, then the total
+	if len(lines) != len(states)+2 {
+		t.Fatalf("trace output has %d lines, want %d:\n%s", len(lines), len(states)+2, out.String())
+	}
+	for i, state := range states {
+		if fields := strings.Fields(lines[i+1]); len(fields) < 2 || fields[0] != state {
+			t.Errorf("trace line %d = %q, want state %s", i+1, lines[i+1], state)
+		}
+	}
+	if !strings.HasPrefix(strings.TrimSpace(lines[len(lines)-1]), "total") {
+		t.Errorf("last trace line = %q, want total", lines[len(lines)-1])
+	}
+}
+
+func TestTrace_AccumulatesRetries(t *testing.T) {
+	trace := NewTrace()
+	trace.record(StateDownload, 2*time.Second)
+	trace.record(StateDownload, 3*time.Second)
+
+	if got := trace.Duration(StateDownload); got != 5*time.Second {
+		t.Errorf("Duration = %s, want 5s", got)
+	}
+	var out bytes.Buffer
+	trace.Write(&out)
+	if !strings.Contains(out.String(), "(2 attempts)") {
+		t.Errorf("trace output doesn't count attempts:\n%s", out.String())
+	}
+}
@@ -0,0 +1,128 @@
+package fsm
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fly-io/162719/pkg/db"
+	"github.com/fly-io/162719/pkg/errors"
+	"github.com/superfly/fsm"
+)
+
+// TreeCacheDir holds extracted trees addressed by content digest, so images
+// with identical tarballs (even under different keys) share one extraction
+const TreeCacheDir = "by-sha"
+
+// completeSuffix names the marker written next to a cached tree once it is
+// fully extracted; a tree without one is never reused
+const completeSuffix = ".complete"
+
+// SubpathTreeSeparator joins a tree's directory name and the subpath it
+// was extracted from
+const SubpathTreeSeparator = "@"
+
+// treePath returns where the tree of req's image with digest lives (see
+// Layout.TreePath)
+func (m *Machine) treePath(req *ImageRequest, digest string) string {
+	return m.layout.TreePath(req.Key(), digest, req.ExtractSubpath)
+}
+
+// treeLockPoll is how often a run waiting for a tree's lock retries it
+const treeLockPoll = 200 * time.Millisecond
+
+// lockTree takes the lock of the digest-addressed tree req's image with
+// digest shares, waiting while another run holds it, and returns its
+// release. Shared trees are only built, replaced, read from or removed
+// under it. Per-key trees, and repos without locks, need none.
+func (m *Machine) lockTree(ctx context.Context, req *ImageRequest, digest string) (func(), error) {
+	locker, ok := m.repo.(treeLocker)
+	if !ok || m.layout.CachedTreePath(digest) == "" {
+		return func() {}, nil
+	}
+
+	key := "tree:" + filepath.Base(m.treePath(req, digest))
+	for waited := false; ; waited = true {
+		lock, err := locker.AcquireLock(ctx, key, db.DefaultLockStaleAfter)
+		if err == nil {
+			// Released even when the run's context has ended
+			return func() { lock.Release(context.WithoutCancel(ctx)) }, nil
+		}
+		if !errors.Is(err, db.ErrLockHeld) {
+			return nil, errors.Wrap(err, "failed to lock extracted tree")
+		}
+		if !waited {
+			loggerFrom(ctx).Info("tree_lock_wait", "s3_key", req.Key(), "key", key, "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(treeLockPoll):
+		}
+	}
+}
+
+// withTreeLock wraps the validate and create_device handlers so they run
+// under the lock of the tree they extract or copy from (see lockTree).
+// Quarantine runs inside it, so a failed tree is moved before another run
+// can reuse it.
+func (m *Machine) withTreeLock(state string, handler transitionFunc) transitionFunc {
+	if state != StateValidate && state != StateCreateDevice {
+		return handler
+	}
+	return func(ctx context.Context, req *fsm.Request[ImageRequest, ImageResponse]) (*fsm.Response[ImageResponse], error) {
+		msg := req.W.Msg
+		if msg == nil {
+			return handler(ctx, req)
+		}
+		release, err := m.lockTree(ctx, req.Msg, msg.SHA256)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+		return handler(ctx, req)
+	}
+}
+
+// treeComplete reports whether dir holds a fully extracted tree
+func treeComplete(dir string) bool {
+	if _, err := os.Stat(dir + completeSuffix); err != nil {
+		return false
+	}
+	fi, err := os.Stat(dir)
+	return err == nil && fi.IsDir()
+}
+
+// markTreeComplete atomically writes the completion marker for dir
+func markTreeComplete(dir string) error {
+	marker := dir + completeSuffix
+	f, err := os.CreateTemp(filepath.Dir(dir), "."+filepath.Base(marker)+".tmp-")
+	if err != nil {
+		return errors.Wrap(err, "failed to create completion marker")
+	}
+	tmp := f.Name()
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return errors.Wrap(err, "failed to sync completion marker")
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "failed to close completion marker")
+	}
+	if err := os.Rename(tmp, marker); err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "failed to commit completion marker")
+	}
+	return nil
+}
+
+// RemoveCachedTree deletes an extracted tree, dropping its completion marker
+// first so a partial removal is never mistaken for a reusable tree
+func RemoveCachedTree(dir string) error {
+	if err := os.Remove(dir + completeSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
@@ -0,0 +1,246 @@
+package fsm
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fly-io/162719/pkg/db"
+	"github.com/fly-io/162719/pkg/security"
+	"github.com/superfly/fsm"
+)
+
+func writeTestTar(t *testing.T, path string, files map[string]string) {
+	t.Helper()
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("create tar: %v", err)
+	}
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+	for name, body := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(body)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatalf("write header: %v", err)
+		}
+		if _, err := tw.Write([]byte(body)); err != nil {
+			t.Fatalf("write body: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close tar: %v", err)
+	}
+}
+
+func TestHandleValidate_ReusesCachedTree(t *testing.T) {
+	dbPath := "/tmp/test_images_treecache.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	repo, err := db.NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	workDir := t.TempDir()
+	validator := security.NewValidator(1024*1024, 10*1024*1024, 1000.0)
+	m := NewMachine(repo, nil, validator, nil, workDir, 5)
+
+	tarPath := filepath.Join(workDir, "image.tar")
+	writeTestTar(t, tarPath, map[string]string{"etc/hostname": "cached"})
+	digest := "sha256:" + strings.Repeat("ab", 32)
+
+	first := fsm.NewRequest(&ImageRequest{S3Key: "images/a.tar"}, &ImageResponse{SHA256: digest, DownloadPath: tarPath, DownloadSize: 1024})
+	resp, err := m.handleValidate(context.Background(), first)
+	if err != nil {
+		t.Fatalf("first handleValidate failed: %v", err)
+	}
+	treeDir := NewLayout(workDir, "").CachedTreePath(digest)
+	if resp.Msg.ExtractedPath != treeDir {
+		t.Fatalf("ExtractedPath = %q, want %q", resp.Msg.ExtractedPath, treeDir)
+	}
+	if !treeComplete(treeDir) {
+		t.Fatal("expected completion marker after extraction")
+	}
+
+	// Same content under another key: the tarball is never opened, so a
+	// missing download must not matter
+	second := fsm.NewRequest(&ImageRequest{S3Key: "images/b.tar"}, &ImageResponse{SHA256: digest, DownloadPath: filepath.Join(workDir, "missing.tar"), DownloadSize: 1024})
+	resp, err = m.handleValidate(context.Background(), second)
+	if err != nil {
+		t.Fatalf("second handleValidate should reuse the cached tree: %v", err)
+	}
+	if resp.Msg.ExtractedPath != treeDir {
+		t.Errorf("ExtractedPath = %q, want %q", resp.Msg.ExtractedPath, treeDir)
+	}
+	if got, err := os.ReadFile(filepath.Join(treeDir, "etc/hostname")); err != nil || string(got) != "cached" {
+		t.Errorf("etc/hostname = %q, %v; want cached content", got, err)
+	}
+
+	// Without the marker the tree is treated as partial and rebuilt
+	if err := os.Remove(treeDir + completeSuffix); err != nil {
+		t.Fatalf("remove marker: %v", err)
+	}
+	writeTestTar(t, tarPath, map[string]string{"etc/hostname": "rebuilt"})
+	third := fsm.NewRequest(&ImageRequest{S3Key: "images/c.tar"}, &ImageResponse{SHA256: digest, DownloadPath: tarPath, DownloadSize: 1024})
+	if _, err := m.handleValidate(context.Background(), third); err != nil {
+		t.Fatalf("third handleValidate failed: %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(treeDir, "etc/hostname")); string(got) != "rebuilt" {
+		t.Errorf("etc/hostname = %q, want tree re-extracted", got)
+	}
+}
+
+func TestHandleValidate_RechecksCachedTree(t *testing.T) {
+	dbPath := "/tmp/test_images_treecache_recheck.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	repo, err := db.NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	ctx := context.Background()
+	workDir := t.TempDir()
+	validator := security.NewValidator(1024*1024, 10*1024*1024, 10.0)
+	m := NewMachine(repo, nil, validator, nil, workDir, 5, WithTrustedPrefixes("trusted/"))
+
+	// Highly compressible, so only a trusted key passes the ratio check
+	tarPath := filepath.Join(workDir, "image.tar")
+	writeTestTar(t, tarPath, map[string]string{"etc/hostname": strings.Repeat("x", 64*1024)})
+	digest := "sha256:" + strings.Repeat("ef", 32)
+
+	trusted := &db.Image{S3Key: "trusted/a.tar", SHA256: digest, Status: db.StatusDownloading}
+	untrusted := &db.Image{S3Key: "images/a.tar", SHA256: digest, Status: db.StatusDownloading}
+	for _, img := range []*db.Image{trusted, untrusted} {
+		if err := repo.CreateContext(ctx, img); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first := fsm.NewRequest(&ImageRequest{S3Key: trusted.S3Key}, &ImageResponse{ImageID: trusted.ID, SHA256: digest, DownloadPath: tarPath, DownloadSize: 1024})
+	if _, err := m.handleValidate(ctx, first); err != nil {
+		t.Fatalf("trusted handleValidate failed: %v", err)
+	}
+	treeDir := m.layout.CachedTreePath(digest)
+	if !treeComplete(treeDir) {
+		t.Fatal("expected completion marker after extraction")
+	}
+
+	second := fsm.NewRequest(&ImageRequest{S3Key: untrusted.S3Key}, &ImageResponse{ImageID: untrusted.ID, SHA256: digest, DownloadPath: tarPath, DownloadSize: 1024})
+	if _, err := m.handleValidate(ctx, second); !errors.Is(err, security.ErrRejected) {
+		t.Fatalf("untrusted key reused the cached tree (err %v), want it rejected", err)
+	}
+	got, err := repo.GetByS3KeyContext(ctx, untrusted.S3Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != db.StatusFailed {
+		t.Errorf("untrusted image is %s, want failed", got.Status)
+	}
+	if !treeComplete(treeDir) {
+		t.Error("cached tree removed for the trusted key")
+	}
+}
+
+func TestHandleValidate_WaitsForTreeLock(t *testing.T) {
+	dbPath := "/tmp/test_images_treelock.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	repo, err := db.NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	ctx := context.Background()
+	workDir := t.TempDir()
+	m := NewMachine(repo, nil, security.NewValidator(1024*1024, 10*1024*1024, 1000.0), nil, workDir, 5)
+
+	tarPath := filepath.Join(workDir, "image.tar")
+	writeTestTar(t, tarPath, map[string]string{"etc/hostname": "locked"})
+	digest := "sha256:" + strings.Repeat("cd", 32)
+	treeDir := m.layout.CachedTreePath(digest)
+
+	// Another run holds the tree, e.g. while removing or copying it
+	lock, err := repo.AcquireLock(ctx, "tree:"+filepath.Base(treeDir), db.DefaultLockStaleAfter)
+	if err != nil {
+		t.Fatalf("acquire tree lock: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		req := fsm.NewRequest(&ImageRequest{S3Key: "images/a.tar"}, &ImageResponse{SHA256: digest, DownloadPath: tarPath, DownloadSize: 1024})
+		_, err := m.handler(StateValidate, m.handleValidate)(ctx, req)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("validate ran under another run's tree lock (err %v)", err)
+	case <-time.After(3 * treeLockPoll):
+	}
+	if _, err := os.Stat(treeDir); !os.IsNotExist(err) {
+		t.Errorf("tree built under another run's lock (%v)", err)
+	}
+
+	if err := lock.Release(ctx); err != nil {
+		t.Fatalf("release tree lock: %v", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("validate failed after the lock was released: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("validate still waiting after the lock was released")
+	}
+	if !treeComplete(treeDir) {
+		t.Error("expected completion marker after extraction")
+	}
+}
+
+func TestCachedTreePath(t *testing.T) {
+	hexDigest := strings.Repeat("0f", 32)
+	tests := []struct {
+		digest string
+		want   string
+	}{
+		{digest: "sha256:" + hexDigest, want: filepath.Join("/work", "extracted", TreeCacheDir, hexDigest)},
+		{digest: hexDigest, want: filepath.Join("/work", "extracted", TreeCacheDir, hexDigest)},
+		{digest: "sha512:" + hexDigest, want: filepath.Join("/work", "extracted", TreeCacheDir, "sha512-"+hexDigest)},
+		{digest: "", want: ""},
+		{digest: "sha256:../../etc", want: ""},
+	}
+
+	for _, tt := range tests {
+		if got := NewLayout("/work", "").CachedTreePath(tt.digest); got != tt.want {
+			t.Errorf("CachedTreePath(%q) = %q, want %q", tt.digest, got, tt.want)
+		}
+	}
+}
+
+func TestTreePath_SubpathSpellingsShareATree(t *testing.T) {
+	layout := NewLayout("/work", "")
+	digest := "sha256:" + strings.Repeat("0f", 32)
+
+	want := layout.TreePath("app.tar", digest, "a/b")
+	if want == layout.TreePath("app.tar", digest, "") {
+		t.Fatal("subpath tree shares the whole archive's directory")
+	}
+	for _, subpath := range []string{"./a/b/", "a//b", "a/c/../b"} {
+		if got := layout.TreePath("app.tar", digest, subpath); got != want {
+			t.Errorf("TreePath(%q) = %q, want %q", subpath, got, want)
+		}
+	}
+}
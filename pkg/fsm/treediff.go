@@ -0,0 +1,80 @@
+package fsm
+
+import (
+	"sort"
+
+	"github.com/fly-io/162719/pkg/errors"
+)
+
+// Kinds of TreeChange
+const (
+	ChangeAdded   = "added"
+	ChangeRemoved = "removed"
+	ChangeChanged = "changed"
+)
+
+// TreeChange is one path that differs between two trees
+type TreeChange struct {
+	Path string
+	Kind string // ChangeAdded, ChangeRemoved or ChangeChanged
+	// SizeDelta is the change in regular-file bytes at Path
+	SizeDelta int64
+}
+
+// TreeDiff is the difference between two trees, in path order
+type TreeDiff struct {
+	Changes                 []TreeChange
+	Added, Removed, Changed int
+	// SizeDelta is the change in total regular-file bytes
+	SizeDelta int64
+}
+
+// DiffTrees compares the trees under a and b by the same attributes
+// TreeHash covers: an entry changes when its type, permission bits, file
+// content or symlink target differ.
+func DiffTrees(a, b string) (*TreeDiff, error) {
+	before := make(map[string]treeEntry)
+	if err := walkTree(a, func(rel string, e treeEntry) error {
+		before[rel] = e
+		return nil
+	}); err != nil {
+		return nil, errors.Wrap(err, "failed to walk tree")
+	}
+
+	diff := &TreeDiff{}
+	add := func(c TreeChange) {
+		diff.Changes = append(diff.Changes, c)
+		diff.SizeDelta += c.SizeDelta
+		switch c.Kind {
+		case ChangeAdded:
+			diff.Added++
+		case ChangeRemoved:
+			diff.Removed++
+		case ChangeChanged:
+			diff.Changed++
+		}
+	}
+
+	err := walkTree(b, func(rel string, e treeEntry) error {
+		old, ok := before[rel]
+		delete(before, rel)
+		switch {
+		case !ok:
+			add(TreeChange{Path: rel, Kind: ChangeAdded, SizeDelta: e.Size})
+		case old != e:
+			add(TreeChange{Path: rel, Kind: ChangeChanged, SizeDelta: e.Size - old.Size})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to walk tree")
+	}
+	for rel, e := range before {
+		add(TreeChange{Path: rel, Kind: ChangeRemoved, SizeDelta: -e.Size})
+	}
+
+	sort.Slice(diff.Changes, func(i, j int) bool {
+		return diff.Changes[i].Path < diff.Changes[j].Path
+	})
+	return diff, nil
+}
@@ -0,0 +1,61 @@
+package fsm
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDiffTrees(t *testing.T) {
+	a, b := t.TempDir(), t.TempDir()
+	writeTree(t, a, []string{"etc/hostname", "etc/motd", "bin/sh", "usr/lib/libc"}, map[string]string{
+		"etc/hostname": "alpine",
+		"etc/motd":     "welcome",
+		"bin/sh":       "#!shell",
+		"usr/lib/libc": "libc",
+	})
+	writeTree(t, b, []string{"etc/hostname", "bin/sh", "usr/lib/libc", "usr/lib/libssl"}, map[string]string{
+		"etc/hostname":   "alpine-edge",
+		"bin/sh":         "#!shell",
+		"usr/lib/libc":   "libc",
+		"usr/lib/libssl": "libssl",
+	})
+	// Same content, different mode
+	if err := os.Chmod(filepath.Join(b, "bin/sh"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// A symlink retargeted
+	os.Symlink("/bin/sh", filepath.Join(a, "bin/ash"))
+	os.Symlink("/bin/busybox", filepath.Join(b, "bin/ash"))
+
+	diff, err := DiffTrees(a, b)
+	if err != nil {
+		t.Fatalf("DiffTrees: %v", err)
+	}
+
+	want := []TreeChange{
+		{Path: "bin/ash", Kind: ChangeChanged},
+		{Path: "bin/sh", Kind: ChangeChanged},
+		{Path: "etc/hostname", Kind: ChangeChanged, SizeDelta: 5},
+		{Path: "etc/motd", Kind: ChangeRemoved, SizeDelta: -7},
+		{Path: "usr/lib/libssl", Kind: ChangeAdded, SizeDelta: 6},
+	}
+	if !reflect.DeepEqual(diff.Changes, want) {
+		t.Errorf("changes = %+v, want %+v", diff.Changes, want)
+	}
+	if diff.Added != 1 || diff.Removed != 1 || diff.Changed != 3 {
+		t.Errorf("counts = %d added, %d removed, %d changed; want 1, 1, 3", diff.Added, diff.Removed, diff.Changed)
+	}
+	if diff.SizeDelta != 4 {
+		t.Errorf("SizeDelta = %d, want 4", diff.SizeDelta)
+	}
+
+	same, err := DiffTrees(a, a)
+	if err != nil {
+		t.Fatalf("DiffTrees: %v", err)
+	}
+	if len(same.Changes) != 0 {
+		t.Errorf("tree differs from itself: %+v", same.Changes)
+	}
+}
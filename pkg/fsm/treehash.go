@@ -0,0 +1,104 @@
+package fsm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/fly-io/162719/pkg/errors"
+	"github.com/fly-io/162719/pkg/storage"
+)
+
+// TreeHash returns a digest of the directory tree under root: every
+// entry's relative path, type and permission bits, plus the SHA256 of each
+// regular file's content and each symlink's target. Entries are visited in
+// lexical path order, so the result doesn't depend on readdir order;
+// timestamps and ownership are left out, so re-extracting the same archive
+// hashes the same.
+func TreeHash(root string) (string, error) {
+	tree := sha256.New()
+
+	err := walkTree(root, func(rel string, e treeEntry) error {
+		// NUL-separated fields can't run into each other: paths and link
+		// targets never contain NUL
+		fmt.Fprintf(tree, "%s\x00%s\x00%o\x00%s\x00", rel, e.Kind, e.Perm, e.Data)
+		return nil
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "failed to hash tree")
+	}
+
+	return storage.FormatDigest("sha256", hex.EncodeToString(tree.Sum(nil))), nil
+}
+
+// treeEntry is what TreeHash records of one entry of a tree
+type treeEntry struct {
+	Kind string // dir, file, symlink or other
+	Perm fs.FileMode
+	Size int64
+	// Data is a file's hex SHA256 or a symlink's target
+	Data string
+}
+
+// walkTree calls fn for every entry under root, excluding root itself, in
+// lexical order with its slash-separated path relative to root
+func walkTree(root string, fn func(rel string, e treeEntry) error) error {
+	content := sha256.New()
+
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		e := treeEntry{Perm: info.Mode().Perm()}
+		switch {
+		case d.IsDir():
+			e.Kind = "dir"
+		case d.Type()&fs.ModeSymlink != 0:
+			e.Kind = "symlink"
+			if e.Data, err = os.Readlink(path); err != nil {
+				return err
+			}
+		case d.Type().IsRegular():
+			e.Kind = "file"
+			e.Size = info.Size()
+			if e.Data, err = fileHash(path, content); err != nil {
+				return err
+			}
+		default:
+			e.Kind = "other"
+		}
+		return fn(filepath.ToSlash(rel), e)
+	})
+}
+
+// fileHash returns the hex SHA256 of a file's content, reusing h
+func fileHash(path string, h hash.Hash) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h.Reset()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,142 @@
+package fsm
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fly-io/162719/pkg/db"
+	"github.com/fly-io/162719/pkg/security"
+	"github.com/superfly/fsm"
+)
+
+// writeTree creates files under root in the given order
+func writeTree(t *testing.T, root string, names []string, files map[string]string) {
+	t.Helper()
+	for _, name := range names {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(files[name]), 0644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+}
+
+func TestTreeHash(t *testing.T) {
+	files := map[string]string{
+		"etc/hostname":   "alpine",
+		"etc/os-release": "ID=alpine",
+		"bin/sh":         "#!shell",
+		"usr/lib/libc":   "libc",
+	}
+
+	// Same content created in opposite orders
+	a, b := t.TempDir(), t.TempDir()
+	writeTree(t, a, []string{"etc/hostname", "etc/os-release", "bin/sh", "usr/lib/libc"}, files)
+	writeTree(t, b, []string{"usr/lib/libc", "bin/sh", "etc/os-release", "etc/hostname"}, files)
+	for _, root := range []string{a, b} {
+		if err := os.Symlink("/bin/sh", filepath.Join(root, "bin/ash")); err != nil {
+			t.Fatalf("symlink: %v", err)
+		}
+	}
+
+	hashA, err := TreeHash(a)
+	if err != nil {
+		t.Fatalf("TreeHash: %v", err)
+	}
+	hashB, err := TreeHash(b)
+	if err != nil {
+		t.Fatalf("TreeHash: %v", err)
+	}
+	if hashA != hashB {
+		t.Errorf("identical trees hash differently: %s vs %s", hashA, hashB)
+	}
+	if !strings.HasPrefix(hashA, "sha256:") {
+		t.Errorf("hash %q lacks algorithm prefix", hashA)
+	}
+
+	changes := map[string]func(root string) error{
+		"one byte of content": func(root string) error {
+			return os.WriteFile(filepath.Join(root, "etc/hostname"), []byte("alpinf"), 0644)
+		},
+		"permission bits": func(root string) error {
+			return os.Chmod(filepath.Join(root, "bin/sh"), 0755)
+		},
+		"symlink target": func(root string) error {
+			os.Remove(filepath.Join(root, "bin/ash"))
+			return os.Symlink("/bin/busybox", filepath.Join(root, "bin/ash"))
+		},
+		"renamed file": func(root string) error {
+			return os.Rename(filepath.Join(root, "usr/lib/libc"), filepath.Join(root, "usr/lib/libc.so"))
+		},
+		"empty directory": func(root string) error {
+			return os.Mkdir(filepath.Join(root, "tmp"), 0755)
+		},
+	}
+	for name, change := range changes {
+		t.Run(name, func(t *testing.T) {
+			root := t.TempDir()
+			writeTree(t, root, []string{"etc/hostname", "etc/os-release", "bin/sh", "usr/lib/libc"}, files)
+			if err := os.Symlink("/bin/sh", filepath.Join(root, "bin/ash")); err != nil {
+				t.Fatalf("symlink: %v", err)
+			}
+			if err := change(root); err != nil {
+				t.Fatalf("change tree: %v", err)
+			}
+			got, err := TreeHash(root)
+			if err != nil {
+				t.Fatalf("TreeHash: %v", err)
+			}
+			if got == hashA {
+				t.Errorf("hash unchanged after changing %s", name)
+			}
+		})
+	}
+}
+
+func TestHandleValidate_RecordsTreeHash(t *testing.T) {
+	dbPath := "/tmp/test_images_treehash.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	repo, err := db.NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	img := &db.Image{S3Key: "images/alpine.tar", Status: db.StatusDownloading}
+	if err := repo.Create(img); err != nil {
+		t.Fatalf("failed to create image: %v", err)
+	}
+
+	workDir := t.TempDir()
+	validator := security.NewValidator(1024*1024, 10*1024*1024, 1000.0)
+	m := NewMachine(repo, nil, validator, nil, workDir, 5, WithTreeHash())
+
+	tarPath := filepath.Join(workDir, "image.tar")
+	writeTestTar(t, tarPath, map[string]string{"etc/hostname": "alpine"})
+	digest := "sha256:" + strings.Repeat("cd", 32)
+
+	req := fsm.NewRequest(&ImageRequest{S3Key: img.S3Key}, &ImageResponse{ImageID: img.ID, SHA256: digest, DownloadPath: tarPath, DownloadSize: 1024})
+	resp, err := m.handleValidate(context.Background(), req)
+	if err != nil {
+		t.Fatalf("handleValidate failed: %v", err)
+	}
+
+	want, err := TreeHash(resp.Msg.ExtractedPath)
+	if err != nil {
+		t.Fatalf("TreeHash: %v", err)
+	}
+	if resp.Msg.TreeHash != want {
+		t.Errorf("response tree hash = %q, want %q", resp.Msg.TreeHash, want)
+	}
+	got, _ := repo.GetByS3Key(img.S3Key)
+	if got.TreeHash != want {
+		t.Errorf("recorded tree hash = %q, want %q", got.TreeHash, want)
+	}
+}
@@ -0,0 +1,67 @@
+package fsm
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fly-io/162719/pkg/db"
+	"github.com/fly-io/162719/pkg/security"
+	"github.com/superfly/fsm"
+)
+
+func TestHandleValidate_TrustedPrefixSkipsCompressionRatio(t *testing.T) {
+	dbPath := "/tmp/test_images_trusted.db"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	repo, err := db.NewRepository(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	defer repo.Close()
+
+	// Plain tarballs expand to about their own size, so a max ratio below
+	// one makes any of them a "bomb"
+	workDir := t.TempDir()
+	validator := security.NewValidator(64*1024, 1024*1024, 0.5)
+	m := NewMachine(repo, nil, validator, nil, workDir, 5, WithTrustedPrefixes("internal/"))
+
+	tarPath := filepath.Join(workDir, "image.tar")
+	writeTestTar(t, tarPath, map[string]string{"etc/zeros": strings.Repeat("\x00", 32*1024)})
+
+	tests := []struct {
+		name    string
+		s3Key   string
+		wantErr bool
+	}{
+		{name: "trusted prefix", s3Key: "internal/base.tar", wantErr: false},
+		{name: "untrusted key", s3Key: "uploads/base.tar", wantErr: true},
+		{name: "prefix must match from the start", s3Key: "uploads/internal/base.tar", wantErr: true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			digest := "sha256:" + strings.Repeat(string(rune('a'+i)), 64)
+			req := fsm.NewRequest(&ImageRequest{S3Key: tt.s3Key}, &ImageResponse{SHA256: digest, DownloadPath: tarPath, DownloadSize: 1024})
+			_, err := m.handleValidate(context.Background(), req)
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "compression ratio") {
+					t.Errorf("handleValidate error = %v, want compression ratio failure", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("handleValidate failed for trusted key: %v", err)
+			}
+		})
+	}
+
+	// Size limits still apply to trusted keys
+	writeTestTar(t, tarPath, map[string]string{"etc/zeros": strings.Repeat("\x00", 128*1024)})
+	req := fsm.NewRequest(&ImageRequest{S3Key: "internal/huge.tar"}, &ImageResponse{SHA256: "sha256:" + strings.Repeat("f", 64), DownloadPath: tarPath, DownloadSize: 1024})
+	if _, err := m.handleValidate(context.Background(), req); err == nil {
+		t.Error("expected file size limit to reject oversized file under trusted prefix")
+	}
+}
@@ -1,23 +1,71 @@
 package fsm
 
-// ImageRequest is the FSM input
+import (
+	"slices"
+	"time"
+)
+
+// ImageRequest is the FSM input. An image comes either from the object
+// store (S3Key) or from a container registry (ImageRef).
 type ImageRequest struct {
 	S3Key    string
 	S3Bucket string
+
+	// ImageRef is a registry image reference such as
+	// "ghcr.io/org/app:1.2"; when set, S3Key is unused
+	ImageRef string
+
+	// TimeoutSeconds bounds this image's run, for images known to be
+	// slow; 0 uses the global fetch timeout
+	TimeoutSeconds int
+
+	// ExtractSubpath, if set, is the directory of the tarball holding
+	// the rootfs, e.g. "rootfs"; only entries under it are extracted, at
+	// the root of the tree
+	ExtractSubpath string
+}
+
+// Key identifies the image: its registry reference, or else its S3 key.
+// Images are recorded and locked under this key.
+func (r *ImageRequest) Key() string {
+	if r.ImageRef != "" {
+		return r.ImageRef
+	}
+	return r.S3Key
+}
+
+// Timeout returns the deadline for processing the image: its own
+// TimeoutSeconds if set, otherwise global (0 = none)
+func (r *ImageRequest) Timeout(global time.Duration) time.Duration {
+	if r.TimeoutSeconds > 0 {
+		return time.Duration(r.TimeoutSeconds) * time.Second
+	}
+	return global
 }
 
 // ImageResponse is the FSM output (accumulated across transitions)
 type ImageResponse struct {
 	// From CheckDB
-	ImageID int64
+	ImageID        int64
+	DownloadCached bool // local download is current, skip re-download
+	Attempts       int  // fetch runs that have processed this image, this one included
 
 	// From Download
-	SHA256       string
+	SHA256       string // algorithm-prefixed digest, e.g. "sha256:<hex>"
 	DownloadPath string
 	DownloadSize int64
+	Streamed     bool // tree was extracted while streaming; no tarball on disk
 
 	// From Validate (extraction)
+	TreeHash      string // digest of the extracted tree, with tree hashing on
 	ExtractedPath string
+	ExtractedSize int64 // bytes of file content in the extracted tree
+	// TreeExtracted reports whether this run extracted the tree, rather
+	// than reusing a cached one that other images may share
+	TreeExtracted bool
+
+	// From Scan
+	PackageCount int
 
 	// From Complete (devicemapper)
 	DevicePath string
@@ -26,6 +74,18 @@ type ImageResponse struct {
 	// From Complete/Failed
 	Status       string
 	ErrorMessage string
+
+	// Degradations lists steps skipped because the platform couldn't
+	// perform them (e.g. no devicemapper). An image that is ready with
+	// degradations is usable but not fully provisioned.
+	Degradations []string
+}
+
+// addDegradation records a skipped step once, even if its state retries
+func (r *ImageResponse) addDegradation(msg string) {
+	if !slices.Contains(r.Degradations, msg) {
+		r.Degradations = append(r.Degradations, msg)
+	}
 }
 
 // State names
@@ -34,6 +94,7 @@ const (
 	StateDownload     = "download"
 	StateValidate     = "validate"
 	StateCreateDevice = "create_device"
+	StateScan         = "scan"
 	StateComplete     = "complete"
 	StateFailed       = "failed"
 )
@@ -0,0 +1,49 @@
+package fsm
+
+import (
+	"testing"
+	"time"
+)
+
+func TestImageRequestTimeout(t *testing.T) {
+	tests := []struct {
+		name           string
+		timeoutSeconds int
+		global         time.Duration
+		want           time.Duration
+	}{
+		{"per-image wins over global", 900, 5 * time.Minute, 15 * time.Minute},
+		{"per-image without global", 30, 0, 30 * time.Second},
+		{"zero uses global", 0, 5 * time.Minute, 5 * time.Minute},
+		{"no timeout", 0, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &ImageRequest{S3Key: "slow.tar", TimeoutSeconds: tt.timeoutSeconds}
+			if got := req.Timeout(tt.global); got != tt.want {
+				t.Errorf("Timeout(%s) = %s, want %s", tt.global, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestImageRequestKey(t *testing.T) {
+	tests := []struct {
+		name string
+		req  ImageRequest
+		want string
+	}{
+		{"s3 key", ImageRequest{S3Key: "images/alpine.tar"}, "images/alpine.tar"},
+		{"image ref", ImageRequest{ImageRef: "ghcr.io/org/app:1.2"}, "ghcr.io/org/app:1.2"},
+		{"image ref wins", ImageRequest{S3Key: "images/alpine.tar", ImageRef: "ghcr.io/org/app:1.2"}, "ghcr.io/org/app:1.2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.req.Key(); got != tt.want {
+				t.Errorf("Key() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
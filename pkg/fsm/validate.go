@@ -0,0 +1,67 @@
+package fsm
+
+import (
+	"io"
+	"os"
+
+	"github.com/fly-io/162719/pkg/devicemapper"
+	"github.com/fly-io/162719/pkg/errors"
+	"github.com/fly-io/162719/pkg/oci"
+	"github.com/fly-io/162719/pkg/security"
+)
+
+// ValidationResult describes a tarball that passed ValidateImage
+type ValidationResult struct {
+	ExtractedPath string
+	OCI           bool  // the tarball was an OCI image layout
+	RootfsErr     error // why the tree doesn't look like a rootfs; nil if it does
+}
+
+// ValidateImage applies the checks the validate state runs on a download
+// to the tarball at tarPath, extracting it into dir. It needs no
+// repository, so images can be checked without any state on the host.
+// Security and extraction failures are returned as errors; a tree that
+// merely doesn't look like a rootfs is reported in the result, leaving
+// the caller to decide.
+func ValidateImage(tarPath, dir string, validator *security.Validator, opts devicemapper.ExtractOptions) (*ValidationResult, error) {
+	if err := devicemapper.ExtractTarballAtomic(tarPath, dir, validator, opts); err != nil {
+		return nil, errors.Wrap(err, "tar extraction failed")
+	}
+	isOCI, err := unpackOCILayout(dir, validator, !opts.SkipCompressionRatio)
+	if err != nil {
+		return nil, errors.Wrap(err, "oci unpack failed")
+	}
+	return &ValidationResult{
+		ExtractedPath: dir,
+		OCI:           isOCI,
+		RootfsErr:     checkRootfsLayout(dir),
+	}, nil
+}
+
+// unpackOCILayout replaces an OCI image layout in dir with the filesystem
+// its layers build, so later steps see a plain tree. With checkRatio,
+// compressed layers are held to the validator's compression ratio as they
+// inflate. It reports whether dir held a layout; on failure dir is
+// removed.
+func unpackOCILayout(dir string, validator *security.Validator, checkRatio bool) (bool, error) {
+	if !oci.IsLayout(dir) {
+		return false, nil
+	}
+
+	var opts []oci.UnpackOption
+	if checkRatio {
+		opts = append(opts, oci.WithRatioGuard(validator))
+	}
+
+	validator.Reset()
+	err := devicemapper.BuildDirAtomic(dir, func(rootfs string) error {
+		return oci.Unpack(dir, func(layer io.Reader) error {
+			return devicemapper.ApplyLayer(layer, rootfs, validator)
+		}, opts...)
+	})
+	if err != nil {
+		os.RemoveAll(dir)
+		return true, err
+	}
+	return true, nil
+}
@@ -0,0 +1,56 @@
+package fsm
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fly-io/162719/pkg/devicemapper"
+	"github.com/fly-io/162719/pkg/security"
+)
+
+func TestValidateImage_NoRepository(t *testing.T) {
+	dir := t.TempDir()
+
+	rootfs := filepath.Join(dir, "rootfs.tar")
+	writeTestTar(t, rootfs, map[string]string{"etc/hostname": "alpine", "bin/sh": "#!shell"})
+	notRootfs := filepath.Join(dir, "data.tar")
+	writeTestTar(t, notRootfs, map[string]string{"data/blob": "payload"})
+	tooBig := filepath.Join(dir, "big.tar")
+	writeTestTar(t, tooBig, map[string]string{"etc/hostname": string(make([]byte, 4096))})
+
+	tests := []struct {
+		name          string
+		tarPath       string
+		wantErr       bool
+		wantNotRootfs bool
+	}{
+		{name: "rootfs", tarPath: rootfs},
+		{name: "not a rootfs", tarPath: notRootfs, wantNotRootfs: true},
+		{name: "file over limit", tarPath: tooBig, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			validator := security.NewValidator(1024, 1<<20, 1000)
+			extractDir := filepath.Join(t.TempDir(), "tree")
+
+			result, err := ValidateImage(tt.tarPath, extractDir, validator, devicemapper.ExtractOptions{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ValidateImage error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if _, statErr := os.Stat(extractDir); !os.IsNotExist(statErr) {
+					t.Errorf("failed validation left %s behind", extractDir)
+				}
+				return
+			}
+			if got := errors.Is(result.RootfsErr, ErrNotRootfs); got != tt.wantNotRootfs {
+				t.Errorf("RootfsErr = %v, want not-rootfs %v", result.RootfsErr, tt.wantNotRootfs)
+			}
+			if result.OCI {
+				t.Errorf("plain tarball reported as OCI layout")
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+// Package notify tells external systems when an image reaches a terminal
+// state, by POSTing a signed JSON payload to a webhook.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// SignatureHeader carries "sha256=<hex>", an HMAC-SHA256 of the request
+// body keyed with the shared secret
+const SignatureHeader = "X-Flyio-Signature"
+
+// Payload describes an image that finished processing
+type Payload struct {
+	Time       time.Time `json:"time"`
+	S3Key      string    `json:"s3_key"`
+	Status     string    `json:"status"` // ready or failed
+	SHA256     string    `json:"sha256,omitempty"`
+	DevicePath string    `json:"device_path,omitempty"`
+	SnapshotID int       `json:"snapshot_id,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Notifier receives terminal image states
+type Notifier interface {
+	Notify(ctx context.Context, payload Payload) error
+}
+
+// Webhook POSTs payloads to an HTTP endpoint, retrying server errors
+type Webhook struct {
+	URL    string
+	Secret string // HMAC key; the signature header is omitted when empty
+
+	Client      *http.Client
+	MaxAttempts int           // total tries for 5xx and network errors
+	Backoff     time.Duration // delay before the first retry, doubled after each
+}
+
+// NewWebhook creates a webhook notifier with default retry settings
+func NewWebhook(url, secret string) *Webhook {
+	return &Webhook{
+		URL:         url,
+		Secret:      secret,
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		MaxAttempts: 3,
+		Backoff:     500 * time.Millisecond,
+	}
+}
+
+// Sign returns the SignatureHeader value for body
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Notify implements Notifier. 4xx responses are not retried: the receiver
+// rejected the payload and would do so again.
+func (w *Webhook) Notify(ctx context.Context, payload Payload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode payload: %w", err)
+	}
+
+	backoff := w.Backoff
+	var lastErr error
+	for attempt := 1; attempt <= max(w.MaxAttempts, 1); attempt++ {
+		if attempt > 1 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+
+		retry, err := w.post(ctx, body)
+		if err == nil {
+			slog.Info("webhook_delivered", "s3_key", payload.S3Key, "status", payload.Status, "attempt", attempt)
+			return nil
+		}
+		lastErr = err
+		slog.Warn("webhook_delivery_failed", "s3_key", payload.S3Key, "attempt", attempt, "error", err)
+		if !retry {
+			break
+		}
+	}
+	return lastErr
+}
+
+// post sends one request, reporting whether a failure is worth retrying
+func (w *Webhook) post(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("failed to build request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(w.Secret, body))
+	}
+
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, fmt.Errorf("webhook request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	switch {
+	case resp.StatusCode >= 500:
+		return true, fmt.Errorf("webhook returned %s", resp.Status)
+	case resp.StatusCode >= 300:
+		return false, fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return false, nil
+}
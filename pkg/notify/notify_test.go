@@ -0,0 +1,86 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestWebhook(url, secret string) *Webhook {
+	w := NewWebhook(url, secret)
+	w.Backoff = time.Millisecond
+	return w
+}
+
+func TestWebhook_PayloadAndSignature(t *testing.T) {
+	const secret = "s3cret"
+
+	var got Payload
+	var signature string
+	var valid bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		signature = r.Header.Get(SignatureHeader)
+		valid = signature == Sign(secret, body)
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Errorf("decode payload: %v", err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	payload := Payload{
+		S3Key:      "images/alpine.tar",
+		Status:     "ready",
+		SHA256:     "sha256:abc",
+		DevicePath: "/dev/mapper/flyio-7",
+		SnapshotID: 8,
+	}
+	if err := newTestWebhook(srv.URL, secret).Notify(context.Background(), payload); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+
+	if got != payload {
+		t.Errorf("payload = %+v, want %+v", got, payload)
+	}
+	if !valid {
+		t.Errorf("signature %q does not match the body", signature)
+	}
+}
+
+func TestWebhook_Retries(t *testing.T) {
+	tests := []struct {
+		name      string
+		responses []int
+		wantCalls int32
+		wantErr   bool
+	}{
+		{name: "5xx then success", responses: []int{502, 503, 200}, wantCalls: 3},
+		{name: "5xx exhausts attempts", responses: []int{500, 500, 500, 200}, wantCalls: 3, wantErr: true},
+		{name: "4xx is not retried", responses: []int{400, 200}, wantCalls: 1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := calls.Add(1)
+				w.WriteHeader(tt.responses[n-1])
+			}))
+			defer srv.Close()
+
+			err := newTestWebhook(srv.URL, "").Notify(context.Background(), Payload{S3Key: "a.tar", Status: "failed"})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Notify error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if calls.Load() != tt.wantCalls {
+				t.Errorf("calls = %d, want %d", calls.Load(), tt.wantCalls)
+			}
+		})
+	}
+}
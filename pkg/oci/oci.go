@@ -0,0 +1,265 @@
+// Package oci reads OCI image layout directories (index.json + blobs/) and
+// applies their layers, in order, into a root filesystem.
+package oci
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fly-io/162719/pkg/security"
+)
+
+// Media types understood by Unpack
+const (
+	MediaTypeImageIndex    = "application/vnd.oci.image.index.v1+json"
+	MediaTypeImageManifest = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeLayer         = "application/vnd.oci.image.layer.v1.tar"
+	MediaTypeLayerGzip     = "application/vnd.oci.image.layer.v1.tar+gzip"
+
+	MediaTypeDockerManifest  = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerLayerGzip = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+)
+
+const (
+	// maxJSONSize bounds index and manifest documents read into memory
+	maxJSONSize = 4 * 1024 * 1024
+	// maxLayers bounds the number of layers applied for a single image
+	maxLayers = 128
+)
+
+// Descriptor references a content-addressed blob
+type Descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+// Index is the top-level index.json of an image layout
+type Index struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	Manifests     []Descriptor `json:"manifests"`
+}
+
+// Manifest lists the layers of a single image
+type Manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Config        Descriptor   `json:"config"`
+	Layers        []Descriptor `json:"layers"`
+}
+
+// IsLayout reports whether dir looks like an OCI image layout
+func IsLayout(dir string) bool {
+	if fi, err := os.Lstat(filepath.Join(dir, "index.json")); err != nil || !fi.Mode().IsRegular() {
+		return false
+	}
+	fi, err := os.Lstat(filepath.Join(dir, "blobs"))
+	return err == nil && fi.IsDir()
+}
+
+// Layers resolves the ordered layer descriptors of the image in a layout.
+// Layouts indexing more than one image manifest are rejected, since there
+// is no way to tell which one is meant.
+func Layers(layoutDir string) ([]Descriptor, error) {
+	var index Index
+	if err := readJSON(filepath.Join(layoutDir, "index.json"), &index); err != nil {
+		return nil, fmt.Errorf("invalid index.json: %w", err)
+	}
+	if index.SchemaVersion != 2 {
+		return nil, fmt.Errorf("unsupported index schema version %d", index.SchemaVersion)
+	}
+
+	var manifests []Descriptor
+	for _, desc := range index.Manifests {
+		switch desc.MediaType {
+		case MediaTypeImageManifest, MediaTypeDockerManifest:
+			manifests = append(manifests, desc)
+		case MediaTypeImageIndex:
+			return nil, fmt.Errorf("nested image indexes are not supported")
+		}
+	}
+	if len(manifests) != 1 {
+		return nil, fmt.Errorf("expected exactly one image manifest, found %d", len(manifests))
+	}
+
+	manifestPath, err := blobPath(layoutDir, manifests[0].Digest)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyBlob(manifestPath, manifests[0]); err != nil {
+		return nil, err
+	}
+
+	var manifest Manifest
+	if err := readJSON(manifestPath, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if len(manifest.Layers) > maxLayers {
+		return nil, fmt.Errorf("too many layers: %d (max %d)", len(manifest.Layers), maxLayers)
+	}
+
+	return manifest.Layers, nil
+}
+
+// UnpackOption configures Unpack
+type UnpackOption func(*unpackConfig)
+
+type unpackConfig struct {
+	ratioGuard *security.Validator
+}
+
+// WithRatioGuard enforces the validator's compression ratio on each
+// compressed layer while it is decompressed, aborting a bomb early
+func WithRatioGuard(validator *security.Validator) UnpackOption {
+	return func(c *unpackConfig) {
+		c.ratioGuard = validator
+	}
+}
+
+// Unpack applies every layer of the image in layoutDir, bottom to top.
+// Each layer blob is verified against its digest before apply is called
+// with the decompressed tar stream.
+func Unpack(layoutDir string, apply func(layer io.Reader) error, opts ...UnpackOption) error {
+	var cfg unpackConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	layers, err := Layers(layoutDir)
+	if err != nil {
+		return err
+	}
+
+	for i, layer := range layers {
+		slog.Info("oci_apply_layer", "index", i, "digest", layer.Digest, "media_type", layer.MediaType)
+
+		if err := unpackLayer(layoutDir, layer, apply, cfg); err != nil {
+			return fmt.Errorf("layer %d (%s): %w", i, layer.Digest, err)
+		}
+	}
+
+	return nil
+}
+
+func unpackLayer(layoutDir string, layer Descriptor, apply func(io.Reader) error, cfg unpackConfig) error {
+	path, err := blobPath(layoutDir, layer.Digest)
+	if err != nil {
+		return err
+	}
+	if err := verifyBlob(path, layer); err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open blob: %w", err)
+	}
+	defer f.Close()
+
+	switch layer.MediaType {
+	case MediaTypeLayer:
+		return apply(f)
+	case MediaTypeLayerGzip, MediaTypeDockerLayerGzip:
+		compressed := security.NewCountingReader(f)
+		gz, err := gzip.NewReader(compressed)
+		if err != nil {
+			return fmt.Errorf("invalid gzip layer: %w", err)
+		}
+		defer gz.Close()
+		if cfg.ratioGuard != nil {
+			return apply(cfg.ratioGuard.GuardRatio(gz, compressed))
+		}
+		return apply(gz)
+	default:
+		return fmt.Errorf("unsupported layer media type %q", layer.MediaType)
+	}
+}
+
+// blobPath maps a digest to its path under blobs/, rejecting anything that
+// is not a well-formed digest so it can never address files outside blobs/
+func blobPath(layoutDir, digest string) (string, error) {
+	algorithm, encoded, ok := strings.Cut(digest, ":")
+	if !ok {
+		return "", fmt.Errorf("malformed digest %q", digest)
+	}
+	newHash, err := hashFor(algorithm)
+	if err != nil {
+		return "", err
+	}
+	if len(encoded) != newHash().Size()*2 || strings.Trim(encoded, "0123456789abcdef") != "" {
+		return "", fmt.Errorf("malformed digest %q", digest)
+	}
+	return filepath.Join(layoutDir, "blobs", algorithm, encoded), nil
+}
+
+// verifyBlob checks a blob's size and digest against its descriptor
+func verifyBlob(path string, desc Descriptor) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return fmt.Errorf("missing blob %s: %w", desc.Digest, err)
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("blob %s is not a regular file", desc.Digest)
+	}
+	if desc.Size != 0 && fi.Size() != desc.Size {
+		return fmt.Errorf("blob %s size %d does not match descriptor size %d", desc.Digest, fi.Size(), desc.Size)
+	}
+
+	algorithm, encoded, _ := strings.Cut(desc.Digest, ":")
+	newHash, err := hashFor(algorithm)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open blob: %w", err)
+	}
+	defer f.Close()
+
+	h := newHash()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("failed to hash blob: %w", err)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != encoded {
+		return fmt.Errorf("blob digest mismatch: expected %s, got %s:%s", desc.Digest, algorithm, got)
+	}
+	return nil
+}
+
+func hashFor(algorithm string) (func() hash.Hash, error) {
+	switch algorithm {
+	case "sha256":
+		return sha256.New, nil
+	case "sha512":
+		return sha512.New, nil
+	}
+	return nil, fmt.Errorf("unsupported digest algorithm %q", algorithm)
+}
+
+func readJSON(path string, v any) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(io.LimitReader(f, maxJSONSize+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > maxJSONSize {
+		return fmt.Errorf("%s exceeds %d bytes", filepath.Base(path), maxJSONSize)
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,220 @@
+package oci
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fly-io/162719/pkg/devicemapper"
+	"github.com/fly-io/162719/pkg/security"
+)
+
+type layerFile struct {
+	name string
+	body string
+}
+
+func layerTar(t *testing.T, files []layerFile, compress bool) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(&buf)
+		w = gz
+	}
+
+	tw := tar.NewWriter(w)
+	for _, f := range files {
+		hdr := &tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.body)), Typeflag: tar.TypeReg}
+		if strings.HasSuffix(f.name, "/") {
+			hdr = &tar.Header{Name: f.name, Mode: 0755, Typeflag: tar.TypeDir}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("write header: %v", err)
+		}
+		if _, err := tw.Write([]byte(f.body)); err != nil {
+			t.Fatalf("write body: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close tar: %v", err)
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			t.Fatalf("close gzip: %v", err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func writeBlob(t *testing.T, dir, mediaType string, data []byte) Descriptor {
+	t.Helper()
+
+	sum := sha256.Sum256(data)
+	encoded := hex.EncodeToString(sum[:])
+	blobDir := filepath.Join(dir, "blobs", "sha256")
+	if err := os.MkdirAll(blobDir, 0755); err != nil {
+		t.Fatalf("mkdir blobs: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(blobDir, encoded), data, 0644); err != nil {
+		t.Fatalf("write blob: %v", err)
+	}
+	return Descriptor{MediaType: mediaType, Digest: "sha256:" + encoded, Size: int64(len(data))}
+}
+
+func writeJSON(t *testing.T, v any) []byte {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	return data
+}
+
+// writeLayout builds an OCI image layout in dir with the given layers
+func writeLayout(t *testing.T, dir string, layers ...Descriptor) {
+	t.Helper()
+
+	config := writeBlob(t, dir, "application/vnd.oci.image.config.v1+json", []byte("{}"))
+	manifest := writeBlob(t, dir, MediaTypeImageManifest, writeJSON(t, Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeImageManifest,
+		Config:        config,
+		Layers:        layers,
+	}))
+	index := writeJSON(t, Index{SchemaVersion: 2, Manifests: []Descriptor{manifest}})
+	if err := os.WriteFile(filepath.Join(dir, "index.json"), index, 0644); err != nil {
+		t.Fatalf("write index: %v", err)
+	}
+}
+
+func newTestValidator() *security.Validator {
+	return security.NewValidator(1024*1024, 10*1024*1024, 1000.0)
+}
+
+func unpackInto(layoutDir, rootfs string) error {
+	v := newTestValidator()
+	return Unpack(layoutDir, func(r io.Reader) error {
+		return devicemapper.ApplyLayer(r, rootfs, v)
+	})
+}
+
+func TestUnpack_AppliesLayersWithWhiteouts(t *testing.T) {
+	layoutDir := t.TempDir()
+	base := writeBlob(t, layoutDir, MediaTypeLayerGzip, layerTar(t, []layerFile{
+		{name: "etc/"},
+		{name: "etc/hostname", body: "base"},
+		{name: "etc/old.conf", body: "stale"},
+	}, true))
+	top := writeBlob(t, layoutDir, MediaTypeLayer, layerTar(t, []layerFile{
+		{name: "etc/.wh.old.conf"},
+		{name: "etc/hostname", body: "top"},
+		{name: "app/run.sh", body: "#!/bin/sh"},
+	}, false))
+	writeLayout(t, layoutDir, base, top)
+
+	if !IsLayout(layoutDir) {
+		t.Fatal("expected directory to be detected as an OCI layout")
+	}
+
+	rootfs := t.TempDir()
+	if err := unpackInto(layoutDir, rootfs); err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+
+	if got, err := os.ReadFile(filepath.Join(rootfs, "etc/hostname")); err != nil || string(got) != "top" {
+		t.Errorf("etc/hostname = %q, %v; want upper layer content", got, err)
+	}
+	if _, err := os.Stat(filepath.Join(rootfs, "etc/old.conf")); !os.IsNotExist(err) {
+		t.Errorf("expected etc/old.conf to be whited out, stat err = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(rootfs, "etc/.wh.old.conf")); !os.IsNotExist(err) {
+		t.Errorf("whiteout marker should not be written, stat err = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(rootfs, "app/run.sh")); err != nil {
+		t.Errorf("expected app/run.sh from upper layer: %v", err)
+	}
+}
+
+func TestUnpack_RejectsDigestMismatch(t *testing.T) {
+	layoutDir := t.TempDir()
+	layer := writeBlob(t, layoutDir, MediaTypeLayer, layerTar(t, []layerFile{
+		{name: "etc/hostname", body: "base"},
+	}, false))
+	writeLayout(t, layoutDir, layer)
+
+	// Tamper with the layer after it was content-addressed
+	blob := filepath.Join(layoutDir, "blobs", "sha256", strings.TrimPrefix(layer.Digest, "sha256:"))
+	tampered := layerTar(t, []layerFile{{name: "etc/hostname", body: "evil"}}, false)
+	if err := os.WriteFile(blob, tampered, 0644); err != nil {
+		t.Fatalf("tamper: %v", err)
+	}
+
+	rootfs := t.TempDir()
+	err := unpackInto(layoutDir, rootfs)
+	if err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+		t.Fatalf("expected digest mismatch error, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(rootfs, "etc/hostname")); !os.IsNotExist(err) {
+		t.Errorf("tampered layer must not be applied, stat err = %v", err)
+	}
+}
+
+func TestBlobPath_RejectsMalformedDigests(t *testing.T) {
+	tests := []string{
+		"sha256",
+		"md5:d41d8cd98f00b204e9800998ecf8427e",
+		"sha256:../../etc/passwd",
+		"sha256:" + strings.Repeat("A", 64),
+		"sha256:" + strings.Repeat("a", 63),
+	}
+
+	for _, digest := range tests {
+		if _, err := blobPath("/layout", digest); err == nil {
+			t.Errorf("blobPath(%q) expected error", digest)
+		}
+	}
+}
+
+func TestUnpack_RatioGuardStopsGzipBombEarly(t *testing.T) {
+	const bombSize = 64 << 20
+	layoutDir := t.TempDir()
+	bomb := writeBlob(t, layoutDir, MediaTypeLayerGzip, layerTar(t, []layerFile{
+		{name: "var/log/zeros", body: strings.Repeat("\x00", bombSize)},
+	}, true))
+	writeLayout(t, layoutDir, bomb)
+
+	validator := security.NewValidator(1<<30, 1<<30, 100)
+	var inflated int64
+	err := Unpack(layoutDir, func(r io.Reader) error {
+		n, err := io.Copy(io.Discard, r)
+		inflated = n
+		return err
+	}, WithRatioGuard(validator))
+
+	if !errors.Is(err, security.ErrRejected) {
+		t.Fatalf("Unpack error = %v, want a compression ratio rejection", err)
+	}
+	if inflated >= bombSize/16 {
+		t.Errorf("inflated %d of %d bytes before rejecting; want an early abort", inflated, bombSize)
+	}
+
+	// Without the guard the same layer inflates in full
+	if err := Unpack(layoutDir, func(r io.Reader) error {
+		_, err := io.Copy(io.Discard, r)
+		return err
+	}); err != nil {
+		t.Errorf("Unpack without guard failed: %v", err)
+	}
+}
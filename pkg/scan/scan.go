@@ -0,0 +1,186 @@
+// Package scan inventories the OS packages installed in an extracted image
+// tree and checks them against a pluggable vulnerability source.
+package scan
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Package managers recognized by Scan
+const (
+	ManagerDpkg = "dpkg"
+	ManagerApk  = "apk"
+)
+
+// Package is an installed OS package
+type Package struct {
+	Manager      string
+	Name         string
+	Version      string
+	Architecture string
+}
+
+// Vulnerability is a known issue affecting an installed package
+type Vulnerability struct {
+	Package  Package
+	ID       string // e.g. CVE-2024-1234
+	Severity string
+}
+
+// Checker looks up known vulnerabilities for a set of packages
+type Checker interface {
+	Check(ctx context.Context, pkgs []Package) ([]Vulnerability, error)
+}
+
+// NoopChecker reports no vulnerabilities. It stands in until a real
+// vulnerability database is wired up.
+type NoopChecker struct{}
+
+// Check implements Checker
+func (NoopChecker) Check(ctx context.Context, pkgs []Package) ([]Vulnerability, error) {
+	return nil, nil
+}
+
+// manifests maps package database locations inside an image to their parsers
+var manifests = []struct {
+	path  string
+	parse func(io.Reader) ([]Package, error)
+}{
+	{"var/lib/dpkg/status", ParseDpkgStatus},
+	{"lib/apk/db/installed", ParseApkInstalled},
+}
+
+// Scan finds package databases under root and returns every installed
+// package they list. Manifests reached through symlinks are skipped, since
+// they could point outside the image.
+func Scan(root string) ([]Package, error) {
+	var pkgs []Package
+	for _, m := range manifests {
+		path, ok, err := manifestPath(root, m.path)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s: %w", m.path, err)
+		}
+		found, err := m.parse(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", m.path, err)
+		}
+
+		slog.Info("scan_manifest_parsed", "manifest", m.path, "package_count", len(found))
+		pkgs = append(pkgs, found...)
+	}
+	return pkgs, nil
+}
+
+// manifestPath resolves rel under root, reporting false if it is missing
+// or any component is a symlink or not a regular file
+func manifestPath(root, rel string) (string, bool, error) {
+	current := root
+	parts := strings.Split(rel, "/")
+	for i, part := range parts {
+		current = filepath.Join(current, part)
+		fi, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return "", false, nil
+		}
+		if err != nil {
+			return "", false, fmt.Errorf("failed to inspect %s: %w", rel, err)
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			slog.Warn("scan_manifest_symlink_skipped", "manifest", rel)
+			return "", false, nil
+		}
+		if i == len(parts)-1 && !fi.Mode().IsRegular() {
+			return "", false, nil
+		}
+	}
+	return current, true, nil
+}
+
+// ParseDpkgStatus parses a dpkg status database (/var/lib/dpkg/status),
+// returning packages whose status is "installed"
+func ParseDpkgStatus(r io.Reader) ([]Package, error) {
+	var pkgs []Package
+	err := parseStanzas(r, func(fields map[string]string) {
+		status := strings.Fields(fields["Status"])
+		if fields["Package"] == "" || len(status) == 0 || status[len(status)-1] != "installed" {
+			return
+		}
+		pkgs = append(pkgs, Package{
+			Manager:      ManagerDpkg,
+			Name:         fields["Package"],
+			Version:      fields["Version"],
+			Architecture: fields["Architecture"],
+		})
+	})
+	return pkgs, err
+}
+
+// ParseApkInstalled parses an apk installed database (/lib/apk/db/installed)
+func ParseApkInstalled(r io.Reader) ([]Package, error) {
+	var pkgs []Package
+	err := parseStanzas(r, func(fields map[string]string) {
+		if fields["P"] == "" {
+			return
+		}
+		pkgs = append(pkgs, Package{
+			Manager:      ManagerApk,
+			Name:         fields["P"],
+			Version:      fields["V"],
+			Architecture: fields["A"],
+		})
+	})
+	return pkgs, err
+}
+
+// parseStanzas splits blank-line separated "Key: value" records and
+// calls emit with each. Continuation lines (leading whitespace) are
+// ignored, as only single-line fields are needed.
+func parseStanzas(r io.Reader, emit func(map[string]string)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	fields := make(map[string]string)
+	flush := func() {
+		if len(fields) > 0 {
+			emit(fields)
+			fields = make(map[string]string)
+		}
+	}
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			flush()
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		fields[key] = strings.TrimSpace(value)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	flush()
+	return nil
+}
@@ -0,0 +1,114 @@
+package scan
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const sampleDpkgStatus = `Package: libc6
+Status: install ok installed
+Priority: optional
+Architecture: amd64
+Version: 2.36-9+deb12u4
+Description: GNU C Library: Shared libraries
+ Contains the standard libraries that are used by nearly all programs on
+ the system.
+
+Package: removed-pkg
+Status: deinstall ok config-files
+Architecture: amd64
+Version: 1.0
+
+Package: bash
+Status: install ok installed
+Architecture: amd64
+Version: 5.2.15-2+b2
+`
+
+const sampleApkInstalled = `C:Q1abc=
+P:musl
+V:1.2.4-r2
+A:x86_64
+
+C:Q1def=
+P:busybox
+V:1.36.1-r5
+A:x86_64
+`
+
+func TestParseDpkgStatus(t *testing.T) {
+	pkgs, err := ParseDpkgStatus(strings.NewReader(sampleDpkgStatus))
+	if err != nil {
+		t.Fatalf("ParseDpkgStatus failed: %v", err)
+	}
+
+	expected := []Package{
+		{Manager: ManagerDpkg, Name: "libc6", Version: "2.36-9+deb12u4", Architecture: "amd64"},
+		{Manager: ManagerDpkg, Name: "bash", Version: "5.2.15-2+b2", Architecture: "amd64"},
+	}
+	if !reflect.DeepEqual(pkgs, expected) {
+		t.Errorf("ParseDpkgStatus = %+v, want %+v", pkgs, expected)
+	}
+}
+
+func TestParseApkInstalled(t *testing.T) {
+	pkgs, err := ParseApkInstalled(strings.NewReader(sampleApkInstalled))
+	if err != nil {
+		t.Fatalf("ParseApkInstalled failed: %v", err)
+	}
+
+	expected := []Package{
+		{Manager: ManagerApk, Name: "musl", Version: "1.2.4-r2", Architecture: "x86_64"},
+		{Manager: ManagerApk, Name: "busybox", Version: "1.36.1-r5", Architecture: "x86_64"},
+	}
+	if !reflect.DeepEqual(pkgs, expected) {
+		t.Errorf("ParseApkInstalled = %+v, want %+v", pkgs, expected)
+	}
+}
+
+func TestScan(t *testing.T) {
+	root := t.TempDir()
+	statusPath := filepath.Join(root, "var/lib/dpkg/status")
+	if err := os.MkdirAll(filepath.Dir(statusPath), 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(statusPath, []byte(sampleDpkgStatus), 0644); err != nil {
+		t.Fatalf("write status: %v", err)
+	}
+
+	pkgs, err := Scan(root)
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	if len(pkgs) != 2 {
+		t.Errorf("expected 2 packages, got %d", len(pkgs))
+	}
+
+	// A manifest reached through a symlink is not trusted
+	outside := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(outside, "db"), 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(outside, "db", "installed"), []byte(sampleApkInstalled), 0644); err != nil {
+		t.Fatalf("write installed: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "lib/apk"), 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "db"), filepath.Join(root, "lib/apk/db")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+
+	pkgs, err = Scan(root)
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	for _, p := range pkgs {
+		if p.Manager == ManagerApk {
+			t.Errorf("expected symlinked apk database to be skipped, got %+v", p)
+		}
+	}
+}
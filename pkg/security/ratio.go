@@ -0,0 +1,65 @@
+package security
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/fly-io/162719/pkg/errors"
+)
+
+// CountingReader counts the bytes read through it
+type CountingReader struct {
+	r io.Reader
+	n int64
+}
+
+// NewCountingReader wraps r
+func NewCountingReader(r io.Reader) *CountingReader {
+	return &CountingReader{r: r}
+}
+
+func (c *CountingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Count returns the bytes read so far
+func (c *CountingReader) Count() int64 {
+	return c.n
+}
+
+// GuardRatio returns a reader over decompressed that fails as soon as it
+// has produced more than the max compression ratio times the bytes read
+// so far from compressed, which must be the decompressor's input. A bomb
+// is stopped while it is being inflated instead of once it is on disk.
+// Decompressors read their input ahead, so the running ratio is never
+// overstated.
+func (v *Validator) GuardRatio(decompressed io.Reader, compressed *CountingReader) io.Reader {
+	return &ratioReader{r: decompressed, compressed: compressed, maxRatio: v.maxCompressionRatio}
+}
+
+type ratioReader struct {
+	r          io.Reader
+	compressed *CountingReader
+	maxRatio   float64
+	produced   int64
+}
+
+func (r *ratioReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.produced += int64(n)
+
+	consumed := r.compressed.Count()
+	if consumed > 0 && float64(r.produced) > r.maxRatio*float64(consumed) {
+		slog.Error("security_compression_bomb_detected",
+			"max_ratio", r.maxRatio,
+			"compressed_bytes", consumed,
+			"decompressed_bytes", r.produced,
+			"reason", "running_ratio")
+		return n, errors.Fatal(fmt.Errorf("%w: compression ratio exceeds max %.2f after %d compressed bytes (decompressed: %d)", ErrRejected,
+			r.maxRatio, consumed, r.produced))
+	}
+	return n, err
+}
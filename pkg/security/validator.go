@@ -6,39 +6,132 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+
+	"github.com/fly-io/162719/pkg/errors"
 )
 
+// ErrRejected is wrapped by every validation failure. Its message is the
+// "security" prefix those errors have always carried.
+var ErrRejected = errors.New("security")
+
+// DefaultMaxSymlinkTarget is the longest symlink target accepted unless
+// WithMaxSymlinkTarget overrides it: Linux's PATH_MAX
+const DefaultMaxSymlinkTarget = 4096
+
 // Validator provides security validation for tar extraction
 type Validator struct {
 	maxFileSize         int64
 	maxTotalSize        int64
 	maxCompressionRatio float64
+	maxSymlinkTarget    int
+	// symlinkAllowlist, if set, holds the absolute prefixes absolute
+	// symlink targets must fall under
+	symlinkAllowlist []string
 
 	mu               sync.Mutex
 	currentTotalSize int64
 }
 
+// ValidatorOption configures a Validator
+type ValidatorOption func(*Validator)
+
+// WithMaxSymlinkTarget sets the longest symlink target, in bytes, that
+// ValidateSymlink accepts. Values below 1 keep the default.
+func WithMaxSymlinkTarget(n int) ValidatorOption {
+	return func(v *Validator) {
+		if n > 0 {
+			v.maxSymlinkTarget = n
+		}
+	}
+}
+
+// WithAbsoluteSymlinkAllowlist makes ValidateSymlink strict about
+// absolute targets: they must be one of prefixes, e.g. "/usr", or lie
+// under one. By default every absolute target is accepted as container-
+// relative, which is unsafe if the tree is ever walked with the host as
+// root. No prefixes keeps the default.
+func WithAbsoluteSymlinkAllowlist(prefixes ...string) ValidatorOption {
+	return func(v *Validator) {
+		v.symlinkAllowlist = nil
+		for _, prefix := range prefixes {
+			v.symlinkAllowlist = append(v.symlinkAllowlist, filepath.Clean(prefix))
+		}
+	}
+}
+
 // NewValidator creates a new security validator
-func NewValidator(maxFileSize, maxTotalSize int64, maxCompressionRatio float64) *Validator {
+func NewValidator(maxFileSize, maxTotalSize int64, maxCompressionRatio float64, opts ...ValidatorOption) *Validator {
+	v := &Validator{
+		maxFileSize:         maxFileSize,
+		maxTotalSize:        maxTotalSize,
+		maxCompressionRatio: maxCompressionRatio,
+		maxSymlinkTarget:    DefaultMaxSymlinkTarget,
+	}
+	for _, opt := range opts {
+		opt(v)
+	}
+
 	slog.Info("security_validator_init",
 		"max_file_size_mb", maxFileSize/1024/1024,
 		"max_total_size_mb", maxTotalSize/1024/1024,
-		"max_compression_ratio", maxCompressionRatio)
+		"max_compression_ratio", maxCompressionRatio,
+		"max_symlink_target", v.maxSymlinkTarget,
+		"symlink_allowlist", v.symlinkAllowlist)
 
-	return &Validator{
-		maxFileSize:         maxFileSize,
-		maxTotalSize:        maxTotalSize,
-		maxCompressionRatio: maxCompressionRatio,
+	return v
+}
+
+// Limits returns the limits the validator was created with
+func (v *Validator) Limits() (maxFileSize, maxTotalSize int64, maxCompressionRatio float64) {
+	return v.maxFileSize, v.maxTotalSize, v.maxCompressionRatio
+}
+
+// MaxSymlinkTarget returns the longest symlink target the validator accepts
+func (v *Validator) MaxSymlinkTarget() int {
+	return v.maxSymlinkTarget
+}
+
+// AbsoluteSymlinkAllowlist returns the prefixes absolute symlink targets
+// are held to, or nil if every absolute target is accepted
+func (v *Validator) AbsoluteSymlinkAllowlist() []string {
+	return v.symlinkAllowlist
+}
+
+// allowedAbsolute reports whether the absolute symlink target is under
+// one of the allowlisted prefixes
+func (v *Validator) allowedAbsolute(target string) bool {
+	clean := filepath.Clean(target)
+	for _, prefix := range v.symlinkAllowlist {
+		if prefix == "/" || clean == prefix || strings.HasPrefix(clean, prefix+"/") {
+			return true
+		}
 	}
+	return false
+}
+
+// controlChar returns the first NUL or other control character in s that
+// filesystems or tools downstream may mishandle. Tabs are allowed.
+func controlChar(s string) (rune, bool) {
+	for _, r := range s {
+		if (r < 0x20 && r != '\t') || r == 0x7f {
+			return r, true
+		}
+	}
+	return 0, false
 }
 
 // ValidatePath checks for path traversal attacks
 // It validates file paths within a tar archive
 func (v *Validator) ValidatePath(tarPath string) error {
+	if r, ok := controlChar(tarPath); ok {
+		slog.Error("security_path_validation_failed", "path", tarPath, "reason", "control_character")
+		return errors.Fatal(fmt.Errorf("%w: path contains control character %U: %q", ErrRejected, r, tarPath))
+	}
+
 	// Reject absolute paths
 	if filepath.IsAbs(tarPath) {
 		slog.Error("security_path_validation_failed", "path", tarPath, "reason", "absolute_path")
-		return fmt.Errorf("security: absolute path not allowed: %s", tarPath)
+		return errors.Fatal(fmt.Errorf("%w: absolute path not allowed: %s", ErrRejected, tarPath))
 	}
 
 	// Clean the path
@@ -47,7 +140,7 @@ func (v *Validator) ValidatePath(tarPath string) error {
 	// Reject paths that start with .. (escape current directory)
 	if strings.HasPrefix(clean, "..") {
 		slog.Error("security_path_validation_failed", "path", tarPath, "reason", "path_traversal")
-		return fmt.Errorf("security: path traversal detected: %s", tarPath)
+		return errors.Fatal(fmt.Errorf("%w: path traversal detected: %s", ErrRejected, tarPath))
 	}
 
 	return nil
@@ -57,9 +150,27 @@ func (v *Validator) ValidatePath(tarPath string) error {
 // symlinkPath: where the symlink is located (e.g., "/etc/fonts/conf.d/foo")
 // targetPath: where the symlink points to (e.g., "../conf.avail/bar")
 func (v *Validator) ValidateSymlink(symlinkPath, targetPath string) error {
+	if r, ok := controlChar(targetPath); ok {
+		slog.Error("security_symlink_validation_failed", "symlink", symlinkPath, "target", targetPath, "reason", "control_character")
+		return errors.Fatal(fmt.Errorf("%w: symlink %s target contains control character %U: %q", ErrRejected,
+			symlinkPath, r, targetPath))
+	}
+	if len(targetPath) > v.maxSymlinkTarget {
+		slog.Error("security_symlink_validation_failed", "symlink", symlinkPath, "target_length", len(targetPath),
+			"max_target_length", v.maxSymlinkTarget, "reason", "target_too_long")
+		return errors.Fatal(fmt.Errorf("%w: symlink %s target is %d bytes, max %d", ErrRejected,
+			symlinkPath, len(targetPath), v.maxSymlinkTarget))
+	}
+
 	// Absolute symlink targets are allowed (container-relative)
-	// e.g., symlink /bin/sh -> /usr/bin/dash
+	// e.g., symlink /bin/sh -> /usr/bin/dash, unless an allowlist says
+	// otherwise
 	if filepath.IsAbs(targetPath) {
+		if v.symlinkAllowlist != nil && !v.allowedAbsolute(targetPath) {
+			slog.Error("security_symlink_validation_failed", "symlink", symlinkPath, "target", targetPath, "reason", "absolute_target_not_allowed")
+			return errors.Fatal(fmt.Errorf("%w: symlink %s target %s is outside the allowed absolute prefixes %v", ErrRejected,
+				symlinkPath, targetPath, v.symlinkAllowlist))
+		}
 		slog.Info("security_symlink_validated", "symlink", symlinkPath, "target", targetPath, "type", "absolute")
 		return nil
 	}
@@ -91,8 +202,8 @@ func (v *Validator) ValidateSymlink(symlinkPath, targetPath string) error {
 			"target", targetPath,
 			"resolved", cleanResolved,
 			"depth", depth)
-		return fmt.Errorf("security: path traversal detected: symlink %s -> %s resolves to %s",
-			symlinkPath, targetPath, cleanResolved)
+		return errors.Fatal(fmt.Errorf("%w: path traversal detected: symlink %s -> %s resolves to %s", ErrRejected,
+			symlinkPath, targetPath, cleanResolved))
 	}
 
 	slog.Info("security_symlink_validated", "symlink", symlinkPath, "target", targetPath, "type", "relative")
@@ -105,7 +216,7 @@ func (v *Validator) ValidateFileSize(size int64) error {
 		slog.Error("security_file_size_exceeded",
 			"file_size_mb", size/1024/1024,
 			"max_file_size_mb", v.maxFileSize/1024/1024)
-		return fmt.Errorf("security: file size %d exceeds max %d", size, v.maxFileSize)
+		return errors.Fatal(fmt.Errorf("%w: file size %d exceeds max %d", ErrRejected, size, v.maxFileSize))
 	}
 	return nil
 }
@@ -122,8 +233,8 @@ func (v *Validator) AddExtractedSize(size int64) error {
 			"current_total_mb", v.currentTotalSize/1024/1024,
 			"max_total_mb", v.maxTotalSize/1024/1024,
 			"file_size_mb", size/1024/1024)
-		return fmt.Errorf("security: total extracted size %d exceeds max %d",
-			v.currentTotalSize, v.maxTotalSize)
+		return errors.Fatal(fmt.Errorf("%w: total extracted size %d exceeds max %d", ErrRejected,
+			v.currentTotalSize, v.maxTotalSize))
 	}
 
 	return nil
@@ -133,7 +244,7 @@ func (v *Validator) AddExtractedSize(size int64) error {
 func (v *Validator) ValidateCompressionRatio(compressedSize, uncompressedSize int64) error {
 	if compressedSize == 0 {
 		slog.Error("security_compression_validation_failed", "reason", "zero_compressed_size")
-		return fmt.Errorf("security: compressed size cannot be zero")
+		return errors.Fatal(fmt.Errorf("%w: compressed size cannot be zero", ErrRejected))
 	}
 
 	ratio := float64(uncompressedSize) / float64(compressedSize)
@@ -144,8 +255,8 @@ func (v *Validator) ValidateCompressionRatio(compressedSize, uncompressedSize in
 			"max_ratio", v.maxCompressionRatio,
 			"compressed_mb", compressedSize/1024/1024,
 			"uncompressed_mb", uncompressedSize/1024/1024)
-		return fmt.Errorf("security: compression ratio %.2f exceeds max %.2f (compressed: %d, uncompressed: %d)",
-			ratio, v.maxCompressionRatio, compressedSize, uncompressedSize)
+		return errors.Fatal(fmt.Errorf("%w: compression ratio %.2f exceeds max %.2f (compressed: %d, uncompressed: %d)", ErrRejected,
+			ratio, v.maxCompressionRatio, compressedSize, uncompressedSize))
 	}
 
 	slog.Info("security_compression_validated", "ratio", ratio, "compressed_mb", compressedSize/1024/1024, "uncompressed_mb", uncompressedSize/1024/1024)
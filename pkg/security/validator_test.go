@@ -1,6 +1,8 @@
 package security
 
 import (
+	"errors"
+	"strings"
 	"testing"
 )
 
@@ -17,6 +19,12 @@ func TestValidatePath_PathTraversal(t *testing.T) {
 		{"/etc/passwd", true},
 		{"dir/../file.txt", false},
 		{"dir/../../etc/passwd", true},
+		{"dir/file\x00.txt", true},
+		{"dir/file\n.txt", true},
+		{"dir/file\r.txt", true},
+		{"dir/\x1b[31mred", true},
+		{"dir/file\x7f", true},
+		{"dir/file\twith-tab", false},
 	}
 
 	for _, tt := range tests {
@@ -65,3 +73,69 @@ func TestAddExtractedSize_ExceedsTotal(t *testing.T) {
 		t.Error("expected error when total extracted exceeds limit")
 	}
 }
+
+func TestValidateSymlink_TargetLengthAndControlCharacters(t *testing.T) {
+	tests := []struct {
+		name      string
+		maxTarget int
+		target    string
+		shouldErr bool
+	}{
+		{"short target", 0, "../lib/libc.so", false},
+		{"at default limit", 0, "/" + strings.Repeat("a", DefaultMaxSymlinkTarget-1), false},
+		{"over default limit", 0, "/" + strings.Repeat("a", DefaultMaxSymlinkTarget), true},
+		{"at configured limit", 16, strings.Repeat("a", 16), false},
+		{"over configured limit", 16, strings.Repeat("a", 17), true},
+		{"embedded NUL", 0, "/usr/bin/da\x00sh", true},
+		{"embedded newline", 0, "target\nsecond-line", true},
+		{"embedded escape", 0, "\x1b]0;title\x07", true},
+		{"tab allowed", 0, "odd\tname", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewValidator(1024, 1024, 10.0, WithMaxSymlinkTarget(tt.maxTarget))
+			err := v.ValidateSymlink("usr/bin/sh", tt.target)
+			if tt.shouldErr {
+				if !errors.Is(err, ErrRejected) {
+					t.Errorf("ValidateSymlink(%q) = %v, want rejection", tt.target, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("ValidateSymlink(%q) = %v, want nil", tt.target, err)
+			}
+		})
+	}
+}
+
+func TestValidateSymlink_AbsoluteAllowlist(t *testing.T) {
+	strict := NewValidator(1024, 1024, 10.0, WithAbsoluteSymlinkAllowlist("/usr", "/bin", "/lib/"))
+	permissive := NewValidator(1024, 1024, 10.0)
+
+	tests := []struct {
+		target    string
+		shouldErr bool
+	}{
+		{"/usr/bin/dash", false},
+		{"/bin", false},
+		{"/lib/x86_64-linux-gnu/libc.so.6", false},
+		{"../lib/libc.so", false},
+		{"/etc/shadow", true},
+		{"/usr/../etc/shadow", true},
+		{"/usrlocal/bin/tool", true},
+		{"/", true},
+	}
+	for _, tt := range tests {
+		err := strict.ValidateSymlink("usr/bin/sh", tt.target)
+		if tt.shouldErr && !errors.Is(err, ErrRejected) {
+			t.Errorf("strict ValidateSymlink(%q) = %v, want rejection", tt.target, err)
+		}
+		if !tt.shouldErr && err != nil {
+			t.Errorf("strict ValidateSymlink(%q) = %v, want nil", tt.target, err)
+		}
+		if err := permissive.ValidateSymlink("usr/bin/sh", tt.target); err != nil {
+			t.Errorf("permissive ValidateSymlink(%q) = %v, want nil", tt.target, err)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/fly-io/162719/pkg/clock"
+	"github.com/fly-io/162719/pkg/errors"
+)
+
+// ErrCircuitOpen is returned for downloads refused while a Breaker waits
+// for its probe to come back
+var ErrCircuitOpen = errors.New("download circuit open")
+
+// Breaker is a circuit breaker shared by every download against a source,
+// so a throttling or unreachable endpoint isn't hammered by each image's
+// retries independently. After threshold consecutive transient failures it
+// opens: new downloads pause for the cooldown, then one probe is let
+// through while the rest fail fast with ErrCircuitOpen. A successful probe
+// closes the circuit; a failed one reopens it for another cooldown.
+type Breaker struct {
+	threshold int
+	cooldown  time.Duration
+	clock     clock.Clock
+	// wait sleeps for d or until ctx is done; tests replace it
+	wait func(ctx context.Context, d time.Duration) error
+
+	mu       sync.Mutex
+	failures int // consecutive transient failures
+	open     bool
+	openedAt time.Time
+	probing  bool
+}
+
+// NewBreaker returns a closed Breaker
+func NewBreaker(threshold int, cooldown time.Duration, c clock.Clock) *Breaker {
+	return &Breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		clock:     c,
+		wait:      sleepContext,
+	}
+}
+
+// Do runs download through the breaker and records its outcome. A nil
+// Breaker runs download directly.
+func (b *Breaker) Do(ctx context.Context, download func() error) error {
+	if b == nil {
+		return download()
+	}
+
+	probe, err := b.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	err = download()
+	b.record(probe, err)
+	return err
+}
+
+// acquire waits out the cooldown of an open circuit and reports whether
+// the caller is the probe
+func (b *Breaker) acquire(ctx context.Context) (bool, error) {
+	for {
+		b.mu.Lock()
+		if !b.open {
+			b.mu.Unlock()
+			return false, nil
+		}
+		if remaining := b.cooldown - b.clock.Now().Sub(b.openedAt); remaining > 0 {
+			b.mu.Unlock()
+			slog.Warn("download_paused", "reason", "circuit_open", "remaining", remaining)
+			if err := b.wait(ctx, remaining); err != nil {
+				return false, err
+			}
+			continue
+		}
+		if b.probing {
+			b.mu.Unlock()
+			return false, errors.Transient(fmt.Errorf("%w: waiting for probe", ErrCircuitOpen))
+		}
+		b.probing = true
+		b.mu.Unlock()
+		slog.Info("download_circuit_probe")
+		return true, nil
+	}
+}
+
+// record updates the breaker with a download's outcome. Only transient
+// failures count against the endpoint; any other answer, such as a missing
+// object, shows it is reachable.
+func (b *Breaker) record(probe bool, err error) {
+	if errors.Is(err, context.Canceled) {
+		if probe {
+			b.mu.Lock()
+			b.probing = false
+			b.mu.Unlock()
+		}
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe {
+		b.probing = false
+	}
+
+	if err == nil || !errors.IsTransient(err) {
+		if b.open {
+			slog.Info("download_circuit_closed")
+		}
+		b.open = false
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if probe || (!b.open && b.failures >= b.threshold) {
+		b.open = true
+		b.openedAt = b.clock.Now()
+		slog.Warn("download_circuit_opened", "consecutive_failures", b.failures, "cooldown", b.cooldown, "error", err)
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fly-io/162719/pkg/clock"
+	"github.com/fly-io/162719/pkg/errors"
+)
+
+func TestBreaker_BurstOfFailuresTripsCircuit(t *testing.T) {
+	fake := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	b := NewBreaker(3, 10*time.Second, fake)
+	var waited []time.Duration
+	b.wait = func(ctx context.Context, d time.Duration) error {
+		waited = append(waited, d)
+		fake.Advance(d)
+		return nil
+	}
+
+	throttled := errors.Transient(fmt.Errorf("%w: SlowDown", ErrNetwork))
+	calls := 0
+	fail := func() error { calls++; return throttled }
+	succeed := func() error { calls++; return nil }
+	ctx := context.Background()
+
+	// Throttling across three images in a row opens the circuit
+	for i := 0; i < 3; i++ {
+		if err := b.Do(ctx, fail); err != throttled {
+			t.Fatalf("download %d error = %v, want throttled", i, err)
+		}
+	}
+	if len(waited) != 0 {
+		t.Fatalf("paused before the threshold: %v", waited)
+	}
+
+	// The next download waits out the cooldown and becomes the probe;
+	// others arriving meanwhile fail fast without touching the endpoint
+	var concurrent error
+	err := b.Do(ctx, func() error {
+		calls++
+		concurrent = b.Do(ctx, succeed)
+		return throttled
+	})
+	if err != throttled {
+		t.Fatalf("probe error = %v, want throttled", err)
+	}
+	if len(waited) != 1 || waited[0] != 10*time.Second {
+		t.Errorf("waited %v, want one 10s cooldown", waited)
+	}
+	if !errors.Is(concurrent, ErrCircuitOpen) || !errors.IsTransient(concurrent) {
+		t.Errorf("download during probe = %v, want transient ErrCircuitOpen", concurrent)
+	}
+	if calls != 4 {
+		t.Errorf("endpoint called %d times, want 4 (the probe only)", calls)
+	}
+
+	// The failed probe reopened the circuit; the next probe succeeds and
+	// closes it
+	if err := b.Do(ctx, succeed); err != nil {
+		t.Fatalf("second probe failed: %v", err)
+	}
+	if len(waited) != 2 {
+		t.Errorf("waited %v, want a second cooldown after the failed probe", waited)
+	}
+	if err := b.Do(ctx, succeed); err != nil {
+		t.Fatalf("download after close failed: %v", err)
+	}
+	if len(waited) != 2 {
+		t.Errorf("paused with the circuit closed: %v", waited)
+	}
+}
+
+func TestBreaker_NonTransientErrorsResetCount(t *testing.T) {
+	fake := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	b := NewBreaker(2, time.Minute, fake)
+	b.wait = func(ctx context.Context, d time.Duration) error {
+		t.Fatalf("paused for %v with the circuit closed", d)
+		return nil
+	}
+
+	ctx := context.Background()
+	throttled := errors.Transient(fmt.Errorf("%w: SlowDown", ErrNetwork))
+	notFound := errors.Fatal(fmt.Errorf("%w: NoSuchKey", ErrNotFound))
+
+	// A missing object proves the endpoint answered, so failures on
+	// either side of it aren't consecutive
+	for _, err := range []error{throttled, notFound, throttled, notFound, throttled} {
+		b.Do(ctx, func() error { return err })
+	}
+	if err := b.Do(ctx, func() error { return nil }); err != nil {
+		t.Errorf("download failed: %v", err)
+	}
+}
+
+func TestBreaker_NilRunsDirectly(t *testing.T) {
+	var b *Breaker
+	called := false
+	if err := b.Do(context.Background(), func() error { called = true; return nil }); err != nil || !called {
+		t.Errorf("nil breaker: called=%v err=%v", called, err)
+	}
+}
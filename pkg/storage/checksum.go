@@ -0,0 +1,36 @@
+package storage
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/fly-io/162719/pkg/errors"
+)
+
+// s3SHA256 returns the full-object SHA-256 S3 reported for an object, as
+// base64, or "" if it reported none. Objects uploaded in parts carry a
+// composite checksum ("<base64>-<parts>"), a hash of the part hashes,
+// which can't be compared with a hash of the body and is ignored.
+func s3SHA256(s3Key string, value *string) string {
+	checksum := aws.ToString(value)
+	if strings.Contains(checksum, "-") {
+		slog.Info("s3_checksum_skipped", "s3_key", s3Key, "reason", "composite")
+		return ""
+	}
+	return checksum
+}
+
+// verifySHA256 compares the SHA-256 sum of a downloaded body with the
+// base64 checksum S3 stored for it
+func verifySHA256(s3Key, want string, sum []byte) error {
+	got := base64.StdEncoding.EncodeToString(sum)
+	if got == want {
+		slog.Info("s3_checksum_verified", "s3_key", s3Key, "algorithm", "sha256")
+		return nil
+	}
+	slog.Error("s3_checksum_mismatch", "s3_key", s3Key, "expected", want, "actual", got)
+	return errors.Transient(fmt.Errorf("%w: %s: S3 sha256 %s, downloaded %s", ErrChecksumMismatch, s3Key, want, got))
+}
@@ -4,26 +4,75 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"hash"
 	"io"
 	"log/slog"
+	"math"
 	"os"
+	"path"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/fly-io/162719/pkg/errors"
 )
 
 // Client provides S3 storage operations
 type Client struct {
-	s3Client *s3.Client
-	bucket   string
+	s3Client      *s3.Client
+	bucket        string
+	hashAlgorithm string
+	hashFunc      func() hash.Hash
+	partSize      int64
+	concurrency   int
+}
+
+// ClientOptions configures optional Client behavior
+type ClientOptions struct {
+	// HashAlgorithm names the download digest algorithm (default sha256)
+	HashAlgorithm string
+	// HashFunc overrides the hash constructor; when nil it is looked up
+	// from HashAlgorithm
+	HashFunc func() hash.Hash
+	// PartSize is the byte size of each ranged GET when Concurrency > 1
+	// (default DefaultPartSize). Objects no larger than one part are
+	// downloaded as a single stream.
+	PartSize int64
+	// Concurrency is the number of parts fetched at once (<= 1 disables
+	// ranged downloads)
+	Concurrency int
+}
+
+// withDefaults fills in the default hash algorithm and resolves HashFunc
+func (o ClientOptions) withDefaults() (ClientOptions, error) {
+	if o.HashAlgorithm == "" {
+		o.HashAlgorithm = DefaultHashAlgorithm
+	}
+	if o.HashFunc == nil {
+		hashFunc, err := HashFunc(o.HashAlgorithm)
+		if err != nil {
+			return o, err
+		}
+		o.HashFunc = hashFunc
+	}
+	if o.PartSize <= 0 {
+		o.PartSize = DefaultPartSize
+	}
+	return o, nil
 }
 
 // NewClient creates a new S3 client for anonymous access
-func NewClient(ctx context.Context, bucket, region string) (*Client, error) {
+func NewClient(ctx context.Context, bucket, region string, opts ClientOptions) (*Client, error) {
 	slog.Info("s3_client_init", "bucket", bucket, "region", region)
 
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+
 	// Load AWS config with anonymous credentials
 	cfg, err := config.LoadDefaultConfig(ctx,
 		config.WithRegion(region),
@@ -40,30 +89,71 @@ func NewClient(ctx context.Context, bucket, region string) (*Client, error) {
 	slog.Info("s3_client_created", "bucket", bucket)
 
 	return &Client{
-		s3Client: s3Client,
-		bucket:   bucket,
+		s3Client:      s3Client,
+		bucket:        bucket,
+		hashAlgorithm: opts.HashAlgorithm,
+		hashFunc:      opts.HashFunc,
+		partSize:      opts.PartSize,
+		concurrency:   opts.Concurrency,
 	}, nil
 }
 
 // DownloadResult contains download metadata
 type DownloadResult struct {
-	LocalPath string
-	SHA256    string
-	Size      int64
+	LocalPath    string
+	Algorithm    string
+	Digest       string // prefixed with Algorithm, e.g. "sha256:<hex>"
+	Size         int64
+	ETag         string
+	LastModified time.Time
+}
+
+// ObjectInfo contains object metadata returned by HeadObject
+type ObjectInfo struct {
+	ETag         string
+	LastModified time.Time
+	Size         int64
+	// ContentType is the object's Content-Type; "" when the source has none
+	ContentType string
+	// ChecksumSHA256 is the base64 full-object SHA-256 S3 stored for the
+	// object; "" when it has none or only a composite one
+	ChecksumSHA256 string
 }
 
-// Download downloads an object from S3 and computes SHA256
+// Download downloads an object from S3 and computes its digest. With
+// Concurrency > 1, objects larger than PartSize are fetched as parallel
+// ranged GETs, falling back to a single stream if ranges are refused.
 func (c *Client) Download(ctx context.Context, s3Key, localPath string) (*DownloadResult, error) {
 	slog.Info("s3_download_start", "bucket", c.bucket, "s3_key", s3Key)
 
+	if c.concurrency > 1 {
+		info, err := c.Head(ctx, s3Key)
+		if err != nil {
+			return nil, err
+		}
+		if c.useRangedDownload(info.Size) {
+			result, err := c.downloadRanged(ctx, s3Key, localPath, info)
+			if !errors.Is(err, errRangeUnsupported) {
+				return result, err
+			}
+			slog.Warn("s3_range_unsupported", "s3_key", s3Key, "fallback", "single_stream")
+		}
+	}
+
+	return c.downloadStream(ctx, s3Key, localPath)
+}
+
+// downloadStream fetches the whole object with a single GetObject
+func (c *Client) downloadStream(ctx context.Context, s3Key, localPath string) (*DownloadResult, error) {
 	// Get object from S3
 	result, err := c.s3Client.GetObject(ctx, &s3.GetObjectInput{
-		Bucket: aws.String(c.bucket),
-		Key:    aws.String(s3Key),
+		Bucket:       aws.String(c.bucket),
+		Key:          aws.String(s3Key),
+		ChecksumMode: types.ChecksumModeEnabled,
 	})
 	if err != nil {
 		slog.Error("s3_get_object_failed", "s3_key", s3Key, "error", err)
-		return nil, errors.Wrap(err, "failed to get object from S3")
+		return nil, classifyS3Error(err, "failed to get object from S3")
 	}
 	defer result.Body.Close()
 
@@ -75,14 +165,39 @@ func (c *Client) Download(ctx context.Context, s3Key, localPath string) (*Downlo
 	}
 	defer f.Close()
 
-	// Copy data and compute SHA256
-	hash := sha256.New()
+	// Copy data and compute digest, plus S3's SHA-256 when it has one
+	hash := c.hashFunc()
 	writer := io.MultiWriter(f, hash)
+	wantSHA256 := s3SHA256(s3Key, result.ChecksumSHA256)
+	// S3's SHA-256 gets a hash of its own: the client's may be a custom
+	// HashFunc under the sha256 name
+	sha := sha256.New()
+	if wantSHA256 != "" {
+		writer = io.MultiWriter(f, hash, sha)
+	}
 
 	size, err := io.Copy(writer, result.Body)
 	if err != nil {
+		// The SDK checks the checksum itself and fails the read that ends
+		// the body; a complete body means the error is a mismatch
+		if wantSHA256 != "" && size == aws.ToInt64(result.ContentLength) {
+			if verr := verifySHA256(s3Key, wantSHA256, sha.Sum(nil)); verr != nil {
+				f.Close()
+				os.Remove(localPath)
+				return nil, verr
+			}
+		}
 		slog.Error("s3_download_failed", "s3_key", s3Key, "error", err)
-		return nil, errors.Wrap(err, "failed to download file")
+		return nil, classifyS3Error(err, "failed to download file")
+	}
+	if wantSHA256 != "" {
+		if err := verifySHA256(s3Key, wantSHA256, sha.Sum(nil)); err != nil {
+			// A corrupt file left behind could pass for the recorded
+			// download on the next run
+			f.Close()
+			os.Remove(localPath)
+			return nil, err
+		}
 	}
 
 	// Compute checksum
@@ -92,45 +207,130 @@ func (c *Client) Download(ctx context.Context, s3Key, localPath string) (*Downlo
 		"s3_key", s3Key,
 		"size_mb", size/1024/1024,
 		"local_path", localPath,
-		"sha256", checksum[:16]+"...",
+		"algorithm", c.hashAlgorithm,
+		"digest", checksum[:16]+"...",
 	)
 
 	return &DownloadResult{
-		LocalPath: localPath,
-		SHA256:    checksum,
-		Size:      size,
+		LocalPath:    localPath,
+		Algorithm:    c.hashAlgorithm,
+		Digest:       FormatDigest(c.hashAlgorithm, checksum),
+		Size:         size,
+		ETag:         normalizeETag(aws.ToString(result.ETag)),
+		LastModified: aws.ToTime(result.LastModified),
 	}, nil
 }
 
+// Head retrieves object metadata without downloading the body
+func (c *Client) Head(ctx context.Context, s3Key string) (*ObjectInfo, error) {
+	result, err := c.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(c.bucket),
+		Key:          aws.String(s3Key),
+		ChecksumMode: types.ChecksumModeEnabled,
+	})
+	if err != nil {
+		slog.Error("s3_head_object_failed", "s3_key", s3Key, "error", err)
+		return nil, classifyS3Error(err, "failed to head object")
+	}
+
+	info := &ObjectInfo{
+		ETag:         normalizeETag(aws.ToString(result.ETag)),
+		LastModified: aws.ToTime(result.LastModified),
+		Size:         aws.ToInt64(result.ContentLength),
+		ContentType:  aws.ToString(result.ContentType),
+		// Ranged downloads are checked against it, since no part carries it
+		ChecksumSHA256: s3SHA256(s3Key, result.ChecksumSHA256),
+	}
+
+	slog.Info("s3_head_object_complete", "s3_key", s3Key, "etag", info.ETag, "size", info.Size, "content_type", info.ContentType)
+	return info, nil
+}
+
+// LocalName returns a collision-free local filename for an S3 key.
+// Keys sharing a basename (a/img.tar, b/img.tar) map to distinct names:
+// a short hash of the full key is prefixed to the sanitized basename.
+func LocalName(s3Key string) string {
+	sum := sha256.Sum256([]byte(s3Key))
+	base := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, path.Base(s3Key))
+	return hex.EncodeToString(sum[:8]) + "-" + base
+}
+
+// normalizeETag strips the quotes S3 wraps around ETag values
+func normalizeETag(etag string) string {
+	return strings.Trim(etag, `"`)
+}
+
 // ListObjects lists all objects in the bucket with a given prefix
 func (c *Client) ListObjects(ctx context.Context, prefix string) ([]string, error) {
-	slog.Info("s3_list_start", "bucket", c.bucket, "prefix", prefix)
+	keys, _, err := c.ListObjectsLimit(ctx, prefix, "", 0)
+	return keys, err
+}
+
+// ListObjectsLimit lists up to limit objects with a given prefix,
+// starting at token ("" for the start of the prefix). Each page asks S3
+// for no more keys than are still wanted, so nothing past limit is
+// fetched. nextToken resumes the listing where it stopped and is "" once
+// the prefix is exhausted. limit <= 0 lists everything.
+func (c *Client) ListObjectsLimit(ctx context.Context, prefix, token string, limit int) (keys []string, nextToken string, err error) {
+	slog.Info("s3_list_start", "bucket", c.bucket, "prefix", prefix, "limit", limit)
+
+	for {
+		maxKeys := 0
+		if limit > 0 {
+			maxKeys = limit - len(keys)
+		}
+		page, next, err := c.ListObjectsPage(ctx, prefix, token, maxKeys)
+		if err != nil {
+			return nil, "", err
+		}
+		keys = append(keys, page...)
+		token = next
+		if token == "" || (limit > 0 && len(keys) >= limit) {
+			break
+		}
+	}
+
+	slog.Info("s3_list_complete", "prefix", prefix, "object_count", len(keys), "truncated", token != "")
+
+	return keys, token, nil
+}
 
+// ListObjectsPage lists one page of up to maxKeys objects with a given
+// prefix, starting at token ("" for the first page). maxKeys <= 0 uses
+// the S3 default of 1000. nextToken is "" on the last page.
+func (c *Client) ListObjectsPage(ctx context.Context, prefix, token string, maxKeys int) (keys []string, nextToken string, err error) {
 	input := &s3.ListObjectsV2Input{
 		Bucket: aws.String(c.bucket),
 		Prefix: aws.String(prefix),
 	}
+	if token != "" {
+		input.ContinuationToken = aws.String(token)
+	}
+	if maxKeys > 0 {
+		input.MaxKeys = aws.Int32(int32(min(maxKeys, math.MaxInt32)))
+	}
 
-	var keys []string
-	paginator := s3.NewListObjectsV2Paginator(c.s3Client, input)
-
-	for paginator.HasMorePages() {
-		page, err := paginator.NextPage(ctx)
-		if err != nil {
-			slog.Error("s3_list_failed", "prefix", prefix, "error", err)
-			return nil, errors.Wrap(err, "failed to list objects")
-		}
+	page, err := c.s3Client.ListObjectsV2(ctx, input)
+	if err != nil {
+		slog.Error("s3_list_failed", "prefix", prefix, "error", err)
+		return nil, "", errors.Wrap(err, "failed to list objects")
+	}
 
-		for _, obj := range page.Contents {
-			if obj.Key != nil {
-				keys = append(keys, *obj.Key)
-			}
+	for _, obj := range page.Contents {
+		if obj.Key != nil {
+			keys = append(keys, *obj.Key)
 		}
 	}
-
-	slog.Info("s3_list_complete", "prefix", prefix, "object_count", len(keys))
-
-	return keys, nil
+	if aws.ToBool(page.IsTruncated) {
+		nextToken = aws.ToString(page.NextContinuationToken)
+	}
+	return keys, nextToken, nil
 }
 
 // Exists checks if an object exists in S3
@@ -141,13 +341,12 @@ func (c *Client) Exists(ctx context.Context, s3Key string) (bool, error) {
 	})
 
 	if err != nil {
-		// Check if it's a NotFound error
-		if err.Error() == "NotFound" {
+		if isS3NotFound(err) {
 			slog.Info("s3_object_not_found", "s3_key", s3Key)
 			return false, nil
 		}
 		slog.Error("s3_head_object_failed", "s3_key", s3Key, "error", err)
-		return false, errors.Wrap(err, "failed to check object existence")
+		return false, classifyS3Error(err, "failed to check object existence")
 	}
 
 	slog.Info("s3_object_exists", "s3_key", s3Key)
@@ -0,0 +1,327 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/fly-io/162719/pkg/errors"
+)
+
+// newTestClient returns a Client backed by an in-process fake S3 serving objects
+func newTestClient(t *testing.T, objects map[string]string) *Client {
+	return newTestClientWithHash(t, objects, DefaultHashAlgorithm)
+}
+
+func newTestClientWithHash(t *testing.T, objects map[string]string, algorithm string) *Client {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Path-style addressing: /<bucket>/<key>
+		key := strings.TrimPrefix(r.URL.Path, "/test-bucket/")
+		body, ok := objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", `"`+key+`-etag"`)
+		w.Header().Set("Last-Modified", "Thu, 02 Jan 2025 03:04:05 GMT")
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+
+	return &Client{
+		s3Client: s3.New(s3.Options{
+			BaseEndpoint: aws.String(srv.URL),
+			Region:       "us-east-1",
+			Credentials:  aws.AnonymousCredentials{},
+			UsePathStyle: true,
+		}),
+		bucket:        "test-bucket",
+		hashAlgorithm: algorithm,
+		hashFunc:      hashAlgorithms[algorithm],
+	}
+}
+
+func TestDownload_SameBasenameDoesNotCollide(t *testing.T) {
+	objects := map[string]string{
+		"a/img.tar": "first image contents",
+		"b/img.tar": "second image contents",
+	}
+	client := newTestClient(t, objects)
+	dir := t.TempDir()
+
+	for key := range objects {
+		localPath := filepath.Join(dir, LocalName(key))
+		if _, err := client.Download(context.Background(), key, localPath); err != nil {
+			t.Fatalf("download %s failed: %v", key, err)
+		}
+	}
+
+	for key, body := range objects {
+		data, err := os.ReadFile(filepath.Join(dir, LocalName(key)))
+		if err != nil {
+			t.Fatalf("download of %s missing: %v", key, err)
+		}
+		want := sha256.Sum256([]byte(body))
+		got := sha256.Sum256(data)
+		if got != want {
+			t.Errorf("%s: checksum %s, want %s", key, hex.EncodeToString(got[:]), hex.EncodeToString(want[:]))
+		}
+	}
+}
+
+func TestLocalName(t *testing.T) {
+	if LocalName("a/img.tar") == LocalName("b/img.tar") {
+		t.Error("keys with the same basename must map to distinct names")
+	}
+	if LocalName("a/img.tar") != LocalName("a/img.tar") {
+		t.Error("LocalName must be deterministic")
+	}
+
+	for _, key := range []string{"../../etc/passwd", "a/..", "img\x00.tar", ""} {
+		name := LocalName(key)
+		if strings.ContainsAny(name, "/\x00") || name == "." || name == ".." {
+			t.Errorf("LocalName(%q) = %q is not a safe filename", key, name)
+		}
+	}
+}
+
+func TestDownload_HashAlgorithms(t *testing.T) {
+	objects := map[string]string{"img.tar": "abc"}
+	tests := []struct {
+		algorithm string
+		want      string
+	}{
+		{"sha256", "sha256:ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{"sha512", "sha512:ddaf35a193617abacc417349ae20413112e6fa4e89a97ea20a9eeee64b55d39a2192992a274fc1a836ba3c23a3feebbd454d4423643ce80e2a9ac94fa54ca49f"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			client := newTestClientWithHash(t, objects, tt.algorithm)
+			localPath := filepath.Join(t.TempDir(), "img.tar")
+
+			result, err := client.Download(context.Background(), "img.tar", localPath)
+			if err != nil {
+				t.Fatalf("download failed: %v", err)
+			}
+			if result.Algorithm != tt.algorithm || result.Digest != tt.want {
+				t.Errorf("got %s %s, want %s", result.Algorithm, result.Digest, tt.want)
+			}
+
+			digest, err := FileDigest(localPath, tt.algorithm)
+			if err != nil {
+				t.Fatalf("file digest failed: %v", err)
+			}
+			if digest != tt.want {
+				t.Errorf("FileDigest = %s, want %s", digest, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDigest(t *testing.T) {
+	if algo, hex := ParseDigest("sha512:abcd"); algo != "sha512" || hex != "abcd" {
+		t.Errorf("ParseDigest prefixed = %s, %s", algo, hex)
+	}
+	if algo, hex := ParseDigest("abcd"); algo != DefaultHashAlgorithm || hex != "abcd" {
+		t.Errorf("ParseDigest legacy = %s, %s", algo, hex)
+	}
+}
+
+func TestDownload_VerifiesS3Checksum(t *testing.T) {
+	const body = "image contents"
+	sum := sha256.Sum256([]byte(body))
+	matching := base64.StdEncoding.EncodeToString(sum[:])
+	other := sha256.Sum256([]byte("other contents"))
+	mismatching := base64.StdEncoding.EncodeToString(other[:])
+
+	tests := []struct {
+		name      string
+		checksum  string
+		algorithm string
+		wantErr   bool
+	}{
+		{name: "matching", checksum: matching, algorithm: "sha256"},
+		{name: "matching with another digest algorithm", checksum: matching, algorithm: "sha512"},
+		{name: "mismatching", checksum: mismatching, algorithm: "sha256", wantErr: true},
+		{name: "mismatching with another digest algorithm", checksum: mismatching, algorithm: "sha512", wantErr: true},
+		{name: "composite is skipped", checksum: mismatching + "-3", algorithm: "sha256"},
+		{name: "absent", algorithm: "sha256"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var checksumMode string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				checksumMode = r.Header.Get("x-amz-checksum-mode")
+				if tt.checksum != "" {
+					w.Header().Set("x-amz-checksum-sha256", tt.checksum)
+				}
+				w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+				w.Write([]byte(body))
+			}))
+			defer srv.Close()
+			client := &Client{
+				s3Client: s3.New(s3.Options{
+					BaseEndpoint: aws.String(srv.URL),
+					Region:       "us-east-1",
+					Credentials:  aws.AnonymousCredentials{},
+					UsePathStyle: true,
+				}),
+				bucket:        "test-bucket",
+				hashAlgorithm: tt.algorithm,
+				hashFunc:      hashAlgorithms[tt.algorithm],
+			}
+
+			_, err := client.Download(context.Background(), "img.tar", filepath.Join(t.TempDir(), "img.tar"))
+			if checksumMode != "ENABLED" {
+				t.Errorf("x-amz-checksum-mode = %q, want ENABLED", checksumMode)
+			}
+			if tt.wantErr {
+				if !errors.Is(err, ErrChecksumMismatch) {
+					t.Fatalf("err = %v, want a checksum mismatch", err)
+				}
+				if !errors.IsTransient(err) {
+					t.Errorf("checksum mismatch should be transient: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("download failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestDownload_ChecksumMismatchRemovesFile(t *testing.T) {
+	const body = "image contents"
+	sum := sha256.Sum256([]byte(body))
+	other := sha256.Sum256([]byte("other contents"))
+
+	var gets int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gets++
+		// The first response is corrupt, the retry is good
+		checksum := sum[:]
+		if gets == 1 {
+			checksum = other[:]
+		}
+		w.Header().Set("x-amz-checksum-sha256", base64.StdEncoding.EncodeToString(checksum))
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+	client := clientForEndpoint(srv.URL)
+	localPath := filepath.Join(t.TempDir(), "img.tar")
+
+	if _, err := client.Download(context.Background(), "img.tar", localPath); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("err = %v, want a checksum mismatch", err)
+	}
+	if _, err := os.Stat(localPath); !os.IsNotExist(err) {
+		t.Fatalf("mismatching download left at %s (%v)", localPath, err)
+	}
+
+	if _, err := client.Download(context.Background(), "img.tar", localPath); err != nil {
+		t.Fatalf("re-download failed: %v", err)
+	}
+	if gets != 2 {
+		t.Errorf("GETs = %d, want 2", gets)
+	}
+	if data, err := os.ReadFile(localPath); err != nil || string(data) != body {
+		t.Errorf("re-downloaded file = %q (%v), want %q", data, err, body)
+	}
+}
+
+func TestDownload_S3ChecksumIgnoresCustomHashFunc(t *testing.T) {
+	const body = "image contents"
+	sum := sha256.Sum256([]byte(body))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("x-amz-checksum-sha256", base64.StdEncoding.EncodeToString(sum[:]))
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	// A custom hash under the sha256 name must not stand in for S3's SHA-256
+	client := clientForEndpoint(srv.URL)
+	client.hashFunc = sha512.New
+	if _, err := client.Download(context.Background(), "img.tar", filepath.Join(t.TempDir(), "img.tar")); err != nil {
+		t.Fatalf("download failed: %v", err)
+	}
+}
+
+func TestOpen_VerifiesS3Checksum(t *testing.T) {
+	const body = "image contents"
+	sum := sha256.Sum256([]byte(body))
+	matching := base64.StdEncoding.EncodeToString(sum[:])
+	other := sha256.Sum256([]byte("other contents"))
+	mismatching := base64.StdEncoding.EncodeToString(other[:])
+
+	tests := []struct {
+		name      string
+		checksum  string
+		algorithm string
+		wantErr   bool
+	}{
+		{name: "matching", checksum: matching, algorithm: "sha256"},
+		{name: "matching with another digest algorithm", checksum: matching, algorithm: "sha512"},
+		{name: "mismatching", checksum: mismatching, algorithm: "sha256", wantErr: true},
+		{name: "mismatching with another digest algorithm", checksum: mismatching, algorithm: "sha512", wantErr: true},
+		{name: "absent", algorithm: "sha256"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var checksumMode string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				checksumMode = r.Header.Get("x-amz-checksum-mode")
+				if tt.checksum != "" {
+					w.Header().Set("x-amz-checksum-sha256", tt.checksum)
+				}
+				w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+				w.Write([]byte(body))
+			}))
+			defer srv.Close()
+			client := clientForEndpoint(srv.URL)
+			client.hashAlgorithm = tt.algorithm
+			client.hashFunc = hashAlgorithms[tt.algorithm]
+
+			obj, err := client.Open(context.Background(), "img.tar")
+			if err != nil {
+				t.Fatalf("open failed: %v", err)
+			}
+			defer obj.Close()
+			if checksumMode != "ENABLED" {
+				t.Errorf("x-amz-checksum-mode = %q, want ENABLED", checksumMode)
+			}
+
+			// The mismatch surfaces from the read that ends the body or
+			// from Digest, whichever checks first
+			_, err = io.Copy(io.Discard, obj)
+			if err == nil {
+				_, err = obj.Digest()
+			}
+			if tt.wantErr {
+				if !errors.Is(err, ErrChecksumMismatch) {
+					t.Fatalf("err = %v, want a checksum mismatch", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("stream failed: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressionZstd marks a file stored zstd-compressed
+const CompressionZstd = "zstd"
+
+// CompressedPath returns where a zstd-compressed copy of path is stored
+func CompressedPath(path string) string {
+	return path + ".zst"
+}
+
+// CompressFile writes a zstd-compressed copy of src to dst. dst is
+// written under a temporary name and renamed into place, so it is never
+// left truncated; src is left alone.
+func CompressFile(src, dst string) error {
+	return transformFile(src, dst, func(w io.Writer, r io.Reader) error {
+		enc, err := zstd.NewWriter(w)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(enc, r); err != nil {
+			enc.Close()
+			return err
+		}
+		return enc.Close()
+	})
+}
+
+// DecompressFile writes the decompressed contents of the zstd file src to
+// dst, with the same guarantees as CompressFile
+func DecompressFile(src, dst string) error {
+	return transformFile(src, dst, func(w io.Writer, r io.Reader) error {
+		dec, err := zstd.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer dec.Close()
+		_, err = io.Copy(w, dec)
+		return err
+	})
+}
+
+// transformFile streams src through fn into a temporary file next to dst,
+// then renames it to dst
+func transformFile(src, dst string, fn func(w io.Writer, r io.Reader) error) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmp := out.Name()
+	defer os.Remove(tmp)
+
+	if err := fn(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("%s: %w", src, err)
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
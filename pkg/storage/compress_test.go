@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompressFile_RoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "app.tar")
+	content := bytes.Repeat([]byte("zero-filled tarball\x00\x00\x00\x00"), 8192)
+	if err := os.WriteFile(src, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	compressed := CompressedPath(src)
+	if err := CompressFile(src, compressed); err != nil {
+		t.Fatalf("CompressFile: %v", err)
+	}
+	fi, err := os.Stat(compressed)
+	if err != nil {
+		t.Fatalf("compressed file missing: %v", err)
+	}
+	if fi.Size() >= int64(len(content)) {
+		t.Errorf("compressed size = %d, want under %d", fi.Size(), len(content))
+	}
+
+	restored := filepath.Join(dir, "restored.tar")
+	if err := DecompressFile(compressed, restored); err != nil {
+		t.Fatalf("DecompressFile: %v", err)
+	}
+	if got, err := os.ReadFile(restored); err != nil || !bytes.Equal(got, content) {
+		t.Errorf("round trip changed the contents (%v)", err)
+	}
+
+	// A file that isn't zstd fails without leaving a partial output
+	if err := DecompressFile(src, filepath.Join(dir, "bad.tar")); err == nil {
+		t.Error("DecompressFile of a plain file succeeded")
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 3 {
+		t.Errorf("dir holds %d files after a failed decompress, want 3", len(entries))
+	}
+}
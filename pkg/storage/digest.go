@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+// DefaultHashAlgorithm is used when no algorithm is configured and for
+// legacy digests stored without an algorithm prefix
+const DefaultHashAlgorithm = "sha256"
+
+var hashAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// HashFunc returns the hash constructor for a named algorithm
+func HashFunc(algorithm string) (func() hash.Hash, error) {
+	fn, ok := hashAlgorithms[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unsupported hash algorithm: %s", algorithm)
+	}
+	return fn, nil
+}
+
+// FormatDigest returns an unambiguous "<algorithm>:<hex>" digest string
+func FormatDigest(algorithm, hexDigest string) string {
+	return algorithm + ":" + hexDigest
+}
+
+// ParseDigest splits a digest into algorithm and hex value.
+// Digests without a prefix predate pluggable hashing and are SHA256.
+func ParseDigest(digest string) (algorithm, hexDigest string) {
+	if algorithm, hexDigest, ok := strings.Cut(digest, ":"); ok {
+		return algorithm, hexDigest
+	}
+	return DefaultHashAlgorithm, digest
+}
+
+// FileDigest computes the prefixed digest of a file with the named algorithm
+func FileDigest(path, algorithm string) (string, error) {
+	newHash, err := HashFunc(algorithm)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := newHash()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return FormatDigest(algorithm, hex.EncodeToString(h.Sum(nil))), nil
+}
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/fly-io/162719/pkg/errors"
+)
+
+// Download failure kinds. Errors returned by a Source wrap one of these
+// alongside the underlying cause and are classified with the errors
+// package: missing objects and denied access are fatal, network failures
+// are transient, as are checksum mismatches, which a fresh download may
+// not repeat.
+var (
+	ErrNotFound         = errors.New("object not found")
+	ErrAccessDenied     = errors.New("access denied")
+	ErrNetwork          = errors.New("network error")
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+)
+
+// classifyS3Error maps an S3 failure from op onto the download error kinds.
+// Anything unrecognized (throttling, server errors) is left transient.
+func classifyS3Error(err error, op string) error {
+	switch {
+	case isS3NotFound(err):
+		return errors.Fatal(fmt.Errorf("%s: %w: %w", op, ErrNotFound, err))
+	case isS3AccessDenied(err):
+		return errors.Fatal(fmt.Errorf("%s: %w: %w", op, ErrAccessDenied, err))
+	case isNetworkError(err):
+		return errors.Transient(fmt.Errorf("%s: %w: %w", op, ErrNetwork, err))
+	}
+	return errors.Transient(errors.Wrap(err, op))
+}
+
+// s3ErrorCode returns the S3 error code and HTTP status carried by err,
+// either of which may be missing. HEAD responses have no body, so they
+// only carry a generic code such as "NotFound".
+func s3ErrorCode(err error) (code string, status int) {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		code = apiErr.ErrorCode()
+	}
+	var respErr interface{ HTTPStatusCode() int }
+	if errors.As(err, &respErr) {
+		status = respErr.HTTPStatusCode()
+	}
+	return code, status
+}
+
+func isS3NotFound(err error) bool {
+	code, status := s3ErrorCode(err)
+	return code == "NoSuchKey" || code == "NotFound" || status == http.StatusNotFound
+}
+
+func isS3AccessDenied(err error) bool {
+	code, status := s3ErrorCode(err)
+	return code == "AccessDenied" || code == "Forbidden" || status == http.StatusForbidden
+}
+
+// isNetworkError reports failures to reach S3 or to finish reading a
+// response: connection errors, timeouts, and truncated bodies
+func isNetworkError(err error) bool {
+	var sendErr *smithyhttp.RequestSendError
+	var netErr net.Error
+	return errors.As(err, &sendErr) ||
+		errors.As(err, &netErr) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
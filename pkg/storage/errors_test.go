@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/fly-io/162719/pkg/errors"
+)
+
+// s3ErrorBody is the XML error document S3 returns for failed requests
+const s3ErrorBody = `<?xml version="1.0" encoding="UTF-8"?>
+<Error><Code>%s</Code><Message>%s</Message></Error>`
+
+// newErrorClient returns a Client whose fake S3 answers every request
+// with status and, for non-HEAD requests, an error document with code
+func newErrorClient(t *testing.T, status int, code string) *Client {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(status)
+		if r.Method != http.MethodHead {
+			fmt.Fprintf(w, s3ErrorBody, code, code)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return clientForEndpoint(srv.URL)
+}
+
+func clientForEndpoint(endpoint string) *Client {
+	return &Client{
+		s3Client: s3.New(s3.Options{
+			BaseEndpoint: aws.String(endpoint),
+			Region:       "us-east-1",
+			Credentials:  aws.AnonymousCredentials{},
+			UsePathStyle: true,
+			// Fail fast instead of backing off on network errors
+			RetryMaxAttempts: 1,
+		}),
+		bucket:        "test-bucket",
+		hashAlgorithm: DefaultHashAlgorithm,
+		hashFunc:      hashAlgorithms[DefaultHashAlgorithm],
+	}
+}
+
+func TestDownload_ClassifiesS3Errors(t *testing.T) {
+	// Nothing listens on a closed server's address
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closedURL := closed.URL
+	closed.Close()
+
+	tests := []struct {
+		name      string
+		client    func(t *testing.T) *Client
+		want      error
+		wantFatal bool
+	}{
+		{
+			name:      "no such key",
+			client:    func(t *testing.T) *Client { return newErrorClient(t, http.StatusNotFound, "NoSuchKey") },
+			want:      ErrNotFound,
+			wantFatal: true,
+		},
+		{
+			name:      "access denied",
+			client:    func(t *testing.T) *Client { return newErrorClient(t, http.StatusForbidden, "AccessDenied") },
+			want:      ErrAccessDenied,
+			wantFatal: true,
+		},
+		{
+			name:   "network",
+			client: func(t *testing.T) *Client { return clientForEndpoint(closedURL) },
+			want:   ErrNetwork,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := tt.client(t)
+			_, err := client.Download(context.Background(), "images/alpine.tar", filepath.Join(t.TempDir(), "out"))
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Download error = %v, want %v", err, tt.want)
+			}
+			if errors.IsFatal(err) != tt.wantFatal || errors.IsTransient(err) == tt.wantFatal {
+				t.Errorf("fatal = %v, transient = %v, want fatal %v", errors.IsFatal(err), errors.IsTransient(err), tt.wantFatal)
+			}
+		})
+	}
+}
+
+func TestDownload_ServerErrorIsTransient(t *testing.T) {
+	client := newErrorClient(t, http.StatusInternalServerError, "InternalError")
+
+	_, err := client.Download(context.Background(), "images/alpine.tar", filepath.Join(t.TempDir(), "out"))
+	if err == nil || !errors.IsTransient(err) {
+		t.Fatalf("expected transient error, got %v", err)
+	}
+	for _, kind := range []error{ErrNotFound, ErrAccessDenied, ErrNetwork} {
+		if errors.Is(err, kind) {
+			t.Errorf("server error misclassified as %v", kind)
+		}
+	}
+}
+
+func TestExists_HeadErrors(t *testing.T) {
+	exists, err := newErrorClient(t, http.StatusNotFound, "").Exists(context.Background(), "images/missing.tar")
+	if err != nil || exists {
+		t.Errorf("404: Exists = %v, %v; want false, nil", exists, err)
+	}
+
+	_, err = newErrorClient(t, http.StatusForbidden, "").Exists(context.Background(), "images/secret.tar")
+	if !errors.Is(err, ErrAccessDenied) {
+		t.Errorf("403: Exists error = %v, want ErrAccessDenied", err)
+	}
+}
@@ -0,0 +1,37 @@
+package storage
+
+import (
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+// IsMultipartETag reports whether etag has the "<md5>-<parts>" form S3
+// gives objects uploaded in parts. Such an ETag is an MD5 of the parts'
+// MD5s, so it depends on how the object was split as well as its content.
+func IsMultipartETag(etag string) bool {
+	sum, parts, ok := strings.Cut(normalizeETag(etag), "-")
+	if !ok || len(sum) != 32 {
+		return false
+	}
+	if _, err := hex.DecodeString(sum); err != nil {
+		return false
+	}
+	n, err := strconv.Atoi(parts)
+	return err == nil && n > 0
+}
+
+// CompareETags reports whether current, a fresh ETag for an object, shows
+// it unchanged since stored was recorded. A matching plain ETag is the
+// content's MD5 and is trusted. A matching multipart ETag is not trusted
+// on its own unless trustMultipart is set: verify is returned and the
+// caller should confirm with a SHA256 comparison instead.
+func CompareETags(stored, current string, trustMultipart bool) (match, verify bool) {
+	if stored == "" || normalizeETag(stored) != normalizeETag(current) {
+		return false, false
+	}
+	if IsMultipartETag(stored) && !trustMultipart {
+		return true, true
+	}
+	return true, false
+}
@@ -0,0 +1,58 @@
+package storage
+
+import "testing"
+
+func TestIsMultipartETag(t *testing.T) {
+	tests := []struct {
+		etag string
+		want bool
+	}{
+		{"9b2cf535f27731c974343645a3985328", false},
+		{`"9b2cf535f27731c974343645a3985328"`, false},
+		{"d41d8cd98f00b204e9800998ecf8427e-12", true},
+		{`"d41d8cd98f00b204e9800998ecf8427e-2"`, true},
+		{"d41d8cd98f00b204e9800998ecf8427e-0", false},
+		{"d41d8cd98f00b204e9800998ecf8427e-x", false},
+		{"not-hex-at-all-not-hex-at-all-xx-3", false},
+		{"18d7a1b2c3-2a", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := IsMultipartETag(tt.etag); got != tt.want {
+			t.Errorf("IsMultipartETag(%q) = %v, want %v", tt.etag, got, tt.want)
+		}
+	}
+}
+
+func TestCompareETags(t *testing.T) {
+	const (
+		simple    = "9b2cf535f27731c974343645a3985328"
+		multipart = "d41d8cd98f00b204e9800998ecf8427e-12"
+	)
+	tests := []struct {
+		name            string
+		stored, current string
+		trustMultipart  bool
+		wantMatch       bool
+		wantVerify      bool
+	}{
+		{"simple match is trusted", simple, simple, false, true, false},
+		{"simple match ignores quotes", simple, `"` + simple + `"`, false, true, false},
+		{"simple mismatch", simple, "0cc175b9c0f1b6a831c399e269772661", false, false, false},
+		{"multipart match needs verification", multipart, multipart, false, true, true},
+		{"multipart match trusted when configured", multipart, multipart, true, true, false},
+		{"multipart mismatch", multipart, "d41d8cd98f00b204e9800998ecf8427e-13", false, false, false},
+		{"nothing stored", "", simple, false, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			match, verify := CompareETags(tt.stored, tt.current, tt.trustMultipart)
+			if match != tt.wantMatch || verify != tt.wantVerify {
+				t.Errorf("CompareETags(%q, %q, %v) = %v, %v; want %v, %v",
+					tt.stored, tt.current, tt.trustMultipart, match, verify, tt.wantMatch, tt.wantVerify)
+			}
+		})
+	}
+}
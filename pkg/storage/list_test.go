@@ -0,0 +1,206 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// newPagedListServer serves ListObjectsV2 as two pages joined by a
+// continuation token and records the query of every request.
+func newPagedListServer(t *testing.T) (*httptest.Server, func() []map[string]string) {
+	t.Helper()
+
+	var (
+		mu      sync.Mutex
+		queries []map[string]string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		mu.Lock()
+		queries = append(queries, map[string]string{
+			"prefix":             q.Get("prefix"),
+			"continuation-token": q.Get("continuation-token"),
+			"max-keys":           q.Get("max-keys"),
+		})
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/xml")
+		switch q.Get("continuation-token") {
+		case "":
+			fmt.Fprint(w, `<ListBucketResult><Name>test-bucket</Name>`+
+				`<Contents><Key>images/a.tar</Key></Contents>`+
+				`<Contents><Key>images/b.tar</Key></Contents>`+
+				`<IsTruncated>true</IsTruncated>`+
+				`<NextContinuationToken>page-2</NextContinuationToken></ListBucketResult>`)
+		case "page-2":
+			fmt.Fprint(w, `<ListBucketResult><Name>test-bucket</Name>`+
+				`<Contents><Key>images/c.tar</Key></Contents>`+
+				`<IsTruncated>false</IsTruncated></ListBucketResult>`)
+		default:
+			http.Error(w, "unknown token", http.StatusBadRequest)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, func() []map[string]string {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(queries)
+	}
+}
+
+func TestListObjectsPage(t *testing.T) {
+	srv, queries := newPagedListServer(t)
+	client := clientForEndpoint(srv.URL)
+	ctx := context.Background()
+
+	keys, next, err := client.ListObjectsPage(ctx, "images/", "", 2)
+	if err != nil {
+		t.Fatalf("first page: %v", err)
+	}
+	if !slices.Equal(keys, []string{"images/a.tar", "images/b.tar"}) {
+		t.Errorf("first page keys = %v", keys)
+	}
+	if next != "page-2" {
+		t.Fatalf("next token = %q, want page-2", next)
+	}
+
+	keys, next, err = client.ListObjectsPage(ctx, "images/", next, 2)
+	if err != nil {
+		t.Fatalf("second page: %v", err)
+	}
+	if !slices.Equal(keys, []string{"images/c.tar"}) {
+		t.Errorf("second page keys = %v", keys)
+	}
+	if next != "" {
+		t.Errorf("next token on last page = %q, want empty", next)
+	}
+
+	got := queries()
+	if len(got) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(got))
+	}
+	for i, want := range []string{"", "page-2"} {
+		if got[i]["continuation-token"] != want {
+			t.Errorf("request %d continuation-token = %q, want %q", i, got[i]["continuation-token"], want)
+		}
+		if got[i]["max-keys"] != "2" {
+			t.Errorf("request %d max-keys = %q, want 2", i, got[i]["max-keys"])
+		}
+		if got[i]["prefix"] != "images/" {
+			t.Errorf("request %d prefix = %q, want images/", i, got[i]["prefix"])
+		}
+	}
+}
+
+func TestListObjects_FollowsPages(t *testing.T) {
+	srv, queries := newPagedListServer(t)
+	client := clientForEndpoint(srv.URL)
+
+	keys, err := client.ListObjects(context.Background(), "images/")
+	if err != nil {
+		t.Fatalf("ListObjects: %v", err)
+	}
+	want := []string{"images/a.tar", "images/b.tar", "images/c.tar"}
+	if !slices.Equal(keys, want) {
+		t.Errorf("keys = %v, want %v", keys, want)
+	}
+
+	got := queries()
+	if len(got) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(got))
+	}
+	if got[0]["max-keys"] != "" {
+		t.Errorf("max-keys sent without a limit: %q", got[0]["max-keys"])
+	}
+	if got[1]["continuation-token"] != "page-2" {
+		t.Errorf("second request token = %q, want page-2", got[1]["continuation-token"])
+	}
+}
+
+// newBucketServer serves ListObjectsV2 over keys, honoring max-keys (1000
+// when unset) with continuation tokens that are offsets into keys. It
+// counts the keys it has returned.
+func newBucketServer(t *testing.T, keys []string) (*httptest.Server, func() int) {
+	t.Helper()
+
+	var (
+		mu     sync.Mutex
+		served int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		start, _ := strconv.Atoi(q.Get("continuation-token"))
+		maxKeys := 1000
+		if v := q.Get("max-keys"); v != "" {
+			maxKeys, _ = strconv.Atoi(v)
+		}
+		end := min(start+maxKeys, len(keys))
+
+		mu.Lock()
+		served += end - start
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/xml")
+		fmt.Fprint(w, `<ListBucketResult><Name>test-bucket</Name>`)
+		for _, key := range keys[start:end] {
+			fmt.Fprintf(w, `<Contents><Key>%s</Key></Contents>`, key)
+		}
+		if end < len(keys) {
+			fmt.Fprintf(w, `<IsTruncated>true</IsTruncated><NextContinuationToken>%d</NextContinuationToken>`, end)
+		} else {
+			fmt.Fprint(w, `<IsTruncated>false</IsTruncated>`)
+		}
+		fmt.Fprint(w, `</ListBucketResult>`)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return served
+	}
+}
+
+func TestListObjectsLimit(t *testing.T) {
+	var bucket []string
+	for i := 0; i < 2500; i++ {
+		bucket = append(bucket, fmt.Sprintf("images/%04d.tar", i))
+	}
+	srv, served := newBucketServer(t, bucket)
+	client := clientForEndpoint(srv.URL)
+	ctx := context.Background()
+
+	// Spans three pages of the S3 default size
+	keys, next, err := client.ListObjectsLimit(ctx, "images/", "", 2100)
+	if err != nil {
+		t.Fatalf("ListObjectsLimit: %v", err)
+	}
+	if !slices.Equal(keys, bucket[:2100]) {
+		t.Errorf("listed %d keys, want the first 2100", len(keys))
+	}
+	if got := served(); got != 2100 {
+		t.Errorf("bucket served %d keys, want exactly 2100", got)
+	}
+	if next == "" {
+		t.Fatal("no continuation token with keys left in the prefix")
+	}
+
+	// Resuming picks up right after the last key listed
+	keys, next, err = client.ListObjectsLimit(ctx, "images/", next, 1000)
+	if err != nil {
+		t.Fatalf("ListObjectsLimit resume: %v", err)
+	}
+	if !slices.Equal(keys, bucket[2100:]) {
+		t.Errorf("resumed listing has %d keys, want the last 400", len(keys))
+	}
+	if next != "" {
+		t.Errorf("next token after the last key = %q, want empty", next)
+	}
+}
@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/fly-io/162719/pkg/errors"
+)
+
+// LocalSource serves image tarballs from a local directory, for testing
+// without S3. Keys are paths relative to the root directory.
+type LocalSource struct {
+	root          string
+	hashAlgorithm string
+	hashFunc      func() hash.Hash
+}
+
+// NewLocalSource creates a source rooted at dir
+func NewLocalSource(dir string, opts ClientOptions) (*LocalSource, error) {
+	slog.Info("local_source_init", "root", dir)
+
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to resolve source dir")
+	}
+	fi, err := os.Stat(root)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open source dir")
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("source dir %s is not a directory", root)
+	}
+
+	return &LocalSource{
+		root:          root,
+		hashAlgorithm: opts.HashAlgorithm,
+		hashFunc:      opts.HashFunc,
+	}, nil
+}
+
+// path maps a key to a file under the root, rejecting keys that would
+// escape it
+func (s *LocalSource) path(key string) (string, error) {
+	rel := filepath.FromSlash(key)
+	if !filepath.IsLocal(rel) {
+		return "", errors.Fatal(fmt.Errorf("invalid key %q: must be a relative path inside the source dir", key))
+	}
+	return filepath.Join(s.root, rel), nil
+}
+
+// Download copies a file from the source dir and computes its digest
+func (s *LocalSource) Download(ctx context.Context, key, localPath string) (*DownloadResult, error) {
+	slog.Info("local_download_start", "root", s.root, "key", key)
+
+	srcPath, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	src, err := os.Open(srcPath)
+	if os.IsNotExist(err) {
+		return nil, errors.Fatal(fmt.Errorf("%w: %w", ErrNotFound, err))
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open source file")
+	}
+	defer src.Close()
+
+	fi, err := src.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to stat source file")
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, errors.Fatal(fmt.Errorf("%s is not a regular file", key))
+	}
+
+	f, err := os.Create(localPath)
+	if err != nil {
+		slog.Error("local_file_creation_failed", "path", localPath, "error", err)
+		return nil, errors.Wrap(err, "failed to create local file")
+	}
+	defer f.Close()
+
+	hash := s.hashFunc()
+	size, err := io.Copy(io.MultiWriter(f, hash), src)
+	if err != nil {
+		slog.Error("local_download_failed", "key", key, "error", err)
+		return nil, errors.Wrap(err, "failed to copy file")
+	}
+
+	checksum := hex.EncodeToString(hash.Sum(nil))
+
+	slog.Info("local_download_complete",
+		"key", key,
+		"size_mb", size/1024/1024,
+		"local_path", localPath,
+		"algorithm", s.hashAlgorithm,
+		"digest", checksum[:16]+"...",
+	)
+
+	return &DownloadResult{
+		LocalPath:    localPath,
+		Algorithm:    s.hashAlgorithm,
+		Digest:       FormatDigest(s.hashAlgorithm, checksum),
+		Size:         size,
+		ETag:         localETag(fi),
+		LastModified: fi.ModTime(),
+	}, nil
+}
+
+// Head returns file metadata. The ETag is derived from size and
+// modification time, so it changes whenever the file is replaced.
+func (s *LocalSource) Head(ctx context.Context, key string) (*ObjectInfo, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to stat file")
+	}
+	return &ObjectInfo{
+		ETag:         localETag(fi),
+		LastModified: fi.ModTime(),
+		Size:         fi.Size(),
+	}, nil
+}
+
+// Exists checks if a regular file exists for key
+func (s *LocalSource) Exists(ctx context.Context, key string) (bool, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return false, err
+	}
+	fi, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "failed to check file existence")
+	}
+	return fi.Mode().IsRegular(), nil
+}
+
+// List returns the keys of all regular files under the root starting
+// with prefix, sorted
+func (s *LocalSource) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(s.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list files")
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func localETag(fi os.FileInfo) string {
+	return fmt.Sprintf("%x-%x", fi.ModTime().UnixNano(), fi.Size())
+}
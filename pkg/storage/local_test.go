@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// newTestLocalSource writes files into a temp dir and returns a source rooted there
+func newTestLocalSource(t *testing.T, files map[string]string) *LocalSource {
+	t.Helper()
+
+	root := t.TempDir()
+	for key, body := range files {
+		p := filepath.Join(root, filepath.FromSlash(key))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("failed to create dir: %v", err)
+		}
+		if err := os.WriteFile(p, []byte(body), 0644); err != nil {
+			t.Fatalf("failed to write %s: %v", key, err)
+		}
+	}
+
+	source, err := NewLocalSource(root, ClientOptions{})
+	if err != nil {
+		t.Fatalf("NewLocalSource failed: %v", err)
+	}
+	return source
+}
+
+func TestLocalSource_DownloadMatchesS3(t *testing.T) {
+	objects := map[string]string{"images/alpine.tar": "tarball bytes"}
+	local := newTestLocalSource(t, objects)
+	remote := newTestClient(t, objects)
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	got, err := local.Download(ctx, "images/alpine.tar", filepath.Join(dir, "local.tar"))
+	if err != nil {
+		t.Fatalf("local Download failed: %v", err)
+	}
+	want, err := remote.Download(ctx, "images/alpine.tar", filepath.Join(dir, "s3.tar"))
+	if err != nil {
+		t.Fatalf("S3 Download failed: %v", err)
+	}
+
+	if got.Algorithm != want.Algorithm || got.Digest != want.Digest || got.Size != want.Size {
+		t.Errorf("local result = %s %s %d, want %s %s %d",
+			got.Algorithm, got.Digest, got.Size, want.Algorithm, want.Digest, want.Size)
+	}
+	if got.ETag == "" || got.LastModified.IsZero() {
+		t.Errorf("expected ETag and LastModified to be set, got %q %v", got.ETag, got.LastModified)
+	}
+
+	info, err := local.Head(ctx, "images/alpine.tar")
+	if err != nil {
+		t.Fatalf("Head failed: %v", err)
+	}
+	if info.ETag != got.ETag || info.Size != got.Size {
+		t.Errorf("Head = %+v, want ETag %q size %d", info, got.ETag, got.Size)
+	}
+}
+
+func TestLocalSource_ExistsAndList(t *testing.T) {
+	local := newTestLocalSource(t, map[string]string{
+		"images/a.tar": "a",
+		"images/b.tar": "b",
+		"other/c.tar":  "c",
+	})
+	ctx := context.Background()
+
+	keys, err := local.List(ctx, "images/")
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if want := []string{"images/a.tar", "images/b.tar"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("List = %v, want %v", keys, want)
+	}
+
+	tests := []struct {
+		key    string
+		exists bool
+	}{
+		{"images/a.tar", true},
+		{"images/missing.tar", false},
+		{"images", false}, // directories are not objects
+	}
+	for _, tt := range tests {
+		exists, err := local.Exists(ctx, tt.key)
+		if err != nil {
+			t.Errorf("Exists(%s) failed: %v", tt.key, err)
+		}
+		if exists != tt.exists {
+			t.Errorf("Exists(%s) = %v, want %v", tt.key, exists, tt.exists)
+		}
+	}
+}
+
+func TestLocalSource_RejectsEscapingKeys(t *testing.T) {
+	local := newTestLocalSource(t, map[string]string{"a.tar": "a"})
+	ctx := context.Background()
+
+	for _, key := range []string{"../etc/passwd", "/etc/passwd", "images/../../x"} {
+		if _, err := local.Download(ctx, key, filepath.Join(t.TempDir(), "out")); err == nil {
+			t.Errorf("Download(%q) expected error", key)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fly-io/162719/pkg/errors"
+)
+
+// newRangeClient returns a ranged-download Client whose fake S3 serves body
+// under every key. When ranges is false the server ignores Range headers
+// and always answers with the whole object.
+func newRangeClient(t *testing.T, body []byte, ranges bool, rangedGets *atomic.Int32) *Client {
+	t.Helper()
+	modified := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"image-etag"`)
+		if !ranges {
+			r.Header.Del("Range")
+		}
+		if r.Header.Get("Range") != "" {
+			rangedGets.Add(1)
+		}
+		http.ServeContent(w, r, "", modified, bytes.NewReader(body))
+	}))
+	t.Cleanup(srv.Close)
+
+	c := clientForEndpoint(srv.URL)
+	c.partSize = 1000
+	c.concurrency = 4
+	return c
+}
+
+func TestDownload_RangedReassemblesObject(t *testing.T) {
+	body := []byte(strings.Repeat("0123456789abcdef", 640)) // 10240 bytes, 11 parts
+	sum := sha256.Sum256(body)
+	want := FormatDigest(DefaultHashAlgorithm, hex.EncodeToString(sum[:]))
+
+	tests := []struct {
+		name       string
+		ranges     bool
+		wantRanged bool
+	}{
+		{name: "ranged", ranges: true, wantRanged: true},
+		{name: "range unsupported falls back", ranges: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rangedGets atomic.Int32
+			client := newRangeClient(t, body, tt.ranges, &rangedGets)
+			localPath := filepath.Join(t.TempDir(), "img.tar")
+
+			result, err := client.Download(context.Background(), "images/big.tar", localPath)
+			if err != nil {
+				t.Fatalf("download failed: %v", err)
+			}
+			if result.Digest != want {
+				t.Errorf("digest = %s, want %s", result.Digest, want)
+			}
+			if result.Size != int64(len(body)) {
+				t.Errorf("size = %d, want %d", result.Size, len(body))
+			}
+			if result.ETag != "image-etag" {
+				t.Errorf("etag = %q, want image-etag", result.ETag)
+			}
+
+			data, err := os.ReadFile(localPath)
+			if err != nil {
+				t.Fatalf("read download: %v", err)
+			}
+			if !bytes.Equal(data, body) {
+				t.Error("reassembled file differs from the object")
+			}
+
+			if got := int(rangedGets.Load()); tt.wantRanged && got != 11 {
+				t.Errorf("ranged GETs = %d, want 11", got)
+			}
+		})
+	}
+}
+
+func TestDownload_SmallObjectUsesSingleStream(t *testing.T) {
+	var rangedGets atomic.Int32
+	client := newRangeClient(t, []byte("small image"), true, &rangedGets)
+
+	if _, err := client.Download(context.Background(), "images/small.tar", filepath.Join(t.TempDir(), "img.tar")); err != nil {
+		t.Fatalf("download failed: %v", err)
+	}
+	if got := rangedGets.Load(); got != 0 {
+		t.Errorf("ranged GETs = %d, want 0 for an object smaller than one part", got)
+	}
+}
+
+func TestSplitRanges(t *testing.T) {
+	got := splitRanges(2500, 1000)
+	want := []byteRange{{0, 999}, {1000, 1999}, {2000, 2499}}
+	if len(got) != len(want) {
+		t.Fatalf("splitRanges = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("part %d = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestDownload_RangedVerifiesS3Checksum(t *testing.T) {
+	body := []byte(strings.Repeat("0123456789abcdef", 640))
+	sum := sha256.Sum256(body)
+	other := sha256.Sum256([]byte("other contents"))
+
+	tests := []struct {
+		name      string
+		checksum  string
+		algorithm string
+		wantErr   bool
+	}{
+		{name: "matching", checksum: base64.StdEncoding.EncodeToString(sum[:]), algorithm: "sha256"},
+		{name: "matching with another digest algorithm", checksum: base64.StdEncoding.EncodeToString(sum[:]), algorithm: "sha512"},
+		{name: "mismatching", checksum: base64.StdEncoding.EncodeToString(other[:]), algorithm: "sha256", wantErr: true},
+		{name: "mismatching with another digest algorithm", checksum: base64.StdEncoding.EncodeToString(other[:]), algorithm: "sha512", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var headChecksumMode string
+			var rangedGets atomic.Int32
+			modified := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("ETag", `"image-etag"`)
+				// S3 only reports the full-object checksum for whole-object requests
+				if r.Header.Get("Range") == "" {
+					w.Header().Set("x-amz-checksum-sha256", tt.checksum)
+				} else {
+					rangedGets.Add(1)
+				}
+				if r.Method == http.MethodHead {
+					headChecksumMode = r.Header.Get("x-amz-checksum-mode")
+				}
+				http.ServeContent(w, r, "", modified, bytes.NewReader(body))
+			}))
+			defer srv.Close()
+
+			client := clientForEndpoint(srv.URL)
+			client.partSize = 1000
+			client.concurrency = 4
+			client.hashAlgorithm = tt.algorithm
+			client.hashFunc = hashAlgorithms[tt.algorithm]
+			localPath := filepath.Join(t.TempDir(), "img.tar")
+
+			_, err := client.Download(context.Background(), "images/big.tar", localPath)
+			if headChecksumMode != "ENABLED" {
+				t.Errorf("HEAD x-amz-checksum-mode = %q, want ENABLED", headChecksumMode)
+			}
+			if rangedGets.Load() == 0 {
+				t.Fatal("download was not ranged")
+			}
+			if tt.wantErr {
+				if !errors.Is(err, ErrChecksumMismatch) {
+					t.Fatalf("err = %v, want a checksum mismatch", err)
+				}
+				if _, err := os.Stat(localPath); !os.IsNotExist(err) {
+					t.Errorf("mismatching download left at %s (%v)", localPath, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("download failed: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,592 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/fly-io/162719/pkg/errors"
+	"github.com/fly-io/162719/pkg/oci"
+)
+
+// Registry media types beyond the single-image ones oci understands
+const (
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+const (
+	// dockerHubRegistry is where references without a registry host resolve
+	dockerHubRegistry = "registry-1.docker.io"
+	// maxManifestSize bounds manifest and token documents read into memory
+	maxManifestSize = 4 * 1024 * 1024
+)
+
+// manifestAccept lists the manifest types asked for, single images first
+var manifestAccept = strings.Join([]string{
+	oci.MediaTypeImageManifest,
+	oci.MediaTypeDockerManifest,
+	oci.MediaTypeImageIndex,
+	mediaTypeDockerManifestList,
+}, ", ")
+
+// Reference is a parsed container image reference such as
+// "ghcr.io/org/app:1.2" or "alpine@sha256:<hex>"
+type Reference struct {
+	Registry   string
+	Repository string
+	// Tag or Digest; Digest wins when both are given
+	Tag    string
+	Digest string
+}
+
+// ParseReference parses an image reference. As with docker, the first
+// path component is the registry host only if it contains a dot or a
+// port, or is "localhost"; otherwise the image is on Docker Hub, where
+// single-component names live under "library/". The tag defaults to
+// "latest".
+func ParseReference(ref string) (Reference, error) {
+	var r Reference
+	name := ref
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, r.Digest = name[:i], name[i+1:]
+		if algorithm, hexDigest, ok := strings.Cut(r.Digest, ":"); !ok || algorithm == "" || hexDigest == "" {
+			return r, fmt.Errorf("invalid reference %q: malformed digest", ref)
+		}
+	}
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, r.Tag = name[:i], name[i+1:]
+		if r.Tag == "" {
+			return r, fmt.Errorf("invalid reference %q: empty tag", ref)
+		}
+	}
+
+	host, rest, ok := strings.Cut(name, "/")
+	if ok && (strings.ContainsAny(host, ".:") || host == "localhost") {
+		r.Registry, r.Repository = host, rest
+	} else {
+		r.Registry, r.Repository = dockerHubRegistry, name
+		if !strings.Contains(name, "/") {
+			r.Repository = "library/" + name
+		}
+	}
+	if r.Repository == "" || strings.Contains(r.Repository, "//") || strings.HasSuffix(r.Repository, "/") {
+		return r, fmt.Errorf("invalid reference %q: bad repository name", ref)
+	}
+	if r.Repository != strings.ToLower(r.Repository) {
+		return r, fmt.Errorf("invalid reference %q: repository must be lowercase", ref)
+	}
+	if r.Tag == "" && r.Digest == "" {
+		r.Tag = "latest"
+	}
+	return r, nil
+}
+
+// manifestRef is the tag or digest manifests are requested by
+func (r Reference) manifestRef() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
+
+// String returns the reference in canonical form
+func (r Reference) String() string {
+	s := r.Registry + "/" + r.Repository
+	if r.Digest != "" {
+		return s + "@" + r.Digest
+	}
+	return s + ":" + r.Tag
+}
+
+// RegistrySource pulls images from an OCI distribution (Docker v2)
+// registry. Keys are image references; each download resolves the
+// reference to a single image for the host platform and writes it as an
+// OCI image layout tarball, which validation unpacks like any other OCI
+// layout. Only anonymous pulls are supported, including the bearer token
+// handshake public registries use.
+type RegistrySource struct {
+	client        *http.Client
+	hashAlgorithm string
+	hashFunc      func() hash.Hash
+	platform      string // "os/arch" picked from multi-platform indexes
+}
+
+// NewRegistrySource creates a registry source. A nil client uses one with
+// a generous overall timeout.
+func NewRegistrySource(client *http.Client, opts ClientOptions) (*RegistrySource, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Minute}
+	}
+	return &RegistrySource{
+		client:        client,
+		hashAlgorithm: opts.HashAlgorithm,
+		hashFunc:      opts.HashFunc,
+		platform:      "linux/" + runtime.GOARCH,
+	}, nil
+}
+
+// registryPull is the state of one pull against a repository: its parsed
+// reference and the bearer token once one has been obtained
+type registryPull struct {
+	s     *RegistrySource
+	ref   Reference
+	token string
+}
+
+func (s *RegistrySource) pull(key string) (*registryPull, error) {
+	ref, err := ParseReference(key)
+	if err != nil {
+		return nil, errors.Fatal(err)
+	}
+	return &registryPull{s: s, ref: ref}, nil
+}
+
+// baseURL returns the registry's API root. Loopback registries are spoken
+// to over plain HTTP, as docker does for local development registries.
+func (p *registryPull) baseURL() string {
+	scheme := "https"
+	host := p.ref.Registry
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		scheme = "http"
+	}
+	return scheme + "://" + p.ref.Registry + "/v2/" + p.ref.Repository
+}
+
+// do sends a request, answering a bearer challenge once if the registry
+// asks for one. The caller closes the response body.
+func (p *registryPull) do(ctx context.Context, method, rawURL, accept string) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, rawURL, nil)
+		if err != nil {
+			return nil, errors.Fatal(errors.Wrap(err, "invalid registry request"))
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if p.token != "" {
+			req.Header.Set("Authorization", "Bearer "+p.token)
+		}
+
+		resp, err := p.s.client.Do(req)
+		if err != nil {
+			return nil, errors.Transient(fmt.Errorf("%s %s: %w: %w", method, rawURL, ErrNetwork, err))
+		}
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			challenge := resp.Header.Get("WWW-Authenticate")
+			resp.Body.Close()
+			if err := p.authenticate(ctx, challenge); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := registryStatusError(resp, method+" "+rawURL); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		return resp, nil
+	}
+}
+
+// authenticate fetches an anonymous pull token for a bearer challenge
+func (p *registryPull) authenticate(ctx context.Context, challenge string) error {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return errors.Fatal(fmt.Errorf("%w: registry requires unsupported %q authentication", ErrAccessDenied, scheme))
+	}
+	attrs := parseChallenge(params)
+	if attrs["realm"] == "" {
+		return errors.Fatal(fmt.Errorf("%w: bearer challenge without realm", ErrAccessDenied))
+	}
+
+	tokenURL, err := url.Parse(attrs["realm"])
+	if err != nil {
+		return errors.Fatal(errors.Wrap(err, "invalid token realm"))
+	}
+	q := tokenURL.Query()
+	if attrs["service"] != "" {
+		q.Set("service", attrs["service"])
+	}
+	scope := attrs["scope"]
+	if scope == "" {
+		scope = "repository:" + p.ref.Repository + ":pull"
+	}
+	q.Set("scope", scope)
+	tokenURL.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tokenURL.String(), nil)
+	if err != nil {
+		return errors.Fatal(errors.Wrap(err, "invalid token request"))
+	}
+	resp, err := p.s.client.Do(req)
+	if err != nil {
+		return errors.Transient(fmt.Errorf("token request: %w: %w", ErrNetwork, err))
+	}
+	defer resp.Body.Close()
+	if err := registryStatusError(resp, "token request"); err != nil {
+		return err
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(&body); err != nil {
+		return errors.Transient(errors.Wrap(err, "invalid token response"))
+	}
+	p.token = body.Token
+	if p.token == "" {
+		p.token = body.AccessToken
+	}
+	if p.token == "" {
+		return errors.Fatal(fmt.Errorf("%w: token response carried no token", ErrAccessDenied))
+	}
+	return nil
+}
+
+// parseChallenge splits the key="value" pairs of a WWW-Authenticate header
+func parseChallenge(params string) map[string]string {
+	attrs := make(map[string]string)
+	for params != "" {
+		var pair string
+		key, rest, ok := strings.Cut(strings.TrimLeft(params, ", "), "=")
+		if !ok {
+			break
+		}
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				break
+			}
+			pair, params = rest[1:end+1], rest[end+2:]
+		} else {
+			pair, params, _ = strings.Cut(rest, ",")
+		}
+		attrs[strings.ToLower(strings.TrimSpace(key))] = pair
+	}
+	return attrs
+}
+
+// registryStatusError maps a non-2xx registry response onto the download
+// error kinds. Server errors and throttling are left transient.
+func registryStatusError(resp *http.Response, op string) error {
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusNotFound:
+		return errors.Fatal(fmt.Errorf("%s: %w: %s", op, ErrNotFound, resp.Status))
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return errors.Fatal(fmt.Errorf("%s: %w: %s", op, ErrAccessDenied, resp.Status))
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return errors.Transient(fmt.Errorf("%s: %s", op, resp.Status))
+	}
+	return errors.Fatal(fmt.Errorf("%s: unexpected status %s", op, resp.Status))
+}
+
+// fetchManifest returns a manifest document, its media type and digest.
+// When the registry reports the digest it must match the content.
+func (p *registryPull) fetchManifest(ctx context.Context, ref string) ([]byte, string, string, error) {
+	resp, err := p.do(ctx, http.MethodGet, p.baseURL()+"/manifests/"+ref, manifestAccept)
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return nil, "", "", errors.Transient(fmt.Errorf("read manifest: %w: %w", ErrNetwork, err))
+	}
+	if len(data) > maxManifestSize {
+		return nil, "", "", errors.Fatal(fmt.Errorf("manifest %s exceeds %d bytes", ref, maxManifestSize))
+	}
+
+	digest := FormatDigest("sha256", sha256Hex(data))
+	if want := resp.Header.Get("Docker-Content-Digest"); want != "" && want != digest {
+		return nil, "", "", errors.Fatal(fmt.Errorf("manifest %s digest mismatch: registry says %s, content is %s", ref, want, digest))
+	}
+	// A manifest requested by digest must have that digest
+	if algorithm, hexDigest, ok := strings.Cut(ref, ":"); ok {
+		newHash, err := HashFunc(algorithm)
+		if err != nil {
+			return nil, "", "", errors.Fatal(err)
+		}
+		h := newHash()
+		h.Write(data)
+		if got := hex.EncodeToString(h.Sum(nil)); got != hexDigest {
+			return nil, "", "", errors.Fatal(fmt.Errorf("manifest digest mismatch: requested %s, got %s:%s", ref, algorithm, got))
+		}
+	}
+
+	mediaType, _, _ := strings.Cut(resp.Header.Get("Content-Type"), ";")
+	var doc struct {
+		MediaType string `json:"mediaType"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, "", "", errors.Fatal(errors.Wrap(err, "invalid manifest"))
+	}
+	if doc.MediaType != "" {
+		mediaType = doc.MediaType
+	}
+	return data, strings.TrimSpace(mediaType), digest, nil
+}
+
+// resolve fetches the reference's manifest, following a multi-platform
+// index to the manifest for this source's platform. It returns the image
+// manifest, its descriptor, and the digest of the document the reference
+// pointed at (the index, for multi-platform images).
+func (p *registryPull) resolve(ctx context.Context) (*oci.Manifest, oci.Descriptor, []byte, string, error) {
+	data, mediaType, topDigest, err := p.fetchManifest(ctx, p.ref.manifestRef())
+	if err != nil {
+		return nil, oci.Descriptor{}, nil, "", err
+	}
+
+	if mediaType == oci.MediaTypeImageIndex || mediaType == mediaTypeDockerManifestList {
+		var index struct {
+			Manifests []struct {
+				oci.Descriptor
+				Platform struct {
+					OS           string `json:"os"`
+					Architecture string `json:"architecture"`
+				} `json:"platform"`
+			} `json:"manifests"`
+		}
+		if err := json.Unmarshal(data, &index); err != nil {
+			return nil, oci.Descriptor{}, nil, "", errors.Fatal(errors.Wrap(err, "invalid image index"))
+		}
+		var chosen string
+		for _, m := range index.Manifests {
+			if m.Platform.OS+"/"+m.Platform.Architecture == p.s.platform {
+				chosen = m.Digest
+				break
+			}
+		}
+		if chosen == "" {
+			return nil, oci.Descriptor{}, nil, "", errors.Fatal(fmt.Errorf("%s has no image for platform %s", p.ref, p.s.platform))
+		}
+		if data, mediaType, _, err = p.fetchManifest(ctx, chosen); err != nil {
+			return nil, oci.Descriptor{}, nil, "", err
+		}
+	}
+
+	if mediaType != oci.MediaTypeImageManifest && mediaType != oci.MediaTypeDockerManifest {
+		return nil, oci.Descriptor{}, nil, "", errors.Fatal(fmt.Errorf("unsupported manifest type %q", mediaType))
+	}
+	var manifest oci.Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, oci.Descriptor{}, nil, "", errors.Fatal(errors.Wrap(err, "invalid manifest"))
+	}
+	desc := oci.Descriptor{
+		MediaType: mediaType,
+		Digest:    FormatDigest("sha256", sha256Hex(data)),
+		Size:      int64(len(data)),
+	}
+	return &manifest, desc, data, topDigest, nil
+}
+
+// Download pulls the image and writes it to localPath as an OCI image
+// layout tarball. Every blob is checked against its descriptor as it is
+// copied. The ETag is the digest the reference resolved to, so a moved
+// tag is seen as a changed object.
+func (s *RegistrySource) Download(ctx context.Context, key, localPath string) (*DownloadResult, error) {
+	slog.Info("registry_download_start", "ref", key)
+
+	p, err := s.pull(key)
+	if err != nil {
+		return nil, err
+	}
+	manifest, manifestDesc, manifestData, topDigest, err := p.resolve(ctx)
+	if err != nil {
+		slog.Error("registry_resolve_failed", "ref", key, "error", err)
+		return nil, err
+	}
+
+	f, err := os.Create(localPath)
+	if err != nil {
+		slog.Error("local_file_creation_failed", "path", localPath, "error", err)
+		return nil, errors.Wrap(err, "failed to create local file")
+	}
+	defer f.Close()
+
+	fileHash := s.hashFunc()
+	counter := &countingWriter{w: io.MultiWriter(f, fileHash)}
+	tw := tar.NewWriter(counter)
+
+	layout, _ := json.Marshal(map[string]string{"imageLayoutVersion": "1.0.0"})
+	index, _ := json.Marshal(oci.Index{SchemaVersion: 2, Manifests: []oci.Descriptor{manifestDesc}})
+	for _, entry := range []struct {
+		name string
+		data []byte
+	}{
+		{"oci-layout", layout},
+		{"index.json", index},
+		{blobName(manifestDesc.Digest), manifestData},
+	} {
+		if err := writeTarFile(tw, entry.name, int64(len(entry.data)), bytes.NewReader(entry.data)); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "blobs/", Mode: 0755}); err != nil {
+		return nil, errors.Wrap(err, "failed to write layout")
+	}
+
+	blobs := append([]oci.Descriptor{manifest.Config}, manifest.Layers...)
+	for _, desc := range blobs {
+		if desc.Digest == "" {
+			continue
+		}
+		if err := p.copyBlob(ctx, tw, desc); err != nil {
+			slog.Error("registry_blob_failed", "ref", key, "digest", desc.Digest, "error", err)
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, errors.Wrap(err, "failed to write layout")
+	}
+	if err := f.Close(); err != nil {
+		return nil, errors.Wrap(err, "failed to write layout")
+	}
+
+	checksum := hex.EncodeToString(fileHash.Sum(nil))
+	slog.Info("registry_download_complete",
+		"ref", key,
+		"resolved", topDigest,
+		"layers", len(manifest.Layers),
+		"size_mb", counter.n/1024/1024,
+		"local_path", localPath,
+	)
+
+	return &DownloadResult{
+		LocalPath:    localPath,
+		Algorithm:    s.hashAlgorithm,
+		Digest:       FormatDigest(s.hashAlgorithm, checksum),
+		Size:         counter.n,
+		ETag:         topDigest,
+		LastModified: time.Now(),
+	}, nil
+}
+
+// copyBlob streams a blob into the layout, failing unless exactly
+// desc.Size bytes with desc.Digest arrive
+func (p *registryPull) copyBlob(ctx context.Context, tw *tar.Writer, desc oci.Descriptor) error {
+	algorithm, hexDigest, ok := strings.Cut(desc.Digest, ":")
+	newHash, err := HashFunc(algorithm)
+	if !ok || err != nil {
+		return errors.Fatal(fmt.Errorf("unsupported blob digest %q", desc.Digest))
+	}
+	if desc.Size < 0 {
+		return errors.Fatal(fmt.Errorf("blob %s has negative size", desc.Digest))
+	}
+
+	resp, err := p.do(ctx, http.MethodGet, p.baseURL()+"/blobs/"+desc.Digest, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	h := newHash()
+	body := io.TeeReader(resp.Body, h)
+	if err := writeTarFile(tw, blobName(desc.Digest), desc.Size, body); err != nil {
+		return err
+	}
+	if n, _ := io.Copy(io.Discard, io.LimitReader(resp.Body, 1)); n > 0 {
+		return errors.Fatal(fmt.Errorf("blob %s is larger than its descriptor size %d", desc.Digest, desc.Size))
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != hexDigest {
+		return errors.Fatal(fmt.Errorf("blob %s digest mismatch: got %s:%s", desc.Digest, algorithm, got))
+	}
+	return nil
+}
+
+// writeTarFile writes a regular file of exactly size bytes from r. A
+// short read is a truncated transfer and worth retrying.
+func writeTarFile(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: size}); err != nil {
+		return errors.Wrap(err, "failed to write layout")
+	}
+	if _, err := io.CopyN(tw, r, size); err != nil {
+		return errors.Transient(fmt.Errorf("copy %s: %w: %w", name, ErrNetwork, err))
+	}
+	return nil
+}
+
+// blobName is a blob's path inside an OCI image layout
+func blobName(digest string) string {
+	algorithm, hexDigest, _ := strings.Cut(digest, ":")
+	return "blobs/" + algorithm + "/" + hexDigest
+}
+
+// Head resolves the reference without pulling the image. The ETag is the
+// digest the reference points at and Size is that manifest's size.
+func (s *RegistrySource) Head(ctx context.Context, key string) (*ObjectInfo, error) {
+	p, err := s.pull(key)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.do(ctx, http.MethodHead, p.baseURL()+"/manifests/"+p.ref.manifestRef(), manifestAccept)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		// Not every registry reports the digest on HEAD
+		_, _, digest, err = p.fetchManifest(ctx, p.ref.manifestRef())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &ObjectInfo{ETag: digest, Size: resp.ContentLength}, nil
+}
+
+// Exists reports whether the reference resolves
+func (s *RegistrySource) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := s.Head(ctx, key)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// List is not supported: registries have no portable way to enumerate
+// images by prefix
+func (s *RegistrySource) List(ctx context.Context, prefix string) ([]string, error) {
+	return nil, errors.Fatal(fmt.Errorf("listing is not supported by the registry source"))
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func sha256Hex(data []byte) string {
+	h := hashAlgorithms["sha256"]()
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
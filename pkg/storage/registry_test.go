@@ -0,0 +1,269 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fly-io/162719/pkg/errors"
+	"github.com/fly-io/162719/pkg/oci"
+)
+
+func TestParseReference(t *testing.T) {
+	tests := []struct {
+		ref     string
+		want    Reference
+		wantErr bool
+	}{
+		{"alpine", Reference{Registry: dockerHubRegistry, Repository: "library/alpine", Tag: "latest"}, false},
+		{"alpine:3.20", Reference{Registry: dockerHubRegistry, Repository: "library/alpine", Tag: "3.20"}, false},
+		{"org/app:1", Reference{Registry: dockerHubRegistry, Repository: "org/app", Tag: "1"}, false},
+		{"ghcr.io/org/app:1.2", Reference{Registry: "ghcr.io", Repository: "org/app", Tag: "1.2"}, false},
+		{"localhost:5000/app", Reference{Registry: "localhost:5000", Repository: "app", Tag: "latest"}, false},
+		{"ghcr.io/org/app@sha256:abc", Reference{Registry: "ghcr.io", Repository: "org/app", Digest: "sha256:abc"}, false},
+		{"ghcr.io/org/app:1.2@sha256:abc", Reference{Registry: "ghcr.io", Repository: "org/app", Tag: "1.2", Digest: "sha256:abc"}, false},
+		{"ghcr.io/org/app:", Reference{}, true},
+		{"ghcr.io/org/app@abc", Reference{}, true},
+		{"ghcr.io/Org/App", Reference{}, true},
+		{"ghcr.io/", Reference{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			got, err := ParseReference(tt.ref)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ParseReference(%q) = %+v, want error", tt.ref, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseReference(%q): %v", tt.ref, err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseReference(%q) = %+v, want %+v", tt.ref, got, tt.want)
+			}
+		})
+	}
+}
+
+// testRegistry is a mock registry serving one single-layer image under
+// "app:1", behind an anonymous bearer token handshake
+type testRegistry struct {
+	srv       *httptest.Server
+	layer     []byte
+	manifest  []byte
+	blobs     map[string][]byte
+	tampered  bool // serve the layer with one byte flipped
+	tokenHits int
+}
+
+func sha256Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func newTestRegistry(t *testing.T) *testRegistry {
+	t.Helper()
+
+	var layerTar bytes.Buffer
+	gz := gzip.NewWriter(&layerTar)
+	tw := tar.NewWriter(gz)
+	body := "registry\n"
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0755})
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0644, Size: int64(len(body))})
+	io.WriteString(tw, body)
+	tw.Close()
+	gz.Close()
+
+	config := []byte(`{"architecture":"amd64","os":"linux"}`)
+	reg := &testRegistry{layer: layerTar.Bytes(), blobs: make(map[string][]byte)}
+	reg.blobs[sha256Digest(config)] = config
+	reg.blobs[sha256Digest(reg.layer)] = reg.layer
+
+	manifest, err := json.Marshal(oci.Manifest{
+		SchemaVersion: 2,
+		MediaType:     oci.MediaTypeImageManifest,
+		Config:        oci.Descriptor{MediaType: "application/vnd.oci.image.config.v1+json", Digest: sha256Digest(config), Size: int64(len(config))},
+		Layers:        []oci.Descriptor{{MediaType: oci.MediaTypeLayerGzip, Digest: sha256Digest(reg.layer), Size: int64(len(reg.layer))}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg.manifest = manifest
+
+	reg.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			reg.tokenHits++
+			if r.URL.Query().Get("scope") != "repository:org/app:pull" {
+				http.Error(w, "bad scope", http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(`{"token":"anonymous"}`))
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer anonymous" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+reg.srv.URL+`/token",service="test",scope="repository:org/app:pull"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch {
+		case r.URL.Path == "/v2/org/app/manifests/1" || r.URL.Path == "/v2/org/app/manifests/"+sha256Digest(reg.manifest):
+			w.Header().Set("Content-Type", oci.MediaTypeImageManifest)
+			w.Header().Set("Docker-Content-Digest", sha256Digest(reg.manifest))
+			w.Write(reg.manifest)
+		case strings.HasPrefix(r.URL.Path, "/v2/org/app/blobs/"):
+			blob, ok := reg.blobs[strings.TrimPrefix(r.URL.Path, "/v2/org/app/blobs/")]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			if reg.tampered && bytes.Equal(blob, reg.layer) {
+				blob = bytes.Clone(blob)
+				blob[len(blob)-1] ^= 0xff
+			}
+			w.Write(blob)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(reg.srv.Close)
+	return reg
+}
+
+// ref returns the reference of the registry's image
+func (reg *testRegistry) ref(tag string) string {
+	return strings.TrimPrefix(reg.srv.URL, "http://") + "/org/app:" + tag
+}
+
+func TestRegistrySource_DownloadWritesOCILayout(t *testing.T) {
+	reg := newTestRegistry(t)
+	source, err := NewRegistrySource(reg.srv.Client(), ClientOptions{})
+	if err != nil {
+		t.Fatalf("registry source: %v", err)
+	}
+
+	localPath := filepath.Join(t.TempDir(), "app.tar")
+	result, err := source.Download(context.Background(), reg.ref("1"), localPath)
+	if err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	if reg.tokenHits == 0 {
+		t.Error("bearer token was never requested")
+	}
+	if want := sha256Digest(reg.manifest); result.ETag != want {
+		t.Errorf("ETag = %q, want manifest digest %q", result.ETag, want)
+	}
+	if digest, err := FileDigest(localPath, "sha256"); err != nil || digest != result.Digest {
+		t.Errorf("Digest = %q, file digest %q (%v)", result.Digest, digest, err)
+	}
+	if fi, err := os.Stat(localPath); err != nil || fi.Size() != result.Size {
+		t.Errorf("Size = %d, file %v (%v)", result.Size, fi, err)
+	}
+
+	// The tarball is an OCI layout that unpacks to the layer's files
+	layoutDir := t.TempDir()
+	untar(t, localPath, layoutDir)
+	if !oci.IsLayout(layoutDir) {
+		t.Fatal("download is not an OCI image layout")
+	}
+	rootfs := t.TempDir()
+	err = oci.Unpack(layoutDir, func(layer io.Reader) error {
+		tr := tar.NewReader(layer)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			target := filepath.Join(rootfs, hdr.Name)
+			if hdr.Typeflag == tar.TypeDir {
+				os.MkdirAll(target, 0755)
+				continue
+			}
+			data, _ := io.ReadAll(tr)
+			if err := os.WriteFile(target, data, 0644); err != nil {
+				return err
+			}
+		}
+	})
+	if err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(rootfs, "etc/hostname")); err != nil || string(got) != "registry\n" {
+		t.Errorf("etc/hostname = %q (%v), want %q", got, err, "registry\n")
+	}
+}
+
+func TestRegistrySource_Errors(t *testing.T) {
+	reg := newTestRegistry(t)
+	source, err := NewRegistrySource(reg.srv.Client(), ClientOptions{})
+	if err != nil {
+		t.Fatalf("registry source: %v", err)
+	}
+	ctx := context.Background()
+	localPath := filepath.Join(t.TempDir(), "app.tar")
+
+	if _, err := source.Download(ctx, reg.ref("missing"), localPath); !errors.Is(err, ErrNotFound) {
+		t.Errorf("missing tag: err = %v, want ErrNotFound", err)
+	}
+	if ok, err := source.Exists(ctx, reg.ref("missing")); ok || err != nil {
+		t.Errorf("Exists(missing) = %v, %v; want false, nil", ok, err)
+	}
+	if ok, err := source.Exists(ctx, reg.ref("1")); !ok || err != nil {
+		t.Errorf("Exists(1) = %v, %v; want true, nil", ok, err)
+	}
+
+	reg.tampered = true
+	if _, err := source.Download(ctx, reg.ref("1"), localPath); err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+		t.Errorf("tampered layer: err = %v, want digest mismatch", err)
+	}
+}
+
+// untar extracts a flat test tarball into dir
+func untar(t *testing.T, path, dir string) {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			t.Fatalf("read tarball: %v", err)
+		}
+		target := filepath.Join(dir, hdr.Name)
+		if hdr.Typeflag == tar.TypeDir {
+			os.MkdirAll(target, 0755)
+			continue
+		}
+		os.MkdirAll(filepath.Dir(target), 0755)
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("read %s: %v", hdr.Name, err)
+		}
+		if err := os.WriteFile(target, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package storage
+
+import "context"
+
+// Source is where image tarballs are fetched from. Keys are slash-separated
+// object names, as in S3.
+type Source interface {
+	// Download copies the object to localPath and computes its digest
+	Download(ctx context.Context, key, localPath string) (*DownloadResult, error)
+	// Head returns object metadata without fetching the body
+	Head(ctx context.Context, key string) (*ObjectInfo, error)
+	// Exists reports whether the object exists
+	Exists(ctx context.Context, key string) (bool, error)
+	// List returns all keys starting with prefix
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+var (
+	_ Source = (*Client)(nil)
+	_ Source = (*LocalSource)(nil)
+	_ Source = (*RegistrySource)(nil)
+)
+
+// List lists all objects in the bucket with a given prefix
+func (c *Client) List(ctx context.Context, prefix string) ([]string, error) {
+	return c.ListObjects(ctx, prefix)
+}
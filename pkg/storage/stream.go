@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/fly-io/162719/pkg/errors"
+)
+
+// Streamer is implemented by sources that can hand out an object's body
+// as a stream, so callers can consume it without a copy on disk
+type Streamer interface {
+	// Open starts reading the object. The caller must Close it.
+	Open(ctx context.Context, key string) (*Object, error)
+}
+
+var (
+	_ Streamer = (*Client)(nil)
+	_ Streamer = (*LocalSource)(nil)
+)
+
+// Object is an open object body. Reads are teed into a hash, so the
+// digest is available once the body has been read to EOF. When the source
+// reported a SHA-256 for the object, the body is checked against it too.
+type Object struct {
+	Info      ObjectInfo
+	Algorithm string
+
+	key  string
+	body io.ReadCloser
+	tee  io.Reader
+	hash hash.Hash
+	sha  hash.Hash // SHA-256 of the body, with Info.ChecksumSHA256 set
+	read int64
+	eof  bool
+}
+
+func newObject(key string, body io.ReadCloser, info ObjectInfo, algorithm string, hashFunc func() hash.Hash) *Object {
+	h := hashFunc()
+	o := &Object{
+		Info:      info,
+		Algorithm: algorithm,
+		key:       key,
+		body:      body,
+		hash:      h,
+	}
+	writer := io.Writer(h)
+	if info.ChecksumSHA256 != "" {
+		o.sha = sha256.New()
+		writer = io.MultiWriter(h, o.sha)
+	}
+	o.tee = io.TeeReader(body, writer)
+	return o
+}
+
+func (o *Object) Read(p []byte) (int, error) {
+	n, err := o.tee.Read(p)
+	o.read += int64(n)
+	if err == io.EOF {
+		o.eof = true
+	} else if err != nil && o.sha != nil && o.read == o.Info.Size {
+		// The SDK checks the checksum itself and fails the read that ends
+		// the body; a complete body means the error is a mismatch
+		if verr := verifySHA256(o.key, o.Info.ChecksumSHA256, o.sha.Sum(nil)); verr != nil {
+			return n, verr
+		}
+	}
+	return n, err
+}
+
+// Close releases the underlying body
+func (o *Object) Close() error {
+	return o.body.Close()
+}
+
+// Size returns the number of bytes read so far
+func (o *Object) Size() int64 {
+	return o.read
+}
+
+// Digest returns the algorithm-prefixed digest of the body. It fails
+// unless the body was read to EOF, matched the advertised size and, when
+// the source reported one, matched its SHA-256.
+func (o *Object) Digest() (string, error) {
+	if !o.eof {
+		return "", fmt.Errorf("object not read to the end: %d bytes read", o.read)
+	}
+	if o.Info.Size > 0 && o.read != o.Info.Size {
+		return "", errors.Transient(fmt.Errorf("object truncated: read %d of %d bytes", o.read, o.Info.Size))
+	}
+	if o.sha != nil {
+		if err := verifySHA256(o.key, o.Info.ChecksumSHA256, o.sha.Sum(nil)); err != nil {
+			return "", err
+		}
+	}
+	return FormatDigest(o.Algorithm, hex.EncodeToString(o.hash.Sum(nil))), nil
+}
+
+// Open streams an object from S3
+func (c *Client) Open(ctx context.Context, s3Key string) (*Object, error) {
+	slog.Info("s3_open_start", "bucket", c.bucket, "s3_key", s3Key)
+
+	result, err := c.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket:       aws.String(c.bucket),
+		Key:          aws.String(s3Key),
+		ChecksumMode: types.ChecksumModeEnabled,
+	})
+	if err != nil {
+		slog.Error("s3_get_object_failed", "s3_key", s3Key, "error", err)
+		return nil, classifyS3Error(err, "failed to get object from S3")
+	}
+
+	info := ObjectInfo{
+		ETag:         normalizeETag(aws.ToString(result.ETag)),
+		LastModified: aws.ToTime(result.LastModified),
+		Size:         aws.ToInt64(result.ContentLength),
+		// Checked against the body as it is read
+		ChecksumSHA256: s3SHA256(s3Key, result.ChecksumSHA256),
+	}
+	return newObject(s3Key, result.Body, info, c.hashAlgorithm, c.hashFunc), nil
+}
+
+// Open streams a file from the source dir
+func (s *LocalSource) Open(ctx context.Context, key string) (*Object, error) {
+	slog.Info("local_open_start", "root", s.root, "key", key)
+
+	srcPath, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	src, err := os.Open(srcPath)
+	if os.IsNotExist(err) {
+		return nil, errors.Fatal(fmt.Errorf("%w: %w", ErrNotFound, err))
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open source file")
+	}
+
+	fi, err := src.Stat()
+	if err != nil {
+		src.Close()
+		return nil, errors.Wrap(err, "failed to stat source file")
+	}
+	if !fi.Mode().IsRegular() {
+		src.Close()
+		return nil, errors.Fatal(fmt.Errorf("%s is not a regular file", key))
+	}
+
+	info := ObjectInfo{ETag: localETag(fi), LastModified: fi.ModTime(), Size: fi.Size()}
+	return newObject(key, src, info, s.hashAlgorithm, s.hashFunc), nil
+}